@@ -79,6 +79,40 @@ func InfoHashFromString(s string) InfoHash {
 	return InfoHash(buf)
 }
 
+// InfoHashV2Len is the length of a BitTorrent v2 infohash, the SHA-256 hash
+// of the info dictionary specified by BEP 52.
+const InfoHashV2Len = 32
+
+// InfoHashFromV2 creates an InfoHash from a BitTorrent v2 infohash.
+//
+// As specified by BEP 52 for trackers, the infohash is truncated to 20 bytes,
+// so that clients announcing the full v2 infohash join the swarm of clients
+// announcing the truncated one, including the v2 swarm of hybrid torrents.
+//
+// It panics if b is not 32 bytes long.
+func InfoHashFromV2(b []byte) InfoHash {
+	if len(b) != InfoHashV2Len {
+		panic("v2 infohash must be 32 bytes")
+	}
+
+	return InfoHashFromBytes(b[:20])
+}
+
+// ParseInfoHash creates an InfoHash from a 20 byte v1 infohash, or a 32 byte
+// v2 infohash, which is truncated like InfoHashFromV2 does.
+//
+// It returns false if b has neither length.
+func ParseInfoHash(b []byte) (InfoHash, bool) {
+	switch len(b) {
+	case 20:
+		return InfoHashFromBytes(b), true
+	case InfoHashV2Len:
+		return InfoHashFromV2(b), true
+	default:
+		return InfoHash{}, false
+	}
+}
+
 // String implements fmt.Stringer, returning the base16 encoded InfoHash.
 func (i InfoHash) String() string {
 	return fmt.Sprintf("%x", i[:])
@@ -102,6 +136,10 @@ type AnnounceRequest struct {
 	Downloaded      uint64
 	Uploaded        uint64
 
+	// TrackerID is the tracker ID the client received in a previous announce
+	// response and sent back as the trackerid parameter, or empty.
+	TrackerID string
+
 	Peer
 	Params
 }
@@ -119,6 +157,7 @@ func (r AnnounceRequest) LogFields() log.Fields {
 		"left":            r.Left,
 		"downloaded":      r.Downloaded,
 		"uploaded":        r.Uploaded,
+		"trackerID":       r.TrackerID,
 		"peer":            r.Peer,
 		"params":          r.Params,
 	}
@@ -134,17 +173,32 @@ type AnnounceResponse struct {
 	MinInterval time.Duration
 	IPv4Peers   []Peer
 	IPv6Peers   []Peer
+
+	// ExternalIP is the IP address of the client as seen by the tracker.
+	// If set, it is communicated to the client as described in BEP 24.
+	ExternalIP net.IP
+
+	// TrackerID, if set, is sent to the client, which sends it back as the
+	// trackerid parameter of subsequent announces.
+	TrackerID string
+
+	// WarningMessage, if set, is shown to the user by the client like a
+	// failure reason, but the announce succeeds nonetheless.
+	WarningMessage string
 }
 
 // LogFields renders the current response as a set of log fields.
 func (r AnnounceResponse) LogFields() log.Fields {
 	return log.Fields{
-		"compact":     r.Compact,
-		"complete":    r.Complete,
-		"interval":    r.Interval,
-		"minInterval": r.MinInterval,
-		"ipv4Peers":   r.IPv4Peers,
-		"ipv6Peers":   r.IPv6Peers,
+		"compact":        r.Compact,
+		"complete":       r.Complete,
+		"interval":       r.Interval,
+		"minInterval":    r.MinInterval,
+		"ipv4Peers":      r.IPv4Peers,
+		"ipv6Peers":      r.IPv6Peers,
+		"externalIP":     r.ExternalIP,
+		"trackerID":      r.TrackerID,
+		"warningMessage": r.WarningMessage,
 	}
 }
 
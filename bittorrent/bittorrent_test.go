@@ -45,6 +45,21 @@ func TestInfoHash_String(t *testing.T) {
 	require.Equal(t, expected, s)
 }
 
+func TestParseInfoHash(t *testing.T) {
+	ih, ok := ParseInfoHash(b)
+	require.True(t, ok)
+	require.Equal(t, InfoHashFromBytes(b), ih)
+
+	// v2 infohashes are truncated to the first 20 bytes.
+	v2 := append(append([]byte{}, b...), 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12)
+	ih, ok = ParseInfoHash(v2)
+	require.True(t, ok)
+	require.Equal(t, InfoHashFromBytes(b), ih)
+
+	_, ok = ParseInfoHash(v2[:21])
+	require.False(t, ok)
+}
+
 func TestPeer_String(t *testing.T) {
 	for _, c := range peerStringTestCases {
 		got := c.input.String()
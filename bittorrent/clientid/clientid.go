@@ -0,0 +1,316 @@
+// Package clientid identifies the BitTorrent client of a peer by its peer ID.
+//
+// Most clients encode their name and version in the peer ID, either in the
+// Azureus style ("-qB4520-..."), in the Shadow style ("T03A0----...") or in
+// the Mainline style ("M4-4-0--..."). Peer IDs are chosen by clients and can
+// be forged, so the decoded client should only be used for statistics and
+// heuristics.
+package clientid
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+// Unknown is the name of clients whose peer ID is not recognized.
+const Unknown = "unknown"
+
+// Client is the BitTorrent client identified by a peer ID.
+type Client struct {
+	// Name is the name of the client, or Unknown. It is one of a fixed set
+	// of names, so it can be used as a metric label.
+	Name string
+
+	// Version is the version of the client, e.g. "4.5.2", or empty if it is
+	// unknown.
+	Version string
+}
+
+// String returns the name and version of the client.
+func (c Client) String() string {
+	if c.Version == "" {
+		return c.Name
+	}
+	return c.Name + " " + c.Version
+}
+
+// versionStyle is the way a client encodes its version in the four version
+// characters of an Azureus style peer ID.
+type versionStyle uint8
+
+const (
+	// versionDigits encodes every component in a character, like "4520"
+	// for 4.5.2.
+	versionDigits versionStyle = iota
+	// versionBuild encodes three components, followed by a build type
+	// letter, like "355B" for 3.5.5.
+	versionBuild
+	// versionMajorMinor encodes the major version, followed by a two digit
+	// minor version and a build type, like "2940" for 2.94.
+	versionMajorMinor
+)
+
+type azureusClient struct {
+	name  string
+	style versionStyle
+}
+
+// azureusClients maps the two character codes of Azureus style peer IDs to
+// their clients.
+var azureusClients = map[string]azureusClient{
+	"7T": {name: "aTorrent"},
+	"AG": {name: "Ares"},
+	"AR": {name: "Arctic"},
+	"AT": {name: "Artemis"},
+	"AX": {name: "BitPump"},
+	"AZ": {name: "Vuze"},
+	"BB": {name: "BitBuddy"},
+	"BC": {name: "BitComet"},
+	"BE": {name: "BitTorrent SDK"},
+	"BF": {name: "Bitflu"},
+	"BG": {name: "BTG"},
+	"BI": {name: "BiglyBT"},
+	"BL": {name: "BitBlinder"},
+	"BN": {name: "Baidu Netdisk"},
+	"BP": {name: "BitTorrent Pro"},
+	"BR": {name: "BitRocket"},
+	"BS": {name: "BTSlave"},
+	"BT": {name: "BitTorrent", style: versionBuild},
+	"BW": {name: "BitWombat"},
+	"BX": {name: "BitTorrent X"},
+	"CD": {name: "Enhanced CTorrent"},
+	"CT": {name: "CTorrent"},
+	"DE": {name: "Deluge"},
+	"EB": {name: "EBit"},
+	"FD": {name: "Free Download Manager"},
+	"FW": {name: "FrostWire"},
+	"FX": {name: "Freebox BitTorrent"},
+	"GS": {name: "GSTorrent"},
+	"HL": {name: "Halite"},
+	"HN": {name: "Hydranode"},
+	"KG": {name: "KGet"},
+	"KT": {name: "KTorrent"},
+	"LC": {name: "LeechCraft"},
+	"LH": {name: "LH-ABC"},
+	"LP": {name: "Lphant"},
+	"LT": {name: "libtorrent"},
+	"lt": {name: "libTorrent (rakshasa)"},
+	"LW": {name: "LimeWire"},
+	"MO": {name: "MonoTorrent"},
+	"MP": {name: "MooPolice"},
+	"MR": {name: "Miro"},
+	"MT": {name: "MoonlightTorrent"},
+	"NX": {name: "Net Transport"},
+	"OS": {name: "OneSwarm"},
+	"OT": {name: "OmegaTorrent"},
+	"PD": {name: "Pando"},
+	"PI": {name: "PicoTorrent"},
+	"qB": {name: "qBittorrent"},
+	"QD": {name: "QQDownload"},
+	"QT": {name: "Qt 4 Torrent example"},
+	"RT": {name: "Retriever"},
+	"SB": {name: "Swiftbit"},
+	"SD": {name: "Thunder"},
+	"SM": {name: "SoMud"},
+	"SP": {name: "BitSpirit"},
+	"SS": {name: "SwarmScope"},
+	"ST": {name: "SymTorrent"},
+	"st": {name: "sharktorrent"},
+	"SZ": {name: "Shareaza"},
+	"TL": {name: "Tribler"},
+	"TN": {name: "TorrentDotNET"},
+	"TR": {name: "Transmission", style: versionMajorMinor},
+	"TS": {name: "Torrentstorm"},
+	"TT": {name: "TuoTu"},
+	"UL": {name: "uLeecher!"},
+	"UM": {name: "µTorrent for Mac", style: versionBuild},
+	"UT": {name: "µTorrent", style: versionBuild},
+	"UW": {name: "µTorrent Web", style: versionBuild},
+	"VG": {name: "Vagaa"},
+	"WD": {name: "WebTorrent Desktop"},
+	"WT": {name: "BitLet"},
+	"WW": {name: "WebTorrent"},
+	"WY": {name: "FireTorrent"},
+	"XF": {name: "Xfplay"},
+	"XL": {name: "Xunlei"},
+	"XS": {name: "XSwifter"},
+	"XT": {name: "XanTorrent"},
+	"XX": {name: "Xtorrent"},
+	"ZT": {name: "ZipTorrent"},
+}
+
+// shadowClients maps the first character of Shadow style peer IDs to their
+// clients.
+var shadowClients = map[byte]string{
+	'A': "ABC",
+	'O': "Osprey Permaseed",
+	'Q': "BTQueue",
+	'R': "Tribler",
+	'S': "Shadow's client",
+	'T': "BitTornado",
+	'U': "UPnP NAT Bit Torrent",
+}
+
+// mainlineClients maps the first character of Mainline style peer IDs to
+// their clients.
+var mainlineClients = map[byte]string{
+	'M': "Mainline",
+	'Q': "Queen Bee",
+}
+
+// Parse identifies the client of a peer ID.
+func Parse(id bittorrent.PeerID) Client {
+	if c, ok := parseAzureus(id); ok {
+		return c
+	}
+	if c, ok := parseMainline(id); ok {
+		return c
+	}
+	if c, ok := parseShadow(id); ok {
+		return c
+	}
+	return parseOther(id)
+}
+
+func parseAzureus(id bittorrent.PeerID) (Client, bool) {
+	if id[0] != '-' || id[7] != '-' {
+		return Client{}, false
+	}
+	ac, ok := azureusClients[string(id[1:3])]
+	if !ok {
+		return Client{}, false
+	}
+
+	v := id[3:7]
+	for _, c := range v {
+		if !isAlphanumeric(c) {
+			return Client{Name: ac.name}, true
+		}
+	}
+
+	var version string
+	switch ac.style {
+	case versionDigits:
+		version = digitsVersion(v[:])
+	case versionBuild:
+		version = digitsVersion(v[:3])
+	case versionMajorMinor:
+		if isDigit(v[1]) && isDigit(v[2]) {
+			version = strconv.Itoa(int(digitValue(v[0]))) + "." + string(v[1:3])
+		}
+	}
+	return Client{Name: ac.name, Version: version}, true
+}
+
+// digitsVersion decodes a version with a component per character. Letters
+// encode the values from 10 on. Trailing zero components are omitted.
+func digitsVersion(v []byte) string {
+	for len(v) > 2 && v[len(v)-1] == '0' {
+		v = v[:len(v)-1]
+	}
+
+	components := make([]string, len(v))
+	for i, c := range v {
+		components[i] = strconv.Itoa(int(digitValue(c)))
+	}
+	return strings.Join(components, ".")
+}
+
+func parseMainline(id bittorrent.PeerID) (Client, bool) {
+	name, ok := mainlineClients[id[0]]
+	if !ok || !isDigit(id[1]) {
+		return Client{}, false
+	}
+
+	// The version consists of numbers separated by dashes, padded with
+	// dashes to eight characters, e.g. "M4-4-0--" or "Q1-10-0-".
+	rest := string(id[1:8])
+	if !strings.HasSuffix(rest, "-") {
+		return Client{}, false
+	}
+	components := strings.Split(strings.TrimRight(rest, "-"), "-")
+	if len(components) != 3 {
+		return Client{}, false
+	}
+	for _, c := range components {
+		if c == "" || strings.Trim(c, "0123456789") != "" {
+			return Client{}, false
+		}
+	}
+	return Client{Name: name, Version: strings.Join(components, ".")}, true
+}
+
+func parseShadow(id bittorrent.PeerID) (Client, bool) {
+	name, ok := shadowClients[id[0]]
+	if !ok || string(id[6:9]) != "---" {
+		return Client{}, false
+	}
+
+	// Up to five characters encode a component each, padded with dashes.
+	var components []string
+	for _, c := range id[1:6] {
+		if c == '-' {
+			break
+		}
+		v, ok := shadowValue(c)
+		if !ok {
+			return Client{}, false
+		}
+		components = append(components, strconv.Itoa(v))
+	}
+	return Client{Name: name, Version: strings.Join(components, ".")}, true
+}
+
+// shadowValue decodes a character of a Shadow style version.
+func shadowValue(c byte) (int, bool) {
+	switch {
+	case isDigit(c):
+		return int(c - '0'), true
+	case 'A' <= c && c <= 'Z':
+		return int(c-'A') + 10, true
+	case 'a' <= c && c <= 'z':
+		return int(c-'a') + 36, true
+	case c == '.':
+		return 62, true
+	default:
+		return 0, false
+	}
+}
+
+// parseOther identifies clients with peer IDs of their own style.
+func parseOther(id bittorrent.PeerID) Client {
+	switch {
+	case string(id[:2]) == "OP":
+		// Opera encodes its build number, e.g. "OP1011".
+		return Client{Name: "Opera", Version: strings.TrimLeft(string(id[2:6]), "0")}
+	case string(id[:4]) == "exbc", string(id[:4]) == "FUTB":
+		// Old BitComet versions encode the version in two binary bytes.
+		return Client{Name: "BitComet", Version: strconv.Itoa(int(id[4])) + "." + strconv.Itoa(int(id[5]))}
+	case string(id[:3]) == "XBT" && isDigit(id[3]) && isDigit(id[4]) && isDigit(id[5]):
+		return Client{Name: "XBT Client", Version: digitsVersion(id[3:6])}
+	default:
+		return Client{Name: Unknown}
+	}
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+func isAlphanumeric(c byte) bool {
+	return isDigit(c) || 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z'
+}
+
+// digitValue decodes a digit or a letter from A on as 10 and above.
+func digitValue(c byte) byte {
+	switch {
+	case isDigit(c):
+		return c - '0'
+	case 'A' <= c && c <= 'Z':
+		return c - 'A' + 10
+	default:
+		return c - 'a' + 10
+	}
+}
@@ -0,0 +1,51 @@
+package clientid
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+func TestParse(t *testing.T) {
+	table := []struct {
+		peerID  string
+		name    string
+		version string
+	}{
+		{"-qB4520-6wfG2wk6wWLc", "qBittorrent", "4.5.2"},
+		{"-AZ5770-6ozMq5q6Q3NX", "Vuze", "5.7.7"},
+		{"-DE13F0-oy4La2MWGEFj", "Deluge", "1.3.15"},
+		{"-LT2000-6oZyyMWoOOBe", "libtorrent", "2.0"},
+		{"-TR2940-s1hiF8vGAAg0", "Transmission", "2.94"},
+		{"-TR400B-lEl2Mm4NEO4n", "Transmission", "4.00"},
+		{"-UT355W-00HS~T7*65rm", "µTorrent", "3.5.5"},
+		{"-KT4310-3L4UvarKuqIu", "KTorrent", "4.3.1"},
+		{"-A~0010-a9mn9DFkj39J", Unknown, ""},
+		{"-XY1234-a9mn9DFkj39J", Unknown, ""},
+		{"-UT2300-KT4310KT4301", "µTorrent", "2.3"},
+
+		{"T03A0----f089kjsdf6e", "BitTornado", "0.3.10.0"},
+		{"S58B-----nKl34GoNb75", "Shadow's client", "5.8.11"},
+		{"M4-4-0--9aa757Efd5Bl", "Mainline", "4.4.0"},
+		{"Q1-10-0-Yoiumn39BDfO", "Queen Bee", "1.10.0"},
+
+		{"OP1011affbecbfabeefb", "Opera", "1011"},
+		{"XBT054d-8602Jn83NnF9", "XBT Client", "0.5.4"},
+		{"346------SDFknl33408", Unknown, ""},
+		{"QVOD0054ABFFEDCCDEDB", Unknown, ""},
+	}
+
+	for _, tt := range table {
+		t.Run(tt.peerID, func(t *testing.T) {
+			c := Parse(bittorrent.PeerIDFromString(tt.peerID))
+			require.Equal(t, Client{Name: tt.name, Version: tt.version}, c)
+		})
+	}
+}
+
+func TestString(t *testing.T) {
+	require.Equal(t, "qBittorrent 4.5.2", Client{Name: "qBittorrent", Version: "4.5.2"}.String())
+	require.Equal(t, Unknown, Client{Name: Unknown}.String())
+}
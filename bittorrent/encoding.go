@@ -0,0 +1,73 @@
+package bittorrent
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+// ErrInvalidPeerEncoding is returned when decoding an EncodedPeer that is
+// malformed or of an unknown version.
+var ErrInvalidPeerEncoding = errors.New("invalid peer encoding")
+
+// EncodedPeer is the binary encoding of a Peer, which storages use to store
+// peers and to identify them, e.g. as keys.
+//
+// Version 0 of the encoding consists of the peer ID (20 bytes), the port
+// (2 bytes, big endian) and the IP address (4 bytes for IPv4, 16 bytes for
+// IPv6). It is the format storages used before the encoding was versioned,
+// so it carries no version, and peers stored by earlier releases decode and
+// are identified as before.
+//
+// Later versions are prefixed by their version, a single byte. They must not
+// be 26 or 38 bytes long, which is how version 0 is told apart from them.
+type EncodedPeer string
+
+// PeerEncodingVersion is the version of the encoding EncodePeer returns.
+const PeerEncodingVersion = 0
+
+// Lengths of version 0 encodings.
+const (
+	encodedPeerV0Len  = 20 + 2
+	encodedPeerV0IPv4 = encodedPeerV0Len + net.IPv4len
+	encodedPeerV0IPv6 = encodedPeerV0Len + net.IPv6len
+)
+
+// EncodePeer returns the binary encoding of a Peer in the current version.
+func EncodePeer(p Peer) EncodedPeer {
+	b := make([]byte, encodedPeerV0Len+len(p.IP.IP))
+	copy(b[:20], p.ID[:])
+	binary.BigEndian.PutUint16(b[20:22], p.Port)
+	copy(b[22:], p.IP.IP)
+	return EncodedPeer(b)
+}
+
+// Version returns the version of the encoding.
+func (e EncodedPeer) Version() int {
+	if len(e) == 0 || len(e) == encodedPeerV0IPv4 || len(e) == encodedPeerV0IPv6 {
+		return 0
+	}
+	return int(e[0])
+}
+
+// Decode decodes the Peer. Both IPv4 and IPv4-mapped IPv6 addresses decode
+// as 4-byte IPv4 addresses.
+func (e EncodedPeer) Decode() (Peer, error) {
+	if len(e) != encodedPeerV0IPv4 && len(e) != encodedPeerV0IPv6 {
+		// No other version is known yet.
+		return Peer{}, ErrInvalidPeerEncoding
+	}
+
+	p := Peer{
+		ID:   PeerIDFromString(string(e[:20])),
+		Port: uint16(e[20])<<8 | uint16(e[21]),
+		IP:   IP{IP: net.IP(e[22:])},
+	}
+	if ip := p.IP.To4(); ip != nil {
+		p.IP.IP = ip
+		p.IP.AddressFamily = IPv4
+	} else {
+		p.IP.AddressFamily = IPv6
+	}
+	return p, nil
+}
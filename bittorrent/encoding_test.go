@@ -0,0 +1,59 @@
+package bittorrent
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncodePeer(t *testing.T) {
+	id := PeerIDFromString("12345678901234567890")
+	table := []struct {
+		peer     Peer
+		expected Peer
+	}{
+		{
+			Peer{ID: id, Port: 6881, IP: IP{IP: net.ParseIP("10.0.0.1").To4(), AddressFamily: IPv4}},
+			Peer{ID: id, Port: 6881, IP: IP{IP: net.ParseIP("10.0.0.1").To4(), AddressFamily: IPv4}},
+		},
+		{
+			Peer{ID: id, Port: 1, IP: IP{IP: net.ParseIP("fc00::1"), AddressFamily: IPv6}},
+			Peer{ID: id, Port: 1, IP: IP{IP: net.ParseIP("fc00::1"), AddressFamily: IPv6}},
+		},
+		{
+			Peer{ID: id, Port: 65535, IP: IP{IP: net.ParseIP("10.0.0.1"), AddressFamily: IPv4}},
+			Peer{ID: id, Port: 65535, IP: IP{IP: net.ParseIP("10.0.0.1").To4(), AddressFamily: IPv4}},
+		},
+	}
+
+	for _, tt := range table {
+		t.Run(tt.peer.String(), func(t *testing.T) {
+			e := EncodePeer(tt.peer)
+			require.Equal(t, PeerEncodingVersion, e.Version())
+
+			p, err := e.Decode()
+			require.Nil(t, err)
+			require.Equal(t, tt.expected, p)
+		})
+	}
+}
+
+func TestDecodePeer(t *testing.T) {
+	// Peers stored before the encoding was versioned decode unchanged.
+	legacy := EncodedPeer("12345678901234567890\x1a\xe1\x0a\x00\x00\x01")
+	p, err := legacy.Decode()
+	require.Nil(t, err)
+	require.Equal(t, Peer{
+		ID:   PeerIDFromString("12345678901234567890"),
+		Port: 6881,
+		IP:   IP{IP: net.IP{10, 0, 0, 1}, AddressFamily: IPv4},
+	}, p)
+	require.Equal(t, legacy, EncodePeer(p))
+
+	for _, e := range []EncodedPeer{"", "too short", "\x01" + legacy} {
+		_, err := e.Decode()
+		require.Equal(t, ErrInvalidPeerEncoding, err)
+	}
+	require.Equal(t, 1, EncodedPeer("\x01"+legacy).Version())
+}
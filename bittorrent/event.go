@@ -25,6 +25,11 @@ const (
 	// Completed is the event sent by a BitTorrent client when it finishes
 	// downloading all of the required chunks.
 	Completed
+
+	// Paused is the event sent by a partial seed as specified in BEP 21: a
+	// BitTorrent client that has downloaded all of the chunks it wants, but
+	// not the complete torrent, and does not download any further.
+	Paused
 )
 
 var (
@@ -37,6 +42,7 @@ func init() {
 	eventToString[Started] = "started"
 	eventToString[Stopped] = "stopped"
 	eventToString[Completed] = "completed"
+	eventToString[Paused] = "paused"
 
 	stringToEvent[""] = None
 
@@ -19,6 +19,7 @@ func TestNew(t *testing.T) {
 		{"started", Started, nil},
 		{"stopped", Stopped, nil},
 		{"completed", Completed, nil},
+		{"paused", Paused, nil},
 		{"notAnEvent", None, ErrUnknownEvent},
 	}
 
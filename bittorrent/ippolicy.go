@@ -0,0 +1,159 @@
+package bittorrent
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// ErrUnroutableIP indicates that the IP of an Announce is not publicly
+// routable.
+var ErrUnroutableIP = RegisterClientError("unroutable_ip", "IP address is not publicly routable")
+
+// Actions of an IPPolicy.
+const (
+	// IPPolicyAllow accepts announces from any IP.
+	IPPolicyAllow = "allow"
+
+	// IPPolicyReject rejects announces from unroutable IPs.
+	IPPolicyReject = "reject"
+
+	// IPPolicyRewrite replaces an unroutable IP provided by the client with
+	// the IP the request was received from, if that is routable, and rejects
+	// the announce otherwise.
+	IPPolicyRewrite = "rewrite"
+)
+
+// reservedNets are networks that are never publicly routable: private
+// networks (RFC 1918, RFC 4193), shared address space (RFC 6598), loopback,
+// link-local and unspecified addresses.
+var reservedNets = mustParseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets
+}
+
+// IPPolicy determines how announces from IPs that are not publicly routable
+// are handled.
+//
+// Private, shared, loopback, link-local and unspecified addresses are
+// considered unroutable, as well as the networks in Bogons and in the
+// BogonFile, which contains one network in CIDR notation per line.
+// Lines starting with '#' are ignored.
+type IPPolicy struct {
+	Action    string   `yaml:"action"`
+	Bogons    []string `yaml:"bogons"`
+	BogonFile string   `yaml:"bogon_file"`
+
+	bogonNets []*net.IPNet
+}
+
+// Init validates the IPPolicy and loads its bogons.
+// It must be called before the IPPolicy is used.
+func (p *IPPolicy) Init() error {
+	if p == nil {
+		return nil
+	}
+
+	switch p.Action {
+	case "", IPPolicyAllow, IPPolicyReject, IPPolicyRewrite:
+	default:
+		return fmt.Errorf("invalid IP policy action: %q", p.Action)
+	}
+
+	cidrs := append([]string(nil), p.Bogons...)
+	if p.BogonFile != "" {
+		f, err := os.Open(p.BogonFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		s := bufio.NewScanner(f)
+		for s.Scan() {
+			line := strings.TrimSpace(s.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			cidrs = append(cidrs, line)
+		}
+		if err := s.Err(); err != nil {
+			return err
+		}
+	}
+
+	p.bogonNets = make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("invalid bogon: %w", err)
+		}
+		p.bogonNets = append(p.bogonNets, ipnet)
+	}
+
+	return nil
+}
+
+// Routable reports whether ip is publicly routable according to the policy.
+func (p *IPPolicy) Routable(ip net.IP) bool {
+	if ip.IsMulticast() {
+		return false
+	}
+	var bogonNets []*net.IPNet
+	if p != nil {
+		bogonNets = p.bogonNets
+	}
+	for _, nets := range [][]*net.IPNet{reservedNets, bogonNets} {
+		for _, ipnet := range nets {
+			if ipnet.Contains(ip) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Apply applies the policy to a sanitized AnnounceRequest.
+// The sourceIP is the IP the request was received from, it may be nil if it
+// is unknown.
+//
+// A nil IPPolicy allows every IP.
+func (p *IPPolicy) Apply(r *AnnounceRequest, sourceIP net.IP) error {
+	if p == nil || p.Action == "" || p.Action == IPPolicyAllow || p.Routable(r.Peer.IP.IP) {
+		return nil
+	}
+
+	if p.Action == IPPolicyRewrite && r.IPProvided && sourceIP != nil && p.Routable(sourceIP) {
+		if ip := sourceIP.To4(); ip != nil {
+			r.Peer.IP = IP{IP: ip, AddressFamily: IPv4}
+		} else {
+			r.Peer.IP = IP{IP: sourceIP, AddressFamily: IPv6}
+		}
+		r.IPProvided = false
+		return nil
+	}
+
+	return ErrUnroutableIP
+}
@@ -0,0 +1,54 @@
+package bittorrent
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIPPolicyRoutable(t *testing.T) {
+	bogonFile := filepath.Join(t.TempDir(), "bogons.txt")
+	require.Nil(t, os.WriteFile(bogonFile, []byte("# Documentation\n198.51.100.0/24\n\n2001:db8::/32\n"), 0o600))
+
+	p := &IPPolicy{Action: IPPolicyReject, Bogons: []string{"203.0.113.0/24"}, BogonFile: bogonFile}
+	require.Nil(t, p.Init())
+
+	for ip, routable := range map[string]bool{
+		"1.1.1.1":         true,
+		"10.1.2.3":        false,
+		"172.31.0.1":      false,
+		"172.32.0.1":      true,
+		"192.168.1.1":     false,
+		"100.64.0.1":      false,
+		"127.0.0.1":       false,
+		"169.254.1.1":     false,
+		"0.0.0.0":         false,
+		"224.0.0.1":       false,
+		"203.0.113.1":     false,
+		"198.51.100.1":    false,
+		"2606:4700::1":    true,
+		"::1":             false,
+		"fd00::1":         false,
+		"fe80::1":         false,
+		"ff02::1":         false,
+		"2001:db8::1":     false,
+		"::ffff:10.0.0.1": false,
+	} {
+		require.Equal(t, routable, p.Routable(net.ParseIP(ip)), ip)
+	}
+
+	// Without a policy, only reserved networks are unroutable.
+	var nilPolicy *IPPolicy
+	require.True(t, nilPolicy.Routable(net.ParseIP("203.0.113.1")))
+	require.False(t, nilPolicy.Routable(net.ParseIP("10.0.0.1")))
+}
+
+func TestIPPolicyInit(t *testing.T) {
+	require.NotNil(t, (&IPPolicy{Action: "drop"}).Init())
+	require.NotNil(t, (&IPPolicy{Bogons: []string{"10.0.0.0/33"}}).Init())
+	require.NotNil(t, (&IPPolicy{BogonFile: filepath.Join(t.TempDir(), "missing")}).Init())
+	require.Nil(t, (*IPPolicy)(nil).Init())
+}
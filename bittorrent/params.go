@@ -2,9 +2,9 @@ package bittorrent
 
 import (
 	"errors"
-	"net/url"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/chihaya/chihaya/pkg/log"
 )
@@ -39,19 +39,64 @@ var ErrKeyNotFound = errors.New("query: value for the provided key does not exis
 
 // ErrInvalidInfohash is returned when parsing a query encounters an infohash
 // with invalid length.
-var ErrInvalidInfohash = ClientError("provided invalid infohash")
+var ErrInvalidInfohash = RegisterClientError("invalid_infohash", "provided invalid infohash")
 
 // ErrInvalidQueryEscape is returned when a query string contains invalid
 // escapes.
-var ErrInvalidQueryEscape = ClientError("invalid query escape")
+var ErrInvalidQueryEscape = RegisterClientError("invalid_query_escape", "invalid query escape")
 
 // QueryParams parses a URL Query and implements the Params interface with some
 // additional helpers.
 type QueryParams struct {
 	path       string
 	query      string
-	params     map[string]string
+	params     []queryParam
 	infoHashes []InfoHash
+
+	// pooled is set for QueryParams obtained by ParsePooledURLData.
+	pooled bool
+
+	// The arrays back params and infoHashes for typical announces, so that
+	// parsing them does not allocate.
+	paramsArray     [16]queryParam
+	infoHashesArray [1]InfoHash
+
+	// buf collects the unescaped values while parsing.
+	buf []byte
+}
+
+// queryParam is a parameter of a query.
+//
+// While parsing, the values of escaped parameters are unescaped into the
+// buffer of the QueryParams at start:end.
+type queryParam struct {
+	key, value string
+	escaped    bool
+	start, end int
+}
+
+// maxPooledBufSize is the maximum capacity of the buffer of QueryParams that
+// is kept when they are released, so that a single huge query does not pin
+// its buffer.
+const maxPooledBufSize = 1024
+
+var queryParamsPool = sync.Pool{
+	New: func() interface{} { return new(QueryParams) },
+}
+
+// knownKeys interns the keys of common parameters, so that keys that must be
+// unescaped or lowercased don't allocate.
+var knownKeys = make(map[string]string)
+
+func init() {
+	for _, key := range []string{
+		"compact", "corrupt", "cryptoport", "downloaded", "event", "info_hash",
+		"ip", "ipv4", "ipv6", "jwt", "key", "left", "no_peer_id", "numwant",
+		"passkey", "peer_id", "port", "redundant", "requirecrypto",
+		"supportcrypto", "trackerid", "uploaded",
+	} {
+		knownKeys[key] = key
+	}
 }
 
 type routeParamsKey struct{}
@@ -105,9 +150,48 @@ func (rp RouteParams) ByName(name string) string {
 // ClientError, as this method is expected to be used to parse client-provided
 // data.
 func ParseURLData(urlData string) (*QueryParams, error) {
+	q := new(QueryParams)
+	if err := q.parseURLData(urlData); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// ParsePooledURLData is like ParseURLData, but takes the QueryParams from a
+// pool, so that parsing typical announces does not allocate.
+//
+// The QueryParams must be assigned to the Params of an AnnounceRequest
+// obtained by NewAnnounceRequest, which releases them along with the request.
+// Neither the QueryParams nor the InfoHashes returned by them may be retained
+// afterwards.
+func ParsePooledURLData(urlData string) (*QueryParams, error) {
+	q := queryParamsPool.Get().(*QueryParams)
+	q.pooled = true
+	if err := q.parseURLData(urlData); err != nil {
+		q.release()
+		return nil, err
+	}
+	return q, nil
+}
+
+// release returns pooled QueryParams to their pool.
+func (qp *QueryParams) release() {
+	if !qp.pooled {
+		return
+	}
+
+	buf := qp.buf[:0]
+	if cap(buf) > maxPooledBufSize {
+		buf = nil
+	}
+	*qp = QueryParams{buf: buf}
+	queryParamsPool.Put(qp)
+}
+
+func (qp *QueryParams) parseURLData(urlData string) error {
 	var path, query string
 
-	queryDelim := strings.IndexAny(urlData, "?")
+	queryDelim := strings.IndexByte(urlData, '?')
 	if queryDelim == -1 {
 		path = urlData
 	} else {
@@ -115,25 +199,35 @@ func ParseURLData(urlData string) (*QueryParams, error) {
 		query = urlData[queryDelim+1:]
 	}
 
-	q, err := parseQuery(query)
-	if err != nil {
-		return nil, ClientError(err.Error())
+	if err := qp.parseQuery(query); err != nil {
+		return ClientError(err.Error())
 	}
-	q.path = path
-	return q, nil
+	qp.path = path
+	return nil
 }
 
 // parseQuery parses a URL query into QueryParams.
 // The query is expected to exclude the delimiting '?'.
-func parseQuery(query string) (q *QueryParams, err error) {
-	// This is basically url.parseQuery, but with a map[string]string
-	// instead of map[string][]string for the values.
-	q = &QueryParams{
-		query:      query,
-		infoHashes: nil,
-		params:     make(map[string]string),
+func parseQuery(query string) (*QueryParams, error) {
+	q := new(QueryParams)
+	if err := q.parseQuery(query); err != nil {
+		return nil, err
 	}
+	return q, nil
+}
 
+// parseQuery parses a URL query like url.ParseQuery, but keeps only the last
+// value of every key.
+//
+// Unescaped keys and values refer to the query, and the values that must be
+// unescaped are copied into a single string, so that parsing allocates at
+// most once, apart from uncommon keys that must be unescaped or lowercased.
+func (qp *QueryParams) parseQuery(query string) error {
+	qp.query = query
+	qp.params = qp.paramsArray[:0]
+	qp.infoHashes = nil
+
+	var escaped bool
 	for query != "" {
 		key := query
 		if i := strings.IndexAny(key, "&;"); i >= 0 {
@@ -145,52 +239,153 @@ func parseQuery(query string) (q *QueryParams, err error) {
 			continue
 		}
 		value := ""
-		if i := strings.Index(key, "="); i >= 0 {
+		if i := strings.IndexByte(key, '='); i >= 0 {
 			key, value = key[:i], key[i+1:]
 		}
-		key, err = url.QueryUnescape(key)
-		if err != nil {
+
+		key, isInfoHash, ok := normalizeKey(key)
+		if !ok {
 			// QueryUnescape returns an error like "invalid escape: '%x'".
 			// But frontends record these errors to prometheus, which generates
 			// a lot of time series.
 			// We log it here for debugging instead.
-			log.Debug("failed to unescape query param key", log.Err(err))
-			return nil, ErrInvalidQueryEscape
+			log.Debug("failed to unescape query param key", log.Fields{"key": key})
+			return ErrInvalidQueryEscape
 		}
-		value, err = url.QueryUnescape(value)
-		if err != nil {
-			// QueryUnescape returns an error like "invalid escape: '%x'".
-			// But frontends record these errors to prometheus, which generates
-			// a lot of time series.
-			// We log it here for debugging instead.
-			log.Debug("failed to unescape query param value", log.Err(err))
-			return nil, ErrInvalidQueryEscape
+
+		if isInfoHash {
+			start := len(qp.buf)
+			if qp.buf, ok = appendUnescaped(qp.buf, value); !ok {
+				log.Debug("failed to unescape query param value", log.Fields{"key": key})
+				return ErrInvalidQueryEscape
+			}
+			ih, ok := ParseInfoHash(qp.buf[start:])
+			qp.buf = qp.buf[:start]
+			if !ok {
+				return ErrInvalidInfohash
+			}
+			if qp.infoHashes == nil {
+				qp.infoHashes = qp.infoHashesArray[:0]
+			}
+			qp.infoHashes = append(qp.infoHashes, ih)
+			continue
 		}
 
-		if key == "info_hash" {
-			if len(value) != 20 {
-				return nil, ErrInvalidInfohash
+		p := queryParam{key: key, value: value}
+		if needsUnescape(value) {
+			p.value, p.escaped, p.start = "", true, len(qp.buf)
+			if qp.buf, ok = appendUnescaped(qp.buf, value); !ok {
+				log.Debug("failed to unescape query param value", log.Fields{"key": key})
+				return ErrInvalidQueryEscape
 			}
-			q.infoHashes = append(q.infoHashes, InfoHashFromString(value))
-		} else {
-			q.params[strings.ToLower(key)] = value
+			p.end = len(qp.buf)
+			escaped = true
 		}
+		qp.params = append(qp.params, p)
 	}
 
-	return q, nil
+	if escaped {
+		values := string(qp.buf)
+		for i, p := range qp.params {
+			if p.escaped {
+				qp.params[i].value = values[p.start:p.end]
+			}
+		}
+	}
+	return nil
+}
+
+// normalizeKey unescapes and lowercases a key and reports whether it is
+// "info_hash", which is matched before lowercasing.
+func normalizeKey(key string) (normalized string, isInfoHash, ok bool) {
+	if !needsUnescape(key) && !hasUpper(key) {
+		return key, key == "info_hash", true
+	}
+
+	var scratch [64]byte
+	b, ok := appendUnescaped(scratch[:0], key)
+	if !ok {
+		return key, false, false
+	}
+	if string(b) == "info_hash" {
+		return "info_hash", true, true
+	}
+
+	for i, c := range b {
+		if 'A' <= c && c <= 'Z' {
+			b[i] = c + 'a' - 'A'
+		}
+	}
+	if interned, ok := knownKeys[string(b)]; ok {
+		return interned, false, true
+	}
+	return string(b), false, true
+}
+
+func hasUpper(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if 'A' <= s[i] && s[i] <= 'Z' {
+			return true
+		}
+	}
+	return false
+}
+
+func needsUnescape(s string) bool {
+	return strings.IndexByte(s, '%') >= 0 || strings.IndexByte(s, '+') >= 0
+}
+
+// appendUnescaped appends s unescaped like url.QueryUnescape to dst and
+// reports whether s was escaped validly.
+func appendUnescaped(dst []byte, s string) ([]byte, bool) {
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '+':
+			dst = append(dst, ' ')
+		case '%':
+			if i+2 >= len(s) || !isHex(s[i+1]) || !isHex(s[i+2]) {
+				return dst, false
+			}
+			dst = append(dst, unhex(s[i+1])<<4|unhex(s[i+2]))
+			i += 2
+		default:
+			dst = append(dst, c)
+		}
+	}
+	return dst, true
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+func unhex(c byte) byte {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0'
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10
+	default:
+		return c - 'A' + 10
+	}
 }
 
 // String returns a string parsed from a query. Every key can be returned as a
 // string because they are encoded in the URL as strings.
 func (qp *QueryParams) String(key string) (string, bool) {
-	value, ok := qp.params[key]
-	return value, ok
+	// The last value of a key wins.
+	for i := len(qp.params) - 1; i >= 0; i-- {
+		if qp.params[i].key == key {
+			return qp.params[i].value, true
+		}
+	}
+	return "", false
 }
 
 // Uint returns a uint parsed from a query. After being called, it is safe to
 // cast the uint64 to your desired length.
 func (qp *QueryParams) Uint(key string, bitSize int) (uint64, error) {
-	str, exists := qp.params[key]
+	str, exists := qp.String(key)
 	if !exists {
 		return 0, ErrKeyNotFound
 	}
@@ -2,6 +2,7 @@ package bittorrent
 
 import (
 	"net/url"
+	"strings"
 	"testing"
 )
 
@@ -35,14 +36,14 @@ var (
 	}
 )
 
-func mapArrayEqual(boxed map[string][]string, unboxed map[string]string) bool {
-	if len(boxed) != len(unboxed) {
+func mapArrayEqual(boxed map[string][]string, unboxed *QueryParams) bool {
+	if len(boxed) != len(unboxed.params) {
 		return false
 	}
 
 	for mapKey, mapVal := range boxed {
 		// Always expect box to hold only one element
-		if len(mapVal) != 1 || mapVal[0] != unboxed[mapKey] {
+		if value, ok := unboxed.String(mapKey); len(mapVal) != 1 || !ok || mapVal[0] != value {
 			return false
 		}
 	}
@@ -67,7 +68,7 @@ func TestParseValidURLData(t *testing.T) {
 			t.Fatal(err)
 		}
 
-		if !mapArrayEqual(parseVal, parsedQueryObj.params) {
+		if !mapArrayEqual(parseVal, parsedQueryObj) {
 			t.Fatalf("Incorrect parse at item %d.\n Expected=%v\n Received=%v\n", parseIndex, parseVal, parsedQueryObj.params)
 		}
 
@@ -90,6 +91,77 @@ func TestParseInvalidURLData(t *testing.T) {
 	}
 }
 
+func TestParseInfoHashes(t *testing.T) {
+	v1 := "aaaaaaaaaaaaaaaaaaaa"
+	v2 := "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+	q, err := ParseURLData("/scrape?info_hash=" + v1 + "&info_hash=" + v2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []InfoHash{InfoHashFromString(v1), InfoHashFromString(v2[:20])}
+	if ihs := q.InfoHashes(); len(ihs) != 2 || ihs[0] != expected[0] || ihs[1] != expected[1] {
+		t.Fatalf("Incorrect infohashes, expected %v, got %v", expected, ihs)
+	}
+
+	if _, err := ParseURLData("/scrape?info_hash=" + v2[:21]); err != ErrInvalidInfohash {
+		t.Fatalf("Incorrect error, expected %v, got %v", ErrInvalidInfohash, err)
+	}
+}
+
+func TestParseEscapedURLData(t *testing.T) {
+	q, err := ParseURLData("/announce?Peer_ID=%2DTEST01%2D6wfG2wk6wWLc&%6B%65%79=a+b&port=1&port=2&x%41=%25;compact")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for key, expected := range map[string]string{
+		"peer_id": "-TEST01-6wfG2wk6wWLc",
+		"key":     "a b",
+		"port":    "2",
+		"xa":      "%",
+		"compact": "",
+	} {
+		if value, ok := q.String(key); !ok || value != expected {
+			t.Fatalf("Incorrect value of %s, expected %q, got %q", key, expected, value)
+		}
+	}
+
+	ih := "%AA%aa" + strings.Repeat("a", 18)
+	q, err = ParseURLData("/announce?info_hash=" + ih + "&Info_Hash=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ihs := q.InfoHashes(); len(ihs) != 1 || ihs[0] != InfoHashFromString("\xaa\xaa"+strings.Repeat("a", 18)) {
+		t.Fatalf("Incorrect infohashes: %v", ihs)
+	}
+	if value, _ := q.String("info_hash"); value != "1" {
+		t.Fatalf("Incorrect value of info_hash, expected %q, got %q", "1", value)
+	}
+
+	for _, invalid := range []string{"/?a=%", "/?a=%a", "/?a=%zz", "/?%=a", "/?info_hash=%a"} {
+		if _, err := ParseURLData(invalid); err != ErrInvalidQueryEscape {
+			t.Fatalf("Incorrect error for %q, expected %v, got %v", invalid, ErrInvalidQueryEscape, err)
+		}
+	}
+}
+
+func TestParsePooledURLDataAllocs(t *testing.T) {
+	query := "/announce?" + realAnnounce
+	allocs := testing.AllocsPerRun(100, func() {
+		q, err := ParsePooledURLData(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := NewAnnounceRequest()
+		r.Params = q
+		ReleaseAnnounceRequest(r)
+	})
+	// Only the escaped peer ID is copied.
+	if allocs > 1 {
+		t.Fatalf("Parsing an announce allocated %v times", allocs)
+	}
+}
+
 func TestParseShouldNotPanicURLData(t *testing.T) {
 	for _, parseStr := range shouldNotPanicQueries {
 		_, _ = ParseURLData(parseStr)
@@ -112,6 +184,34 @@ func BenchmarkParseQuery(b *testing.B) {
 	}
 }
 
+// realAnnounce is the query of an announce of a common client, with an
+// escaped infohash and peer ID.
+const realAnnounce = "info_hash=%12%34%56%78%9A%BC%DE%F1%23%45%67%89%AB%CD%EF%12%34%56%78%9A" +
+	"&peer_id=-qB4500-%28%21ABCDEFGHIJ&port=51413&uploaded=0&downloaded=0&left=1073741824" +
+	"&corrupt=0&key=6C0A8E4F&event=started&numwant=200&compact=1&no_peer_id=1&supportcrypto=1&redundant=0"
+
+func BenchmarkParsePooledURLData(b *testing.B) {
+	query := "/announce?" + realAnnounce
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		q, err := ParsePooledURLData(query)
+		if err != nil {
+			b.Fatal(err)
+		}
+		q.release()
+	}
+}
+
+func BenchmarkParseURLData(b *testing.B) {
+	query := "/announce?" + realAnnounce
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := ParseURLData(query); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
 func BenchmarkURLParseQuery(b *testing.B) {
 	announceStrings := make([]string, 0)
 	for i := range ValidAnnounceArguments {
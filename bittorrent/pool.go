@@ -0,0 +1,93 @@
+package bittorrent
+
+import "sync"
+
+// Announces are the dominant source of allocations of a tracker, so the
+// objects passed through the announce pipeline are pooled.
+//
+// Ownership of pooled objects follows the announce pipeline:
+//
+//   - A Frontend obtains an AnnounceRequest via NewAnnounceRequest and hands it
+//     to the TrackerLogic.
+//   - The TrackerLogic obtains an AnnounceResponse via NewAnnounceResponse.
+//     The peer slices of the response are obtained via NewPeers, usually by a
+//     PeerStore, and are owned by the response they are assigned to.
+//   - After the post-hooks have run, the TrackerLogic releases the request and
+//     the response including its peer slices. Neither may be used afterwards,
+//     i.e. Frontends must not touch them after calling AfterAnnounce, and hooks
+//     must not retain them beyond their invocation.
+//
+// Objects that are never released are simply garbage collected.
+
+var (
+	announceRequestPool = sync.Pool{
+		New: func() interface{} { return new(AnnounceRequest) },
+	}
+
+	announceResponsePool = sync.Pool{
+		New: func() interface{} { return new(AnnounceResponse) },
+	}
+
+	peersPool sync.Pool
+)
+
+// NewAnnounceRequest returns an empty AnnounceRequest from a pool.
+func NewAnnounceRequest() *AnnounceRequest {
+	return announceRequestPool.Get().(*AnnounceRequest)
+}
+
+// ReleaseAnnounceRequest returns an AnnounceRequest to the pool.
+func ReleaseAnnounceRequest(r *AnnounceRequest) {
+	if r == nil {
+		return
+	}
+
+	if qp, ok := r.Params.(*QueryParams); ok {
+		qp.release()
+	}
+	*r = AnnounceRequest{}
+	announceRequestPool.Put(r)
+}
+
+// NewAnnounceResponse returns an empty AnnounceResponse from a pool.
+func NewAnnounceResponse() *AnnounceResponse {
+	return announceResponsePool.Get().(*AnnounceResponse)
+}
+
+// ReleaseAnnounceResponse returns an AnnounceResponse and its peer slices to
+// their pools.
+func ReleaseAnnounceResponse(r *AnnounceResponse) {
+	if r == nil {
+		return
+	}
+
+	ReleasePeers(r.IPv4Peers)
+	ReleasePeers(r.IPv6Peers)
+	*r = AnnounceResponse{}
+	announceResponsePool.Put(r)
+}
+
+// NewPeers returns an empty slice of Peers with at least the given capacity
+// from a pool.
+func NewPeers(capacity int) []Peer {
+	if p, ok := peersPool.Get().(*[]Peer); ok && cap(*p) >= capacity {
+		return (*p)[:0]
+	}
+	return make([]Peer, 0, capacity)
+}
+
+// ReleasePeers returns a slice of Peers to the pool.
+func ReleasePeers(peers []Peer) {
+	if cap(peers) == 0 {
+		return
+	}
+
+	// Drop references to the IPs, so they can be garbage collected.
+	peers = peers[:cap(peers)]
+	for i := range peers {
+		peers[i] = Peer{}
+	}
+
+	peers = peers[:0]
+	peersPool.Put(&peers)
+}
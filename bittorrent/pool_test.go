@@ -0,0 +1,28 @@
+package bittorrent
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAnnouncePools(t *testing.T) {
+	req := NewAnnounceRequest()
+	req.NumWant = 50
+	req.Peer.IP = IP{IP: net.ParseIP("10.0.0.1"), AddressFamily: IPv4}
+	ReleaseAnnounceRequest(req)
+	require.Equal(t, AnnounceRequest{}, *req)
+
+	peers := NewPeers(10)
+	require.Len(t, peers, 0)
+	require.GreaterOrEqual(t, cap(peers), 10)
+	peers = append(peers, Peer{IP: IP{IP: net.ParseIP("10.0.0.2"), AddressFamily: IPv4}})
+
+	resp := NewAnnounceResponse()
+	resp.Complete = 1
+	resp.IPv4Peers = peers
+	ReleaseAnnounceResponse(resp)
+	require.Equal(t, AnnounceResponse{}, *resp)
+	require.Equal(t, Peer{}, peers[:1][0])
+}
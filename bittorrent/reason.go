@@ -0,0 +1,80 @@
+package bittorrent
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// Reasons of errors that are not ClientErrors registered with
+// RegisterClientError.
+const (
+	// ReasonClientError is the reason of ClientErrors without a registered
+	// reason, e.g. those created by scripts.
+	ReasonClientError = "client_error"
+
+	// ReasonTimeout is the reason of errors caused by a deadline or a
+	// network timeout, e.g. of a storage request.
+	ReasonTimeout = "timeout"
+
+	// ReasonCanceled is the reason of errors caused by a canceled context,
+	// e.g. because the client went away.
+	ReasonCanceled = "canceled"
+
+	// ReasonInternalError is the reason of all other errors.
+	ReasonInternalError = "internal_error"
+)
+
+var (
+	reasonsMu sync.RWMutex
+	reasons   = make(map[ClientError]string)
+)
+
+// RegisterClientError registers the reason of a ClientError and returns it,
+// so that it can be used in the declaration of the error.
+//
+// Reasons are short, stable codes like "unapproved_client" that classify
+// errors for metrics, independently of the message sent to clients.
+// RegisterClientError panics if the error was registered with another
+// reason.
+func RegisterClientError(reason string, err ClientError) ClientError {
+	reasonsMu.Lock()
+	defer reasonsMu.Unlock()
+
+	if registered, ok := reasons[err]; ok && registered != reason {
+		panic("bittorrent: ClientError " + string(err) + " registered with reasons " + registered + " and " + reason)
+	}
+	reasons[err] = reason
+	return err
+}
+
+// ErrorReason classifies an error into a reason code, or returns an empty
+// string for a nil error.
+func ErrorReason(err error) string {
+	if err == nil {
+		return ""
+	}
+
+	var clientErr ClientError
+	if errors.As(err, &clientErr) {
+		reasonsMu.RLock()
+		reason, ok := reasons[clientErr]
+		reasonsMu.RUnlock()
+		if ok {
+			return reason
+		}
+		return ReasonClientError
+	}
+
+	var timeoutErr interface{ Timeout() bool }
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return ReasonTimeout
+	case errors.As(err, &timeoutErr) && timeoutErr.Timeout():
+		return ReasonTimeout
+	case errors.Is(err, context.Canceled):
+		return ReasonCanceled
+	default:
+		return ReasonInternalError
+	}
+}
@@ -0,0 +1,45 @@
+package bittorrent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestErrorReason(t *testing.T) {
+	timeout := &net.OpError{Op: "read", Err: &timeoutError{}}
+
+	for _, tt := range []struct {
+		err      error
+		expected string
+	}{
+		{nil, ""},
+		{ErrInvalidPort, "invalid_port"},
+		{fmt.Errorf("wrapped: %w", ErrUnroutableIP), "unroutable_ip"},
+		{ClientError("unregistered"), ReasonClientError},
+		{context.DeadlineExceeded, ReasonTimeout},
+		{fmt.Errorf("storage: %w", timeout), ReasonTimeout},
+		{context.Canceled, ReasonCanceled},
+		{errors.New("failure"), ReasonInternalError},
+	} {
+		require.Equal(t, tt.expected, ErrorReason(tt.err), "%v", tt.err)
+	}
+}
+
+func TestRegisterClientError(t *testing.T) {
+	err := RegisterClientError("test_reason", "test error")
+	require.Equal(t, ClientError("test error"), err)
+
+	// Registering an error again with the same reason is fine.
+	require.NotPanics(t, func() { RegisterClientError("test_reason", "test error") })
+	require.Panics(t, func() { RegisterClientError("other_reason", "test error") })
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string { return "i/o timeout" }
+func (timeoutError) Timeout() bool { return true }
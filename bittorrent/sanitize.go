@@ -7,10 +7,10 @@ import (
 )
 
 // ErrInvalidIP indicates an invalid IP for an Announce.
-var ErrInvalidIP = ClientError("invalid IP")
+var ErrInvalidIP = RegisterClientError("invalid_ip", "invalid IP")
 
 // ErrInvalidPort indicates an invalid Port for an Announce.
-var ErrInvalidPort = ClientError("invalid port")
+var ErrInvalidPort = RegisterClientError("invalid_port", "invalid port")
 
 // SanitizeAnnounce enforces a max and default NumWant and coerces the peer's
 // IP address into the proper format.
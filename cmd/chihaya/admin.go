@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/chihaya/chihaya/middleware/blocklist"
+	"github.com/chihaya/chihaya/middleware/denylist"
+	"github.com/chihaya/chihaya/pkg/admin"
+)
+
+// adminClient creates a client of the admin API from the flags of the admin
+// command.
+func adminClient(cmd *cobra.Command) (*admin.Client, error) {
+	url, err := cmd.Flags().GetString("url")
+	if err != nil {
+		return nil, err
+	}
+	apiKey, err := cmd.Flags().GetString("api-key")
+	if err != nil {
+		return nil, err
+	}
+	// The key is read from the environment unless given, so that it does
+	// not show up in the process list or the help output.
+	if apiKey == "" {
+		apiKey = os.Getenv("CHIHAYA_ADMIN_API_KEY")
+	}
+	return admin.NewClient(url, apiKey), nil
+}
+
+// printJSON writes an indented JSON response of the admin API to the output
+// of a command.
+func printJSON(cmd *cobra.Command, body json.RawMessage) error {
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, body, "", "  "); err != nil {
+		return err
+	}
+	buf.WriteByte('\n')
+	_, err := buf.WriteTo(cmd.OutOrStdout())
+	return err
+}
+
+// AdminSwarmCmdFunc implements a Cobra command that prints a swarm.
+func AdminSwarmCmdFunc(cmd *cobra.Command, args []string) error {
+	limit, err := cmd.Flags().GetInt("limit")
+	if err != nil {
+		return err
+	}
+	c, err := adminClient(cmd)
+	if err != nil {
+		return err
+	}
+
+	body, err := c.Swarm(context.Background(), args[0], limit)
+	if err != nil {
+		return err
+	}
+	return printJSON(cmd, body)
+}
+
+// AdminGCCmdFunc implements a Cobra command that makes the storage collect
+// garbage immediately.
+func AdminGCCmdFunc(cmd *cobra.Command, args []string) error {
+	c, err := adminClient(cmd)
+	if err != nil {
+		return err
+	}
+	return c.CollectGarbage(context.Background())
+}
+
+// AdminDrainCmdFunc implements a Cobra command that makes the tracker drain
+// and shut down after the drain period, or makes one of its instances drain.
+func AdminDrainCmdFunc(cmd *cobra.Command, args []string) error {
+	c, err := adminClient(cmd)
+	if err != nil {
+		return err
+	}
+
+	name, err := cmd.Flags().GetString("instance")
+	if err != nil {
+		return err
+	}
+	if name != "" {
+		return c.DrainInstance(context.Background(), name)
+	}
+	return c.Drain(context.Background())
+}
+
+// AdminListsCmdFunc implements a Cobra command that prints the names of the
+// middleware lists, or the entries of one.
+func AdminListsCmdFunc(cmd *cobra.Command, args []string) error {
+	c, err := adminClient(cmd)
+	if err != nil {
+		return err
+	}
+
+	var name string
+	if len(args) > 0 {
+		name = args[0]
+	}
+	body, err := c.ListEntries(context.Background(), name)
+	if err != nil {
+		return err
+	}
+	return printJSON(cmd, body)
+}
+
+// adminListCmdFunc returns a Cobra command function that adds its argument to
+// or removes it from a middleware list.
+func adminListCmdFunc(list string, add bool) func(*cobra.Command, []string) error {
+	return func(cmd *cobra.Command, args []string) error {
+		c, err := adminClient(cmd)
+		if err != nil {
+			return err
+		}
+		if add {
+			return c.AddListEntry(context.Background(), list, args[0])
+		}
+		return c.RemoveListEntry(context.Background(), list, args[0])
+	}
+}
+
+// adminCmd returns the admin command and its subcommands, which perform
+// routine operations on a running tracker through the admin API.
+func adminCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "admin",
+		Short: "operate a running tracker",
+		Long:  "Perform routine operations on a running tracker through its admin API",
+	}
+	cmd.PersistentFlags().String("url", "http://127.0.0.1:6880", "base URL of the admin API")
+	cmd.PersistentFlags().String("api-key", "", "key of the admin API (default $CHIHAYA_ADMIN_API_KEY)")
+
+	swarmCmd := &cobra.Command{
+		Use:   "swarm <infohash>",
+		Short: "print a swarm",
+		Long:  "Print the counts and peers of a swarm",
+		Args:  cobra.ExactArgs(1),
+		RunE:  AdminSwarmCmdFunc,
+	}
+	swarmCmd.Flags().Int("limit", 100, "maximum number of seeders and leechers printed per address family")
+
+	drainCmd := &cobra.Command{
+		Use:   "drain",
+		Short: "drain the tracker",
+		Long:  "Make the tracker answer announces with the drain interval, stop creating swarms and shut down after the drain period",
+		Args:  cobra.NoArgs,
+		RunE:  AdminDrainCmdFunc,
+	}
+	drainCmd.Flags().String("instance", "", "name of an instance to drain on its own, without shutting down")
+
+	cmd.AddCommand(
+		swarmCmd,
+		&cobra.Command{
+			Use:   "gc",
+			Short: "collect garbage",
+			Long:  "Make the storage remove expired peers immediately",
+			Args:  cobra.NoArgs,
+			RunE:  AdminGCCmdFunc,
+		},
+		drainCmd,
+		&cobra.Command{
+			Use:   "lists [name]",
+			Short: "print middleware lists",
+			Long:  "Print the names of the middleware lists, or the entries added to a list at runtime",
+			Args:  cobra.MaximumNArgs(1),
+			RunE:  AdminListsCmdFunc,
+		},
+		&cobra.Command{
+			Use:   "ban-ip <ip|cidr>",
+			Short: "block an IP or network",
+			Long:  fmt.Sprintf("Add an IP or network to the %s middleware of the tracker", blocklist.Name),
+			Args:  cobra.ExactArgs(1),
+			RunE:  adminListCmdFunc(blocklist.Name, true),
+		},
+		&cobra.Command{
+			Use:   "unban-ip <ip|cidr>",
+			Short: "unblock an IP or network",
+			Long:  fmt.Sprintf("Remove an IP or network added at runtime from the %s middleware of the tracker", blocklist.Name),
+			Args:  cobra.ExactArgs(1),
+			RunE:  adminListCmdFunc(blocklist.Name, false),
+		},
+		&cobra.Command{
+			Use:   "deny-infohash <infohash|prefix|re:expression>",
+			Short: "deny an infohash",
+			Long:  fmt.Sprintf("Add an infohash rule to the %s middleware of the tracker", denylist.ListName),
+			Args:  cobra.ExactArgs(1),
+			RunE:  adminListCmdFunc(denylist.ListName, true),
+		},
+		&cobra.Command{
+			Use:   "undeny-infohash <infohash|prefix|re:expression>",
+			Short: "allow a denied infohash",
+			Long:  fmt.Sprintf("Remove an infohash rule added at runtime from the %s middleware of the tracker", denylist.ListName),
+			Args:  cobra.ExactArgs(1),
+			RunE:  adminListCmdFunc(denylist.ListName, false),
+		},
+	)
+
+	return cmd
+}
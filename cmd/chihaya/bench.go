@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"regexp"
+	"testing"
+
+	"github.com/spf13/cobra"
+
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/storage"
+	"github.com/chihaya/chihaya/storage/memory"
+)
+
+// BenchRunCmdFunc implements a Cobra command that runs the storage benchmark
+// suite against the storage of a configuration file, so that storages can be
+// compared on the hardware they are deployed on.
+func BenchRunCmdFunc(cmd *cobra.Command, args []string) error {
+	configFilePath, err := cmd.Flags().GetString("config")
+	if err != nil {
+		return err
+	}
+	run, err := cmd.Flags().GetString("run")
+	if err != nil {
+		return err
+	}
+	benchtime, err := cmd.Flags().GetDuration("benchtime")
+	if err != nil {
+		return err
+	}
+	allowClear, err := cmd.Flags().GetBool("allow-clear")
+	if err != nil {
+		return err
+	}
+
+	filter, err := regexp.Compile(run)
+	if err != nil {
+		return errors.New("invalid run expression: " + err.Error())
+	}
+
+	configFile, err := ParseConfigFile(configFilePath)
+	if err != nil {
+		return errors.New("failed to read config: " + err.Error())
+	}
+	cfg := configFile.Chihaya.Storage
+
+	// The benchmarks clear shared and persistent storages, which must not
+	// contain the swarms of a running tracker. The swarms of the memory
+	// storage only live in this process.
+	ps, err := storage.NewPeerStore(cfg.Name, cfg.Config)
+	if err != nil {
+		return errors.New("failed to create storage: " + err.Error())
+	}
+	_, clearable := ps.(storage.ClearablePeerStore)
+	if errs := ps.Stop().Wait(); len(errs) != 0 {
+		return combineErrors("failed while shutting down storage", errs)
+	}
+	if clearable && !allowClear && cfg.Name != memory.Name {
+		return errors.New("the benchmarks delete all swarms of storage " + cfg.Name + "; use a dedicated instance and pass --allow-clear")
+	}
+
+	// testing.Benchmark reads the benchmark time from the flags of the
+	// testing package.
+	testing.Init()
+	if err := flag.Set("test.benchtime", benchtime.String()); err != nil {
+		return err
+	}
+
+	log.Info("running storage benchmarks", log.Fields{
+		"storage":   cfg.Name,
+		"benchtime": benchtime,
+	})
+	out := cmd.OutOrStdout()
+	fmt.Fprintf(out, "%-28s %12s %12s %12s\n", "benchmark", "iterations", "ns/op", "ops/s")
+	for _, bm := range storage.Benchmarks {
+		if !filter.MatchString(bm.Name) {
+			continue
+		}
+
+		var createErr error
+		result := testing.Benchmark(func(b *testing.B) {
+			ps, err := storage.NewPeerStore(cfg.Name, cfg.Config)
+			if err != nil {
+				createErr = err
+				b.SkipNow()
+			}
+			bm.Run(b, ps)
+		})
+		if createErr != nil {
+			return errors.New("failed to create storage: " + createErr.Error())
+		}
+
+		// Benchmarks that fail report no iterations.
+		if result.N == 0 {
+			fmt.Fprintf(out, "%-28s %12s\n", bm.Name, "failed")
+			continue
+		}
+		opsPerSec := float64(result.N) / result.T.Seconds()
+		fmt.Fprintf(out, "%-28s %12d %12d %12.0f\n", bm.Name, result.N, result.NsPerOp(), opsPerSec)
+	}
+
+	return nil
+}
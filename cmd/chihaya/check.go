@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/spf13/cobra"
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/pkg/stop"
+	"github.com/chihaya/chihaya/storage"
+)
+
+// CheckConfigCmdFunc implements a Cobra command that checks a configuration
+// file without running Chihaya, so that invalid configurations are caught
+// before they are deployed.
+func CheckConfigCmdFunc(cmd *cobra.Command, args []string) error {
+	configFilePath, err := cmd.Flags().GetString("config")
+	if err != nil {
+		return err
+	}
+
+	errs := checkConfig(configFilePath)
+	for _, err := range errs {
+		log.Error("invalid configuration", log.Err(err))
+	}
+	if len(errs) != 0 {
+		return fmt.Errorf("%s: found %d errors", configFilePath, len(errs))
+	}
+
+	log.Info("configuration is valid", log.Fields{"path": configFilePath})
+	return nil
+}
+
+// checkConfig parses and validates the configuration file at path.
+//
+// Unlike Start, the file must not contain unknown fields. The hooks and the
+// storage are created and stopped again, which validates their options;
+// frontends are validated without listening.
+// Values that are replaced with defaults are logged as warnings, not
+// returned as errors.
+func checkConfig(path string) (errs []error) {
+	configFile, err := parseConfigFile(path, yaml.UnmarshalStrict)
+	if err != nil {
+		return []error{err}
+	}
+	cfg := configFile.Chihaya
+	if err := cfg.validateInstances(); err != nil {
+		return []error{err}
+	}
+	cfg.applyIPPolicies()
+
+	if err := loadPlugins(cfg); err != nil {
+		// Hooks of the plugins cannot be checked without them.
+		return []error{fmt.Errorf("plugins: %w", err)}
+	}
+
+	if cfg.TracingConfig.Enabled() {
+		cfg.TracingConfig.Validate()
+	}
+	if cfg.AccessLogConfig.Enabled() {
+		cfg.AccessLogConfig.Validate()
+	}
+	if cfg.StatsDConfig.Enabled() {
+		cfg.StatsDConfig.Validate()
+	}
+	cfg.DrainConfig.Validate()
+	if err := cfg.LogConfig.Check(); err != nil {
+		errs = append(errs, fmt.Errorf("log: %w", err))
+	}
+
+	frontends := checkTracker("", cfg.TrackerConfig, &errs)
+	for i, instance := range cfg.Instances {
+		prefix := fmt.Sprintf("instances[%d] (%s).", i, instance.Name)
+		frontends += checkTracker(prefix, instance.TrackerConfig, &errs)
+	}
+	if frontends == 0 {
+		log.Warn("no frontend configured")
+	}
+
+	return errs
+}
+
+// checkTracker validates the configuration of the top-level tracker or of an
+// instance, whose errors are prefixed with its location, and returns the
+// number of its frontends.
+func checkTracker(prefix string, cfg TrackerConfig, errs *[]error) (frontends int) {
+	checkIPPolicy := func(name string, p *bittorrent.IPPolicy) {
+		frontends++
+		if err := p.Init(); err != nil {
+			*errs = append(*errs, fmt.Errorf("%s%s.ip_policy: %w", prefix, name, err))
+		}
+	}
+	if cfg.httpEnabled() {
+		checkIPPolicy("http", cfg.HTTPConfig.Validate().IPPolicy)
+	}
+	if cfg.udpEnabled() {
+		checkIPPolicy("udp", cfg.UDPConfig.Validate().IPPolicy)
+	}
+	if cfg.webSocketEnabled() {
+		checkIPPolicy("websocket", cfg.WebSocketConfig.Validate().IPPolicy)
+	}
+
+	*errs = append(*errs, checkHooks(prefix+"prehooks", cfg.PreHooks)...)
+	*errs = append(*errs, checkHooks(prefix+"posthooks", cfg.PostHooks)...)
+
+	ps, err := storage.NewPeerStore(cfg.Storage.Name, cfg.Storage.Config)
+	if err != nil {
+		*errs = append(*errs, fmt.Errorf("%sstorage (%s): %w", prefix, cfg.Storage.Name, err))
+	} else if stopErrs := ps.Stop().Wait(); len(stopErrs) != 0 {
+		*errs = append(*errs, combineErrors(prefix+"storage ("+cfg.Storage.Name+"): failed to stop", stopErrs))
+	}
+
+	return frontends
+}
+
+// checkHooks creates the hooks of the configs one by one, so that errors
+// name the hook they belong to, and stops them again.
+func checkHooks(name string, cfgs []middleware.HookConfig) (errs []error) {
+	for i, cfg := range cfgs {
+		location := name + "[" + strconv.Itoa(i) + "] (" + cfg.Name + ")"
+
+		hooks, err := middleware.HooksFromHookConfigs([]middleware.HookConfig{cfg})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", location, err))
+			continue
+		}
+
+		if stopper, ok := hooks[0].(stop.Stopper); ok {
+			if stopErrs := stopper.Stop().Wait(); len(stopErrs) != 0 {
+				errs = append(errs, combineErrors(location+": failed to stop", stopErrs))
+			}
+		}
+	}
+	return errs
+}
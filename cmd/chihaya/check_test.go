@@ -0,0 +1,70 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckExampleConfig(t *testing.T) {
+	require.Empty(t, checkConfig("../../dist/example_config.yaml"))
+}
+
+func TestCheckConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chihaya.yaml")
+	require.Nil(t, os.WriteFile(path, []byte(`
+chihaya:
+  udp:
+    addr: "0.0.0.0:6969"
+    ip_policy:
+      action: "deny"
+  storage:
+    name: memory
+  prehooks:
+  - name: clientapproval
+    options:
+      whitelist: ["OP1011"]
+      blacklist: ["OP1012"]
+  - name: unknown
+`), 0o644))
+
+	errs := checkConfig(path)
+	require.Len(t, errs, 3)
+	require.Contains(t, errs[0].Error(), "udp.ip_policy")
+	require.Contains(t, errs[1].Error(), "prehooks[0] (clientapproval)")
+	require.Contains(t, errs[2].Error(), "prehooks[1] (unknown)")
+
+	// Instances are checked like the top-level tracker.
+	require.Nil(t, os.WriteFile(path, []byte(`
+chihaya:
+  storage:
+    name: memory
+  instances:
+  - name: tenant
+    storage:
+      name: unknown
+`), 0o644))
+	errs = checkConfig(path)
+	require.Len(t, errs, 1)
+	require.Contains(t, errs[0].Error(), "instances[0] (tenant).storage (unknown)")
+
+	// Log backends must be registered.
+	require.Nil(t, os.WriteFile(path, []byte(`
+chihaya:
+  storage:
+    name: memory
+  log:
+    backend: unknown
+`), 0o644))
+	errs = checkConfig(path)
+	require.Len(t, errs, 1)
+	require.Contains(t, errs[0].Error(), `log: unknown log backend "unknown"`)
+
+	// Unknown fields are rejected.
+	require.Nil(t, os.WriteFile(path, []byte("chihaya:\n  udp:\n    adr: \"0.0.0.0:6969\"\n"), 0o644))
+	errs = checkConfig(path)
+	require.Len(t, errs, 1)
+	require.Contains(t, errs[0].Error(), "adr")
+}
@@ -1,25 +1,60 @@
 package main
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"time"
 
 	yaml "gopkg.in/yaml.v2"
 
+	"github.com/chihaya/chihaya/bittorrent"
 	"github.com/chihaya/chihaya/frontend/http"
 	"github.com/chihaya/chihaya/frontend/udp"
+	"github.com/chihaya/chihaya/frontend/websocket"
 	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/pkg/accesslog"
+	"github.com/chihaya/chihaya/pkg/admin"
+	"github.com/chihaya/chihaya/pkg/drain"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/pkg/metrics"
+	"github.com/chihaya/chihaya/pkg/timecache"
+	"github.com/chihaya/chihaya/pkg/tracing"
 
 	// Imports to register middleware drivers.
+	_ "github.com/chihaya/chihaya/middleware/blocklist"
+	_ "github.com/chihaya/chihaya/middleware/cheatdetect"
 	_ "github.com/chihaya/chihaya/middleware/clientapproval"
+	_ "github.com/chihaya/chihaya/middleware/dedup"
+	_ "github.com/chihaya/chihaya/middleware/denylist"
+	_ "github.com/chihaya/chihaya/middleware/encryption"
+	_ "github.com/chihaya/chihaya/middleware/geoip"
+	_ "github.com/chihaya/chihaya/middleware/hybrid"
 	_ "github.com/chihaya/chihaya/middleware/jwt"
+	_ "github.com/chihaya/chihaya/middleware/kafka"
+	_ "github.com/chihaya/chihaya/middleware/luascript"
+	_ "github.com/chihaya/chihaya/middleware/passkey"
+	_ "github.com/chihaya/chihaya/middleware/pubsub"
+	_ "github.com/chihaya/chihaya/middleware/ratelimit"
+	_ "github.com/chihaya/chihaya/middleware/ratio"
+	_ "github.com/chihaya/chihaya/middleware/subnet"
+	_ "github.com/chihaya/chihaya/middleware/swarminterval"
 	_ "github.com/chihaya/chihaya/middleware/torrentapproval"
 	_ "github.com/chihaya/chihaya/middleware/varinterval"
+	_ "github.com/chihaya/chihaya/middleware/webhook"
+
+	// Imports to register log backends.
+	_ "github.com/chihaya/chihaya/pkg/log/zap"
+	_ "github.com/chihaya/chihaya/pkg/log/zerolog"
 
 	// Imports to register storage drivers.
+	_ "github.com/chihaya/chihaya/storage/bolt"
+	_ "github.com/chihaya/chihaya/storage/etcd"
 	_ "github.com/chihaya/chihaya/storage/memory"
 	_ "github.com/chihaya/chihaya/storage/redis"
+	_ "github.com/chihaya/chihaya/storage/tiered"
 )
 
 type storageConfig struct {
@@ -28,18 +63,49 @@ type storageConfig struct {
 }
 
 // Config represents the configuration used for executing Chihaya.
+//
+// The tracker configured at the top level is run along with the tracker
+// instances, while the other components, such as the metrics server, are
+// shared by all of them.
 type Config struct {
+	TrackerConfig   `yaml:",inline"`
+	MetricsAddr     string               `yaml:"metrics_addr"`
+	PprofConfig     metrics.PprofConfig  `yaml:"pprof"`
+	StatsDConfig    metrics.StatsDConfig `yaml:"statsd"`
+	AdminConfig     admin.Config         `yaml:"admin"`
+	Plugins         []string             `yaml:"plugins"`
+	TracingConfig   tracing.Config       `yaml:"tracing"`
+	AccessLogConfig accesslog.Config     `yaml:"access_log"`
+	DrainConfig     drain.Config         `yaml:"drain"`
+	LogConfig       log.Config           `yaml:"log"`
+	ClockResolution time.Duration        `yaml:"clock_resolution"`
+	ShutdownTimeout time.Duration        `yaml:"shutdown_timeout"`
+	Instances       []InstanceConfig     `yaml:"instances"`
+}
+
+// TrackerConfig represents the configuration of a tracker: the frontends,
+// hooks and storage serving a set of swarms.
+type TrackerConfig struct {
 	middleware.ResponseConfig `yaml:",inline"`
-	MetricsAddr               string                  `yaml:"metrics_addr"`
 	HTTPConfig                http.Config             `yaml:"http"`
 	UDPConfig                 udp.Config              `yaml:"udp"`
+	WebSocketConfig           websocket.Config        `yaml:"websocket"`
 	Storage                   storageConfig           `yaml:"storage"`
 	PreHooks                  []middleware.HookConfig `yaml:"prehooks"`
 	PostHooks                 []middleware.HookConfig `yaml:"posthooks"`
+	IPPolicy                  *bittorrent.IPPolicy    `yaml:"ip_policy"`
+}
+
+// InstanceConfig represents the configuration of a tracker instance, which
+// runs independently of the top-level tracker and the other instances, with
+// swarms of its own.
+type InstanceConfig struct {
+	Name          string `yaml:"name"`
+	TrackerConfig `yaml:",inline"`
 }
 
 // PreHookNames returns only the names of the configured middleware.
-func (cfg Config) PreHookNames() (names []string) {
+func (cfg TrackerConfig) PreHookNames() (names []string) {
 	for _, hook := range cfg.PreHooks {
 		names = append(names, hook.Name)
 	}
@@ -48,7 +114,7 @@ func (cfg Config) PreHookNames() (names []string) {
 }
 
 // PostHookNames returns only the names of the configured middleware.
-func (cfg Config) PostHookNames() (names []string) {
+func (cfg TrackerConfig) PostHookNames() (names []string) {
 	for _, hook := range cfg.PostHooks {
 		names = append(names, hook.Name)
 	}
@@ -56,6 +122,84 @@ func (cfg Config) PostHookNames() (names []string) {
 	return
 }
 
+// httpEnabled reports whether the HTTP frontend is configured.
+func (cfg TrackerConfig) httpEnabled() bool {
+	return cfg.HTTPConfig.Addr != "" || cfg.HTTPConfig.HTTPSAddr != "" ||
+		len(cfg.HTTPConfig.Addrs) > 0 || len(cfg.HTTPConfig.HTTPSAddrs) > 0
+}
+
+// udpEnabled reports whether the UDP frontend is configured.
+func (cfg TrackerConfig) udpEnabled() bool {
+	return cfg.UDPConfig.Addr != "" || len(cfg.UDPConfig.Addrs) > 0 ||
+		len(cfg.UDPConfig.IPv4.Addrs) > 0 || len(cfg.UDPConfig.IPv6.Addrs) > 0
+}
+
+// webSocketEnabled reports whether the WebSocket frontend is configured.
+func (cfg TrackerConfig) webSocketEnabled() bool {
+	return cfg.WebSocketConfig.Addr != ""
+}
+
+// applyIPPolicy sets the IP policy of all frontends that don't configure one
+// themselves. Every frontend gets its own copy.
+func (cfg *TrackerConfig) applyIPPolicy() {
+	if cfg.IPPolicy == nil {
+		return
+	}
+
+	for _, p := range []**bittorrent.IPPolicy{
+		&cfg.HTTPConfig.IPPolicy,
+		&cfg.UDPConfig.IPPolicy,
+		&cfg.WebSocketConfig.IPPolicy,
+	} {
+		if *p == nil {
+			policy := *cfg.IPPolicy
+			*p = &policy
+		}
+	}
+}
+
+// applyIPPolicies applies the IP policy of the top-level tracker and of every
+// instance to their own frontends.
+func (cfg *Config) applyIPPolicies() {
+	cfg.applyIPPolicy()
+	for i := range cfg.Instances {
+		cfg.Instances[i].applyIPPolicy()
+	}
+}
+
+// validateInstances checks that every instance has a unique name, by which
+// instances are matched when the configuration is reloaded.
+func (cfg Config) validateInstances() error {
+	names := make(map[string]bool, len(cfg.Instances))
+	for i, instance := range cfg.Instances {
+		switch {
+		case instance.Name == "":
+			return fmt.Errorf("instances[%d]: missing name", i)
+		case names[instance.Name]:
+			return fmt.Errorf("instances[%d]: duplicate name %q", i, instance.Name)
+		}
+		names[instance.Name] = true
+	}
+	return nil
+}
+
+// clockResolution returns the interval at which the cached clock is updated.
+func (cfg Config) clockResolution() time.Duration {
+	if cfg.ClockResolution <= 0 {
+		return timecache.DefaultResolution
+	}
+	return cfg.ClockResolution
+}
+
+// changed reports whether two parts of configurations differ.
+func changed(a, b interface{}) bool {
+	// Compare the serialized configurations, which excludes state kept in
+	// unexported fields.
+	aBytes, errA := yaml.Marshal(a)
+	bBytes, errB := yaml.Marshal(b)
+	return errA != nil || errB != nil || !bytes.Equal(aBytes, bBytes)
+}
+
 // ConfigFile represents a namespaced YAML configation file.
 type ConfigFile struct {
 	Chihaya Config `yaml:"chihaya"`
@@ -66,6 +210,12 @@ type ConfigFile struct {
 //
 // It supports relative and absolute paths and environment variables.
 func ParseConfigFile(path string) (*ConfigFile, error) {
+	return parseConfigFile(path, yaml.Unmarshal)
+}
+
+// parseConfigFile is ParseConfigFile with the given function to unmarshal
+// the file, e.g. yaml.UnmarshalStrict to reject unknown fields.
+func parseConfigFile(path string, unmarshal func([]byte, interface{}) error) (*ConfigFile, error) {
 	if path == "" {
 		return nil, errors.New("no config path specified")
 	}
@@ -82,7 +232,7 @@ func ParseConfigFile(path string) (*ConfigFile, error) {
 	}
 
 	var cfgFile ConfigFile
-	err = yaml.Unmarshal(contents, &cfgFile)
+	err = unmarshal(contents, &cfgFile)
 	if err != nil {
 		return nil, err
 	}
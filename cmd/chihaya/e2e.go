@@ -3,6 +3,7 @@ package main
 import (
 	"crypto/rand"
 	"fmt"
+	"sort"
 	"time"
 
 	"github.com/anacrolix/torrent/tracker"
@@ -15,38 +16,37 @@ import (
 
 // EndToEndRunCmdFunc implements a Cobra command that runs the end-to-end test
 // suite for a Chihaya build.
+//
+// The suite announces and scrapes new swarms through each frontend that an
+// address is provided for, which makes it a smoke test of the conformance of
+// a running tracker to the protocols.
 func EndToEndRunCmdFunc(cmd *cobra.Command, args []string) error {
 	delay, err := cmd.Flags().GetDuration("delay")
 	if err != nil {
 		return err
 	}
 
-	// Test the HTTP tracker
-	httpAddr, err := cmd.Flags().GetString("httpaddr")
-	if err != nil {
-		return err
-	}
-
-	if len(httpAddr) != 0 {
-		log.Info("testing HTTP...")
-		err := test(httpAddr, delay)
+	for _, frontend := range []struct {
+		name string
+		flag string
+		ipv6 bool
+	}{
+		{"HTTP", "httpaddr", false},
+		{"UDP", "udpaddr", false},
+		{"HTTP over IPv6", "http6addr", true},
+		{"UDP over IPv6", "udp6addr", true},
+	} {
+		addr, err := cmd.Flags().GetString(frontend.flag)
 		if err != nil {
 			return err
 		}
-		log.Info("success")
-	}
-
-	// Test the UDP tracker.
-	udpAddr, err := cmd.Flags().GetString("udpaddr")
-	if err != nil {
-		return err
-	}
+		if len(addr) == 0 {
+			continue
+		}
 
-	if len(udpAddr) != 0 {
-		log.Info("testing UDP...")
-		err := test(udpAddr, delay)
-		if err != nil {
-			return err
+		log.Info("testing " + frontend.name + "...")
+		if err := test(addr, frontend.ipv6, delay); err != nil {
+			return errors.Wrap(err, frontend.name)
 		}
 		log.Info("success")
 	}
@@ -68,9 +68,24 @@ func generateInfohash() [20]byte {
 	return [20]byte(bittorrent.InfoHashFromBytes(b))
 }
 
-func test(addr string, delay time.Duration) error {
-	ih := generateInfohash()
-	return testWithInfohash(ih, addr, delay)
+// test runs the suite against the tracker at addr. The peers of addresses
+// that are expected to be reached over IPv6 are checked to be IPv6 peers;
+// announces of the client library are only checked over IPv4.
+func test(addr string, ipv6 bool, delay time.Duration) error {
+	c, err := newTrackerClient(addr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if !ipv6 {
+		ih := generateInfohash()
+		if err := testWithInfohash(ih, addr, delay); err != nil {
+			return err
+		}
+	}
+
+	return testSwarm(c, generateInfohash(), ipv6, delay)
 }
 
 func testWithInfohash(infoHash [20]byte, url string, delay time.Duration) error {
@@ -132,3 +147,134 @@ func testWithInfohash(infoHash [20]byte, url string, delay time.Duration) error
 
 	return nil
 }
+
+// testSwarm checks the scrapes, stopped events and numwant edge cases of a
+// new swarm of a leecher, a seeder and a second leecher that joins later.
+func testSwarm(c trackerClient, infoHash [20]byte, ipv6 bool, delay time.Duration) error {
+	leecher := clientAnnounce{
+		InfoHash: infoHash,
+		PeerID:   [20]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 30},
+		Port:     10011,
+		Left:     100,
+		Event:    bittorrent.Started,
+		NumWant:  50,
+	}
+	seeder := leecher
+	seeder.PeerID[19], seeder.Port, seeder.Left = 31, 10012, 0
+	joining := leecher
+	joining.PeerID[19], joining.Port = 32, 10013
+
+	announce := func(name string, a clientAnnounce) (clientAnnounceResponse, error) {
+		resp, err := c.Announce(a)
+		if err != nil {
+			return resp, errors.Wrap(err, name+" announce failed")
+		}
+		for _, p := range resp.Peers {
+			if (p.IP.To4() == nil) != ipv6 {
+				return resp, fmt.Errorf("%s announce: got peer %s of the wrong address family", name, p)
+			}
+		}
+		time.Sleep(delay)
+		return resp, nil
+	}
+	scrape := func(name string, complete, incomplete uint32) error {
+		s, err := c.Scrape(infoHash)
+		if err != nil {
+			return errors.Wrap(err, "scrape "+name+" failed")
+		}
+		if s.Complete != complete || s.Incomplete != incomplete {
+			return fmt.Errorf("scrape %s: expected %d seeders and %d leechers, got %d and %d", name, complete, incomplete, s.Complete, s.Incomplete)
+		}
+		return nil
+	}
+
+	if _, err := announce("leecher", leecher); err != nil {
+		return err
+	}
+	if _, err := announce("seeder", seeder); err != nil {
+		return err
+	}
+	if err := scrape("after started events", 1, 1); err != nil {
+		return err
+	}
+
+	// numwant limits the peers returned.
+	joining.NumWant = 1
+	resp, err := announce("numwant=1", joining)
+	if err != nil {
+		return err
+	}
+	if len(resp.Peers) != 1 {
+		return fmt.Errorf("numwant=1 announce: expected 1 peer, got %v", resp.Peers)
+	}
+
+	// Peers that want none get at most themselves, which Chihaya returns to
+	// peers that would otherwise get no peers at all.
+	joining.Event, joining.NumWant = bittorrent.None, 0
+	resp, err = announce("numwant=0", joining)
+	if err != nil {
+		return err
+	}
+	if len(resp.Peers) != 0 {
+		if err := expectPorts("numwant=0 announce", resp.Peers, joining.Port); err != nil {
+			return err
+		}
+	}
+
+	// A numwant above max_numwant is lowered to the maximum, not rejected.
+	joining.NumWant = 1 << 20
+	resp, err = announce("numwant=1048576", joining)
+	if err != nil {
+		return err
+	}
+	if err := expectPorts("numwant=1048576 announce", resp.Peers, leecher.Port, seeder.Port); err != nil {
+		return err
+	}
+
+	// Stopped events remove the peer from the swarm.
+	leecher.Event = bittorrent.Stopped
+	if _, err := announce("stopped leecher", leecher); err != nil {
+		return err
+	}
+	if err := scrape("after stopped event", 1, 1); err != nil {
+		return err
+	}
+	joining.NumWant = 50
+	resp, err = announce("joining leecher", joining)
+	if err != nil {
+		return err
+	}
+	if err := expectPorts("joining leecher announce", resp.Peers, seeder.Port); err != nil {
+		return err
+	}
+
+	// Leave the swarm empty.
+	seeder.Event, joining.Event = bittorrent.Stopped, bittorrent.Stopped
+	if _, err := announce("stopped seeder", seeder); err != nil {
+		return err
+	}
+	if _, err := announce("stopped joining leecher", joining); err != nil {
+		return err
+	}
+	return scrape("after all stopped events", 0, 0)
+}
+
+// expectPorts returns an error unless the peers have exactly the ports, in any
+// order. The peers of a swarm of the end-to-end tests share an IP address.
+func expectPorts(name string, peers []clientPeer, ports ...uint16) error {
+	got := make([]int, 0, len(peers))
+	for _, p := range peers {
+		got = append(got, int(p.Port))
+	}
+	want := make([]int, 0, len(ports))
+	for _, port := range ports {
+		want = append(want, int(port))
+	}
+	sort.Ints(got)
+	sort.Ints(want)
+
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		return fmt.Errorf("%s: expected peers with ports %v, got %v", name, want, peers)
+	}
+	return nil
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/chihaya/chihaya/frontend/http"
+	"github.com/chihaya/chihaya/frontend/udp"
+	"github.com/chihaya/chihaya/frontend/websocket"
+	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/pkg/drain"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/pkg/stop"
+	"github.com/chihaya/chihaya/storage"
+)
+
+// instance represents a running tracker: a peer store and the logic and
+// frontends serving its swarms.
+//
+// The top-level tracker of the configuration runs as an instance without a
+// name.
+type instance struct {
+	name      string
+	cfg       TrackerConfig
+	peerStore storage.PeerStore
+	logic     *middleware.Logic
+
+	// drain is the drain state of the instance, which is kept when the
+	// logic is replaced.
+	drain *drain.State
+
+	// trackerLogic is the TrackerLogic of the frontends, which forwards to
+	// logic.
+	trackerLogic *trackerLogic
+
+	// The frontends are nil if they are disabled.
+	httpFrontend *http.Frontend
+	udpFrontend  *udp.Frontend
+	wsFrontend   *websocket.Frontend
+}
+
+// startInstance starts a tracker instance.
+// It is optional to provide an instance of the peer store to avoid the
+// creation of a new one.
+func startInstance(name string, cfg TrackerConfig, ps storage.PeerStore) (_ *instance, err error) {
+	t := &instance{name: name, cfg: cfg, drain: drain.NewState(name)}
+	defer func() {
+		if err != nil {
+			t.drain.Close()
+		}
+	}()
+
+	if ps == nil {
+		if ps, err = t.newPeerStore(cfg); err != nil {
+			return nil, err
+		}
+	}
+	t.peerStore = ps
+
+	preHooks, postHooks, err := newHooks(cfg)
+	if err != nil {
+		return nil, err
+	}
+	t.logic = t.newLogic(cfg, preHooks, postHooks)
+	t.trackerLogic = newTrackerLogic(t.logic)
+
+	if err := t.startHTTPFrontend(cfg); err != nil {
+		return nil, err
+	}
+	if err := t.startUDPFrontend(cfg); err != nil {
+		return nil, err
+	}
+	if err := t.startWebSocketFrontend(cfg); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// LogFields renders the name of the instance as a set of Logrus fields, which
+// is empty for the top-level tracker.
+func (t *instance) LogFields() log.Fields {
+	if t.name == "" {
+		return log.Fields{}
+	}
+	return log.Fields{"instance": t.name}
+}
+
+// newPeerStore creates the configured storage.
+func (t *instance) newPeerStore(cfg TrackerConfig) (storage.PeerStore, error) {
+	log.Info("starting storage", log.Fields{"name": cfg.Storage.Name}, t)
+	ps, err := storage.NewPeerStore(cfg.Storage.Name, cfg.Storage.Config)
+	if err != nil {
+		return nil, errors.New("failed to create storage: " + err.Error())
+	}
+	log.Info("started storage", ps, t)
+	return ps, nil
+}
+
+// newLogic creates the tracker logic.
+func (t *instance) newLogic(cfg TrackerConfig, preHooks, postHooks []middleware.Hook) *middleware.Logic {
+	log.Info("starting tracker logic", log.Fields{
+		"prehooks":  cfg.PreHookNames(),
+		"posthooks": cfg.PostHookNames(),
+	}, t)
+	l := middleware.NewLogic(cfg.ResponseConfig, t.peerStore, preHooks, postHooks)
+	l.SetDrain(t.drain)
+	return l
+}
+
+// newHooks creates the configured pre- and post-hooks.
+func newHooks(cfg TrackerConfig) (preHooks, postHooks []middleware.Hook, err error) {
+	preHooks, err = middleware.HooksFromHookConfigs(cfg.PreHooks)
+	if err != nil {
+		return nil, nil, errors.New("failed to validate hook config: " + err.Error())
+	}
+	postHooks, err = middleware.HooksFromHookConfigs(cfg.PostHooks)
+	if err != nil {
+		return nil, nil, errors.New("failed to validate hook config: " + err.Error())
+	}
+	return preHooks, postHooks, nil
+}
+
+// startHTTPFrontend starts the HTTP frontend, if it is configured.
+func (t *instance) startHTTPFrontend(cfg TrackerConfig) (err error) {
+	t.httpFrontend = nil
+	if !cfg.httpEnabled() {
+		return nil
+	}
+
+	log.Info("starting HTTP frontend", cfg.HTTPConfig, t)
+	t.httpFrontend, err = http.NewFrontend(t.trackerLogic, cfg.HTTPConfig)
+	return err
+}
+
+// startUDPFrontend starts the UDP frontend, if it is configured.
+func (t *instance) startUDPFrontend(cfg TrackerConfig) (err error) {
+	t.udpFrontend = nil
+	if !cfg.udpEnabled() {
+		return nil
+	}
+
+	log.Info("starting UDP frontend", cfg.UDPConfig, t)
+	t.udpFrontend, err = udp.NewFrontend(t.trackerLogic, cfg.UDPConfig)
+	return err
+}
+
+// startWebSocketFrontend starts the WebSocket frontend, if it is configured.
+func (t *instance) startWebSocketFrontend(cfg TrackerConfig) (err error) {
+	t.wsFrontend = nil
+	if !cfg.webSocketEnabled() {
+		return nil
+	}
+
+	log.Info("starting WebSocket frontend", cfg.WebSocketConfig, t)
+	t.wsFrontend, err = websocket.NewFrontend(t.trackerLogic, cfg.WebSocketConfig)
+	return err
+}
+
+// replacePeerStore creates a new peer store if the storage configuration
+// changed and returns the previous one, which must be stopped after the logic
+// using it was replaced by reloadLogic.
+func (t *instance) replacePeerStore(cfg TrackerConfig) (previous storage.PeerStore, err error) {
+	if !changed(t.cfg.Storage, cfg.Storage) {
+		return nil, nil
+	}
+
+	ps, err := t.newPeerStore(cfg)
+	if err != nil {
+		return nil, err
+	}
+	previous, t.peerStore = t.peerStore, ps
+	return previous, nil
+}
+
+// reloadLogic replaces the logic, without restarting the frontends, if the
+// storage or the response configuration changed. Otherwise, if only the hooks
+// changed, they are replaced, and the previous hooks are kept and restored in
+// cfg if the new hooks cannot be created.
+func (t *instance) reloadLogic(cfg *TrackerConfig, storageChanged bool) error {
+	if storageChanged || changed(t.cfg.ResponseConfig, cfg.ResponseConfig) {
+		preHooks, postHooks, err := newHooks(*cfg)
+		if err != nil {
+			return err
+		}
+		t.logic = t.newLogic(*cfg, preHooks, postHooks)
+		if errs := t.trackerLogic.set(t.logic).Wait(); len(errs) != 0 {
+			return combineErrors("failed while shutting down replaced logic", errs)
+		}
+	} else if changed(t.cfg.PreHooks, cfg.PreHooks) || changed(t.cfg.PostHooks, cfg.PostHooks) {
+		t.reloadHooks(cfg)
+	}
+	return nil
+}
+
+// reloadHooks replaces the hooks of the logic while it keeps serving
+// requests. If the new hooks cannot be created, the previous hooks are kept
+// and restored in cfg.
+func (t *instance) reloadHooks(cfg *TrackerConfig) {
+	preHooks, postHooks, err := newHooks(*cfg)
+	if err != nil {
+		log.Error("failed to reload hooks, keeping previous hooks", t, log.Err(err))
+		cfg.PreHooks, cfg.PostHooks = t.cfg.PreHooks, t.cfg.PostHooks
+		return
+	}
+
+	log.Info("replacing tracker logic hooks", log.Fields{
+		"prehooks":  cfg.PreHookNames(),
+		"posthooks": cfg.PostHookNames(),
+	}, t)
+	stopped := t.logic.SetHooks(preHooks, postHooks)
+
+	go func() {
+		if errs := stopped.Wait(); len(errs) != 0 {
+			log.Error("failed while shutting down replaced hooks", t, log.Err(combineErrors("replaced hooks", errs)))
+		}
+	}()
+}
+
+// reloadFrontends restarts the frontends whose configuration changed. The
+// others keep serving, so unchanged UDP frontends keep accepting the
+// connection IDs they issued.
+func (t *instance) reloadFrontends(cfg TrackerConfig) error {
+	if changed(t.cfg.HTTPConfig, cfg.HTTPConfig) {
+		if t.httpFrontend != nil {
+			if err := t.stopComponent("HTTP frontend", t.httpFrontend); err != nil {
+				return err
+			}
+		}
+		if err := t.startHTTPFrontend(cfg); err != nil {
+			return err
+		}
+	}
+	if changed(t.cfg.UDPConfig, cfg.UDPConfig) {
+		if t.udpFrontend != nil {
+			if err := t.stopComponent("UDP frontend", t.udpFrontend); err != nil {
+				return err
+			}
+		}
+		if err := t.startUDPFrontend(cfg); err != nil {
+			return err
+		}
+	}
+	if changed(t.cfg.WebSocketConfig, cfg.WebSocketConfig) {
+		if t.wsFrontend != nil {
+			if err := t.stopComponent("WebSocket frontend", t.wsFrontend); err != nil {
+				return err
+			}
+		}
+		if err := t.startWebSocketFrontend(cfg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The tiers of the shutdown. Frontends stop accepting requests before the
+// logic stops, whose post-hooks may still use the peer store. The tracing
+// exporter is stopped after the logic to export the spans of the post-hooks
+// that ran while the logic was stopped.
+const (
+	frontendTier = iota
+	accessLogTier
+	logicTier
+	tracerTier
+	peerStoreTier
+)
+
+// componentName returns the name of a component of the instance.
+func (t *instance) componentName(name string) string {
+	if t.name != "" {
+		name += " of instance " + t.name
+	}
+	return name
+}
+
+// addToGroup adds the components of the instance to a shutdown group in
+// their tiers. The peer store is added only if stopPeerStore is set.
+func (t *instance) addToGroup(sg *stop.Group, stopPeerStore bool) {
+	add := func(name string, tier int, s stop.Stopper) {
+		sg.AddMember(stop.Member{Name: t.componentName(name), Tier: tier, Stop: stop.StopperFunc(s)})
+	}
+
+	if t.httpFrontend != nil {
+		add("HTTP frontend", frontendTier, t.httpFrontend)
+	}
+	if t.udpFrontend != nil {
+		add("UDP frontend", frontendTier, t.udpFrontend)
+	}
+	if t.wsFrontend != nil {
+		add("WebSocket frontend", frontendTier, t.wsFrontend)
+	}
+	add("logic", logicTier, t.logic)
+	if stopPeerStore {
+		add("peer store", peerStoreTier, t.peerStore)
+	}
+}
+
+// stopComponent stops a component of the instance that is replaced or
+// disabled on reload.
+func (t *instance) stopComponent(name string, s stop.Stopper) error {
+	return stopComponent(t.componentName(name), s)
+}
+
+// stop shuts down an instance that was removed from the configuration.
+func (t *instance) stop() error {
+	t.drain.Close()
+
+	sg := stop.NewGroup()
+	t.addToGroup(sg, true)
+	if errs := sg.Stop().Wait(); len(errs) != 0 {
+		return combineErrors("failed while shutting down instance "+t.name, errs)
+	}
+	return nil
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	mathrand "math/rand"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/pkg/log"
+)
+
+// LoadTestRunCmdFunc implements a Cobra command that sends announces and
+// scrapes at a fixed rate to a running tracker and reports the latencies of
+// its responses, so that capacity can be planned without external tools.
+func LoadTestRunCmdFunc(cmd *cobra.Command, args []string) error {
+	var lt loadTest
+	var err error
+	flags := cmd.Flags()
+	if lt.HTTPAddr, err = flags.GetString("httpaddr"); err != nil {
+		return err
+	}
+	if lt.UDPAddr, err = flags.GetString("udpaddr"); err != nil {
+		return err
+	}
+	if lt.QPS, err = flags.GetFloat64("qps"); err != nil {
+		return err
+	}
+	if lt.Duration, err = flags.GetDuration("duration"); err != nil {
+		return err
+	}
+	if lt.Concurrency, err = flags.GetInt("concurrency"); err != nil {
+		return err
+	}
+	if lt.Swarms, err = flags.GetInt("swarms"); err != nil {
+		return err
+	}
+	if lt.PeersPerSwarm, err = flags.GetInt("peers"); err != nil {
+		return err
+	}
+	if lt.Churn, err = flags.GetFloat64("churn"); err != nil {
+		return err
+	}
+	if lt.ScrapeRatio, err = flags.GetFloat64("scrape-ratio"); err != nil {
+		return err
+	}
+	if lt.UDPRatio, err = flags.GetFloat64("udp-ratio"); err != nil {
+		return err
+	}
+	if err := lt.validate(); err != nil {
+		return err
+	}
+
+	// Interrupting the test still reports the requests sent so far.
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	log.Info("running load test", lt)
+	result, err := lt.run(ctx)
+	if err != nil {
+		return err
+	}
+	result.write(cmd.OutOrStdout())
+	return nil
+}
+
+// loadTest describes the traffic of a load test.
+//
+// Every worker owns a share of the peers of all swarms, whose requests it
+// sends one at a time. The peers announce from the address of the load test,
+// so they are told apart by their peer IDs and ports.
+type loadTest struct {
+	HTTPAddr    string
+	UDPAddr     string
+	QPS         float64
+	Duration    time.Duration
+	Concurrency int
+
+	Swarms        int
+	PeersPerSwarm int
+
+	// Churn is the fraction of announces of peers in a swarm that are
+	// stopped events. Stopped peers are replaced by new peers, which join
+	// the swarm with their next announce.
+	Churn float64
+
+	// ScrapeRatio is the fraction of requests that are scrapes.
+	ScrapeRatio float64
+
+	// UDPRatio is the fraction of requests sent to the UDP tracker.
+	UDPRatio float64
+}
+
+// LogFields renders the current config as a set of Logrus fields.
+func (lt loadTest) LogFields() log.Fields {
+	return log.Fields{
+		"httpAddr":      lt.HTTPAddr,
+		"udpAddr":       lt.UDPAddr,
+		"qps":           lt.QPS,
+		"duration":      lt.Duration,
+		"concurrency":   lt.Concurrency,
+		"swarms":        lt.Swarms,
+		"peersPerSwarm": lt.PeersPerSwarm,
+		"churn":         lt.Churn,
+		"scrapeRatio":   lt.ScrapeRatio,
+		"udpRatio":      lt.UDPRatio,
+	}
+}
+
+func (lt loadTest) validate() error {
+	switch {
+	case lt.QPS <= 0:
+		return errors.New("qps must be positive")
+	case lt.Duration <= 0:
+		return errors.New("duration must be positive")
+	case lt.Concurrency <= 0:
+		return errors.New("concurrency must be positive")
+	case lt.Swarms <= 0 || lt.PeersPerSwarm <= 0:
+		return errors.New("swarms and peers must be positive")
+	case lt.Swarms*lt.PeersPerSwarm < lt.Concurrency:
+		return errors.New("there must be at least as many peers in all swarms as workers")
+	case lt.Churn < 0 || lt.Churn > 1 || lt.ScrapeRatio < 0 || lt.ScrapeRatio > 1 || lt.UDPRatio < 0 || lt.UDPRatio > 1:
+		return errors.New("churn, scrape-ratio and udp-ratio must be between 0 and 1")
+	case lt.UDPRatio < 1 && lt.HTTPAddr == "":
+		return errors.New("httpaddr is required unless udp-ratio is 1")
+	case lt.UDPRatio > 0 && lt.UDPAddr == "":
+		return errors.New("udpaddr is required unless udp-ratio is 0")
+	}
+	return nil
+}
+
+// run sends requests until the duration passed or the context is canceled.
+func (lt loadTest) run(ctx context.Context) (*loadTestResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, lt.Duration)
+	defer cancel()
+
+	// Swarms of earlier runs may still contain peers, so every run uses
+	// swarms of its own.
+	var run [12]byte
+	if _, err := rand.Read(run[:]); err != nil {
+		return nil, err
+	}
+
+	workers := make([]*loadTestWorker, lt.Concurrency)
+	for i := range workers {
+		w := &loadTestWorker{
+			lt:      lt,
+			run:     run,
+			rand:    mathrand.New(mathrand.NewSource(time.Now().UnixNano() + int64(i))),
+			results: make(map[string]*loadTestStats),
+		}
+		for peer := i; peer < lt.Swarms*lt.PeersPerSwarm; peer += lt.Concurrency {
+			w.peers = append(w.peers, &loadTestPeer{index: peer})
+		}
+		if lt.UDPRatio < 1 {
+			c, err := newTrackerClient(lt.HTTPAddr)
+			if err != nil {
+				return nil, fmt.Errorf("httpaddr: %w", err)
+			}
+			w.http = c
+		}
+		if lt.UDPRatio > 0 {
+			c, err := newTrackerClient(lt.UDPAddr)
+			if err != nil {
+				return nil, fmt.Errorf("udpaddr: %w", err)
+			}
+			w.udp = c
+		}
+		workers[i] = w
+	}
+
+	// Requests are scheduled at the rate regardless of the responses, and
+	// skipped if all workers are busy.
+	requests := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, w := range workers {
+		wg.Add(1)
+		go func(w *loadTestWorker) {
+			defer wg.Done()
+			for range requests {
+				w.request()
+			}
+		}(w)
+	}
+
+	result := &loadTestResult{start: time.Now()}
+	interval := time.Duration(float64(time.Second) / lt.QPS)
+	next := result.start
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+schedule:
+	for {
+		select {
+		case <-ctx.Done():
+			break schedule
+		case <-timer.C:
+		}
+
+		now := time.Now()
+		for ; !next.After(now); next = next.Add(interval) {
+			select {
+			case requests <- struct{}{}:
+			default:
+				result.skipped++
+			}
+		}
+		timer.Reset(next.Sub(now))
+	}
+	close(requests)
+	wg.Wait()
+	result.elapsed = time.Since(result.start)
+
+	result.stats = make(map[string]*loadTestStats)
+	for _, w := range workers {
+		for name, stats := range w.results {
+			if result.stats[name] == nil {
+				result.stats[name] = &loadTestStats{}
+			}
+			result.stats[name].merge(stats)
+		}
+		for _, c := range []trackerClient{w.http, w.udp} {
+			if c != nil {
+				c.Close()
+			}
+		}
+	}
+	return result, nil
+}
+
+// loadTestPeer is a peer slot of a swarm, whose peer is replaced when it
+// stops.
+type loadTestPeer struct {
+	index      int
+	generation uint32
+	started    bool
+}
+
+type loadTestWorker struct {
+	lt      loadTest
+	run     [12]byte
+	rand    *mathrand.Rand
+	peers   []*loadTestPeer
+	http    trackerClient
+	udp     trackerClient
+	results map[string]*loadTestStats
+}
+
+// request sends one request drawn from the traffic of the load test.
+func (w *loadTestWorker) request() {
+	c, protocol := w.http, "http"
+	if w.rand.Float64() < w.lt.UDPRatio {
+		c, protocol = w.udp, "udp"
+	}
+
+	var name string
+	var err error
+	start := time.Now()
+	if w.rand.Float64() < w.lt.ScrapeRatio {
+		name = protocol + " scrape"
+		_, err = c.Scrape(w.infoHash(w.rand.Intn(w.lt.Swarms)))
+	} else {
+		name = protocol + " announce"
+		err = w.announce(c, w.peers[w.rand.Intn(len(w.peers))])
+	}
+	duration := time.Since(start)
+
+	stats, ok := w.results[name]
+	if !ok {
+		stats = &loadTestStats{}
+		w.results[name] = stats
+	}
+	if err != nil {
+		log.Debug("load test request failed", log.Fields{"request": name}, log.Err(err))
+		stats.errors++
+		if stats.firstErr == nil {
+			stats.firstErr = err
+		}
+		return
+	}
+	stats.durations = append(stats.durations, duration)
+}
+
+func (w *loadTestWorker) announce(c trackerClient, p *loadTestPeer) error {
+	a := clientAnnounce{
+		InfoHash: w.infoHash(p.index % w.lt.Swarms),
+		Port:     uint16(1024 + p.index%64000),
+		Left:     100,
+		Event:    bittorrent.None,
+		NumWant:  50,
+	}
+	copy(a.PeerID[:], "-LT0000-")
+	binary.BigEndian.PutUint64(a.PeerID[12:], uint64(p.index)<<32|uint64(p.generation))
+	// A fifth of the peers are seeders.
+	if p.index%5 == 0 {
+		a.Left = 0
+	}
+
+	switch {
+	case !p.started:
+		a.Event = bittorrent.Started
+	case w.rand.Float64() < w.lt.Churn:
+		a.Event = bittorrent.Stopped
+	}
+
+	if _, err := c.Announce(a); err != nil {
+		return err
+	}
+	switch a.Event {
+	case bittorrent.Started:
+		p.started = true
+	case bittorrent.Stopped:
+		p.started = false
+		p.generation++
+	}
+	return nil
+}
+
+func (w *loadTestWorker) infoHash(swarm int) (ih [20]byte) {
+	copy(ih[:], w.run[:])
+	binary.BigEndian.PutUint64(ih[12:], uint64(swarm))
+	return ih
+}
+
+// loadTestStats are the latencies and errors of one kind of request.
+type loadTestStats struct {
+	durations []time.Duration
+	errors    int
+	firstErr  error
+}
+
+func (s *loadTestStats) merge(other *loadTestStats) {
+	s.durations = append(s.durations, other.durations...)
+	s.errors += other.errors
+	if s.firstErr == nil {
+		s.firstErr = other.firstErr
+	}
+}
+
+type loadTestResult struct {
+	start   time.Time
+	elapsed time.Duration
+	skipped int
+	stats   map[string]*loadTestStats
+}
+
+// write prints the latency percentiles of the successful requests of every
+// kind and the first error of each.
+func (r *loadTestResult) write(out io.Writer) {
+	names := make([]string, 0, len(r.stats))
+	sent := 0
+	for name, stats := range r.stats {
+		names = append(names, name)
+		sent += len(stats.durations) + stats.errors
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(out, "sent %d requests in %s (%.0f/s), skipped %d because all workers were busy\n\n",
+		sent, r.elapsed.Round(time.Millisecond), float64(sent)/r.elapsed.Seconds(), r.skipped)
+	fmt.Fprintf(out, "%-14s %8s %8s %10s %10s %10s %10s %10s\n", "request", "ok", "errors", "p50", "p90", "p99", "p99.9", "max")
+	for _, name := range names {
+		stats := r.stats[name]
+		sort.Slice(stats.durations, func(i, j int) bool { return stats.durations[i] < stats.durations[j] })
+		fmt.Fprintf(out, "%-14s %8d %8d", name, len(stats.durations), stats.errors)
+		for _, p := range []float64{50, 90, 99, 99.9, 100} {
+			fmt.Fprintf(out, " %10s", percentile(stats.durations, p).Round(time.Microsecond))
+		}
+		fmt.Fprintln(out)
+	}
+
+	for _, name := range names {
+		if err := r.stats[name].firstErr; err != nil {
+			fmt.Fprintf(out, "first %s error: %s\n", name, err)
+		}
+	}
+}
+
+// percentile returns the p-th percentile of sorted durations by the nearest
+// rank, or zero if there are none.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	httpfrontend "github.com/chihaya/chihaya/frontend/http"
+)
+
+func TestPercentile(t *testing.T) {
+	sorted := []time.Duration{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	require.Equal(t, time.Duration(5), percentile(sorted, 50))
+	require.Equal(t, time.Duration(10), percentile(sorted, 99))
+	require.Equal(t, time.Duration(10), percentile(sorted, 100))
+	require.Equal(t, time.Duration(1), percentile(sorted, 0))
+	require.Equal(t, time.Duration(0), percentile(nil, 50))
+}
+
+func TestLoadTest(t *testing.T) {
+	var mu sync.Mutex
+	events := make(map[string]int)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ih bittorrent.InfoHash
+		copy(ih[:], r.URL.Query().Get("info_hash"))
+
+		switch r.URL.Path {
+		case "/announce":
+			mu.Lock()
+			events[r.URL.Query().Get("event")]++
+			mu.Unlock()
+			_ = httpfrontend.WriteAnnounceResponse(w, &bittorrent.AnnounceResponse{Compact: true})
+		case "/scrape":
+			_ = httpfrontend.WriteScrapeResponse(w, &bittorrent.ScrapeResponse{
+				Files: []bittorrent.Scrape{{InfoHash: ih}},
+			})
+		}
+	}))
+	defer srv.Close()
+
+	lt := loadTest{
+		HTTPAddr:      srv.URL + "/announce",
+		QPS:           500,
+		Duration:      500 * time.Millisecond,
+		Concurrency:   4,
+		Swarms:        2,
+		PeersPerSwarm: 4,
+		Churn:         0.2,
+		ScrapeRatio:   0.2,
+	}
+	require.Nil(t, lt.validate())
+
+	result, err := lt.run(context.Background())
+	require.Nil(t, err)
+	require.Len(t, result.stats, 2)
+	for name, stats := range result.stats {
+		require.NotEmpty(t, stats.durations, name)
+		require.Zero(t, stats.errors, name)
+	}
+
+	// Stopped peers are replaced by new peers that start again.
+	require.NotZero(t, events["stopped"])
+	require.Greater(t, events["started"], lt.Swarms*lt.PeersPerSwarm)
+
+	var out bytes.Buffer
+	result.write(&out)
+	require.Contains(t, out.String(), "http announce")
+	require.Contains(t, out.String(), "http scrape")
+}
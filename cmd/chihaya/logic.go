@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/frontend"
+	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/pkg/stop"
+)
+
+// trackerLogic is the TrackerLogic of the frontends. It forwards to the
+// current middleware.Logic, which Reload replaces when the storage or the
+// response configuration changed, without restarting the frontends.
+//
+// Like the hooks of a Logic, every call runs on the Logic that was current
+// when it started, and a replaced Logic is only stopped after all calls
+// running on it have returned.
+type trackerLogic struct {
+	mu      sync.RWMutex
+	current *runningLogic
+}
+
+var _ frontend.TrackerLogic = &trackerLogic{}
+
+// runningLogic is a Logic with the calls running on it.
+type runningLogic struct {
+	*middleware.Logic
+	inFlight sync.WaitGroup
+}
+
+func newTrackerLogic(l *middleware.Logic) *trackerLogic {
+	return &trackerLogic{current: &runningLogic{Logic: l}}
+}
+
+// acquire returns the current Logic, which must be released after use.
+func (t *trackerLogic) acquire() *runningLogic {
+	t.mu.RLock()
+	l := t.current
+	// Adding to the WaitGroup while holding the lock ensures that it happens
+	// before a replaced Logic is waited for.
+	l.inFlight.Add(1)
+	t.mu.RUnlock()
+	return l
+}
+
+func (l *runningLogic) release() {
+	l.inFlight.Done()
+}
+
+// set replaces the Logic. The returned Result stops the previous Logic once
+// the calls running on it have returned.
+func (t *trackerLogic) set(l *middleware.Logic) stop.Result {
+	t.mu.Lock()
+	old := t.current
+	t.current = &runningLogic{Logic: l}
+	t.mu.Unlock()
+
+	c := make(stop.Channel)
+	go func() {
+		old.inFlight.Wait()
+		c.Done(old.Stop().Wait()...)
+	}()
+	return c.Result()
+}
+
+// HandleAnnounce generates a response for an Announce.
+func (t *trackerLogic) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest) (context.Context, *bittorrent.AnnounceResponse, error) {
+	l := t.acquire()
+	defer l.release()
+	return l.HandleAnnounce(ctx, req)
+}
+
+// AfterAnnounce does something with the results of an Announce after it has
+// been completed.
+func (t *trackerLogic) AfterAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) {
+	l := t.acquire()
+	defer l.release()
+	l.AfterAnnounce(ctx, req, resp)
+}
+
+// HandleScrape generates a response for a Scrape.
+func (t *trackerLogic) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest) (context.Context, *bittorrent.ScrapeResponse, error) {
+	l := t.acquire()
+	defer l.release()
+	return l.HandleScrape(ctx, req)
+}
+
+// AfterScrape does something with the results of a Scrape after it has been
+// completed.
+func (t *trackerLogic) AfterScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) {
+	l := t.acquire()
+	defer l.release()
+	l.AfterScrape(ctx, req, resp)
+}
@@ -4,30 +4,54 @@ package main
 import (
 	"context"
 	"errors"
+	"os"
 	"os/signal"
 	"runtime"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 
-	"github.com/chihaya/chihaya/frontend/http"
-	"github.com/chihaya/chihaya/frontend/udp"
 	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/pkg/accesslog"
+	"github.com/chihaya/chihaya/pkg/admin"
+	"github.com/chihaya/chihaya/pkg/drain"
 	"github.com/chihaya/chihaya/pkg/log"
 	"github.com/chihaya/chihaya/pkg/metrics"
 	"github.com/chihaya/chihaya/pkg/stop"
+	"github.com/chihaya/chihaya/pkg/systemd"
+	"github.com/chihaya/chihaya/pkg/timecache"
+	"github.com/chihaya/chihaya/pkg/tracing"
 	"github.com/chihaya/chihaya/storage"
 )
 
 // Run represents the state of a running instance of Chihaya.
+//
+// Reload replaces the components whose configuration changed and keeps the
+// others running.
 type Run struct {
 	configFilePath string
-	peerStore      storage.PeerStore
-	logic          *middleware.Logic
-	sg             *stop.Group
+	cfg            Config
+	metricsServer  *metrics.Server
+
+	// tracker is the top-level tracker of the configuration, and instances
+	// are the configured instances, in order.
+	tracker   *instance
+	instances []*instance
+
+	// The following components are nil if they are disabled.
+	statsd      *metrics.StatsDExporter
+	adminServer *admin.Server
+	tracer      *tracing.Exporter
+	accessLog   *accesslog.Logger
+
+	// serving is set while the frontends are listening. It is accessed
+	// atomically.
+	serving int32
 }
 
 // NewRun runs an instance of Chihaya.
@@ -39,62 +63,380 @@ func NewRun(configFilePath string) (*Run, error) {
 	return r, r.Start(nil)
 }
 
-// Start begins an instance of Chihaya.
-// It is optional to provide an instance of the peer store to avoid the
-// creation of a new one.
-func (r *Run) Start(ps storage.PeerStore) error {
+// parseConfig reads the configuration file.
+func (r *Run) parseConfig() (Config, error) {
 	configFile, err := ParseConfigFile(r.configFilePath)
 	if err != nil {
-		return errors.New("failed to read config: " + err.Error())
+		return Config{}, errors.New("failed to read config: " + err.Error())
 	}
 	cfg := configFile.Chihaya
+	if err := cfg.validateInstances(); err != nil {
+		return Config{}, errors.New("invalid config: " + err.Error())
+	}
+	cfg.applyIPPolicies()
+	return cfg, nil
+}
+
+// trackers returns the top-level tracker followed by the instances.
+func (r *Run) trackers() []*instance {
+	return append([]*instance{r.tracker}, r.instances...)
+}
 
-	r.sg = stop.NewGroup()
+// Start begins an instance of Chihaya.
+// It is optional to provide an instance of the peer store of the top-level
+// tracker to avoid the creation of a new one.
+func (r *Run) Start(ps storage.PeerStore) error {
+	cfg, err := r.parseConfig()
+	if err != nil {
+		return err
+	}
+	r.cfg = cfg
 
-	log.Info("starting metrics server", log.Fields{"addr": cfg.MetricsAddr})
-	r.sg.Add(metrics.NewServer(cfg.MetricsAddr))
+	if err := log.Configure(cfg.LogConfig); err != nil {
+		return errors.New("failed to configure logging: " + err.Error())
+	}
+	timecache.SetResolution(cfg.clockResolution())
 
-	if ps == nil {
-		log.Info("starting storage", log.Fields{"name": cfg.Storage.Name})
-		ps, err = storage.NewPeerStore(cfg.Storage.Name, cfg.Storage.Config)
+	if err := loadPlugins(cfg); err != nil {
+		return err
+	}
+
+	drain.Configure(cfg.DrainConfig)
+
+	if err := r.startStatsD(cfg); err != nil {
+		return err
+	}
+	r.startTracing(cfg)
+	if err := r.startAccessLog(cfg); err != nil {
+		return err
+	}
+
+	if r.tracker, err = startInstance("", cfg.TrackerConfig, ps); err != nil {
+		return err
+	}
+	r.instances = nil
+	for _, instance := range cfg.Instances {
+		t, err := startInstance(instance.Name, instance.TrackerConfig, nil)
 		if err != nil {
-			return errors.New("failed to create storage: " + err.Error())
+			return errors.New("instance " + instance.Name + ": " + err.Error())
 		}
-		log.Info("started storage", ps)
+		r.instances = append(r.instances, t)
 	}
-	r.peerStore = ps
 
-	preHooks, err := middleware.HooksFromHookConfigs(cfg.PreHooks)
+	r.startMetricsServer(cfg)
+	r.startAdminServer(cfg)
+
+	atomic.StoreInt32(&r.serving, 1)
+	return nil
+}
+
+// startStatsD starts the statsd exporter, if it is enabled.
+func (r *Run) startStatsD(cfg Config) error {
+	r.statsd = nil
+	if !cfg.StatsDConfig.Enabled() {
+		return nil
+	}
+
+	log.Info("starting statsd exporter", cfg.StatsDConfig)
+	statsd, err := metrics.NewStatsDExporter(cfg.StatsDConfig, prometheus.DefaultGatherer)
 	if err != nil {
-		return errors.New("failed to validate hook config: " + err.Error())
+		return errors.New("failed to start statsd exporter: " + err.Error())
+	}
+	r.statsd = statsd
+	return nil
+}
+
+// startTracing starts the tracing exporter, if it is enabled.
+func (r *Run) startTracing(cfg Config) {
+	r.tracer = nil
+	if cfg.TracingConfig.Enabled() {
+		log.Info("starting tracing exporter", cfg.TracingConfig)
+		r.tracer = tracing.NewExporter(cfg.TracingConfig)
+	}
+}
+
+// startAccessLog starts the access log, if it is enabled.
+func (r *Run) startAccessLog(cfg Config) (err error) {
+	r.accessLog = nil
+	if !cfg.AccessLogConfig.Enabled() {
+		return nil
 	}
-	postHooks, err := middleware.HooksFromHookConfigs(cfg.PostHooks)
+
+	log.Info("starting access log", cfg.AccessLogConfig)
+	r.accessLog, err = accesslog.NewLogger(cfg.AccessLogConfig)
 	if err != nil {
-		return errors.New("failed to validate hook config: " + err.Error())
+		return errors.New("failed to open access log: " + err.Error())
 	}
+	return nil
+}
 
-	log.Info("starting tracker logic", log.Fields{
-		"prehooks":  cfg.PreHookNames(),
-		"posthooks": cfg.PostHookNames(),
+// startMetricsServer starts the metrics server with the health checks of the
+// peer stores and, unless it has an address of its own, the admin API.
+func (r *Run) startMetricsServer(cfg Config) {
+	log.Info("starting metrics server", log.Fields{
+		"addr":               cfg.MetricsAddr,
+		"pprofDisabled":      cfg.PprofConfig.Disabled,
+		"pprofAuthenticated": cfg.PprofConfig.APIKey != "",
 	})
-	r.logic = middleware.NewLogic(cfg.ResponseConfig, r.peerStore, preHooks, postHooks)
+	r.metricsServer = metrics.NewServer(cfg.MetricsAddr, cfg.PprofConfig)
+	r.metricsServer.AddReadinessCheck("frontends", r.checkFrontends)
+	r.metricsServer.AddReadinessCheck("drain", checkDrain)
+
+	for _, t := range r.trackers() {
+		name := "storage"
+		if t.name != "" {
+			name = "storage of instance " + t.name
+		}
+		ps := t.peerStore
+		r.metricsServer.AddHealthCheck(name, func(ctx context.Context) error {
+			return storage.Ping(ctx, ps)
+		})
+	}
+
+	if cfg.AdminConfig.Enabled() && cfg.AdminConfig.Addr == "" {
+		log.Info("starting admin API", cfg.AdminConfig)
+		r.metricsServer.Handle(admin.Prefix, admin.NewHandler(r.tracker.peerStore, cfg.AdminConfig.APIKey))
+	}
+}
+
+// startAdminServer starts the admin API, if it is enabled with an address of
+// its own. It serves the swarms of the top-level tracker.
+func (r *Run) startAdminServer(cfg Config) {
+	r.adminServer = nil
+	if cfg.AdminConfig.Enabled() && cfg.AdminConfig.Addr != "" {
+		log.Info("starting admin API", cfg.AdminConfig)
+		r.adminServer = admin.NewServer(cfg.AdminConfig, r.tracker.peerStore)
+	}
+}
+
+// checkFrontends reports whether the frontends are listening. Failing to
+// serve is fatal, so they are from the end of Start until Stop.
+func (r *Run) checkFrontends(context.Context) error {
+	if atomic.LoadInt32(&r.serving) == 0 {
+		return errors.New("not listening")
+	}
+	return nil
+}
+
+// checkDrain fails while the process is draining, so that load balancers stop
+// sending new clients.
+func checkDrain(context.Context) error {
+	if drain.Draining() {
+		return errors.New("draining")
+	}
+	return nil
+}
+
+// loadPlugins loads the configured plugins.
+func loadPlugins(cfg Config) error {
+	for _, path := range cfg.Plugins {
+		log.Info("loading plugin", log.Fields{"path": path})
+		if err := middleware.LoadPlugin(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reload applies changes of the configuration file.
+//
+// Only the components whose configuration changed are replaced; the others,
+// in particular the frontends, keep serving. A frontend is restarted only if
+// its own configuration changed, so unchanged UDP frontends keep accepting
+// the connection IDs they issued.
+//
+// If the storage or the response configuration of a tracker changed, its
+// logic is replaced without restarting its frontends. If only the hooks
+// changed, they are replaced, and the previous hooks are kept if the new hooks
+// cannot be created.
+//
+// Instances are matched by name: added instances are started, removed
+// instances are stopped and the others are reloaded like the top-level
+// tracker.
+func (r *Run) Reload() error {
+	cfg, err := r.parseConfig()
+	if err != nil {
+		return err
+	}
+	old := r.cfg
+
+	if changed(old.LogConfig, cfg.LogConfig) {
+		log.Info("reconfiguring logging", cfg.LogConfig)
+		if err := log.Configure(cfg.LogConfig); err != nil {
+			return errors.New("failed to configure logging: " + err.Error())
+		}
+	}
 
-	if cfg.HTTPConfig.Addr != "" {
-		log.Info("starting HTTP frontend", cfg.HTTPConfig)
-		httpfe, err := http.NewFrontend(r.logic, cfg.HTTPConfig)
+	if old.clockResolution() != cfg.clockResolution() {
+		log.Info("changing clock resolution", log.Fields{"resolution": cfg.clockResolution()})
+		timecache.SetResolution(cfg.clockResolution())
+	}
+
+	if changed(old.Plugins, cfg.Plugins) {
+		if err := loadPlugins(cfg); err != nil {
+			return err
+		}
+	}
+
+	if changed(old.DrainConfig, cfg.DrainConfig) {
+		drain.Configure(cfg.DrainConfig)
+	}
+
+	if changed(old.StatsDConfig, cfg.StatsDConfig) {
+		if r.statsd != nil {
+			if err := stopComponent("statsd exporter", r.statsd); err != nil {
+				return err
+			}
+		}
+		if err := r.startStatsD(cfg); err != nil {
+			return err
+		}
+	}
+
+	// The tracing exporter and the access log are replaced before they are
+	// stopped, so that no spans or entries are lost in between.
+	if changed(old.TracingConfig, cfg.TracingConfig) {
+		previous := r.tracer
+		r.startTracing(cfg)
+		if previous != nil {
+			if err := stopComponent("tracing exporter", previous); err != nil {
+				return err
+			}
+		}
+	}
+	if changed(old.AccessLogConfig, cfg.AccessLogConfig) {
+		previous := r.accessLog
+		if err := r.startAccessLog(cfg); err != nil {
+			return err
+		}
+		if previous != nil {
+			if err := stopComponent("access log", previous); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Replaced peer stores are stopped after the logic using them.
+	type reloadedTracker struct {
+		t                 *instance
+		cfg               *TrackerConfig
+		previousPeerStore storage.PeerStore
+	}
+	var reloaded []reloadedTracker
+	reloadTracker := func(t *instance, cfg *TrackerConfig) error {
+		previous, err := t.replacePeerStore(*cfg)
 		if err != nil {
 			return err
 		}
-		r.sg.Add(httpfe)
+		reloaded = append(reloaded, reloadedTracker{t, cfg, previous})
+		return nil
+	}
+
+	if err := reloadTracker(r.tracker, &cfg.TrackerConfig); err != nil {
+		return err
 	}
+	topLevelStorageChanged := reloaded[0].previousPeerStore != nil
 
-	if cfg.UDPConfig.Addr != "" {
-		log.Info("starting UDP frontend", cfg.UDPConfig)
-		udpfe, err := udp.NewFrontend(r.logic, cfg.UDPConfig)
+	removed := make(map[string]*instance, len(r.instances))
+	for _, t := range r.instances {
+		removed[t.name] = t
+	}
+	instances := make([]*instance, 0, len(cfg.Instances))
+	instancesChanged := len(cfg.Instances) != len(r.instances)
+	for i := range cfg.Instances {
+		instance := &cfg.Instances[i]
+		if t, ok := removed[instance.Name]; ok {
+			delete(removed, instance.Name)
+			if err := reloadTracker(t, &instance.TrackerConfig); err != nil {
+				return err
+			}
+			instances = append(instances, t)
+			continue
+		}
+
+		instancesChanged = true
+		t, err := startInstance(instance.Name, instance.TrackerConfig, nil)
 		if err != nil {
+			return errors.New("instance " + instance.Name + ": " + err.Error())
+		}
+		instances = append(instances, t)
+	}
+	r.instances = instances
+
+	storageChanged := instancesChanged
+	for _, rt := range reloaded {
+		storageChanged = storageChanged || rt.previousPeerStore != nil
+	}
+
+	// The metrics server serves the health checks of the peer stores and may
+	// serve the admin API, so it is restarted when either changes.
+	adminChanged := topLevelStorageChanged || changed(old.AdminConfig, cfg.AdminConfig)
+	adminMounted := func(cfg Config) bool { return cfg.AdminConfig.Enabled() && cfg.AdminConfig.Addr == "" }
+	if storageChanged || changed(old.MetricsAddr, cfg.MetricsAddr) || changed(old.PprofConfig, cfg.PprofConfig) ||
+		(adminChanged && (adminMounted(old) || adminMounted(cfg))) {
+		if err := stopComponent("metrics server", r.metricsServer); err != nil {
 			return err
 		}
-		r.sg.Add(udpfe)
+		r.startMetricsServer(cfg)
+	}
+	if adminChanged {
+		if r.adminServer != nil {
+			if err := stopComponent("admin API", r.adminServer); err != nil {
+				return err
+			}
+		}
+		r.startAdminServer(cfg)
+	}
+
+	for _, rt := range reloaded {
+		if err := rt.t.reloadLogic(rt.cfg, rt.previousPeerStore != nil); err != nil {
+			return err
+		}
+		if rt.previousPeerStore != nil {
+			if err := rt.t.stopComponent("replaced peer store", rt.previousPeerStore); err != nil {
+				return err
+			}
+		}
+		if err := rt.t.reloadFrontends(*rt.cfg); err != nil {
+			return err
+		}
+		rt.t.cfg = *rt.cfg
+	}
+
+	for _, t := range removed {
+		log.Info("stopping removed instance", t)
+		if err := t.stop(); err != nil {
+			return err
+		}
+	}
+
+	r.cfg = cfg
+	return nil
+}
+
+// stopComponent stops a component that is replaced or disabled on reload.
+func stopComponent(name string, s stop.Stopper) error {
+	log.Info("stopping " + name)
+	if errs := s.Stop().Wait(); len(errs) != 0 {
+		return combineErrors("failed while shutting down "+name, errs)
+	}
+	return nil
+}
+
+// ReloadCertificates reloads the TLS certificates of the running frontends
+// without restarting them.
+func (r *Run) ReloadCertificates() error {
+	for _, t := range r.trackers() {
+		if t.httpFrontend != nil {
+			if err := t.httpFrontend.ReloadCertificate(); err != nil {
+				return err
+			}
+		}
+		if t.wsFrontend != nil {
+			if err := t.wsFrontend.ReloadCertificate(); err != nil {
+				return err
+			}
+		}
 	}
 
 	return nil
@@ -110,26 +452,53 @@ func combineErrors(prefix string, errs []error) error {
 }
 
 // Stop shuts down an instance of Chihaya.
+//
+// If keepPeerStore is set, the peer store of the top-level tracker is kept
+// running and returned; those of instances are always stopped.
+//
+// The shutdown is bounded by the configured shutdown_timeout, after which
+// the remaining components are abandoned and an error is returned.
 func (r *Run) Stop(keepPeerStore bool) (storage.PeerStore, error) {
-	log.Debug("stopping frontends and metrics server")
-	if errs := r.sg.Stop().Wait(); len(errs) != 0 {
-		return nil, combineErrors("failed while shutting down frontends", errs)
+	atomic.StoreInt32(&r.serving, 0)
+
+	ctx := context.Background()
+	if r.cfg.ShutdownTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.cfg.ShutdownTimeout)
+		defer cancel()
 	}
 
-	log.Debug("stopping logic")
-	if errs := r.logic.Stop().Wait(); len(errs) != 0 {
-		return nil, combineErrors("failed while shutting down middleware", errs)
+	sg := stop.NewGroup()
+	add := func(name string, tier int, s stop.Stopper) {
+		sg.AddMember(stop.Member{Name: name, Tier: tier, Stop: stop.StopperFunc(s)})
+	}
+	add("metrics server", frontendTier, r.metricsServer)
+	if r.statsd != nil {
+		add("statsd exporter", frontendTier, r.statsd)
+	}
+	if r.adminServer != nil {
+		add("admin server", frontendTier, r.adminServer)
+	}
+	if r.accessLog != nil {
+		add("access log", accessLogTier, r.accessLog)
+	}
+	if r.tracer != nil {
+		add("tracing exporter", tracerTier, r.tracer)
+	}
+	for _, t := range r.trackers() {
+		t.drain.Close()
+		t.addToGroup(sg, t != r.tracker || !keepPeerStore)
 	}
 
+	log.Debug("stopping components")
+	if errs := sg.StopContext(ctx).Wait(); len(errs) != 0 {
+		return nil, combineErrors("failed while shutting down", errs)
+	}
 	if !keepPeerStore {
-		log.Debug("stopping peer store")
-		if errs := r.peerStore.Stop().Wait(); len(errs) != 0 {
-			return nil, combineErrors("failed while shutting down peer store", errs)
-		}
-		r.peerStore = nil
+		r.tracker.peerStore = nil
 	}
 
-	return r.peerStore, nil
+	return r.tracker.peerStore, nil
 }
 
 // RootRunCmdFunc implements a Cobra command that runs an instance of Chihaya
@@ -144,33 +513,72 @@ func RootRunCmdFunc(cmd *cobra.Command, args []string) error {
 	if err != nil {
 		return err
 	}
+	notify(systemd.Ready)
 
 	ctx, _ := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
-	reload, _ := signal.NotifyContext(context.Background(), ReloadSignals...)
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, ReloadSignals...)
+
+	certReload := make(chan os.Signal, 1)
+	if len(CertReloadSignals) > 0 {
+		signal.Notify(certReload, CertReloadSignals...)
+	}
+
+	drainSignal := make(chan os.Signal, 1)
+	if len(DrainSignals) > 0 {
+		signal.Notify(drainSignal, DrainSignals...)
+	}
+
+	// Draining is started by a signal or the admin API. drainStarted is set
+	// to nil once it started, and drained fires at the end of the drain
+	// period.
+	drainStarted := drain.Started()
+	var drained <-chan time.Time
+
+	shutdown := func() error {
+		notify(systemd.Stopping)
+		_, err := r.Stop(false)
+		return err
+	}
 
 	for {
 		select {
-		case <-reload.Done():
-			log.Info("reloading; received reload signal")
-			peerStore, err := r.Stop(true)
-			if err != nil {
-				return err
+		case <-certReload:
+			log.Info("reloading TLS certificates; received certificate reload signal")
+			if err := r.ReloadCertificates(); err != nil {
+				log.Error("failed to reload TLS certificates", log.Err(err))
 			}
-
-			if err := r.Start(peerStore); err != nil {
+		case <-reload:
+			log.Info("reloading; received reload signal")
+			notify(systemd.Reloading)
+			if err := r.Reload(); err != nil {
 				return err
 			}
+			notify(systemd.Ready)
+		case <-drainSignal:
+			log.Info("draining; received drain signal")
+			drain.Start()
+		case <-drainStarted:
+			period := drain.CurrentConfig().Period
+			log.Info("shutting down after the drain period", log.Fields{"period": period})
+			drainStarted, drained = nil, time.After(period)
+		case <-drained:
+			log.Info("shutting down; drain period elapsed")
+			return shutdown()
 		case <-ctx.Done():
 			log.Info("shutting down; received shutdown signal")
-			if _, err := r.Stop(false); err != nil {
-				return err
-			}
-
-			return nil
+			return shutdown()
 		}
 	}
 }
 
+// notify sends a state to systemd if Chihaya runs as a notify service.
+func notify(state string) {
+	if _, err := systemd.Notify(state); err != nil {
+		log.Warn("failed to notify systemd", log.Fields{"state": state}, log.Err(err))
+	}
+}
+
 // RootPreRunCmdFunc handles command line flags for the Run command.
 func RootPreRunCmdFunc(cmd *cobra.Command, args []string) error {
 	noColors, err := cmd.Flags().GetBool("nocolors")
@@ -237,10 +645,59 @@ func main() {
 
 	e2eCmd.Flags().String("httpaddr", "http://127.0.0.1:6969/announce", "address of the HTTP tracker")
 	e2eCmd.Flags().String("udpaddr", "udp://127.0.0.1:6969", "address of the UDP tracker")
+	e2eCmd.Flags().String("http6addr", "", "address of the HTTP tracker over IPv6, e.g. http://[::1]:6969/announce")
+	e2eCmd.Flags().String("udp6addr", "", "address of the UDP tracker over IPv6, e.g. udp://[::1]:6969")
 	e2eCmd.Flags().Duration("delay", time.Second, "delay between announces")
 
 	rootCmd.AddCommand(e2eCmd)
 
+	checkConfigCmd := &cobra.Command{
+		Use:   "check-config",
+		Short: "check a configuration file",
+		Long:  "Parse and validate a configuration file, including the options of hooks and storage, and exit non-zero if it is invalid",
+		RunE:  CheckConfigCmdFunc,
+	}
+
+	checkConfigCmd.Flags().String("config", "/etc/chihaya.yaml", "location of configuration file")
+
+	rootCmd.AddCommand(checkConfigCmd)
+
+	benchCmd := &cobra.Command{
+		Use:   "bench",
+		Short: "benchmark a storage",
+		Long:  "Run the storage benchmark suite against the storage of a configuration file and print the throughput and latency of its operations",
+		RunE:  BenchRunCmdFunc,
+	}
+
+	benchCmd.Flags().String("config", "/etc/chihaya.yaml", "location of configuration file")
+	benchCmd.Flags().String("run", ".", "regular expression selecting the benchmarks to run")
+	benchCmd.Flags().Duration("benchtime", time.Second, "duration each benchmark runs for")
+	benchCmd.Flags().Bool("allow-clear", false, "allow deleting all swarms of shared storages, such as redis")
+
+	rootCmd.AddCommand(benchCmd)
+
+	loadTestCmd := &cobra.Command{
+		Use:   "loadtest",
+		Short: "load test a tracker",
+		Long:  "Send announces and scrapes at a fixed rate to a running tracker and print the latency percentiles of its responses",
+		RunE:  LoadTestRunCmdFunc,
+	}
+
+	loadTestCmd.Flags().String("httpaddr", "http://127.0.0.1:6969/announce", "address of the HTTP tracker")
+	loadTestCmd.Flags().String("udpaddr", "udp://127.0.0.1:6969", "address of the UDP tracker")
+	loadTestCmd.Flags().Float64("qps", 1000, "requests sent per second")
+	loadTestCmd.Flags().Duration("duration", 30*time.Second, "duration of the load test")
+	loadTestCmd.Flags().Int("concurrency", 64, "maximum number of requests waiting for a response")
+	loadTestCmd.Flags().Int("swarms", 1000, "number of swarms")
+	loadTestCmd.Flags().Int("peers", 20, "number of peers per swarm")
+	loadTestCmd.Flags().Float64("churn", 0.05, "fraction of announces that are stopped events of peers replaced by new ones")
+	loadTestCmd.Flags().Float64("scrape-ratio", 0.1, "fraction of requests that are scrapes")
+	loadTestCmd.Flags().Float64("udp-ratio", 0.5, "fraction of requests sent to the UDP tracker")
+
+	rootCmd.AddCommand(loadTestCmd)
+
+	rootCmd.AddCommand(adminCmd())
+
 	if err := rootCmd.Execute(); err != nil {
 		log.Fatal("failed when executing root cobra command: " + err.Error())
 	}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chihaya.yaml")
+	writeConfig := func(interval, udpAddr, hook string) {
+		require.Nil(t, os.WriteFile(path, []byte(fmt.Sprintf(`
+chihaya:
+  announce_interval: %s
+  metrics_addr: "127.0.0.1:0"
+  udp:
+    addr: %q
+  storage:
+    name: memory
+  prehooks:
+  - name: client approval
+    options:
+      blacklist: [%q]
+`, interval, udpAddr, hook)), 0o644))
+	}
+
+	writeConfig("30m", "127.0.0.1:0", "OP1011")
+	r, err := NewRun(path)
+	require.Nil(t, err)
+
+	metricsServer, peerStore, logic, udpFrontend := r.metricsServer, r.tracker.peerStore, r.tracker.logic, r.tracker.udpFrontend
+
+	// Changed hooks are replaced in the running logic.
+	writeConfig("30m", "127.0.0.1:0", "OP1012")
+	require.Nil(t, r.Reload())
+	require.Equal(t, "OP1012", r.cfg.PreHooks[0].Options["blacklist"].([]interface{})[0])
+	require.True(t, metricsServer == r.metricsServer)
+	require.True(t, peerStore == r.tracker.peerStore)
+	require.True(t, logic == r.tracker.logic)
+	require.True(t, udpFrontend == r.tracker.udpFrontend)
+
+	// A changed response configuration replaces the logic only.
+	writeConfig("15m", "127.0.0.1:0", "OP1012")
+	require.Nil(t, r.Reload())
+	require.True(t, metricsServer == r.metricsServer)
+	require.True(t, peerStore == r.tracker.peerStore)
+	require.False(t, logic == r.tracker.logic)
+	require.True(t, r.tracker.logic == r.tracker.trackerLogic.current.Logic)
+	require.True(t, udpFrontend == r.tracker.udpFrontend)
+
+	// A changed frontend configuration restarts the frontend only.
+	logic = r.tracker.logic
+	writeConfig("15m", "localhost:0", "OP1012")
+	require.Nil(t, r.Reload())
+	require.True(t, metricsServer == r.metricsServer)
+	require.True(t, logic == r.tracker.logic)
+	require.False(t, udpFrontend == r.tracker.udpFrontend)
+
+	_, err = r.Stop(false)
+	require.Nil(t, err)
+}
+
+func TestInstances(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chihaya.yaml")
+	writeConfig := func(instances string) {
+		require.Nil(t, os.WriteFile(path, []byte(`
+chihaya:
+  metrics_addr: "127.0.0.1:0"
+  storage:
+    name: memory
+  instances:
+`+instances), 0o644))
+	}
+
+	writeConfig(`
+  - name: a
+    udp:
+      addr: "127.0.0.1:0"
+    storage:
+      name: memory
+  - name: b
+    storage:
+      name: memory
+`)
+	r, err := NewRun(path)
+	require.Nil(t, err)
+	require.Len(t, r.instances, 2)
+	require.Nil(t, r.tracker.udpFrontend)
+	require.NotNil(t, r.instances[0].udpFrontend)
+	require.False(t, r.tracker.peerStore == r.instances[0].peerStore)
+	require.False(t, r.instances[0].peerStore == r.instances[1].peerStore)
+	a, metricsServer := r.instances[0], r.metricsServer
+
+	// Instances are matched by name: b is removed and c is added, while a
+	// keeps running.
+	writeConfig(`
+  - name: c
+    storage:
+      name: memory
+  - name: a
+    udp:
+      addr: "127.0.0.1:0"
+    storage:
+      name: memory
+`)
+	require.Nil(t, r.Reload())
+	require.Len(t, r.instances, 2)
+	require.Equal(t, "c", r.instances[0].name)
+	require.True(t, a == r.instances[1])
+	require.True(t, a.udpFrontend == r.instances[1].udpFrontend)
+	require.False(t, metricsServer == r.metricsServer)
+
+	// Instances must have unique names.
+	writeConfig(`
+  - name: a
+    storage:
+      name: memory
+  - name: a
+    storage:
+      name: memory
+`)
+	require.NotNil(t, r.Reload())
+
+	_, err = r.Stop(false)
+	require.Nil(t, err)
+}
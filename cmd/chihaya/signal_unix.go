@@ -13,3 +13,15 @@ import (
 var ReloadSignals = []os.Signal{
 	syscall.SIGUSR1,
 }
+
+// CertReloadSignals are the signals that the current OS will send to the
+// process when a reload of TLS certificates is requested.
+var CertReloadSignals = []os.Signal{
+	syscall.SIGHUP,
+}
+
+// DrainSignals are the signals that the current OS will send to the process
+// when draining is requested.
+var DrainSignals = []os.Signal{
+	syscall.SIGUSR2,
+}
@@ -11,3 +11,11 @@ import (
 var ReloadSignals = []os.Signal{
 	syscall.SIGHUP,
 }
+
+// CertReloadSignals is empty on Windows, because SIGHUP already triggers a
+// full reload, which includes TLS certificates.
+var CertReloadSignals = []os.Signal{}
+
+// DrainSignals is empty on Windows, which lacks a spare signal; use the
+// admin API to drain.
+var DrainSignals = []os.Signal{}
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/frontend/http/bencode"
+)
+
+// clientTimeout is the time a trackerClient waits for a response.
+const clientTimeout = 5 * time.Second
+
+// clientAnnounce is an announce sent by a trackerClient.
+type clientAnnounce struct {
+	InfoHash [20]byte
+	PeerID   [20]byte
+	Port     uint16
+	Left     uint64
+	Event    bittorrent.Event
+	NumWant  uint32
+}
+
+// clientPeer is a peer returned in the compact format, which has no peer ID.
+type clientPeer struct {
+	IP   net.IP
+	Port uint16
+}
+
+func (p clientPeer) String() string {
+	return net.JoinHostPort(p.IP.String(), strconv.Itoa(int(p.Port)))
+}
+
+// clientAnnounceResponse is the response to a clientAnnounce.
+type clientAnnounceResponse struct {
+	Complete   uint32
+	Incomplete uint32
+	Peers      []clientPeer
+}
+
+// clientScrape is the scrape of a single swarm.
+type clientScrape struct {
+	Complete   uint32
+	Incomplete uint32
+	Snatches   uint32
+}
+
+// trackerClient is a minimal client of a frontend, so that the end-to-end and
+// load tests control every parameter of the requests they send.
+//
+// trackerClients are not safe for concurrent use.
+type trackerClient interface {
+	Announce(a clientAnnounce) (clientAnnounceResponse, error)
+	Scrape(infoHash [20]byte) (clientScrape, error)
+	Close() error
+}
+
+// newTrackerClient creates a client of the HTTP or UDP tracker at addr,
+// depending on its scheme.
+func newTrackerClient(addr string) (trackerClient, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		scrape, err := scrapeURL(u)
+		if err != nil {
+			return nil, err
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		return &httpTrackerClient{
+			announceURL: u.String(),
+			scrapeURL:   scrape,
+			transport:   transport,
+			client:      &http.Client{Transport: transport, Timeout: clientTimeout},
+		}, nil
+	case "udp":
+		return &udpTrackerClient{addr: u.Host}, nil
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+}
+
+// scrapeURL derives the scrape URL from an announce URL by the convention
+// that clients follow: the "announce" at the start of the last path segment
+// is replaced with "scrape".
+func scrapeURL(announceURL *url.URL) (string, error) {
+	i := strings.LastIndex(announceURL.Path, "/")
+	if !strings.HasPrefix(announceURL.Path[i+1:], "announce") {
+		return "", errors.New("cannot derive the scrape URL from announce URL " + announceURL.String())
+	}
+
+	u := *announceURL
+	u.Path = announceURL.Path[:i+1] + "scrape" + strings.TrimPrefix(announceURL.Path[i+1:], "announce")
+	u.RawPath = ""
+	return u.String(), nil
+}
+
+// httpTrackerClient is a trackerClient of the HTTP frontend.
+type httpTrackerClient struct {
+	announceURL string
+	scrapeURL   string
+	transport   *http.Transport
+	client      *http.Client
+}
+
+func (c *httpTrackerClient) Announce(a clientAnnounce) (clientAnnounceResponse, error) {
+	query := url.Values{
+		"info_hash":  {string(a.InfoHash[:])},
+		"peer_id":    {string(a.PeerID[:])},
+		"port":       {strconv.Itoa(int(a.Port))},
+		"uploaded":   {"0"},
+		"downloaded": {"0"},
+		"left":       {strconv.FormatUint(a.Left, 10)},
+		"numwant":    {strconv.FormatUint(uint64(a.NumWant), 10)},
+		"compact":    {"1"},
+	}
+	if a.Event != bittorrent.None {
+		query.Set("event", a.Event.String())
+	}
+
+	dict, err := c.get(c.announceURL, query)
+	if err != nil {
+		return clientAnnounceResponse{}, err
+	}
+	return parseHTTPAnnounceResponse(dict)
+}
+
+func (c *httpTrackerClient) Scrape(infoHash [20]byte) (clientScrape, error) {
+	dict, err := c.get(c.scrapeURL, url.Values{"info_hash": {string(infoHash[:])}})
+	if err != nil {
+		return clientScrape{}, err
+	}
+	return parseHTTPScrapeResponse(dict, infoHash)
+}
+
+func (c *httpTrackerClient) Close() error {
+	c.transport.CloseIdleConnections()
+	return nil
+}
+
+// get sends a request to the tracker and returns the bencoded dictionary it
+// responds with, or the failure reason as an error.
+func (c *httpTrackerClient) get(rawURL string, query url.Values) (bencode.Dict, error) {
+	sep := "?"
+	if strings.Contains(rawURL, "?") {
+		sep = "&"
+	}
+	resp, err := c.client.Get(rawURL + sep + query.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	v, err := bencode.Unmarshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("invalid response: %w", err)
+	}
+	dict, ok := v.(bencode.Dict)
+	if !ok {
+		return nil, errors.New("invalid response: not a dictionary")
+	}
+	if reason, ok := dict["failure reason"]; ok {
+		return nil, fmt.Errorf("tracker error: %v", reason)
+	}
+	return dict, nil
+}
+
+func parseHTTPAnnounceResponse(dict bencode.Dict) (resp clientAnnounceResponse, err error) {
+	if resp.Complete, err = dictUint32(dict, "complete"); err != nil {
+		return resp, err
+	}
+	if resp.Incomplete, err = dictUint32(dict, "incomplete"); err != nil {
+		return resp, err
+	}
+
+	for key, size := range map[string]int{"peers": net.IPv4len + 2, "peers6": net.IPv6len + 2} {
+		v, ok := dict[key]
+		if !ok {
+			continue
+		}
+		compact, ok := v.(string)
+		if !ok {
+			return resp, errors.New("invalid response: " + key + " is not compact")
+		}
+		peers, err := parseCompactPeers([]byte(compact), size)
+		if err != nil {
+			return resp, err
+		}
+		resp.Peers = append(resp.Peers, peers...)
+	}
+
+	return resp, nil
+}
+
+func parseHTTPScrapeResponse(dict bencode.Dict, infoHash [20]byte) (scrape clientScrape, err error) {
+	files, ok := dict["files"].(bencode.Dict)
+	if !ok {
+		return scrape, errors.New("invalid response: missing files")
+	}
+	file, ok := files[string(infoHash[:])].(bencode.Dict)
+	if !ok {
+		return scrape, errors.New("invalid response: missing the scraped infohash")
+	}
+
+	if scrape.Complete, err = dictUint32(file, "complete"); err != nil {
+		return scrape, err
+	}
+	if scrape.Incomplete, err = dictUint32(file, "incomplete"); err != nil {
+		return scrape, err
+	}
+	if scrape.Snatches, err = dictUint32(file, "downloaded"); err != nil {
+		return scrape, err
+	}
+	return scrape, nil
+}
+
+func dictUint32(dict bencode.Dict, key string) (uint32, error) {
+	v, ok := dict[key].(int64)
+	if !ok || v < 0 || v > int64(^uint32(0)) {
+		return 0, errors.New("invalid response: missing or invalid " + key)
+	}
+	return uint32(v), nil
+}
+
+// parseCompactPeers parses peers in the compact format, in which each peer is
+// an IP address followed by a port, size bytes in total.
+func parseCompactPeers(b []byte, size int) ([]clientPeer, error) {
+	if len(b)%size != 0 {
+		return nil, fmt.Errorf("invalid compact peers: length %d is not a multiple of %d", len(b), size)
+	}
+
+	peers := make([]clientPeer, 0, len(b)/size)
+	for ; len(b) > 0; b = b[size:] {
+		peers = append(peers, clientPeer{
+			IP:   net.IP(append([]byte(nil), b[:size-2]...)),
+			Port: binary.BigEndian.Uint16(b[size-2 : size]),
+		})
+	}
+	return peers, nil
+}
+
+// Actions of the UDP tracker protocol as specified in BEP 15.
+const (
+	udpConnectAction  uint32 = 0
+	udpAnnounceAction uint32 = 1
+	udpScrapeAction   uint32 = 2
+	udpErrorAction    uint32 = 3
+
+	udpProtocolID uint64 = 0x41727101980
+)
+
+// udpEvents are the numbers of the events in the UDP tracker protocol.
+var udpEvents = map[bittorrent.Event]uint32{
+	bittorrent.None:      0,
+	bittorrent.Completed: 1,
+	bittorrent.Started:   2,
+	bittorrent.Stopped:   3,
+}
+
+// udpTrackerClient is a trackerClient of the UDP frontend.
+//
+// Like other clients, it uses a connection ID for up to a minute.
+type udpTrackerClient struct {
+	addr         string
+	conn         net.Conn
+	connID       []byte
+	connIDExpiry time.Time
+}
+
+func (c *udpTrackerClient) Announce(a clientAnnounce) (clientAnnounceResponse, error) {
+	event, ok := udpEvents[a.Event]
+	if !ok {
+		return clientAnnounceResponse{}, errors.New("unsupported event " + a.Event.String())
+	}
+
+	var resp clientAnnounceResponse
+	err := c.do(udpAnnounceAction, func(packet []byte) []byte {
+		packet = append(packet, a.InfoHash[:]...)
+		packet = append(packet, a.PeerID[:]...)
+		packet = appendUint64(packet, 0) // downloaded
+		packet = appendUint64(packet, a.Left)
+		packet = appendUint64(packet, 0) // uploaded
+		packet = appendUint32(packet, event)
+		packet = appendUint32(packet, 0) // IP address
+		packet = appendUint32(packet, 0) // key
+		packet = appendUint32(packet, a.NumWant)
+		return append(packet, byte(a.Port>>8), byte(a.Port))
+	}, func(body []byte, ipv6 bool) (err error) {
+		// The interval, leechers and seeders are followed by the peers of
+		// the address family of the request.
+		if len(body) < 12 {
+			return errors.New("invalid response: too short")
+		}
+		resp.Incomplete = binary.BigEndian.Uint32(body[4:8])
+		resp.Complete = binary.BigEndian.Uint32(body[8:12])
+
+		size := net.IPv4len + 2
+		if ipv6 {
+			size = net.IPv6len + 2
+		}
+		resp.Peers, err = parseCompactPeers(body[12:], size)
+		return err
+	})
+	return resp, err
+}
+
+func (c *udpTrackerClient) Scrape(infoHash [20]byte) (clientScrape, error) {
+	var scrape clientScrape
+	err := c.do(udpScrapeAction, func(packet []byte) []byte {
+		return append(packet, infoHash[:]...)
+	}, func(body []byte, _ bool) error {
+		if len(body) != 12 {
+			return errors.New("invalid response: expected the scrape of one infohash")
+		}
+		scrape.Complete = binary.BigEndian.Uint32(body[0:4])
+		scrape.Snatches = binary.BigEndian.Uint32(body[4:8])
+		scrape.Incomplete = binary.BigEndian.Uint32(body[8:12])
+		return nil
+	})
+	return scrape, err
+}
+
+func (c *udpTrackerClient) Close() error {
+	if c.conn == nil {
+		return nil
+	}
+	return c.conn.Close()
+}
+
+// do obtains a connection ID if needed and sends a request of the action,
+// whose body is appended to the header by writeBody. The body of the response
+// is passed to readBody, along with whether the request was sent over IPv6.
+func (c *udpTrackerClient) do(action uint32, writeBody func([]byte) []byte, readBody func(body []byte, ipv6 bool) error) error {
+	if c.conn == nil {
+		conn, err := net.Dial("udp", c.addr)
+		if err != nil {
+			return err
+		}
+		c.conn = conn
+	}
+	now := time.Now()
+	if err := c.conn.SetDeadline(now.Add(clientTimeout)); err != nil {
+		return err
+	}
+
+	if now.After(c.connIDExpiry) {
+		connect := appendUint32(appendUint64(nil, udpProtocolID), udpConnectAction)
+		body, err := udpRoundTrip(c.conn, connect, udpConnectAction)
+		if err != nil {
+			return fmt.Errorf("connect failed: %w", err)
+		}
+		if len(body) != 8 {
+			return errors.New("connect failed: invalid response")
+		}
+		c.connID, c.connIDExpiry = body, now.Add(time.Minute)
+	}
+
+	header := append(append([]byte(nil), c.connID...), 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(header[8:], action)
+	body, err := udpRoundTrip(c.conn, writeBody(header), action)
+	if err != nil {
+		// The connection ID may have been rejected, e.g. after the tracker
+		// rotated its key.
+		c.connIDExpiry = time.Time{}
+		return err
+	}
+
+	ipv6 := c.conn.RemoteAddr().(*net.UDPAddr).IP.To4() == nil
+	return readBody(body, ipv6)
+}
+
+// udpRoundTrip sends a request that starts with the connection ID and the
+// action, after which the transaction ID is inserted, and returns the body of
+// the response. Error responses are returned as errors.
+func udpRoundTrip(conn net.Conn, request []byte, action uint32) ([]byte, error) {
+	txID := make([]byte, 4)
+	if _, err := rand.Read(txID); err != nil {
+		return nil, err
+	}
+	packet := append(append(append([]byte(nil), request[:12]...), txID...), request[12:]...)
+	if _, err := conn.Write(packet); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 2048)
+	var resp []byte
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		resp = buf[:n]
+		if len(resp) < 8 {
+			return nil, errors.New("invalid response: too short")
+		}
+		// Skip late responses to earlier requests that timed out.
+		if string(resp[4:8]) == string(txID) {
+			break
+		}
+	}
+
+	switch respAction := binary.BigEndian.Uint32(resp[:4]); respAction {
+	case action:
+		return resp[8:], nil
+	case udpErrorAction:
+		return nil, errors.New("tracker error: " + strings.TrimRight(string(resp[8:]), "\x00"))
+	default:
+		return nil, fmt.Errorf("invalid response: unexpected action %d", respAction)
+	}
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	return appendUint32(appendUint32(b, uint32(v>>32)), uint32(v))
+}
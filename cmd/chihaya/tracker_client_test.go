@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	httpfrontend "github.com/chihaya/chihaya/frontend/http"
+)
+
+func TestScrapeURL(t *testing.T) {
+	for _, tc := range []struct {
+		announce string
+		scrape   string
+	}{
+		{"http://127.0.0.1:6969/announce", "http://127.0.0.1:6969/scrape"},
+		{"http://example.com/a/announce.php?key=1", "http://example.com/a/scrape.php?key=1"},
+		{"http://example.com/announce/key", ""},
+	} {
+		u, err := url.Parse(tc.announce)
+		require.Nil(t, err)
+
+		scrape, err := scrapeURL(u)
+		if tc.scrape == "" {
+			require.NotNil(t, err, tc.announce)
+			continue
+		}
+		require.Nil(t, err, tc.announce)
+		require.Equal(t, tc.scrape, scrape)
+	}
+}
+
+func TestHTTPTrackerClient(t *testing.T) {
+	var infoHash [20]byte
+	infoHash[0] = 1
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/announce":
+			require.Equal(t, "17", r.URL.Query().Get("numwant"))
+			require.Equal(t, "stopped", r.URL.Query().Get("event"))
+			_ = httpfrontend.WriteAnnounceResponse(w, &bittorrent.AnnounceResponse{
+				Compact:    true,
+				Complete:   2,
+				Incomplete: 3,
+				IPv4Peers:  []bittorrent.Peer{{IP: bittorrent.IP{IP: net.IPv4(10, 0, 0, 1).To4(), AddressFamily: bittorrent.IPv4}, Port: 1234}},
+				IPv6Peers:  []bittorrent.Peer{{IP: bittorrent.IP{IP: net.ParseIP("fc00::1"), AddressFamily: bittorrent.IPv6}, Port: 5678}},
+			})
+		case "/scrape":
+			_ = httpfrontend.WriteScrapeResponse(w, &bittorrent.ScrapeResponse{
+				Files: []bittorrent.Scrape{{InfoHash: bittorrent.InfoHash(infoHash), Complete: 4, Incomplete: 5, Snatches: 6}},
+			})
+		default:
+			_ = httpfrontend.WriteError(w, bittorrent.ClientError("unknown route"))
+		}
+	}))
+	defer srv.Close()
+
+	c, err := newTrackerClient(srv.URL + "/announce")
+	require.Nil(t, err)
+
+	resp, err := c.Announce(clientAnnounce{InfoHash: infoHash, Event: bittorrent.Stopped, NumWant: 17})
+	require.Nil(t, err)
+	require.Equal(t, uint32(2), resp.Complete)
+	require.Equal(t, uint32(3), resp.Incomplete)
+	require.Len(t, resp.Peers, 2)
+	require.ElementsMatch(t, []string{"10.0.0.1:1234", "[fc00::1]:5678"}, []string{resp.Peers[0].String(), resp.Peers[1].String()})
+
+	scrape, err := c.Scrape(infoHash)
+	require.Nil(t, err)
+	require.Equal(t, clientScrape{Complete: 4, Incomplete: 5, Snatches: 6}, scrape)
+
+	c, err = newTrackerClient(srv.URL + "/other/announce")
+	require.Nil(t, err)
+	_, err = c.Announce(clientAnnounce{})
+	require.EqualError(t, err, "tracker error: unknown route")
+}
@@ -20,6 +20,10 @@ type TrackerLogic interface {
 
 	// AfterAnnounce does something with the results of an Announce after it
 	// has been completed.
+	//
+	// AfterAnnounce takes ownership of the request and response, which may be
+	// released to their pools, see bittorrent.NewAnnounceRequest.
+	// Callers must not use them afterwards.
 	AfterAnnounce(context.Context, *bittorrent.AnnounceRequest, *bittorrent.AnnounceResponse)
 
 	// HandleScrape generates a response for a Scrape.
@@ -31,3 +35,13 @@ type TrackerLogic interface {
 	// AfterScrape does something with the results of a Scrape after it has been completed.
 	AfterScrape(context.Context, *bittorrent.ScrapeRequest, *bittorrent.ScrapeResponse)
 }
+
+type webTorrent struct{}
+
+// WebTorrentKey is a key for the context of a request to mark it as a request
+// of a WebTorrent peer.
+// Any non-nil value set for this key marks the request.
+//
+// WebTorrent peers can only connect to each other, via WebRTC, so a
+// TrackerLogic must keep them in swarms separate from those of other peers.
+var WebTorrentKey = webTorrent{}
@@ -11,27 +11,41 @@ import (
 	"time"
 
 	"github.com/julienschmidt/httprouter"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 
 	"github.com/chihaya/chihaya/bittorrent"
 	"github.com/chihaya/chihaya/frontend"
+	"github.com/chihaya/chihaya/pkg/accesslog"
 	"github.com/chihaya/chihaya/pkg/log"
 	"github.com/chihaya/chihaya/pkg/stop"
+	"github.com/chihaya/chihaya/pkg/systemd"
+	"github.com/chihaya/chihaya/pkg/tracing"
 )
 
 // Config represents all of the configurable options for an HTTP BitTorrent
 // Frontend.
 type Config struct {
 	Addr                string        `yaml:"addr"`
+	Addrs               []string      `yaml:"addrs"`
 	HTTPSAddr           string        `yaml:"https_addr"`
+	HTTPSAddrs          []string      `yaml:"https_addrs"`
+	HTTP3Addr           string        `yaml:"http3_addr"`
 	ReadTimeout         time.Duration `yaml:"read_timeout"`
 	WriteTimeout        time.Duration `yaml:"write_timeout"`
 	IdleTimeout         time.Duration `yaml:"idle_timeout"`
+	MaxHeaderBytes      int           `yaml:"max_header_bytes"`
+	HandlerTimeout      time.Duration `yaml:"handler_timeout"`
+	RequestTimeout      time.Duration `yaml:"request_timeout"`
 	EnableKeepAlive     bool          `yaml:"enable_keepalive"`
+	EnableHTTP2         bool          `yaml:"enable_http2"`
+	EnableH2C           bool          `yaml:"enable_h2c"`
 	TLSCertPath         string        `yaml:"tls_cert_path"`
 	TLSKeyPath          string        `yaml:"tls_key_path"`
 	AnnounceRoutes      []string      `yaml:"announce_routes"`
 	ScrapeRoutes        []string      `yaml:"scrape_routes"`
 	EnableRequestTiming bool          `yaml:"enable_request_timing"`
+	EnableExternalIP    bool          `yaml:"enable_external_ip"`
 	ParseOptions        `yaml:",inline"`
 }
 
@@ -39,18 +53,29 @@ type Config struct {
 func (cfg Config) LogFields() log.Fields {
 	return log.Fields{
 		"addr":                cfg.Addr,
+		"addrs":               cfg.Addrs,
 		"httpsAddr":           cfg.HTTPSAddr,
+		"httpsAddrs":          cfg.HTTPSAddrs,
+		"http3Addr":           cfg.HTTP3Addr,
 		"readTimeout":         cfg.ReadTimeout,
 		"writeTimeout":        cfg.WriteTimeout,
 		"idleTimeout":         cfg.IdleTimeout,
+		"maxHeaderBytes":      cfg.MaxHeaderBytes,
+		"handlerTimeout":      cfg.HandlerTimeout,
+		"requestTimeout":      cfg.RequestTimeout,
 		"enableKeepAlive":     cfg.EnableKeepAlive,
+		"enableHTTP2":         cfg.EnableHTTP2,
+		"enableH2C":           cfg.EnableH2C,
 		"tlsCertPath":         cfg.TLSCertPath,
 		"tlsKeyPath":          cfg.TLSKeyPath,
 		"announceRoutes":      cfg.AnnounceRoutes,
 		"scrapeRoutes":        cfg.ScrapeRoutes,
 		"enableRequestTiming": cfg.EnableRequestTiming,
+		"enableExternalIP":    cfg.EnableExternalIP,
 		"allowIPSpoofing":     cfg.AllowIPSpoofing,
 		"realIPHeader":        cfg.RealIPHeader,
+		"trustedProxies":      cfg.TrustedProxies,
+		"allowNonCompact":     cfg.AllowNonCompact,
 		"maxNumWant":          cfg.MaxNumWant,
 		"defaultNumWant":      cfg.DefaultNumWant,
 		"maxScrapeInfoHashes": cfg.MaxScrapeInfoHashes,
@@ -62,6 +87,8 @@ const (
 	defaultReadTimeout  = 2 * time.Second
 	defaultWriteTimeout = 2 * time.Second
 	defaultIdleTimeout  = 30 * time.Second
+
+	defaultMaxHeaderBytes = http.DefaultMaxHeaderBytes
 )
 
 // Validate sanity checks values set in a config and returns a new config with
@@ -102,6 +129,15 @@ func (cfg Config) Validate() Config {
 		}
 	}
 
+	if cfg.MaxHeaderBytes <= 0 {
+		validcfg.MaxHeaderBytes = defaultMaxHeaderBytes
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     "http.MaxHeaderBytes",
+			"provided": cfg.MaxHeaderBytes,
+			"default":  validcfg.MaxHeaderBytes,
+		})
+	}
+
 	if cfg.MaxNumWant <= 0 {
 		validcfg.MaxNumWant = defaultMaxNumWant
 		log.Warn("falling back to default configuration", log.Fields{
@@ -132,11 +168,28 @@ func (cfg Config) Validate() Config {
 	return validcfg
 }
 
+// httpAddrs returns all addresses to serve non-TLS HTTP on.
+func (cfg Config) httpAddrs() []string {
+	if cfg.Addr == "" {
+		return cfg.Addrs
+	}
+	return append([]string{cfg.Addr}, cfg.Addrs...)
+}
+
+// httpsAddrs returns all addresses to serve HTTPS on.
+func (cfg Config) httpsAddrs() []string {
+	if cfg.HTTPSAddr == "" {
+		return cfg.HTTPSAddrs
+	}
+	return append([]string{cfg.HTTPSAddr}, cfg.HTTPSAddrs...)
+}
+
 // Frontend represents the state of an HTTP BitTorrent Frontend.
 type Frontend struct {
-	srv    *http.Server
-	tlsSrv *http.Server
-	tlsCfg *tls.Config
+	servers []*http.Server
+	h3      *http3Server
+	tlsCfg  *tls.Config
+	keypair *frontend.KeypairReloader
 
 	logic frontend.TrackerLogic
 	Config
@@ -152,64 +205,102 @@ func NewFrontend(logic frontend.TrackerLogic, provided Config) (*Frontend, error
 		Config: cfg,
 	}
 
-	if cfg.Addr == "" && cfg.HTTPSAddr == "" {
-		return nil, errors.New("must specify addr or https_addr or both")
+	httpAddrs, httpsAddrs := cfg.httpAddrs(), cfg.httpsAddrs()
+	if len(httpAddrs) == 0 && len(httpsAddrs) == 0 && cfg.HTTP3Addr == "" {
+		return nil, errors.New("must specify addr, https_addr or http3_addr")
 	}
 
 	if len(cfg.AnnounceRoutes) < 1 || len(cfg.ScrapeRoutes) < 1 {
 		return nil, errors.New("must specify routes")
 	}
 
-	// If TLS is enabled, create a key pair.
+	if err := f.ParseOptions.parseTrustedProxies(); err != nil {
+		return nil, err
+	}
+
+	if err := f.ParseOptions.IPPolicy.Init(); err != nil {
+		return nil, err
+	}
+
+	// If TLS is enabled, load the key pair.
 	if cfg.TLSCertPath != "" && cfg.TLSKeyPath != "" {
 		var err error
-		f.tlsCfg = &tls.Config{
-			MinVersion:   tls.VersionTLS12,
-			Certificates: make([]tls.Certificate, 1),
-		}
-		f.tlsCfg.Certificates[0], err = tls.LoadX509KeyPair(cfg.TLSCertPath, cfg.TLSKeyPath)
+		f.keypair, err = frontend.NewKeypairReloader(cfg.TLSCertPath, cfg.TLSKeyPath)
 		if err != nil {
 			return nil, err
 		}
+		f.tlsCfg = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: f.keypair.GetCertificate,
+		}
 	}
 
-	if cfg.HTTPSAddr != "" && f.tlsCfg == nil {
+	if len(httpsAddrs) > 0 && f.tlsCfg == nil {
 		return nil, errors.New("must specify tls_cert_path and tls_key_path when using https_addr")
 	}
-	if cfg.HTTPSAddr == "" && f.tlsCfg != nil {
-		return nil, errors.New("must specify https_addr when using tls_cert_path and tls_key_path")
+	if cfg.HTTP3Addr != "" && f.tlsCfg == nil {
+		return nil, errors.New("must specify tls_cert_path and tls_key_path when using http3_addr")
+	}
+	if len(httpsAddrs) == 0 && cfg.HTTP3Addr == "" && f.tlsCfg != nil {
+		return nil, errors.New("must specify https_addr or http3_addr when using tls_cert_path and tls_key_path")
 	}
 
-	var listenerHTTP, listenerHTTPS net.Listener
-	var err error
-	if cfg.Addr != "" {
-		listenerHTTP, err = net.Listen("tcp", f.Addr)
+	var listeners []net.Listener
+	closeListeners := func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+		if f.h3 != nil {
+			f.h3.conn.Close()
+		}
+	}
+
+	if cfg.HTTP3Addr != "" {
+		var err error
+		if f.h3, err = f.newHTTP3Server(cfg.HTTP3Addr); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, addr := range httpAddrs {
+		l, err := listen(addr)
 		if err != nil {
+			closeListeners()
 			return nil, err
 		}
+		listeners = append(listeners, l)
+		f.servers = append(f.servers, f.newHTTPServer(addr))
 	}
-	if cfg.HTTPSAddr != "" {
-		listenerHTTPS, err = net.Listen("tcp", f.HTTPSAddr)
+
+	for _, addr := range httpsAddrs {
+		l, err := listen(addr)
 		if err != nil {
-			if listenerHTTP != nil {
-				listenerHTTP.Close()
-			}
+			closeListeners()
 			return nil, err
 		}
+		listeners = append(listeners, l)
+
+		srv, err := f.newHTTPSServer(addr)
+		if err != nil {
+			closeListeners()
+			return nil, err
+		}
+		f.servers = append(f.servers, srv)
 	}
 
-	if cfg.Addr != "" {
+	for i := range f.servers {
+		srv, l := f.servers[i], listeners[i]
 		go func() {
-			if err := f.serveHTTP(listenerHTTP); err != nil {
-				log.Fatal("failed while serving http", log.Err(err))
+			if err := serve(srv, l); err != nil {
+				log.Fatal("failed while serving http", log.Fields{"addr": srv.Addr}, log.Err(err))
 			}
 		}()
 	}
 
-	if cfg.HTTPSAddr != "" {
+	if f.h3 != nil {
 		go func() {
-			if err := f.serveHTTPS(listenerHTTPS); err != nil {
-				log.Fatal("failed while serving https", log.Err(err))
+			if err := f.h3.serve(); err != nil {
+				log.Fatal("failed while serving http3", log.Fields{"addr": f.HTTP3Addr}, log.Err(err))
 			}
 		}()
 	}
@@ -217,20 +308,43 @@ func NewFrontend(logic frontend.TrackerLogic, provided Config) (*Frontend, error
 	return f, nil
 }
 
+// listen returns a listener for the socket passed by systemd socket activation
+// for the address, if any, or binds a new socket.
+func listen(addr string) (net.Listener, error) {
+	l, err := systemd.Listener(addr)
+	if l != nil || err != nil {
+		return l, err
+	}
+	return net.Listen("tcp", addr)
+}
+
 // Stop provides a thread-safe way to shutdown a currently running Frontend.
 func (f *Frontend) Stop() stop.Result {
 	stopGroup := stop.NewGroup()
 
-	if f.srv != nil {
-		stopGroup.AddFunc(f.makeStopFunc(f.srv))
+	for _, srv := range f.servers {
+		stopGroup.AddFunc(f.makeStopFunc(srv))
 	}
-	if f.tlsSrv != nil {
-		stopGroup.AddFunc(f.makeStopFunc(f.tlsSrv))
+	if f.h3 != nil {
+		stopGroup.AddFunc(f.h3.stop)
 	}
 
 	return stopGroup.Stop()
 }
 
+// ReloadCertificate reloads the TLS certificate and key from the configured
+// paths without interrupting the server.
+//
+// Connections established after a successful reload use the new certificate.
+// If reloading fails, the previous certificate remains in use.
+func (f *Frontend) ReloadCertificate() error {
+	if f.keypair == nil {
+		return nil
+	}
+
+	return f.keypair.Reload()
+}
+
 func (f *Frontend) makeStopFunc(stopSrv *http.Server) stop.Func {
 	return func() stop.Result {
 		c := make(stop.Channel)
@@ -241,7 +355,7 @@ func (f *Frontend) makeStopFunc(stopSrv *http.Server) stop.Func {
 	}
 }
 
-func (f *Frontend) handler() http.Handler {
+func (f *Frontend) handler(addr string) http.Handler {
 	router := httprouter.New()
 	for _, route := range f.AnnounceRoutes {
 		router.GET(route, f.announceRoute)
@@ -249,44 +363,141 @@ func (f *Frontend) handler() http.Handler {
 	for _, route := range f.ScrapeRoutes {
 		router.GET(route, f.scrapeRoute)
 	}
-	return router
+
+	var handler http.Handler = router
+	if f.HandlerTimeout > 0 {
+		handler = http.TimeoutHandler(handler, f.HandlerTimeout, timeoutMessage)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recordRequest(r, addr)
+		handler.ServeHTTP(w, r)
+	})
 }
 
-// serveHTTP blocks while listening and serving non-TLS HTTP BitTorrent
-// requests until Stop() is called or an error is returned.
-func (f *Frontend) serveHTTP(l net.Listener) error {
-	f.srv = &http.Server{
-		Addr:         f.Addr,
-		Handler:      f.handler(),
-		ReadTimeout:  f.ReadTimeout,
-		WriteTimeout: f.WriteTimeout,
-		IdleTimeout:  f.IdleTimeout,
+// timeoutMessage is the bencoded failure written for requests exceeding the
+// handler timeout.
+const timeoutMessage = "d14:failure reason17:request timed oute"
+
+// errRequestTimeout is returned to clients whose request could not be
+// processed within the request timeout.
+var errRequestTimeout = bittorrent.RegisterClientError("request_timeout", "request timed out")
+
+// requestContext derives the context passed to the TrackerLogic for a
+// request from the context of the request.
+// It is canceled if the client goes away or the request timeout is exceeded.
+func (f *Frontend) requestContext(ctx context.Context, ps httprouter.Params) (context.Context, context.CancelFunc) {
+	ctx = injectRouteParamsToContext(ctx, ps)
+	if f.RequestTimeout > 0 {
+		return context.WithTimeout(ctx, f.RequestTimeout)
 	}
+	return context.WithCancel(ctx)
+}
 
-	f.srv.SetKeepAlivesEnabled(f.EnableKeepAlive)
+// logicError maps errors caused by the end of the request context to an error
+// for the client.
+func logicError(err error) error {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return errRequestTimeout
+	}
+	return err
+}
 
-	// Start the HTTP server.
-	if err := f.srv.Serve(l); !errors.Is(err, http.ErrServerClosed) {
-		return err
+// sizedResponseWriter records the size of a response in its access log
+// entry.
+type sizedResponseWriter struct {
+	http.ResponseWriter
+	entry *accesslog.Entry
+}
+
+func (w sizedResponseWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.entry.AddSize(n)
+	return n, err
+}
+
+// detachedContext carries the values of a context, but is never canceled.
+// It is used for the After* calls of the TrackerLogic, which run after the
+// response has been written and must not be interrupted.
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+// http2Server returns the configuration used for HTTP/2 connections.
+func (f *Frontend) http2Server() *http2.Server {
+	return &http2.Server{
+		IdleTimeout: f.IdleTimeout,
 	}
-	return nil
 }
 
-// serveHTTPS blocks while listening and serving TLS HTTP BitTorrent
-// requests until Stop() is called or an error is returned.
-func (f *Frontend) serveHTTPS(l net.Listener) error {
-	f.tlsSrv = &http.Server{
-		Addr:         f.HTTPSAddr,
-		TLSConfig:    f.tlsCfg,
-		Handler:      f.handler(),
-		ReadTimeout:  f.ReadTimeout,
-		WriteTimeout: f.WriteTimeout,
+// newHTTPServer creates a server for non-TLS HTTP BitTorrent requests.
+func (f *Frontend) newHTTPServer(addr string) *http.Server {
+	handler := f.handler(addr)
+	if f.EnableH2C {
+		// Cleartext HTTP/2 is negotiated either by prior knowledge or by
+		// upgrading an HTTP/1.1 request.
+		handler = h2c.NewHandler(handler, f.http2Server())
 	}
 
-	f.tlsSrv.SetKeepAlivesEnabled(f.EnableKeepAlive)
+	srv := &http.Server{
+		Addr:           addr,
+		Handler:        handler,
+		ReadTimeout:    f.ReadTimeout,
+		WriteTimeout:   f.WriteTimeout,
+		IdleTimeout:    f.IdleTimeout,
+		MaxHeaderBytes: f.MaxHeaderBytes,
+	}
 
-	// Start the HTTP server.
-	if err := f.tlsSrv.ServeTLS(l, "", ""); !errors.Is(err, http.ErrServerClosed) {
+	srv.SetKeepAlivesEnabled(f.EnableKeepAlive)
+	return srv
+}
+
+// newHTTPSServer creates a server for TLS HTTP BitTorrent requests.
+// If HTTP/3 is enabled, its responses advertise the HTTP/3 server.
+func (f *Frontend) newHTTPSServer(addr string) (*http.Server, error) {
+	handler := f.handler(addr)
+	if f.h3 != nil {
+		handler = f.h3.altSvcHandler(handler)
+	}
+
+	srv := &http.Server{
+		Addr:           addr,
+		TLSConfig:      f.tlsCfg,
+		Handler:        handler,
+		ReadTimeout:    f.ReadTimeout,
+		WriteTimeout:   f.WriteTimeout,
+		IdleTimeout:    f.IdleTimeout,
+		MaxHeaderBytes: f.MaxHeaderBytes,
+	}
+
+	if f.EnableHTTP2 {
+		if err := http2.ConfigureServer(srv, f.http2Server()); err != nil {
+			return nil, err
+		}
+	} else {
+		// A non-nil, empty map disables HTTP/2 negotiation via ALPN.
+		srv.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	}
+
+	srv.SetKeepAlivesEnabled(f.EnableKeepAlive)
+	return srv, nil
+}
+
+// serve blocks while listening and serving HTTP BitTorrent requests on a
+// server until Stop() is called or an error is returned.
+func serve(srv *http.Server, l net.Listener) error {
+	var err error
+	if srv.TLSConfig != nil {
+		err = srv.ServeTLS(l, "", "")
+	} else {
+		err = srv.Serve(l)
+	}
+
+	if !errors.Is(err, http.ErrServerClosed) {
 		return err
 	}
 	return nil
@@ -307,8 +518,17 @@ func (f *Frontend) announceRoute(w http.ResponseWriter, r *http.Request, ps http
 	if f.EnableRequestTiming {
 		start = time.Now()
 	}
+	// Continue the trace of the client, if it sent one.
+	ctx, span := tracing.Start(tracing.ContextWithRemoteParent(r.Context(), r.Header.Get("traceparent")), "http.announce")
+	entry := accesslog.Sample("http")
+	if entry != nil {
+		w = sizedResponseWriter{w, entry}
+	}
 	var af *bittorrent.AddressFamily
 	defer func() {
+		entry.Log("announce", err)
+		span.SetError(err)
+		span.End()
 		if f.EnableRequestTiming {
 			recordResponseDuration("announce", af, err, time.Since(start))
 		} else {
@@ -316,21 +536,34 @@ func (f *Frontend) announceRoute(w http.ResponseWriter, r *http.Request, ps http
 		}
 	}()
 
+	_, parseSpan := tracing.Start(ctx, "http.ParseAnnounce")
 	req, err := ParseAnnounce(r, f.ParseOptions)
+	parseSpan.SetError(err)
+	parseSpan.End()
 	if err != nil {
 		_ = WriteError(w, err)
 		return
 	}
 	af = new(bittorrent.AddressFamily)
 	*af = req.IP.AddressFamily
+	entry.SetAnnounce(req)
 
-	ctx := injectRouteParamsToContext(context.Background(), ps)
+	ctx, cancel := f.requestContext(ctx, ps)
+	defer cancel()
 	ctx, resp, err := f.logic.HandleAnnounce(ctx, req)
 	if err != nil {
+		err = logicError(err)
 		_ = WriteError(w, err)
 		return
 	}
 
+	if f.EnableExternalIP {
+		// Never echo an IP the client provided itself.
+		opts := f.ParseOptions
+		opts.AllowIPSpoofing = false
+		resp.ExternalIP, _ = requestedIP(r, nil, opts)
+	}
+
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	err = WriteAnnounceResponse(w, resp)
 	if err != nil {
@@ -338,7 +571,7 @@ func (f *Frontend) announceRoute(w http.ResponseWriter, r *http.Request, ps http
 		return
 	}
 
-	go f.logic.AfterAnnounce(ctx, req, resp)
+	go f.logic.AfterAnnounce(detachedContext{ctx}, req, resp)
 }
 
 // scrapeRoute parses and responds to a Scrape.
@@ -348,8 +581,17 @@ func (f *Frontend) scrapeRoute(w http.ResponseWriter, r *http.Request, ps httpro
 	if f.EnableRequestTiming {
 		start = time.Now()
 	}
+	// Continue the trace of the client, if it sent one.
+	ctx, span := tracing.Start(tracing.ContextWithRemoteParent(r.Context(), r.Header.Get("traceparent")), "http.scrape")
+	entry := accesslog.Sample("http")
+	if entry != nil {
+		w = sizedResponseWriter{w, entry}
+	}
 	var af *bittorrent.AddressFamily
 	defer func() {
+		entry.Log("scrape", err)
+		span.SetError(err)
+		span.End()
 		if f.EnableRequestTiming {
 			recordResponseDuration("scrape", af, err, time.Since(start))
 		} else {
@@ -357,7 +599,10 @@ func (f *Frontend) scrapeRoute(w http.ResponseWriter, r *http.Request, ps httpro
 		}
 	}()
 
+	_, parseSpan := tracing.Start(ctx, "http.ParseScrape")
 	req, err := ParseScrape(r, f.ParseOptions)
+	parseSpan.SetError(err)
+	parseSpan.End()
 	if err != nil {
 		_ = WriteError(w, err)
 		return
@@ -382,10 +627,13 @@ func (f *Frontend) scrapeRoute(w http.ResponseWriter, r *http.Request, ps httpro
 	}
 	af = new(bittorrent.AddressFamily)
 	*af = req.AddressFamily
+	entry.SetScrape(req, reqIP)
 
-	ctx := injectRouteParamsToContext(context.Background(), ps)
+	ctx, cancel := f.requestContext(ctx, ps)
+	defer cancel()
 	ctx, resp, err := f.logic.HandleScrape(ctx, req)
 	if err != nil {
+		err = logicError(err)
 		_ = WriteError(w, err)
 		return
 	}
@@ -397,5 +645,5 @@ func (f *Frontend) scrapeRoute(w http.ResponseWriter, r *http.Request, ps httpro
 		return
 	}
 
-	go f.logic.AfterScrape(ctx, req, resp)
+	go f.logic.AfterScrape(detachedContext{ctx}, req, resp)
 }
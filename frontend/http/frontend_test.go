@@ -0,0 +1,58 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+type ctxKey struct{}
+
+func TestDetachedContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), ctxKey{}, "value"))
+	cancel()
+
+	detached := detachedContext{ctx}
+	require.Nil(t, detached.Err())
+	require.Nil(t, detached.Done())
+	_, ok := detached.Deadline()
+	require.False(t, ok)
+	require.Equal(t, "value", detached.Value(ctxKey{}))
+}
+
+func TestLogicError(t *testing.T) {
+	other := errors.New("other")
+	clientErr := bittorrent.ClientError("client error")
+
+	require.Equal(t, errRequestTimeout, logicError(context.DeadlineExceeded))
+	require.Equal(t, errRequestTimeout, logicError(fmt.Errorf("wrapped: %w", context.Canceled)))
+	require.Equal(t, other, logicError(other))
+	require.Equal(t, clientErr, logicError(clientErr))
+}
+
+func TestServerTuning(t *testing.T) {
+	f := &Frontend{Config: Config{
+		EnableKeepAlive: true,
+		IdleTimeout:     time.Minute,
+		MaxHeaderBytes:  4096,
+	}.Validate()}
+
+	srv := f.newHTTPServer("127.0.0.1:0")
+	require.Equal(t, time.Minute, srv.IdleTimeout)
+	require.Equal(t, 4096, srv.MaxHeaderBytes)
+
+	srv, err := f.newHTTPSServer("127.0.0.1:0")
+	require.Nil(t, err)
+	require.Equal(t, time.Minute, srv.IdleTimeout)
+	require.Equal(t, 4096, srv.MaxHeaderBytes)
+
+	f.Config = Config{}.Validate()
+	require.Equal(t, http.DefaultMaxHeaderBytes, f.newHTTPServer("127.0.0.1:0").MaxHeaderBytes)
+}
@@ -0,0 +1,74 @@
+package http
+
+import (
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+
+	"github.com/chihaya/chihaya/pkg/stop"
+)
+
+// http3Server serves the routes of the frontend over HTTP/3 (QUIC).
+type http3Server struct {
+	srv  *http3.Server
+	conn net.PacketConn
+}
+
+// newHTTP3Server binds a UDP socket to the address and creates a server for
+// HTTP/3 BitTorrent requests on it.
+//
+// The server uses the TLS configuration of the frontend, including reloaded
+// certificates.
+func (f *Frontend) newHTTP3Server(addr string) (*http3Server, error) {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	srv := &http3.Server{
+		Addr:           conn.LocalAddr().String(),
+		Handler:        f.handler(addr),
+		TLSConfig:      f.tlsCfg,
+		MaxHeaderBytes: f.MaxHeaderBytes,
+		QuicConfig: &quic.Config{
+			MaxIdleTimeout: f.IdleTimeout,
+		},
+	}
+
+	return &http3Server{srv: srv, conn: conn}, nil
+}
+
+// serve blocks while serving HTTP/3 BitTorrent requests until the server is
+// stopped or an error is returned.
+func (s *http3Server) serve() error {
+	err := s.srv.Serve(s.conn)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// stop closes the server, aborting requests in flight, and its socket.
+func (s *http3Server) stop() stop.Result {
+	c := make(stop.Channel)
+	go func() {
+		err := s.srv.Close()
+		if cerr := s.conn.Close(); err == nil {
+			err = cerr
+		}
+		c.Done(err)
+	}()
+	return c.Result()
+}
+
+// altSvcHandler advertises the HTTP/3 server in the Alt-Svc header of the
+// responses of a handler, so that clients can switch to HTTP/3.
+func (s *http3Server) altSvcHandler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = s.srv.SetQuicHeaders(w.Header())
+		handler.ServeHTTP(w, r)
+	})
+}
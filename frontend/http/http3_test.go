@@ -0,0 +1,43 @@
+package http
+
+import (
+	"crypto/tls"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/quic-go/quic-go/http3"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTP3(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeKeypair(t, certPath, keyPath, "localhost")
+
+	cfg := Config{
+		HTTP3Addr:      "127.0.0.1:0",
+		AnnounceRoutes: []string{"/announce"},
+		ScrapeRoutes:   []string{"/scrape"},
+	}
+
+	// HTTP/3 requires TLS.
+	_, err := NewFrontend(nil, cfg)
+	require.NotNil(t, err)
+
+	cfg.TLSCertPath, cfg.TLSKeyPath = certPath, keyPath
+	f, err := NewFrontend(nil, cfg)
+	require.Nil(t, err)
+	defer func() { require.Empty(t, <-f.Stop()) }()
+
+	rt := &http3.RoundTripper{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	defer rt.Close()
+	client := &http.Client{Transport: rt}
+
+	// Requests are served by the routes of the frontend.
+	resp, err := client.Get("https://" + f.h3.conn.LocalAddr().String() + "/unknown")
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	require.Equal(t, 3, resp.ProtoMajor)
+}
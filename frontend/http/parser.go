@@ -6,6 +6,21 @@ import (
 	"net/http"
 
 	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/frontend"
+)
+
+var (
+	errInvalidEvent       = bittorrent.RegisterClientError("invalid_event", "failed to provide valid client event")
+	errNoInfoHash         = bittorrent.RegisterClientError("no_infohash", "no info_hash parameter supplied")
+	errMultipleInfoHashes = bittorrent.RegisterClientError("multiple_infohashes", "multiple info_hash parameters supplied")
+	errMissingPeerID      = bittorrent.RegisterClientError("invalid_peer_id", "failed to parse parameter: peer_id")
+	errInvalidPeerID      = bittorrent.RegisterClientError("invalid_peer_id", "failed to provide valid peer_id")
+	errInvalidLeft        = bittorrent.RegisterClientError("invalid_parameter", "failed to parse parameter: left")
+	errInvalidDownloaded  = bittorrent.RegisterClientError("invalid_parameter", "failed to parse parameter: downloaded")
+	errInvalidUploaded    = bittorrent.RegisterClientError("invalid_parameter", "failed to parse parameter: uploaded")
+	errInvalidNumWant     = bittorrent.RegisterClientError("invalid_parameter", "failed to parse parameter: numwant")
+	errInvalidPort        = bittorrent.RegisterClientError("invalid_port", "failed to parse parameter: port")
+	errInvalidIP          = bittorrent.RegisterClientError("invalid_ip", "failed to parse peer IP address")
 )
 
 // ParseOptions is the configuration used to parse an Announce Request.
@@ -13,12 +28,34 @@ import (
 // If AllowIPSpoofing is true, IPs provided via BitTorrent params will be used.
 // If RealIPHeader is not empty string, the value of the first HTTP Header with
 // that name will be used.
+// If TrustedProxies is not empty, forwarded headers are only used for requests
+// coming from one of the listed networks. RealIPHeader then defaults to
+// X-Forwarded-For.
+// If AllowNonCompact is true, clients not requesting a compact response get a
+// dictionary peer list including peer IDs. Otherwise, responses are always
+// compact.
+// IPPolicy determines how announces from unroutable IPs are handled. When
+// rewriting, IPs provided via params are replaced by the IP determined without
+// them.
 type ParseOptions struct {
-	AllowIPSpoofing     bool   `yaml:"allow_ip_spoofing"`
-	RealIPHeader        string `yaml:"real_ip_header"`
-	MaxNumWant          uint32 `yaml:"max_numwant"`
-	DefaultNumWant      uint32 `yaml:"default_numwant"`
-	MaxScrapeInfoHashes uint32 `yaml:"max_scrape_infohashes"`
+	AllowIPSpoofing     bool     `yaml:"allow_ip_spoofing"`
+	RealIPHeader        string   `yaml:"real_ip_header"`
+	TrustedProxies      []string `yaml:"trusted_proxies"`
+	AllowNonCompact     bool     `yaml:"allow_non_compact"`
+	MaxNumWant          uint32   `yaml:"max_numwant"`
+	DefaultNumWant      uint32   `yaml:"default_numwant"`
+	MaxScrapeInfoHashes uint32   `yaml:"max_scrape_infohashes"`
+
+	IPPolicy *bittorrent.IPPolicy `yaml:"ip_policy"`
+
+	trustedProxies frontend.TrustedProxies
+}
+
+// parseTrustedProxies parses the CIDRs in TrustedProxies.
+// A single IP address is treated as a network containing only that address.
+func (opts *ParseOptions) parseTrustedProxies() (err error) {
+	opts.trustedProxies, err = frontend.ParseTrustedProxies(opts.TrustedProxies)
+	return err
 }
 
 // Default parser config constants.
@@ -30,12 +67,13 @@ const (
 
 // ParseAnnounce parses an bittorrent.AnnounceRequest from an http.Request.
 func ParseAnnounce(r *http.Request, opts ParseOptions) (*bittorrent.AnnounceRequest, error) {
-	qp, err := bittorrent.ParseURLData(r.RequestURI)
+	qp, err := bittorrent.ParsePooledURLData(r.RequestURI)
 	if err != nil {
 		return nil, err
 	}
 
-	request := &bittorrent.AnnounceRequest{Params: qp}
+	request := bittorrent.NewAnnounceRequest()
+	request.Params = qp
 
 	// Attempt to parse the event from the request.
 	var eventStr string
@@ -43,58 +81,60 @@ func ParseAnnounce(r *http.Request, opts ParseOptions) (*bittorrent.AnnounceRequ
 	if request.EventProvided {
 		request.Event, err = bittorrent.NewEvent(eventStr)
 		if err != nil {
-			return nil, bittorrent.ClientError("failed to provide valid client event")
+			return nil, errInvalidEvent
 		}
 	} else {
 		request.Event = bittorrent.None
 	}
 
 	// Determine if the client expects a compact response.
+	// Clients that omit the parameter predate compact responses, so they get
+	// a dictionary peer list as well, if allowed.
 	compactStr, _ := qp.String("compact")
-	request.Compact = compactStr != "" && compactStr != "0"
+	request.Compact = !opts.AllowNonCompact || (compactStr != "" && compactStr != "0")
 
 	// Parse the infohash from the request.
 	infoHashes := qp.InfoHashes()
 	if len(infoHashes) < 1 {
-		return nil, bittorrent.ClientError("no info_hash parameter supplied")
+		return nil, errNoInfoHash
 	}
 	if len(infoHashes) > 1 {
-		return nil, bittorrent.ClientError("multiple info_hash parameters supplied")
+		return nil, errMultipleInfoHashes
 	}
 	request.InfoHash = infoHashes[0]
 
 	// Parse the PeerID from the request.
 	peerID, ok := qp.String("peer_id")
 	if !ok {
-		return nil, bittorrent.ClientError("failed to parse parameter: peer_id")
+		return nil, errMissingPeerID
 	}
 	if len(peerID) != 20 {
-		return nil, bittorrent.ClientError("failed to provide valid peer_id")
+		return nil, errInvalidPeerID
 	}
 	request.Peer.ID = bittorrent.PeerIDFromString(peerID)
 
 	// Determine the number of remaining bytes for the client.
 	request.Left, err = qp.Uint("left", 64)
 	if err != nil {
-		return nil, bittorrent.ClientError("failed to parse parameter: left")
+		return nil, errInvalidLeft
 	}
 
 	// Determine the number of bytes downloaded by the client.
 	request.Downloaded, err = qp.Uint("downloaded", 64)
 	if err != nil {
-		return nil, bittorrent.ClientError("failed to parse parameter: downloaded")
+		return nil, errInvalidDownloaded
 	}
 
 	// Determine the number of bytes shared by the client.
 	request.Uploaded, err = qp.Uint("uploaded", 64)
 	if err != nil {
-		return nil, bittorrent.ClientError("failed to parse parameter: uploaded")
+		return nil, errInvalidUploaded
 	}
 
 	// Determine the number of peers the client wants in the response.
 	numwant, err := qp.Uint("numwant", 32)
 	if err != nil && !errors.Is(err, bittorrent.ErrKeyNotFound) {
-		return nil, bittorrent.ClientError("failed to parse parameter: numwant")
+		return nil, errInvalidNumWant
 	}
 	// If there were no errors, the user actually provided the numwant.
 	request.NumWantProvided = err == nil
@@ -103,24 +143,40 @@ func ParseAnnounce(r *http.Request, opts ParseOptions) (*bittorrent.AnnounceRequ
 	// Parse the port where the client is listening.
 	port, err := qp.Uint("port", 16)
 	if err != nil {
-		return nil, bittorrent.ClientError("failed to parse parameter: port")
+		return nil, errInvalidPort
 	}
 	request.Peer.Port = uint16(port)
 
+	// Clients send back the tracker ID of a previous response, if any.
+	request.TrackerID, _ = qp.String("trackerid")
+
 	// Parse the IP address where the client is listening.
 	request.Peer.IP.IP, request.IPProvided = requestedIP(r, qp, opts)
 	if request.Peer.IP.IP == nil {
-		return nil, bittorrent.ClientError("failed to parse peer IP address")
+		return nil, errInvalidIP
 	}
 
 	if err := bittorrent.SanitizeAnnounce(request, opts.MaxNumWant, opts.DefaultNumWant); err != nil {
 		return nil, err
 	}
 
+	var sourceIP net.IP
+	if request.IPProvided {
+		sourceOpts := opts
+		sourceOpts.AllowIPSpoofing = false
+		sourceIP, _ = requestedIP(r, qp, sourceOpts)
+	}
+	if err := opts.IPPolicy.Apply(request, sourceIP); err != nil {
+		return nil, err
+	}
+
 	return request, nil
 }
 
 // ParseScrape parses an bittorrent.ScrapeRequest from an http.Request.
+//
+// A request without infohashes is a full scrape, which the TrackerLogic
+// either answers with all swarms or rejects.
 func ParseScrape(r *http.Request, opts ParseOptions) (*bittorrent.ScrapeRequest, error) {
 	qp, err := bittorrent.ParseURLData(r.RequestURI)
 	if err != nil {
@@ -128,9 +184,6 @@ func ParseScrape(r *http.Request, opts ParseOptions) (*bittorrent.ScrapeRequest,
 	}
 
 	infoHashes := qp.InfoHashes()
-	if len(infoHashes) < 1 {
-		return nil, bittorrent.ClientError("no info_hash parameter supplied")
-	}
 
 	request := &bittorrent.ScrapeRequest{
 		InfoHashes: infoHashes,
@@ -160,6 +213,10 @@ func requestedIP(r *http.Request, p bittorrent.Params, opts ParseOptions) (ip ne
 		}
 	}
 
+	if len(opts.trustedProxies) > 0 {
+		return opts.trustedProxies.ClientIP(r, opts.RealIPHeader), false
+	}
+
 	if opts.RealIPHeader != "" {
 		if ip := r.Header.Get(opts.RealIPHeader); ip != "" {
 			return net.ParseIP(ip), false
@@ -0,0 +1,194 @@
+package http
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+func TestRequestedIP(t *testing.T) {
+	table := []struct {
+		name       string
+		opts       ParseOptions
+		remoteAddr string
+		header     http.Header
+		expected   string
+	}{
+		{
+			name:       "no proxy",
+			remoteAddr: "203.0.113.1:1234",
+			expected:   "203.0.113.1",
+		},
+		{
+			name:       "real ip header without trusted proxies",
+			opts:       ParseOptions{RealIPHeader: "X-Real-Ip"},
+			remoteAddr: "10.0.0.1:1234",
+			header:     http.Header{"X-Real-Ip": {"203.0.113.1"}},
+			expected:   "203.0.113.1",
+		},
+		{
+			name:       "untrusted remote",
+			opts:       ParseOptions{TrustedProxies: []string{"10.0.0.0/8"}},
+			remoteAddr: "198.51.100.1:1234",
+			header:     http.Header{"X-Forwarded-For": {"203.0.113.1"}},
+			expected:   "198.51.100.1",
+		},
+		{
+			name:       "trusted remote",
+			opts:       ParseOptions{TrustedProxies: []string{"10.0.0.0/8"}},
+			remoteAddr: "10.0.0.1:1234",
+			header:     http.Header{"X-Forwarded-For": {"203.0.113.1"}},
+			expected:   "203.0.113.1",
+		},
+		{
+			name:       "spoofed forwarded entry",
+			opts:       ParseOptions{TrustedProxies: []string{"10.0.0.0/8"}},
+			remoteAddr: "10.0.0.1:1234",
+			header:     http.Header{"X-Forwarded-For": {"192.0.2.1, 203.0.113.1, 10.0.0.2"}},
+			expected:   "203.0.113.1",
+		},
+		{
+			name:       "multiple headers",
+			opts:       ParseOptions{TrustedProxies: []string{"10.0.0.1", "10.0.0.2"}},
+			remoteAddr: "10.0.0.1:1234",
+			header:     http.Header{"X-Forwarded-For": {"203.0.113.1", "10.0.0.2"}},
+			expected:   "203.0.113.1",
+		},
+		{
+			name:       "custom header",
+			opts:       ParseOptions{RealIPHeader: "X-Real-Ip", TrustedProxies: []string{"10.0.0.0/8"}},
+			remoteAddr: "10.0.0.1:1234",
+			header:     http.Header{"X-Real-Ip": {"203.0.113.1"}, "X-Forwarded-For": {"192.0.2.1"}},
+			expected:   "203.0.113.1",
+		},
+		{
+			name:       "missing header",
+			opts:       ParseOptions{TrustedProxies: []string{"10.0.0.0/8"}},
+			remoteAddr: "10.0.0.1:1234",
+			expected:   "10.0.0.1",
+		},
+		{
+			name:       "malformed header",
+			opts:       ParseOptions{TrustedProxies: []string{"10.0.0.0/8"}},
+			remoteAddr: "10.0.0.1:1234",
+			header:     http.Header{"X-Forwarded-For": {"unknown"}},
+			expected:   "10.0.0.1",
+		},
+		{
+			name:       "IPv6 proxy",
+			opts:       ParseOptions{TrustedProxies: []string{"fd00::/8"}},
+			remoteAddr: "[fd00::1]:1234",
+			header:     http.Header{"X-Forwarded-For": {"2001:db8::1"}},
+			expected:   "2001:db8::1",
+		},
+	}
+
+	for _, tt := range table {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Nil(t, tt.opts.parseTrustedProxies())
+
+			r := &http.Request{RemoteAddr: tt.remoteAddr, Header: tt.header}
+			if r.Header == nil {
+				r.Header = http.Header{}
+			}
+
+			ip, provided := requestedIP(r, nil, tt.opts)
+			require.False(t, provided)
+			require.True(t, net.ParseIP(tt.expected).Equal(ip), "expected %s, got %s", tt.expected, ip)
+		})
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	opts := ParseOptions{TrustedProxies: []string{"not an ip"}}
+	require.NotNil(t, opts.parseTrustedProxies())
+
+	opts = ParseOptions{TrustedProxies: []string{"10.0.0.0/33"}}
+	require.NotNil(t, opts.parseTrustedProxies())
+}
+
+func TestParseAnnounceCompact(t *testing.T) {
+	table := []struct {
+		query           string
+		allowNonCompact bool
+		expected        bool
+	}{
+		{"", false, true},
+		{"&compact=0", false, true},
+		{"&compact=1", false, true},
+		{"", true, false},
+		{"&compact=0", true, false},
+		{"&compact=1", true, true},
+	}
+
+	for _, tt := range table {
+		t.Run(fmt.Sprintf("%q allowing non-compact %t", tt.query, tt.allowNonCompact), func(t *testing.T) {
+			r, err := http.NewRequest("GET", "/announce", nil)
+			require.Nil(t, err)
+			r.RemoteAddr = "203.0.113.1:1234"
+			r.RequestURI = "/announce?info_hash=aaaaaaaaaaaaaaaaaaaa&peer_id=bbbbbbbbbbbbbbbbbbbb" +
+				"&port=6881&left=0&downloaded=0&uploaded=0" + tt.query
+
+			opts := ParseOptions{AllowNonCompact: tt.allowNonCompact, MaxNumWant: 50, DefaultNumWant: 50}
+			req, err := ParseAnnounce(r, opts)
+			require.Nil(t, err)
+			require.Equal(t, tt.expected, req.Compact)
+		})
+	}
+}
+
+func TestParseAnnounceTrackerID(t *testing.T) {
+	for _, trackerID := range []string{"", "abc"} {
+		r, err := http.NewRequest("GET", "/announce", nil)
+		require.Nil(t, err)
+		r.RemoteAddr = "203.0.113.1:1234"
+		r.RequestURI = "/announce?info_hash=aaaaaaaaaaaaaaaaaaaa&peer_id=bbbbbbbbbbbbbbbbbbbb" +
+			"&port=6881&left=0&downloaded=0&uploaded=0&trackerid=" + trackerID
+
+		req, err := ParseAnnounce(r, ParseOptions{MaxNumWant: 50, DefaultNumWant: 50})
+		require.Nil(t, err)
+		require.Equal(t, trackerID, req.TrackerID)
+	}
+}
+
+func TestParseAnnounceIPPolicy(t *testing.T) {
+	table := []struct {
+		action     string
+		query      string
+		remoteAddr string
+		expected   string
+		err        error
+	}{
+		{bittorrent.IPPolicyAllow, "&ip=10.0.0.1", "203.0.113.1:1234", "10.0.0.1", nil},
+		{bittorrent.IPPolicyReject, "&ip=10.0.0.1", "203.0.113.1:1234", "", bittorrent.ErrUnroutableIP},
+		{bittorrent.IPPolicyReject, "&ip=198.51.100.1", "203.0.113.1:1234", "198.51.100.1", nil},
+		{bittorrent.IPPolicyRewrite, "&ip=10.0.0.1", "203.0.113.1:1234", "203.0.113.1", nil},
+		{bittorrent.IPPolicyRewrite, "&ip=fe80::1", "203.0.113.1:1234", "203.0.113.1", nil},
+		{bittorrent.IPPolicyRewrite, "&ip=10.0.0.1", "192.168.0.1:1234", "", bittorrent.ErrUnroutableIP},
+		{bittorrent.IPPolicyRewrite, "", "127.0.0.1:1234", "", bittorrent.ErrUnroutableIP},
+	}
+
+	for _, tt := range table {
+		t.Run(fmt.Sprintf("%s %q from %s", tt.action, tt.query, tt.remoteAddr), func(t *testing.T) {
+			r, err := http.NewRequest("GET", "/announce", nil)
+			require.Nil(t, err)
+			r.RemoteAddr = tt.remoteAddr
+			r.RequestURI = "/announce?info_hash=aaaaaaaaaaaaaaaaaaaa&peer_id=bbbbbbbbbbbbbbbbbbbb" +
+				"&port=6881&left=0&downloaded=0&uploaded=0" + tt.query
+
+			policy := &bittorrent.IPPolicy{Action: tt.action}
+			require.Nil(t, policy.Init())
+			opts := ParseOptions{AllowIPSpoofing: true, MaxNumWant: 50, DefaultNumWant: 50, IPPolicy: policy}
+			req, err := ParseAnnounce(r, opts)
+			require.Equal(t, tt.err, err)
+			if tt.err == nil {
+				require.Equal(t, tt.expected, req.IP.String())
+			}
+		})
+	}
+}
@@ -2,29 +2,49 @@ package http
 
 import (
 	"errors"
+	"net/http"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 
 	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/frontend"
 )
 
 func init() {
-	prometheus.MustRegister(promResponseDurationMilliseconds)
+	prometheus.MustRegister(promResponseDurationMilliseconds, promRequests)
 }
 
-var promResponseDurationMilliseconds = prometheus.NewHistogramVec(
-	prometheus.HistogramOpts{
-		Name:    "chihaya_http_response_duration_milliseconds",
-		Help:    "The duration of time it takes to receive and write a response to an API request",
-		Buckets: prometheus.ExponentialBuckets(9.375, 2, 10),
-	},
-	[]string{"action", "address_family", "error"},
+var (
+	promResponseDurationMilliseconds = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "chihaya_http_response_duration_milliseconds",
+			Help:    "The duration of time it takes to receive and write a response to an API request",
+			Buckets: prometheus.ExponentialBuckets(9.375, 2, 10),
+		},
+		[]string{"action", "address_family", "error"},
+	)
+
+	promRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "chihaya_http_requests_total",
+			Help: "The number of HTTP requests received, by listener and protocol version",
+		},
+		[]string{"addr", "protocol"},
+	)
 )
 
+// recordRequest records a Request received on the listener with the given
+// address.
+func recordRequest(r *http.Request, addr string) {
+	promRequests.WithLabelValues(addr, r.Proto).Inc()
+}
+
 // recordResponseDuration records the duration of time to respond to a Request
-// in milliseconds.
+// in milliseconds, and the reason of its error, if any.
 func recordResponseDuration(action string, af *bittorrent.AddressFamily, err error, duration time.Duration) {
+	frontend.RecordError("http", action, err)
+
 	var errString string
 	if err != nil {
 		var clientErr bittorrent.ClientError
@@ -0,0 +1,75 @@
+package http
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/frontend"
+)
+
+// writeKeypair writes a self-signed certificate for the common name and its
+// key to the paths and returns the DER encoded certificate.
+func writeKeypair(t *testing.T, certPath, keyPath, commonName string) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{commonName},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.Nil(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.Nil(t, err)
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	require.Nil(t, os.WriteFile(certPath, certPEM, 0o600))
+	require.Nil(t, os.WriteFile(keyPath, keyPEM, 0o600))
+	return der
+}
+
+func TestKeypairReloader(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+
+	first := writeKeypair(t, certPath, keyPath, "first.example.com")
+	kpr, err := frontend.NewKeypairReloader(certPath, keyPath)
+	require.Nil(t, err)
+	cert, err := kpr.GetCertificate(nil)
+	require.Nil(t, err)
+	require.Equal(t, first, cert.Certificate[0])
+
+	// A new key pair is served after a reload.
+	second := writeKeypair(t, certPath, keyPath, "second.example.com")
+	require.Nil(t, kpr.Reload())
+	cert, err = kpr.GetCertificate(nil)
+	require.Nil(t, err)
+	require.Equal(t, second, cert.Certificate[0])
+
+	// A corrupt key pair fails to reload, and the previous one is still
+	// served.
+	require.Nil(t, os.WriteFile(certPath, []byte("not a certificate"), 0o600))
+	require.NotNil(t, kpr.Reload())
+	cert, err = kpr.GetCertificate(nil)
+	require.Nil(t, err)
+	require.Equal(t, second, cert.Certificate[0])
+
+	// Loading a corrupt key pair initially fails.
+	_, err = frontend.NewKeypairReloader(certPath, keyPath)
+	require.NotNil(t, err)
+}
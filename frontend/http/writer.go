@@ -35,6 +35,20 @@ func WriteAnnounceResponse(w http.ResponseWriter, resp *bittorrent.AnnounceRespo
 		"min interval": resp.MinInterval,
 	}
 
+	// Add the external IP of the client as described in BEP 24.
+	if ip := resp.ExternalIP.To4(); ip != nil {
+		bdict["external ip"] = []byte(ip)
+	} else if ip := resp.ExternalIP.To16(); ip != nil {
+		bdict["external ip"] = []byte(ip)
+	}
+
+	if resp.TrackerID != "" {
+		bdict["tracker id"] = resp.TrackerID
+	}
+	if resp.WarningMessage != "" {
+		bdict["warning message"] = resp.WarningMessage
+	}
+
 	// Add the peers to the dictionary in the compact format.
 	if resp.Compact {
 		var IPv4CompactDict, IPv6CompactDict []byte
@@ -79,6 +93,7 @@ func WriteScrapeResponse(w http.ResponseWriter, resp *bittorrent.ScrapeResponse)
 		filesDict[string(scrape.InfoHash[:])] = bencode.Dict{
 			"complete":   scrape.Complete,
 			"incomplete": scrape.Incomplete,
+			"downloaded": scrape.Snatches,
 		}
 	}
 
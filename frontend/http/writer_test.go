@@ -2,12 +2,14 @@ package http
 
 import (
 	"fmt"
+	"net"
 	"net/http/httptest"
 	"testing"
 
 	"github.com/stretchr/testify/require"
 
 	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/frontend/http/bencode"
 )
 
 func TestWriteError(t *testing.T) {
@@ -44,3 +46,62 @@ func TestWriteStatus(t *testing.T) {
 		})
 	}
 }
+
+func TestWriteAnnounceResponseExternalIP(t *testing.T) {
+	table := []struct {
+		ip       net.IP
+		expected interface{}
+	}{
+		{nil, nil},
+		{net.ParseIP("1.2.3.4"), "\x01\x02\x03\x04"},
+		{net.ParseIP("::1"), string(net.ParseIP("::1"))},
+	}
+
+	for _, tt := range table {
+		t.Run(tt.ip.String(), func(t *testing.T) {
+			r := httptest.NewRecorder()
+			err := WriteAnnounceResponse(r, &bittorrent.AnnounceResponse{ExternalIP: tt.ip})
+			require.Nil(t, err)
+
+			decoded, err := bencode.Unmarshal(r.Body.Bytes())
+			require.Nil(t, err)
+			require.Equal(t, tt.expected, decoded.(bencode.Dict)["external ip"])
+		})
+	}
+}
+
+func TestWriteAnnounceResponseOptionalFields(t *testing.T) {
+	r := httptest.NewRecorder()
+	err := WriteAnnounceResponse(r, &bittorrent.AnnounceResponse{})
+	require.Nil(t, err)
+	decoded, err := bencode.Unmarshal(r.Body.Bytes())
+	require.Nil(t, err)
+	require.NotContains(t, decoded.(bencode.Dict), "tracker id")
+	require.NotContains(t, decoded.(bencode.Dict), "warning message")
+
+	r = httptest.NewRecorder()
+	err = WriteAnnounceResponse(r, &bittorrent.AnnounceResponse{TrackerID: "abc", WarningMessage: "client outdated"})
+	require.Nil(t, err)
+	decoded, err = bencode.Unmarshal(r.Body.Bytes())
+	require.Nil(t, err)
+	require.Equal(t, "abc", decoded.(bencode.Dict)["tracker id"])
+	require.Equal(t, "client outdated", decoded.(bencode.Dict)["warning message"])
+}
+
+func TestWriteScrapeResponse(t *testing.T) {
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	r := httptest.NewRecorder()
+	err := WriteScrapeResponse(r, &bittorrent.ScrapeResponse{
+		Files: []bittorrent.Scrape{{InfoHash: ih, Complete: 2, Incomplete: 3, Snatches: 5}},
+	})
+	require.Nil(t, err)
+
+	resp, err := bencode.Unmarshal(r.Body.Bytes())
+	require.Nil(t, err)
+	files := resp.(bencode.Dict)["files"].(bencode.Dict)
+	require.Equal(t, bencode.Dict{
+		"complete":   int64(2),
+		"incomplete": int64(3),
+		"downloaded": int64(5),
+	}, files[string(ih[:])])
+}
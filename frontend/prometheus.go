@@ -0,0 +1,29 @@
+package frontend
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+func init() {
+	prometheus.MustRegister(promErrors)
+}
+
+var promErrors = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "chihaya_frontend_errors_total",
+		Help: "The number of requests that failed, by frontend, action and reason",
+	},
+	[]string{"frontend", "action", "reason"},
+)
+
+// RecordError records a request of a frontend that failed with err, labeled
+// by the reason of the error, see bittorrent.ErrorReason.
+// Nothing is recorded for a nil error.
+func RecordError(frontend, action string, err error) {
+	if err == nil {
+		return
+	}
+	promErrors.WithLabelValues(frontend, action, bittorrent.ErrorReason(err)).Inc()
+}
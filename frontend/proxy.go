@@ -0,0 +1,97 @@
+package frontend
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// TrustedProxies are the networks of reverse proxies whose forwarding headers
+// are trusted.
+type TrustedProxies []*net.IPNet
+
+// ParseTrustedProxies parses a list of CIDRs.
+// A single IP address is treated as a network containing only that address.
+func ParseTrustedProxies(cidrs []string) (TrustedProxies, error) {
+	var tp TrustedProxies
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy: %q", cidr)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			tp = append(tp, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy: %w", err)
+		}
+		tp = append(tp, ipnet)
+	}
+
+	return tp, nil
+}
+
+// Contains returns whether the given IP belongs to a trusted proxy.
+func (tp TrustedProxies) Contains(ip net.IP) bool {
+	for _, ipnet := range tp {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP determines the IP of the client of a request.
+//
+// If the request was received from a trusted proxy, the client IP is taken
+// from the given header, X-Forwarded-For if it is empty. Otherwise, or if the
+// header holds no usable address, the remote address of the request is used.
+func (tp TrustedProxies) ClientIP(r *http.Request, header string) net.IP {
+	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+	remoteIP := net.ParseIP(host)
+	if remoteIP == nil || !tp.Contains(remoteIP) {
+		return remoteIP
+	}
+
+	if header == "" {
+		header = "X-Forwarded-For"
+	}
+	if ip := tp.ForwardedIP(r.Header.Values(header)); ip != nil {
+		return ip
+	}
+	return remoteIP
+}
+
+// ForwardedIP determines the client IP from the values of a forwarding
+// header, such as X-Forwarded-For.
+//
+// Every proxy appends the address it received the request from, so the list
+// is walked from the right, skipping trusted proxies. If all addresses are
+// trusted, the leftmost one is returned.
+func (tp TrustedProxies) ForwardedIP(values []string) net.IP {
+	var addrs []string
+	for _, v := range values {
+		addrs = append(addrs, strings.Split(v, ",")...)
+	}
+
+	var ip net.IP
+	for i := len(addrs) - 1; i >= 0; i-- {
+		ip = net.ParseIP(strings.TrimSpace(addrs[i]))
+		if ip == nil {
+			// Everything left of a malformed entry cannot be trusted.
+			return nil
+		}
+		if !tp.Contains(ip) {
+			return ip
+		}
+	}
+	return ip
+}
@@ -0,0 +1,53 @@
+package frontend
+
+import (
+	"crypto/tls"
+	"sync"
+)
+
+// KeypairReloader holds a TLS certificate that can be reloaded from disk
+// without restarting the server using it.
+type KeypairReloader struct {
+	certPath string
+	keyPath  string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+// NewKeypairReloader loads the key pair at the given paths.
+func NewKeypairReloader(certPath, keyPath string) (*KeypairReloader, error) {
+	kpr := &KeypairReloader{
+		certPath: certPath,
+		keyPath:  keyPath,
+	}
+
+	if err := kpr.Reload(); err != nil {
+		return nil, err
+	}
+
+	return kpr, nil
+}
+
+// Reload loads the key pair from disk.
+// If loading fails, the previously loaded key pair is kept.
+func (kpr *KeypairReloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(kpr.certPath, kpr.keyPath)
+	if err != nil {
+		return err
+	}
+
+	kpr.mu.Lock()
+	kpr.cert = &cert
+	kpr.mu.Unlock()
+
+	return nil
+}
+
+// GetCertificate implements the GetCertificate callback of a tls.Config.
+func (kpr *KeypairReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	kpr.mu.RLock()
+	defer kpr.mu.RUnlock()
+
+	return kpr.cert, nil
+}
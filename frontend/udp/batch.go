@@ -0,0 +1,213 @@
+package udp
+
+import (
+	"net"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+
+	"github.com/chihaya/chihaya/frontend/udp/bytepool"
+	"github.com/chihaya/chihaya/pkg/log"
+)
+
+// batchConn is implemented by the PacketConns of the ipv4 and ipv6 packages.
+// On Linux, ReadBatch and WriteBatch receive and send multiple messages with a
+// single recvmmsg or sendmmsg syscall, on other platforms they process one
+// message per call.
+type batchConn interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+// newBatchConn returns a batchConn for a socket.
+func newBatchConn(socket *net.UDPConn) (conn batchConn, v6 bool) {
+	if ip := socket.LocalAddr().(*net.UDPAddr).IP; ip.To4() != nil {
+		return ipv4.NewPacketConn(socket), false
+	}
+	return ipv6.NewPacketConn(socket), true
+}
+
+// receivedPacket is a packet read from a socket into a buffer of a pool.
+type receivedPacket struct {
+	buf  *[]byte
+	n    int
+	addr *net.UDPAddr
+}
+
+// A batchReader reads multiple packets from a socket at once.
+type batchReader struct {
+	conn batchConn
+	pool *bytepool.BytePool
+	msgs []ipv4.Message
+	bufs []*[]byte
+}
+
+// newBatchReader creates a batchReader reading up to size packets at once
+// into buffers from the given pool.
+func newBatchReader(socket *net.UDPConn, pool *bytepool.BytePool, size int) *batchReader {
+	conn, _ := newBatchConn(socket)
+	b := &batchReader{
+		conn: conn,
+		pool: pool,
+		msgs: make([]ipv4.Message, size),
+		bufs: make([]*[]byte, size),
+	}
+	for i := range b.msgs {
+		b.bufs[i] = pool.Get()
+		b.msgs[i].Buffers = [][]byte{*b.bufs[i]}
+	}
+	return b
+}
+
+// read blocks until at least one packet was read and appends the packets read
+// to packets.
+// The buffers of the returned packets are owned by the caller, who must return
+// them to the pool.
+func (b *batchReader) read(packets []receivedPacket) ([]receivedPacket, error) {
+	n, err := b.conn.ReadBatch(b.msgs, 0)
+	if err != nil {
+		return packets, err
+	}
+	promBatchSize.WithLabelValues("read").Observe(float64(n))
+
+	for i := 0; i < n; i++ {
+		m := &b.msgs[i]
+		addr, ok := m.Addr.(*net.UDPAddr)
+		if ok {
+			packets = append(packets, receivedPacket{buf: b.bufs[i], n: m.N, addr: addr})
+		} else {
+			b.pool.Put(b.bufs[i])
+		}
+
+		// Replace the buffer handed out.
+		b.bufs[i] = b.pool.Get()
+		m.Buffers[0] = *b.bufs[i]
+	}
+
+	return packets, nil
+}
+
+// close returns the buffers of the reader to the pool.
+func (b *batchReader) close() {
+	for _, buf := range b.bufs {
+		b.pool.Put(buf)
+	}
+}
+
+// outgoingPacket is a response queued for a batchWriter.
+type outgoingPacket struct {
+	buf  *[]byte
+	addr *net.UDPAddr
+}
+
+// A batchWriter collects the responses written to a socket and sends them in
+// batches, which reduces the number of syscalls under load.
+//
+// Batching never delays a response: the writer sends whatever is queued as
+// soon as it is idle, so batches only form if responses are produced faster
+// than they can be sent individually.
+type batchWriter struct {
+	socket *net.UDPConn
+	conn   batchConn
+	v6     bool
+	size   int
+
+	pool  *bytepool.BytePool
+	queue chan outgoingPacket
+	done  chan struct{}
+}
+
+// newBatchWriter creates a batchWriter sending batches of up to size
+// responses on the given socket.
+func newBatchWriter(socket *net.UDPConn, size int) *batchWriter {
+	b := &batchWriter{
+		socket: socket,
+		size:   size,
+		pool:   bytepool.New(2048),
+		queue:  make(chan outgoingPacket, 4*size),
+		done:   make(chan struct{}),
+	}
+	b.conn, b.v6 = newBatchConn(socket)
+
+	go b.run()
+	return b
+}
+
+// write queues a response to addr.
+// The response is copied, so b can be reused after write returns.
+func (b *batchWriter) write(p []byte, addr *net.UDPAddr) {
+	// The sockaddrs of batched messages are encoded according to the family of
+	// their IP, which an IPv6 socket does not accept for IPv4 destinations.
+	if b.v6 && addr.IP.To4() != nil {
+		_, _ = b.socket.WriteToUDP(p, addr)
+		return
+	}
+
+	buf := b.pool.Get()
+	if cap(*buf) < len(p) {
+		*buf = make([]byte, len(p))
+	}
+	*buf = (*buf)[:len(p)]
+	copy(*buf, p)
+
+	b.queue <- outgoingPacket{buf: buf, addr: addr}
+}
+
+// run sends the queued responses until the writer is closed.
+func (b *batchWriter) run() {
+	defer close(b.done)
+
+	packets := make([]outgoingPacket, 0, b.size)
+	msgs := make([]ipv4.Message, 0, b.size)
+	for first := range b.queue {
+		packets = append(packets[:0], first)
+	collect:
+		for len(packets) < b.size {
+			select {
+			case p, ok := <-b.queue:
+				if !ok {
+					break collect
+				}
+				packets = append(packets, p)
+			default:
+				break collect
+			}
+		}
+
+		msgs = msgs[:0]
+		for _, p := range packets {
+			msgs = append(msgs, ipv4.Message{Buffers: [][]byte{*p.buf}, Addr: p.addr})
+		}
+		b.flush(msgs)
+
+		for _, p := range packets {
+			b.pool.Put(p.buf)
+		}
+	}
+}
+
+// flush sends a batch of messages.
+// Messages that cannot be sent are dropped, just like failed individual
+// writes.
+func (b *batchWriter) flush(msgs []ipv4.Message) {
+	promBatchSize.WithLabelValues("write").Observe(float64(len(msgs)))
+	for len(msgs) > 0 {
+		n, err := b.conn.WriteBatch(msgs, 0)
+		if err != nil {
+			if n >= len(msgs) {
+				return
+			}
+			log.Debug("udp: failed to write response", log.Fields{"addr": msgs[n].Addr}, log.Err(err))
+			// Skip the message that failed.
+			n++
+		}
+		msgs = msgs[n:]
+	}
+}
+
+// close sends the remaining queued responses and stops the writer.
+// write must not be called after close.
+func (b *batchWriter) close() {
+	close(b.queue)
+	<-b.done
+}
@@ -0,0 +1,70 @@
+package udp
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/frontend/udp/bytepool"
+)
+
+func TestBatchWriter(t *testing.T) {
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.Nil(t, err)
+	defer server.Close()
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.Nil(t, err)
+	defer client.Close()
+
+	w := newBatchWriter(server, 8)
+	addr := client.LocalAddr().(*net.UDPAddr)
+	for i := 0; i < 20; i++ {
+		w.write([]byte(fmt.Sprintf("response %d", i)), addr)
+	}
+	w.close()
+
+	require.Nil(t, client.SetReadDeadline(time.Now().Add(5*time.Second)))
+	buf := make([]byte, 64)
+	for i := 0; i < 20; i++ {
+		n, _, err := client.ReadFromUDP(buf)
+		require.Nil(t, err)
+		require.Equal(t, fmt.Sprintf("response %d", i), string(buf[:n]))
+	}
+}
+
+func TestBatchReader(t *testing.T) {
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.Nil(t, err)
+	defer server.Close()
+	client, err := net.DialUDP("udp", nil, server.LocalAddr().(*net.UDPAddr))
+	require.Nil(t, err)
+	defer client.Close()
+
+	for i := 0; i < 10; i++ {
+		_, err := client.Write([]byte(fmt.Sprintf("request %d", i)))
+		require.Nil(t, err)
+	}
+
+	pool := bytepool.New(2048)
+	r := newBatchReader(server, pool, 4)
+	defer r.close()
+	require.Nil(t, server.SetReadDeadline(time.Now().Add(5*time.Second)))
+
+	var packets []receivedPacket
+	for len(packets) < 10 {
+		var read []receivedPacket
+		read, err = r.read(nil)
+		require.Nil(t, err)
+		require.True(t, len(read) <= 4)
+		packets = append(packets, read...)
+	}
+
+	for i, p := range packets {
+		require.Equal(t, fmt.Sprintf("request %d", i), string((*p.buf)[:p.n]))
+		require.Equal(t, client.LocalAddr().String(), p.addr.String())
+		pool.Put(p.buf)
+	}
+}
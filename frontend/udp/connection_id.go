@@ -12,8 +12,9 @@ import (
 	"github.com/chihaya/chihaya/pkg/log"
 )
 
-// ttl is the duration a connection ID should be valid according to BEP 15.
-const ttl = 2 * time.Minute
+// defaultTTL is the duration a connection ID should be valid according to
+// BEP 15.
+const defaultTTL = 2 * time.Minute
 
 // NewConnectionID creates an 8-byte connection identifier for UDP packets as
 // described by BEP 15.
@@ -30,17 +31,51 @@ func ValidConnectionID(connectionID []byte, ip net.IP, now time.Time, maxClockSk
 	return NewConnectionIDGenerator(key).Validate(connectionID, ip, now, maxClockSkew)
 }
 
+// ConnectionIDOptions configure the keys and validity of connection IDs.
+type ConnectionIDOptions struct {
+	// Key is the secret used to sign connection IDs.
+	Key string
+
+	// PreviousKey is a secret that connection IDs are still accepted for,
+	// which allows changing Key without invalidating IDs of clients.
+	PreviousKey string
+
+	// RotationInterval, if positive, is the interval at which the key used to
+	// sign connection IDs is rotated. The keys are derived from Key, so all
+	// instances using the same Key agree on them.
+	// IDs signed with the key of the previous interval remain valid.
+	RotationInterval time.Duration
+
+	// TTL is the duration a connection ID is valid for.
+	TTL time.Duration
+}
+
+// epochMAC is an HMAC keyed for one rotation epoch.
+type epochMAC struct {
+	previous bool
+	epoch    int64
+	mac      hash.Hash
+}
+
+// maxCachedMACs is the number of keyed HMACs a generator keeps around.
+// This covers the current and previous epoch for both the current and the
+// previous key.
+const maxCachedMACs = 4
+
 // A ConnectionIDGenerator is a reusable generator and validator for connection
 // IDs as described in BEP 15.
 // It is not thread safe, but is safe to be pooled and reused by other
 // goroutines. It manages its state itself, so it can be taken from and returned
 // to a pool without any cleanup.
-// After initial creation, it can generate connection IDs without allocating.
+// After initial creation, it can generate connection IDs without allocating,
+// except once per key rotation.
 // See Generate and Validate for usage notes and guarantees.
 type ConnectionIDGenerator struct {
-	// mac is a keyed HMAC that can be reused for subsequent connection ID
-	// generations.
-	mac hash.Hash
+	opts ConnectionIDOptions
+
+	// macs are keyed HMACs that can be reused for subsequent connection ID
+	// generations, most recently used last.
+	macs []epochMAC
 
 	// connID is an 8-byte slice that holds the generated connection ID after a
 	// call to Generate.
@@ -53,20 +88,68 @@ type ConnectionIDGenerator struct {
 	scratch []byte
 }
 
-// NewConnectionIDGenerator creates a new connection ID generator.
+// NewConnectionIDGenerator creates a new connection ID generator using a
+// single, fixed key.
 func NewConnectionIDGenerator(key string) *ConnectionIDGenerator {
+	return NewConnectionIDGeneratorWithOptions(ConnectionIDOptions{Key: key})
+}
+
+// NewConnectionIDGeneratorWithOptions creates a new connection ID generator.
+func NewConnectionIDGeneratorWithOptions(opts ConnectionIDOptions) *ConnectionIDGenerator {
+	if opts.TTL <= 0 {
+		opts.TTL = defaultTTL
+	}
+
 	return &ConnectionIDGenerator{
-		mac:     hmac.New(sha256.New, []byte(key)),
+		opts:    opts,
+		macs:    make([]epochMAC, 0, maxCachedMACs),
 		connID:  make([]byte, 8),
 		scratch: make([]byte, 32),
 	}
 }
 
+// epoch returns the rotation epoch of a point in time.
+func (g *ConnectionIDGenerator) epoch(t time.Time) int64 {
+	if g.opts.RotationInterval <= 0 {
+		return 0
+	}
+	return t.Unix() / int64(g.opts.RotationInterval/time.Second)
+}
+
+// macFor returns a reset HMAC keyed for the given key and epoch.
+func (g *ConnectionIDGenerator) macFor(previous bool, epoch int64) hash.Hash {
+	for i := len(g.macs) - 1; i >= 0; i-- {
+		if m := g.macs[i]; m.previous == previous && m.epoch == epoch {
+			m.mac.Reset()
+			return m.mac
+		}
+	}
+
+	key := []byte(g.opts.Key)
+	if previous {
+		key = []byte(g.opts.PreviousKey)
+	}
+	if g.opts.RotationInterval > 0 {
+		// Derive the key of the epoch from the configured key.
+		var epochBytes [8]byte
+		binary.BigEndian.PutUint64(epochBytes[:], uint64(epoch))
+		derive := hmac.New(sha256.New, key)
+		derive.Write(epochBytes[:])
+		key = derive.Sum(nil)
+	}
+
+	if len(g.macs) == maxCachedMACs {
+		g.macs = append(g.macs[:0], g.macs[1:]...)
+	}
+	mac := hmac.New(sha256.New, key)
+	g.macs = append(g.macs, epochMAC{previous: previous, epoch: epoch, mac: mac})
+	return mac
+}
+
 // reset resets the generator.
 // This is called by other methods of the generator, it's not necessary to call
 // it after getting a generator from a pool.
 func (g *ConnectionIDGenerator) reset() {
-	g.mac.Reset()
 	g.connID = g.connID[:8]
 	g.scratch = g.scratch[:0]
 }
@@ -90,9 +173,10 @@ func (g *ConnectionIDGenerator) Generate(ip net.IP, now time.Time) []byte {
 
 	binary.BigEndian.PutUint32(g.connID, uint32(now.Unix()))
 
-	g.mac.Write(g.connID[:4])
-	g.mac.Write(ip)
-	g.scratch = g.mac.Sum(g.scratch)
+	mac := g.macFor(false, g.epoch(now))
+	mac.Write(g.connID[:4])
+	mac.Write(ip)
+	g.scratch = mac.Sum(g.scratch)
 	copy(g.connID[4:8], g.scratch[:4])
 
 	log.Debug("generated connection ID", log.Fields{"ip": ip, "now": now, "connID": g.connID})
@@ -100,17 +184,34 @@ func (g *ConnectionIDGenerator) Generate(ip net.IP, now time.Time) []byte {
 }
 
 // Validate validates the given connection ID for an IP and the current time.
+//
+// IDs signed with the previous key or in the previous rotation epoch are
+// accepted, as long as they have not expired.
 func (g *ConnectionIDGenerator) Validate(connectionID []byte, ip net.IP, now time.Time, maxClockSkew time.Duration) bool {
 	ts := time.Unix(int64(binary.BigEndian.Uint32(connectionID[:4])), 0)
 	log.Debug("validating connection ID", log.Fields{"connID": connectionID, "ip": ip, "ts": ts, "now": now})
-	if now.After(ts.Add(ttl)) || ts.After(now.Add(maxClockSkew)) {
+	if now.After(ts.Add(g.opts.TTL)) || ts.After(now.Add(maxClockSkew)) {
+		return false
+	}
+
+	// The key of an ID is determined by the epoch it was created in.
+	epoch := g.epoch(ts)
+	if epoch < g.epoch(now)-1 {
 		return false
 	}
 
+	if g.validateWith(false, epoch, connectionID, ip) {
+		return true
+	}
+	return g.opts.PreviousKey != "" && g.validateWith(true, epoch, connectionID, ip)
+}
+
+func (g *ConnectionIDGenerator) validateWith(previous bool, epoch int64, connectionID []byte, ip net.IP) bool {
 	g.reset()
 
-	g.mac.Write(connectionID[:4])
-	g.mac.Write(ip)
-	g.scratch = g.mac.Sum(g.scratch)
+	mac := g.macFor(previous, epoch)
+	mac.Write(connectionID[:4])
+	mac.Write(ip)
+	g.scratch = mac.Sum(g.scratch)
 	return hmac.Equal(g.scratch[:4], connectionID[4:])
 }
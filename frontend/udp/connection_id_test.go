@@ -98,6 +98,52 @@ func TestReuseGeneratorValidate(t *testing.T) {
 	}
 }
 
+func TestPreviousKey(t *testing.T) {
+	ip := net.ParseIP("127.0.0.1")
+	now := time.Unix(1000, 0)
+
+	cid := NewConnectionID(ip, now, "old")
+
+	gen := NewConnectionIDGeneratorWithOptions(ConnectionIDOptions{Key: "new", PreviousKey: "old"})
+	require.True(t, gen.Validate(cid, ip, now, time.Minute))
+
+	gen = NewConnectionIDGenerator("new")
+	require.False(t, gen.Validate(cid, ip, now, time.Minute))
+}
+
+func TestKeyRotation(t *testing.T) {
+	var table = []struct {
+		createdAt int64
+		now       int64
+		valid     bool
+	}{
+		{10, 20, true},
+		{50, 70, true},
+		{59, 150, false},
+		{120, 239, true},
+		{120, 241, false},
+	}
+
+	ip := net.ParseIP("127.0.0.1")
+	opts := ConnectionIDOptions{Key: "key", RotationInterval: time.Minute}
+	for _, tt := range table {
+		t.Run(fmt.Sprintf("created at %d verified at %d", tt.createdAt, tt.now), func(t *testing.T) {
+			cid := make([]byte, 8)
+			copy(cid, NewConnectionIDGeneratorWithOptions(opts).Generate(ip, time.Unix(tt.createdAt, 0)))
+
+			// A separate generator simulates a replica sharing the key.
+			gen := NewConnectionIDGeneratorWithOptions(opts)
+			require.Equal(t, tt.valid, gen.Validate(cid, ip, time.Unix(tt.now, 0), time.Minute))
+		})
+	}
+
+	gen := NewConnectionIDGeneratorWithOptions(opts)
+	first := append([]byte(nil), gen.Generate(ip, time.Unix(0, 0))...)
+	second := append([]byte(nil), gen.Generate(ip, time.Unix(0, 0).Add(time.Minute))...)
+	require.NotEqual(t, first[4:], second[4:], "the key should change between intervals")
+	require.NotEqual(t, simpleNewConnectionID(ip, time.Unix(0, 0), "key"), first)
+}
+
 func BenchmarkSimpleNewConnectionID(b *testing.B) {
 	ip := net.ParseIP("127.0.0.1")
 	key := "some random string that is hopefully at least this long"
@@ -0,0 +1,64 @@
+package udp
+
+import (
+	"time"
+
+	"github.com/chihaya/chihaya/pkg/log"
+)
+
+// dropsPollInterval is how often the numbers of packets dropped by the kernel
+// are read.
+const dropsPollInterval = 10 * time.Second
+
+// watchDrops periodically adds the packets the kernel dropped on the sockets
+// of the frontend to promDroppedPackets until the frontend is stopped.
+//
+// The kernel drops packets if the receive buffer of a socket is full, i.e. if
+// they are not read fast enough. Drops are only reported on Linux.
+func (t *Frontend) watchDrops() {
+	defer t.wg.Done()
+
+	listeners := make(map[uint64]string, len(t.sockets))
+	for _, socket := range t.sockets {
+		inode, err := socketInode(socket)
+		if err != nil {
+			log.Debug("udp: not reporting dropped packets", log.Err(err))
+			return
+		}
+		listeners[inode] = socket.LocalAddr().String()
+	}
+
+	ticker := time.NewTicker(dropsPollInterval)
+	defer ticker.Stop()
+
+	// Packets dropped before the frontend started, e.g. on a socket passed by
+	// systemd, are not reported.
+	var last map[uint64]uint64
+	for {
+		drops, err := readDrops()
+		if err != nil {
+			log.Warn("udp: failed to read dropped packets", log.Err(err))
+			return
+		}
+
+		if last != nil {
+			for inode, listener := range listeners {
+				if drops[inode] > last[inode] {
+					n := drops[inode] - last[inode]
+					promDroppedPackets.WithLabelValues(listener).Add(float64(n))
+					log.Warn("udp: the kernel dropped packets, consider increasing the read buffer size or the number of workers", log.Fields{
+						"addr":    listener,
+						"dropped": n,
+					})
+				}
+			}
+		}
+		last = drops
+
+		select {
+		case <-t.closing:
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package udp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// socketInode returns the inode of a socket, which identifies it in
+// /proc/net/udp.
+func socketInode(socket *net.UDPConn) (uint64, error) {
+	rc, err := socket.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	var st unix.Stat_t
+	var statErr error
+	if err := rc.Control(func(fd uintptr) {
+		statErr = unix.Fstat(int(fd), &st)
+	}); err != nil {
+		return 0, err
+	}
+	return st.Ino, statErr
+}
+
+// readDrops returns the numbers of packets dropped by the kernel on all UDP
+// sockets, keyed by their inodes.
+func readDrops() (map[uint64]uint64, error) {
+	drops := make(map[uint64]uint64)
+	for _, path := range []string{"/proc/net/udp", "/proc/net/udp6"} {
+		f, err := os.Open(path)
+		if os.IsNotExist(err) {
+			// IPv6 is disabled.
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		err = parseDrops(f, drops)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return drops, nil
+}
+
+// parseDrops parses a table in the format of /proc/net/udp and adds the
+// number of dropped packets of every socket to drops.
+func parseDrops(r io.Reader, drops map[uint64]uint64) error {
+	s := bufio.NewScanner(r)
+
+	// Skip the header.
+	s.Scan()
+
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 13 {
+			return fmt.Errorf("malformed line: %q", s.Text())
+		}
+
+		inode, err := strconv.ParseUint(fields[9], 10, 64)
+		if err != nil {
+			return err
+		}
+		n, err := strconv.ParseUint(fields[12], 10, 64)
+		if err != nil {
+			return err
+		}
+		drops[inode] += n
+	}
+	return s.Err()
+}
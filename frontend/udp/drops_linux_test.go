@@ -0,0 +1,46 @@
+package udp
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+const procNetUDP = `   sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode ref pointer drops
+  812: 00000000:1B39 00000000:0000 07 00000000:00000000 00:00000000 00000000     0        0 21453 2 0000000000000000 7
+ 1095: 0100007F:0035 00000000:0000 07 00000000:00000000 00:00000000 00000000   101        0 18110 2 0000000000000000 0
+`
+
+func TestParseDrops(t *testing.T) {
+	drops := make(map[uint64]uint64)
+	if err := parseDrops(strings.NewReader(procNetUDP), drops); err != nil {
+		t.Fatal(err)
+	}
+	if len(drops) != 2 || drops[21453] != 7 || drops[18110] != 0 {
+		t.Fatalf("unexpected drops: %v", drops)
+	}
+
+	if err := parseDrops(strings.NewReader("header\n 1: 00000000:1B39\n"), drops); err == nil {
+		t.Fatal("expected a malformed line to fail")
+	}
+}
+
+func TestReadDrops(t *testing.T) {
+	socket, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socket.Close()
+
+	inode, err := socketInode(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	drops, err := readDrops()
+	if err != nil {
+		t.Skip("/proc/net/udp is not available:", err)
+	}
+	if _, ok := drops[inode]; !ok {
+		t.Fatalf("socket %d not found in %v", inode, drops)
+	}
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+// +build !linux
+
+package udp
+
+import (
+	"errors"
+	"net"
+)
+
+var errDropsUnsupported = errors.New("dropped packets are only reported on Linux")
+
+// socketInode is not supported on this platform.
+func socketInode(socket *net.UDPConn) (uint64, error) {
+	return 0, errDropsUnsupported
+}
+
+// readDrops is not supported on this platform.
+func readDrops() (map[uint64]uint64, error) {
+	return nil, errDropsUnsupported
+}
@@ -16,9 +16,12 @@ import (
 	"github.com/chihaya/chihaya/bittorrent"
 	"github.com/chihaya/chihaya/frontend"
 	"github.com/chihaya/chihaya/frontend/udp/bytepool"
+	"github.com/chihaya/chihaya/pkg/accesslog"
 	"github.com/chihaya/chihaya/pkg/log"
 	"github.com/chihaya/chihaya/pkg/stop"
+	"github.com/chihaya/chihaya/pkg/systemd"
 	"github.com/chihaya/chihaya/pkg/timecache"
+	"github.com/chihaya/chihaya/pkg/tracing"
 )
 
 var allowedGeneratedPrivateKeyRunes = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ1234567890")
@@ -27,8 +30,21 @@ var allowedGeneratedPrivateKeyRunes = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGH
 // Tracker.
 type Config struct {
 	Addr                string        `yaml:"addr"`
+	Addrs               []string      `yaml:"addrs"`
+	IPv4                FamilyConfig  `yaml:"ipv4"`
+	IPv6                FamilyConfig  `yaml:"ipv6"`
 	PrivateKey          string        `yaml:"private_key"`
+	PreviousPrivateKey  string        `yaml:"previous_private_key"`
+	KeyRotationInterval time.Duration `yaml:"key_rotation_interval"`
+	ConnectionIDTTL     time.Duration `yaml:"connection_id_ttl"`
 	MaxClockSkew        time.Duration `yaml:"max_clock_skew"`
+	Workers             int           `yaml:"workers"`
+	ProcessingWorkers   int           `yaml:"processing_workers"`
+	PacketBufferSize    int           `yaml:"packet_buffer_size"`
+	ReadBufferSize      int           `yaml:"read_buffer_size"`
+	WriteBufferSize     int           `yaml:"write_buffer_size"`
+	ReadBatchSize       int           `yaml:"read_batch_size"`
+	WriteBatchSize      int           `yaml:"write_batch_size"`
 	EnableRequestTiming bool          `yaml:"enable_request_timing"`
 	ParseOptions        `yaml:",inline"`
 }
@@ -37,8 +53,21 @@ type Config struct {
 func (cfg Config) LogFields() log.Fields {
 	return log.Fields{
 		"addr":                cfg.Addr,
+		"addrs":               cfg.Addrs,
+		"ipv4":                cfg.IPv4,
+		"ipv6":                cfg.IPv6,
 		"privateKey":          cfg.PrivateKey,
+		"previousPrivateKey":  cfg.PreviousPrivateKey,
+		"keyRotationInterval": cfg.KeyRotationInterval,
+		"connectionIDTTL":     cfg.ConnectionIDTTL,
 		"maxClockSkew":        cfg.MaxClockSkew,
+		"workers":             cfg.Workers,
+		"processingWorkers":   cfg.ProcessingWorkers,
+		"packetBufferSize":    cfg.PacketBufferSize,
+		"readBufferSize":      cfg.ReadBufferSize,
+		"writeBufferSize":     cfg.WriteBufferSize,
+		"readBatchSize":       cfg.ReadBatchSize,
+		"writeBatchSize":      cfg.WriteBatchSize,
 		"enableRequestTiming": cfg.EnableRequestTiming,
 		"allowIPSpoofing":     cfg.AllowIPSpoofing,
 		"maxNumWant":          cfg.MaxNumWant,
@@ -47,6 +76,57 @@ func (cfg Config) LogFields() log.Fields {
 	}
 }
 
+// FamilyConfig represents the configuration of the sockets of a UDP
+// BitTorrent Tracker that only serve a single address family.
+//
+// Buffer sizes of zero fall back to the buffer sizes of the Config.
+type FamilyConfig struct {
+	Addrs           []string `yaml:"addrs"`
+	ReadBufferSize  int      `yaml:"read_buffer_size"`
+	WriteBufferSize int      `yaml:"write_buffer_size"`
+}
+
+// validate sanity checks the values set in a FamilyConfig.
+func (cfg FamilyConfig) validate(name string) FamilyConfig {
+	validcfg := cfg
+
+	if cfg.ReadBufferSize < 0 {
+		validcfg.ReadBufferSize = 0
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     name + ".ReadBufferSize",
+			"provided": cfg.ReadBufferSize,
+			"default":  validcfg.ReadBufferSize,
+		})
+	}
+
+	if cfg.WriteBufferSize < 0 {
+		validcfg.WriteBufferSize = 0
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     name + ".WriteBufferSize",
+			"provided": cfg.WriteBufferSize,
+			"default":  validcfg.WriteBufferSize,
+		})
+	}
+
+	return validcfg
+}
+
+// Default config constants.
+const (
+	// defaultWorkers is the default number of sockets per address.
+	defaultWorkers = 1
+
+	// defaultPacketBufferSize is the default size of the buffers packets are
+	// read into.
+	defaultPacketBufferSize = 2048
+
+	// minPacketBufferSize is the smallest buffer that holds an announce.
+	minPacketBufferSize = 128
+
+	// maxPacketBufferSize is the largest payload of a UDP packet.
+	maxPacketBufferSize = 65507
+)
+
 // Validate sanity checks values set in a config and returns a new config with
 // default values replacing anything that is invalid.
 //
@@ -66,6 +146,72 @@ func (cfg Config) Validate() Config {
 		log.Warn("UDP private key was not provided, using generated key", log.Fields{"key": validcfg.PrivateKey})
 	}
 
+	if cfg.ReadBufferSize < 0 {
+		validcfg.ReadBufferSize = 0
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     "udp.ReadBufferSize",
+			"provided": cfg.ReadBufferSize,
+			"default":  validcfg.ReadBufferSize,
+		})
+	}
+
+	if cfg.WriteBufferSize < 0 {
+		validcfg.WriteBufferSize = 0
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     "udp.WriteBufferSize",
+			"provided": cfg.WriteBufferSize,
+			"default":  validcfg.WriteBufferSize,
+		})
+	}
+
+	validcfg.IPv4 = cfg.IPv4.validate("udp.IPv4")
+	validcfg.IPv6 = cfg.IPv6.validate("udp.IPv6")
+
+	if cfg.KeyRotationInterval < 0 || (cfg.KeyRotationInterval > 0 && cfg.KeyRotationInterval < time.Second) {
+		validcfg.KeyRotationInterval = 0
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     "udp.KeyRotationInterval",
+			"provided": cfg.KeyRotationInterval,
+			"default":  validcfg.KeyRotationInterval,
+		})
+	}
+
+	if cfg.ConnectionIDTTL <= 0 {
+		validcfg.ConnectionIDTTL = defaultTTL
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     "udp.ConnectionIDTTL",
+			"provided": cfg.ConnectionIDTTL,
+			"default":  validcfg.ConnectionIDTTL,
+		})
+	}
+
+	if cfg.Workers <= 0 {
+		validcfg.Workers = defaultWorkers
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     "udp.Workers",
+			"provided": cfg.Workers,
+			"default":  validcfg.Workers,
+		})
+	}
+
+	if cfg.ProcessingWorkers < 0 {
+		validcfg.ProcessingWorkers = 0
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     "udp.ProcessingWorkers",
+			"provided": cfg.ProcessingWorkers,
+			"default":  validcfg.ProcessingWorkers,
+		})
+	}
+
+	if cfg.PacketBufferSize < minPacketBufferSize || cfg.PacketBufferSize > maxPacketBufferSize {
+		validcfg.PacketBufferSize = defaultPacketBufferSize
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     "udp.PacketBufferSize",
+			"provided": cfg.PacketBufferSize,
+			"default":  validcfg.PacketBufferSize,
+		})
+	}
+
 	if cfg.MaxNumWant <= 0 {
 		validcfg.MaxNumWant = defaultMaxNumWant
 		log.Warn("falling back to default configuration", log.Fields{
@@ -84,7 +230,7 @@ func (cfg Config) Validate() Config {
 		})
 	}
 
-	if cfg.MaxScrapeInfoHashes <= 0 {
+	if cfg.MaxScrapeInfoHashes <= 0 || cfg.MaxScrapeInfoHashes > MaxScrapeInfoHashes {
 		validcfg.MaxScrapeInfoHashes = defaultMaxScrapeInfoHashes
 		log.Warn("falling back to default configuration", log.Fields{
 			"name":     "udp.MaxScrapeInfoHashes",
@@ -96,12 +242,68 @@ func (cfg Config) Validate() Config {
 	return validcfg
 }
 
+// connectionIDOptions returns the options used to generate and validate
+// connection IDs.
+func (cfg Config) connectionIDOptions() ConnectionIDOptions {
+	return ConnectionIDOptions{
+		Key:              cfg.PrivateKey,
+		PreviousKey:      cfg.PreviousPrivateKey,
+		RotationInterval: cfg.KeyRotationInterval,
+		TTL:              cfg.ConnectionIDTTL,
+	}
+}
+
+// listenConfig describes the sockets bound for one address.
+type listenConfig struct {
+	network string
+	addr    string
+	FamilyConfig
+}
+
+// listenConfigs returns the configurations of all addresses to listen on.
+func (cfg Config) listenConfigs() []listenConfig {
+	buffers := FamilyConfig{ReadBufferSize: cfg.ReadBufferSize, WriteBufferSize: cfg.WriteBufferSize}
+	ipv4, ipv6 := cfg.familyBuffers(cfg.IPv4), cfg.familyBuffers(cfg.IPv6)
+
+	var lcs []listenConfig
+	if cfg.Addr != "" {
+		lcs = append(lcs, listenConfig{network: "udp", addr: cfg.Addr, FamilyConfig: buffers})
+	}
+	for _, addr := range cfg.Addrs {
+		lcs = append(lcs, listenConfig{network: "udp", addr: addr, FamilyConfig: buffers})
+	}
+	for _, addr := range cfg.IPv4.Addrs {
+		lcs = append(lcs, listenConfig{network: "udp4", addr: addr, FamilyConfig: ipv4})
+	}
+	for _, addr := range cfg.IPv6.Addrs {
+		lcs = append(lcs, listenConfig{network: "udp6", addr: addr, FamilyConfig: ipv6})
+	}
+	return lcs
+}
+
+// familyBuffers returns the FamilyConfig with the buffer sizes it leaves unset
+// taken from the Config.
+func (cfg Config) familyBuffers(fc FamilyConfig) FamilyConfig {
+	if fc.ReadBufferSize == 0 {
+		fc.ReadBufferSize = cfg.ReadBufferSize
+	}
+	if fc.WriteBufferSize == 0 {
+		fc.WriteBufferSize = cfg.WriteBufferSize
+	}
+	return fc
+}
+
 // Frontend holds the state of a UDP BitTorrent Frontend.
 type Frontend struct {
-	socket  *net.UDPConn
+	sockets []*net.UDPConn
+	writers []*batchWriter
 	closing chan struct{}
 	wg      sync.WaitGroup
 
+	// packets is the queue of the processing workers, if any are configured.
+	packets   chan queuedPacket
+	workersWG sync.WaitGroup
+
 	genPool *sync.Pool
 
 	logic frontend.TrackerLogic
@@ -113,13 +315,17 @@ type Frontend struct {
 func NewFrontend(logic frontend.TrackerLogic, provided Config) (*Frontend, error) {
 	cfg := provided.Validate()
 
+	if err := cfg.IPPolicy.Init(); err != nil {
+		return nil, err
+	}
+
 	f := &Frontend{
 		closing: make(chan struct{}),
 		logic:   logic,
 		Config:  cfg,
 		genPool: &sync.Pool{
 			New: func() interface{} {
-				return NewConnectionIDGenerator(cfg.PrivateKey)
+				return NewConnectionIDGeneratorWithOptions(cfg.connectionIDOptions())
 			},
 		},
 	}
@@ -128,11 +334,26 @@ func NewFrontend(logic frontend.TrackerLogic, provided Config) (*Frontend, error
 		return nil, err
 	}
 
-	go func() {
-		if err := f.serve(); err != nil {
-			log.Fatal("failed while serving udp", log.Err(err))
+	if cfg.ProcessingWorkers > 0 {
+		f.packets = make(chan queuedPacket, cfg.ProcessingWorkers)
+		f.workersWG.Add(cfg.ProcessingWorkers)
+		for i := 0; i < cfg.ProcessingWorkers; i++ {
+			go f.process()
 		}
-	}()
+	}
+
+	f.wg.Add(1)
+	go f.watchDrops()
+
+	for i, socket := range f.sockets {
+		socket, writer := socket, f.writers[i]
+		f.wg.Add(1)
+		go func() {
+			if err := f.serve(socket, writer); err != nil {
+				log.Fatal("failed while serving udp", log.Fields{"addr": socket.LocalAddr()}, log.Err(err))
+			}
+		}()
+	}
 
 	return f, nil
 }
@@ -148,32 +369,158 @@ func (t *Frontend) Stop() stop.Result {
 	c := make(stop.Channel)
 	go func() {
 		close(t.closing)
-		_ = t.socket.SetReadDeadline(time.Now())
+		for _, socket := range t.sockets {
+			_ = socket.SetReadDeadline(time.Now())
+		}
 		t.wg.Wait()
-		c.Done(t.socket.Close())
+
+		if t.packets != nil {
+			close(t.packets)
+			t.workersWG.Wait()
+		}
+
+		for _, writer := range t.writers {
+			if writer != nil {
+				writer.close()
+			}
+		}
+
+		var errs []error
+		for _, socket := range t.sockets {
+			if err := socket.Close(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		c.Done(errs...)
 	}()
 
 	return c.Result()
 }
 
-// listen resolves the address and binds the server socket.
+// listen resolves the addresses and binds the server sockets.
 func (t *Frontend) listen() error {
-	udpAddr, err := net.ResolveUDPAddr("udp", t.Addr)
+	lcs := t.listenConfigs()
+	if len(lcs) == 0 {
+		return errors.New("must specify addr")
+	}
+
+	for _, lc := range lcs {
+		sockets, err := t.listenAddr(lc)
+		if err != nil {
+			for _, socket := range t.sockets {
+				socket.Close()
+			}
+			return err
+		}
+		t.sockets = append(t.sockets, sockets...)
+	}
+
+	t.writers = make([]*batchWriter, len(t.sockets))
+	if t.WriteBatchSize > 1 {
+		for i, socket := range t.sockets {
+			t.writers[i] = newBatchWriter(socket, t.WriteBatchSize)
+		}
+	}
+
+	return nil
+}
+
+// listenAddr binds the sockets for one address.
+//
+// If more than one worker is configured, that many sockets are bound to the
+// address using SO_REUSEPORT, each served by its own read loop.
+// A socket passed by systemd socket activation for the address is used
+// instead of binding new ones.
+// Sockets bound for a single address family only accept packets of that
+// family, which allows binding IPv4 and IPv6 sockets to the same port.
+func (t *Frontend) listenAddr(cfg listenConfig) ([]*net.UDPConn, error) {
+	var sockets []*net.UDPConn
+	closeAll := func() {
+		for _, socket := range sockets {
+			socket.Close()
+		}
+	}
+
+	inherited, err := systemd.PacketConn(cfg.addr)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	switch {
+	case inherited != nil:
+		// The read loops of all workers share the socket passed by systemd.
+		sockets = append(sockets, inherited)
+		for i := 1; i < t.Workers; i++ {
+			socket, err := systemd.PacketConn(cfg.addr)
+			if err != nil {
+				closeAll()
+				return nil, err
+			}
+			sockets = append(sockets, socket)
+		}
+	case t.Workers <= 1:
+		udpAddr, err := net.ResolveUDPAddr(cfg.network, cfg.addr)
+		if err != nil {
+			return nil, err
+		}
+		socket, err := net.ListenUDP(cfg.network, udpAddr)
+		if err != nil {
+			return nil, err
+		}
+		sockets = append(sockets, socket)
+	default:
+		lc := net.ListenConfig{Control: reusePortControl}
+		addr := cfg.addr
+		for i := 0; i < t.Workers; i++ {
+			conn, err := lc.ListenPacket(context.Background(), cfg.network, addr)
+			if err != nil {
+				closeAll()
+				return nil, err
+			}
+			socket := conn.(*net.UDPConn)
+			sockets = append(sockets, socket)
+
+			// If the port was chosen by the OS, bind the remaining sockets to
+			// the same one.
+			addr = socket.LocalAddr().String()
+		}
 	}
-	t.socket, err = net.ListenUDP("udp", udpAddr)
-	return err
+
+	for _, socket := range sockets {
+		if cfg.ReadBufferSize > 0 {
+			if err := socket.SetReadBuffer(cfg.ReadBufferSize); err != nil {
+				closeAll()
+				return nil, err
+			}
+		}
+		if cfg.WriteBufferSize > 0 {
+			if err := socket.SetWriteBuffer(cfg.WriteBufferSize); err != nil {
+				closeAll()
+				return nil, err
+			}
+		}
+	}
+
+	return sockets, nil
 }
 
-// serve blocks while listening and serving UDP BitTorrent requests
-// until Stop() is called or an error is returned.
-func (t *Frontend) serve() error {
-	pool := bytepool.New(2048)
+// serve blocks while listening and serving UDP BitTorrent requests on a
+// socket until Stop() is called or an error is returned.
+// If writer is not nil, responses are sent through it.
+// The caller must add serve to the wait group.
+func (t *Frontend) serve(socket *net.UDPConn, writer *batchWriter) error {
+	pool := bytepool.New(t.PacketBufferSize)
+	listener := socket.LocalAddr().String()
 
-	t.wg.Add(1)
 	defer t.wg.Done()
 
+	var reader *batchReader
+	if t.ReadBatchSize > 1 {
+		reader = newBatchReader(socket, pool, t.ReadBatchSize)
+		defer reader.close()
+	}
+
+	var packets []receivedPacket
 	for {
 		// Check to see if we need to shutdown.
 		select {
@@ -183,11 +530,23 @@ func (t *Frontend) serve() error {
 		default:
 		}
 
-		// Read a UDP packet into a reusable buffer.
-		buffer := pool.Get()
-		n, addr, err := t.socket.ReadFromUDP(*buffer)
+		// Read UDP packets into reusable buffers.
+		var err error
+		packets = packets[:0]
+		if reader != nil {
+			packets, err = reader.read(packets)
+		} else {
+			buffer := pool.Get()
+			var n int
+			var addr *net.UDPAddr
+			n, addr, err = socket.ReadFromUDP(*buffer)
+			if err != nil {
+				pool.Put(buffer)
+			} else {
+				packets = append(packets, receivedPacket{buf: buffer, n: n, addr: addr})
+			}
+		}
 		if err != nil {
-			pool.Put(buffer)
 			var netErr net.Error
 			if errors.As(err, &netErr); netErr.Temporary() {
 				// A temporary failure is not fatal; just pretend it never happened.
@@ -196,37 +555,74 @@ func (t *Frontend) serve() error {
 			return err
 		}
 
-		// We got nothin'
-		if n == 0 {
-			pool.Put(buffer)
-			continue
+		for _, p := range packets {
+			// We got nothin'
+			if p.n == 0 {
+				pool.Put(p.buf)
+				continue
+			}
+
+			if t.packets != nil {
+				t.packets <- queuedPacket{socket, writer, listener, pool, p}
+				continue
+			}
+
+			p := p
+			t.wg.Add(1)
+			go func() {
+				defer t.wg.Done()
+				defer pool.Put(p.buf)
+				t.handlePacket(socket, writer, listener, p)
+			}()
 		}
+	}
+}
 
-		t.wg.Add(1)
-		go func() {
-			defer t.wg.Done()
-			defer pool.Put(buffer)
+// queuedPacket is a packet queued for the processing workers, along with the
+// socket it was received on.
+type queuedPacket struct {
+	socket   *net.UDPConn
+	writer   *batchWriter
+	listener string
+	pool     *bytepool.BytePool
+	receivedPacket
+}
 
-			if ip := addr.IP.To4(); ip != nil {
-				addr.IP = ip
-			}
+// process handles queued packets until the queue is closed.
+func (t *Frontend) process() {
+	defer t.workersWG.Done()
+	for qp := range t.packets {
+		t.handlePacket(qp.socket, qp.writer, qp.listener, qp.receivedPacket)
+		qp.pool.Put(qp.buf)
+	}
+}
 
-			// Handle the request.
-			var start time.Time
-			if t.EnableRequestTiming {
-				start = time.Now()
-			}
-			action, af, err := t.handleRequest(
-				// Make sure the IP is copied, not referenced.
-				Request{(*buffer)[:n], append([]byte{}, addr.IP...)},
-				ResponseWriter{t.socket, addr},
-			)
-			if t.EnableRequestTiming {
-				recordResponseDuration(action, af, err, time.Since(start))
-			} else {
-				recordResponseDuration(action, af, err, time.Duration(0))
-			}
-		}()
+// handlePacket handles a packet received on a socket.
+func (t *Frontend) handlePacket(socket *net.UDPConn, writer *batchWriter, listener string, p receivedPacket) {
+	addr := p.addr
+	if ip := addr.IP.To4(); ip != nil {
+		addr.IP = ip
+		promRequests.WithLabelValues(listener, "IPv4").Inc()
+	} else {
+		promRequests.WithLabelValues(listener, "IPv6").Inc()
+	}
+
+	// Handle the request.
+	var start time.Time
+	if t.EnableRequestTiming {
+		start = time.Now()
+	}
+	entry := accesslog.Sample("udp")
+	action, af, err := t.handleRequest(
+		// Make sure the IP is copied, not referenced.
+		Request{(*p.buf)[:p.n], append([]byte{}, addr.IP...)},
+		ResponseWriter{socket, addr, writer, entry},
+	)
+	entry.Log(action, err)
+	if t.EnableRequestTiming {
+		recordResponseDuration(action, af, err, time.Since(start))
+	} else {
+		recordResponseDuration(action, af, err, time.Duration(0))
 	}
 }
 
@@ -241,10 +637,20 @@ type Request struct {
 type ResponseWriter struct {
 	socket *net.UDPConn
 	addr   *net.UDPAddr
+	batch  *batchWriter
+
+	// entry is the access log entry of the request, if it is sampled.
+	entry *accesslog.Entry
 }
 
 // Write implements the io.Writer interface for a ResponseWriter.
 func (w ResponseWriter) Write(b []byte) (int, error) {
+	w.entry.AddSize(len(b))
+	if w.batch != nil {
+		w.batch.write(b, w.addr)
+		return len(b), nil
+	}
+
 	_, _ = w.socket.WriteToUDP(b, w.addr)
 	return len(b), nil
 }
@@ -300,18 +706,27 @@ func (t *Frontend) handleRequest(r Request, w ResponseWriter) (actionName string
 	case announceActionID, announceV6ActionID:
 		actionName = "announce"
 
+		ctx, span := tracing.Start(context.Background(), "udp.announce")
+		defer func() {
+			span.SetError(err)
+			span.End()
+		}()
+
 		var req *bittorrent.AnnounceRequest
+		_, parseSpan := tracing.Start(ctx, "udp.ParseAnnounce")
 		req, err = ParseAnnounce(r, actionID == announceV6ActionID, t.ParseOptions)
+		parseSpan.SetError(err)
+		parseSpan.End()
 		if err != nil {
 			WriteError(w, txID, err)
 			return
 		}
 		af = new(bittorrent.AddressFamily)
 		*af = req.IP.AddressFamily
+		w.entry.SetAnnounce(req)
 
-		var ctx context.Context
 		var resp *bittorrent.AnnounceResponse
-		ctx, resp, err = t.logic.HandleAnnounce(context.Background(), req)
+		ctx, resp, err = t.logic.HandleAnnounce(ctx, req)
 		if err != nil {
 			WriteError(w, txID, err)
 			return
@@ -324,8 +739,17 @@ func (t *Frontend) handleRequest(r Request, w ResponseWriter) (actionName string
 	case scrapeActionID:
 		actionName = "scrape"
 
+		ctx, span := tracing.Start(context.Background(), "udp.scrape")
+		defer func() {
+			span.SetError(err)
+			span.End()
+		}()
+
 		var req *bittorrent.ScrapeRequest
+		_, parseSpan := tracing.Start(ctx, "udp.ParseScrape")
 		req, err = ParseScrape(r, t.ParseOptions)
+		parseSpan.SetError(err)
+		parseSpan.End()
 		if err != nil {
 			WriteError(w, txID, err)
 			return
@@ -341,10 +765,10 @@ func (t *Frontend) handleRequest(r Request, w ResponseWriter) (actionName string
 		}
 		af = new(bittorrent.AddressFamily)
 		*af = req.AddressFamily
+		w.entry.SetScrape(req, r.IP)
 
-		var ctx context.Context
 		var resp *bittorrent.ScrapeResponse
-		ctx, resp, err = t.logic.HandleScrape(context.Background(), req)
+		ctx, resp, err = t.logic.HandleScrape(ctx, req)
 		if err != nil {
 			WriteError(w, txID, err)
 			return
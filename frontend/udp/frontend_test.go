@@ -25,3 +25,20 @@ func TestStartStopRaceIssue437(t *testing.T) {
 		t.Fatal(errs[0])
 	}
 }
+
+func TestStartStopBatching(t *testing.T) {
+	ps, err := storage.NewPeerStore("memory", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var responseConfig middleware.ResponseConfig
+	lgc := middleware.NewLogic(responseConfig, ps, nil, nil)
+	fe, err := udp.NewFrontend(lgc, udp.Config{Addr: "127.0.0.1:0", ReadBatchSize: 8, WriteBatchSize: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	errC := fe.Stop()
+	if errs := <-errC; len(errs) != 0 {
+		t.Fatal(errs[0])
+	}
+}
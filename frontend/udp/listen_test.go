@@ -0,0 +1,78 @@
+package udp
+
+import (
+	"net"
+	"testing"
+)
+
+func TestListenPerFamily(t *testing.T) {
+	f := &Frontend{Config: Config{
+		IPv4: FamilyConfig{Addrs: []string{"127.0.0.1:0"}, ReadBufferSize: 1 << 16},
+		IPv6: FamilyConfig{Addrs: []string{"[::1]:0"}, WriteBufferSize: 1 << 16},
+	}}
+	if err := f.listen(); err != nil {
+		if _, v6err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback}); v6err != nil {
+			t.Skip("IPv6 is not available:", v6err)
+		}
+		t.Fatal(err)
+	}
+	defer func() {
+		for _, socket := range f.sockets {
+			socket.Close()
+		}
+	}()
+
+	if len(f.sockets) != 2 {
+		t.Fatalf("expected 2 sockets, got %d", len(f.sockets))
+	}
+	if ip := f.sockets[0].LocalAddr().(*net.UDPAddr).IP; ip.To4() == nil {
+		t.Fatalf("expected an IPv4 socket, got %s", ip)
+	}
+	if ip := f.sockets[1].LocalAddr().(*net.UDPAddr).IP; ip.To4() != nil {
+		t.Fatalf("expected an IPv6 socket, got %s", ip)
+	}
+}
+
+func TestListenFamilyMismatch(t *testing.T) {
+	f := &Frontend{Config: Config{
+		IPv4: FamilyConfig{Addrs: []string{"[::1]:0"}},
+	}}
+	if err := f.listen(); err == nil {
+		for _, socket := range f.sockets {
+			socket.Close()
+		}
+		t.Fatal("expected binding an IPv6 address to an IPv4 socket to fail")
+	}
+}
+
+func TestListenConfigsBufferSizes(t *testing.T) {
+	cfg := Config{
+		Addr:           "127.0.0.1:0",
+		ReadBufferSize: 1 << 20,
+		IPv4:           FamilyConfig{Addrs: []string{"127.0.0.1:0"}, WriteBufferSize: 1 << 16},
+		IPv6:           FamilyConfig{Addrs: []string{"[::1]:0"}, ReadBufferSize: 1 << 18},
+	}
+
+	lcs := cfg.listenConfigs()
+	if len(lcs) != 3 {
+		t.Fatalf("expected 3 listen configs, got %d", len(lcs))
+	}
+	for i, expected := range [][2]int{{1 << 20, 0}, {1 << 20, 1 << 16}, {1 << 18, 0}} {
+		if lcs[i].ReadBufferSize != expected[0] || lcs[i].WriteBufferSize != expected[1] {
+			t.Fatalf("unexpected buffer sizes of %s: %d, %d", lcs[i].addr, lcs[i].ReadBufferSize, lcs[i].WriteBufferSize)
+		}
+	}
+}
+
+func TestValidatePacketBufferSize(t *testing.T) {
+	for provided, expected := range map[int]int{
+		0:       defaultPacketBufferSize,
+		64:      defaultPacketBufferSize,
+		1 << 17: defaultPacketBufferSize,
+		4096:    4096,
+	} {
+		if size := (Config{PacketBufferSize: provided}).Validate().PacketBufferSize; size != expected {
+			t.Fatalf("expected packet buffer size %d for %d, got %d", expected, provided, size)
+		}
+	}
+}
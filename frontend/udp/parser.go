@@ -22,6 +22,10 @@ const (
 )
 
 // Option-Types as described in BEP 41 and BEP 45.
+//
+// Every option other than EndOfOptions and NOP is followed by a length byte
+// and that many bytes of data. This allows skipping options that are not
+// known to this implementation.
 const (
 	optionEndOfOptions byte = 0x0
 	optionNOP          byte = 0x1
@@ -32,39 +36,49 @@ var (
 	// initialConnectionID is the magic initial connection ID specified by BEP 15.
 	initialConnectionID = []byte{0, 0, 0x04, 0x17, 0x27, 0x10, 0x19, 0x80}
 
-	// eventIDs map values described in BEP 15 to Events.
+	// eventIDs map values described in BEP 15 to Events. BEP 21 does not
+	// assign a value to the paused event; 4 is the value used by libtorrent.
 	eventIDs = []bittorrent.Event{
 		bittorrent.None,
 		bittorrent.Completed,
 		bittorrent.Started,
 		bittorrent.Stopped,
+		bittorrent.Paused,
 	}
 
-	errMalformedPacket   = bittorrent.ClientError("malformed packet")
-	errMalformedIP       = bittorrent.ClientError("malformed IP address")
-	errMalformedEvent    = bittorrent.ClientError("malformed event ID")
-	errUnknownAction     = bittorrent.ClientError("unknown action ID")
-	errBadConnectionID   = bittorrent.ClientError("bad connection ID")
-	errUnknownOptionType = bittorrent.ClientError("unknown option type")
+	errMalformedPacket = bittorrent.RegisterClientError("malformed_packet", "malformed packet")
+	errMalformedIP     = bittorrent.RegisterClientError("invalid_ip", "malformed IP address")
+	errMalformedEvent  = bittorrent.RegisterClientError("invalid_event", "malformed event ID")
+	errUnknownAction   = bittorrent.RegisterClientError("unknown_action", "unknown action ID")
+	errBadConnectionID = bittorrent.RegisterClientError("bad_connection_id", "bad connection ID")
 )
 
 // ParseOptions is the configuration used to parse an Announce Request.
 //
 // If AllowIPSpoofing is true, IPs provided via params will be used.
+// IPPolicy determines how announces from unroutable IPs are handled. When
+// rewriting, IPs provided via params are replaced by the source address of the
+// packet.
 type ParseOptions struct {
 	AllowIPSpoofing     bool   `yaml:"allow_ip_spoofing"`
 	MaxNumWant          uint32 `yaml:"max_numwant"`
 	DefaultNumWant      uint32 `yaml:"default_numwant"`
 	MaxScrapeInfoHashes uint32 `yaml:"max_scrape_infohashes"`
+
+	IPPolicy *bittorrent.IPPolicy `yaml:"ip_policy"`
 }
 
 // Default parser config constants.
 const (
 	defaultMaxNumWant          = 100
 	defaultDefaultNumWant      = 50
-	defaultMaxScrapeInfoHashes = 50
+	defaultMaxScrapeInfoHashes = MaxScrapeInfoHashes
 )
 
+// MaxScrapeInfoHashes is the maximum number of infohashes of a scrape, as
+// specified in BEP 15: more don't fit in a packet of a typical MTU.
+const MaxScrapeInfoHashes = 74
+
 // ParseAnnounce parses an AnnounceRequest from a UDP request.
 //
 // If v6Action is true, the announce is parsed the
@@ -95,8 +109,10 @@ func ParseAnnounce(r Request, v6Action bool, opts ParseOptions) (*bittorrent.Ann
 	ipProvided := false
 	ipbytes := r.Packet[84:ipEnd]
 	if opts.AllowIPSpoofing {
-		// Make sure the bytes are copied to a new slice.
-		copy(ip, net.IP(ipbytes))
+		// Make sure the bytes are copied to a new slice, the source address
+		// is still needed for the IP policy.
+		ip = make(net.IP, len(ipbytes))
+		copy(ip, ipbytes)
 		ipProvided = true
 	}
 	if !opts.AllowIPSpoofing && r.IP == nil {
@@ -112,7 +128,8 @@ func ParseAnnounce(r Request, v6Action bool, opts ParseOptions) (*bittorrent.Ann
 		return nil, err
 	}
 
-	request := &bittorrent.AnnounceRequest{
+	request := bittorrent.NewAnnounceRequest()
+	*request = bittorrent.AnnounceRequest{
 		Event:           eventIDs[eventID],
 		InfoHash:        bittorrent.InfoHashFromBytes(infohash),
 		NumWant:         numWant,
@@ -134,6 +151,10 @@ func ParseAnnounce(r Request, v6Action bool, opts ParseOptions) (*bittorrent.Ann
 		return nil, err
 	}
 
+	if err := opts.IPPolicy.Apply(request, r.IP); err != nil {
+		return nil, err
+	}
+
 	return request, nil
 }
 
@@ -156,9 +177,17 @@ func (b *buffer) free() {
 
 // handleOptionalParameters parses the optional parameters as described in BEP
 // 41 and updates an announce with the values parsed.
+//
+// The data of all URLData options is concatenated and parsed as the path and
+// query of the request, which hooks can access via the RawPath and RawQuery
+// methods of the returned Params.
+// The returned Params are pooled and released along with the announce.
+// NOP options can be used as padding and are skipped, as are options of
+// unknown types. Parsing stops at an EndOfOptions option, ignoring any bytes
+// after it.
 func handleOptionalParameters(packet []byte) (bittorrent.Params, error) {
 	if len(packet) == 0 {
-		return bittorrent.ParseURLData("")
+		return bittorrent.ParsePooledURLData("")
 	}
 
 	buf := newBuffer()
@@ -168,10 +197,10 @@ func handleOptionalParameters(packet []byte) (bittorrent.Params, error) {
 		option := packet[i]
 		switch option {
 		case optionEndOfOptions:
-			return bittorrent.ParseURLData(buf.String())
+			return bittorrent.ParsePooledURLData(buf.String())
 		case optionNOP:
 			i++
-		case optionURLData:
+		default:
 			if i+1 >= len(packet) {
 				return nil, errMalformedPacket
 			}
@@ -181,21 +210,21 @@ func handleOptionalParameters(packet []byte) (bittorrent.Params, error) {
 				return nil, errMalformedPacket
 			}
 
-			n, err := buf.Write(packet[i+2 : i+2+length])
-			if err != nil {
-				return nil, err
-			}
-			if n != length {
-				return nil, fmt.Errorf("expected to write %d bytes, wrote %d", length, n)
+			if option == optionURLData {
+				n, err := buf.Write(packet[i+2 : i+2+length])
+				if err != nil {
+					return nil, err
+				}
+				if n != length {
+					return nil, fmt.Errorf("expected to write %d bytes, wrote %d", length, n)
+				}
 			}
 
 			i += 2 + length
-		default:
-			return nil, errUnknownOptionType
 		}
 	}
 
-	return bittorrent.ParseURLData(buf.String())
+	return bittorrent.ParsePooledURLData(buf.String())
 }
 
 // ParseScrape parses a ScrapeRequest from a UDP request.
@@ -213,7 +242,7 @@ func ParseScrape(r Request, opts ParseOptions) (*bittorrent.ScrapeRequest, error
 	}
 
 	// Allocate a list of infohashes and append it to the list until we're out.
-	var infohashes []bittorrent.InfoHash
+	infohashes := make([]bittorrent.InfoHash, 0, len(r.Packet)/20)
 	for len(r.Packet) >= 20 {
 		infohashes = append(infohashes, bittorrent.InfoHashFromBytes(r.Packet[:20]))
 		r.Packet = r.Packet[20:]
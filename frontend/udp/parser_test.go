@@ -1,51 +1,106 @@
 package udp
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
 )
 
 var table = []struct {
 	data   []byte
 	values map[string]string
+	path   string
 	err    error
 }{
 	{
 		[]byte{0x2, 0x5, '/', '?', 'a', '=', 'b'},
 		map[string]string{"a": "b"},
+		"/",
 		nil,
 	},
 	{
 		[]byte{0x2, 0x0},
 		map[string]string{},
+		"",
 		nil,
 	},
 	{
 		[]byte{0x2, 0x1},
 		nil,
+		"",
 		errMalformedPacket,
 	},
 	{
 		[]byte{0x2},
 		nil,
+		"",
 		errMalformedPacket,
 	},
 	{
 		[]byte{0x2, 0x8, '/', 'c', '/', 'd', '?', 'a', '=', 'b'},
 		map[string]string{"a": "b"},
+		"/c/d",
 		nil,
 	},
 	{
 		[]byte{0x2, 0x2, '/', '?', 0x2, 0x3, 'a', '=', 'b'},
 		map[string]string{"a": "b"},
+		"/",
 		nil,
 	},
 	{
 		[]byte{0x2, 0x9, '/', '?', 'a', '=', 'b', '%', '2', '0', 'c'},
 		map[string]string{"a": "b c"},
+		"/",
+		nil,
+	},
+	{
+		[]byte{0x2, 0x3, '/', 'c', '/', 0x2, 0x4, 'd', '?', 'a', '=', 0x2, 0x1, 'b'},
+		map[string]string{"a": "b"},
+		"/c/d",
+		nil,
+	},
+	{
+		[]byte{0x1, 0x1, 0x2, 0x5, '/', '?', 'a', '=', 'b', 0x1},
+		map[string]string{"a": "b"},
+		"/",
+		nil,
+	},
+	{
+		[]byte{0x2, 0x5, '/', '?', 'a', '=', 'b', 0x0, 0x2, 0x5, '/', '?', 'c', '=', 'd'},
+		map[string]string{"a": "b"},
+		"/",
+		nil,
+	},
+	{
+		[]byte{0x2, 0x5, '/', '?', 'a', '=', 'b', 0x0, 0xff, 0xff},
+		map[string]string{"a": "b"},
+		"/",
+		nil,
+	},
+	{
+		[]byte{0x7, 0x2, 0xff, 0xff, 0x2, 0x5, '/', '?', 'a', '=', 'b'},
+		map[string]string{"a": "b"},
+		"/",
 		nil,
 	},
+	{
+		[]byte{0x2, 0x5, '/', '?', 'a', '=', 'b', 0x7, 0x3, 0xff},
+		nil,
+		"",
+		errMalformedPacket,
+	},
+	{
+		[]byte{0x7},
+		nil,
+		"",
+		errMalformedPacket,
+	},
 }
 
 func TestHandleOptionalParameters(t *testing.T) {
@@ -70,8 +125,58 @@ func TestHandleOptionalParameters(t *testing.T) {
 							t.Fatalf("expected param %s=%s, but was %s for data %x", key, want, got, tt.data)
 						}
 					}
+					if got := params.RawPath(); got != tt.path {
+						t.Fatalf("expected path %s, but was %s for data %x", tt.path, got, tt.data)
+					}
 				}
 			}
 		})
 	}
 }
+
+func TestParseScrape(t *testing.T) {
+	opts := ParseOptions{MaxScrapeInfoHashes: MaxScrapeInfoHashes}
+	scrape := func(n int) []byte {
+		packet := make([]byte, 16, 16+20*n)
+		for i := 0; i < n; i++ {
+			ih := bittorrent.InfoHash{byte(i)}
+			packet = append(packet, ih[:]...)
+		}
+		return packet
+	}
+
+	req, err := ParseScrape(Request{Packet: scrape(MaxScrapeInfoHashes)}, opts)
+	require.Nil(t, err)
+	require.Len(t, req.InfoHashes, MaxScrapeInfoHashes)
+	for i, ih := range req.InfoHashes {
+		require.Equal(t, bittorrent.InfoHash{byte(i)}, ih)
+	}
+
+	// Additional infohashes are ignored.
+	req, err = ParseScrape(Request{Packet: scrape(MaxScrapeInfoHashes + 1)}, opts)
+	require.Nil(t, err)
+	require.Len(t, req.InfoHashes, MaxScrapeInfoHashes)
+
+	_, err = ParseScrape(Request{Packet: scrape(1)[:30]}, opts)
+	require.Equal(t, errMalformedPacket, err)
+	_, err = ParseScrape(Request{Packet: scrape(2)[:50]}, opts)
+	require.Equal(t, errMalformedPacket, err)
+}
+
+func TestWriteScrape(t *testing.T) {
+	resp := &bittorrent.ScrapeResponse{}
+	for i := 0; i < MaxScrapeInfoHashes; i++ {
+		resp.Files = append(resp.Files, bittorrent.Scrape{Complete: uint32(i), Snatches: 1, Incomplete: 2})
+	}
+
+	var buf bytes.Buffer
+	WriteScrape(&buf, []byte{1, 2, 3, 4}, resp)
+
+	// The scrapes are written in the order of the infohashes after the
+	// action and transaction ID.
+	b := buf.Bytes()
+	require.Len(t, b, 8+12*MaxScrapeInfoHashes)
+	require.Equal(t, []byte{0, 0, 0, 2, 1, 2, 3, 4}, b[:8])
+	last := b[8+12*(MaxScrapeInfoHashes-1):]
+	require.Equal(t, []byte{0, 0, 0, MaxScrapeInfoHashes - 1, 0, 0, 0, 1, 0, 0, 0, 2}, last)
+}
@@ -0,0 +1,43 @@
+package udp
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProcessingWorkers(t *testing.T) {
+	// Connects are answered without the tracker logic.
+	fe, err := NewFrontend(nil, Config{Addr: "127.0.0.1:0", ProcessingWorkers: 2, PacketBufferSize: 512})
+	require.Nil(t, err)
+	defer func() {
+		errs := <-fe.Stop()
+		require.Empty(t, errs)
+	}()
+
+	conn, err := net.DialUDP("udp", nil, fe.sockets[0].LocalAddr().(*net.UDPAddr))
+	require.Nil(t, err)
+	defer conn.Close()
+
+	// A connect request, as described in BEP 15.
+	txID := []byte{1, 2, 3, 4}
+	packet := make([]byte, 16)
+	binary.BigEndian.PutUint64(packet, 0x41727101980)
+	copy(packet[12:], txID)
+	for i := 0; i < 4; i++ {
+		_, err = conn.Write(packet)
+		require.Nil(t, err)
+	}
+
+	require.Nil(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	resp := make([]byte, 64)
+	for i := 0; i < 4; i++ {
+		n, err := conn.Read(resp)
+		require.Nil(t, err)
+		require.Equal(t, 16, n)
+		require.Equal(t, txID, resp[4:8])
+	}
+}
@@ -7,24 +7,54 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 
 	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/frontend"
 )
 
 func init() {
-	prometheus.MustRegister(promResponseDurationMilliseconds)
+	prometheus.MustRegister(promResponseDurationMilliseconds, promRequests, promBatchSize, promDroppedPackets)
 }
 
-var promResponseDurationMilliseconds = prometheus.NewHistogramVec(
-	prometheus.HistogramOpts{
-		Name:    "chihaya_udp_response_duration_milliseconds",
-		Help:    "The duration of time it takes to receive and write a response to an API request",
-		Buckets: prometheus.ExponentialBuckets(9.375, 2, 10),
-	},
-	[]string{"action", "address_family", "error"},
+var (
+	promResponseDurationMilliseconds = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "chihaya_udp_response_duration_milliseconds",
+			Help:    "The duration of time it takes to receive and write a response to an API request",
+			Buckets: prometheus.ExponentialBuckets(9.375, 2, 10),
+		},
+		[]string{"action", "address_family", "error"},
+	)
+
+	promRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "chihaya_udp_requests_total",
+			Help: "The number of UDP packets received, by listener and address family",
+		},
+		[]string{"addr", "address_family"},
+	)
+
+	promBatchSize = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "chihaya_udp_batch_size",
+			Help:    "The number of packets read or written with a single syscall",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 8),
+		},
+		[]string{"direction"},
+	)
+
+	promDroppedPackets = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "chihaya_udp_dropped_packets_total",
+			Help: "The number of UDP packets dropped by the kernel because the receive buffer of a socket was full, by listener",
+		},
+		[]string{"addr"},
+	)
 )
 
 // recordResponseDuration records the duration of time to respond to a UDP
-// Request in milliseconds.
+// Request in milliseconds, and the reason of its error, if any.
 func recordResponseDuration(action string, af *bittorrent.AddressFamily, err error, duration time.Duration) {
+	frontend.RecordError("udp", action, err)
+
 	var errString string
 	if err != nil {
 		var clientErr bittorrent.ClientError
@@ -0,0 +1,29 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package udp
+
+import (
+	"testing"
+)
+
+func TestListenReusePort(t *testing.T) {
+	f := &Frontend{Config: Config{Addr: "127.0.0.1:0", Workers: 4}}
+	if err := f.listen(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		for _, socket := range f.sockets {
+			socket.Close()
+		}
+	}()
+
+	if len(f.sockets) != 4 {
+		t.Fatalf("expected 4 sockets, got %d", len(f.sockets))
+	}
+	for _, socket := range f.sockets[1:] {
+		if socket.LocalAddr().String() != f.sockets[0].LocalAddr().String() {
+			t.Fatalf("expected all sockets to be bound to %s, got %s", f.sockets[0].LocalAddr(), socket.LocalAddr())
+		}
+	}
+}
@@ -0,0 +1,706 @@
+// Package websocket implements a BitTorrent frontend via the WebTorrent
+// tracker protocol, which exchanges JSON messages over WebSockets.
+//
+// Browser peers cannot accept incoming connections, so instead of returning
+// the addresses of other peers, the tracker relays WebRTC offers and answers
+// between the peers of a swarm.
+package websocket
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/julienschmidt/httprouter"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/frontend"
+	"github.com/chihaya/chihaya/pkg/accesslog"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/pkg/stop"
+	"github.com/chihaya/chihaya/pkg/tracing"
+)
+
+// Config represents all of the configurable options for a WebSocket
+// BitTorrent Frontend.
+type Config struct {
+	Addr                string        `yaml:"addr"`
+	WriteTimeout        time.Duration `yaml:"write_timeout"`
+	PingInterval        time.Duration `yaml:"ping_interval"`
+	MaxMessageSize      int64         `yaml:"max_message_size"`
+	TLSCertPath         string        `yaml:"tls_cert_path"`
+	TLSKeyPath          string        `yaml:"tls_key_path"`
+	Routes              []string      `yaml:"routes"`
+	EnableRequestTiming bool          `yaml:"enable_request_timing"`
+	ParseOptions        `yaml:",inline"`
+}
+
+// LogFields renders the current config as a set of Logrus fields.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"addr":                cfg.Addr,
+		"writeTimeout":        cfg.WriteTimeout,
+		"pingInterval":        cfg.PingInterval,
+		"maxMessageSize":      cfg.MaxMessageSize,
+		"tlsCertPath":         cfg.TLSCertPath,
+		"tlsKeyPath":          cfg.TLSKeyPath,
+		"routes":              cfg.Routes,
+		"enableRequestTiming": cfg.EnableRequestTiming,
+		"realIPHeader":        cfg.RealIPHeader,
+		"trustedProxies":      cfg.TrustedProxies,
+		"maxNumWant":          cfg.MaxNumWant,
+		"defaultNumWant":      cfg.DefaultNumWant,
+		"maxScrapeInfoHashes": cfg.MaxScrapeInfoHashes,
+	}
+}
+
+// Default config constants.
+const (
+	defaultWriteTimeout   = 5 * time.Second
+	defaultPingInterval   = 30 * time.Second
+	defaultMaxMessageSize = 64 * 1024
+)
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+//
+// This function warns to the logger when a value is changed.
+func (cfg Config) Validate() Config {
+	validcfg := cfg
+
+	if cfg.WriteTimeout <= 0 {
+		validcfg.WriteTimeout = defaultWriteTimeout
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     "websocket.WriteTimeout",
+			"provided": cfg.WriteTimeout,
+			"default":  validcfg.WriteTimeout,
+		})
+	}
+
+	if cfg.PingInterval <= 0 {
+		validcfg.PingInterval = defaultPingInterval
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     "websocket.PingInterval",
+			"provided": cfg.PingInterval,
+			"default":  validcfg.PingInterval,
+		})
+	}
+
+	if cfg.MaxMessageSize <= 0 {
+		validcfg.MaxMessageSize = defaultMaxMessageSize
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     "websocket.MaxMessageSize",
+			"provided": cfg.MaxMessageSize,
+			"default":  validcfg.MaxMessageSize,
+		})
+	}
+
+	if cfg.MaxNumWant <= 0 {
+		validcfg.MaxNumWant = defaultMaxNumWant
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     "websocket.MaxNumWant",
+			"provided": cfg.MaxNumWant,
+			"default":  validcfg.MaxNumWant,
+		})
+	}
+
+	if cfg.DefaultNumWant <= 0 {
+		validcfg.DefaultNumWant = defaultDefaultNumWant
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     "websocket.DefaultNumWant",
+			"provided": cfg.DefaultNumWant,
+			"default":  validcfg.DefaultNumWant,
+		})
+	}
+
+	if cfg.MaxScrapeInfoHashes <= 0 {
+		validcfg.MaxScrapeInfoHashes = defaultMaxScrapeInfoHashes
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     "websocket.MaxScrapeInfoHashes",
+			"provided": cfg.MaxScrapeInfoHashes,
+			"default":  validcfg.MaxScrapeInfoHashes,
+		})
+	}
+
+	return validcfg
+}
+
+// conn is a WebSocket connection of a WebTorrent client.
+type conn struct {
+	ws          *websocket.Conn
+	writeM      sync.Mutex
+	ip          net.IP
+	port        uint16
+	params      bittorrent.Params
+	routeParams httprouter.Params
+
+	// peerIDs are the IDs the client announced with on this connection.
+	// Guarded by the Frontend's peersM.
+	peerIDs map[bittorrent.PeerID]struct{}
+
+	writeTimeout time.Duration
+}
+
+// WriteJSON implements the JSONWriter interface for a conn.
+// It is safe to call concurrently.
+func (c *conn) WriteJSON(v interface{}) error {
+	c.writeM.Lock()
+	defer c.writeM.Unlock()
+
+	_ = c.ws.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	return c.ws.WriteJSON(v)
+}
+
+// writeMessage writes an encoded message. It is safe to call concurrently.
+func (c *conn) writeMessage(data []byte) error {
+	c.writeM.Lock()
+	defer c.writeM.Unlock()
+
+	_ = c.ws.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	return c.ws.WriteMessage(websocket.TextMessage, data)
+}
+
+// sizedWriter writes messages to a conn and records their size in an access
+// log entry.
+type sizedWriter struct {
+	c     *conn
+	entry *accesslog.Entry
+}
+
+// WriteJSON implements the JSONWriter interface for a sizedWriter.
+func (w sizedWriter) WriteJSON(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	w.entry.AddSize(len(data))
+	return w.c.writeMessage(data)
+}
+
+func (c *conn) ping() error {
+	return c.ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(c.writeTimeout))
+}
+
+// Frontend represents the state of a WebSocket BitTorrent Frontend.
+type Frontend struct {
+	srv      *http.Server
+	tlsCfg   *tls.Config
+	keypair  *frontend.KeypairReloader
+	upgrader websocket.Upgrader
+	closing  chan struct{}
+	wg       sync.WaitGroup
+
+	peersM sync.RWMutex
+	peers  map[bittorrent.PeerID]*conn
+	conns  map[*conn]struct{}
+
+	logic frontend.TrackerLogic
+	Config
+}
+
+// NewFrontend creates a new instance of a WebSocket Frontend that
+// asynchronously serves requests.
+func NewFrontend(logic frontend.TrackerLogic, provided Config) (*Frontend, error) {
+	cfg := provided.Validate()
+
+	f := &Frontend{
+		closing: make(chan struct{}),
+		peers:   make(map[bittorrent.PeerID]*conn),
+		conns:   make(map[*conn]struct{}),
+		logic:   logic,
+		Config:  cfg,
+		upgrader: websocket.Upgrader{
+			// Browser peers connect from arbitrary origins.
+			CheckOrigin: func(r *http.Request) bool { return true },
+		},
+	}
+
+	if cfg.Addr == "" {
+		return nil, errors.New("must specify addr")
+	}
+
+	if len(cfg.Routes) < 1 {
+		return nil, errors.New("must specify routes")
+	}
+
+	var err error
+	if f.trustedProxies, err = frontend.ParseTrustedProxies(cfg.TrustedProxies); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.IPPolicy.Init(); err != nil {
+		return nil, err
+	}
+
+	// If TLS is enabled, load the key pair.
+	if cfg.TLSCertPath != "" && cfg.TLSKeyPath != "" {
+		f.keypair, err = frontend.NewKeypairReloader(cfg.TLSCertPath, cfg.TLSKeyPath)
+		if err != nil {
+			return nil, err
+		}
+		f.tlsCfg = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: f.keypair.GetCertificate,
+		}
+	}
+
+	l, err := net.Listen("tcp", cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	f.srv = &http.Server{
+		Addr:              cfg.Addr,
+		TLSConfig:         f.tlsCfg,
+		Handler:           f.handler(),
+		ReadHeaderTimeout: cfg.WriteTimeout,
+	}
+
+	go func() {
+		if err := f.serve(l); err != nil {
+			log.Fatal("failed while serving websocket", log.Err(err))
+		}
+	}()
+
+	return f, nil
+}
+
+// Stop provides a thread-safe way to shutdown a currently running Frontend.
+func (f *Frontend) Stop() stop.Result {
+	select {
+	case <-f.closing:
+		return stop.AlreadyStopped
+	default:
+	}
+
+	c := make(stop.Channel)
+	go func() {
+		close(f.closing)
+		err := f.srv.Shutdown(context.Background())
+
+		// Hijacked connections are not closed by Shutdown.
+		f.peersM.Lock()
+		for conn := range f.conns {
+			_ = conn.ws.Close()
+		}
+		f.peersM.Unlock()
+
+		f.wg.Wait()
+		c.Done(err)
+	}()
+
+	return c.Result()
+}
+
+// ReloadCertificate reloads the TLS certificate and key from the configured
+// paths without interrupting the server.
+//
+// Connections established after a successful reload use the new certificate.
+// If reloading fails, the previous certificate remains in use.
+func (f *Frontend) ReloadCertificate() error {
+	if f.keypair == nil {
+		return nil
+	}
+
+	return f.keypair.Reload()
+}
+
+func (f *Frontend) handler() http.Handler {
+	router := httprouter.New()
+	for _, route := range f.Routes {
+		router.GET(route, f.connectRoute)
+	}
+	return router
+}
+
+// serve blocks while listening and serving WebSocket connections until Stop()
+// is called or an error is returned.
+func (f *Frontend) serve(l net.Listener) error {
+	var err error
+	if f.tlsCfg != nil {
+		err = f.srv.ServeTLS(l, "", "")
+	} else {
+		err = f.srv.Serve(l)
+	}
+
+	if !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// connectRoute upgrades a request to a WebSocket connection and serves
+// messages on it until it is closed.
+func (f *Frontend) connectRoute(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ip, port, err := f.remoteAddr(r)
+	if err != nil {
+		log.Error("websocket: unable to determine remote address", log.Err(err))
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	params, err := bittorrent.ParseURLData(r.RequestURI)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ws, err := f.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader already replied to the client.
+		log.Debug("websocket: failed to upgrade connection", log.Err(err))
+		return
+	}
+
+	c := &conn{
+		ws:           ws,
+		ip:           ip,
+		port:         port,
+		params:       params,
+		routeParams:  ps,
+		peerIDs:      make(map[bittorrent.PeerID]struct{}),
+		writeTimeout: f.WriteTimeout,
+	}
+
+	f.peersM.Lock()
+	select {
+	case <-f.closing:
+		f.peersM.Unlock()
+		_ = ws.Close()
+		return
+	default:
+	}
+	f.conns[c] = struct{}{}
+	f.wg.Add(1)
+	f.peersM.Unlock()
+	promConnectionsCount.Inc()
+
+	defer func() {
+		f.removeConn(c)
+		_ = ws.Close()
+		promConnectionsCount.Dec()
+		f.wg.Done()
+	}()
+
+	f.serveConn(c)
+}
+
+// remoteAddr determines the IP and port of the client of a request.
+// The IP is forwarded by trusted proxies, the port is the one of the
+// connection.
+func (f *Frontend) remoteAddr(r *http.Request) (net.IP, uint16, error) {
+	_, portStr, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil, 0, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ip := f.trustedProxies.ClientIP(r, f.RealIPHeader)
+	if ip == nil {
+		return nil, 0, fmt.Errorf("invalid remote address: %q", r.RemoteAddr)
+	}
+	return ip, uint16(port), nil
+}
+
+// serveConn blocks while reading and handling messages from a connection
+// until the connection is closed or broken.
+func (f *Frontend) serveConn(c *conn) {
+	c.ws.SetReadLimit(f.MaxMessageSize)
+	_ = c.ws.SetReadDeadline(time.Now().Add(2 * f.PingInterval))
+	c.ws.SetPongHandler(func(string) error {
+		return c.ws.SetReadDeadline(time.Now().Add(2 * f.PingInterval))
+	})
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		t := time.NewTicker(f.PingInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+				if err := c.ping(); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	for {
+		_, data, err := c.ws.ReadMessage()
+		if err != nil {
+			log.Debug("websocket: connection closed", log.Err(err))
+			return
+		}
+		_ = c.ws.SetReadDeadline(time.Now().Add(2 * f.PingInterval))
+
+		var m Message
+		if err := json.Unmarshal(data, &m); err != nil {
+			_ = WriteError(c, "", nil, errMalformedMessage)
+			recordResponseDuration("unknown", nil, errMalformedMessage, time.Duration(0))
+			continue
+		}
+
+		var start time.Time
+		if f.EnableRequestTiming {
+			start = time.Now()
+		}
+		entry := accesslog.Sample("websocket")
+		var w JSONWriter = c
+		if entry != nil {
+			w = sizedWriter{c, entry}
+		}
+		action, af, err := f.handleMessage(c, w, &m, entry)
+		if err != nil {
+			_ = WriteError(w, m.Action, m.InfoHash, err)
+		}
+		entry.Log(action, err)
+		if f.EnableRequestTiming {
+			recordResponseDuration(action, af, err, time.Since(start))
+		} else {
+			recordResponseDuration(action, af, err, time.Duration(0))
+		}
+	}
+}
+
+// registerPeer associates a PeerID with a connection, so that offers and
+// answers can be relayed to it.
+//
+// A PeerID belongs to the first connection that announced with it until that
+// connection is closed, so that other clients cannot take over its offers
+// and answers.
+func (f *Frontend) registerPeer(c *conn, id bittorrent.PeerID) error {
+	f.peersM.Lock()
+	defer f.peersM.Unlock()
+
+	if owner, ok := f.peers[id]; ok && owner != c {
+		return errPeerIDInUse
+	}
+	f.peers[id] = c
+	c.peerIDs[id] = struct{}{}
+	return nil
+}
+
+// ownsPeer returns whether a PeerID was registered by a connection.
+func (f *Frontend) ownsPeer(c *conn, id bittorrent.PeerID) bool {
+	f.peersM.RLock()
+	defer f.peersM.RUnlock()
+
+	_, ok := c.peerIDs[id]
+	return ok
+}
+
+// removeConn removes a connection and all PeerIDs associated with it.
+func (f *Frontend) removeConn(c *conn) {
+	f.peersM.Lock()
+	defer f.peersM.Unlock()
+
+	for id := range c.peerIDs {
+		if f.peers[id] == c {
+			delete(f.peers, id)
+		}
+	}
+	delete(f.conns, c)
+}
+
+func (f *Frontend) lookupPeer(id bittorrent.PeerID) *conn {
+	f.peersM.RLock()
+	defer f.peersM.RUnlock()
+
+	return f.peers[id]
+}
+
+func injectRouteParamsToContext(ctx context.Context, ps httprouter.Params) context.Context {
+	rp := bittorrent.RouteParams{}
+	for _, p := range ps {
+		rp = append(rp, bittorrent.RouteParam{Key: p.Key, Value: p.Value})
+	}
+	return context.WithValue(ctx, bittorrent.RouteParamsKey, rp)
+}
+
+// requestContext returns the context of a request received on a connection,
+// which holds the route parameters of the connection and marks the request as
+// one of a WebTorrent peer.
+func requestContext(c *conn) context.Context {
+	ctx := context.WithValue(context.Background(), frontend.WebTorrentKey, struct{}{})
+	return injectRouteParamsToContext(ctx, c.routeParams)
+}
+
+// handleMessage handles a single message received on a connection and writes
+// the response to w.
+func (f *Frontend) handleMessage(c *conn, w JSONWriter, m *Message, entry *accesslog.Entry) (actionName string, af *bittorrent.AddressFamily, err error) {
+	switch m.Action {
+	case "announce":
+		actionName = "announce"
+		if len(m.Answer) > 0 {
+			actionName = "answer"
+			err = f.relayAnswer(c, m)
+			return
+		}
+
+		ctx, span := tracing.Start(requestContext(c), "websocket.announce")
+		defer func() {
+			span.SetError(err)
+			span.End()
+		}()
+
+		var req *bittorrent.AnnounceRequest
+		_, parseSpan := tracing.Start(ctx, "websocket.ParseAnnounce")
+		req, err = ParseAnnounce(m, c.ip, c.port, c.params, f.ParseOptions)
+		parseSpan.SetError(err)
+		parseSpan.End()
+		if err != nil {
+			return
+		}
+		af = new(bittorrent.AddressFamily)
+		*af = req.IP.AddressFamily
+		entry.SetAnnounce(req)
+
+		if err = f.registerPeer(c, req.Peer.ID); err != nil {
+			return
+		}
+
+		var resp *bittorrent.AnnounceResponse
+		ctx, resp, err = f.logic.HandleAnnounce(ctx, req)
+		if err != nil {
+			return
+		}
+
+		if err = WriteAnnounceResponse(w, req, resp); err != nil {
+			return
+		}
+		f.relayOffers(req, resp, m.Offers)
+
+		go f.logic.AfterAnnounce(ctx, req, resp)
+
+	case "scrape":
+		actionName = "scrape"
+
+		ctx, span := tracing.Start(requestContext(c), "websocket.scrape")
+		defer func() {
+			span.SetError(err)
+			span.End()
+		}()
+
+		var req *bittorrent.ScrapeRequest
+		_, parseSpan := tracing.Start(ctx, "websocket.ParseScrape")
+		req, err = ParseScrape(m, c.params, f.ParseOptions)
+		parseSpan.SetError(err)
+		parseSpan.End()
+		if err != nil {
+			return
+		}
+
+		if c.ip.To4() != nil {
+			req.AddressFamily = bittorrent.IPv4
+		} else if len(c.ip) == net.IPv6len { // implies c.ip.To4() == nil
+			req.AddressFamily = bittorrent.IPv6
+		} else {
+			log.Error("websocket: invalid IP: neither v4 nor v6", log.Fields{"IP": c.ip})
+			err = bittorrent.ErrInvalidIP
+			return
+		}
+		af = new(bittorrent.AddressFamily)
+		*af = req.AddressFamily
+		entry.SetScrape(req, c.ip)
+
+		var resp *bittorrent.ScrapeResponse
+		ctx, resp, err = f.logic.HandleScrape(ctx, req)
+		if err != nil {
+			return
+		}
+
+		if err = WriteScrapeResponse(w, resp); err != nil {
+			return
+		}
+
+		go f.logic.AfterScrape(ctx, req, resp)
+
+	default:
+		actionName = "unknown"
+		err = errUnknownAction
+	}
+
+	return
+}
+
+// relayOffers sends the offers of an announcing peer to the peers returned by
+// the TrackerLogic, one offer per peer.
+func (f *Frontend) relayOffers(req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse, offers []Offer) {
+	peers := resp.IPv4Peers
+	if req.IP.AddressFamily == bittorrent.IPv6 {
+		peers = resp.IPv6Peers
+	}
+
+	for _, peer := range peers {
+		if len(offers) == 0 {
+			return
+		}
+		if peer.ID == req.Peer.ID {
+			continue
+		}
+
+		target := f.lookupPeer(peer.ID)
+		if target == nil {
+			// The peer is not connected to this instance.
+			continue
+		}
+
+		if err := WriteOffer(target, req.InfoHash, req.Peer.ID, offers[0]); err != nil {
+			log.Debug("websocket: failed to relay offer", log.Err(err))
+			continue
+		}
+		offers = offers[1:]
+	}
+}
+
+// relayAnswer forwards a WebRTC answer received on a connection to the peer
+// that sent the corresponding offer.
+// Answers are only relayed from PeerIDs registered by the connection.
+func (f *Frontend) relayAnswer(c *conn, m *Message) error {
+	var ihStr string
+	if err := json.Unmarshal(m.InfoHash, &ihStr); err != nil {
+		return errInvalidInfoHash
+	}
+	infoHash, err := parseInfoHash(ihStr)
+	if err != nil {
+		return err
+	}
+
+	from, err := parsePeerID(m.PeerID, errInvalidPeerID)
+	if err != nil {
+		return err
+	}
+	if !f.ownsPeer(c, from) {
+		return errPeerIDNotOwned
+	}
+
+	to, err := parsePeerID(m.ToPeerID, errInvalidToPeerID)
+	if err != nil {
+		return err
+	}
+
+	if m.OfferID == "" {
+		return errMissingOfferID
+	}
+
+	target := f.lookupPeer(to)
+	if target == nil {
+		return errPeerNotConnected
+	}
+
+	return WriteAnswer(target, infoHash, from, m.Answer, m.OfferID)
+}
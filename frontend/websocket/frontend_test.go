@@ -0,0 +1,84 @@
+package websocket
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/frontend"
+)
+
+func newTestConn() *conn {
+	return &conn{peerIDs: make(map[bittorrent.PeerID]struct{})}
+}
+
+func TestRegisterPeer(t *testing.T) {
+	f := &Frontend{peers: make(map[bittorrent.PeerID]*conn), conns: make(map[*conn]struct{})}
+	owner, other := newTestConn(), newTestConn()
+	id := bittorrent.PeerIDFromString(strings.Repeat("a", 20))
+
+	require.Nil(t, f.registerPeer(owner, id))
+	require.Nil(t, f.registerPeer(owner, id))
+
+	// Other connections cannot take over the PeerID while it is in use.
+	require.Equal(t, errPeerIDInUse, f.registerPeer(other, id))
+	require.True(t, f.lookupPeer(id) == owner)
+
+	// Once the owner is gone, the PeerID can be registered again.
+	f.removeConn(owner)
+	require.Nil(t, f.lookupPeer(id))
+	require.Nil(t, f.registerPeer(other, id))
+	require.True(t, f.lookupPeer(id) == other)
+}
+
+func TestRelayAnswerFromOwnPeerID(t *testing.T) {
+	f := &Frontend{peers: make(map[bittorrent.PeerID]*conn), conns: make(map[*conn]struct{})}
+	sender, target := newTestConn(), newTestConn()
+	from := strings.Repeat("a", 20)
+	to := strings.Repeat("b", 20)
+	require.Nil(t, f.registerPeer(target, bittorrent.PeerIDFromString(to)))
+
+	ih, err := json.Marshal(strings.Repeat("c", 20))
+	require.Nil(t, err)
+	m := &Message{
+		Action:   "announce",
+		InfoHash: ih,
+		PeerID:   from,
+		ToPeerID: to,
+		OfferID:  "offer",
+		Answer:   json.RawMessage(`{}`),
+	}
+
+	// Answers cannot be sent on behalf of PeerIDs of other connections.
+	require.Equal(t, errPeerIDNotOwned, f.relayAnswer(sender, m))
+	m.PeerID = to
+	require.Equal(t, errPeerIDNotOwned, f.relayAnswer(sender, m))
+}
+
+func TestRemoteAddr(t *testing.T) {
+	trusted, err := frontend.ParseTrustedProxies([]string{"10.0.0.0/8"})
+	require.Nil(t, err)
+	f := &Frontend{}
+	f.trustedProxies = trusted
+
+	header := http.Header{"X-Forwarded-For": {"203.0.113.7"}}
+
+	// Forwarding headers of trusted proxies are used.
+	ip, port, err := f.remoteAddr(&http.Request{RemoteAddr: "10.0.0.1:1234", Header: header})
+	require.Nil(t, err)
+	require.True(t, net.ParseIP("203.0.113.7").Equal(ip), ip)
+	require.Equal(t, uint16(1234), port)
+
+	// Forwarding headers of other clients are ignored.
+	ip, _, err = f.remoteAddr(&http.Request{RemoteAddr: "198.51.100.1:1234", Header: header})
+	require.Nil(t, err)
+	require.True(t, net.ParseIP("198.51.100.1").Equal(ip), ip)
+
+	_, _, err = f.remoteAddr(&http.Request{RemoteAddr: "invalid", Header: header})
+	require.NotNil(t, err)
+}
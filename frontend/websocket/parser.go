@@ -0,0 +1,229 @@
+package websocket
+
+import (
+	"encoding/json"
+	"math"
+	"net"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/frontend"
+)
+
+// ParseOptions is the configuration used to parse an Announce Request.
+//
+// If TrustedProxies is not empty, the IP of a client connecting through one
+// of the listed networks is taken from the RealIPHeader, which defaults to
+// X-Forwarded-For, like in the HTTP frontend. Forwarding headers of other
+// clients are ignored.
+// IPPolicy determines how announces from unroutable IPs are handled.
+// WebTorrent clients cannot provide an IP, so rewriting is the same as
+// rejecting.
+type ParseOptions struct {
+	RealIPHeader        string   `yaml:"real_ip_header"`
+	TrustedProxies      []string `yaml:"trusted_proxies"`
+	MaxNumWant          uint32   `yaml:"max_numwant"`
+	DefaultNumWant      uint32   `yaml:"default_numwant"`
+	MaxScrapeInfoHashes uint32   `yaml:"max_scrape_infohashes"`
+
+	IPPolicy *bittorrent.IPPolicy `yaml:"ip_policy"`
+
+	trustedProxies frontend.TrustedProxies
+}
+
+// Default parser config constants.
+const (
+	defaultMaxNumWant          = 10
+	defaultDefaultNumWant      = 5
+	defaultMaxScrapeInfoHashes = 50
+)
+
+var (
+	errMalformedMessage  = bittorrent.RegisterClientError("malformed_message", "malformed message")
+	errUnknownAction     = bittorrent.RegisterClientError("unknown_action", "unknown action")
+	errInvalidInfoHash   = bittorrent.RegisterClientError("invalid_infohash", "invalid info_hash")
+	errInvalidPeerID     = bittorrent.RegisterClientError("invalid_peer_id", "invalid peer_id")
+	errInvalidToPeerID   = bittorrent.RegisterClientError("invalid_to_peer_id", "invalid to_peer_id")
+	errInvalidEvent      = bittorrent.RegisterClientError("invalid_event", "failed to provide valid client event")
+	errNoInfoHash        = bittorrent.RegisterClientError("no_infohash", "no info_hash parameter supplied")
+	errMissingOfferID    = bittorrent.RegisterClientError("missing_offer_id", "missing offer_id")
+	errPeerNotConnected  = bittorrent.RegisterClientError("peer_not_connected", "peer is not connected")
+	errPeerIDInUse       = bittorrent.RegisterClientError("peer_id_in_use", "peer_id is used by another connection")
+	errPeerIDNotOwned    = bittorrent.RegisterClientError("invalid_peer_id", "peer_id was not announced on this connection")
+	errInvalidBinaryRune = bittorrent.RegisterClientError("invalid_binary_string", "invalid binary string")
+)
+
+// Message represents a message sent by a WebTorrent client.
+//
+// WebTorrent encodes binary values, such as infohashes and peer IDs, as
+// "binary strings": JSON strings in which every character represents exactly
+// one byte.
+type Message struct {
+	Action     string          `json:"action"`
+	InfoHash   json.RawMessage `json:"info_hash"`
+	PeerID     string          `json:"peer_id"`
+	Uploaded   uint64          `json:"uploaded"`
+	Downloaded uint64          `json:"downloaded"`
+	Left       *uint64         `json:"left"`
+	Event      string          `json:"event"`
+	NumWant    *uint32         `json:"numwant"`
+	Offers     []Offer         `json:"offers"`
+	Answer     json.RawMessage `json:"answer"`
+	OfferID    string          `json:"offer_id"`
+	ToPeerID   string          `json:"to_peer_id"`
+	TrackerID  string          `json:"trackerid"`
+}
+
+// Offer is a WebRTC offer that is relayed to other peers of a swarm.
+type Offer struct {
+	Offer   json.RawMessage `json:"offer"`
+	OfferID string          `json:"offer_id"`
+}
+
+// decodeBinaryString converts a WebTorrent binary string into raw bytes.
+func decodeBinaryString(s string) ([]byte, error) {
+	b := make([]byte, 0, len(s))
+	for _, r := range s {
+		if r > 0xff {
+			return nil, errInvalidBinaryRune
+		}
+		b = append(b, byte(r))
+	}
+	return b, nil
+}
+
+// encodeBinaryString converts raw bytes into a WebTorrent binary string.
+func encodeBinaryString(b []byte) string {
+	runes := make([]rune, len(b))
+	for i, c := range b {
+		runes[i] = rune(c)
+	}
+	return string(runes)
+}
+
+func parseInfoHash(s string) (bittorrent.InfoHash, error) {
+	b, err := decodeBinaryString(s)
+	if err != nil {
+		return bittorrent.InfoHash{}, errInvalidInfoHash
+	}
+	ih, ok := bittorrent.ParseInfoHash(b)
+	if !ok {
+		return bittorrent.InfoHash{}, errInvalidInfoHash
+	}
+	return ih, nil
+}
+
+func parsePeerID(s string, invalid error) (bittorrent.PeerID, error) {
+	b, err := decodeBinaryString(s)
+	if err != nil || len(b) != 20 {
+		return bittorrent.PeerID{}, invalid
+	}
+	return bittorrent.PeerIDFromBytes(b), nil
+}
+
+// ParseAnnounce parses a bittorrent.AnnounceRequest from a WebTorrent
+// announce message.
+//
+// The ip and port are the remote address of the WebSocket connection,
+// params are taken from the URL used to establish the connection.
+func ParseAnnounce(m *Message, ip net.IP, port uint16, params bittorrent.Params, opts ParseOptions) (*bittorrent.AnnounceRequest, error) {
+	var ihStr string
+	if err := json.Unmarshal(m.InfoHash, &ihStr); err != nil {
+		return nil, errInvalidInfoHash
+	}
+	infoHash, err := parseInfoHash(ihStr)
+	if err != nil {
+		return nil, err
+	}
+
+	peerID, err := parsePeerID(m.PeerID, errInvalidPeerID)
+	if err != nil {
+		return nil, err
+	}
+
+	request := bittorrent.NewAnnounceRequest()
+	*request = bittorrent.AnnounceRequest{
+		InfoHash:   infoHash,
+		Downloaded: m.Downloaded,
+		Uploaded:   m.Uploaded,
+		Compact:    true,
+		TrackerID:  m.TrackerID,
+		Peer: bittorrent.Peer{
+			ID:   peerID,
+			IP:   bittorrent.IP{IP: ip},
+			Port: port,
+		},
+		Params: params,
+	}
+
+	request.EventProvided = m.Event != ""
+	request.Event, err = bittorrent.NewEvent(m.Event)
+	if err != nil {
+		return nil, errInvalidEvent
+	}
+
+	// WebTorrent clients that have not yet received the metadata of a torrent
+	// report an infinite amount left, which is encoded as null.
+	if m.Left != nil {
+		request.Left = *m.Left
+	} else {
+		request.Left = math.MaxUint64
+	}
+
+	// The offers sent by a client determine how many peers it wants to
+	// connect to.
+	if m.NumWant != nil {
+		request.NumWant = *m.NumWant
+		request.NumWantProvided = true
+	} else if len(m.Offers) > 0 {
+		request.NumWant = uint32(len(m.Offers))
+		request.NumWantProvided = true
+	}
+
+	if err := bittorrent.SanitizeAnnounce(request, opts.MaxNumWant, opts.DefaultNumWant); err != nil {
+		return nil, err
+	}
+
+	if err := opts.IPPolicy.Apply(request, ip); err != nil {
+		return nil, err
+	}
+
+	return request, nil
+}
+
+// ParseScrape parses a bittorrent.ScrapeRequest from a WebTorrent scrape
+// message.
+//
+// The info_hash of a scrape can either be a single binary string or a list of
+// them.
+func ParseScrape(m *Message, params bittorrent.Params, opts ParseOptions) (*bittorrent.ScrapeRequest, error) {
+	var ihStrs []string
+	if err := json.Unmarshal(m.InfoHash, &ihStrs); err != nil {
+		var ihStr string
+		if err := json.Unmarshal(m.InfoHash, &ihStr); err != nil {
+			return nil, errInvalidInfoHash
+		}
+		ihStrs = []string{ihStr}
+	}
+
+	if len(ihStrs) < 1 {
+		return nil, errNoInfoHash
+	}
+
+	request := &bittorrent.ScrapeRequest{
+		InfoHashes: make([]bittorrent.InfoHash, 0, len(ihStrs)),
+		Params:     params,
+	}
+	for _, ihStr := range ihStrs {
+		infoHash, err := parseInfoHash(ihStr)
+		if err != nil {
+			return nil, err
+		}
+		request.InfoHashes = append(request.InfoHashes, infoHash)
+	}
+
+	if err := bittorrent.SanitizeScrape(request, opts.MaxScrapeInfoHashes); err != nil {
+		return nil, err
+	}
+
+	return request, nil
+}
@@ -0,0 +1,124 @@
+package websocket
+
+import (
+	"encoding/json"
+	"math"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+var (
+	testOpts = ParseOptions{
+		MaxNumWant:          10,
+		DefaultNumWant:      5,
+		MaxScrapeInfoHashes: 2,
+	}
+	testInfoHash = encodeBinaryString([]byte{
+		0xff, 0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08,
+		0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f, 0x10, 0x11, 0xfe,
+	})
+	testPeerID = "-WW0105-" + strings.Repeat("a", 12)
+)
+
+func TestBinaryString(t *testing.T) {
+	b := make([]byte, 256)
+	for i := range b {
+		b[i] = byte(i)
+	}
+
+	decoded, err := decodeBinaryString(encodeBinaryString(b))
+	require.Nil(t, err)
+	require.Equal(t, b, decoded)
+
+	_, err = decodeBinaryString("Ā")
+	require.Equal(t, errInvalidBinaryRune, err)
+}
+
+func TestParseAnnounce(t *testing.T) {
+	ih, _ := json.Marshal(testInfoHash)
+	left := uint64(100)
+
+	table := []struct {
+		name string
+		msg  Message
+		err  error
+	}{
+		{"valid", Message{InfoHash: ih, PeerID: testPeerID, Left: &left, Event: "started"}, nil},
+		{"tracker id", Message{InfoHash: ih, PeerID: testPeerID, TrackerID: "abc"}, nil},
+		{"null left", Message{InfoHash: ih, PeerID: testPeerID}, nil},
+		{"offers as numwant", Message{InfoHash: ih, PeerID: testPeerID, Offers: make([]Offer, 3)}, nil},
+		{"short infohash", Message{InfoHash: json.RawMessage(`"abc"`), PeerID: testPeerID}, errInvalidInfoHash},
+		{"infohash list", Message{InfoHash: json.RawMessage(`["abc"]`), PeerID: testPeerID}, errInvalidInfoHash},
+		{"short peer_id", Message{InfoHash: ih, PeerID: "abc"}, errInvalidPeerID},
+		{"invalid event", Message{InfoHash: ih, PeerID: testPeerID, Event: "bogus"}, errInvalidEvent},
+	}
+
+	for _, tt := range table {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := ParseAnnounce(&tt.msg, net.ParseIP("10.0.0.1"), 1234, nil, testOpts)
+			require.Equal(t, tt.err, err)
+			if tt.err != nil {
+				return
+			}
+
+			require.Equal(t, decodeMust(t, testInfoHash), req.InfoHash[:])
+			require.Equal(t, testPeerID, string(req.Peer.ID[:]))
+			require.Equal(t, uint16(1234), req.Peer.Port)
+			require.Equal(t, bittorrent.IPv4, req.IP.AddressFamily)
+			require.Equal(t, tt.msg.TrackerID, req.TrackerID)
+
+			if tt.msg.Left == nil {
+				require.Equal(t, uint64(math.MaxUint64), req.Left)
+			} else {
+				require.Equal(t, *tt.msg.Left, req.Left)
+			}
+
+			if len(tt.msg.Offers) > 0 {
+				require.Equal(t, uint32(len(tt.msg.Offers)), req.NumWant)
+			} else {
+				require.Equal(t, testOpts.DefaultNumWant, req.NumWant)
+			}
+		})
+	}
+}
+
+func TestParseScrape(t *testing.T) {
+	ih, _ := json.Marshal(testInfoHash)
+	ihs, _ := json.Marshal([]string{testInfoHash, testInfoHash})
+	tooMany, _ := json.Marshal([]string{testInfoHash, testInfoHash, testInfoHash})
+
+	table := []struct {
+		name     string
+		infoHash json.RawMessage
+		expected int
+		err      error
+	}{
+		{"single", ih, 1, nil},
+		{"list", ihs, 2, nil},
+		{"too many", tooMany, 2, nil},
+		{"empty list", json.RawMessage(`[]`), 0, errNoInfoHash},
+		{"invalid", json.RawMessage(`42`), 0, errInvalidInfoHash},
+	}
+
+	for _, tt := range table {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := ParseScrape(&Message{Action: "scrape", InfoHash: tt.infoHash}, nil, testOpts)
+			require.Equal(t, tt.err, err)
+			if tt.err != nil {
+				return
+			}
+			require.Len(t, req.InfoHashes, tt.expected)
+		})
+	}
+}
+
+func decodeMust(t *testing.T, s string) []byte {
+	b, err := decodeBinaryString(s)
+	require.Nil(t, err)
+	return b
+}
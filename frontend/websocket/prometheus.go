@@ -0,0 +1,60 @@
+package websocket
+
+import (
+	"errors"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/frontend"
+)
+
+func init() {
+	prometheus.MustRegister(promResponseDurationMilliseconds, promConnectionsCount)
+}
+
+var (
+	promResponseDurationMilliseconds = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "chihaya_websocket_response_duration_milliseconds",
+			Help:    "The duration of time it takes to receive and write a response to an API request",
+			Buckets: prometheus.ExponentialBuckets(9.375, 2, 10),
+		},
+		[]string{"action", "address_family", "error"},
+	)
+
+	promConnectionsCount = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "chihaya_websocket_connections_count",
+		Help: "The number of open WebSocket connections",
+	})
+)
+
+// recordResponseDuration records the duration of time to respond to a
+// WebSocket message in milliseconds, and the reason of its error, if any.
+func recordResponseDuration(action string, af *bittorrent.AddressFamily, err error, duration time.Duration) {
+	frontend.RecordError("websocket", action, err)
+
+	var errString string
+	if err != nil {
+		var clientErr bittorrent.ClientError
+		if errors.As(err, &clientErr) {
+			errString = clientErr.Error()
+		} else {
+			errString = "internal error"
+		}
+	}
+
+	var afString string
+	if af == nil {
+		afString = "Unknown"
+	} else if *af == bittorrent.IPv4 {
+		afString = "IPv4"
+	} else if *af == bittorrent.IPv6 {
+		afString = "IPv6"
+	}
+
+	promResponseDurationMilliseconds.
+		WithLabelValues(action, afString, errString).
+		Observe(float64(duration.Nanoseconds()) / float64(time.Millisecond))
+}
@@ -0,0 +1,103 @@
+package websocket
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/pkg/log"
+)
+
+// JSONWriter is implemented by anything a JSON encoded message can be written
+// to, such as a WebSocket connection.
+type JSONWriter interface {
+	WriteJSON(v interface{}) error
+}
+
+// WriteError communicates an error to a WebTorrent client.
+func WriteError(w JSONWriter, action string, infoHash json.RawMessage, err error) error {
+	message := "internal server error"
+	var clientErr bittorrent.ClientError
+	if errors.As(err, &clientErr) {
+		message = clientErr.Error()
+	} else {
+		log.Error("websocket: internal error", log.Err(err))
+	}
+
+	resp := map[string]interface{}{
+		"action":         action,
+		"failure reason": message,
+	}
+	if len(infoHash) > 0 {
+		resp["info_hash"] = infoHash
+	}
+
+	return w.WriteJSON(resp)
+}
+
+// WriteAnnounceResponse communicates the results of an Announce to a
+// WebTorrent client.
+//
+// Peers are not part of the response, they are sent the offers of the
+// announcing client instead.
+func WriteAnnounceResponse(w JSONWriter, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) error {
+	msg := map[string]interface{}{
+		"action":       "announce",
+		"info_hash":    encodeBinaryString(req.InfoHash[:]),
+		"complete":     resp.Complete,
+		"incomplete":   resp.Incomplete,
+		"interval":     uint32(resp.Interval / time.Second),
+		"min interval": uint32(resp.MinInterval / time.Second),
+	}
+	if resp.TrackerID != "" {
+		msg["tracker id"] = resp.TrackerID
+	}
+	if resp.WarningMessage != "" {
+		msg["warning message"] = resp.WarningMessage
+	}
+
+	return w.WriteJSON(msg)
+}
+
+// WriteScrapeResponse communicates the results of a Scrape to a WebTorrent
+// client.
+func WriteScrapeResponse(w JSONWriter, resp *bittorrent.ScrapeResponse) error {
+	files := make(map[string]interface{}, len(resp.Files))
+	for _, scrape := range resp.Files {
+		files[encodeBinaryString(scrape.InfoHash[:])] = map[string]uint32{
+			"complete":   scrape.Complete,
+			"incomplete": scrape.Incomplete,
+			"downloaded": scrape.Snatches,
+		}
+	}
+
+	return w.WriteJSON(map[string]interface{}{
+		"action": "scrape",
+		"files":  files,
+	})
+}
+
+// WriteOffer relays a WebRTC offer of the peer identified by from to another
+// WebTorrent client.
+func WriteOffer(w JSONWriter, infoHash bittorrent.InfoHash, from bittorrent.PeerID, offer Offer) error {
+	return w.WriteJSON(map[string]interface{}{
+		"action":    "announce",
+		"info_hash": encodeBinaryString(infoHash[:]),
+		"peer_id":   encodeBinaryString(from[:]),
+		"offer":     offer.Offer,
+		"offer_id":  offer.OfferID,
+	})
+}
+
+// WriteAnswer relays a WebRTC answer of the peer identified by from to the
+// WebTorrent client that sent the corresponding offer.
+func WriteAnswer(w JSONWriter, infoHash bittorrent.InfoHash, from bittorrent.PeerID, answer json.RawMessage, offerID string) error {
+	return w.WriteJSON(map[string]interface{}{
+		"action":    "announce",
+		"info_hash": encodeBinaryString(infoHash[:]),
+		"peer_id":   encodeBinaryString(from[:]),
+		"answer":    answer,
+		"offer_id":  offerID,
+	})
+}
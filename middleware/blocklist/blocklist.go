@@ -0,0 +1,347 @@
+// Package blocklist implements a Hook that fails an Announce if the IP address
+// of the announcing peer is part of a blocklist of networks.
+//
+// The blocklist can be configured statically and loaded from HTTP(S) URLs or
+// files, such as the Spamhaus DROP list, which are refreshed periodically.
+// Networks can also be blocked at runtime through the admin API.
+package blocklist
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/middleware/pkg/listsource"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/pkg/stop"
+)
+
+// Name is the name by which this middleware is registered with Chihaya.
+const Name = "blocklist"
+
+func init() {
+	middleware.RegisterDriver(Name, driver{})
+	middleware.RegisterList(Name, runtimeList)
+	prometheus.MustRegister(promBlockedRequests, promEntries)
+}
+
+var (
+	promBlockedRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "chihaya_blocklist_blocked_requests_total",
+			Help: "The number of announces rejected because of the blocklist",
+		},
+		[]string{"address_family"},
+	)
+
+	promEntries = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "chihaya_blocklist_entries",
+		Help: "The number of networks in the blocklist",
+	})
+)
+
+var _ middleware.Driver = driver{}
+
+type driver struct{}
+
+func (d driver) NewHook(optionBytes []byte) (middleware.Hook, error) {
+	var cfg Config
+	err := yaml.Unmarshal(optionBytes, &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid options for middleware %s: %w", Name, err)
+	}
+
+	return NewHook(cfg)
+}
+
+// ErrBlockedIP is the error returned when the IP of a peer is blocked.
+var ErrBlockedIP = bittorrent.RegisterClientError("blocked_ip", "blocked IP address")
+
+// Config represents all the values required by this middleware to block
+// networks.
+type Config struct {
+	// CIDRs is a static list of blocked networks or addresses.
+	CIDRs []string `yaml:"cidrs"`
+
+	// ListURLs are HTTP(S) URLs or paths of files that contain one network
+	// or address per line. Comments starting with '#' or ';' are ignored.
+	ListURLs []string `yaml:"list_urls"`
+
+	// UpdateInterval is the interval at which the lists are reloaded.
+	UpdateInterval time.Duration `yaml:"update_interval"`
+}
+
+// LogFields implements log.Fielder for a Config.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"cidrs":          len(cfg.CIDRs),
+		"listURLs":       cfg.ListURLs,
+		"updateInterval": cfg.UpdateInterval,
+	}
+}
+
+const defaultUpdateInterval = time.Hour
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+//
+// This function warns to the logger when a value is changed.
+func (cfg Config) Validate() Config {
+	validcfg := cfg
+
+	if len(cfg.ListURLs) > 0 && cfg.UpdateInterval <= 0 {
+		validcfg.UpdateInterval = defaultUpdateInterval
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".UpdateInterval",
+			"provided": cfg.UpdateInterval,
+			"default":  validcfg.UpdateInterval,
+		})
+	}
+
+	return validcfg
+}
+
+// blocklist holds the blocked networks of both address families.
+type blocklist struct {
+	ipv4 trie
+	ipv6 trie
+}
+
+// add adds a network in CIDR notation or a single address.
+func (b *blocklist) add(entry string) error {
+	if !strings.Contains(entry, "/") {
+		ip := net.ParseIP(entry)
+		if ip == nil {
+			return fmt.Errorf("invalid IP address %q", entry)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			b.ipv4.insert(ip4, 32)
+		} else {
+			b.ipv6.insert(ip, 128)
+		}
+		return nil
+	}
+
+	_, network, err := net.ParseCIDR(entry)
+	if err != nil {
+		return err
+	}
+	ones, bits := network.Mask.Size()
+	if bits == 32 {
+		b.ipv4.insert(network.IP.To4(), ones)
+	} else {
+		b.ipv6.insert(network.IP.To16(), ones)
+	}
+	return nil
+}
+
+func (b *blocklist) contains(ip bittorrent.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		return b.ipv4.contains(ip4)
+	}
+	if ip16 := ip.To16(); ip16 != nil {
+		return b.ipv6.contains(ip16)
+	}
+	return false
+}
+
+// runtimeList holds the networks blocked at runtime through the admin API,
+// which are checked by all hooks in addition to their own blocklists.
+var runtimeList = &dynamicList{entries: make(map[string]struct{}), list: &blocklist{}}
+
+// dynamicList implements middleware.List for networks and addresses.
+type dynamicList struct {
+	mu      sync.RWMutex
+	entries map[string]struct{}
+	list    *blocklist
+}
+
+var _ middleware.List = &dynamicList{}
+
+// rebuild rebuilds the blocklist from the entries. The lock must be held.
+func (l *dynamicList) rebuild() {
+	list := &blocklist{}
+	for entry := range l.entries {
+		// The entries were validated when they were added.
+		_ = list.add(entry)
+	}
+	l.list = list
+}
+
+func (l *dynamicList) Add(entry string) error {
+	if err := (&blocklist{}).add(entry); err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries[entry] = struct{}{}
+	l.rebuild()
+	return nil
+}
+
+func (l *dynamicList) Remove(entry string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.entries[entry]; !ok {
+		return false
+	}
+	delete(l.entries, entry)
+	l.rebuild()
+	return true
+}
+
+func (l *dynamicList) Entries() []string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	entries := make([]string, 0, len(l.entries))
+	for entry := range l.entries {
+		entries = append(entries, entry)
+	}
+	sort.Strings(entries)
+	return entries
+}
+
+func (l *dynamicList) contains(ip bittorrent.IP) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.list.contains(ip)
+}
+
+type hook struct {
+	cidrs   []string
+	sources []*listsource.Source
+
+	// entries are the entries of each source, so that unchanged sources
+	// don't need to be downloaded again.
+	entries [][]string
+
+	mu   sync.RWMutex
+	list *blocklist
+
+	closing chan struct{}
+	wg      sync.WaitGroup
+}
+
+// NewHook returns an instance of the blocklist middleware.
+func NewHook(provided Config) (middleware.Hook, error) {
+	cfg := provided.Validate()
+	h := &hook{
+		cidrs:   cfg.CIDRs,
+		entries: make([][]string, len(cfg.ListURLs)),
+		closing: make(chan struct{}),
+	}
+	for _, url := range cfg.ListURLs {
+		h.sources = append(h.sources, listsource.New(url))
+	}
+
+	if err := h.refresh(); err != nil {
+		return nil, err
+	}
+
+	if len(h.sources) > 0 {
+		h.wg.Add(1)
+		go func() {
+			defer h.wg.Done()
+			t := time.NewTicker(cfg.UpdateInterval)
+			defer t.Stop()
+			for {
+				select {
+				case <-h.closing:
+					return
+				case <-t.C:
+					if err := h.refresh(); err != nil {
+						log.Error("failed to refresh blocklist", log.Err(err))
+					}
+				}
+			}
+		}()
+	}
+
+	return h, nil
+}
+
+// refresh reloads all lists and rebuilds the blocklist.
+// If any list cannot be loaded, the previous blocklist is kept.
+func (h *hook) refresh() error {
+	entries := make([][]string, len(h.sources))
+	changed := h.list == nil
+	for i, s := range h.sources {
+		e, c, err := s.Fetch()
+		if err != nil {
+			return fmt.Errorf("failed to load blocklist %s: %w", s.URL(), err)
+		}
+		if c {
+			entries[i] = e
+			changed = true
+		} else {
+			entries[i] = h.entries[i]
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	list := &blocklist{}
+	count := 0
+	for _, e := range append([][]string{h.cidrs}, entries...) {
+		for _, entry := range e {
+			if err := list.add(entry); err != nil {
+				return fmt.Errorf("invalid blocklist entry: %w", err)
+			}
+			count++
+		}
+	}
+
+	h.mu.Lock()
+	h.list = list
+	h.mu.Unlock()
+	h.entries = entries
+
+	promEntries.Set(float64(count))
+	log.Debug("loaded blocklist", log.Fields{"entries": count})
+	return nil
+}
+
+// Stop stops refreshing the lists.
+func (h *hook) Stop() stop.Result {
+	select {
+	case <-h.closing:
+		return stop.AlreadyStopped
+	default:
+	}
+	c := make(stop.Channel)
+	go func() {
+		close(h.closing)
+		h.wg.Wait()
+		c.Done()
+	}()
+	return c.Result()
+}
+
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	h.mu.RLock()
+	blocked := h.list.contains(req.IP)
+	h.mu.RUnlock()
+	blocked = blocked || runtimeList.contains(req.IP)
+
+	if blocked {
+		promBlockedRequests.WithLabelValues(req.IP.AddressFamily.String()).Inc()
+		return ctx, ErrBlockedIP
+	}
+	return ctx, nil
+}
+
+func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrapes don't require any protection.
+	return ctx, nil
+}
@@ -0,0 +1,116 @@
+package blocklist
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+func ip(s string) bittorrent.IP {
+	parsed := net.ParseIP(s)
+	if ip4 := parsed.To4(); ip4 != nil {
+		return bittorrent.IP{IP: ip4, AddressFamily: bittorrent.IPv4}
+	}
+	return bittorrent.IP{IP: parsed, AddressFamily: bittorrent.IPv6}
+}
+
+func TestBlocklist(t *testing.T) {
+	var b blocklist
+	for _, entry := range []string{"10.0.0.0/8", "192.168.1.1", "10.1.0.0/16", "172.16.0.0/12", "2001:db8::/32", "::1"} {
+		require.Nil(t, b.add(entry))
+	}
+	require.NotNil(t, b.add("10.0.0.0/33"))
+	require.NotNil(t, b.add("invalid"))
+
+	var table = []struct {
+		ip      string
+		blocked bool
+	}{
+		{"10.0.0.1", true},
+		{"10.255.255.255", true},
+		{"11.0.0.0", false},
+		{"192.168.1.1", true},
+		{"192.168.1.2", false},
+		{"172.31.255.255", true},
+		{"172.32.0.0", false},
+		{"2001:db8::1", true},
+		{"2001:db9::1", false},
+		{"::1", true},
+		{"::2", false},
+		// IPv4-mapped IPv6 addresses are treated as IPv4.
+		{"::ffff:10.0.0.1", true},
+	}
+	for _, tt := range table {
+		require.Equal(t, tt.blocked, b.contains(ip(tt.ip)), tt.ip)
+	}
+}
+
+func TestHandleAnnounce(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "drop.txt")
+	require.Nil(t, os.WriteFile(path, []byte("; Spamhaus DROP List\n1.10.16.0/20 ; SBL256894\n"), 0o600))
+
+	mh, err := NewHook(Config{
+		CIDRs:          []string{"10.0.0.0/8"},
+		ListURLs:       []string{path},
+		UpdateInterval: time.Hour,
+	})
+	require.Nil(t, err)
+	h := mh.(*hook)
+	defer func() { require.Nil(t, h.Stop().Wait()) }()
+
+	announce := func(s string) error {
+		req := &bittorrent.AnnounceRequest{Peer: bittorrent.Peer{IP: ip(s)}}
+		_, err := h.HandleAnnounce(context.Background(), req, &bittorrent.AnnounceResponse{})
+		return err
+	}
+
+	require.Equal(t, ErrBlockedIP, announce("10.1.2.3"))
+	require.Equal(t, ErrBlockedIP, announce("1.10.20.1"))
+	require.Nil(t, announce("1.10.32.1"))
+
+	// Invalid lists keep the previous blocklist.
+	require.Nil(t, os.WriteFile(path, []byte("invalid\n"), 0o600))
+	require.Nil(t, os.Chtimes(path, time.Now(), time.Now().Add(time.Minute)))
+	require.NotNil(t, h.refresh())
+	require.Equal(t, ErrBlockedIP, announce("1.10.20.1"))
+
+	require.Nil(t, os.WriteFile(path, []byte("1.10.32.0/20\n"), 0o600))
+	require.Nil(t, os.Chtimes(path, time.Now(), time.Now().Add(2*time.Minute)))
+	require.Nil(t, h.refresh())
+	require.Nil(t, announce("1.10.20.1"))
+	require.Equal(t, ErrBlockedIP, announce("1.10.32.1"))
+	require.Equal(t, ErrBlockedIP, announce("10.1.2.3"))
+}
+
+func TestRuntimeList(t *testing.T) {
+	mh, err := NewHook(Config{})
+	require.Nil(t, err)
+	h := mh.(*hook)
+	defer func() { require.Nil(t, h.Stop().Wait()) }()
+
+	announce := func(s string) error {
+		req := &bittorrent.AnnounceRequest{Peer: bittorrent.Peer{IP: ip(s)}}
+		_, err := h.HandleAnnounce(context.Background(), req, &bittorrent.AnnounceResponse{})
+		return err
+	}
+
+	require.NotNil(t, runtimeList.Add("invalid"))
+	require.Nil(t, runtimeList.Add("10.0.0.0/8"))
+	require.Nil(t, runtimeList.Add("2001:db8::1"))
+	require.Equal(t, []string{"10.0.0.0/8", "2001:db8::1"}, runtimeList.Entries())
+	require.Equal(t, ErrBlockedIP, announce("10.1.2.3"))
+	require.Equal(t, ErrBlockedIP, announce("2001:db8::1"))
+
+	require.True(t, runtimeList.Remove("10.0.0.0/8"))
+	require.False(t, runtimeList.Remove("10.0.0.0/8"))
+	require.Nil(t, announce("10.1.2.3"))
+
+	require.True(t, runtimeList.Remove("2001:db8::1"))
+}
@@ -0,0 +1,55 @@
+package blocklist
+
+import "net"
+
+// trie is a binary radix tree of IP prefixes.
+// Lookups take at most one step per bit of the address.
+type trie struct {
+	root node
+}
+
+type node struct {
+	children [2]*node
+	// blocked is set if the prefix ending at this node is part of the list.
+	blocked bool
+}
+
+// bit returns the i-th most significant bit of ip.
+func bit(ip net.IP, i int) int {
+	return int(ip[i/8]>>(7-uint(i%8))) & 1
+}
+
+// insert adds a prefix to the trie.
+// ip must be 4 bytes long for IPv4 and 16 bytes long for IPv6.
+func (t *trie) insert(ip net.IP, ones int) {
+	n := &t.root
+	for i := 0; i < ones; i++ {
+		if n.blocked {
+			// A shorter prefix already covers this one.
+			return
+		}
+		b := bit(ip, i)
+		if n.children[b] == nil {
+			n.children[b] = &node{}
+		}
+		n = n.children[b]
+	}
+	n.blocked = true
+	// Longer prefixes are covered by this one now.
+	n.children = [2]*node{}
+}
+
+// contains returns whether ip is covered by any prefix of the trie.
+func (t *trie) contains(ip net.IP) bool {
+	n := &t.root
+	for i := 0; i < len(ip)*8; i++ {
+		if n.blocked {
+			return true
+		}
+		n = n.children[bit(ip, i)]
+		if n == nil {
+			return false
+		}
+	}
+	return n.blocked
+}
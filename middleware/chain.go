@@ -0,0 +1,163 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/pkg/stop"
+	"github.com/chihaya/chihaya/pkg/tracing"
+)
+
+// hookChain is a set of hooks used by a Logic.
+//
+// The hooks of a Logic can be replaced while it is serving requests. Every
+// call of a Logic runs on the chain that was current when it started, and a
+// replaced chain is only stopped after all calls running on it have returned.
+type hookChain struct {
+	preHooks  []Hook
+	postHooks []Hook
+
+	// preSpans and postSpans are the names of the spans of the hooks.
+	preSpans  []string
+	postSpans []string
+
+	// hooks are the configured hooks, without the hooks added by the Logic.
+	hooks []Hook
+
+	inFlight sync.WaitGroup
+}
+
+// newChain creates a chain of the configured hooks, amended by the hooks
+// generating responses and updating swarms.
+func (l *Logic) newChain(preHooks, postHooks []Hook) *hookChain {
+	stores := swarmStores{store: l.peerStore, webTorrent: l.webTorrentPeerStore}
+	rh := &responseHook{
+		swarmStores: stores,
+		mix:         l.mix,
+		mixer:       l.mixer,
+		fullScrape:  l.fullScrape,
+	}
+	for _, h := range preHooks {
+		if s, ok := h.(PeerSelector); ok {
+			rh.selectors = append(rh.selectors, s)
+		}
+		if a, ok := h.(AnnounceResponseAdjuster); ok {
+			rh.adjusters = append(rh.adjusters, a)
+		}
+		if a, ok := h.(ScrapeResponseAdjuster); ok {
+			rh.scrapeAdjusters = append(rh.scrapeAdjusters, a)
+		}
+	}
+
+	c := &hookChain{
+		preHooks:  append(preHooks[:len(preHooks):len(preHooks)], rh),
+		postHooks: append(postHooks[:len(postHooks):len(postHooks)], &swarmInteractionHook{swarmStores: stores}),
+	}
+	c.preSpans = spanNames(c.preHooks)
+	c.postSpans = spanNames(c.postHooks)
+	c.hooks = append(c.hooks, preHooks...)
+	c.hooks = append(c.hooks, postHooks...)
+	return c
+}
+
+// spanNames returns the names of the spans of hooks, which are named after
+// their types.
+func spanNames(hooks []Hook) []string {
+	names := make([]string, len(hooks))
+	for i, h := range hooks {
+		names[i] = "hook " + strings.TrimPrefix(fmt.Sprintf("%T", h), "*")
+	}
+	return names
+}
+
+// handleAnnounce runs hooks on an announce, each in a span of its own.
+func handleAnnounce(ctx context.Context, hooks []Hook, spans []string, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	for i, h := range hooks {
+		hctx, span := tracing.Start(ctx, spans[i])
+		hctx, err := h.HandleAnnounce(hctx, req, resp)
+		if span != nil {
+			span.SetError(err)
+			span.End()
+			hctx = tracing.Unwind(hctx, ctx)
+		}
+		if err != nil {
+			return nil, err
+		}
+		ctx = hctx
+	}
+	return ctx, nil
+}
+
+// handleScrape runs hooks on a scrape, each in a span of its own.
+func handleScrape(ctx context.Context, hooks []Hook, spans []string, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	for i, h := range hooks {
+		hctx, span := tracing.Start(ctx, spans[i])
+		hctx, err := h.HandleScrape(hctx, req, resp)
+		if span != nil {
+			span.SetError(err)
+			span.End()
+			hctx = tracing.Unwind(hctx, ctx)
+		}
+		if err != nil {
+			return nil, err
+		}
+		ctx = hctx
+	}
+	return ctx, nil
+}
+
+// acquireChain returns the current chain, which must be released after use.
+func (l *Logic) acquireChain() *hookChain {
+	l.chainMu.RLock()
+	c := l.chain
+	// Adding to the WaitGroup while holding the lock ensures that it happens
+	// before a replaced chain is waited for.
+	c.inFlight.Add(1)
+	l.chainMu.RUnlock()
+	return c
+}
+
+func (c *hookChain) release() {
+	c.inFlight.Done()
+}
+
+// stop stops the hooks of the chain that implement stop.Stopper, after all
+// calls running on the chain have returned.
+func (c *hookChain) stop() stop.Result {
+	ch := make(stop.Channel)
+	go func() {
+		c.inFlight.Wait()
+
+		stopGroup := stop.NewGroup()
+		for _, hook := range c.hooks {
+			if stoppable, ok := hook.(stop.Stopper); ok {
+				stopGroup.Add(stoppable)
+			}
+		}
+		ch.Done(stopGroup.Stop().Wait()...)
+	}()
+	return ch.Result()
+}
+
+// SetHooks replaces the hooks of the Logic while it keeps serving requests.
+//
+// Calls that are executing the previous hooks finish on them. The returned
+// Result stops the previous hooks once these calls have returned.
+func (l *Logic) SetHooks(preHooks, postHooks []Hook) stop.Result {
+	c := l.newChain(preHooks, postHooks)
+
+	l.chainMu.Lock()
+	old := l.chain
+	l.chain = c
+	l.chainMu.Unlock()
+
+	log.Debug("replaced middleware hooks", log.Fields{
+		"prehooks":  len(preHooks),
+		"posthooks": len(postHooks),
+	})
+	return old.stop()
+}
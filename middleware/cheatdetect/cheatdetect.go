@@ -0,0 +1,524 @@
+// Package cheatdetect implements a Hook that detects announces with
+// impossible statistics, records them as incidents and warns, throttles or
+// bans the offenders.
+//
+// Offenders are identified by their passkey if the passkey middleware runs
+// before this middleware, and by their IP address otherwise.
+package cheatdetect
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/middleware/passkey"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/pkg/stop"
+	"github.com/chihaya/chihaya/pkg/timecache"
+)
+
+// Name is the name by which this middleware is registered with Chihaya.
+const Name = "cheat detection"
+
+func init() {
+	middleware.RegisterDriver(Name, driver{})
+	prometheus.MustRegister(promIncidents)
+}
+
+var promIncidents = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "chihaya_cheatdetect_incidents_total",
+	Help: "The number of announces with impossible statistics, by reason",
+}, []string{"reason"})
+
+var _ middleware.Driver = driver{}
+
+type driver struct{}
+
+func (d driver) NewHook(optionBytes []byte) (middleware.Hook, error) {
+	var cfg Config
+	err := yaml.Unmarshal(optionBytes, &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid options for middleware %s: %w", Name, err)
+	}
+
+	return NewHook(cfg)
+}
+
+// ErrBanned is the error returned for announces of banned offenders.
+var ErrBanned = bittorrent.RegisterClientError("banned", "banned for reporting impossible statistics")
+
+// Actions taken against offenders.
+const (
+	ActionWarn     = "warn"
+	ActionThrottle = "throttle"
+	ActionBan      = "ban"
+)
+
+// Reasons of incidents.
+const (
+	ReasonUploadRate = "upload_rate"
+	ReasonDownloaded = "downloaded"
+)
+
+// Config represents all the values required by this middleware to detect
+// cheating.
+type Config struct {
+	// Action is the action taken against offenders: "warn", "throttle" or
+	// "ban".
+	Action string `yaml:"action"`
+
+	// MaxUploadRate is the highest plausible upload rate in bytes per second
+	// between two announces of a peer.
+	MaxUploadRate uint64 `yaml:"max_upload_rate"`
+
+	// MaxDownloadedFactor is how many times the size of a torrent a peer may
+	// report as downloaded, which accounts for data discarded by clients.
+	MaxDownloadedFactor float64 `yaml:"max_downloaded_factor"`
+
+	// SizeParam, if set, is the name of a query parameter announce URLs
+	// carry the size of the torrent in. Otherwise, the size of a torrent is
+	// estimated as the largest amount left reported by its peers.
+	SizeParam string `yaml:"size_param"`
+
+	// WarningMessage is the warning message sent to offenders.
+	WarningMessage string `yaml:"warning_message"`
+
+	// PenaltyDuration is how long offenders are throttled or banned.
+	PenaltyDuration time.Duration `yaml:"penalty_duration"`
+
+	// ThrottleInterval is the announce interval of throttled offenders.
+	ThrottleInterval time.Duration `yaml:"throttle_interval"`
+
+	// Store is the type of the Store for incidents, either "memory" or
+	// "redis".
+	Store string `yaml:"store"`
+
+	// Redis configures the redis store.
+	Redis RedisConfig `yaml:"redis"`
+
+	// SessionLifetime is the duration after which peers and torrents that
+	// weren't announced are forgotten. It should be longer than the
+	// announce interval.
+	SessionLifetime time.Duration `yaml:"session_lifetime"`
+
+	// GarbageCollectionInterval is the interval at which expired sessions
+	// and penalties are removed.
+	GarbageCollectionInterval time.Duration `yaml:"gc_interval"`
+}
+
+// LogFields implements log.Fielder for a Config.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"action":              cfg.Action,
+		"maxUploadRate":       cfg.MaxUploadRate,
+		"maxDownloadedFactor": cfg.MaxDownloadedFactor,
+		"sizeParam":           cfg.SizeParam,
+		"warningMessage":      cfg.WarningMessage,
+		"penaltyDuration":     cfg.PenaltyDuration,
+		"throttleInterval":    cfg.ThrottleInterval,
+		"store":               cfg.Store,
+		"redisURL":            cfg.Redis.URL,
+		"redisPrefix":         cfg.Redis.KeyPrefix,
+		"sessionLifetime":     cfg.SessionLifetime,
+		"gcInterval":          cfg.GarbageCollectionInterval,
+	}
+}
+
+// Store types.
+const (
+	StoreMemory = "memory"
+	StoreRedis  = "redis"
+)
+
+// Default config constants.
+const (
+	defaultAction                    = ActionWarn
+	defaultMaxUploadRate             = 100 << 20
+	defaultMaxDownloadedFactor       = 1.5
+	defaultWarningMessage            = "impossible statistics reported"
+	defaultPenaltyDuration           = 24 * time.Hour
+	defaultThrottleInterval          = time.Hour
+	defaultStore                     = StoreMemory
+	defaultSessionLifetime           = 2 * time.Hour
+	defaultGarbageCollectionInterval = 5 * time.Minute
+)
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+//
+// This function warns to the logger when a value is changed.
+func (cfg Config) Validate() Config {
+	validcfg := cfg
+
+	switch cfg.Action {
+	case ActionWarn, ActionThrottle, ActionBan:
+	default:
+		validcfg.Action = defaultAction
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".Action",
+			"provided": cfg.Action,
+			"default":  validcfg.Action,
+		})
+	}
+
+	if cfg.MaxUploadRate == 0 {
+		validcfg.MaxUploadRate = defaultMaxUploadRate
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".MaxUploadRate",
+			"provided": cfg.MaxUploadRate,
+			"default":  validcfg.MaxUploadRate,
+		})
+	}
+
+	if cfg.MaxDownloadedFactor < 1 {
+		validcfg.MaxDownloadedFactor = defaultMaxDownloadedFactor
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".MaxDownloadedFactor",
+			"provided": cfg.MaxDownloadedFactor,
+			"default":  validcfg.MaxDownloadedFactor,
+		})
+	}
+
+	if cfg.WarningMessage == "" {
+		validcfg.WarningMessage = defaultWarningMessage
+	}
+
+	if cfg.PenaltyDuration <= 0 {
+		validcfg.PenaltyDuration = defaultPenaltyDuration
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".PenaltyDuration",
+			"provided": cfg.PenaltyDuration,
+			"default":  validcfg.PenaltyDuration,
+		})
+	}
+
+	if cfg.ThrottleInterval <= 0 {
+		validcfg.ThrottleInterval = defaultThrottleInterval
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".ThrottleInterval",
+			"provided": cfg.ThrottleInterval,
+			"default":  validcfg.ThrottleInterval,
+		})
+	}
+
+	if cfg.Store == "" {
+		validcfg.Store = defaultStore
+	}
+
+	if validcfg.Store == StoreRedis {
+		validcfg.Redis = cfg.Redis.validate()
+	}
+
+	if cfg.SessionLifetime <= 0 {
+		validcfg.SessionLifetime = defaultSessionLifetime
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".SessionLifetime",
+			"provided": cfg.SessionLifetime,
+			"default":  validcfg.SessionLifetime,
+		})
+	}
+
+	if cfg.GarbageCollectionInterval <= 0 {
+		validcfg.GarbageCollectionInterval = defaultGarbageCollectionInterval
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".GarbageCollectionInterval",
+			"provided": cfg.GarbageCollectionInterval,
+			"default":  validcfg.GarbageCollectionInterval,
+		})
+	}
+
+	return validcfg
+}
+
+// shardCount is the number of shards the sessions are distributed over to
+// reduce lock contention.
+const shardCount = 256
+
+type sessionKey struct {
+	infoHash bittorrent.InfoHash
+	peerID   bittorrent.PeerID
+}
+
+// session is the state of a peer in a swarm.
+type session struct {
+	uploaded uint64
+	// lastSeen is the time of the last announce in nanoseconds since the
+	// epoch.
+	lastSeen int64
+}
+
+// sizeEstimate is the largest amount left reported for a torrent.
+type sizeEstimate struct {
+	size     uint64
+	lastSeen int64
+}
+
+type shard struct {
+	sync.Mutex
+	sessions map[sessionKey]session
+	sizes    map[bittorrent.InfoHash]sizeEstimate
+}
+
+type hook struct {
+	cfg             Config
+	sessionLifetime int64
+	store           Store
+	shards          [shardCount]shard
+
+	// penalties maps offenders to the end of their penalty in nanoseconds
+	// since the epoch.
+	penaltiesMu sync.RWMutex
+	penalties   map[string]int64
+
+	closing chan struct{}
+	wg      sync.WaitGroup
+}
+
+// NewHook returns an instance of the cheat detection middleware.
+func NewHook(provided Config) (middleware.Hook, error) {
+	cfg := provided.Validate()
+
+	var store Store
+	switch cfg.Store {
+	case StoreMemory:
+		store = newMemoryStore()
+	case StoreRedis:
+		store = newRedisStore(cfg.Redis)
+	default:
+		return nil, fmt.Errorf("unknown incident store %q", cfg.Store)
+	}
+
+	return NewHookWithStore(cfg, store), nil
+}
+
+// NewHookWithStore returns an instance of the cheat detection middleware that
+// persists incidents in the given store. The Store and Redis fields of the
+// config are ignored.
+func NewHookWithStore(provided Config, store Store) middleware.Hook {
+	cfg := provided.Validate()
+	h := &hook{
+		cfg:             cfg,
+		sessionLifetime: int64(cfg.SessionLifetime),
+		store:           store,
+		penalties:       make(map[string]int64),
+		closing:         make(chan struct{}),
+	}
+	for i := range h.shards {
+		h.shards[i].sessions = make(map[sessionKey]session)
+		h.shards[i].sizes = make(map[bittorrent.InfoHash]sizeEstimate)
+	}
+
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		t := time.NewTicker(cfg.GarbageCollectionInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-h.closing:
+				return
+			case <-t.C:
+				h.collectGarbage(timecache.NowUnixNano())
+			}
+		}
+	}()
+
+	return h
+}
+
+// collectGarbage removes sessions, size estimates and penalties that expired.
+func (h *hook) collectGarbage(now int64) {
+	for i := range h.shards {
+		s := &h.shards[i]
+		s.Lock()
+		for k, sess := range s.sessions {
+			if now-sess.lastSeen > h.sessionLifetime {
+				delete(s.sessions, k)
+			}
+		}
+		for ih, est := range s.sizes {
+			if now-est.lastSeen > h.sessionLifetime {
+				delete(s.sizes, ih)
+			}
+		}
+		s.Unlock()
+	}
+
+	h.penaltiesMu.Lock()
+	for identity, until := range h.penalties {
+		if now >= until {
+			delete(h.penalties, identity)
+		}
+	}
+	h.penaltiesMu.Unlock()
+}
+
+// Stop stops the garbage collection and closes the Store, if necessary.
+func (h *hook) Stop() stop.Result {
+	select {
+	case <-h.closing:
+		return stop.AlreadyStopped
+	default:
+	}
+	c := make(stop.Channel)
+	go func() {
+		close(h.closing)
+		h.wg.Wait()
+		if s, ok := h.store.(stop.Stopper); ok {
+			c.Done(s.Stop().Wait()...)
+			return
+		}
+		c.Done()
+	}()
+	return c.Result()
+}
+
+// identity returns the passkey of the request if there is one, and its IP
+// address otherwise.
+func identity(ctx context.Context, req *bittorrent.AnnounceRequest) string {
+	if pk, ok := ctx.Value(passkey.PasskeyKey).(string); ok && pk != "" {
+		return pk
+	}
+	return req.IP.String()
+}
+
+// penalized returns whether an offender is throttled or banned at now.
+func (h *hook) penalized(identity string, now int64) bool {
+	h.penaltiesMu.RLock()
+	until, ok := h.penalties[identity]
+	h.penaltiesMu.RUnlock()
+	return ok && now < until
+}
+
+func (h *hook) penalize(identity string, now int64) {
+	h.penaltiesMu.Lock()
+	h.penalties[identity] = now + int64(h.cfg.PenaltyDuration)
+	h.penaltiesMu.Unlock()
+}
+
+// violation is a statistic that exceeds its limit.
+type violation struct {
+	reason string
+	value  float64
+	limit  float64
+}
+
+// check updates the session of the announcing peer and the size estimate of
+// the torrent and returns the violations of the announce.
+func (h *hook) check(req *bittorrent.AnnounceRequest, now int64) []violation {
+	k := sessionKey{infoHash: req.InfoHash, peerID: req.Peer.ID}
+	s := &h.shards[k.infoHash[0]]
+
+	var size uint64
+	if h.cfg.SizeParam != "" {
+		if v, ok := req.Params.String(h.cfg.SizeParam); ok {
+			size, _ = strconv.ParseUint(v, 10, 64)
+		}
+	}
+
+	s.Lock()
+	previous, known := s.sessions[k]
+	if req.Event == bittorrent.Stopped {
+		delete(s.sessions, k)
+	} else {
+		s.sessions[k] = session{uploaded: req.Uploaded, lastSeen: now}
+	}
+
+	if size == 0 {
+		est := s.sizes[req.InfoHash]
+		if req.Left > est.size {
+			est.size = req.Left
+		}
+		est.lastSeen = now
+		s.sizes[req.InfoHash] = est
+		size = est.size
+	}
+	s.Unlock()
+
+	var violations []violation
+	// Clients that restarted report smaller values, which are skipped.
+	if known && req.Event != bittorrent.Started && req.Uploaded > previous.uploaded {
+		elapsed := time.Duration(now - previous.lastSeen)
+		// The clock has a resolution of one second.
+		if elapsed < time.Second {
+			elapsed = time.Second
+		}
+		rate := float64(req.Uploaded-previous.uploaded) / elapsed.Seconds()
+		if rate > float64(h.cfg.MaxUploadRate) {
+			violations = append(violations, violation{ReasonUploadRate, rate, float64(h.cfg.MaxUploadRate)})
+		}
+	}
+
+	if size > 0 {
+		limit := float64(size) * h.cfg.MaxDownloadedFactor
+		if float64(req.Downloaded) > limit {
+			violations = append(violations, violation{ReasonDownloaded, float64(req.Downloaded), limit})
+		}
+	}
+
+	return violations
+}
+
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	id := identity(ctx, req)
+	now := timecache.NowUnixNano()
+
+	violations := h.check(req, now)
+	for _, v := range violations {
+		promIncidents.WithLabelValues(v.reason).Inc()
+		incident := Incident{
+			Identity: id,
+			InfoHash: req.InfoHash.String(),
+			PeerID:   req.Peer.ID.String(),
+			IP:       req.IP.String(),
+			Reason:   v.reason,
+			Value:    v.value,
+			Limit:    v.limit,
+			Action:   h.cfg.Action,
+			Time:     time.Unix(0, now),
+		}
+		log.Info("cheat detection: impossible statistics reported", log.Fields{
+			"identity": id,
+			"infoHash": req.InfoHash,
+			"reason":   v.reason,
+			"value":    v.value,
+			"limit":    v.limit,
+		})
+		if err := h.store.AddIncident(ctx, incident); err != nil {
+			log.Error("failed to record incident", log.Fields{"identity": id}, log.Err(err))
+		}
+	}
+
+	if len(violations) > 0 && h.cfg.Action != ActionWarn {
+		h.penalize(id, now)
+	}
+
+	switch {
+	case h.cfg.Action == ActionWarn && len(violations) > 0:
+		resp.WarningMessage = h.cfg.WarningMessage
+	case h.cfg.Action == ActionThrottle && h.penalized(id, now):
+		resp.WarningMessage = h.cfg.WarningMessage
+		if resp.Interval < h.cfg.ThrottleInterval {
+			resp.Interval = h.cfg.ThrottleInterval
+		}
+		if resp.MinInterval < h.cfg.ThrottleInterval {
+			resp.MinInterval = h.cfg.ThrottleInterval
+		}
+	case h.cfg.Action == ActionBan && h.penalized(id, now):
+		return ctx, ErrBanned
+	}
+
+	return ctx, nil
+}
+
+func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrapes carry no statistics.
+	return ctx, nil
+}
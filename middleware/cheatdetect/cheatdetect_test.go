@@ -0,0 +1,118 @@
+package cheatdetect
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware/passkey"
+)
+
+func TestCheck(t *testing.T) {
+	mh, err := NewHook(Config{MaxUploadRate: 1000, MaxDownloadedFactor: 1.5})
+	require.Nil(t, err)
+	h := mh.(*hook)
+	defer func() { require.Nil(t, h.Stop().Wait()) }()
+
+	start := time.Now().UnixNano()
+	req := func(event bittorrent.Event, left, uploaded, downloaded uint64) *bittorrent.AnnounceRequest {
+		return &bittorrent.AnnounceRequest{
+			InfoHash:   bittorrent.InfoHash{1},
+			Event:      event,
+			Left:       left,
+			Uploaded:   uploaded,
+			Downloaded: downloaded,
+		}
+	}
+
+	require.Empty(t, h.check(req(bittorrent.Started, 1000, 0, 0), start))
+	require.Empty(t, h.check(req(bittorrent.None, 500, 10000, 500), start+int64(10*time.Second)))
+
+	// Uploading 20000 bytes in 10 seconds exceeds the rate.
+	violations := h.check(req(bittorrent.None, 500, 30000, 500), start+int64(20*time.Second))
+	require.Equal(t, []violation{{ReasonUploadRate, 2000, 1000}}, violations)
+
+	// The torrent is estimated to be 1000 bytes large.
+	violations = h.check(req(bittorrent.None, 0, 30000, 1600), start+int64(30*time.Second))
+	require.Equal(t, []violation{{ReasonDownloaded, 1600, 1500}}, violations)
+
+	// Restarted clients report smaller values.
+	require.Empty(t, h.check(req(bittorrent.Started, 0, 0, 0), start+int64(31*time.Second)))
+}
+
+func TestActions(t *testing.T) {
+	rs, err := miniredis.Run()
+	require.Nil(t, err)
+	defer rs.Close()
+
+	stores := map[string]Config{
+		"memory": {},
+		"redis":  {Store: StoreRedis, Redis: RedisConfig{URL: "redis://" + rs.Addr()}},
+	}
+
+	for name, cfg := range stores {
+		for _, action := range []string{ActionWarn, ActionThrottle, ActionBan} {
+			t.Run(name+"/"+action, func(t *testing.T) {
+				cfg.Action = action
+				cfg.SizeParam = "size"
+				mh, err := NewHook(cfg)
+				require.Nil(t, err)
+				h := mh.(*hook)
+				defer func() { require.Nil(t, h.Stop().Wait()) }()
+
+				ctx := context.WithValue(context.Background(), passkey.PasskeyKey, "secret-"+action)
+				params, err := bittorrent.ParseURLData("/announce?size=1000")
+				require.Nil(t, err)
+				announce := func(downloaded uint64) (*bittorrent.AnnounceResponse, error) {
+					req := &bittorrent.AnnounceRequest{
+						InfoHash:   bittorrent.InfoHash{2},
+						Downloaded: downloaded,
+						Peer:       bittorrent.Peer{IP: bittorrent.IP{IP: net.IPv4(10, 0, 0, 1), AddressFamily: bittorrent.IPv4}},
+						Params:     params,
+					}
+					resp := &bittorrent.AnnounceResponse{Interval: time.Minute, MinInterval: time.Minute}
+					_, err := h.HandleAnnounce(ctx, req, resp)
+					return resp, err
+				}
+
+				resp, err := announce(100)
+				require.Nil(t, err)
+				require.Empty(t, resp.WarningMessage)
+
+				resp, err = announce(5000)
+				if action == ActionBan {
+					require.Equal(t, ErrBanned, err)
+				} else {
+					require.Nil(t, err)
+					require.Equal(t, defaultWarningMessage, resp.WarningMessage)
+				}
+
+				// Throttling and bans persist for the following announces.
+				resp, err = announce(100)
+				switch action {
+				case ActionWarn:
+					require.Nil(t, err)
+					require.Empty(t, resp.WarningMessage)
+				case ActionThrottle:
+					require.Nil(t, err)
+					require.Equal(t, defaultThrottleInterval, resp.Interval)
+					require.Equal(t, defaultThrottleInterval, resp.MinInterval)
+				case ActionBan:
+					require.Equal(t, ErrBanned, err)
+				}
+
+				incidents, err := h.store.Incidents(ctx, "secret-"+action)
+				require.Nil(t, err)
+				require.Len(t, incidents, 1)
+				require.Equal(t, ReasonDownloaded, incidents[0].Reason)
+				require.Equal(t, action, incidents[0].Action)
+				require.Equal(t, float64(5000), incidents[0].Value)
+			})
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package cheatdetect
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/pkg/stop"
+)
+
+// Incident describes an announce with impossible statistics.
+type Incident struct {
+	// Identity is the passkey or IP address of the offender.
+	Identity string    `json:"identity"`
+	InfoHash string    `json:"info_hash"`
+	PeerID   string    `json:"peer_id"`
+	IP       string    `json:"ip"`
+	Reason   string    `json:"reason"`
+	Value    float64   `json:"value"`
+	Limit    float64   `json:"limit"`
+	Action   string    `json:"action"`
+	Time     time.Time `json:"time"`
+}
+
+// Store persists incidents.
+//
+// Implementations must be safe for concurrent use and may implement
+// stop.Stopper if they need to be closed.
+type Store interface {
+	// AddIncident records an incident.
+	AddIncident(ctx context.Context, incident Incident) error
+
+	// Incidents returns the incidents of an identity, most recent first.
+	Incidents(ctx context.Context, identity string) ([]Incident, error)
+}
+
+// maxIncidents is the number of incidents kept per identity.
+const maxIncidents = 100
+
+// memoryStore is a Store that keeps incidents in memory.
+// The incidents are lost on restarts, so it's mostly useful for testing.
+type memoryStore struct {
+	mu        sync.Mutex
+	incidents map[string][]Incident
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{incidents: make(map[string][]Incident)}
+}
+
+func (s *memoryStore) AddIncident(_ context.Context, incident Incident) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	incidents := append([]Incident{incident}, s.incidents[incident.Identity]...)
+	if len(incidents) > maxIncidents {
+		incidents = incidents[:maxIncidents]
+	}
+	s.incidents[incident.Identity] = incidents
+	return nil
+}
+
+func (s *memoryStore) Incidents(_ context.Context, identity string) ([]Incident, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Incident(nil), s.incidents[identity]...), nil
+}
+
+// RedisConfig represents the configuration of a Store backed by Redis.
+//
+// The incidents of every identity are stored as a list of JSON objects under
+// KeyPrefix followed by the identity.
+type RedisConfig struct {
+	URL            string        `yaml:"url"`
+	KeyPrefix      string        `yaml:"key_prefix"`
+	ReadTimeout    time.Duration `yaml:"read_timeout"`
+	WriteTimeout   time.Duration `yaml:"write_timeout"`
+	ConnectTimeout time.Duration `yaml:"connect_timeout"`
+}
+
+// Default Redis config constants.
+const (
+	defaultRedisURL       = "redis://127.0.0.1:6379/0"
+	defaultRedisKeyPrefix = "chihaya_incidents_"
+	defaultRedisTimeout   = 5 * time.Second
+)
+
+func (cfg RedisConfig) validate() RedisConfig {
+	validcfg := cfg
+
+	if cfg.URL == "" {
+		validcfg.URL = defaultRedisURL
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".Redis.URL",
+			"provided": cfg.URL,
+			"default":  validcfg.URL,
+		})
+	}
+
+	if cfg.KeyPrefix == "" {
+		validcfg.KeyPrefix = defaultRedisKeyPrefix
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".Redis.KeyPrefix",
+			"provided": cfg.KeyPrefix,
+			"default":  validcfg.KeyPrefix,
+		})
+	}
+
+	for _, d := range []struct {
+		name     string
+		provided time.Duration
+		valid    *time.Duration
+	}{
+		{"ReadTimeout", cfg.ReadTimeout, &validcfg.ReadTimeout},
+		{"WriteTimeout", cfg.WriteTimeout, &validcfg.WriteTimeout},
+		{"ConnectTimeout", cfg.ConnectTimeout, &validcfg.ConnectTimeout},
+	} {
+		if d.provided <= 0 {
+			*d.valid = defaultRedisTimeout
+			log.Warn("falling back to default configuration", log.Fields{
+				"name":     Name + ".Redis." + d.name,
+				"provided": d.provided,
+				"default":  *d.valid,
+			})
+		}
+	}
+
+	return validcfg
+}
+
+// redisStore is a Store backed by Redis.
+type redisStore struct {
+	prefix string
+	pool   *redis.Pool
+}
+
+func newRedisStore(cfg RedisConfig) *redisStore {
+	return &redisStore{
+		prefix: cfg.KeyPrefix,
+		pool: &redis.Pool{
+			MaxIdle:     3,
+			IdleTimeout: 240 * time.Second,
+			Dial: func() (redis.Conn, error) {
+				return redis.DialURL(cfg.URL,
+					redis.DialReadTimeout(cfg.ReadTimeout),
+					redis.DialWriteTimeout(cfg.WriteTimeout),
+					redis.DialConnectTimeout(cfg.ConnectTimeout),
+				)
+			},
+		},
+	}
+}
+
+func (s *redisStore) AddIncident(ctx context.Context, incident Incident) error {
+	encoded, err := json.Marshal(incident)
+	if err != nil {
+		return err
+	}
+
+	conn, err := s.pool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	key := s.prefix + incident.Identity
+	_ = conn.Send("MULTI")
+	_ = conn.Send("LPUSH", key, encoded)
+	_ = conn.Send("LTRIM", key, 0, maxIncidents-1)
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+func (s *redisStore) Incidents(ctx context.Context, identity string) ([]Incident, error) {
+	conn, err := s.pool.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	values, err := redis.ByteSlices(conn.Do("LRANGE", s.prefix+identity, 0, -1))
+	if err != nil {
+		return nil, err
+	}
+
+	incidents := make([]Incident, 0, len(values))
+	for _, v := range values {
+		var incident Incident
+		if err := json.Unmarshal(v, &incident); err != nil {
+			return nil, err
+		}
+		incidents = append(incidents, incident)
+	}
+	return incidents, nil
+}
+
+// Stop closes the connections to Redis.
+func (s *redisStore) Stop() stop.Result {
+	c := make(stop.Channel)
+	go func() {
+		c.Done(s.pool.Close())
+	}()
+	return c.Result()
+}
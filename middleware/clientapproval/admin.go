@@ -0,0 +1,130 @@
+package clientapproval
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/pkg/stop"
+)
+
+// adminPrefix is the path prefix of the admin API.
+const adminPrefix = "/clientapproval"
+
+// adminServer serves an HTTP API to modify the lists of a hook:
+//
+//	GET    /clientapproval                      lists all client IDs
+//	PUT    /clientapproval/whitelist/<clientID> adds a client ID
+//	DELETE /clientapproval/whitelist/<clientID> removes a client ID
+//
+// and likewise for the blacklist.
+type adminServer struct {
+	srv *http.Server
+}
+
+func newAdminServer(addr, token string, h *hook) (*adminServer, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(adminPrefix, adminHandler{h: h, token: token})
+	mux.Handle(adminPrefix+"/", adminHandler{h: h, token: token})
+
+	s := &adminServer{
+		srv: &http.Server{
+			Handler:           mux,
+			ReadHeaderTimeout: 10 * time.Second,
+		},
+	}
+
+	go func() {
+		if err := s.srv.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+			log.Error("failed while serving client approval admin API", log.Err(err))
+		}
+	}()
+
+	log.Info("started client approval admin API", log.Fields{"addr": ln.Addr()})
+	return s, nil
+}
+
+// Stop shuts down the server.
+func (s *adminServer) Stop() stop.Result {
+	c := make(stop.Channel)
+	go func() {
+		c.Done(s.srv.Shutdown(context.Background()))
+	}()
+	return c.Result()
+}
+
+type adminHandler struct {
+	h     *hook
+	token string
+}
+
+func (a adminHandler) authorized(r *http.Request) bool {
+	if a.token == "" {
+		return true
+	}
+	provided := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(provided), []byte(a.token)) == 1
+}
+
+func (a adminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !a.authorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, adminPrefix), "/")
+	if path == "" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string][]string{
+			"whitelist": a.h.snapshot(true),
+			"blacklist": a.h.snapshot(false),
+		})
+		return
+	}
+
+	parts := strings.SplitN(path, "/", 2)
+	if len(parts) != 2 || (parts[0] != "whitelist" && parts[0] != "blacklist") {
+		http.NotFound(w, r)
+		return
+	}
+	whitelist := parts[0] == "whitelist"
+	cid, err := parseClientID(parts[1])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		if err := a.h.add(whitelist, cid); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		log.Info("client approval: added client ID", log.Fields{"list": parts[0], "clientID": parts[1]})
+	case http.MethodDelete:
+		if !a.h.remove(whitelist, cid) {
+			http.NotFound(w, r)
+			return
+		}
+		log.Info("client approval: removed client ID", log.Fields{"list": parts[0], "clientID": parts[1]})
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -1,16 +1,22 @@
 // Package clientapproval implements a Hook that fails an Announce based on a
 // whitelist or blacklist of BitTorrent client IDs.
+//
+// The lists can optionally be modified at runtime through an HTTP API.
 package clientapproval
 
 import (
 	"context"
 	"errors"
 	"fmt"
+	"sort"
+	"sync"
 
 	yaml "gopkg.in/yaml.v2"
 
 	"github.com/chihaya/chihaya/bittorrent"
 	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/pkg/stop"
 )
 
 // Name is the name by which this middleware is registered with Chihaya.
@@ -35,18 +41,39 @@ func (d driver) NewHook(optionBytes []byte) (middleware.Hook, error) {
 }
 
 // ErrClientUnapproved is the error returned when a client's PeerID is invalid.
-var ErrClientUnapproved = bittorrent.ClientError("unapproved client")
+var ErrClientUnapproved = bittorrent.RegisterClientError("unapproved_client", "unapproved client")
 
 // Config represents all the values required by this middleware to validate
 // peers based on their BitTorrent client ID.
 type Config struct {
 	Whitelist []string `yaml:"whitelist"`
 	Blacklist []string `yaml:"blacklist"`
+
+	// AdminAddr, if set, is the address on which an HTTP API is served that
+	// allows adding and removing client IDs at runtime.
+	AdminAddr string `yaml:"admin_addr"`
+
+	// AdminToken, if set, must be provided as a bearer token to the admin
+	// API.
+	AdminToken string `yaml:"admin_token"`
+}
+
+// LogFields implements log.Fielder for a Config.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"whitelist": cfg.Whitelist,
+		"blacklist": cfg.Blacklist,
+		"adminAddr": cfg.AdminAddr,
+		"adminAuth": cfg.AdminToken != "",
+	}
 }
 
 type hook struct {
+	mu         sync.RWMutex
 	approved   map[bittorrent.ClientID]struct{}
 	unapproved map[bittorrent.ClientID]struct{}
+
+	admin *adminServer
 }
 
 // NewHook returns an instance of the client approval middleware.
@@ -57,35 +84,110 @@ func NewHook(cfg Config) (middleware.Hook, error) {
 	}
 
 	if len(cfg.Whitelist) > 0 && len(cfg.Blacklist) > 0 {
-		return nil, fmt.Errorf("using both whitelist and blacklist is invalid")
+		return nil, errBothLists
 	}
 
 	for _, cidString := range cfg.Whitelist {
-		cidBytes := []byte(cidString)
-		if len(cidBytes) != 6 {
-			return nil, errors.New("client ID " + cidString + " must be 6 bytes")
+		cid, err := parseClientID(cidString)
+		if err != nil {
+			return nil, err
 		}
-		var cid bittorrent.ClientID
-		copy(cid[:], cidBytes)
 		h.approved[cid] = struct{}{}
 	}
 
 	for _, cidString := range cfg.Blacklist {
-		cidBytes := []byte(cidString)
-		if len(cidBytes) != 6 {
-			return nil, errors.New("client ID " + cidString + " must be 6 bytes")
+		cid, err := parseClientID(cidString)
+		if err != nil {
+			return nil, err
 		}
-		var cid bittorrent.ClientID
-		copy(cid[:], cidBytes)
 		h.unapproved[cid] = struct{}{}
 	}
 
+	if cfg.AdminAddr != "" {
+		admin, err := newAdminServer(cfg.AdminAddr, cfg.AdminToken, h)
+		if err != nil {
+			return nil, err
+		}
+		h.admin = admin
+	}
+
 	return h, nil
 }
 
+var errBothLists = errors.New("using both whitelist and blacklist is invalid")
+
+func parseClientID(cidString string) (bittorrent.ClientID, error) {
+	var cid bittorrent.ClientID
+	cidBytes := []byte(cidString)
+	if len(cidBytes) != 6 {
+		return cid, errors.New("client ID " + cidString + " must be 6 bytes")
+	}
+	copy(cid[:], cidBytes)
+	return cid, nil
+}
+
+// list returns the whitelist or the blacklist.
+// The caller must hold h.mu.
+func (h *hook) list(whitelist bool) map[bittorrent.ClientID]struct{} {
+	if whitelist {
+		return h.approved
+	}
+	return h.unapproved
+}
+
+// add adds a client ID to the whitelist or the blacklist.
+// It fails if the other list is not empty.
+func (h *hook) add(whitelist bool, cid bittorrent.ClientID) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.list(!whitelist)) > 0 {
+		return errBothLists
+	}
+	h.list(whitelist)[cid] = struct{}{}
+	return nil
+}
+
+// remove removes a client ID from the whitelist or the blacklist and returns
+// whether it was present.
+func (h *hook) remove(whitelist bool, cid bittorrent.ClientID) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	list := h.list(whitelist)
+	_, found := list[cid]
+	delete(list, cid)
+	return found
+}
+
+// snapshot returns the client IDs of the whitelist or the blacklist.
+func (h *hook) snapshot(whitelist bool) []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	list := h.list(whitelist)
+	cids := make([]string, 0, len(list))
+	for cid := range list {
+		cids = append(cids, string(cid[:]))
+	}
+	sort.Strings(cids)
+	return cids
+}
+
+// Stop stops the admin API, if it is running.
+func (h *hook) Stop() stop.Result {
+	if h.admin == nil {
+		return stop.AlreadyStopped
+	}
+	return h.admin.Stop()
+}
+
 func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
 	clientID := bittorrent.NewClientID(req.Peer.ID)
 
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
 	if len(h.approved) > 0 {
 		if _, found := h.approved[clientID]; !found {
 			return ctx, ErrClientUnapproved
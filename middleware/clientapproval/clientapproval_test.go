@@ -2,7 +2,10 @@ package clientapproval
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -73,3 +76,56 @@ func TestHandleAnnounce(t *testing.T) {
 		})
 	}
 }
+
+func TestAdminAPI(t *testing.T) {
+	mh, err := NewHook(Config{Whitelist: []string{"010203"}})
+	require.Nil(t, err)
+	h := mh.(*hook)
+	handler := adminHandler{h: h, token: "secret"}
+
+	do := func(method, path, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	var table = []struct {
+		method string
+		path   string
+		token  string
+		code   int
+	}{
+		{http.MethodPut, "/clientapproval/whitelist/123456", "", http.StatusUnauthorized},
+		{http.MethodPut, "/clientapproval/whitelist/123456", "wrong", http.StatusUnauthorized},
+		{http.MethodPut, "/clientapproval/whitelist/123456", "secret", http.StatusNoContent},
+		{http.MethodPut, "/clientapproval/whitelist/1234", "secret", http.StatusBadRequest},
+		{http.MethodPut, "/clientapproval/blacklist/654321", "secret", http.StatusConflict},
+		{http.MethodPut, "/clientapproval/graylist/654321", "secret", http.StatusNotFound},
+		{http.MethodDelete, "/clientapproval/whitelist/010203", "secret", http.StatusNoContent},
+		{http.MethodDelete, "/clientapproval/whitelist/010203", "secret", http.StatusNotFound},
+		{http.MethodPost, "/clientapproval", "secret", http.StatusMethodNotAllowed},
+	}
+	for _, tt := range table {
+		require.Equal(t, tt.code, do(tt.method, tt.path, tt.token).Code, "%s %s", tt.method, tt.path)
+	}
+
+	rr := do(http.MethodGet, "/clientapproval", "secret")
+	require.Equal(t, http.StatusOK, rr.Code)
+	var lists map[string][]string
+	require.Nil(t, json.NewDecoder(rr.Body).Decode(&lists))
+	require.Equal(t, []string{"123456"}, lists["whitelist"])
+	require.Empty(t, lists["blacklist"])
+
+	req := &bittorrent.AnnounceRequest{}
+	req.Peer.ID = bittorrent.PeerIDFromString("01020304050607080900")
+	_, err = h.HandleAnnounce(context.Background(), req, &bittorrent.AnnounceResponse{})
+	require.Equal(t, ErrClientUnapproved, err)
+
+	req.Peer.ID = bittorrent.PeerIDFromString("12345604050607080900")
+	_, err = h.HandleAnnounce(context.Background(), req, &bittorrent.AnnounceResponse{})
+	require.Nil(t, err)
+}
@@ -0,0 +1,271 @@
+// Package dedup implements a Hook that answers repeated identical announces
+// of a peer with the response to its first announce, without touching the
+// storage again.
+package dedup
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/pkg/timecache"
+)
+
+// Name is the name by which this middleware is registered with Chihaya.
+const Name = "announce deduplication"
+
+func init() {
+	middleware.RegisterDriver(Name, driver{})
+	prometheus.MustRegister(promDeduplicatedAnnounces)
+}
+
+var promDeduplicatedAnnounces = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "chihaya_dedup_deduplicated_announces_total",
+	Help: "The number of announces answered with the cached response to an identical announce",
+})
+
+var _ middleware.Driver = driver{}
+
+type driver struct{}
+
+func (d driver) NewHook(optionBytes []byte) (middleware.Hook, error) {
+	var cfg Config
+	err := yaml.Unmarshal(optionBytes, &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid options for middleware %s: %w", Name, err)
+	}
+
+	return NewHook(cfg)
+}
+
+// Config represents all the values required by this middleware to
+// deduplicate announces.
+type Config struct {
+	// Window is the duration after an announce during which identical
+	// announces of the same peer are answered with the cached response.
+	Window time.Duration `yaml:"window"`
+
+	// CacheSize is the maximum number of cached responses.
+	CacheSize int `yaml:"cache_size"`
+}
+
+// LogFields implements log.Fielder for a Config.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"window":    cfg.Window,
+		"cacheSize": cfg.CacheSize,
+	}
+}
+
+// Default config constants.
+const (
+	defaultWindow    = 5 * time.Second
+	defaultCacheSize = 100000
+)
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+//
+// This function warns to the logger when a value is changed.
+func (cfg Config) Validate() Config {
+	validcfg := cfg
+
+	if cfg.Window <= 0 {
+		validcfg.Window = defaultWindow
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".Window",
+			"provided": cfg.Window,
+			"default":  validcfg.Window,
+		})
+	}
+
+	if cfg.CacheSize <= 0 {
+		validcfg.CacheSize = defaultCacheSize
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".CacheSize",
+			"provided": cfg.CacheSize,
+			"default":  validcfg.CacheSize,
+		})
+	}
+
+	return validcfg
+}
+
+// shardCount is the number of shards the cached responses are distributed
+// over to reduce lock contention.
+const shardCount = 256
+
+// peerKey identifies a peer in a swarm.
+type peerKey struct {
+	infoHash bittorrent.InfoHash
+	peerID   bittorrent.PeerID
+}
+
+// announceParams are the parameters of an announce that must match for two
+// announces of a peer to be identical.
+type announceParams struct {
+	ip         [16]byte
+	port       uint16
+	event      bittorrent.Event
+	left       uint64
+	downloaded uint64
+	uploaded   uint64
+	numWant    uint32
+	compact    bool
+}
+
+// entry is the cached response to the last announce of a peer.
+type entry struct {
+	params announceParams
+	resp   bittorrent.AnnounceResponse
+	// created is the time of the announce in nanoseconds since the epoch.
+	created int64
+}
+
+// slot records the insertion of an entry, so that entries can be evicted in
+// the order they were inserted.
+type slot struct {
+	key     peerKey
+	created int64
+}
+
+type shard struct {
+	sync.Mutex
+	entries map[peerKey]entry
+
+	// slots is a ring buffer of the insertions, oldest first.
+	slots []slot
+	head  int
+	n     int
+}
+
+type hook struct {
+	window int64
+	shards [shardCount]shard
+}
+
+// NewHook returns an instance of the announce deduplication middleware.
+func NewHook(provided Config) (middleware.Hook, error) {
+	cfg := provided.Validate()
+	h := &hook{window: int64(cfg.Window)}
+
+	perShard := (cfg.CacheSize + shardCount - 1) / shardCount
+	for i := range h.shards {
+		h.shards[i].entries = make(map[peerKey]entry)
+		h.shards[i].slots = make([]slot, perShard)
+	}
+
+	return h, nil
+}
+
+func key(req *bittorrent.AnnounceRequest) peerKey {
+	return peerKey{infoHash: req.InfoHash, peerID: req.Peer.ID}
+}
+
+func params(req *bittorrent.AnnounceRequest) announceParams {
+	p := announceParams{
+		port:       req.Port,
+		event:      req.Event,
+		left:       req.Left,
+		downloaded: req.Downloaded,
+		uploaded:   req.Uploaded,
+		numWant:    req.NumWant,
+		compact:    req.Compact,
+	}
+	copy(p.ip[:], req.IP.To16())
+	return p
+}
+
+// lookup returns the cached response to an announce identical to the one
+// with the given parameters, if it was made less than the window before now.
+func (h *hook) lookup(k peerKey, p announceParams, now int64) (bittorrent.AnnounceResponse, bool) {
+	s := &h.shards[k.infoHash[0]]
+	s.Lock()
+	defer s.Unlock()
+
+	e, ok := s.entries[k]
+	if !ok || e.params != p || now-e.created >= h.window {
+		return bittorrent.AnnounceResponse{}, false
+	}
+	return e.resp, true
+}
+
+// store caches the response to an announce, replacing the previous entry of
+// the peer.
+// If the shard is full, the oldest entries are evicted.
+func (h *hook) store(k peerKey, e entry) {
+	s := &h.shards[k.infoHash[0]]
+	s.Lock()
+	defer s.Unlock()
+
+	if s.n == len(s.slots) {
+		oldest := s.slots[s.head]
+		// The entry may have been replaced by a later announce of the peer,
+		// which has its own slot.
+		if cur, ok := s.entries[oldest.key]; ok && cur.created == oldest.created {
+			delete(s.entries, oldest.key)
+		}
+		s.head = (s.head + 1) % len(s.slots)
+		s.n--
+	}
+
+	s.entries[k] = e
+	s.slots[(s.head+s.n)%len(s.slots)] = slot{key: k, created: e.created}
+	s.n++
+}
+
+// clonePeers copies peers, so that cached responses are not changed through
+// the responses they are copied into.
+func clonePeers(peers []bittorrent.Peer) []bittorrent.Peer {
+	if peers == nil {
+		return nil
+	}
+	return append(make([]bittorrent.Peer, 0, len(peers)), peers...)
+}
+
+func cloneResponse(resp bittorrent.AnnounceResponse) bittorrent.AnnounceResponse {
+	resp.IPv4Peers = clonePeers(resp.IPv4Peers)
+	resp.IPv6Peers = clonePeers(resp.IPv6Peers)
+	if resp.ExternalIP != nil {
+		resp.ExternalIP = append(net.IP(nil), resp.ExternalIP...)
+	}
+	return resp
+}
+
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	cached, ok := h.lookup(key(req), params(req), timecache.NowUnixNano())
+	if !ok {
+		return ctx, nil
+	}
+
+	promDeduplicatedAnnounces.Inc()
+	*resp = cloneResponse(cached)
+
+	// The swarm has already been updated for the identical announce.
+	ctx = context.WithValue(ctx, middleware.SkipResponseHookKey, struct{}{})
+	ctx = context.WithValue(ctx, middleware.SkipSwarmInteractionKey, struct{}{})
+	return ctx, nil
+}
+
+// AdjustAnnounceResponse implements middleware.AnnounceResponseAdjuster to
+// cache the response to every announce that was not deduplicated.
+func (h *hook) AdjustAnnounceResponse(req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) {
+	h.store(key(req), entry{
+		params:  params(req),
+		resp:    cloneResponse(*resp),
+		created: timecache.NowUnixNano(),
+	})
+}
+
+func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrapes don't modify any state, so they are not deduplicated.
+	return ctx, nil
+}
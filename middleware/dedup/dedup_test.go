@@ -0,0 +1,105 @@
+package dedup
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+)
+
+func announceRequest(left uint64) *bittorrent.AnnounceRequest {
+	return &bittorrent.AnnounceRequest{
+		InfoHash: bittorrent.InfoHash{1},
+		Left:     left,
+		NumWant:  50,
+		Peer: bittorrent.Peer{
+			ID:   bittorrent.PeerID{1},
+			IP:   bittorrent.IP{IP: net.IPv4(10, 0, 0, 1), AddressFamily: bittorrent.IPv4},
+			Port: 6881,
+		},
+	}
+}
+
+func TestHandleAnnounce(t *testing.T) {
+	mh, err := NewHook(Config{Window: time.Hour})
+	require.Nil(t, err)
+	h := mh.(*hook)
+
+	peer := bittorrent.Peer{ID: bittorrent.PeerID{2}, IP: bittorrent.IP{IP: net.IPv4(10, 0, 0, 2), AddressFamily: bittorrent.IPv4}}
+	ctx, resp := context.Background(), &bittorrent.AnnounceResponse{}
+	ctx, err = h.HandleAnnounce(ctx, announceRequest(10), resp)
+	require.Nil(t, err)
+	require.Nil(t, ctx.Value(middleware.SkipResponseHookKey))
+
+	resp.Interval = time.Minute
+	resp.IPv4Peers = []bittorrent.Peer{peer}
+	h.AdjustAnnounceResponse(announceRequest(10), resp)
+
+	// An identical announce is answered with a copy of the cached response.
+	ctx, resp = context.Background(), &bittorrent.AnnounceResponse{}
+	ctx, err = h.HandleAnnounce(ctx, announceRequest(10), resp)
+	require.Nil(t, err)
+	require.NotNil(t, ctx.Value(middleware.SkipResponseHookKey))
+	require.NotNil(t, ctx.Value(middleware.SkipSwarmInteractionKey))
+	require.Equal(t, time.Minute, resp.Interval)
+	require.Equal(t, []bittorrent.Peer{peer}, resp.IPv4Peers)
+
+	resp.IPv4Peers[0].Port = 1
+	resp2 := &bittorrent.AnnounceResponse{}
+	_, err = h.HandleAnnounce(context.Background(), announceRequest(10), resp2)
+	require.Nil(t, err)
+	require.Equal(t, []bittorrent.Peer{peer}, resp2.IPv4Peers)
+
+	// A different announce is handled normally.
+	ctx, err = h.HandleAnnounce(context.Background(), announceRequest(5), &bittorrent.AnnounceResponse{})
+	require.Nil(t, err)
+	require.Nil(t, ctx.Value(middleware.SkipResponseHookKey))
+}
+
+func TestLookup(t *testing.T) {
+	mh, err := NewHook(Config{Window: time.Minute})
+	require.Nil(t, err)
+	h := mh.(*hook)
+
+	req := announceRequest(10)
+	start := time.Now().UnixNano()
+	h.store(key(req), entry{params: params(req), resp: bittorrent.AnnounceResponse{Complete: 1}, created: start})
+
+	_, ok := h.lookup(key(req), params(req), start+int64(30*time.Second))
+	require.True(t, ok)
+	_, ok = h.lookup(key(req), params(req), start+int64(time.Minute))
+	require.False(t, ok)
+
+	// A later announce of the peer replaces its entry, so the first one is
+	// not served anymore.
+	later := announceRequest(0)
+	h.store(key(later), entry{params: params(later), created: start + 1})
+	_, ok = h.lookup(key(req), params(req), start+2)
+	require.False(t, ok)
+	_, ok = h.lookup(key(later), params(later), start+2)
+	require.True(t, ok)
+}
+
+func TestStoreEviction(t *testing.T) {
+	mh, err := NewHook(Config{Window: time.Minute, CacheSize: 2 * shardCount})
+	require.Nil(t, err)
+	h := mh.(*hook)
+
+	now := time.Now().UnixNano()
+	for i := 0; i < 3; i++ {
+		req := announceRequest(10)
+		req.Peer.ID = bittorrent.PeerID{byte(i)}
+		h.store(key(req), entry{params: params(req), created: now})
+	}
+
+	// The shard holds two entries, the oldest one was evicted.
+	s := &h.shards[1]
+	require.Len(t, s.entries, 2)
+	_, ok := s.entries[peerKey{infoHash: bittorrent.InfoHash{1}, peerID: bittorrent.PeerID{0}}]
+	require.False(t, ok)
+}
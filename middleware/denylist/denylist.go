@@ -0,0 +1,416 @@
+// Package denylist implements a Hook that rejects announces and scrapes of
+// infohashes matching a list of hexadecimal prefixes or regular expressions,
+// e.g. to comply with takedown requests.
+//
+// The rules can be configured statically and loaded from an HTTP(S) URL or a
+// file, which is refreshed periodically. Rules can also be added at runtime
+// through the admin API.
+package denylist
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/middleware/pkg/listsource"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/pkg/stop"
+)
+
+// Name is the name by which this middleware is registered with Chihaya.
+const Name = "infohash deny list"
+
+// ListName is the name of the List of rules added at runtime through the
+// admin API.
+const ListName = "denylist"
+
+func init() {
+	middleware.RegisterDriver(Name, driver{})
+	middleware.RegisterList(ListName, runtimeList)
+	prometheus.MustRegister(promMatches)
+}
+
+var promMatches = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "chihaya_denylist_matches_total",
+		Help: "The number of requests rejected by the infohash deny list, by rule",
+	},
+	[]string{"rule"},
+)
+
+var _ middleware.Driver = driver{}
+
+type driver struct{}
+
+func (d driver) NewHook(optionBytes []byte) (middleware.Hook, error) {
+	var cfg Config
+	err := yaml.Unmarshal(optionBytes, &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid options for middleware %s: %w", Name, err)
+	}
+
+	return NewHook(cfg)
+}
+
+// ErrInfoHashDenied is the error returned for requests of a denied infohash.
+var ErrInfoHashDenied = bittorrent.RegisterClientError("infohash_denied", "infohash denied")
+
+// Config represents all the values required by this middleware to deny
+// infohashes.
+type Config struct {
+	// Prefixes are hexadecimal prefixes of denied infohashes.
+	// A complete infohash is a prefix as well. Complete v2 infohashes are
+	// truncated to 20 bytes like the infohashes of announces.
+	Prefixes []string `yaml:"prefixes"`
+
+	// Regexes are regular expressions matched against the lowercase
+	// hexadecimal representation of infohashes, which is 40 characters long
+	// for v2 infohashes as well.
+	Regexes []string `yaml:"regexes"`
+
+	// ListURL is an HTTP(S) URL or the path of a file from which additional
+	// rules are loaded. The list contains one rule per line, which is either
+	// a prefix or a regular expression prefixed with "re:". Comments starting
+	// with '#' or ';' are ignored, so regular expressions in the list cannot
+	// contain these characters.
+	ListURL string `yaml:"list_url"`
+
+	// ListUpdateInterval is the interval at which the list is reloaded from
+	// ListURL.
+	ListUpdateInterval time.Duration `yaml:"list_update_interval"`
+}
+
+// LogFields implements log.Fielder for a Config.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"prefixes":           len(cfg.Prefixes),
+		"regexes":            len(cfg.Regexes),
+		"listURL":            cfg.ListURL,
+		"listUpdateInterval": cfg.ListUpdateInterval,
+	}
+}
+
+const defaultListUpdateInterval = 5 * time.Minute
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+//
+// This function warns to the logger when a value is changed.
+func (cfg Config) Validate() Config {
+	validcfg := cfg
+
+	if cfg.ListURL != "" && cfg.ListUpdateInterval <= 0 {
+		validcfg.ListUpdateInterval = defaultListUpdateInterval
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".ListUpdateInterval",
+			"provided": cfg.ListUpdateInterval,
+			"default":  validcfg.ListUpdateInterval,
+		})
+	}
+
+	return validcfg
+}
+
+// regexPrefix marks regular expressions in a list.
+const regexPrefix = "re:"
+
+type regexRule struct {
+	rule string
+	re   *regexp.Regexp
+}
+
+// rules is a compiled set of rules.
+type rules struct {
+	// hashes are the prefixes that are complete infohashes.
+	hashes   map[string]string
+	prefixes []string
+	regexes  []regexRule
+}
+
+func newRules() *rules {
+	return &rules{hashes: make(map[string]string)}
+}
+
+func (r *rules) addPrefix(prefix string) error {
+	prefix = strings.ToLower(prefix)
+	if len(prefix) == 2*bittorrent.InfoHashV2Len {
+		// Announces of v2 infohashes are truncated, so must be the denied
+		// infohashes.
+		if _, err := hex.DecodeString(prefix + strings.Repeat("0", len(prefix)%2)); err != nil {
+			return fmt.Errorf("invalid prefix %q: %w", prefix, err)
+		}
+		prefix = prefix[:2*len(bittorrent.InfoHash{})]
+	}
+	if len(prefix) == 0 || len(prefix) > 2*len(bittorrent.InfoHash{}) {
+		return fmt.Errorf("invalid prefix %q", prefix)
+	}
+	// Allow odd lengths by validating the prefix padded to whole bytes.
+	if _, err := hex.DecodeString(prefix + strings.Repeat("0", len(prefix)%2)); err != nil {
+		return fmt.Errorf("invalid prefix %q: %w", prefix, err)
+	}
+
+	if len(prefix) == 2*len(bittorrent.InfoHash{}) {
+		r.hashes[prefix] = "prefix:" + prefix
+	} else {
+		r.prefixes = append(r.prefixes, prefix)
+	}
+	return nil
+}
+
+func (r *rules) addRegex(expr string) error {
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return fmt.Errorf("invalid regex %q: %w", expr, err)
+	}
+	r.regexes = append(r.regexes, regexRule{rule: "regex:" + expr, re: re})
+	return nil
+}
+
+// match returns the rule that the infohash matches, if any.
+func (r *rules) match(ih bittorrent.InfoHash) (rule string, matched bool) {
+	s := ih.String()
+	if rule, ok := r.hashes[s]; ok {
+		return rule, true
+	}
+	for _, prefix := range r.prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return "prefix:" + prefix, true
+		}
+	}
+	for _, rr := range r.regexes {
+		if rr.re.MatchString(s) {
+			return rr.rule, true
+		}
+	}
+	return "", false
+}
+
+// addRule adds a rule of a list, which is a prefix or a regular expression
+// prefixed with "re:".
+func (r *rules) addRule(entry string) error {
+	if strings.HasPrefix(entry, regexPrefix) {
+		return r.addRegex(strings.TrimPrefix(entry, regexPrefix))
+	}
+	return r.addPrefix(entry)
+}
+
+// runtimeList holds the rules added at runtime through the admin API, which
+// are checked by all hooks in addition to their own rules.
+var runtimeList = &dynamicList{entries: make(map[string]struct{}), rules: newRules()}
+
+// dynamicList implements middleware.List for rules.
+type dynamicList struct {
+	mu      sync.RWMutex
+	entries map[string]struct{}
+	rules   *rules
+}
+
+var _ middleware.List = &dynamicList{}
+
+// rebuild rebuilds the rules from the entries. The lock must be held.
+func (l *dynamicList) rebuild() {
+	r := newRules()
+	for entry := range l.entries {
+		// The entries were validated when they were added.
+		_ = r.addRule(entry)
+	}
+	l.rules = r
+}
+
+func (l *dynamicList) Add(entry string) error {
+	if err := newRules().addRule(entry); err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries[entry] = struct{}{}
+	l.rebuild()
+	return nil
+}
+
+func (l *dynamicList) Remove(entry string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.entries[entry]; !ok {
+		return false
+	}
+	delete(l.entries, entry)
+	l.rebuild()
+	return true
+}
+
+func (l *dynamicList) Entries() []string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	entries := make([]string, 0, len(l.entries))
+	for entry := range l.entries {
+		entries = append(entries, entry)
+	}
+	sort.Strings(entries)
+	return entries
+}
+
+func (l *dynamicList) match(ih bittorrent.InfoHash) (rule string, matched bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.rules.match(ih)
+}
+
+type hook struct {
+	cfg Config
+
+	mu    sync.RWMutex
+	rules *rules
+
+	source  *listsource.Source
+	closing chan struct{}
+	wg      sync.WaitGroup
+}
+
+// NewHook returns an instance of the infohash deny list middleware.
+func NewHook(provided Config) (middleware.Hook, error) {
+	cfg := provided.Validate()
+	h := &hook{
+		cfg:     cfg,
+		closing: make(chan struct{}),
+	}
+
+	var err error
+	if h.rules, err = h.compile(nil); err != nil {
+		return nil, err
+	}
+
+	if cfg.ListURL != "" {
+		h.source = listsource.New(cfg.ListURL)
+		if err := h.refresh(); err != nil {
+			return nil, fmt.Errorf("failed to load initial list: %w", err)
+		}
+
+		h.wg.Add(1)
+		go h.runRefresh(cfg.ListUpdateInterval)
+	}
+
+	return h, nil
+}
+
+// compile compiles the configured rules and the rules of a list.
+func (h *hook) compile(list []string) (*rules, error) {
+	r := newRules()
+	for _, prefix := range h.cfg.Prefixes {
+		if err := r.addPrefix(prefix); err != nil {
+			return nil, err
+		}
+	}
+	for _, expr := range h.cfg.Regexes {
+		if err := r.addRegex(expr); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, entry := range list {
+		if err := r.addRule(entry); err != nil {
+			return nil, err
+		}
+	}
+
+	return r, nil
+}
+
+// refresh reloads the list from its source, if it has changed.
+func (h *hook) refresh() error {
+	list, changed, err := h.source.Fetch()
+	if err != nil {
+		return err
+	}
+	if !changed {
+		log.Debug("infohash deny list unchanged", log.Fields{"url": h.source.URL()})
+		return nil
+	}
+
+	r, err := h.compile(list)
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	h.rules = r
+	h.mu.Unlock()
+
+	log.Debug("loaded infohash deny list", log.Fields{
+		"url":   h.source.URL(),
+		"count": len(list),
+	})
+	return nil
+}
+
+// runRefresh periodically reloads the list until the hook is stopped.
+// If the list cannot be loaded, the previous list is kept.
+func (h *hook) runRefresh(interval time.Duration) {
+	defer h.wg.Done()
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-h.closing:
+			return
+		case <-t.C:
+			if err := h.refresh(); err != nil {
+				log.Error("failed to refresh infohash deny list", log.Fields{"url": h.source.URL()}, log.Err(err))
+			}
+		}
+	}
+}
+
+// Stop stops refreshing the list.
+func (h *hook) Stop() stop.Result {
+	select {
+	case <-h.closing:
+		return stop.AlreadyStopped
+	default:
+	}
+	c := make(stop.Channel)
+	go func() {
+		close(h.closing)
+		h.wg.Wait()
+		c.Done()
+	}()
+	return c.Result()
+}
+
+// check returns ErrInfoHashDenied if any of the infohashes is denied.
+func (h *hook) check(infoHashes ...bittorrent.InfoHash) error {
+	h.mu.RLock()
+	r := h.rules
+	h.mu.RUnlock()
+
+	for _, ih := range infoHashes {
+		rule, matched := r.match(ih)
+		if !matched {
+			rule, matched = runtimeList.match(ih)
+		}
+		if matched {
+			promMatches.WithLabelValues(rule).Inc()
+			return ErrInfoHashDenied
+		}
+	}
+	return nil
+}
+
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	return ctx, h.check(req.InfoHash)
+}
+
+func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	return ctx, h.check(req.InfoHashes...)
+}
@@ -0,0 +1,114 @@
+package denylist
+
+import (
+	"context"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+func infoHash(t *testing.T, s string) bittorrent.InfoHash {
+	b, err := hex.DecodeString(s)
+	require.Nil(t, err)
+	return bittorrent.InfoHashFromBytes(b)
+}
+
+func TestMatch(t *testing.T) {
+	mh, err := NewHook(Config{
+		Prefixes: []string{"ABCD", "123", "3532cf2d327fad8448c075b4cb42c8136964a435", "caa1ab1d99efa7c5aa7e2d39c63ba6b4a2b1d45be0dd03b6a8a8e0ed2f4b0a1c"},
+		Regexes:  []string{"^ff.*00$"},
+	})
+	require.Nil(t, err)
+	h := mh.(*hook)
+
+	var tests = []struct {
+		infoHash string
+		rule     string
+	}{
+		{"abcd000000000000000000000000000000000000", "prefix:abcd"},
+		{"1234000000000000000000000000000000000000", "prefix:123"},
+		{"1240000000000000000000000000000000000000", ""},
+		{"3532cf2d327fad8448c075b4cb42c8136964a435", "prefix:3532cf2d327fad8448c075b4cb42c8136964a435"},
+		{"3532cf2d327fad8448c075b4cb42c8136964a436", ""},
+		{"caa1ab1d99efa7c5aa7e2d39c63ba6b4a2b1d45b", "prefix:caa1ab1d99efa7c5aa7e2d39c63ba6b4a2b1d45b"},
+		{"ff00000000000000000000000000000000000000", "regex:^ff.*00$"},
+		{"ff00000000000000000000000000000000000001", ""},
+	}
+	for _, tt := range tests {
+		rule, matched := h.rules.match(infoHash(t, tt.infoHash))
+		require.Equal(t, tt.rule != "", matched, tt.infoHash)
+		require.Equal(t, tt.rule, rule, tt.infoHash)
+	}
+}
+
+func TestHandleRequests(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "denylist")
+	require.Nil(t, os.WriteFile(path, []byte("# takedowns\nabcd\nre:^ff\n"), 0o600))
+
+	mh, err := NewHook(Config{ListURL: path})
+	require.Nil(t, err)
+	h := mh.(*hook)
+	defer func() { require.Nil(t, h.Stop().Wait()) }()
+
+	denied := infoHash(t, "ff00000000000000000000000000000000000000")
+	allowed := infoHash(t, "0000000000000000000000000000000000000000")
+
+	_, err = h.HandleAnnounce(context.Background(), &bittorrent.AnnounceRequest{InfoHash: denied}, &bittorrent.AnnounceResponse{})
+	require.Equal(t, ErrInfoHashDenied, err)
+	_, err = h.HandleAnnounce(context.Background(), &bittorrent.AnnounceRequest{InfoHash: allowed}, &bittorrent.AnnounceResponse{})
+	require.Nil(t, err)
+
+	// A scrape is denied if any of its infohashes is.
+	_, err = h.HandleScrape(context.Background(), &bittorrent.ScrapeRequest{InfoHashes: []bittorrent.InfoHash{allowed, denied}}, &bittorrent.ScrapeResponse{})
+	require.Equal(t, ErrInfoHashDenied, err)
+
+	// Invalid lists are not applied.
+	require.Nil(t, os.WriteFile(path, []byte("re:(\n"), 0o600))
+	require.Nil(t, os.Chtimes(path, time.Now(), time.Now().Add(time.Minute)))
+	require.NotNil(t, h.refresh())
+	_, err = h.HandleAnnounce(context.Background(), &bittorrent.AnnounceRequest{InfoHash: denied}, &bittorrent.AnnounceResponse{})
+	require.Equal(t, ErrInfoHashDenied, err)
+
+	require.Nil(t, os.WriteFile(path, nil, 0o600))
+	require.Nil(t, os.Chtimes(path, time.Now(), time.Now().Add(2*time.Minute)))
+	require.Nil(t, h.refresh())
+	_, err = h.HandleAnnounce(context.Background(), &bittorrent.AnnounceRequest{InfoHash: denied}, &bittorrent.AnnounceResponse{})
+	require.Nil(t, err)
+}
+
+func TestRuntimeList(t *testing.T) {
+	mh, err := NewHook(Config{})
+	require.Nil(t, err)
+	h := mh.(*hook)
+	defer func() { require.Nil(t, h.Stop().Wait()) }()
+
+	denied := infoHash(t, "ff00000000000000000000000000000000000000")
+
+	require.NotNil(t, runtimeList.Add("re:("))
+	require.Nil(t, runtimeList.Add("ff00000000000000000000000000000000000000"))
+	require.Equal(t, []string{"ff00000000000000000000000000000000000000"}, runtimeList.Entries())
+	_, err = h.HandleAnnounce(context.Background(), &bittorrent.AnnounceRequest{InfoHash: denied}, &bittorrent.AnnounceResponse{})
+	require.Equal(t, ErrInfoHashDenied, err)
+
+	require.True(t, runtimeList.Remove("ff00000000000000000000000000000000000000"))
+	_, err = h.HandleAnnounce(context.Background(), &bittorrent.AnnounceRequest{InfoHash: denied}, &bittorrent.AnnounceResponse{})
+	require.Nil(t, err)
+}
+
+func TestConfig(t *testing.T) {
+	for _, cfg := range []Config{
+		{Prefixes: []string{"xyz"}},
+		{Prefixes: []string{""}},
+		{Prefixes: []string{"3532cf2d327fad8448c075b4cb42c8136964a4350"}},
+		{Regexes: []string{"["}},
+	} {
+		_, err := NewHook(cfg)
+		require.NotNil(t, err, "%#v", cfg)
+	}
+}
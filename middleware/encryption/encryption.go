@@ -0,0 +1,371 @@
+// Package encryption implements a Hook that handles the crypto announce
+// parameters, by which clients announce their support for encrypted
+// connections (message stream encryption).
+//
+// Clients send supportcrypto=1 if they support encrypted connections and
+// requirecrypto=1 if they only accept encrypted connections. Clients that
+// require encryption may announce port 0, so that clients not supporting it
+// don't connect, and send the port they listen on as cryptoport instead.
+//
+// The preferences are remembered per peer endpoint, so that peers that
+// require encryption are only returned to peers that support it, and peers
+// that require encryption only get peers that support it. This works with
+// any PeerStore, because the peers are filtered after they have been fetched
+// from storage.
+package encryption
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/pkg/stop"
+	"github.com/chihaya/chihaya/pkg/timecache"
+)
+
+// Name is the name by which this middleware is registered with Chihaya.
+const Name = "encryption"
+
+func init() {
+	middleware.RegisterDriver(Name, driver{})
+}
+
+var _ middleware.Driver = driver{}
+
+type driver struct{}
+
+func (d driver) NewHook(optionBytes []byte) (middleware.Hook, error) {
+	var cfg Config
+	err := yaml.Unmarshal(optionBytes, &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid options for middleware %s: %w", Name, err)
+	}
+
+	return NewHook(cfg), nil
+}
+
+// Config represents all the values required by this middleware to handle
+// the crypto announce parameters.
+type Config struct {
+	// FilterPeers enables filtering the peers of announce responses by their
+	// crypto preferences. Otherwise only the cryptoport parameter is applied.
+	FilterPeers bool `yaml:"filter_peers"`
+
+	// CandidatesFactor is the multiple of the requested number of peers that
+	// is fetched from storage to filter peers from.
+	CandidatesFactor int `yaml:"candidates_factor"`
+
+	// PeerLifetime is the duration for which the crypto preferences of a
+	// peer are remembered after its last announce. It should match the peer
+	// lifetime of the storage.
+	PeerLifetime time.Duration `yaml:"peer_lifetime"`
+
+	// GarbageCollectionInterval is the interval at which expired preferences
+	// are removed.
+	GarbageCollectionInterval time.Duration `yaml:"gc_interval"`
+}
+
+// LogFields implements log.Fielder for a Config.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"filterPeers":      cfg.FilterPeers,
+		"candidatesFactor": cfg.CandidatesFactor,
+		"peerLifetime":     cfg.PeerLifetime,
+		"gcInterval":       cfg.GarbageCollectionInterval,
+	}
+}
+
+// Default config constants.
+const (
+	defaultCandidatesFactor          = 2
+	defaultPeerLifetime              = 31 * time.Minute
+	defaultGarbageCollectionInterval = 3 * time.Minute
+)
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+//
+// This function warns to the logger when a value is changed.
+func (cfg Config) Validate() Config {
+	validcfg := cfg
+
+	if cfg.CandidatesFactor <= 0 {
+		validcfg.CandidatesFactor = defaultCandidatesFactor
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".CandidatesFactor",
+			"provided": cfg.CandidatesFactor,
+			"default":  validcfg.CandidatesFactor,
+		})
+	}
+
+	if cfg.PeerLifetime <= 0 {
+		validcfg.PeerLifetime = defaultPeerLifetime
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".PeerLifetime",
+			"provided": cfg.PeerLifetime,
+			"default":  validcfg.PeerLifetime,
+		})
+	}
+
+	if cfg.GarbageCollectionInterval <= 0 {
+		validcfg.GarbageCollectionInterval = defaultGarbageCollectionInterval
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".GarbageCollectionInterval",
+			"provided": cfg.GarbageCollectionInterval,
+			"default":  validcfg.GarbageCollectionInterval,
+		})
+	}
+
+	return validcfg
+}
+
+// Preference is the support of a peer for encrypted connections.
+type Preference uint8
+
+// The crypto preferences a peer can announce.
+const (
+	// Plaintext is the preference of peers that don't announce support for
+	// encryption.
+	Plaintext Preference = iota
+	// Supported is the preference of peers that accept both encrypted and
+	// plaintext connections.
+	Supported
+	// Required is the preference of peers that only accept encrypted
+	// connections.
+	Required
+)
+
+// ParsePreference returns the crypto preference and the crypto port of an
+// announce. The port is zero if none was provided.
+func ParsePreference(req *bittorrent.AnnounceRequest) (Preference, uint16) {
+	if req.Params == nil {
+		return Plaintext, 0
+	}
+
+	pref := Plaintext
+	if flagSet(req.Params, "requirecrypto") {
+		pref = Required
+	} else if flagSet(req.Params, "supportcrypto") {
+		pref = Supported
+	}
+
+	var port uint16
+	if s, ok := req.Params.String("cryptoport"); ok {
+		if p, err := strconv.ParseUint(s, 10, 16); err == nil {
+			port = uint16(p)
+		}
+	}
+	return pref, port
+}
+
+func flagSet(params bittorrent.Params, key string) bool {
+	s, ok := params.String(key)
+	return ok && s == "1"
+}
+
+// shardCount is the number of shards the preferences are distributed over to
+// reduce lock contention.
+const shardCount = 256
+
+// endpoint identifies a peer by its IP address in its 16-byte form and its
+// port.
+type endpoint struct {
+	ip   [16]byte
+	port uint16
+}
+
+func endpointOf(p bittorrent.Peer) endpoint {
+	e := endpoint{port: p.Port}
+	copy(e.ip[:], p.IP.To16())
+	return e
+}
+
+// entry is the preference of a peer and the time of its last announce in
+// nanoseconds since the epoch.
+type entry struct {
+	pref    Preference
+	updated int64
+}
+
+type shard struct {
+	sync.RWMutex
+	entries map[endpoint]entry
+}
+
+type hook struct {
+	filter           bool
+	candidatesFactor int
+	peerLifetime     int64
+	shards           [shardCount]shard
+
+	closing chan struct{}
+	wg      sync.WaitGroup
+}
+
+var _ middleware.PeerSelector = &hook{}
+
+// NewHook returns an instance of the encryption middleware.
+func NewHook(provided Config) middleware.Hook {
+	cfg := provided.Validate()
+	h := &hook{
+		filter:           cfg.FilterPeers,
+		candidatesFactor: cfg.CandidatesFactor,
+		peerLifetime:     int64(cfg.PeerLifetime),
+		closing:          make(chan struct{}),
+	}
+	for i := range h.shards {
+		h.shards[i].entries = make(map[endpoint]entry)
+	}
+
+	if !h.filter {
+		// Preferences are only remembered to filter peers.
+		return h
+	}
+
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		t := time.NewTicker(cfg.GarbageCollectionInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-h.closing:
+				return
+			case <-t.C:
+				h.collectGarbage(timecache.NowUnixNano())
+			}
+		}
+	}()
+
+	return h
+}
+
+func (h *hook) shard(e endpoint) *shard {
+	return &h.shards[e.ip[15]^byte(e.port)]
+}
+
+// set records the preference of a peer. Peers without a preference are not
+// recorded, because they are treated as Plaintext anyway.
+func (h *hook) set(e endpoint, pref Preference, now int64) {
+	s := h.shard(e)
+	s.Lock()
+	defer s.Unlock()
+
+	if pref == Plaintext {
+		delete(s.entries, e)
+		return
+	}
+	s.entries[e] = entry{pref: pref, updated: now}
+}
+
+func (h *hook) forget(e endpoint) {
+	s := h.shard(e)
+	s.Lock()
+	delete(s.entries, e)
+	s.Unlock()
+}
+
+// preference returns the recorded preference of a peer.
+func (h *hook) preference(p bittorrent.Peer) Preference {
+	e := endpointOf(p)
+	s := h.shard(e)
+	s.RLock()
+	defer s.RUnlock()
+	return s.entries[e].pref
+}
+
+// collectGarbage removes the preferences of peers that didn't announce within
+// the peer lifetime.
+func (h *hook) collectGarbage(now int64) {
+	for i := range h.shards {
+		s := &h.shards[i]
+		s.Lock()
+		for e, en := range s.entries {
+			if now-en.updated >= h.peerLifetime {
+				delete(s.entries, e)
+			}
+		}
+		s.Unlock()
+	}
+}
+
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	pref, port := ParsePreference(req)
+
+	// Peers requiring encryption listen for encrypted connections on the
+	// crypto port, so that is the port other peers must connect to.
+	if pref != Plaintext && port != 0 {
+		req.Peer.Port = port
+	}
+
+	if h.filter {
+		if req.Event == bittorrent.Stopped {
+			h.forget(endpointOf(req.Peer))
+		} else {
+			h.set(endpointOf(req.Peer), pref, timecache.NowUnixNano())
+		}
+	}
+	return ctx, nil
+}
+
+func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrapes don't contain peers.
+	return ctx, nil
+}
+
+// Candidates implements middleware.PeerSelector.
+func (h *hook) Candidates(numWant int) int {
+	if !h.filter {
+		return numWant
+	}
+	return numWant * h.candidatesFactor
+}
+
+// SelectPeers implements middleware.PeerSelector by removing the peers the
+// announcing peer cannot connect to: peers requiring encryption for peers
+// that don't support it, and peers not supporting encryption for peers that
+// require it.
+func (h *hook) SelectPeers(req *bittorrent.AnnounceRequest, peers []bittorrent.Peer) []bittorrent.Peer {
+	if !h.filter {
+		return peers
+	}
+
+	pref, _ := ParsePreference(req)
+	if pref == Supported {
+		return peers
+	}
+
+	n := 0
+	for _, p := range peers {
+		other := h.preference(p)
+		if (pref == Required && other == Plaintext) || (pref == Plaintext && other == Required) {
+			continue
+		}
+		peers[n] = p
+		n++
+	}
+	return peers[:n]
+}
+
+// Stop stops the garbage collection.
+func (h *hook) Stop() stop.Result {
+	select {
+	case <-h.closing:
+		return stop.AlreadyStopped
+	default:
+	}
+	c := make(stop.Channel)
+	go func() {
+		close(h.closing)
+		h.wg.Wait()
+		c.Done()
+	}()
+	return c.Result()
+}
@@ -0,0 +1,87 @@
+package encryption
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+func announce(t *testing.T, h *hook, query string, i byte, port uint16) *bittorrent.AnnounceRequest {
+	params, err := bittorrent.ParseURLData("/announce?" + query)
+	require.Nil(t, err)
+
+	req := &bittorrent.AnnounceRequest{
+		Peer: bittorrent.Peer{
+			ID:   bittorrent.PeerID{i},
+			IP:   bittorrent.IP{IP: net.IPv4(10, 0, 0, i).To4(), AddressFamily: bittorrent.IPv4},
+			Port: port,
+		},
+		Params: params,
+	}
+	_, err = h.HandleAnnounce(context.Background(), req, &bittorrent.AnnounceResponse{})
+	require.Nil(t, err)
+	return req
+}
+
+func TestParsePreference(t *testing.T) {
+	table := []struct {
+		query string
+		pref  Preference
+		port  uint16
+	}{
+		{"", Plaintext, 0},
+		{"supportcrypto=0", Plaintext, 0},
+		{"supportcrypto=1", Supported, 0},
+		{"supportcrypto=1&requirecrypto=1&cryptoport=6881", Required, 6881},
+		{"requirecrypto=1&cryptoport=invalid", Required, 0},
+	}
+
+	for _, tt := range table {
+		t.Run(tt.query, func(t *testing.T) {
+			params, err := bittorrent.ParseURLData("/announce?" + tt.query)
+			require.Nil(t, err)
+			pref, port := ParsePreference(&bittorrent.AnnounceRequest{Params: params})
+			require.Equal(t, tt.pref, pref)
+			require.Equal(t, tt.port, port)
+		})
+	}
+}
+
+func TestCryptoPort(t *testing.T) {
+	h := NewHook(Config{}).(*hook)
+	defer func() { require.Nil(t, <-h.Stop()) }()
+
+	require.Equal(t, uint16(6881), announce(t, h, "requirecrypto=1&cryptoport=6881", 1, 0).Port)
+	require.Equal(t, uint16(6882), announce(t, h, "cryptoport=6881", 2, 6882).Port)
+}
+
+func TestSelectPeers(t *testing.T) {
+	h := NewHook(Config{FilterPeers: true}).(*hook)
+	defer func() { require.Nil(t, <-h.Stop()) }()
+
+	plaintext := announce(t, h, "", 1, 6881).Peer
+	supported := announce(t, h, "supportcrypto=1", 2, 6881).Peer
+	required := announce(t, h, "requirecrypto=1&cryptoport=6881", 3, 0).Peer
+	peers := []bittorrent.Peer{plaintext, supported, required}
+
+	selected := func(req *bittorrent.AnnounceRequest) []bittorrent.Peer {
+		return h.SelectPeers(req, append([]bittorrent.Peer(nil), peers...))
+	}
+	require.Equal(t, []bittorrent.Peer{plaintext, supported}, selected(announce(t, h, "", 4, 6881)))
+	require.Equal(t, peers, selected(announce(t, h, "supportcrypto=1", 5, 6881)))
+	require.Equal(t, []bittorrent.Peer{supported, required}, selected(announce(t, h, "requirecrypto=1", 6, 6881)))
+
+	// Stopped peers and expired preferences are forgotten.
+	req := announce(t, h, "requirecrypto=1", 3, 6881)
+	req.Event = bittorrent.Stopped
+	_, err := h.HandleAnnounce(context.Background(), req, &bittorrent.AnnounceResponse{})
+	require.Nil(t, err)
+	require.Equal(t, Plaintext, h.preference(required))
+
+	h.collectGarbage(1 << 62)
+	require.Equal(t, Plaintext, h.preference(supported))
+}
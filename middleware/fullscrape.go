@@ -0,0 +1,105 @@
+package middleware
+
+import (
+	"sync"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/pkg/stop"
+	"github.com/chihaya/chihaya/storage"
+)
+
+// ErrNoInfoHashes is the error returned for scrapes without infohashes if full
+// scrapes are disabled.
+var ErrNoInfoHashes = bittorrent.RegisterClientError("no_infohash", "no info_hash parameter supplied")
+
+// defaultFullScrapeInterval is the default interval at which the full scrape
+// cache is refreshed.
+const defaultFullScrapeInterval = 5 * time.Minute
+
+// fullScrapeCache periodically collects the Scrapes of all swarms from a
+// PeerStore, so that full scrapes can be served without querying the
+// PeerStore for every request.
+type fullScrapeCache struct {
+	store storage.FullScraper
+
+	mu      sync.RWMutex
+	scrapes map[bittorrent.AddressFamily][]bittorrent.Scrape
+
+	closing chan struct{}
+	wg      sync.WaitGroup
+}
+
+// newFullScrapeCache creates a fullScrapeCache that is refreshed every
+// interval until it is stopped.
+func newFullScrapeCache(store storage.FullScraper, interval time.Duration) *fullScrapeCache {
+	c := &fullScrapeCache{
+		store:   store,
+		scrapes: make(map[bittorrent.AddressFamily][]bittorrent.Scrape),
+		closing: make(chan struct{}),
+	}
+	c.refresh()
+
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-c.closing:
+				return
+			case <-t.C:
+				c.refresh()
+			}
+		}
+	}()
+
+	return c
+}
+
+// refresh replaces the cached Scrapes with the current ones of the PeerStore.
+// If the Scrapes of an address family cannot be collected, the previous ones
+// are kept.
+func (c *fullScrapeCache) refresh() {
+	start := time.Now()
+	scrapes := make(map[bittorrent.AddressFamily][]bittorrent.Scrape, 2)
+	for _, af := range []bittorrent.AddressFamily{bittorrent.IPv4, bittorrent.IPv6} {
+		s, err := c.store.ScrapeAll(af)
+		if err != nil {
+			log.Error("failed to refresh full scrape", log.Fields{"addressFamily": af}, log.Err(err))
+			s = c.get(af)
+		}
+		scrapes[af] = s
+	}
+
+	c.mu.Lock()
+	c.scrapes = scrapes
+	c.mu.Unlock()
+
+	log.Debug("refreshed full scrape", log.Fields{
+		"IPv4":     len(scrapes[bittorrent.IPv4]),
+		"IPv6":     len(scrapes[bittorrent.IPv6]),
+		"duration": time.Since(start),
+	})
+}
+
+// get returns the cached Scrapes of an address family.
+// The returned slice must not be modified.
+func (c *fullScrapeCache) get(af bittorrent.AddressFamily) []bittorrent.Scrape {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.scrapes[af]
+}
+
+// Stop stops refreshing the cache.
+func (c *fullScrapeCache) Stop() stop.Result {
+	ch := make(stop.Channel)
+	go func() {
+		close(c.closing)
+		c.wg.Wait()
+		ch.Done()
+	}()
+	return ch.Result()
+}
@@ -0,0 +1,62 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+type fakeFullScraper struct {
+	sync.Mutex
+	scrapes []bittorrent.Scrape
+	err     error
+}
+
+func (s *fakeFullScraper) ScrapeAll(af bittorrent.AddressFamily) ([]bittorrent.Scrape, error) {
+	s.Lock()
+	defer s.Unlock()
+	if af == bittorrent.IPv6 {
+		return nil, nil
+	}
+	return s.scrapes, s.err
+}
+
+func TestFullScrapeCache(t *testing.T) {
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	store := &fakeFullScraper{scrapes: []bittorrent.Scrape{{InfoHash: ih, Complete: 1}}}
+
+	c := newFullScrapeCache(store, time.Hour)
+	defer func() { require.Nil(t, <-c.Stop()) }()
+	require.Equal(t, store.scrapes, c.get(bittorrent.IPv4))
+	require.Empty(t, c.get(bittorrent.IPv6))
+
+	// Failed refreshes keep the previous scrapes.
+	store.Lock()
+	store.scrapes, store.err = nil, errors.New("failure")
+	store.Unlock()
+	c.refresh()
+	require.Equal(t, []bittorrent.Scrape{{InfoHash: ih, Complete: 1}}, c.get(bittorrent.IPv4))
+}
+
+func TestResponseHookFullScrape(t *testing.T) {
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	store := &fakeFullScraper{scrapes: []bittorrent.Scrape{{InfoHash: ih, Incomplete: 2}}}
+	req := &bittorrent.ScrapeRequest{AddressFamily: bittorrent.IPv4}
+
+	h := &responseHook{}
+	_, err := h.HandleScrape(context.Background(), req, &bittorrent.ScrapeResponse{})
+	require.Equal(t, ErrNoInfoHashes, err)
+
+	h = &responseHook{fullScrape: newFullScrapeCache(store, time.Hour)}
+	resp := &bittorrent.ScrapeResponse{}
+	_, err = h.HandleScrape(context.Background(), req, resp)
+	require.Nil(t, err)
+	require.Equal(t, store.scrapes, resp.Files)
+	require.Nil(t, <-h.fullScrape.Stop())
+}
@@ -0,0 +1,436 @@
+// Package geoip implements a Hook that sorts the peers of an announce
+// response by their geographic proximity to the announcing peer, using a
+// MaxMind GeoIP2 or GeoLite2 database, and optionally counts announces and
+// returned peers by their location.
+package geoip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+	"github.com/prometheus/client_golang/prometheus"
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/pkg/stop"
+)
+
+// Name is the name by which this middleware is registered with Chihaya.
+const Name = "geoip"
+
+func init() {
+	middleware.RegisterDriver(Name, driver{})
+	prometheus.MustRegister(promDatabaseAge, promAnnounces, promReturnedPeers)
+}
+
+// databaseBuildEpoch is the build time of the most recently loaded database
+// in seconds since the epoch.
+var databaseBuildEpoch int64
+
+var promDatabaseAge = prometheus.NewGaugeFunc(
+	prometheus.GaugeOpts{
+		Name: "chihaya_geoip_database_age_seconds",
+		Help: "The time since the loaded GeoIP database was built",
+	},
+	func() float64 {
+		epoch := atomic.LoadInt64(&databaseBuildEpoch)
+		if epoch == 0 {
+			return 0
+		}
+		return time.Since(time.Unix(epoch, 0)).Seconds()
+	},
+)
+
+var (
+	promAnnounces = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "chihaya_geoip_announces_total",
+		Help: "The number of announces by the continent and country of the announcing peer",
+	}, []string{"continent", "country"})
+
+	promReturnedPeers = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "chihaya_geoip_returned_peers_total",
+		Help: "The number of peers returned in announce responses by their continent and country",
+	}, []string{"continent", "country"})
+)
+
+// unknownLocation is the label value of locations missing in the database.
+const unknownLocation = "unknown"
+
+var _ middleware.Driver = driver{}
+
+type driver struct{}
+
+func (d driver) NewHook(optionBytes []byte) (middleware.Hook, error) {
+	var cfg Config
+	err := yaml.Unmarshal(optionBytes, &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid options for middleware %s: %w", Name, err)
+	}
+
+	return NewHook(cfg)
+}
+
+// Filters that can be configured to drop peers that are too far away.
+const (
+	FilterNone      = "none"
+	FilterContinent = "continent"
+	FilterCountry   = "country"
+)
+
+// Config represents all the values required by this middleware to sort peers
+// by their location.
+type Config struct {
+	// Database is the path to a MaxMind database containing at least country
+	// and continent information, e.g. GeoLite2-Country.mmdb.
+	Database string `yaml:"database"`
+
+	// ReloadInterval is the interval at which the database file is checked
+	// for modifications and reloaded.
+	ReloadInterval time.Duration `yaml:"reload_interval"`
+
+	// SameCountryWeight and SameContinentWeight are the scores of peers in
+	// the same country or, otherwise, the same continent as the announcing
+	// peer. Peers are returned in the order of their scores.
+	SameCountryWeight   float64 `yaml:"same_country_weight"`
+	SameContinentWeight float64 `yaml:"same_continent_weight"`
+
+	// Filter drops peers outside of the announcing peer's continent or
+	// country. Peers of announcing peers with an unknown location are never
+	// filtered.
+	Filter string `yaml:"filter"`
+
+	// CandidatesFactor is the multiple of the requested number of peers that
+	// is fetched from storage to choose the closest peers from.
+	CandidatesFactor int `yaml:"candidates_factor"`
+
+	// DisableSorting returns the peers of the storage unchanged, neither
+	// sorted nor filtered, e.g. to only collect metrics.
+	DisableSorting bool `yaml:"disable_sorting"`
+
+	// Metrics enables counting announces and the peers returned to them by
+	// their continent and country.
+	Metrics bool `yaml:"metrics"`
+}
+
+// LogFields implements log.Fielder for a Config.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"database":            cfg.Database,
+		"reloadInterval":      cfg.ReloadInterval,
+		"sameCountryWeight":   cfg.SameCountryWeight,
+		"sameContinentWeight": cfg.SameContinentWeight,
+		"filter":              cfg.Filter,
+		"candidatesFactor":    cfg.CandidatesFactor,
+		"disableSorting":      cfg.DisableSorting,
+		"metrics":             cfg.Metrics,
+	}
+}
+
+// Default config constants.
+const (
+	defaultReloadInterval      = time.Hour
+	defaultSameCountryWeight   = 2
+	defaultSameContinentWeight = 1
+	defaultCandidatesFactor    = 4
+)
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+//
+// This function warns to the logger when a value is changed.
+func (cfg Config) Validate() Config {
+	validcfg := cfg
+
+	if cfg.ReloadInterval <= 0 {
+		validcfg.ReloadInterval = defaultReloadInterval
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".ReloadInterval",
+			"provided": cfg.ReloadInterval,
+			"default":  validcfg.ReloadInterval,
+		})
+	}
+
+	if cfg.SameCountryWeight == 0 && cfg.SameContinentWeight == 0 {
+		validcfg.SameCountryWeight = defaultSameCountryWeight
+		validcfg.SameContinentWeight = defaultSameContinentWeight
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".SameCountryWeight",
+			"provided": cfg.SameCountryWeight,
+			"default":  validcfg.SameCountryWeight,
+		})
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".SameContinentWeight",
+			"provided": cfg.SameContinentWeight,
+			"default":  validcfg.SameContinentWeight,
+		})
+	}
+
+	switch cfg.Filter {
+	case "", FilterNone, FilterContinent, FilterCountry:
+	default:
+		validcfg.Filter = FilterNone
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".Filter",
+			"provided": cfg.Filter,
+			"default":  validcfg.Filter,
+		})
+	}
+
+	if cfg.CandidatesFactor <= 0 {
+		validcfg.CandidatesFactor = defaultCandidatesFactor
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".CandidatesFactor",
+			"provided": cfg.CandidatesFactor,
+			"default":  validcfg.CandidatesFactor,
+		})
+	}
+
+	return validcfg
+}
+
+// location is the part of a database record used by this middleware.
+type location struct {
+	Continent struct {
+		Code string `maxminddb:"code"`
+	} `maxminddb:"continent"`
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+}
+
+type hook struct {
+	cfg Config
+
+	// mu protects db, which must not be closed while lookups are in progress.
+	mu      sync.RWMutex
+	db      *maxminddb.Reader
+	modTime time.Time
+
+	// lookup returns the location of an IP. It is replaced by tests.
+	lookup func(ip net.IP) (location, bool)
+
+	closing chan struct{}
+	wg      sync.WaitGroup
+}
+
+var (
+	_ middleware.PeerSelector             = &hook{}
+	_ middleware.AnnounceResponseAdjuster = &hook{}
+)
+
+// NewHook returns an instance of the GeoIP middleware.
+func NewHook(provided Config) (middleware.Hook, error) {
+	cfg := provided.Validate()
+	if cfg.Database == "" {
+		return nil, errors.New("no GeoIP database configured")
+	}
+
+	h := &hook{
+		cfg:     cfg,
+		closing: make(chan struct{}),
+	}
+	h.lookup = h.lookupDB
+
+	if err := h.reload(); err != nil {
+		return nil, fmt.Errorf("failed to load GeoIP database: %w", err)
+	}
+
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		t := time.NewTicker(cfg.ReloadInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-h.closing:
+				return
+			case <-t.C:
+				if err := h.reload(); err != nil {
+					log.Error("failed to reload GeoIP database", log.Fields{"database": cfg.Database}, log.Err(err))
+				}
+			}
+		}
+	}()
+
+	return h, nil
+}
+
+// reload opens the database if it was modified since it was last loaded.
+func (h *hook) reload() error {
+	info, err := os.Stat(h.cfg.Database)
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(h.modTime) {
+		return nil
+	}
+
+	db, err := maxminddb.Open(h.cfg.Database)
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	old := h.db
+	h.db = db
+	h.modTime = info.ModTime()
+	h.mu.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+
+	atomic.StoreInt64(&databaseBuildEpoch, int64(db.Metadata.BuildEpoch))
+	log.Debug("loaded GeoIP database", log.Fields{
+		"database":     h.cfg.Database,
+		"databaseType": db.Metadata.DatabaseType,
+		"buildEpoch":   db.Metadata.BuildEpoch,
+	})
+	return nil
+}
+
+// labels returns the label values of the location for the metrics.
+func (loc location) labels() []string {
+	continent, country := loc.Continent.Code, loc.Country.ISOCode
+	if continent == "" {
+		continent = unknownLocation
+	}
+	if country == "" {
+		country = unknownLocation
+	}
+	return []string{continent, country}
+}
+
+// lookupDB looks up the location of an IP in the database.
+// The caller must hold h.mu.
+func (h *hook) lookupDB(ip net.IP) (location, bool) {
+	var loc location
+	if err := h.db.Lookup(ip, &loc); err != nil {
+		return loc, false
+	}
+	return loc, loc.Continent.Code != "" || loc.Country.ISOCode != ""
+}
+
+// Stop stops reloading the database and closes it.
+func (h *hook) Stop() stop.Result {
+	select {
+	case <-h.closing:
+		return stop.AlreadyStopped
+	default:
+	}
+	c := make(stop.Channel)
+	go func() {
+		close(h.closing)
+		h.wg.Wait()
+
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		c.Done(h.db.Close())
+	}()
+	return c.Result()
+}
+
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	// Peers are selected in SelectPeers.
+	if h.cfg.Metrics {
+		h.mu.RLock()
+		loc, _ := h.lookup(req.IP.IP)
+		h.mu.RUnlock()
+		promAnnounces.WithLabelValues(loc.labels()...).Inc()
+	}
+	return ctx, nil
+}
+
+// AdjustAnnounceResponse implements middleware.AnnounceResponseAdjuster by
+// counting the peers of the response, if metrics are enabled.
+func (h *hook) AdjustAnnounceResponse(req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) {
+	if !h.cfg.Metrics {
+		return
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for _, peers := range [][]bittorrent.Peer{resp.IPv4Peers, resp.IPv6Peers} {
+		for _, p := range peers {
+			loc, _ := h.lookup(p.IP.IP)
+			promReturnedPeers.WithLabelValues(loc.labels()...).Inc()
+		}
+	}
+}
+
+func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrapes don't contain peers.
+	return ctx, nil
+}
+
+// Candidates implements middleware.PeerSelector.
+func (h *hook) Candidates(numWant int) int {
+	if h.cfg.DisableSorting {
+		return numWant
+	}
+	return numWant * h.cfg.CandidatesFactor
+}
+
+// SelectPeers implements middleware.PeerSelector by sorting peers by their
+// score and dropping peers outside of the configured area.
+func (h *hook) SelectPeers(req *bittorrent.AnnounceRequest, peers []bittorrent.Peer) []bittorrent.Peer {
+	if h.cfg.DisableSorting {
+		return peers
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	origin, ok := h.lookup(req.IP.IP)
+	if !ok {
+		return peers
+	}
+
+	scored := make([]scoredPeer, 0, len(peers))
+	for _, p := range peers {
+		loc, _ := h.lookup(p.IP.IP)
+		sameCountry := origin.Country.ISOCode != "" && loc.Country.ISOCode == origin.Country.ISOCode
+		sameContinent := origin.Continent.Code != "" && loc.Continent.Code == origin.Continent.Code
+
+		var score float64
+		switch {
+		case sameCountry:
+			score = h.cfg.SameCountryWeight
+		case sameContinent:
+			score = h.cfg.SameContinentWeight
+		}
+
+		switch {
+		case h.cfg.Filter == FilterCountry && !sameCountry:
+			continue
+		case h.cfg.Filter == FilterContinent && !sameContinent && !sameCountry:
+			continue
+		}
+		scored = append(scored, scoredPeer{peer: p, score: score})
+	}
+
+	sort.SliceStable(scored, func(i, j int) bool {
+		return scored[i].score > scored[j].score
+	})
+
+	peers = peers[:0]
+	for _, sp := range scored {
+		peers = append(peers, sp.peer)
+	}
+	return peers
+}
+
+type scoredPeer struct {
+	peer  bittorrent.Peer
+	score float64
+}
@@ -0,0 +1,94 @@
+package geoip
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+// locations maps the first byte of IPv4 addresses to locations.
+var locations = map[byte][2]string{
+	1: {"EU", "DE"},
+	2: {"EU", "FR"},
+	3: {"NA", "US"},
+}
+
+func lookupStub(ip net.IP) (location, bool) {
+	var loc location
+	l, ok := locations[ip.To4()[0]]
+	loc.Continent.Code, loc.Country.ISOCode = l[0], l[1]
+	return loc, ok
+}
+
+func peer(a byte) bittorrent.Peer {
+	return bittorrent.Peer{
+		ID:   bittorrent.PeerID{a},
+		IP:   bittorrent.IP{IP: net.IPv4(a, 0, 0, 1).To4(), AddressFamily: bittorrent.IPv4},
+		Port: 6881,
+	}
+}
+
+func TestSelectPeers(t *testing.T) {
+	var table = []struct {
+		origin   byte
+		filter   string
+		peers    []byte
+		expected []byte
+	}{
+		{1, FilterNone, []byte{3, 4, 2, 1, 3}, []byte{1, 2, 3, 4, 3}},
+		{3, FilterNone, []byte{1, 2, 3}, []byte{3, 1, 2}},
+		{1, FilterContinent, []byte{3, 4, 2, 1}, []byte{1, 2}},
+		{1, FilterCountry, []byte{3, 4, 2, 1}, []byte{1}},
+		// Peers of announcers with an unknown location are unchanged.
+		{4, FilterCountry, []byte{3, 4, 2, 1}, []byte{3, 4, 2, 1}},
+	}
+
+	for _, tt := range table {
+		h := &hook{
+			cfg: Config{
+				SameCountryWeight:   defaultSameCountryWeight,
+				SameContinentWeight: defaultSameContinentWeight,
+				Filter:              tt.filter,
+			},
+			lookup: lookupStub,
+		}
+
+		req := &bittorrent.AnnounceRequest{Peer: peer(tt.origin)}
+		var peers, expected []bittorrent.Peer
+		for _, a := range tt.peers {
+			peers = append(peers, peer(a))
+		}
+		for _, a := range tt.expected {
+			expected = append(expected, peer(a))
+		}
+
+		selected := h.SelectPeers(req, peers)
+		require.Equal(t, len(expected), len(selected))
+		for i := range expected {
+			require.Equal(t, expected[i].IP.IP, selected[i].IP.IP, "origin %d, filter %s", tt.origin, tt.filter)
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	h := &hook{cfg: Config{DisableSorting: true, Metrics: true}, lookup: lookupStub}
+
+	req := &bittorrent.AnnounceRequest{Peer: peer(1)}
+	resp := &bittorrent.AnnounceResponse{}
+	_, err := h.HandleAnnounce(context.Background(), req, resp)
+	require.Nil(t, err)
+
+	peers := []bittorrent.Peer{peer(3), peer(4), peer(3)}
+	resp.IPv4Peers = h.SelectPeers(req, peers)
+	require.Equal(t, peers, resp.IPv4Peers)
+	h.AdjustAnnounceResponse(req, resp)
+
+	require.Equal(t, 1.0, testutil.ToFloat64(promAnnounces.WithLabelValues("EU", "DE")))
+	require.Equal(t, 2.0, testutil.ToFloat64(promReturnedPeers.WithLabelValues("NA", "US")))
+	require.Equal(t, 1.0, testutil.ToFloat64(promReturnedPeers.WithLabelValues(unknownLocation, unknownLocation)))
+}
@@ -5,6 +5,8 @@ import (
 	"errors"
 
 	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/frontend"
+	"github.com/chihaya/chihaya/pkg/tracing"
 	"github.com/chihaya/chihaya/storage"
 )
 
@@ -18,6 +20,48 @@ type Hook interface {
 	HandleScrape(context.Context, *bittorrent.ScrapeRequest, *bittorrent.ScrapeResponse) (context.Context, error)
 }
 
+// A PeerSelector is a pre-hook that reorders or filters the peers returned in
+// an announce response.
+//
+// Pre-hooks run before peers are fetched from the PeerStore, so SelectPeers is
+// called separately once they are available, in the order the hooks were
+// configured.
+type PeerSelector interface {
+	Hook
+
+	// Candidates returns the number of peers to fetch from the PeerStore to
+	// select numWant peers from.
+	Candidates(numWant int) int
+
+	// SelectPeers returns the peers to use for the response in the order of
+	// preference. It may modify peers. Excess peers are dropped afterwards.
+	SelectPeers(req *bittorrent.AnnounceRequest, peers []bittorrent.Peer) []bittorrent.Peer
+}
+
+// An AnnounceResponseAdjuster is a pre-hook that adjusts announce responses
+// based on the state of the swarm.
+//
+// Pre-hooks run before the swarm is scraped, so AdjustAnnounceResponse is
+// called separately once the counts and peers of the response are filled in,
+// in the order the hooks were configured.
+type AnnounceResponseAdjuster interface {
+	Hook
+
+	AdjustAnnounceResponse(req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse)
+}
+
+// A ScrapeResponseAdjuster is a pre-hook that adjusts scrape responses.
+//
+// Pre-hooks run before the swarms are scraped, so AdjustScrapeResponse is
+// called separately once the files of the response are filled in, in the
+// order the hooks were configured. The context is the one returned by the
+// last pre-hook.
+type ScrapeResponseAdjuster interface {
+	Hook
+
+	AdjustScrapeResponse(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse)
+}
+
 type skipSwarmInteraction struct{}
 
 // SkipSwarmInteractionKey is a key for the context of an Announce to control
@@ -26,8 +70,45 @@ type skipSwarmInteraction struct{}
 // middleware to skip.
 var SkipSwarmInteractionKey = skipSwarmInteraction{}
 
-type swarmInteractionHook struct {
+// storeSpan starts the span of a call of the PeerStore.
+func storeSpan(ctx context.Context, name string) *tracing.Span {
+	_, span := tracing.Start(ctx, name)
+	return span
+}
+
+// endStoreSpan ends the span of a call of the PeerStore. Missing swarms and
+// peers are not errors of the storage.
+func endStoreSpan(span *tracing.Span, err error) {
+	if !errors.Is(err, storage.ErrResourceDoesNotExist) {
+		span.SetError(err)
+	}
+	span.End()
+}
+
+// swarmStores holds the PeerStores of the swarms of a Logic.
+type swarmStores struct {
+	// store holds the swarms of all peers but WebTorrent peers.
 	store storage.PeerStore
+
+	// webTorrent returns the PeerStore of the swarms of WebTorrent peers.
+	webTorrent func() (storage.PeerStore, error)
+}
+
+// isWebTorrent returns whether a request is one of a WebTorrent peer.
+func isWebTorrent(ctx context.Context) bool {
+	return ctx.Value(frontend.WebTorrentKey) != nil
+}
+
+// get returns the PeerStore holding the swarm of a request.
+func (s swarmStores) get(ctx context.Context) (storage.PeerStore, error) {
+	if isWebTorrent(ctx) {
+		return s.webTorrent()
+	}
+	return s.store, nil
+}
+
+type swarmInteractionHook struct {
+	swarmStores
 }
 
 func (h *swarmInteractionHook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (_ context.Context, err error) {
@@ -35,29 +116,61 @@ func (h *swarmInteractionHook) HandleAnnounce(ctx context.Context, req *bittorre
 		return ctx, nil
 	}
 
+	store, err := h.get(ctx)
+	if err != nil {
+		return ctx, err
+	}
+
+	var span *tracing.Span
 	switch {
 	case req.Event == bittorrent.Stopped:
-		err = h.store.DeleteSeeder(req.InfoHash, req.Peer)
+		span = storeSpan(ctx, "storage.DeleteSeeder")
+		err = store.DeleteSeeder(req.InfoHash, req.Peer)
+		endStoreSpan(span, err)
 		if err != nil && !errors.Is(err, storage.ErrResourceDoesNotExist) {
 			return ctx, err
 		}
 
-		err = h.store.DeleteLeecher(req.InfoHash, req.Peer)
+		span = storeSpan(ctx, "storage.DeleteLeecher")
+		err = store.DeleteLeecher(req.InfoHash, req.Peer)
+		endStoreSpan(span, err)
 		if err != nil && !errors.Is(err, storage.ErrResourceDoesNotExist) {
 			return ctx, err
 		}
 	case req.Event == bittorrent.Completed:
-		err = h.store.GraduateLeecher(req.InfoHash, req.Peer)
+		span = storeSpan(ctx, "storage.GraduateLeecher")
+		err = store.GraduateLeecher(req.InfoHash, req.Peer)
+		endStoreSpan(span, err)
+		return ctx, err
+	case req.Event == bittorrent.Paused:
+		// Partial seeds don't download any further, so they are stored
+		// as seeders: they count as complete for availability and are
+		// not announced to other seeders. Unlike for completing
+		// leechers, no snatch is recorded.
+		span = storeSpan(ctx, "storage.DeleteLeecher")
+		err = store.DeleteLeecher(req.InfoHash, req.Peer)
+		endStoreSpan(span, err)
+		if err != nil && !errors.Is(err, storage.ErrResourceDoesNotExist) {
+			return ctx, err
+		}
+
+		span = storeSpan(ctx, "storage.PutSeeder")
+		err = store.PutSeeder(req.InfoHash, req.Peer)
+		endStoreSpan(span, err)
 		return ctx, err
 	case req.Left == 0:
 		// Completed events will also have Left == 0, but by making this
 		// an extra case we can treat "old" seeders differently from
 		// graduating leechers. (Calling PutSeeder is probably faster
 		// than calling GraduateLeecher.)
-		err = h.store.PutSeeder(req.InfoHash, req.Peer)
+		span = storeSpan(ctx, "storage.PutSeeder")
+		err = store.PutSeeder(req.InfoHash, req.Peer)
+		endStoreSpan(span, err)
 		return ctx, err
 	default:
-		err = h.store.PutLeecher(req.InfoHash, req.Peer)
+		span = storeSpan(ctx, "storage.PutLeecher")
+		err = store.PutLeecher(req.InfoHash, req.Peer)
+		endStoreSpan(span, err)
 		return ctx, err
 	}
 
@@ -86,8 +199,25 @@ type scrapeAddressType struct{}
 // it being set to false.
 var ScrapeIsIPv6Key = scrapeAddressType{}
 
+type emptySwarm struct{}
+
+// emptySwarmKey is set in the context of an Announce by the response hook if
+// the swarm of the announce was empty.
+var emptySwarmKey = emptySwarm{}
+
 type responseHook struct {
-	store storage.PeerStore
+	swarmStores
+	selectors []PeerSelector
+	adjusters []AnnounceResponseAdjuster
+
+	scrapeAdjusters []ScrapeResponseAdjuster
+
+	// mix is nil if peer mixes are disabled.
+	mix   *peerMix
+	mixer storage.PeerMixer
+
+	// fullScrape is nil if full scrapes are disabled.
+	fullScrape *fullScrapeCache
 }
 
 func (h *responseHook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (_ context.Context, err error) {
@@ -95,22 +225,73 @@ func (h *responseHook) HandleAnnounce(ctx context.Context, req *bittorrent.Annou
 		return ctx, nil
 	}
 
+	// Don't query the storage for requests that were abandoned already.
+	if err := ctx.Err(); err != nil {
+		return ctx, err
+	}
+
+	store, err := h.get(ctx)
+	if err != nil {
+		return ctx, err
+	}
+
 	// Add the Scrape data to the response.
-	s := h.store.ScrapeSwarm(req.InfoHash, req.IP.AddressFamily)
+	span := storeSpan(ctx, "storage.ScrapeSwarm")
+	s := store.ScrapeSwarm(req.InfoHash, req.IP.AddressFamily)
+	span.End()
 	resp.Incomplete = s.Incomplete
 	resp.Complete = s.Complete
+	if s.Complete == 0 && s.Incomplete == 0 {
+		// appendPeers counts the announcing peer in empty swarms.
+		ctx = context.WithValue(ctx, emptySwarmKey, struct{}{})
+	}
 
-	err = h.appendPeers(req, resp)
-	return ctx, err
+	if err = h.appendPeers(ctx, store, req, resp); err != nil {
+		return ctx, err
+	}
+
+	for _, a := range h.adjusters {
+		a.AdjustAnnounceResponse(req, resp)
+	}
+	return ctx, nil
 }
 
-func (h *responseHook) appendPeers(req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) error {
-	seeding := req.Left == 0
-	peers, err := h.store.AnnouncePeers(req.InfoHash, seeding, int(req.NumWant), req.Peer)
+func (h *responseHook) appendPeers(ctx context.Context, store storage.PeerStore, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) error {
+	// Partial seeds (BEP 21) only want leechers, just like seeders.
+	seeding := req.Left == 0 || req.Event == bittorrent.Paused
+	numWant := int(req.NumWant)
+	candidates := numWant
+	for _, s := range h.selectors {
+		if c := s.Candidates(numWant); c > candidates {
+			candidates = c
+		}
+	}
+
+	var peers []bittorrent.Peer
+	var err error
+	// Peer mixes are configured for the PeerStore of the tracker, not for the
+	// swarms of WebTorrent peers.
+	if h.mix != nil && !isWebTorrent(ctx) {
+		numSeeders, numLeechers := h.mix.split(seeding, candidates, resp.Complete, resp.Incomplete)
+		span := storeSpan(ctx, "storage.AnnounceMixedPeers")
+		peers, err = h.mixer.AnnounceMixedPeers(req.InfoHash, numSeeders, numLeechers, req.Peer)
+		endStoreSpan(span, err)
+	} else {
+		span := storeSpan(ctx, "storage.AnnouncePeers")
+		peers, err = store.AnnouncePeers(req.InfoHash, seeding, candidates, req.Peer)
+		endStoreSpan(span, err)
+	}
 	if err != nil && !errors.Is(err, storage.ErrResourceDoesNotExist) {
 		return err
 	}
 
+	for _, s := range h.selectors {
+		peers = s.SelectPeers(req, peers)
+	}
+	if len(peers) > numWant {
+		peers = peers[:numWant]
+	}
+
 	// Some clients expect a minimum of their own peer representation returned to
 	// them if they are the only peer in a swarm.
 	if len(peers) == 0 {
@@ -139,9 +320,31 @@ func (h *responseHook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeR
 		return ctx, nil
 	}
 
-	for _, infoHash := range req.InfoHashes {
-		resp.Files = append(resp.Files, h.store.ScrapeSwarm(infoHash, req.AddressFamily))
+	if err := ctx.Err(); err != nil {
+		return ctx, err
 	}
 
+	if len(req.InfoHashes) == 0 {
+		// Full scrapes only cover the swarms of the PeerStore of the
+		// tracker.
+		if h.fullScrape == nil || isWebTorrent(ctx) {
+			return ctx, ErrNoInfoHashes
+		}
+		resp.Files = append(resp.Files, h.fullScrape.get(req.AddressFamily)...)
+		return ctx, nil
+	}
+
+	store, err := h.get(ctx)
+	if err != nil {
+		return ctx, err
+	}
+
+	span := storeSpan(ctx, "storage.ScrapeMany")
+	resp.Files = append(resp.Files, storage.ScrapeMany(store, req.InfoHashes, req.AddressFamily)...)
+	span.End()
+
+	for _, a := range h.scrapeAdjusters {
+		a.AdjustScrapeResponse(ctx, req, resp)
+	}
 	return ctx, nil
 }
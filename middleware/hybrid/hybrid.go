@@ -0,0 +1,278 @@
+// Package hybrid implements a Hook that joins the v1 and v2 swarms of hybrid
+// torrents, so that their peers find each other.
+//
+// Clients of a hybrid torrent announce its v1 infohash and its truncated v2
+// infohash (BEP 52) as two separate swarms. The Hook replaces the v2
+// infohashes of announces and scrapes with the paired v1 infohashes, and
+// restores the requested infohashes in scrape responses.
+//
+// The pairs can either be configured statically or be fetched from an
+// HTTP(S) URL or a file, in which case they are refreshed periodically.
+package hybrid
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/middleware/pkg/listsource"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/pkg/stop"
+)
+
+// Name is the name by which this middleware is registered with Chihaya.
+const Name = "hybrid torrents"
+
+func init() {
+	middleware.RegisterDriver(Name, driver{})
+}
+
+var _ middleware.Driver = driver{}
+
+type driver struct{}
+
+func (d driver) NewHook(optionBytes []byte) (middleware.Hook, error) {
+	var cfg Config
+	err := yaml.Unmarshal(optionBytes, &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid options for middleware %s: %w", Name, err)
+	}
+
+	return NewHook(cfg)
+}
+
+// Config represents all the values required by this middleware to join the
+// swarms of hybrid torrents.
+type Config struct {
+	// Pairs are the infohashes of hybrid torrents. Every pair consists of
+	// the hexadecimal v1 infohash and the hexadecimal v2 infohash, either
+	// complete or truncated, separated by whitespace.
+	Pairs []string `yaml:"pairs"`
+
+	// ListURL is an HTTP(S) URL or the path of a file from which the pairs
+	// are loaded, as an alternative to Pairs. The list contains one pair per
+	// line. Comments starting with '#' or ';' are ignored.
+	ListURL string `yaml:"list_url"`
+
+	// ListUpdateInterval is the interval at which the list is reloaded from
+	// ListURL.
+	ListUpdateInterval time.Duration `yaml:"list_update_interval"`
+}
+
+// LogFields implements log.Fielder for a Config.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"pairs":              len(cfg.Pairs),
+		"listURL":            cfg.ListURL,
+		"listUpdateInterval": cfg.ListUpdateInterval,
+	}
+}
+
+const defaultListUpdateInterval = 5 * time.Minute
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+//
+// This function warns to the logger when a value is changed.
+func (cfg Config) Validate() Config {
+	validcfg := cfg
+
+	if cfg.ListURL != "" && cfg.ListUpdateInterval <= 0 {
+		validcfg.ListUpdateInterval = defaultListUpdateInterval
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".ListUpdateInterval",
+			"provided": cfg.ListUpdateInterval,
+			"default":  validcfg.ListUpdateInterval,
+		})
+	}
+
+	return validcfg
+}
+
+type requestedInfoHashes struct{}
+
+// requestedInfoHashesKey is the key under which the infohashes of a scrape
+// are stored before they are replaced.
+var requestedInfoHashesKey = requestedInfoHashes{}
+
+type hook struct {
+	mu sync.RWMutex
+	// v1 maps the truncated v2 infohash of a hybrid torrent to its v1
+	// infohash.
+	v1 map[bittorrent.InfoHash]bittorrent.InfoHash
+
+	source  *listsource.Source
+	closing chan struct{}
+	wg      sync.WaitGroup
+}
+
+var _ middleware.ScrapeResponseAdjuster = &hook{}
+
+// NewHook returns an instance of the hybrid torrents middleware.
+func NewHook(provided Config) (middleware.Hook, error) {
+	cfg := provided.Validate()
+	h := &hook{closing: make(chan struct{})}
+
+	if cfg.ListURL != "" {
+		if len(cfg.Pairs) > 0 {
+			return nil, fmt.Errorf("using both list_url and static pairs is invalid")
+		}
+
+		h.source = listsource.New(cfg.ListURL)
+		if err := h.refresh(); err != nil {
+			return nil, fmt.Errorf("failed to load initial list: %w", err)
+		}
+
+		h.wg.Add(1)
+		go h.runRefresh(cfg.ListUpdateInterval)
+		return h, nil
+	}
+
+	var err error
+	if h.v1, err = parsePairs(cfg.Pairs); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// parsePairs decodes a list of pairs of hexadecimal v1 and v2 infohashes.
+func parsePairs(pairs []string) (map[bittorrent.InfoHash]bittorrent.InfoHash, error) {
+	v1 := make(map[bittorrent.InfoHash]bittorrent.InfoHash, len(pairs))
+	for _, pair := range pairs {
+		fields := strings.Fields(pair)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("pair %q is not a v1 and a v2 infohash", pair)
+		}
+		b1, err := hex.DecodeString(fields[0])
+		if err != nil || len(b1) != len(bittorrent.InfoHash{}) {
+			return nil, fmt.Errorf("pair %q: invalid v1 infohash", pair)
+		}
+		b2, err := hex.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("pair %q: invalid v2 infohash", pair)
+		}
+		ih2, ok := bittorrent.ParseInfoHash(b2)
+		if !ok {
+			return nil, fmt.Errorf("pair %q: invalid v2 infohash", pair)
+		}
+		v1[ih2] = bittorrent.InfoHashFromBytes(b1)
+	}
+	return v1, nil
+}
+
+// refresh reloads the list from its source, if it has changed.
+func (h *hook) refresh() error {
+	pairs, changed, err := h.source.Fetch()
+	if err != nil {
+		return err
+	}
+	if !changed {
+		log.Debug("hybrid torrents list unchanged", log.Fields{"url": h.source.URL()})
+		return nil
+	}
+
+	v1, err := parsePairs(pairs)
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	h.v1 = v1
+	h.mu.Unlock()
+
+	log.Debug("loaded hybrid torrents list", log.Fields{
+		"url":   h.source.URL(),
+		"count": len(v1),
+	})
+	return nil
+}
+
+// runRefresh periodically reloads the list until the hook is stopped.
+// If the list cannot be loaded, the previous list is kept.
+func (h *hook) runRefresh(interval time.Duration) {
+	defer h.wg.Done()
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-h.closing:
+			return
+		case <-t.C:
+			if err := h.refresh(); err != nil {
+				log.Error("failed to refresh hybrid torrents list", log.Fields{"url": h.source.URL()}, log.Err(err))
+			}
+		}
+	}
+}
+
+// Stop stops refreshing the list.
+func (h *hook) Stop() stop.Result {
+	select {
+	case <-h.closing:
+		return stop.AlreadyStopped
+	default:
+	}
+	c := make(stop.Channel)
+	go func() {
+		close(h.closing)
+		h.wg.Wait()
+		c.Done()
+	}()
+	return c.Result()
+}
+
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if v1, ok := h.v1[req.InfoHash]; ok {
+		req.InfoHash = v1
+	}
+	return ctx, nil
+}
+
+func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	var infoHashes []bittorrent.InfoHash
+	for i, ih := range req.InfoHashes {
+		v1, ok := h.v1[ih]
+		if !ok {
+			continue
+		}
+		if infoHashes == nil {
+			// The requested infohashes are kept to restore them in the
+			// response.
+			infoHashes = append([]bittorrent.InfoHash(nil), req.InfoHashes...)
+			ctx = context.WithValue(ctx, requestedInfoHashesKey, req.InfoHashes)
+		}
+		infoHashes[i] = v1
+	}
+	if infoHashes != nil {
+		req.InfoHashes = infoHashes
+	}
+
+	return ctx, nil
+}
+
+// AdjustScrapeResponse restores the infohashes replaced by HandleScrape in
+// the response, so that clients find the infohashes they requested.
+func (h *hook) AdjustScrapeResponse(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) {
+	requested, ok := ctx.Value(requestedInfoHashesKey).([]bittorrent.InfoHash)
+	if !ok || len(requested) != len(resp.Files) {
+		return
+	}
+
+	for i := range resp.Files {
+		resp.Files[i].InfoHash = requested[i]
+	}
+	req.InfoHashes = requested
+}
@@ -0,0 +1,98 @@
+package hybrid
+
+import (
+	"context"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+const (
+	v1 = "3532cf2d327fad8448c075b4cb42c8136964a435"
+	v2 = "caa1ab1d99efa7c5aa7e2d39c63ba6b4a2b1d45be0dd03b6a8a8e0ed2f4b0a1c"
+)
+
+func infoHash(t *testing.T, s string) bittorrent.InfoHash {
+	b, err := hex.DecodeString(s)
+	require.Nil(t, err)
+	ih, ok := bittorrent.ParseInfoHash(b)
+	require.True(t, ok)
+	return ih
+}
+
+func TestHandleAnnounce(t *testing.T) {
+	h, err := NewHook(Config{Pairs: []string{v1 + " " + v2}})
+	require.Nil(t, err)
+
+	for _, tt := range []struct{ in, out string }{
+		{v2, v1},
+		{v1, v1},
+		{"0000000000000000000000000000000000000000", "0000000000000000000000000000000000000000"},
+	} {
+		req := &bittorrent.AnnounceRequest{InfoHash: infoHash(t, tt.in)}
+		_, err := h.HandleAnnounce(context.Background(), req, &bittorrent.AnnounceResponse{})
+		require.Nil(t, err)
+		require.Equal(t, infoHash(t, tt.out), req.InfoHash)
+	}
+}
+
+func TestHandleScrape(t *testing.T) {
+	mh, err := NewHook(Config{Pairs: []string{v1 + "\t" + v2[:40]}})
+	require.Nil(t, err)
+	h := mh.(*hook)
+
+	requested := []bittorrent.InfoHash{infoHash(t, v2), infoHash(t, v1)}
+	req := &bittorrent.ScrapeRequest{InfoHashes: requested}
+	ctx, err := h.HandleScrape(context.Background(), req, &bittorrent.ScrapeResponse{})
+	require.Nil(t, err)
+	require.Equal(t, []bittorrent.InfoHash{infoHash(t, v1), infoHash(t, v1)}, req.InfoHashes)
+
+	// The swarm of the v1 infohash is scraped for both infohashes.
+	resp := &bittorrent.ScrapeResponse{Files: []bittorrent.Scrape{
+		{InfoHash: req.InfoHashes[0], Complete: 2},
+		{InfoHash: req.InfoHashes[1], Complete: 2},
+	}}
+	h.AdjustScrapeResponse(ctx, req, resp)
+	require.Equal(t, []bittorrent.Scrape{
+		{InfoHash: requested[0], Complete: 2},
+		{InfoHash: requested[1], Complete: 2},
+	}, resp.Files)
+	require.Equal(t, requested, req.InfoHashes)
+}
+
+func TestListFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pairs")
+	require.Nil(t, os.WriteFile(path, []byte("# v1 v2\n"+v1+" "+v2+"\n"), 0o600))
+
+	mh, err := NewHook(Config{ListURL: path})
+	require.Nil(t, err)
+	h := mh.(*hook)
+	defer func() { require.Nil(t, h.Stop().Wait()) }()
+
+	req := &bittorrent.AnnounceRequest{InfoHash: infoHash(t, v2)}
+	_, err = h.HandleAnnounce(context.Background(), req, &bittorrent.AnnounceResponse{})
+	require.Nil(t, err)
+	require.Equal(t, infoHash(t, v1), req.InfoHash)
+
+	// The previous list is kept if the list is invalid.
+	require.Nil(t, os.WriteFile(path, []byte(v1+"\n"), 0o600))
+	require.Nil(t, os.Chtimes(path, time.Now(), time.Now().Add(time.Minute)))
+	require.NotNil(t, h.refresh())
+	require.Len(t, h.v1, 1)
+}
+
+func TestConfig(t *testing.T) {
+	for _, pair := range []string{v1, v1 + " " + v2 + " " + v1, v2 + " " + v1, v1 + " nothex"} {
+		_, err := NewHook(Config{Pairs: []string{pair}})
+		require.NotNil(t, err, pair)
+	}
+
+	_, err := NewHook(Config{Pairs: []string{v1 + " " + v2}, ListURL: "pairs"})
+	require.NotNil(t, err)
+}
@@ -3,18 +3,22 @@
 //
 // JWTs are validated against the standard claims in RFC7519 along with an
 // extra "infohash" claim that verifies the client has access to the Swarm.
-// RS256 keys are asychronously rotated from a provided JWK Set HTTP endpoint.
+// RS256 and ES256 keys are asychronously rotated from the provided JWK Set
+// HTTP endpoints.
 package jwt
 
 import (
 	"context"
 	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	jc "github.com/SermoDigital/jose/crypto"
@@ -52,18 +56,25 @@ func (d driver) NewHook(optionBytes []byte) (middleware.Hook, error) {
 
 var (
 	// ErrMissingJWT is returned when a JWT is missing from a request.
-	ErrMissingJWT = bittorrent.ClientError("unapproved request: missing jwt")
+	ErrMissingJWT = bittorrent.RegisterClientError("missing_jwt", "unapproved request: missing jwt")
 
 	// ErrInvalidJWT is returned when a JWT fails to verify.
-	ErrInvalidJWT = bittorrent.ClientError("unapproved request: invalid jwt")
+	ErrInvalidJWT = bittorrent.RegisterClientError("invalid_jwt", "unapproved request: invalid jwt")
 )
 
 // Config represents all the values required by this middleware to fetch JWKs
 // and verify JWTs.
+//
+// Issuer and Issuers, Audience and Audiences as well as JWKSetURL and
+// JWKSetURLs are merged. A JWT is valid if it was issued by any of the
+// issuers for any of the audiences and signed by any of the keys.
 type Config struct {
 	Issuer            string        `yaml:"issuer"`
+	Issuers           []string      `yaml:"issuers"`
 	Audience          string        `yaml:"audience"`
+	Audiences         []string      `yaml:"audiences"`
 	JWKSetURL         string        `yaml:"jwk_set_url"`
+	JWKSetURLs        []string      `yaml:"jwk_set_urls"`
 	JWKUpdateInterval time.Duration `yaml:"jwk_set_update_interval"`
 }
 
@@ -71,38 +82,93 @@ type Config struct {
 func (cfg Config) LogFields() log.Fields {
 	return log.Fields{
 		"issuer":            cfg.Issuer,
+		"issuers":           cfg.Issuers,
 		"audience":          cfg.Audience,
+		"audiences":         cfg.Audiences,
 		"JWKSetURL":         cfg.JWKSetURL,
+		"JWKSetURLs":        cfg.JWKSetURLs,
 		"JWKUpdateInterval": cfg.JWKUpdateInterval,
 	}
 }
 
+// defaultJWKUpdateInterval is the default interval at which JWK Sets are
+// fetched.
+const defaultJWKUpdateInterval = 5 * time.Minute
+
+// jwkFetchTimeout is the timeout for fetching a JWK Set.
+const jwkFetchTimeout = 30 * time.Second
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+//
+// This function warns to the logger when a value is changed.
+func (cfg Config) Validate() Config {
+	validcfg := cfg
+
+	if cfg.JWKUpdateInterval <= 0 {
+		validcfg.JWKUpdateInterval = defaultJWKUpdateInterval
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".JWKUpdateInterval",
+			"provided": cfg.JWKUpdateInterval,
+			"default":  validcfg.JWKUpdateInterval,
+		})
+	}
+
+	return validcfg
+}
+
+// merge returns the non-empty value of single followed by multiple.
+func merge(single string, multiple []string) []string {
+	if single == "" {
+		return multiple
+	}
+	return append([]string{single}, multiple...)
+}
+
 type hook struct {
-	cfg        Config
+	cfg       Config
+	issuers   []string
+	audiences []string
+	urls      []string
+	client    *http.Client
+
+	mu         sync.RWMutex
 	publicKeys map[string]crypto.PublicKey
-	closing    chan struct{}
+
+	closing chan struct{}
 }
 
 // NewHook returns an instance of the JWT middleware.
-func NewHook(cfg Config) (middleware.Hook, error) {
+func NewHook(provided Config) (middleware.Hook, error) {
+	cfg := provided.Validate()
 	log.Debug("creating new JWT middleware", cfg)
 	h := &hook{
 		cfg:        cfg,
+		issuers:    merge(cfg.Issuer, cfg.Issuers),
+		audiences:  merge(cfg.Audience, cfg.Audiences),
+		urls:       merge(cfg.JWKSetURL, cfg.JWKSetURLs),
+		client:     &http.Client{Timeout: jwkFetchTimeout},
 		publicKeys: map[string]crypto.PublicKey{},
 		closing:    make(chan struct{}),
 	}
 
+	if len(h.urls) == 0 {
+		return nil, errors.New("no JWK Set URL configured")
+	}
+
 	log.Debug("performing initial fetch of JWKs")
 	if err := h.updateKeys(); err != nil {
 		return nil, errors.New("failed to fetch initial JWK Set: " + err.Error())
 	}
 
 	go func() {
+		t := time.NewTicker(cfg.JWKUpdateInterval)
+		defer t.Stop()
 		for {
 			select {
 			case <-h.closing:
 				return
-			case <-time.After(cfg.JWKUpdateInterval):
+			case <-t.C:
 				log.Debug("performing fetch of JWKs")
 				_ = h.updateKeys()
 			}
@@ -112,37 +178,66 @@ func NewHook(cfg Config) (middleware.Hook, error) {
 	return h, nil
 }
 
+// updateKeys fetches all JWK Sets and replaces the known public keys.
+// If any JWK Set cannot be fetched, the previous keys are kept.
 func (h *hook) updateKeys() error {
-	resp, err := http.Get(h.cfg.JWKSetURL)
+	keys := map[string]crypto.PublicKey{}
+	for _, url := range h.urls {
+		if err := h.fetchKeys(url, keys); err != nil {
+			return err
+		}
+	}
+
+	h.mu.Lock()
+	h.publicKeys = keys
+	h.mu.Unlock()
+
+	log.Debug("successfully fetched JWK Sets")
+	return nil
+}
+
+// fetchKeys fetches the JWK Set at url and adds its keys to keys.
+func (h *hook) fetchKeys(url string, keys map[string]crypto.PublicKey) error {
+	resp, err := h.client.Get(url)
 	if err != nil {
-		log.Error("failed to fetch JWK Set", log.Err(err))
+		log.Error("failed to fetch JWK Set", log.Fields{"url": url}, log.Err(err))
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("unexpected status code %d", resp.StatusCode)
+		log.Error("failed to fetch JWK Set", log.Fields{"url": url}, log.Err(err))
 		return err
 	}
 
 	var parsedJWKs gojwk.Key
 	err = json.NewDecoder(resp.Body).Decode(&parsedJWKs)
 	if err != nil {
-		resp.Body.Close()
-		log.Error("failed to decode JWK JSON", log.Err(err))
+		log.Error("failed to decode JWK JSON", log.Fields{"url": url}, log.Err(err))
 		return err
 	}
-	resp.Body.Close()
 
-	keys := map[string]crypto.PublicKey{}
 	for _, parsedJWK := range parsedJWKs.Keys {
 		publicKey, err := parsedJWK.DecodePublicKey()
 		if err != nil {
-			log.Error("failed to decode JWK into public key", log.Err(err))
+			log.Error("failed to decode JWK into public key", log.Fields{"url": url}, log.Err(err))
 			return err
 		}
 		keys[parsedJWK.Kid] = publicKey
 	}
-	h.publicKeys = keys
 
-	log.Debug("successfully fetched JWK Set")
 	return nil
 }
 
+// publicKey returns the public key with the given ID.
+func (h *hook) publicKey(kid string) (crypto.PublicKey, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	publicKey, ok := h.publicKeys[kid]
+	return publicKey, ok
+}
+
 func (h *hook) Stop() stop.Result {
 	log.Debug("attempting to shutdown JWT middleware")
 	select {
@@ -168,7 +263,7 @@ func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceReque
 		return ctx, ErrMissingJWT
 	}
 
-	if err := validateJWT(req.InfoHash, []byte(jwtParam), h.cfg.Issuer, h.cfg.Audience, h.publicKeys); err != nil {
+	if err := validateJWT(req.InfoHash, []byte(jwtParam), h.issuers, h.audiences, h.publicKey); err != nil {
 		return ctx, ErrInvalidJWT
 	}
 
@@ -180,27 +275,27 @@ func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest,
 	return ctx, nil
 }
 
-func validateJWT(ih bittorrent.InfoHash, jwtBytes []byte, cfgIss, cfgAud string, publicKeys map[string]crypto.PublicKey) error {
+func validateJWT(ih bittorrent.InfoHash, jwtBytes []byte, cfgIss, cfgAud []string, publicKeys func(kid string) (crypto.PublicKey, bool)) error {
 	parsedJWT, err := jws.ParseJWT(jwtBytes)
 	if err != nil {
 		return err
 	}
 
 	claims := parsedJWT.Claims()
-	if iss, ok := claims.Issuer(); !ok || iss != cfgIss {
+	if iss, ok := claims.Issuer(); !ok || !in(iss, cfgIss) {
 		log.Debug("unequal or missing issuer when validating JWT", log.Fields{
 			"exists": ok,
 			"claim":  iss,
-			"config": cfgIss,
+			"config": strings.Join(cfgIss, ","),
 		})
 		return jwt.ErrInvalidISSClaim
 	}
 
-	if auds, ok := claims.Audience(); !ok || !in(cfgAud, auds) {
+	if auds, ok := claims.Audience(); !ok || !anyIn(auds, cfgAud) {
 		log.Debug("unequal or missing audience when validating JWT", log.Fields{
 			"exists": ok,
 			"claim":  strings.Join(auds, ","),
-			"config": cfgAud,
+			"config": strings.Join(cfgAud, ","),
 		})
 		return jwt.ErrInvalidAUDClaim
 	}
@@ -224,7 +319,7 @@ func validateJWT(ih bittorrent.InfoHash, jwtBytes []byte, cfgIss, cfgAud string,
 		})
 		return errors.New("invalid kid")
 	}
-	publicKey, ok := publicKeys[kid]
+	publicKey, ok := publicKeys(kid)
 	if !ok {
 		log.Debug("missing public key forkid when validating JWT", log.Fields{
 			"kid": kid,
@@ -232,7 +327,29 @@ func validateJWT(ih bittorrent.InfoHash, jwtBytes []byte, cfgIss, cfgAud string,
 		return errors.New("signed by unknown kid")
 	}
 
-	err = parsedJWS.Verify(publicKey, jc.SigningMethodRS256)
+	// The algorithm must match the type of the key, otherwise an attacker
+	// could choose an algorithm the key was never meant for.
+	alg, _ := parsedJWS.Protected().Get("alg").(string)
+	var method jc.SigningMethod
+	switch publicKey.(type) {
+	case *rsa.PublicKey:
+		if alg == "RS256" {
+			method = jc.SigningMethodRS256
+		}
+	case *ecdsa.PublicKey:
+		if alg == "ES256" {
+			method = jc.SigningMethodES256
+		}
+	}
+	if method == nil {
+		log.Debug("unsupported algorithm when validating JWT", log.Fields{
+			"kid": kid,
+			"alg": alg,
+		})
+		return errors.New("unsupported algorithm")
+	}
+
+	err = parsedJWS.Verify(publicKey, method)
 	if err != nil {
 		log.Debug("failed to verify signature of JWT", log.Err(err))
 		return err
@@ -241,6 +358,16 @@ func validateJWT(ih bittorrent.InfoHash, jwtBytes []byte, cfgIss, cfgAud string,
 	return nil
 }
 
+// anyIn returns whether any of xs is in ys.
+func anyIn(xs, ys []string) bool {
+	for _, x := range xs {
+		if in(x, ys) {
+			return true
+		}
+	}
+	return false
+}
+
 func in(x string, xs []string) bool {
 	for _, y := range xs {
 		if x == y {
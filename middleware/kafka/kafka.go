@@ -0,0 +1,404 @@
+// Package kafka implements a Hook that publishes announce events to Kafka
+// topics for analytics pipelines.
+//
+// Events are produced through a Kafka REST Proxy (API v2), so no Kafka client
+// needs to be linked into chihaya. Every record is keyed by the infohash, so
+// all events of a swarm end up in the same partition.
+package kafka
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/middleware/webhook"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/pkg/stop"
+)
+
+// Name is the name by which this middleware is registered with Chihaya.
+const Name = "kafka"
+
+func init() {
+	middleware.RegisterDriver(Name, driver{})
+	prometheus.MustRegister(promRecords)
+}
+
+var promRecords = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "chihaya_kafka_records_total",
+		Help: "The number of records produced to Kafka, by topic and result",
+	},
+	[]string{"topic", "result"},
+)
+
+var _ middleware.Driver = driver{}
+
+type driver struct{}
+
+func (d driver) NewHook(optionBytes []byte) (middleware.Hook, error) {
+	var cfg Config
+	err := yaml.Unmarshal(optionBytes, &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid options for middleware %s: %w", Name, err)
+	}
+
+	return NewHook(cfg)
+}
+
+// Config represents all the values required by this middleware to publish
+// events.
+type Config struct {
+	// RESTProxyURL is the base URL of the Kafka REST Proxy.
+	RESTProxyURL string `yaml:"rest_proxy_url"`
+
+	// Topic is the topic announce events are published to.
+	Topic string `yaml:"topic"`
+
+	// CompletedTopic, if set, is the topic completed events are published
+	// to instead of Topic.
+	CompletedTopic string `yaml:"completed_topic"`
+
+	// Events are the types of announce events to publish: "started",
+	// "completed" and "stopped". All are published if it is empty.
+	Events []string `yaml:"events"`
+
+	BatchSize     int           `yaml:"batch_size"`
+	FlushInterval time.Duration `yaml:"flush_interval"`
+	QueueSize     int           `yaml:"queue_size"`
+	MaxRetries    int           `yaml:"max_retries"`
+	RetryBackoff  time.Duration `yaml:"retry_backoff"`
+	Timeout       time.Duration `yaml:"timeout"`
+}
+
+// LogFields implements log.Fielder for a Config.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"restProxyURL":   cfg.RESTProxyURL,
+		"topic":          cfg.Topic,
+		"completedTopic": cfg.CompletedTopic,
+		"events":         cfg.Events,
+		"batchSize":      cfg.BatchSize,
+		"flushInterval":  cfg.FlushInterval,
+		"queueSize":      cfg.QueueSize,
+		"maxRetries":     cfg.MaxRetries,
+		"retryBackoff":   cfg.RetryBackoff,
+		"timeout":        cfg.Timeout,
+	}
+}
+
+// Default config constants.
+const (
+	defaultTopic         = "chihaya_announces"
+	defaultBatchSize     = 500
+	defaultFlushInterval = time.Second
+	defaultQueueSize     = 10000
+	defaultMaxRetries    = 3
+	defaultRetryBackoff  = time.Second
+	defaultTimeout       = 10 * time.Second
+)
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+//
+// This function warns to the logger when a value is changed.
+func (cfg Config) Validate() Config {
+	validcfg := cfg
+
+	if cfg.Topic == "" {
+		validcfg.Topic = defaultTopic
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".Topic",
+			"provided": cfg.Topic,
+			"default":  validcfg.Topic,
+		})
+	}
+
+	if cfg.CompletedTopic == "" {
+		validcfg.CompletedTopic = validcfg.Topic
+	}
+
+	if cfg.BatchSize <= 0 {
+		validcfg.BatchSize = defaultBatchSize
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".BatchSize",
+			"provided": cfg.BatchSize,
+			"default":  validcfg.BatchSize,
+		})
+	}
+
+	if cfg.FlushInterval <= 0 {
+		validcfg.FlushInterval = defaultFlushInterval
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".FlushInterval",
+			"provided": cfg.FlushInterval,
+			"default":  validcfg.FlushInterval,
+		})
+	}
+
+	if cfg.QueueSize <= 0 {
+		validcfg.QueueSize = defaultQueueSize
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".QueueSize",
+			"provided": cfg.QueueSize,
+			"default":  validcfg.QueueSize,
+		})
+	}
+
+	if cfg.MaxRetries <= 0 {
+		validcfg.MaxRetries = defaultMaxRetries
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".MaxRetries",
+			"provided": cfg.MaxRetries,
+			"default":  validcfg.MaxRetries,
+		})
+	}
+
+	if cfg.RetryBackoff <= 0 {
+		validcfg.RetryBackoff = defaultRetryBackoff
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".RetryBackoff",
+			"provided": cfg.RetryBackoff,
+			"default":  validcfg.RetryBackoff,
+		})
+	}
+
+	if cfg.Timeout <= 0 {
+		validcfg.Timeout = defaultTimeout
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".Timeout",
+			"provided": cfg.Timeout,
+			"default":  validcfg.Timeout,
+		})
+	}
+
+	return validcfg
+}
+
+// record is a record in the JSON embedded format of the REST Proxy.
+type record struct {
+	Key   string        `json:"key"`
+	Value webhook.Event `json:"value"`
+}
+
+type message struct {
+	topic  string
+	record record
+}
+
+type hook struct {
+	cfg    Config
+	events map[string]bool
+	client *http.Client
+	queue  chan message
+
+	closing chan struct{}
+	wg      sync.WaitGroup
+}
+
+// NewHook returns an instance of the Kafka middleware.
+func NewHook(provided Config) (middleware.Hook, error) {
+	cfg := provided.Validate()
+	if cfg.RESTProxyURL == "" {
+		return nil, fmt.Errorf("no Kafka REST Proxy URL configured")
+	}
+
+	h := &hook{
+		cfg:     cfg,
+		events:  make(map[string]bool),
+		client:  &http.Client{Timeout: cfg.Timeout},
+		queue:   make(chan message, cfg.QueueSize),
+		closing: make(chan struct{}),
+	}
+
+	events := cfg.Events
+	if len(events) == 0 {
+		events = []string{webhook.EventStarted, webhook.EventCompleted, webhook.EventStopped}
+	}
+	for _, e := range events {
+		switch e {
+		case webhook.EventStarted, webhook.EventCompleted, webhook.EventStopped:
+			h.events[e] = true
+		default:
+			return nil, fmt.Errorf("unknown event %q", e)
+		}
+	}
+
+	h.wg.Add(1)
+	go h.run()
+
+	return h, nil
+}
+
+// run collects records into batches per topic and produces them until the
+// hook is stopped, then produces the remaining records.
+func (h *hook) run() {
+	defer h.wg.Done()
+	t := time.NewTicker(h.cfg.FlushInterval)
+	defer t.Stop()
+
+	batches := make(map[string][]record)
+	add := func(m message) {
+		batch := append(batches[m.topic], m.record)
+		if len(batch) >= h.cfg.BatchSize {
+			h.produce(m.topic, batch)
+			batch = batch[:0]
+		}
+		batches[m.topic] = batch
+	}
+	flush := func() {
+		for topic, batch := range batches {
+			if len(batch) > 0 {
+				h.produce(topic, batch)
+				batches[topic] = batch[:0]
+			}
+		}
+	}
+
+	for {
+		select {
+		case m := <-h.queue:
+			add(m)
+		case <-t.C:
+			flush()
+		case <-h.closing:
+			for {
+				select {
+				case m := <-h.queue:
+					add(m)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// produce sends a batch of records to a topic, retrying with exponential
+// backoff. The backoff is skipped once the hook is stopped.
+func (h *hook) produce(topic string, batch []record) {
+	body, err := json.Marshal(struct {
+		Records []record `json:"records"`
+	}{batch})
+	if err != nil {
+		log.Error("failed to encode Kafka records", log.Err(err))
+		return
+	}
+
+	backoff := h.cfg.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		failed, err := h.produceOnce(topic, body)
+		if err == nil {
+			promRecords.WithLabelValues(topic, "success").Add(float64(len(batch) - failed))
+			if failed > 0 {
+				// Records that failed individually are not retried, so
+				// that the other records aren't produced twice.
+				promRecords.WithLabelValues(topic, "failure").Add(float64(failed))
+				log.Error("failed to produce some Kafka records", log.Fields{"topic": topic, "failed": failed})
+			}
+			return
+		}
+
+		if attempt >= h.cfg.MaxRetries {
+			promRecords.WithLabelValues(topic, "failure").Add(float64(len(batch)))
+			log.Error("failed to produce Kafka records", log.Fields{"topic": topic, "records": len(batch)}, log.Err(err))
+			return
+		}
+
+		select {
+		case <-h.closing:
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// produceOnce posts records to the REST Proxy and returns the number of
+// records that could not be produced.
+func (h *hook) produceOnce(topic string, body []byte) (int, error) {
+	url := strings.TrimSuffix(h.cfg.RESTProxyURL, "/") + "/topics/" + topic
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/vnd.kafka.json.v2+json")
+	req.Header.Set("Accept", "application/vnd.kafka.v2+json")
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	var result struct {
+		Offsets []struct {
+			ErrorCode *int `json:"error_code"`
+		} `json:"offsets"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return 0, err
+	}
+
+	failed := 0
+	for _, o := range result.Offsets {
+		if o.ErrorCode != nil {
+			failed++
+		}
+	}
+	return failed, nil
+}
+
+// Stop produces all queued records and stops the hook.
+func (h *hook) Stop() stop.Result {
+	select {
+	case <-h.closing:
+		return stop.AlreadyStopped
+	default:
+	}
+	c := make(stop.Channel)
+	go func() {
+		close(h.closing)
+		h.wg.Wait()
+		c.Done()
+	}()
+	return c.Result()
+}
+
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	e, ok := webhook.NewAnnounceEvent(req)
+	if !ok || !h.events[e.Type] {
+		return ctx, nil
+	}
+
+	topic := h.cfg.Topic
+	if e.Type == webhook.EventCompleted {
+		topic = h.cfg.CompletedTopic
+	}
+
+	select {
+	case h.queue <- message{topic: topic, record: record{Key: e.InfoHash, Value: e}}:
+	default:
+		promRecords.WithLabelValues(topic, "dropped").Inc()
+	}
+	return ctx, nil
+}
+
+func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrapes are not published.
+	return ctx, nil
+}
@@ -0,0 +1,64 @@
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+func TestProduce(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		records = make(map[string][]record)
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "application/vnd.kafka.json.v2+json", r.Header.Get("Content-Type"))
+
+		var body struct {
+			Records []record `json:"records"`
+		}
+		require.Nil(t, json.NewDecoder(r.Body).Decode(&body))
+
+		mu.Lock()
+		topic := r.URL.Path[len("/topics/"):]
+		records[topic] = append(records[topic], body.Records...)
+		mu.Unlock()
+
+		fmt.Fprint(w, `{"offsets":[{"partition":0,"offset":1}]}`)
+	}))
+	defer srv.Close()
+
+	mh, err := NewHook(Config{
+		RESTProxyURL:   srv.URL,
+		Topic:          "announces",
+		CompletedTopic: "completions",
+		FlushInterval:  time.Hour,
+	})
+	require.Nil(t, err)
+
+	for _, event := range []bittorrent.Event{bittorrent.Started, bittorrent.None, bittorrent.Completed} {
+		req := &bittorrent.AnnounceRequest{Event: event, InfoHash: bittorrent.InfoHash{byte(event)}}
+		_, err = mh.HandleAnnounce(context.Background(), req, &bittorrent.AnnounceResponse{})
+		require.Nil(t, err)
+	}
+
+	// Stopping flushes all records.
+	require.Nil(t, mh.(*hook).Stop().Wait())
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, records["announces"], 1)
+	require.Equal(t, bittorrent.InfoHash{byte(bittorrent.Started)}.String(), records["announces"][0].Key)
+	require.Equal(t, "started", records["announces"][0].Value.Type)
+	require.Len(t, records["completions"], 1)
+	require.Equal(t, "completed", records["completions"][0].Value.Type)
+}
@@ -0,0 +1,75 @@
+package middleware
+
+import (
+	"context"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+// ErrTrackerBusy is returned when a request could not be processed because
+// the maximum number of concurrent requests has been reached.
+var ErrTrackerBusy = bittorrent.RegisterClientError("tracker_busy", "tracker is busy, try again later")
+
+// limiter bounds the number of requests processed concurrently.
+//
+// A nil limiter does not impose any limit.
+type limiter struct {
+	sem     chan struct{}
+	timeout time.Duration
+}
+
+// newLimiter creates a limiter allowing up to max concurrent requests.
+// If max is not positive, nil is returned.
+func newLimiter(max int, timeout time.Duration) *limiter {
+	if max <= 0 {
+		return nil
+	}
+
+	return &limiter{
+		sem:     make(chan struct{}, max),
+		timeout: timeout,
+	}
+}
+
+// tryAcquire waits up to the timeout of the limiter for a slot to become
+// available and reports whether one was acquired.
+func (l *limiter) tryAcquire(ctx context.Context) bool {
+	if l == nil {
+		return true
+	}
+
+	select {
+	case l.sem <- struct{}{}:
+		promInFlightRequests.Inc()
+		return true
+	default:
+	}
+
+	if l.timeout <= 0 {
+		return false
+	}
+
+	t := time.NewTimer(l.timeout)
+	defer t.Stop()
+
+	select {
+	case l.sem <- struct{}{}:
+		promInFlightRequests.Inc()
+		return true
+	case <-t.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// release frees a slot previously obtained by tryAcquire.
+func (l *limiter) release() {
+	if l == nil {
+		return
+	}
+
+	<-l.sem
+	promInFlightRequests.Dec()
+}
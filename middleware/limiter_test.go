@@ -0,0 +1,32 @@
+package middleware
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimiter(t *testing.T) {
+	var unlimited *limiter
+	require.True(t, unlimited.tryAcquire(context.Background()))
+	unlimited.release()
+
+	l := newLimiter(1, 10*time.Millisecond)
+	require.True(t, l.tryAcquire(context.Background()))
+	require.False(t, l.tryAcquire(context.Background()))
+
+	l.release()
+	require.True(t, l.tryAcquire(context.Background()))
+	l.release()
+
+	// A slot freed while waiting is acquired.
+	l = newLimiter(1, time.Minute)
+	require.True(t, l.tryAcquire(context.Background()))
+	done := make(chan bool)
+	go func() { done <- l.tryAcquire(context.Background()) }()
+	l.release()
+	require.True(t, <-done)
+	l.release()
+}
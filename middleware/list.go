@@ -0,0 +1,71 @@
+package middleware
+
+import (
+	"sort"
+	"sync"
+)
+
+// A List is a list of a middleware, such as the networks blocked by the
+// blocklist, whose entries can be changed at runtime through the admin API.
+//
+// Entries added at runtime are shared by all hooks of the middleware and
+// kept when the hooks are reloaded, but not when Chihaya is restarted.
+type List interface {
+	// Add adds an entry, or returns an error if it is invalid.
+	Add(entry string) error
+
+	// Remove removes an entry and reports whether it was listed.
+	Remove(entry string) bool
+
+	// Entries returns the entries added at runtime.
+	Entries() []string
+}
+
+var (
+	listsM sync.RWMutex
+	lists  = make(map[string]List)
+)
+
+// RegisterList makes a List available to the admin API by the provided name.
+//
+// If called twice with the same name, the name is blank, or if the provided
+// List is nil, this function panics.
+func RegisterList(name string, l List) {
+	if name == "" {
+		panic("middleware: could not register a List with an empty name")
+	}
+	if l == nil {
+		panic("middleware: could not register a nil List")
+	}
+
+	listsM.Lock()
+	defer listsM.Unlock()
+
+	if _, dup := lists[name]; dup {
+		panic("middleware: RegisterList called twice for " + name)
+	}
+
+	lists[name] = l
+}
+
+// ListByName returns the List registered by the name, if any.
+func ListByName(name string) (List, bool) {
+	listsM.RLock()
+	defer listsM.RUnlock()
+
+	l, ok := lists[name]
+	return l, ok
+}
+
+// ListNames returns the sorted names of the registered Lists.
+func ListNames() []string {
+	listsM.RLock()
+	defer listsM.RUnlock()
+
+	names := make([]string, 0, len(lists))
+	for name := range lists {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
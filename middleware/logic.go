@@ -2,88 +2,297 @@ package middleware
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
 	"time"
 
 	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/bittorrent/clientid"
 	"github.com/chihaya/chihaya/frontend"
+	"github.com/chihaya/chihaya/middleware/pkg/random"
+	"github.com/chihaya/chihaya/pkg/drain"
 	"github.com/chihaya/chihaya/pkg/log"
 	"github.com/chihaya/chihaya/pkg/stop"
+	"github.com/chihaya/chihaya/pkg/timecache"
 	"github.com/chihaya/chihaya/storage"
+	"github.com/chihaya/chihaya/storage/memory"
 )
 
 // ResponseConfig holds the configuration used for the actual response.
 //
+// MaxConcurrentRequests bounds the number of announces and scrapes processed
+// at the same time across all frontends. Requests that cannot be processed
+// within ConcurrencyTimeout are rejected. A value of zero disables the limit.
+// The post-hooks of requests are not limited: they update the swarms with
+// requests that were already answered, so they must neither be dropped nor
+// hold up the requests waiting for a slot.
+//
+// If AnnounceIntervalJitter is positive, the interval of every announce
+// response is shifted by a random duration of up to AnnounceIntervalJitter in
+// either direction, but never below MinAnnounceInterval. This spreads out
+// reannounces of clients that announced at the same time, e.g. after a restart.
+//
+// If EnablePeerMix is true, announce responses to leechers consist of
+// seeders by the fraction PeerMixSeedersToLeechers and of leechers otherwise,
+// and responses to seeders of seeders by the fraction PeerMixSeedersToSeeders.
+// If a swarm lacks peers of one kind, more of the other are returned.
+// Otherwise the mix is left to the PeerStore.
+//
+// TrackerID is sent in every announce response, so that clients send it back
+// as the trackerid parameter of their following announces, which hooks find
+// in the TrackerID of the request. If it is empty, a random tracker ID is
+// generated on startup; deployments with several instances should configure
+// the same one for all of them.
+//
+// If EnableFullScrape is true, scrapes without infohashes are answered with
+// the counts of all swarms, which are collected from the PeerStore every
+// FullScrapeInterval.
+//
+// WebTorrent peers, whose requests are marked by frontend.WebTorrentKey, are
+// kept in swarms of their own in a memory PeerStore, because they can only
+// connect to each other.
+//
 // TODO(jzelinskie): Evaluate whether we would like to make this optional.
 // We can make Chihaya extensible enough that you can program a new response
 // generator at the cost of making it possible for users to create config that
 // won't compose a functional tracker.
 type ResponseConfig struct {
-	AnnounceInterval    time.Duration `yaml:"announce_interval"`
-	MinAnnounceInterval time.Duration `yaml:"min_announce_interval"`
+	AnnounceInterval         time.Duration `yaml:"announce_interval"`
+	MinAnnounceInterval      time.Duration `yaml:"min_announce_interval"`
+	AnnounceIntervalJitter   time.Duration `yaml:"announce_interval_jitter"`
+	MaxConcurrentRequests    int           `yaml:"max_concurrent_requests"`
+	ConcurrencyTimeout       time.Duration `yaml:"concurrency_timeout"`
+	EnableFullScrape         bool          `yaml:"enable_full_scrape"`
+	FullScrapeInterval       time.Duration `yaml:"full_scrape_interval"`
+	EnablePeerMix            bool          `yaml:"enable_peer_mix"`
+	PeerMixSeedersToLeechers float64       `yaml:"peer_mix_seeders_to_leechers"`
+	PeerMixSeedersToSeeders  float64       `yaml:"peer_mix_seeders_to_seeders"`
+	TrackerID                string        `yaml:"tracker_id"`
 }
 
 var _ frontend.TrackerLogic = &Logic{}
 
+var errLogicStopped = errors.New("tracker logic was stopped")
+
+// The configuration of the PeerStore of the swarms of WebTorrent peers. Peers
+// expire after two announce intervals.
+const (
+	webTorrentShardCount = 64
+	webTorrentGCInterval = time.Minute
+)
+
 // NewLogic creates a new instance of a TrackerLogic that executes the provided
 // middleware hooks.
 func NewLogic(cfg ResponseConfig, peerStore storage.PeerStore, preHooks, postHooks []Hook) *Logic {
-	return &Logic{
-		announceInterval:    cfg.AnnounceInterval,
-		minAnnounceInterval: cfg.MinAnnounceInterval,
-		peerStore:           peerStore,
-		preHooks:            append(preHooks, &responseHook{store: peerStore}),
-		postHooks:           append(postHooks, &swarmInteractionHook{store: peerStore}),
+	l := &Logic{
+		announceInterval:       cfg.AnnounceInterval,
+		minAnnounceInterval:    cfg.MinAnnounceInterval,
+		announceIntervalJitter: cfg.AnnounceIntervalJitter,
+		trackerID:              cfg.TrackerID,
+		peerStore:              peerStore,
+		limiter:                newLimiter(cfg.MaxConcurrentRequests, cfg.ConcurrencyTimeout),
+		webTorrentCfg: memory.Config{
+			ShardCount:                webTorrentShardCount,
+			GarbageCollectionInterval: webTorrentGCInterval,
+			PeerLifetime:              2 * (cfg.AnnounceInterval + cfg.AnnounceIntervalJitter),
+			DisableMetrics:            true,
+		},
 	}
+
+	if l.trackerID == "" {
+		l.trackerID = newTrackerID()
+		log.Info("generated tracker ID", log.Fields{"trackerID": l.trackerID})
+	}
+
+	if cfg.EnablePeerMix {
+		if pm, ok := peerStore.(storage.PeerMixer); ok {
+			l.mixer = pm
+			l.mix = newPeerMix(cfg)
+		} else {
+			log.Error("peer mixes are not supported by the storage, disabling them")
+		}
+	}
+	if cfg.EnableFullScrape {
+		if fs, ok := peerStore.(storage.FullScraper); ok {
+			interval := cfg.FullScrapeInterval
+			if interval <= 0 {
+				interval = defaultFullScrapeInterval
+				log.Warn("falling back to default configuration", log.Fields{
+					"name":     "FullScrapeInterval",
+					"provided": cfg.FullScrapeInterval,
+					"default":  interval,
+				})
+			}
+			l.fullScrape = newFullScrapeCache(fs, interval)
+		} else {
+			log.Error("full scrapes are not supported by the storage, disabling them")
+		}
+	}
+
+	l.chain = l.newChain(preHooks, postHooks)
+	return l
 }
 
 // Logic is an implementation of the TrackerLogic that functions by
 // executing a series of middleware hooks.
 type Logic struct {
-	announceInterval    time.Duration
-	minAnnounceInterval time.Duration
-	peerStore           storage.PeerStore
-	preHooks            []Hook
-	postHooks           []Hook
+	announceInterval       time.Duration
+	minAnnounceInterval    time.Duration
+	announceIntervalJitter time.Duration
+	trackerID              string
+	peerStore              storage.PeerStore
+	limiter                *limiter
+
+	// drain is the drain state of the tracker, or nil if it never drains.
+	drain *drain.State
+
+	// mix is nil if peer mixes are disabled.
+	mix   *peerMix
+	mixer storage.PeerMixer
+
+	// fullScrape is nil if full scrapes are disabled.
+	fullScrape *fullScrapeCache
+
+	// webTorrentStore holds the swarms of WebTorrent peers. It is created
+	// on the first request of a WebTorrent peer.
+	webTorrentCfg     memory.Config
+	webTorrentMu      sync.Mutex
+	webTorrentStore   storage.PeerStore
+	webTorrentStopped bool
+
+	chainMu sync.RWMutex
+	chain   *hookChain
+}
+
+// SetDrain sets the drain state of the tracker the Logic serves, which
+// outlives the Logic if it is replaced on reload. Without one, the Logic never
+// drains.
+//
+// It must be called before the Logic handles requests.
+func (l *Logic) SetDrain(s *drain.State) {
+	l.drain = s
 }
 
 // HandleAnnounce generates a response for an Announce.
 func (l *Logic) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest) (_ context.Context, resp *bittorrent.AnnounceResponse, err error) {
-	resp = &bittorrent.AnnounceResponse{
-		Interval:    l.announceInterval,
-		MinInterval: l.minAnnounceInterval,
-		Compact:     req.Compact,
-	}
-	for _, h := range l.preHooks {
-		if ctx, err = h.HandleAnnounce(ctx, req, resp); err != nil {
-			return nil, nil, err
-		}
+	if !l.limiter.tryAcquire(ctx) {
+		promRejectedRequests.WithLabelValues("announce").Inc()
+		return nil, nil, ErrTrackerBusy
 	}
+	defer l.limiter.release()
+
+	c := l.acquireChain()
+	defer c.release()
+
+	resp = bittorrent.NewAnnounceResponse()
+	resp.Interval = l.interval(req)
+	resp.MinInterval = l.minAnnounceInterval
+	resp.Compact = req.Compact
+	resp.TrackerID = l.trackerID
+	if ctx, err = handleAnnounce(ctx, c.preHooks, c.preSpans, req, resp); err != nil {
+		return nil, nil, err
+	}
+	ctx = applyDrain(ctx, resp, l.drain.AnnounceInterval())
+	promAnnouncesByClient.WithLabelValues(clientid.Parse(req.Peer.ID).Name).Inc()
 
 	log.Debug("generated announce response", resp)
 	return ctx, resp, nil
 }
 
+// applyDrain raises the intervals of an announce response to the interval of
+// the drain mode, if the tracker is draining, and keeps the announce from
+// creating a swarm if the swarm is empty.
+//
+// Whether the swarm is empty is recorded by the response hook, because the
+// counts of the response include the announcing peer of an empty swarm. If
+// the response hook was skipped, the counts of the response are used.
+func applyDrain(ctx context.Context, resp *bittorrent.AnnounceResponse, interval time.Duration) context.Context {
+	if interval <= 0 {
+		return ctx
+	}
+
+	if resp.Interval < interval {
+		resp.Interval = interval
+	}
+	if resp.MinInterval < interval {
+		resp.MinInterval = interval
+	}
+	empty := ctx.Value(emptySwarmKey) != nil
+	if ctx.Value(SkipResponseHookKey) != nil {
+		empty = resp.Complete == 0 && resp.Incomplete == 0
+	}
+	if empty {
+		ctx = context.WithValue(ctx, SkipSwarmInteractionKey, struct{}{})
+	}
+	return ctx
+}
+
+// newTrackerID returns a random tracker ID.
+func newTrackerID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic("failed to generate tracker ID: " + err.Error())
+	}
+	return hex.EncodeToString(b)
+}
+
+// interval returns the announce interval for a response to the given request.
+func (l *Logic) interval(req *bittorrent.AnnounceRequest) time.Duration {
+	if l.announceIntervalJitter < time.Second {
+		return l.announceInterval
+	}
+
+	// Mix in the current time so that subsequent announces of the same peer
+	// get different intervals.
+	s0, s1 := random.DeriveEntropyFromRequest(req)
+	s1 ^= uint64(timecache.NowUnixNano())
+	jitter := int(l.announceIntervalJitter / time.Second)
+	v, _, _ := random.Intn(s0, s1, 2*jitter+1)
+
+	interval := l.announceInterval + time.Duration(v-jitter)*time.Second
+	if interval < l.minAnnounceInterval {
+		interval = l.minAnnounceInterval
+	}
+	return interval
+}
+
 // AfterAnnounce does something with the results of an Announce after it has
 // been completed.
+//
+// The request and response are released to their pools afterwards and must
+// not be used by the caller anymore.
 func (l *Logic) AfterAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) {
-	var err error
-	for _, h := range l.postHooks {
-		if ctx, err = h.HandleAnnounce(ctx, req, resp); err != nil {
-			log.Error("post-announce hooks failed", log.Err(err))
-			return
-		}
+	defer func() {
+		bittorrent.ReleaseAnnounceRequest(req)
+		bittorrent.ReleaseAnnounceResponse(resp)
+	}()
+
+	c := l.acquireChain()
+	defer c.release()
+
+	if _, err := handleAnnounce(ctx, c.postHooks, c.postSpans, req, resp); err != nil {
+		log.Error("post-announce hooks failed", log.Err(err))
 	}
 }
 
 // HandleScrape generates a response for a Scrape.
 func (l *Logic) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest) (_ context.Context, resp *bittorrent.ScrapeResponse, err error) {
+	if !l.limiter.tryAcquire(ctx) {
+		promRejectedRequests.WithLabelValues("scrape").Inc()
+		return nil, nil, ErrTrackerBusy
+	}
+	defer l.limiter.release()
+
+	c := l.acquireChain()
+	defer c.release()
+
 	resp = &bittorrent.ScrapeResponse{
 		Files: make([]bittorrent.Scrape, 0, len(req.InfoHashes)),
 	}
-	for _, h := range l.preHooks {
-		if ctx, err = h.HandleScrape(ctx, req, resp); err != nil {
-			return nil, nil, err
-		}
+	if ctx, err = handleScrape(ctx, c.preHooks, c.preSpans, req, resp); err != nil {
+		return nil, nil, err
 	}
 
 	log.Debug("generated scrape response", resp)
@@ -93,33 +302,63 @@ func (l *Logic) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest)
 // AfterScrape does something with the results of a Scrape after it has been
 // completed.
 func (l *Logic) AfterScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) {
-	var err error
-	for _, h := range l.postHooks {
-		if ctx, err = h.HandleScrape(ctx, req, resp); err != nil {
-			log.Error("post-scrape hooks failed", log.Err(err))
-			return
-		}
+	c := l.acquireChain()
+	defer c.release()
+
+	if _, err := handleScrape(ctx, c.postHooks, c.postSpans, req, resp); err != nil {
+		log.Error("post-scrape hooks failed", log.Err(err))
 	}
 }
 
 // Stop stops the Logic.
 //
-// This stops any hooks that implement stop.Stopper.
+// This stops any hooks that implement stop.Stopper once the calls currently
+// executing them have returned, and afterwards the swarms of WebTorrent peers.
 func (l *Logic) Stop() stop.Result {
+	l.chainMu.RLock()
+	c := l.chain
+	l.chainMu.RUnlock()
+
 	stopGroup := stop.NewGroup()
-	for _, hook := range l.preHooks {
-		stoppable, ok := hook.(stop.Stopper)
-		if ok {
-			stopGroup.Add(stoppable)
-		}
+	stopGroup.AddFunc(c.stop)
+	if l.fullScrape != nil {
+		stopGroup.Add(l.fullScrape)
 	}
 
-	for _, hook := range l.postHooks {
-		stoppable, ok := hook.(stop.Stopper)
-		if ok {
-			stopGroup.Add(stoppable)
+	// The swarms of WebTorrent peers are used by the post-hooks, so they
+	// are stopped last.
+	stopped := make(stop.Channel)
+	go func() {
+		errs := stopGroup.Stop().Wait()
+
+		l.webTorrentMu.Lock()
+		l.webTorrentStopped = true
+		ps := l.webTorrentStore
+		l.webTorrentMu.Unlock()
+		if ps != nil {
+			errs = append(errs, ps.Stop().Wait()...)
 		}
-	}
 
-	return stopGroup.Stop()
+		stopped.Done(errs...)
+	}()
+	return stopped.Result()
+}
+
+// webTorrentPeerStore returns the PeerStore of the swarms of WebTorrent
+// peers, creating it on first use.
+func (l *Logic) webTorrentPeerStore() (storage.PeerStore, error) {
+	l.webTorrentMu.Lock()
+	defer l.webTorrentMu.Unlock()
+
+	if l.webTorrentStopped {
+		return nil, errLogicStopped
+	}
+	if l.webTorrentStore == nil {
+		ps, err := memory.New(l.webTorrentCfg)
+		if err != nil {
+			return nil, err
+		}
+		l.webTorrentStore = ps
+	}
+	return l.webTorrentStore, nil
 }
@@ -5,10 +5,16 @@ import (
 	"fmt"
 	"net"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 
 	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/frontend"
+	"github.com/chihaya/chihaya/pkg/drain"
+	"github.com/chihaya/chihaya/pkg/stop"
+	"github.com/chihaya/chihaya/storage"
+	"github.com/chihaya/chihaya/storage/memory"
 )
 
 // nopHook is a Hook to measure the overhead of a no-operation Hook through
@@ -81,3 +87,446 @@ func BenchmarkHookOverhead(b *testing.B) {
 		})
 	}
 }
+
+func TestAnnounceIntervalJitter(t *testing.T) {
+	l := &Logic{
+		announceInterval:       30 * time.Minute,
+		minAnnounceInterval:    29 * time.Minute,
+		announceIntervalJitter: 2 * time.Minute,
+	}
+
+	seen := make(map[time.Duration]struct{})
+	for i := 0; i < 100; i++ {
+		req := &bittorrent.AnnounceRequest{InfoHash: bittorrent.InfoHash{byte(i), byte(i * 7)}}
+		interval := l.interval(req)
+		require.True(t, interval >= l.minAnnounceInterval, "interval %s below minimum", interval)
+		require.True(t, interval <= l.announceInterval+l.announceIntervalJitter, "interval %s above maximum", interval)
+		require.Zero(t, interval%time.Second)
+		seen[interval] = struct{}{}
+	}
+	require.True(t, len(seen) > 1, "expected intervals to vary")
+
+	l.announceIntervalJitter = 0
+	require.Equal(t, l.announceInterval, l.interval(&bittorrent.AnnounceRequest{}))
+}
+
+func TestTrackerID(t *testing.T) {
+	req := &bittorrent.AnnounceRequest{
+		Peer: bittorrent.Peer{IP: bittorrent.IP{IP: net.IPv4(10, 0, 1, 1).To4(), AddressFamily: bittorrent.IPv4}},
+	}
+
+	l := NewLogic(ResponseConfig{TrackerID: "abc"}, &peersStore{}, nil, nil)
+	_, resp, err := l.HandleAnnounce(context.Background(), req)
+	require.Nil(t, err)
+	require.Equal(t, "abc", resp.TrackerID)
+
+	// Without a configured tracker ID, every Logic generates one.
+	generated := NewLogic(ResponseConfig{}, &peersStore{}, nil, nil).trackerID
+	require.Len(t, generated, 16)
+	require.NotEqual(t, generated, NewLogic(ResponseConfig{}, &peersStore{}, nil, nil).trackerID)
+}
+
+// peersStore is a PeerStore that returns up to numWant of its peers.
+type peersStore struct {
+	storage.PeerStore
+	peers    []bittorrent.Peer
+	numWants []int
+}
+
+func (s *peersStore) ScrapeSwarm(bittorrent.InfoHash, bittorrent.AddressFamily) bittorrent.Scrape {
+	return bittorrent.Scrape{}
+}
+
+func (s *peersStore) AnnouncePeers(_ bittorrent.InfoHash, _ bool, numWant int, _ bittorrent.Peer) ([]bittorrent.Peer, error) {
+	s.numWants = append(s.numWants, numWant)
+	if numWant > len(s.peers) {
+		numWant = len(s.peers)
+	}
+	return append([]bittorrent.Peer(nil), s.peers[:numWant]...), nil
+}
+
+// reverseSelector is a PeerSelector that reverses the order of the peers.
+type reverseSelector struct {
+	nopHook
+	factor int
+}
+
+func (s *reverseSelector) Candidates(numWant int) int { return numWant * s.factor }
+
+func (s *reverseSelector) SelectPeers(_ *bittorrent.AnnounceRequest, peers []bittorrent.Peer) []bittorrent.Peer {
+	for i, j := 0, len(peers)-1; i < j; i, j = i+1, j-1 {
+		peers[i], peers[j] = peers[j], peers[i]
+	}
+	return peers
+}
+
+func TestPeerSelector(t *testing.T) {
+	store := &peersStore{}
+	for i := 0; i < 10; i++ {
+		store.peers = append(store.peers, bittorrent.Peer{
+			ID:   bittorrent.PeerID{byte(i)},
+			IP:   bittorrent.IP{IP: net.IPv4(10, 0, 0, byte(i)).To4(), AddressFamily: bittorrent.IPv4},
+			Port: 6881,
+		})
+	}
+
+	l := NewLogic(ResponseConfig{}, store, []Hook{&nopHook{}, &reverseSelector{factor: 3}, &reverseSelector{factor: 1}, &reverseSelector{factor: 3}}, nil)
+	req := &bittorrent.AnnounceRequest{
+		NumWant: 2,
+		Left:    1,
+		Peer:    bittorrent.Peer{IP: bittorrent.IP{IP: net.IPv4(10, 0, 1, 1).To4(), AddressFamily: bittorrent.IPv4}},
+	}
+	_, resp, err := l.HandleAnnounce(context.Background(), req)
+	require.Nil(t, err)
+
+	// The largest number of candidates is fetched and reversed three times
+	// before it is truncated.
+	require.Equal(t, []int{6}, store.numWants)
+	require.Equal(t, []bittorrent.Peer{store.peers[5], store.peers[4]}, resp.IPv4Peers)
+}
+
+// doublingAdjuster is an AnnounceResponseAdjuster that doubles the interval.
+type doublingAdjuster struct {
+	nopHook
+	incomplete []uint32
+}
+
+func (a *doublingAdjuster) AdjustAnnounceResponse(_ *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) {
+	a.incomplete = append(a.incomplete, resp.Incomplete)
+	resp.Interval *= 2
+}
+
+func TestAnnounceResponseAdjuster(t *testing.T) {
+	a := &doublingAdjuster{}
+	l := NewLogic(ResponseConfig{AnnounceInterval: time.Minute}, &peersStore{}, []Hook{a, &nopHook{}, a}, nil)
+	req := &bittorrent.AnnounceRequest{
+		NumWant: 2,
+		Left:    1,
+		Peer:    bittorrent.Peer{IP: bittorrent.IP{IP: net.IPv4(10, 0, 1, 1).To4(), AddressFamily: bittorrent.IPv4}},
+	}
+	_, resp, err := l.HandleAnnounce(context.Background(), req)
+	require.Nil(t, err)
+
+	// Adjusters see the filled in response, including the announcing peer.
+	require.Equal(t, []uint32{1, 1}, a.incomplete)
+	require.Equal(t, 4*time.Minute, resp.Interval)
+}
+
+func TestPostHooksNotLimited(t *testing.T) {
+	store, err := memory.New(memory.Config{
+		ShardCount:                  1,
+		GarbageCollectionInterval:   10 * time.Minute,
+		PrometheusReportingInterval: 10 * time.Minute,
+		PeerLifetime:                30 * time.Minute,
+	})
+	require.Nil(t, err)
+	defer func() { require.Nil(t, <-store.Stop()) }()
+
+	l := NewLogic(ResponseConfig{AnnounceInterval: time.Minute, MaxConcurrentRequests: 1}, store, nil, nil)
+	defer func() { require.Nil(t, <-l.Stop()) }()
+
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	req := &bittorrent.AnnounceRequest{
+		InfoHash: ih,
+		Event:    bittorrent.Started,
+		Left:     5,
+		NumWant:  10,
+		Peer: bittorrent.Peer{
+			ID:   bittorrent.PeerID{1},
+			IP:   bittorrent.IP{IP: net.IPv4(10, 0, 0, 1).To4(), AddressFamily: bittorrent.IPv4},
+			Port: 6881,
+		},
+	}
+	ctx, resp, err := l.HandleAnnounce(context.Background(), req)
+	require.Nil(t, err)
+
+	// With all slots taken, requests are rejected, but post-hooks still
+	// update the swarm without waiting for a slot.
+	require.True(t, l.limiter.tryAcquire(context.Background()))
+	defer l.limiter.release()
+
+	_, _, err = l.HandleScrape(context.Background(), &bittorrent.ScrapeRequest{
+		AddressFamily: bittorrent.IPv4,
+		InfoHashes:    []bittorrent.InfoHash{ih},
+	})
+	require.Equal(t, ErrTrackerBusy, err)
+
+	l.AfterAnnounce(ctx, req, resp)
+	require.Equal(t, uint32(1), store.ScrapeSwarm(ih, bittorrent.IPv4).Incomplete)
+}
+
+func TestDrain(t *testing.T) {
+	store, err := memory.New(memory.Config{
+		ShardCount:                  1,
+		GarbageCollectionInterval:   10 * time.Minute,
+		PrometheusReportingInterval: 10 * time.Minute,
+		PeerLifetime:                30 * time.Minute,
+	})
+	require.Nil(t, err)
+	defer func() { require.Nil(t, <-store.Stop()) }()
+
+	l := NewLogic(ResponseConfig{AnnounceInterval: time.Minute}, store, nil, nil)
+	d := drain.NewState("test")
+	defer d.Close()
+	l.SetDrain(d)
+	announce := func(ih bittorrent.InfoHash, i byte) *bittorrent.AnnounceResponse {
+		req := &bittorrent.AnnounceRequest{
+			InfoHash: ih,
+			Event:    bittorrent.Started,
+			Left:     5,
+			NumWant:  10,
+			Peer: bittorrent.Peer{
+				ID:   bittorrent.PeerID{i},
+				IP:   bittorrent.IP{IP: net.IPv4(10, 0, 0, i).To4(), AddressFamily: bittorrent.IPv4},
+				Port: 6881,
+			},
+		}
+		ctx, resp, err := l.HandleAnnounce(context.Background(), req)
+		require.Nil(t, err)
+
+		// The response is released by AfterAnnounce.
+		r := *resp
+		l.AfterAnnounce(ctx, req, resp)
+		return &r
+	}
+
+	existing := bittorrent.InfoHashFromString("00000000000000000001")
+	announce(existing, 1)
+	require.Equal(t, uint32(1), store.ScrapeSwarm(existing, bittorrent.IPv4).Incomplete)
+
+	require.True(t, d.Start())
+
+	// Announces to unknown swarms are answered with the drain interval, but
+	// do not create the swarm.
+	unknown := bittorrent.InfoHashFromString("00000000000000000002")
+	resp := announce(unknown, 2)
+	require.Equal(t, time.Hour, resp.Interval)
+	require.Equal(t, time.Hour, resp.MinInterval)
+	require.Equal(t, uint32(1), resp.Incomplete)
+	require.Equal(t, bittorrent.Scrape{InfoHash: unknown}, store.ScrapeSwarm(unknown, bittorrent.IPv4))
+
+	// Existing swarms are still updated.
+	resp = announce(existing, 3)
+	require.Equal(t, time.Hour, resp.Interval)
+	require.Equal(t, uint32(2), store.ScrapeSwarm(existing, bittorrent.IPv4).Incomplete)
+}
+
+type scrapeAdjusterKey struct{}
+
+// snatchingAdjuster is a ScrapeResponseAdjuster that sets the snatches of the
+// scrapes to a value stored in the context by its HandleScrape.
+type snatchingAdjuster struct {
+	nopHook
+}
+
+func (a *snatchingAdjuster) HandleScrape(ctx context.Context, _ *bittorrent.ScrapeRequest, _ *bittorrent.ScrapeResponse) (context.Context, error) {
+	return context.WithValue(ctx, scrapeAdjusterKey{}, uint32(7)), nil
+}
+
+func (a *snatchingAdjuster) AdjustScrapeResponse(ctx context.Context, _ *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) {
+	for i := range resp.Files {
+		resp.Files[i].Snatches = ctx.Value(scrapeAdjusterKey{}).(uint32)
+	}
+}
+
+func TestWebTorrentSwarms(t *testing.T) {
+	store, err := memory.New(memory.Config{
+		ShardCount:                  1,
+		GarbageCollectionInterval:   10 * time.Minute,
+		PrometheusReportingInterval: 10 * time.Minute,
+		PeerLifetime:                30 * time.Minute,
+	})
+	require.Nil(t, err)
+	defer func() { require.Nil(t, <-store.Stop()) }()
+
+	l := NewLogic(ResponseConfig{AnnounceInterval: time.Minute}, store, nil, nil)
+	defer func() { require.Nil(t, <-l.Stop()) }()
+
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	webTorrent := context.WithValue(context.Background(), frontend.WebTorrentKey, struct{}{})
+	announce := func(ctx context.Context, i byte) []bittorrent.Peer {
+		req := &bittorrent.AnnounceRequest{
+			InfoHash: ih,
+			Event:    bittorrent.Started,
+			Left:     5,
+			NumWant:  10,
+			Peer: bittorrent.Peer{
+				ID:   bittorrent.PeerID{i},
+				IP:   bittorrent.IP{IP: net.IPv4(10, 0, 0, i).To4(), AddressFamily: bittorrent.IPv4},
+				Port: 6881,
+			},
+		}
+		ctx, resp, err := l.HandleAnnounce(ctx, req)
+		require.Nil(t, err)
+
+		// The response is released by AfterAnnounce.
+		peers := append([]bittorrent.Peer(nil), resp.IPv4Peers...)
+		l.AfterAnnounce(ctx, req, resp)
+		return peers
+	}
+	ids := func(peers []bittorrent.Peer) (ids []bittorrent.PeerID) {
+		for _, p := range peers {
+			ids = append(ids, p.ID)
+		}
+		return ids
+	}
+
+	announce(context.Background(), 1)
+	announce(webTorrent, 2)
+
+	// Peers of other frontends and WebTorrent peers don't get each other.
+	require.Equal(t, []bittorrent.PeerID{{1}}, ids(announce(context.Background(), 3)))
+	require.Equal(t, []bittorrent.PeerID{{2}}, ids(announce(webTorrent, 4)))
+
+	// Scrapes count the peers of their own swarms only.
+	scrape := func(ctx context.Context) bittorrent.Scrape {
+		_, resp, err := l.HandleScrape(ctx, &bittorrent.ScrapeRequest{
+			AddressFamily: bittorrent.IPv4,
+			InfoHashes:    []bittorrent.InfoHash{ih},
+		})
+		require.Nil(t, err)
+		return resp.Files[0]
+	}
+	require.Equal(t, uint32(2), scrape(context.Background()).Incomplete)
+	require.Equal(t, uint32(2), scrape(webTorrent).Incomplete)
+	require.Equal(t, uint32(2), store.ScrapeSwarm(ih, bittorrent.IPv4).Incomplete)
+}
+
+func TestScrapeResponseAdjuster(t *testing.T) {
+	l := NewLogic(ResponseConfig{}, &peersStore{}, []Hook{&snatchingAdjuster{}, &nopHook{}}, nil)
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	_, resp, err := l.HandleScrape(context.Background(), &bittorrent.ScrapeRequest{InfoHashes: []bittorrent.InfoHash{ih}})
+	require.Nil(t, err)
+	require.Len(t, resp.Files, 1)
+	require.Equal(t, uint32(7), resp.Files[0].Snatches)
+}
+
+func TestPartialSeed(t *testing.T) {
+	store, err := memory.New(memory.Config{
+		ShardCount:                  1,
+		GarbageCollectionInterval:   10 * time.Minute,
+		PrometheusReportingInterval: 10 * time.Minute,
+		PeerLifetime:                30 * time.Minute,
+	})
+	require.Nil(t, err)
+	defer func() { require.Nil(t, <-store.Stop()) }()
+
+	l := NewLogic(ResponseConfig{}, store, nil, nil)
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	announce := func(i byte, left uint64, event bittorrent.Event) bittorrent.AnnounceResponse {
+		req := &bittorrent.AnnounceRequest{
+			InfoHash: ih,
+			Event:    event,
+			Left:     left,
+			NumWant:  10,
+			Peer: bittorrent.Peer{
+				ID:   bittorrent.PeerID{i},
+				IP:   bittorrent.IP{IP: net.IPv4(10, 0, 0, i).To4(), AddressFamily: bittorrent.IPv4},
+				Port: 6881,
+			},
+		}
+		ctx, resp, err := l.HandleAnnounce(context.Background(), req)
+		require.Nil(t, err)
+
+		// The response is released by AfterAnnounce.
+		r := *resp
+		r.IPv4Peers = append([]bittorrent.Peer(nil), resp.IPv4Peers...)
+		l.AfterAnnounce(ctx, req, resp)
+		return r
+	}
+
+	announce(1, 0, bittorrent.Started)
+	announce(2, 10, bittorrent.Started)
+	announce(3, 5, bittorrent.Started)
+
+	// Once stored as a partial seed, the peer only gets the leecher.
+	announce(3, 5, bittorrent.Paused)
+	resp := announce(3, 5, bittorrent.Paused)
+	require.Len(t, resp.IPv4Peers, 1)
+	require.Equal(t, bittorrent.PeerID{2}, resp.IPv4Peers[0].ID)
+
+	// The partial seed counts as complete, but seeders don't get it.
+	resp = announce(1, 0, bittorrent.None)
+	require.Equal(t, uint32(2), resp.Complete)
+	require.Equal(t, uint32(1), resp.Incomplete)
+	require.Len(t, resp.IPv4Peers, 1)
+	require.Equal(t, bittorrent.PeerID{2}, resp.IPv4Peers[0].ID)
+
+	require.Len(t, announce(2, 10, bittorrent.None).IPv4Peers, 2)
+}
+
+// blockingHook is a Hook that blocks scrapes until unblocked and records
+// whether it was stopped.
+type blockingHook struct {
+	nopHook
+	entered   chan struct{}
+	unblock   chan struct{}
+	stopped   chan struct{}
+	announces int
+}
+
+func newBlockingHook() *blockingHook {
+	return &blockingHook{
+		entered: make(chan struct{}, 1),
+		unblock: make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+}
+
+func (h *blockingHook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	h.announces++
+	return ctx, nil
+}
+
+func (h *blockingHook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	h.entered <- struct{}{}
+	<-h.unblock
+	return ctx, nil
+}
+
+func (h *blockingHook) Stop() stop.Result {
+	close(h.stopped)
+	return stop.AlreadyStopped
+}
+
+func TestSetHooks(t *testing.T) {
+	oldHook, newHook := newBlockingHook(), newBlockingHook()
+	l := NewLogic(ResponseConfig{}, &peersStore{}, []Hook{oldHook}, nil)
+	req := &bittorrent.AnnounceRequest{
+		Peer: bittorrent.Peer{IP: bittorrent.IP{IP: net.IPv4(10, 0, 1, 1).To4(), AddressFamily: bittorrent.IPv4}},
+	}
+
+	scraped := make(chan error)
+	go func() {
+		_, _, err := l.HandleScrape(context.Background(), &bittorrent.ScrapeRequest{InfoHashes: []bittorrent.InfoHash{{1}}})
+		scraped <- err
+	}()
+	<-oldHook.entered
+
+	stopped := l.SetHooks([]Hook{newHook}, nil)
+
+	// New calls run on the new hooks while the old hooks are still in use.
+	_, _, err := l.HandleAnnounce(context.Background(), req)
+	require.Nil(t, err)
+	require.Equal(t, 0, oldHook.announces)
+	require.Equal(t, 1, newHook.announces)
+
+	select {
+	case <-oldHook.stopped:
+		t.Fatal("old hook stopped while a call was in flight")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	close(oldHook.unblock)
+	require.Nil(t, <-scraped)
+	require.Empty(t, stopped.Wait())
+	<-oldHook.stopped
+
+	select {
+	case <-newHook.stopped:
+		t.Fatal("new hook stopped by replacement")
+	default:
+	}
+	require.Empty(t, l.Stop().Wait())
+	<-newHook.stopped
+}
@@ -0,0 +1,350 @@
+// Package luascript implements a Hook that applies announce and scrape
+// policies written in Lua.
+//
+// A script may define the global functions announce(req, resp) and
+// scrape(req). Returning a string rejects the request with that string as the
+// error message. Changes to the interval, min_interval and warning_message
+// fields of resp are applied to the announce response.
+package luascript
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/bittorrent/clientid"
+	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/pkg/log"
+)
+
+// Name is the name by which this middleware is registered with Chihaya.
+const Name = "lua script"
+
+func init() {
+	middleware.RegisterDriver(Name, driver{})
+}
+
+var _ middleware.Driver = driver{}
+
+type driver struct{}
+
+func (d driver) NewHook(optionBytes []byte) (middleware.Hook, error) {
+	var cfg Config
+	err := yaml.Unmarshal(optionBytes, &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid options for middleware %s: %w", Name, err)
+	}
+
+	return NewHook(cfg)
+}
+
+// ErrNoScript is returned for a config without a script.
+var ErrNoScript = errors.New("no script configured")
+
+// Config represents all the values required by this middleware to run a
+// script.
+type Config struct {
+	// Script is the path to the Lua script.
+	Script string `yaml:"script"`
+
+	// Timeout is the maximum duration of a single call into the script.
+	Timeout time.Duration `yaml:"timeout"`
+
+	// States is the number of Lua interpreters, and thereby the number of
+	// requests the script can handle concurrently.
+	States int `yaml:"states"`
+}
+
+// LogFields implements log.Fielder for a Config.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"script":  cfg.Script,
+		"timeout": cfg.Timeout,
+		"states":  cfg.States,
+	}
+}
+
+// Default config constants.
+const defaultTimeout = 50 * time.Millisecond
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+//
+// This function warns to the logger when a value is changed.
+func (cfg Config) Validate() Config {
+	validcfg := cfg
+
+	if cfg.Timeout <= 0 {
+		validcfg.Timeout = defaultTimeout
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".Timeout",
+			"provided": cfg.Timeout,
+			"default":  validcfg.Timeout,
+		})
+	}
+
+	if cfg.States <= 0 {
+		validcfg.States = runtime.GOMAXPROCS(0)
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".States",
+			"provided": cfg.States,
+			"default":  validcfg.States,
+		})
+	}
+
+	return validcfg
+}
+
+// Limits of the Lua interpreters.
+const (
+	callStackSize = 256
+	registrySize  = 1024 * 16
+)
+
+// unsafeGlobals are removed from the base library, because they give access
+// to the file system or allow loading code at runtime.
+var unsafeGlobals = []string{"dofile", "loadfile", "load", "loadstring", "require", "module", "collectgarbage"}
+
+type hook struct {
+	cfg    Config
+	proto  *lua.FunctionProto
+	states chan *lua.LState
+
+	hasAnnounce bool
+	hasScrape   bool
+}
+
+// NewHook returns an instance of the Lua script middleware.
+func NewHook(provided Config) (middleware.Hook, error) {
+	cfg := provided.Validate()
+	if cfg.Script == "" {
+		return nil, ErrNoScript
+	}
+
+	f, err := os.Open(cfg.Script)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	chunk, err := parse.Parse(f, cfg.Script)
+	if err != nil {
+		return nil, err
+	}
+	proto, err := lua.Compile(chunk, cfg.Script)
+	if err != nil {
+		return nil, err
+	}
+
+	return newHook(cfg, proto)
+}
+
+func newHook(cfg Config, proto *lua.FunctionProto) (*hook, error) {
+	h := &hook{
+		cfg:    cfg,
+		proto:  proto,
+		states: make(chan *lua.LState, cfg.States),
+	}
+
+	for i := 0; i < cfg.States; i++ {
+		L, err := h.newState()
+		if err != nil {
+			return nil, err
+		}
+		h.states <- L
+	}
+
+	L := <-h.states
+	h.hasAnnounce = L.GetGlobal("announce").Type() == lua.LTFunction
+	h.hasScrape = L.GetGlobal("scrape").Type() == lua.LTFunction
+	h.states <- L
+
+	return h, nil
+}
+
+// newState creates a sandboxed Lua interpreter and runs the script in it.
+func (h *hook) newState() (*lua.LState, error) {
+	L := lua.NewState(lua.Options{
+		SkipOpenLibs:  true,
+		CallStackSize: callStackSize,
+		RegistrySize:  registrySize,
+	})
+
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	for _, name := range unsafeGlobals {
+		L.SetGlobal(name, lua.LNil)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.cfg.Timeout)
+	defer cancel()
+	L.SetContext(ctx)
+	defer L.RemoveContext()
+
+	L.Push(L.NewFunctionFromProto(h.proto))
+	if err := L.PCall(0, 0, nil); err != nil {
+		L.Close()
+		return nil, fmt.Errorf("failed to run script: %w", err)
+	}
+
+	return L, nil
+}
+
+// call calls the global function name with args and returns the error to
+// respond with.
+func (h *hook) call(ctx context.Context, name string, args func(L *lua.LState) []lua.LValue, results func(L *lua.LState)) error {
+	L := <-h.states
+
+	ctx, cancel := context.WithTimeout(ctx, h.cfg.Timeout)
+	defer cancel()
+	L.SetContext(ctx)
+
+	err := L.CallByParam(lua.P{
+		Fn:      L.GetGlobal(name),
+		NRet:    1,
+		Protect: true,
+	}, args(L)...)
+	L.RemoveContext()
+
+	if err != nil {
+		// A state can be left in any condition by an aborted call, so it is
+		// replaced.
+		L.Close()
+		if L, err = h.newState(); err != nil {
+			log.Error("failed to replace Lua state", log.Err(err))
+			// Keep the number of states constant by retrying later.
+			go h.replaceState()
+		} else {
+			h.states <- L
+		}
+		return fmt.Errorf("lua script %s: %w", name, err)
+	}
+
+	ret := L.Get(-1)
+	L.Pop(1)
+	if results != nil {
+		results(L)
+	}
+	h.states <- L
+
+	if s, ok := ret.(lua.LString); ok {
+		return bittorrent.ClientError(s)
+	}
+	return nil
+}
+
+func (h *hook) replaceState() {
+	for {
+		time.Sleep(time.Second)
+		L, err := h.newState()
+		if err == nil {
+			h.states <- L
+			return
+		}
+	}
+}
+
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	if !h.hasAnnounce {
+		return ctx, nil
+	}
+
+	var respTable *lua.LTable
+	err := h.call(ctx, "announce", func(L *lua.LState) []lua.LValue {
+		respTable = L.NewTable()
+		respTable.RawSetString("interval", lua.LNumber(resp.Interval.Seconds()))
+		respTable.RawSetString("min_interval", lua.LNumber(resp.MinInterval.Seconds()))
+		respTable.RawSetString("warning_message", lua.LString(resp.WarningMessage))
+		return []lua.LValue{announceTable(L, req), respTable}
+	}, func(L *lua.LState) {
+		if v, ok := respTable.RawGetString("interval").(lua.LNumber); ok {
+			resp.Interval = time.Duration(float64(v) * float64(time.Second))
+		}
+		if v, ok := respTable.RawGetString("min_interval").(lua.LNumber); ok {
+			resp.MinInterval = time.Duration(float64(v) * float64(time.Second))
+		}
+		if v, ok := respTable.RawGetString("warning_message").(lua.LString); ok {
+			resp.WarningMessage = string(v)
+		}
+	})
+	return ctx, err
+}
+
+func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	if !h.hasScrape {
+		return ctx, nil
+	}
+
+	err := h.call(ctx, "scrape", func(L *lua.LState) []lua.LValue {
+		return []lua.LValue{scrapeTable(L, req)}
+	}, nil)
+	return ctx, err
+}
+
+func announceTable(L *lua.LState, req *bittorrent.AnnounceRequest) *lua.LTable {
+	t := L.NewTable()
+	t.RawSetString("event", lua.LString(req.Event.String()))
+	t.RawSetString("info_hash", lua.LString(req.InfoHash.String()))
+	t.RawSetString("peer_id", lua.LString(req.Peer.ID.String()))
+	client := clientid.Parse(req.Peer.ID)
+	t.RawSetString("client", lua.LString(client.Name))
+	t.RawSetString("client_version", lua.LString(client.Version))
+	t.RawSetString("ip", lua.LString(req.Peer.IP.String()))
+	t.RawSetString("address_family", lua.LString(req.Peer.IP.AddressFamily.String()))
+	t.RawSetString("port", lua.LNumber(req.Peer.Port))
+	t.RawSetString("left", lua.LNumber(req.Left))
+	t.RawSetString("uploaded", lua.LNumber(req.Uploaded))
+	t.RawSetString("downloaded", lua.LNumber(req.Downloaded))
+	t.RawSetString("numwant", lua.LNumber(req.NumWant))
+	t.RawSetString("tracker_id", lua.LString(req.TrackerID))
+	t.RawSetString("param", paramFunc(L, req.Params))
+	return t
+}
+
+func scrapeTable(L *lua.LState, req *bittorrent.ScrapeRequest) *lua.LTable {
+	infoHashes := L.CreateTable(len(req.InfoHashes), 0)
+	for _, ih := range req.InfoHashes {
+		infoHashes.Append(lua.LString(ih.String()))
+	}
+
+	t := L.NewTable()
+	t.RawSetString("info_hashes", infoHashes)
+	t.RawSetString("address_family", lua.LString(req.AddressFamily.String()))
+	t.RawSetString("param", paramFunc(L, req.Params))
+	return t
+}
+
+// paramFunc returns a Lua function that looks up the query parameters of a
+// request, returning nil for missing parameters.
+func paramFunc(L *lua.LState, params bittorrent.Params) *lua.LFunction {
+	return L.NewFunction(func(L *lua.LState) int {
+		key := L.CheckString(1)
+		if params != nil {
+			if v, ok := params.String(key); ok {
+				L.Push(lua.LString(v))
+				return 1
+			}
+		}
+		L.Push(lua.LNil)
+		return 1
+	})
+}
@@ -0,0 +1,124 @@
+package luascript
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+const script = `
+local blocked = { ["0101010101010101010101010101010101010101"] = true }
+
+function announce(req, resp)
+	if blocked[req.info_hash] then
+		return "torrent is blocked"
+	end
+	if req.param("loop") then
+		while true do end
+	end
+	if req.event == "completed" then
+		resp.interval = resp.interval * 2
+		resp.warning_message = "thanks for seeding"
+	end
+	if req.param("file") then
+		dofile("/etc/passwd")
+	end
+	if req.param("client") then
+		resp.warning_message = req.client .. " " .. req.client_version
+	end
+end
+
+function scrape(req)
+	if #req.info_hashes > 2 then
+		return "too many infohashes"
+	end
+end
+`
+
+func newTestHook(t *testing.T, cfg Config, script string) *hook {
+	cfg.Script = filepath.Join(t.TempDir(), "policy.lua")
+	require.Nil(t, os.WriteFile(cfg.Script, []byte(script), 0o600))
+
+	h, err := NewHook(cfg)
+	require.Nil(t, err)
+	return h.(*hook)
+}
+
+func TestAnnounce(t *testing.T) {
+	h := newTestHook(t, Config{Timeout: 100 * time.Millisecond, States: 1}, script)
+	ctx := context.Background()
+
+	announce := func(query string, ih bittorrent.InfoHash, event bittorrent.Event) (*bittorrent.AnnounceResponse, error) {
+		params, err := bittorrent.ParseURLData("/announce?" + query)
+		require.Nil(t, err)
+		req := &bittorrent.AnnounceRequest{
+			InfoHash: ih,
+			Event:    event,
+			Peer:     bittorrent.Peer{IP: bittorrent.IP{IP: net.ParseIP("10.0.0.1").To4(), AddressFamily: bittorrent.IPv4}},
+			Params:   params,
+		}
+		resp := &bittorrent.AnnounceResponse{Interval: time.Minute, MinInterval: time.Minute}
+		_, err = h.HandleAnnounce(ctx, req, resp)
+		return resp, err
+	}
+
+	resp, err := announce("", bittorrent.InfoHash{}, bittorrent.None)
+	require.Nil(t, err)
+	require.Equal(t, time.Minute, resp.Interval)
+
+	_, err = announce("", bittorrent.InfoHashFromString("\x01\x01\x01\x01\x01\x01\x01\x01\x01\x01\x01\x01\x01\x01\x01\x01\x01\x01\x01\x01"), bittorrent.None)
+	require.Equal(t, bittorrent.ClientError("torrent is blocked"), err)
+
+	resp, err = announce("", bittorrent.InfoHash{}, bittorrent.Completed)
+	require.Nil(t, err)
+	require.Equal(t, 2*time.Minute, resp.Interval)
+	require.Equal(t, time.Minute, resp.MinInterval)
+	require.Equal(t, "thanks for seeding", resp.WarningMessage)
+
+	resp, err = announce("client=1", bittorrent.InfoHash{}, bittorrent.None)
+	require.Nil(t, err)
+	require.Equal(t, "unknown ", resp.WarningMessage)
+
+	// Calls are aborted after the timeout and the state is replaced.
+	start := time.Now()
+	_, err = announce("loop=1", bittorrent.InfoHash{}, bittorrent.None)
+	require.NotNil(t, err)
+	require.Less(t, int64(time.Since(start)), int64(time.Second))
+
+	_, err = announce("file=1", bittorrent.InfoHash{}, bittorrent.None)
+	require.NotNil(t, err)
+	_, isClientErr := err.(bittorrent.ClientError)
+	require.False(t, isClientErr)
+
+	_, err = announce("", bittorrent.InfoHash{}, bittorrent.None)
+	require.Nil(t, err)
+}
+
+func TestScrape(t *testing.T) {
+	h := newTestHook(t, Config{}, script)
+
+	req := &bittorrent.ScrapeRequest{InfoHashes: []bittorrent.InfoHash{{1}, {2}}}
+	_, err := h.HandleScrape(context.Background(), req, &bittorrent.ScrapeResponse{})
+	require.Nil(t, err)
+
+	req.InfoHashes = append(req.InfoHashes, bittorrent.InfoHash{3})
+	_, err = h.HandleScrape(context.Background(), req, &bittorrent.ScrapeResponse{})
+	require.Equal(t, bittorrent.ClientError("too many infohashes"), err)
+}
+
+func TestConfig(t *testing.T) {
+	_, err := NewHook(Config{})
+	require.Equal(t, ErrNoScript, err)
+
+	// Scripts without hooks accept everything.
+	h := newTestHook(t, Config{}, "x = 1")
+	_, err = h.HandleAnnounce(context.Background(), &bittorrent.AnnounceRequest{}, &bittorrent.AnnounceResponse{})
+	require.Nil(t, err)
+}
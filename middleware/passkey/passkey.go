@@ -0,0 +1,226 @@
+// Package passkey implements a Hook that fails an Announce or Scrape if it
+// does not contain the passkey of a known and enabled user.
+//
+// Passkeys are usually part of the URL path, e.g. by configuring the HTTP
+// frontend with an announce route of "/:passkey/announce".
+//
+// Users are looked up in a UserStore, which is either kept in memory or
+// backed by Redis.
+package passkey
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/pkg/stop"
+)
+
+// Name is the name by which this middleware is registered with Chihaya.
+const Name = "passkey"
+
+func init() {
+	middleware.RegisterDriver(Name, driver{})
+}
+
+var _ middleware.Driver = driver{}
+
+type driver struct{}
+
+func (d driver) NewHook(optionBytes []byte) (middleware.Hook, error) {
+	var cfg Config
+	err := yaml.Unmarshal(optionBytes, &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid options for middleware %s: %w", Name, err)
+	}
+
+	return NewHook(cfg)
+}
+
+var (
+	// ErrMissingPasskey is returned when a request does not contain a
+	// passkey.
+	ErrMissingPasskey = bittorrent.RegisterClientError("missing_passkey", "missing passkey")
+
+	// ErrInvalidPasskey is returned when a request contains an unknown
+	// passkey.
+	ErrInvalidPasskey = bittorrent.RegisterClientError("invalid_passkey", "invalid passkey")
+
+	// ErrDisabledUser is returned when a request contains the passkey of a
+	// disabled user.
+	ErrDisabledUser = bittorrent.RegisterClientError("account_disabled", "account disabled")
+)
+
+type passkeyKey struct{}
+
+// PasskeyKey is the key under which the validated passkey of a request is
+// stored in the context passed to subsequent hooks.
+var PasskeyKey = passkeyKey{}
+
+type userKey struct{}
+
+// UserKey is the key under which the User of a request is stored in the
+// context passed to subsequent hooks.
+// The value is of type User.
+var UserKey = userKey{}
+
+// Config represents all the values required by this middleware to validate
+// passkeys.
+type Config struct {
+	// Param is the name of the route parameter containing the passkey.
+	// If the route does not contain it, the query parameter of the same name
+	// is used.
+	Param string `yaml:"param"`
+
+	// Store is the type of the UserStore, either "memory" or "redis".
+	Store string `yaml:"store"`
+
+	// Passkeys is a list of valid passkeys of the memory store. The passkeys
+	// are also used as the IDs of their users.
+	Passkeys []string `yaml:"passkeys"`
+
+	// Users is a list of users of the memory store.
+	Users []User `yaml:"users"`
+
+	// PasskeysFile is the path to a file of the memory store containing one
+	// valid passkey per line, optionally followed by whitespace and the ID
+	// of its user. It is read on startup and on every configuration reload.
+	PasskeysFile string `yaml:"passkeys_file"`
+
+	// Redis configures the redis store.
+	Redis RedisConfig `yaml:"redis"`
+}
+
+// LogFields implements log.Fielder for a Config.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"param":        cfg.Param,
+		"store":        cfg.Store,
+		"passkeys":     len(cfg.Passkeys),
+		"users":        len(cfg.Users),
+		"passkeysFile": cfg.PasskeysFile,
+		"redisURL":     cfg.Redis.URL,
+		"redisPrefix":  cfg.Redis.KeyPrefix,
+	}
+}
+
+// Store types.
+const (
+	StoreMemory = "memory"
+	StoreRedis  = "redis"
+)
+
+const (
+	defaultParam = "passkey"
+	defaultStore = StoreMemory
+)
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+//
+// This function warns to the logger when a value is changed.
+func (cfg Config) Validate() Config {
+	validcfg := cfg
+
+	if cfg.Param == "" {
+		validcfg.Param = defaultParam
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".Param",
+			"provided": cfg.Param,
+			"default":  validcfg.Param,
+		})
+	}
+
+	if cfg.Store == "" {
+		validcfg.Store = defaultStore
+	}
+
+	if validcfg.Store == StoreRedis {
+		validcfg.Redis = cfg.Redis.validate()
+	}
+
+	return validcfg
+}
+
+type hook struct {
+	param string
+	store UserStore
+}
+
+// NewHook returns an instance of the passkey middleware.
+func NewHook(provided Config) (middleware.Hook, error) {
+	cfg := provided.Validate()
+
+	h := &hook{param: cfg.Param}
+	switch cfg.Store {
+	case StoreMemory:
+		store, err := newMemoryUserStore(cfg)
+		if err != nil {
+			return nil, err
+		}
+		h.store = store
+	case StoreRedis:
+		h.store = newRedisUserStore(cfg.Redis)
+	default:
+		return nil, fmt.Errorf("unknown user store %q", cfg.Store)
+	}
+
+	return h, nil
+}
+
+// NewHookWithStore returns an instance of the passkey middleware that looks
+// up users in the given store.
+func NewHookWithStore(param string, store UserStore) middleware.Hook {
+	cfg := Config{Param: param}.Validate()
+	return &hook{param: cfg.Param, store: store}
+}
+
+// Stop closes the UserStore, if necessary.
+func (h *hook) Stop() stop.Result {
+	if s, ok := h.store.(stop.Stopper); ok {
+		return s.Stop()
+	}
+	return stop.AlreadyStopped
+}
+
+// check validates the passkey of a request and stores it and its user in the
+// context.
+func (h *hook) check(ctx context.Context, params bittorrent.Params) (context.Context, error) {
+	var passkey string
+	if rp, ok := ctx.Value(bittorrent.RouteParamsKey).(bittorrent.RouteParams); ok {
+		passkey = rp.ByName(h.param)
+	}
+	if passkey == "" && params != nil {
+		passkey, _ = params.String(h.param)
+	}
+
+	if passkey == "" {
+		return ctx, ErrMissingPasskey
+	}
+
+	user, err := h.store.LookupUser(ctx, passkey)
+	if errors.Is(err, ErrUserNotFound) {
+		return ctx, ErrInvalidPasskey
+	} else if err != nil {
+		return ctx, err
+	}
+	if user.Disabled {
+		return ctx, ErrDisabledUser
+	}
+
+	ctx = context.WithValue(ctx, PasskeyKey, passkey)
+	return context.WithValue(ctx, UserKey, user), nil
+}
+
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	return h.check(ctx, req.Params)
+}
+
+func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	return h.check(ctx, req.Params)
+}
@@ -0,0 +1,105 @@
+package passkey
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/alicebob/miniredis"
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+func TestHandleAnnounce(t *testing.T) {
+	h, err := NewHook(Config{Passkeys: []string{"secret"}})
+	require.Nil(t, err)
+
+	table := []struct {
+		name        string
+		routeParams bittorrent.RouteParams
+		uri         string
+		err         error
+	}{
+		{"route param", bittorrent.RouteParams{{Key: "passkey", Value: "secret"}}, "/announce", nil},
+		{"query param", nil, "/announce?passkey=secret", nil},
+		{"invalid", bittorrent.RouteParams{{Key: "passkey", Value: "guess"}}, "/announce", ErrInvalidPasskey},
+		{"missing", nil, "/announce", ErrMissingPasskey},
+	}
+
+	for _, tt := range table {
+		t.Run(tt.name, func(t *testing.T) {
+			params, err := bittorrent.ParseURLData(tt.uri)
+			require.Nil(t, err)
+
+			ctx := context.Background()
+			if tt.routeParams != nil {
+				ctx = context.WithValue(ctx, bittorrent.RouteParamsKey, tt.routeParams)
+			}
+
+			ctx, err = h.HandleAnnounce(ctx, &bittorrent.AnnounceRequest{Params: params}, &bittorrent.AnnounceResponse{})
+			require.Equal(t, tt.err, err)
+			if tt.err == nil {
+				require.Equal(t, "secret", ctx.Value(PasskeyKey))
+			}
+
+			_, err = h.HandleScrape(ctx, &bittorrent.ScrapeRequest{Params: params}, &bittorrent.ScrapeResponse{})
+			require.Equal(t, tt.err, err)
+		})
+	}
+}
+
+func TestPasskeysFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "passkeys")
+	require.Nil(t, os.WriteFile(path, []byte("first\n\n  second  user2\n"), 0o600))
+
+	h, err := NewHook(Config{PasskeysFile: path})
+	require.Nil(t, err)
+	store := h.(*hook).store.(*memoryUserStore)
+	require.Len(t, store.users, 2)
+	require.Equal(t, User{ID: "first", Passkey: "first"}, store.users["first"])
+	require.Equal(t, User{ID: "user2", Passkey: "second"}, store.users["second"])
+
+	_, err = NewHook(Config{})
+	require.NotNil(t, err)
+}
+
+func TestUserStores(t *testing.T) {
+	rs, err := miniredis.Run()
+	require.Nil(t, err)
+	defer rs.Close()
+	rs.HSet("chihaya_user_secret", "id", "42")
+	rs.HSet("chihaya_user_banned", "disabled", "1")
+
+	stores := map[string]Config{
+		"memory": {Users: []User{
+			{ID: "42", Passkey: "secret"},
+			{Passkey: "banned", Disabled: true},
+		}},
+		"redis": {Store: StoreRedis, Redis: RedisConfig{URL: "redis://" + rs.Addr()}},
+	}
+
+	for name, cfg := range stores {
+		t.Run(name, func(t *testing.T) {
+			h, err := NewHook(cfg)
+			require.Nil(t, err)
+			defer func() { require.Nil(t, h.(*hook).Stop().Wait()) }()
+
+			check := func(passkey string) (context.Context, error) {
+				ctx := context.WithValue(context.Background(), bittorrent.RouteParamsKey, bittorrent.RouteParams{{Key: "passkey", Value: passkey}})
+				return h.HandleAnnounce(ctx, &bittorrent.AnnounceRequest{}, &bittorrent.AnnounceResponse{})
+			}
+
+			ctx, err := check("secret")
+			require.Nil(t, err)
+			require.Equal(t, User{ID: "42", Passkey: "secret"}, ctx.Value(UserKey))
+
+			_, err = check("banned")
+			require.Equal(t, ErrDisabledUser, err)
+
+			_, err = check("guess")
+			require.Equal(t, ErrInvalidPasskey, err)
+		})
+	}
+}
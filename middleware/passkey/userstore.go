@@ -0,0 +1,224 @@
+package passkey
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/pkg/stop"
+)
+
+// ErrUserNotFound is returned by a UserStore if no user has the passkey.
+var ErrUserNotFound = errors.New("user not found")
+
+// User is a user of a private tracker.
+type User struct {
+	// ID identifies the user, e.g. for accounting in subsequent hooks.
+	ID       string `yaml:"id"`
+	Passkey  string `yaml:"passkey"`
+	Disabled bool   `yaml:"disabled"`
+}
+
+// UserStore looks up users by their passkey.
+//
+// Implementations must be safe for concurrent use and may implement
+// stop.Stopper if they need to be closed.
+type UserStore interface {
+	// LookupUser returns the user with the given passkey or
+	// ErrUserNotFound.
+	LookupUser(ctx context.Context, passkey string) (User, error)
+}
+
+// memoryUserStore is a UserStore of a fixed set of users.
+type memoryUserStore struct {
+	users map[string]User
+}
+
+func newMemoryUserStore(cfg Config) (*memoryUserStore, error) {
+	s := &memoryUserStore{users: make(map[string]User)}
+
+	for _, passkey := range cfg.Passkeys {
+		s.users[passkey] = User{ID: passkey, Passkey: passkey}
+	}
+
+	for _, user := range cfg.Users {
+		if user.Passkey == "" {
+			return nil, fmt.Errorf("user %q has no passkey", user.ID)
+		}
+		if user.ID == "" {
+			user.ID = user.Passkey
+		}
+		s.users[user.Passkey] = user
+	}
+
+	if cfg.PasskeysFile != "" {
+		if err := s.loadFile(cfg.PasskeysFile); err != nil {
+			return nil, fmt.Errorf("failed to load passkeys: %w", err)
+		}
+	}
+
+	if len(s.users) == 0 {
+		return nil, fmt.Errorf("no passkeys configured")
+	}
+
+	log.Debug("loaded passkeys", log.Fields{"count": len(s.users)})
+	return s, nil
+}
+
+func (s *memoryUserStore) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		user := User{ID: fields[0], Passkey: fields[0]}
+		if len(fields) > 1 {
+			user.ID = fields[1]
+		}
+		s.users[user.Passkey] = user
+	}
+	return scanner.Err()
+}
+
+func (s *memoryUserStore) LookupUser(_ context.Context, passkey string) (User, error) {
+	user, ok := s.users[passkey]
+	if !ok {
+		return User{}, ErrUserNotFound
+	}
+	return user, nil
+}
+
+// RedisConfig represents the configuration of a UserStore backed by Redis.
+//
+// Every user is stored as a hash under KeyPrefix followed by the passkey,
+// with the fields "id" and "disabled". A missing "id" defaults to the
+// passkey, a "disabled" value of "1" or "true" disables the user.
+type RedisConfig struct {
+	URL            string        `yaml:"url"`
+	KeyPrefix      string        `yaml:"key_prefix"`
+	ReadTimeout    time.Duration `yaml:"read_timeout"`
+	WriteTimeout   time.Duration `yaml:"write_timeout"`
+	ConnectTimeout time.Duration `yaml:"connect_timeout"`
+}
+
+// Default Redis config constants.
+const (
+	defaultRedisURL       = "redis://127.0.0.1:6379/0"
+	defaultRedisKeyPrefix = "chihaya_user_"
+	defaultRedisTimeout   = 5 * time.Second
+)
+
+func (cfg RedisConfig) validate() RedisConfig {
+	validcfg := cfg
+
+	if cfg.URL == "" {
+		validcfg.URL = defaultRedisURL
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".Redis.URL",
+			"provided": cfg.URL,
+			"default":  validcfg.URL,
+		})
+	}
+
+	if cfg.KeyPrefix == "" {
+		validcfg.KeyPrefix = defaultRedisKeyPrefix
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".Redis.KeyPrefix",
+			"provided": cfg.KeyPrefix,
+			"default":  validcfg.KeyPrefix,
+		})
+	}
+
+	for _, d := range []struct {
+		name     string
+		provided time.Duration
+		valid    *time.Duration
+	}{
+		{"ReadTimeout", cfg.ReadTimeout, &validcfg.ReadTimeout},
+		{"WriteTimeout", cfg.WriteTimeout, &validcfg.WriteTimeout},
+		{"ConnectTimeout", cfg.ConnectTimeout, &validcfg.ConnectTimeout},
+	} {
+		if d.provided <= 0 {
+			*d.valid = defaultRedisTimeout
+			log.Warn("falling back to default configuration", log.Fields{
+				"name":     Name + ".Redis." + d.name,
+				"provided": d.provided,
+				"default":  *d.valid,
+			})
+		}
+	}
+
+	return validcfg
+}
+
+// redisUserStore is a UserStore backed by Redis.
+type redisUserStore struct {
+	prefix string
+	pool   *redis.Pool
+}
+
+func newRedisUserStore(cfg RedisConfig) *redisUserStore {
+	return &redisUserStore{
+		prefix: cfg.KeyPrefix,
+		pool: &redis.Pool{
+			MaxIdle:     3,
+			IdleTimeout: 240 * time.Second,
+			Dial: func() (redis.Conn, error) {
+				return redis.DialURL(cfg.URL,
+					redis.DialReadTimeout(cfg.ReadTimeout),
+					redis.DialWriteTimeout(cfg.WriteTimeout),
+					redis.DialConnectTimeout(cfg.ConnectTimeout),
+				)
+			},
+		},
+	}
+}
+
+func (s *redisUserStore) LookupUser(ctx context.Context, passkey string) (User, error) {
+	conn, err := s.pool.GetContext(ctx)
+	if err != nil {
+		return User{}, err
+	}
+	defer conn.Close()
+
+	fields, err := redis.StringMap(conn.Do("HGETALL", s.prefix+passkey))
+	if err != nil {
+		return User{}, err
+	}
+	if len(fields) == 0 {
+		return User{}, ErrUserNotFound
+	}
+
+	user := User{ID: fields["id"], Passkey: passkey}
+	if user.ID == "" {
+		user.ID = passkey
+	}
+	switch fields["disabled"] {
+	case "1", "true":
+		user.Disabled = true
+	}
+	return user, nil
+}
+
+// Stop closes the connections to Redis.
+func (s *redisUserStore) Stop() stop.Result {
+	c := make(stop.Channel)
+	go func() {
+		c.Done(s.pool.Close())
+	}()
+	return c.Result()
+}
@@ -0,0 +1,73 @@
+package middleware
+
+import (
+	"math"
+
+	"github.com/chihaya/chihaya/pkg/log"
+)
+
+// peerMix determines how many seeders and leechers are returned in announce
+// responses.
+type peerMix struct {
+	// seedersToLeechers and seedersToSeeders are the fractions of seeders in
+	// the peers returned to leechers and seeders respectively.
+	seedersToLeechers float64
+	seedersToSeeders  float64
+}
+
+// newPeerMix creates a peerMix from the configured fractions, falling back to
+// the behavior of a PeerStore without a mix for invalid fractions.
+func newPeerMix(cfg ResponseConfig) *peerMix {
+	m := &peerMix{
+		seedersToLeechers: cfg.PeerMixSeedersToLeechers,
+		seedersToSeeders:  cfg.PeerMixSeedersToSeeders,
+	}
+
+	if m.seedersToLeechers < 0 || m.seedersToLeechers > 1 {
+		m.seedersToLeechers = 1
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     "PeerMixSeedersToLeechers",
+			"provided": cfg.PeerMixSeedersToLeechers,
+			"default":  m.seedersToLeechers,
+		})
+	}
+
+	if m.seedersToSeeders < 0 || m.seedersToSeeders > 1 {
+		m.seedersToSeeders = 0
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     "PeerMixSeedersToSeeders",
+			"provided": cfg.PeerMixSeedersToSeeders,
+			"default":  m.seedersToSeeders,
+		})
+	}
+
+	return m
+}
+
+// split divides numWant into the number of seeders and leechers to return to
+// a peer, given the number of seeders and leechers in the swarm.
+// If there are not enough peers of one kind, more of the other are returned.
+// Neither number exceeds the number of peers of its kind in the swarm.
+func (m *peerMix) split(seeding bool, numWant int, seeders, leechers uint32) (numSeeders, numLeechers int) {
+	fraction := m.seedersToLeechers
+	if seeding {
+		fraction = m.seedersToSeeders
+	}
+
+	numSeeders = int(math.Round(float64(numWant) * fraction))
+	numLeechers = numWant - numSeeders
+
+	if numSeeders > int(seeders) {
+		numLeechers += numSeeders - int(seeders)
+		numSeeders = int(seeders)
+	}
+	if numLeechers > int(leechers) {
+		numSeeders += numLeechers - int(leechers)
+		numLeechers = int(leechers)
+	}
+	if numSeeders > int(seeders) {
+		numSeeders = int(seeders)
+	}
+
+	return numSeeders, numLeechers
+}
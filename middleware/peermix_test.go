@@ -0,0 +1,42 @@
+package middleware
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPeerMixSplit(t *testing.T) {
+	m := newPeerMix(ResponseConfig{PeerMixSeedersToLeechers: 0.8, PeerMixSeedersToSeeders: 0.1})
+
+	var tests = []struct {
+		seeding               bool
+		numWant               int
+		seeders, leechers     uint32
+		numSeeders, numLeechs int
+	}{
+		{false, 50, 100, 100, 40, 10},
+		{true, 50, 100, 100, 5, 45},
+		// Missing seeders are made up for by leechers.
+		{false, 50, 20, 100, 20, 30},
+		// Missing leechers are made up for by seeders.
+		{false, 50, 100, 5, 45, 5},
+		{true, 50, 100, 20, 30, 20},
+		// Small swarms return everything.
+		{false, 50, 3, 4, 3, 4},
+		{true, 50, 3, 4, 3, 4},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%#v", tt), func(t *testing.T) {
+			numSeeders, numLeechers := m.split(tt.seeding, tt.numWant, tt.seeders, tt.leechers)
+			require.Equal(t, tt.numSeeders, numSeeders)
+			require.Equal(t, tt.numLeechs, numLeechers)
+		})
+	}
+
+	// Invalid fractions fall back to the behavior without a mix.
+	m = newPeerMix(ResponseConfig{PeerMixSeedersToLeechers: 2, PeerMixSeedersToSeeders: -1})
+	require.Equal(t, 1.0, m.seedersToLeechers)
+	require.Equal(t, 0.0, m.seedersToSeeders)
+}
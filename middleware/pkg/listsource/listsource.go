@@ -0,0 +1,132 @@
+// Package listsource implements loading line-based lists, such as lists of
+// infohashes or CIDRs, from HTTP(S) URLs or files.
+package listsource
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// fetchTimeout is the timeout for fetching a list over HTTP.
+const fetchTimeout = 30 * time.Second
+
+// A Source loads a list from an HTTP(S) URL or a file.
+//
+// It remembers the ETag of HTTP responses and the modification time of files,
+// so that unchanged lists are not parsed again.
+// It is not safe for concurrent use.
+type Source struct {
+	url    string
+	client *http.Client
+
+	etag    string
+	modTime time.Time
+}
+
+// New creates a Source for an HTTP(S) URL or the path of a file, optionally
+// prefixed with "file://".
+func New(url string) *Source {
+	return &Source{
+		url:    url,
+		client: &http.Client{Timeout: fetchTimeout},
+	}
+}
+
+// URL returns the URL or path the Source loads from.
+func (s *Source) URL() string {
+	return s.url
+}
+
+func (s *Source) isHTTP() bool {
+	return strings.HasPrefix(s.url, "http://") || strings.HasPrefix(s.url, "https://")
+}
+
+// Fetch loads the entries of the list. If the list has not changed since the
+// last successful fetch, changed is false and entries is nil.
+//
+// Entries are separated by newlines. Comments starting with '#' or ';' as well
+// as surrounding whitespace are removed and empty entries are skipped.
+func (s *Source) Fetch() (entries []string, changed bool, err error) {
+	if s.isHTTP() {
+		return s.fetchHTTP()
+	}
+	return s.fetchFile()
+}
+
+func (s *Source) fetchHTTP() ([]string, bool, error) {
+	req, err := http.NewRequest(http.MethodGet, s.url, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	if s.etag != "" {
+		req.Header.Set("If-None-Match", s.etag)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return nil, false, nil
+	case http.StatusOK:
+	default:
+		return nil, false, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	entries, err := readList(resp.Body)
+	if err != nil {
+		return nil, false, err
+	}
+	s.etag = resp.Header.Get("ETag")
+	return entries, true, nil
+}
+
+func (s *Source) fetchFile() ([]string, bool, error) {
+	path := strings.TrimPrefix(s.url, "file://")
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, false, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, false, err
+	}
+	if !s.modTime.IsZero() && info.ModTime().Equal(s.modTime) {
+		return nil, false, nil
+	}
+
+	entries, err := readList(f)
+	if err != nil {
+		return nil, false, err
+	}
+	s.modTime = info.ModTime()
+	return entries, true, nil
+}
+
+// readList reads one entry per line, removing comments.
+func readList(r io.Reader) ([]string, error) {
+	var entries []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexAny(line, "#;"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		entries = append(entries, line)
+	}
+	return entries, scanner.Err()
+}
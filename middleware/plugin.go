@@ -0,0 +1,21 @@
+package middleware
+
+import (
+	"fmt"
+	"plugin"
+)
+
+// LoadPlugin loads a Go plugin from the shared object at path.
+//
+// Plugins make their middleware available by calling RegisterDriver from an
+// init function, just like middleware built into chihaya.
+// They must be built with -buildmode=plugin using the same version of Go and of
+// every package shared with chihaya as the chihaya binary loading them.
+//
+// Loading the same plugin more than once has no effect.
+func LoadPlugin(path string) error {
+	if _, err := plugin.Open(path); err != nil {
+		return fmt.Errorf("failed to load plugin %s: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+package middleware
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func init() {
+	prometheus.MustRegister(promInFlightRequests, promRejectedRequests, promAnnouncesByClient)
+}
+
+var (
+	promInFlightRequests = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "chihaya_logic_requests_in_flight",
+		Help: "The number of requests currently being processed by the tracker logic",
+	})
+
+	promRejectedRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "chihaya_logic_requests_rejected_total",
+		Help: "The number of requests rejected because the concurrency limit was reached",
+	}, []string{"action"})
+
+	promAnnouncesByClient = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "chihaya_logic_announces_by_client_total",
+		Help: "The number of announces answered by the tracker logic, by the client identified by the peer ID",
+	}, []string{"client"})
+)
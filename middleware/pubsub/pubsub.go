@@ -0,0 +1,336 @@
+// Package pubsub implements a Hook that publishes announce and scrape events
+// to Redis pub/sub channels or NATS subjects.
+//
+// It is a lightweight alternative to the Kafka middleware and uses the same
+// JSON representation of events as the webhook and Kafka middleware.
+package pubsub
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus"
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/middleware/webhook"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/pkg/stop"
+)
+
+// Name is the name by which this middleware is registered with Chihaya.
+const Name = "pubsub"
+
+func init() {
+	middleware.RegisterDriver(Name, driver{})
+	prometheus.MustRegister(promMessages)
+}
+
+var promMessages = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "chihaya_pubsub_messages_total",
+		Help: "The number of events published, by result",
+	},
+	[]string{"result"},
+)
+
+var _ middleware.Driver = driver{}
+
+type driver struct{}
+
+func (d driver) NewHook(optionBytes []byte) (middleware.Hook, error) {
+	var cfg Config
+	err := yaml.Unmarshal(optionBytes, &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid options for middleware %s: %w", Name, err)
+	}
+
+	return NewHook(cfg)
+}
+
+// Backends events can be published to.
+const (
+	BackendRedis = "redis"
+	BackendNATS  = "nats"
+)
+
+// Config represents all the values required by this middleware to publish
+// events.
+type Config struct {
+	// Backend is either "redis" or "nats".
+	Backend string `yaml:"backend"`
+
+	// URL is the URL of the Redis or NATS server, e.g.
+	// "redis://127.0.0.1:6379/0" or "nats://127.0.0.1:4222".
+	URL string `yaml:"url"`
+
+	// Channel is the Redis channel or NATS subject events are published to.
+	Channel string `yaml:"channel"`
+
+	// Events are the types of events to publish: "started", "completed",
+	// "stopped" and "scrape". All are published if it is empty.
+	Events []string `yaml:"events"`
+
+	QueueSize int           `yaml:"queue_size"`
+	Timeout   time.Duration `yaml:"timeout"`
+}
+
+// LogFields implements log.Fielder for a Config.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"backend":   cfg.Backend,
+		"url":       cfg.URL,
+		"channel":   cfg.Channel,
+		"events":    cfg.Events,
+		"queueSize": cfg.QueueSize,
+		"timeout":   cfg.Timeout,
+	}
+}
+
+// Default config constants.
+const (
+	defaultChannel   = "chihaya.events"
+	defaultQueueSize = 10000
+	defaultTimeout   = 5 * time.Second
+)
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+//
+// This function warns to the logger when a value is changed.
+func (cfg Config) Validate() Config {
+	validcfg := cfg
+
+	if cfg.Channel == "" {
+		validcfg.Channel = defaultChannel
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".Channel",
+			"provided": cfg.Channel,
+			"default":  validcfg.Channel,
+		})
+	}
+
+	if cfg.QueueSize <= 0 {
+		validcfg.QueueSize = defaultQueueSize
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".QueueSize",
+			"provided": cfg.QueueSize,
+			"default":  validcfg.QueueSize,
+		})
+	}
+
+	if cfg.Timeout <= 0 {
+		validcfg.Timeout = defaultTimeout
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".Timeout",
+			"provided": cfg.Timeout,
+			"default":  validcfg.Timeout,
+		})
+	}
+
+	return validcfg
+}
+
+// publisher publishes messages to a backend.
+// It is only used by a single goroutine.
+type publisher interface {
+	publish(channel string, payload []byte) error
+	close() error
+}
+
+type redisPublisher struct {
+	pool *redis.Pool
+}
+
+func newRedisPublisher(cfg Config) *redisPublisher {
+	return &redisPublisher{pool: &redis.Pool{
+		MaxIdle:     1,
+		IdleTimeout: 240 * time.Second,
+		Dial: func() (redis.Conn, error) {
+			return redis.DialURL(cfg.URL,
+				redis.DialReadTimeout(cfg.Timeout),
+				redis.DialWriteTimeout(cfg.Timeout),
+				redis.DialConnectTimeout(cfg.Timeout),
+			)
+		},
+	}}
+}
+
+func (p *redisPublisher) publish(channel string, payload []byte) error {
+	conn := p.pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("PUBLISH", channel, payload)
+	return err
+}
+
+func (p *redisPublisher) close() error {
+	return p.pool.Close()
+}
+
+type natsPublisher struct {
+	conn    *nats.Conn
+	timeout time.Duration
+}
+
+func newNATSPublisher(cfg Config) (*natsPublisher, error) {
+	conn, err := nats.Connect(cfg.URL,
+		nats.Name("chihaya"),
+		nats.Timeout(cfg.Timeout),
+		nats.MaxReconnects(-1),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &natsPublisher{conn: conn, timeout: cfg.Timeout}, nil
+}
+
+func (p *natsPublisher) publish(channel string, payload []byte) error {
+	return p.conn.Publish(channel, payload)
+}
+
+func (p *natsPublisher) close() error {
+	err := p.conn.FlushTimeout(p.timeout)
+	p.conn.Close()
+	return err
+}
+
+type hook struct {
+	channel   string
+	events    map[string]bool
+	publisher publisher
+	queue     chan webhook.Event
+
+	closing chan struct{}
+	wg      sync.WaitGroup
+}
+
+// NewHook returns an instance of the pub/sub middleware.
+func NewHook(provided Config) (middleware.Hook, error) {
+	cfg := provided.Validate()
+	if cfg.URL == "" {
+		return nil, fmt.Errorf("no %s URL configured", Name)
+	}
+
+	var p publisher
+	switch cfg.Backend {
+	case BackendRedis:
+		p = newRedisPublisher(cfg)
+	case BackendNATS:
+		var err error
+		if p, err = newNATSPublisher(cfg); err != nil {
+			return nil, fmt.Errorf("failed to connect to NATS: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unknown backend %q", cfg.Backend)
+	}
+
+	return newHook(cfg, p)
+}
+
+func newHook(cfg Config, p publisher) (*hook, error) {
+	h := &hook{
+		channel:   cfg.Channel,
+		events:    make(map[string]bool),
+		publisher: p,
+		queue:     make(chan webhook.Event, cfg.QueueSize),
+		closing:   make(chan struct{}),
+	}
+
+	events := cfg.Events
+	if len(events) == 0 {
+		events = []string{webhook.EventStarted, webhook.EventCompleted, webhook.EventStopped, webhook.EventScrape}
+	}
+	for _, e := range events {
+		switch e {
+		case webhook.EventStarted, webhook.EventCompleted, webhook.EventStopped, webhook.EventScrape:
+			h.events[e] = true
+		default:
+			return nil, fmt.Errorf("unknown event %q", e)
+		}
+	}
+
+	h.wg.Add(1)
+	go h.run()
+
+	return h, nil
+}
+
+// run publishes events until the hook is stopped, then publishes the
+// remaining events.
+func (h *hook) run() {
+	defer h.wg.Done()
+	for {
+		select {
+		case e := <-h.queue:
+			h.publish(e)
+		case <-h.closing:
+			for {
+				select {
+				case e := <-h.queue:
+					h.publish(e)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (h *hook) publish(e webhook.Event) {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		log.Error("failed to encode event", log.Err(err))
+		return
+	}
+
+	if err := h.publisher.publish(h.channel, payload); err != nil {
+		promMessages.WithLabelValues("failure").Inc()
+		log.Error("failed to publish event", log.Fields{"channel": h.channel}, log.Err(err))
+		return
+	}
+	promMessages.WithLabelValues("success").Inc()
+}
+
+func (h *hook) enqueue(e webhook.Event) {
+	select {
+	case h.queue <- e:
+	default:
+		promMessages.WithLabelValues("dropped").Inc()
+	}
+}
+
+// Stop publishes all queued events and closes the connection.
+func (h *hook) Stop() stop.Result {
+	select {
+	case <-h.closing:
+		return stop.AlreadyStopped
+	default:
+	}
+	c := make(stop.Channel)
+	go func() {
+		close(h.closing)
+		h.wg.Wait()
+		c.Done(h.publisher.close())
+	}()
+	return c.Result()
+}
+
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	if e, ok := webhook.NewAnnounceEvent(req); ok && h.events[e.Type] {
+		h.enqueue(e)
+	}
+	return ctx, nil
+}
+
+func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	if h.events[webhook.EventScrape] {
+		h.enqueue(webhook.NewScrapeEvent(req))
+	}
+	return ctx, nil
+}
@@ -0,0 +1,70 @@
+package pubsub
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware/webhook"
+)
+
+type fakePublisher struct {
+	messages []webhook.Event
+	channels []string
+	closed   bool
+}
+
+func (p *fakePublisher) publish(channel string, payload []byte) error {
+	var e webhook.Event
+	if err := json.Unmarshal(payload, &e); err != nil {
+		return err
+	}
+	if e.Type == webhook.EventStopped {
+		return errors.New("failure")
+	}
+	p.channels = append(p.channels, channel)
+	p.messages = append(p.messages, e)
+	return nil
+}
+
+func (p *fakePublisher) close() error {
+	p.closed = true
+	return nil
+}
+
+func TestPublish(t *testing.T) {
+	p := &fakePublisher{}
+	h, err := newHook(Config{Channel: "events", QueueSize: 10}.Validate(), p)
+	require.Nil(t, err)
+
+	ctx := context.Background()
+	for _, event := range []bittorrent.Event{bittorrent.Started, bittorrent.None, bittorrent.Stopped, bittorrent.Completed} {
+		req := &bittorrent.AnnounceRequest{Event: event, InfoHash: bittorrent.InfoHash{1}}
+		_, err = h.HandleAnnounce(ctx, req, &bittorrent.AnnounceResponse{})
+		require.Nil(t, err)
+	}
+	_, err = h.HandleScrape(ctx, &bittorrent.ScrapeRequest{InfoHashes: []bittorrent.InfoHash{{2}}}, &bittorrent.ScrapeResponse{})
+	require.Nil(t, err)
+
+	// Stopping publishes all queued events.
+	require.Nil(t, h.Stop().Wait())
+	require.True(t, p.closed)
+
+	require.Equal(t, []string{"events", "events", "events"}, p.channels)
+	require.Equal(t, webhook.EventStarted, p.messages[0].Type)
+	require.Equal(t, webhook.EventCompleted, p.messages[1].Type)
+	require.Equal(t, webhook.EventScrape, p.messages[2].Type)
+	require.Equal(t, []string{bittorrent.InfoHash{2}.String()}, p.messages[2].InfoHashes)
+}
+
+func TestConfig(t *testing.T) {
+	_, err := NewHook(Config{Backend: "carrier pigeon", URL: "coop://"})
+	require.NotNil(t, err)
+
+	_, err = newHook(Config{Events: []string{"announce"}}.Validate(), &fakePublisher{})
+	require.NotNil(t, err)
+}
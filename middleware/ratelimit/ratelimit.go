@@ -0,0 +1,270 @@
+// Package ratelimit implements a Hook that fails an Announce if the same peer
+// announced the same torrent too recently.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/pkg/stop"
+	"github.com/chihaya/chihaya/pkg/timecache"
+)
+
+// Name is the name by which this middleware is registered with Chihaya.
+const Name = "announce rate limit"
+
+func init() {
+	middleware.RegisterDriver(Name, driver{})
+	prometheus.MustRegister(promRejectedAnnounces)
+}
+
+var promRejectedAnnounces = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "chihaya_ratelimit_rejected_announces_total",
+	Help: "The number of announces rejected because they arrived too frequently",
+})
+
+var _ middleware.Driver = driver{}
+
+type driver struct{}
+
+func (d driver) NewHook(optionBytes []byte) (middleware.Hook, error) {
+	var cfg Config
+	err := yaml.Unmarshal(optionBytes, &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid options for middleware %s: %w", Name, err)
+	}
+
+	return NewHook(cfg)
+}
+
+// ErrAnnounceTooFrequent is the error returned when a peer announces faster
+// than the configured minimum interval.
+var ErrAnnounceTooFrequent = bittorrent.RegisterClientError("announce_too_frequent", "announcing too frequently")
+
+// Keys by which peers can be identified.
+const (
+	KeyPeerID = "peer_id"
+	KeyIP     = "ip"
+)
+
+// Config represents all the values required by this middleware to limit the
+// rate of announces.
+type Config struct {
+	// MinInterval is the minimum duration between two announces of the same
+	// peer for the same torrent. Announces with the stopped or completed
+	// event are never rejected.
+	MinInterval time.Duration `yaml:"min_interval"`
+
+	// Key determines how peers are identified: by their peer ID or by their
+	// IP address.
+	Key string `yaml:"key"`
+
+	// GarbageCollectionInterval is the interval at which expired entries are
+	// removed.
+	GarbageCollectionInterval time.Duration `yaml:"gc_interval"`
+}
+
+// LogFields implements log.Fielder for a Config.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"minInterval": cfg.MinInterval,
+		"key":         cfg.Key,
+		"gcInterval":  cfg.GarbageCollectionInterval,
+	}
+}
+
+// Default config constants.
+const (
+	defaultMinInterval               = 30 * time.Second
+	defaultKey                       = KeyPeerID
+	defaultGarbageCollectionInterval = time.Minute
+)
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+//
+// This function warns to the logger when a value is changed.
+func (cfg Config) Validate() Config {
+	validcfg := cfg
+
+	if cfg.MinInterval <= 0 {
+		validcfg.MinInterval = defaultMinInterval
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".MinInterval",
+			"provided": cfg.MinInterval,
+			"default":  validcfg.MinInterval,
+		})
+	}
+
+	if cfg.Key != KeyPeerID && cfg.Key != KeyIP {
+		validcfg.Key = defaultKey
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".Key",
+			"provided": cfg.Key,
+			"default":  validcfg.Key,
+		})
+	}
+
+	if cfg.GarbageCollectionInterval <= 0 {
+		validcfg.GarbageCollectionInterval = defaultGarbageCollectionInterval
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".GarbageCollectionInterval",
+			"provided": cfg.GarbageCollectionInterval,
+			"default":  validcfg.GarbageCollectionInterval,
+		})
+	}
+
+	return validcfg
+}
+
+// shardCount is the number of shards the last announces are distributed
+// over to reduce lock contention.
+const shardCount = 256
+
+// peerKey identifies a peer in a swarm.
+// The peer part is either a peer ID or an IP address in its 16-byte form.
+type peerKey struct {
+	infoHash bittorrent.InfoHash
+	peer     [20]byte
+}
+
+type shard struct {
+	sync.Mutex
+	// lastAnnounces maps peers to the time of their last accepted announce
+	// in nanoseconds since the epoch.
+	lastAnnounces map[peerKey]int64
+}
+
+type hook struct {
+	minInterval int64
+	byIP        bool
+	shards      [shardCount]shard
+
+	closing chan struct{}
+	wg      sync.WaitGroup
+}
+
+// NewHook returns an instance of the announce rate limit middleware.
+func NewHook(provided Config) (middleware.Hook, error) {
+	cfg := provided.Validate()
+	h := &hook{
+		minInterval: int64(cfg.MinInterval),
+		byIP:        cfg.Key == KeyIP,
+		closing:     make(chan struct{}),
+	}
+	for i := range h.shards {
+		h.shards[i].lastAnnounces = make(map[peerKey]int64)
+	}
+
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		t := time.NewTicker(cfg.GarbageCollectionInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-h.closing:
+				return
+			case <-t.C:
+				h.collectGarbage(timecache.NowUnixNano())
+			}
+		}
+	}()
+
+	return h, nil
+}
+
+func (h *hook) key(req *bittorrent.AnnounceRequest) peerKey {
+	k := peerKey{infoHash: req.InfoHash}
+	if h.byIP {
+		copy(k.peer[:], req.IP.To16())
+	} else {
+		k.peer = req.Peer.ID
+	}
+	return k
+}
+
+// allow records an announce at now and returns whether it was at least the
+// minimum interval after the previous one.
+// Rejected announces don't reset the interval.
+func (h *hook) allow(k peerKey, now int64) bool {
+	s := &h.shards[k.infoHash[0]]
+	s.Lock()
+	defer s.Unlock()
+
+	if last, ok := s.lastAnnounces[k]; ok && now-last < h.minInterval {
+		return false
+	}
+	s.lastAnnounces[k] = now
+	return true
+}
+
+// forget removes a peer, so that it can announce again immediately.
+func (h *hook) forget(k peerKey) {
+	s := &h.shards[k.infoHash[0]]
+	s.Lock()
+	delete(s.lastAnnounces, k)
+	s.Unlock()
+}
+
+// collectGarbage removes all entries that cannot cause rejections anymore.
+func (h *hook) collectGarbage(now int64) {
+	for i := range h.shards {
+		s := &h.shards[i]
+		s.Lock()
+		for k, last := range s.lastAnnounces {
+			if now-last >= h.minInterval {
+				delete(s.lastAnnounces, k)
+			}
+		}
+		s.Unlock()
+	}
+}
+
+// Stop stops the garbage collection.
+func (h *hook) Stop() stop.Result {
+	select {
+	case <-h.closing:
+		return stop.AlreadyStopped
+	default:
+	}
+	c := make(stop.Channel)
+	go func() {
+		close(h.closing)
+		h.wg.Wait()
+		c.Done()
+	}()
+	return c.Result()
+}
+
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	k := h.key(req)
+
+	switch req.Event {
+	case bittorrent.Stopped:
+		// The peer leaves the swarm, it may rejoin at any time.
+		h.forget(k)
+		return ctx, nil
+	case bittorrent.Completed:
+		return ctx, nil
+	}
+
+	if !h.allow(k, timecache.NowUnixNano()) {
+		promRejectedAnnounces.Inc()
+		return ctx, ErrAnnounceTooFrequent
+	}
+	return ctx, nil
+}
+
+func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrapes are not limited.
+	return ctx, nil
+}
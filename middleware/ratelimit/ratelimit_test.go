@@ -0,0 +1,63 @@
+package ratelimit
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+func TestHandleAnnounce(t *testing.T) {
+	mh, err := NewHook(Config{MinInterval: time.Hour})
+	require.Nil(t, err)
+	h := mh.(*hook)
+	defer func() { require.Nil(t, h.Stop().Wait()) }()
+
+	announce := func(ih byte, event bittorrent.Event) error {
+		req := &bittorrent.AnnounceRequest{
+			InfoHash: bittorrent.InfoHash{ih},
+			Event:    event,
+			Peer: bittorrent.Peer{
+				ID: bittorrent.PeerID{1},
+				IP: bittorrent.IP{IP: net.IPv4(10, 0, 0, 1), AddressFamily: bittorrent.IPv4},
+			},
+		}
+		_, err := h.HandleAnnounce(context.Background(), req, &bittorrent.AnnounceResponse{})
+		return err
+	}
+
+	require.Nil(t, announce(1, bittorrent.Started))
+	require.Equal(t, ErrAnnounceTooFrequent, announce(1, bittorrent.None))
+
+	// Other torrents are limited separately.
+	require.Nil(t, announce(2, bittorrent.None))
+
+	// Completed and stopped events are always allowed, and stopping resets
+	// the limit.
+	require.Nil(t, announce(1, bittorrent.Completed))
+	require.Nil(t, announce(1, bittorrent.Stopped))
+	require.Nil(t, announce(1, bittorrent.Started))
+}
+
+func TestAllow(t *testing.T) {
+	h := &hook{minInterval: int64(time.Minute)}
+	for i := range h.shards {
+		h.shards[i].lastAnnounces = make(map[peerKey]int64)
+	}
+	k := peerKey{infoHash: bittorrent.InfoHash{1}}
+	start := time.Now().UnixNano()
+
+	require.True(t, h.allow(k, start))
+	require.False(t, h.allow(k, start+int64(30*time.Second)))
+	// Rejected announces don't extend the interval.
+	require.True(t, h.allow(k, start+int64(time.Minute)))
+
+	h.collectGarbage(start + int64(90*time.Second))
+	require.Len(t, h.shards[1].lastAnnounces, 1)
+	h.collectGarbage(start + int64(2*time.Minute))
+	require.Empty(t, h.shards[1].lastAnnounces)
+}
@@ -0,0 +1,351 @@
+// Package ratio implements a Hook that accounts the traffic of users of a
+// private tracker and fails announces of users that start to download while
+// their ratio of uploaded to downloaded data is too low.
+//
+// Users are identified by the passkey middleware, which must run before this
+// middleware.
+package ratio
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/middleware/passkey"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/pkg/stop"
+	"github.com/chihaya/chihaya/pkg/timecache"
+)
+
+// Name is the name by which this middleware is registered with Chihaya.
+const Name = "ratio"
+
+func init() {
+	middleware.RegisterDriver(Name, driver{})
+}
+
+var _ middleware.Driver = driver{}
+
+type driver struct{}
+
+func (d driver) NewHook(optionBytes []byte) (middleware.Hook, error) {
+	var cfg Config
+	err := yaml.Unmarshal(optionBytes, &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid options for middleware %s: %w", Name, err)
+	}
+
+	return NewHook(cfg)
+}
+
+// ErrRatioTooLow is the error returned when a user with a ratio below the
+// minimum starts downloading.
+var ErrRatioTooLow = bittorrent.RegisterClientError("ratio_too_low", "ratio too low")
+
+// Config represents all the values required by this middleware to enforce
+// ratios.
+type Config struct {
+	// MinRatio is the minimum ratio of uploaded to downloaded data a user
+	// needs to start downloading. Zero disables the enforcement, so that
+	// traffic is only accounted.
+	MinRatio float64 `yaml:"min_ratio"`
+
+	// GraceBytes is the amount of data a user can download before the
+	// ratio is enforced.
+	GraceBytes uint64 `yaml:"grace_bytes"`
+
+	// Store is the type of the Store for the traffic, either "memory" or
+	// "redis".
+	Store string `yaml:"store"`
+
+	// Redis configures the redis store.
+	Redis RedisConfig `yaml:"redis"`
+
+	// SessionLifetime is the duration after which peers that didn't
+	// announce are forgotten. It should be longer than the announce
+	// interval.
+	SessionLifetime time.Duration `yaml:"session_lifetime"`
+
+	// GarbageCollectionInterval is the interval at which expired sessions
+	// are removed.
+	GarbageCollectionInterval time.Duration `yaml:"gc_interval"`
+}
+
+// LogFields implements log.Fielder for a Config.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"minRatio":        cfg.MinRatio,
+		"graceBytes":      cfg.GraceBytes,
+		"store":           cfg.Store,
+		"redisURL":        cfg.Redis.URL,
+		"redisPrefix":     cfg.Redis.KeyPrefix,
+		"sessionLifetime": cfg.SessionLifetime,
+		"gcInterval":      cfg.GarbageCollectionInterval,
+	}
+}
+
+// Store types.
+const (
+	StoreMemory = "memory"
+	StoreRedis  = "redis"
+)
+
+// Default config constants.
+const (
+	defaultStore                     = StoreMemory
+	defaultSessionLifetime           = 2 * time.Hour
+	defaultGarbageCollectionInterval = 5 * time.Minute
+)
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+//
+// This function warns to the logger when a value is changed.
+func (cfg Config) Validate() Config {
+	validcfg := cfg
+
+	if cfg.MinRatio < 0 {
+		validcfg.MinRatio = 0
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".MinRatio",
+			"provided": cfg.MinRatio,
+			"default":  validcfg.MinRatio,
+		})
+	}
+
+	if cfg.Store == "" {
+		validcfg.Store = defaultStore
+	}
+
+	if validcfg.Store == StoreRedis {
+		validcfg.Redis = cfg.Redis.validate()
+	}
+
+	if cfg.SessionLifetime <= 0 {
+		validcfg.SessionLifetime = defaultSessionLifetime
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".SessionLifetime",
+			"provided": cfg.SessionLifetime,
+			"default":  validcfg.SessionLifetime,
+		})
+	}
+
+	if cfg.GarbageCollectionInterval <= 0 {
+		validcfg.GarbageCollectionInterval = defaultGarbageCollectionInterval
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".GarbageCollectionInterval",
+			"provided": cfg.GarbageCollectionInterval,
+			"default":  validcfg.GarbageCollectionInterval,
+		})
+	}
+
+	return validcfg
+}
+
+// shardCount is the number of shards the sessions are distributed over to
+// reduce lock contention.
+const shardCount = 256
+
+type sessionKey struct {
+	infoHash bittorrent.InfoHash
+	peerID   bittorrent.PeerID
+}
+
+// session is the state of a peer in a swarm.
+type session struct {
+	// traffic is the traffic the peer reported in its last announce.
+	traffic Traffic
+	// lastSeen is the time of the last announce in nanoseconds since the
+	// epoch.
+	lastSeen int64
+	// denied is set if the last announce was rejected, so that the peer
+	// is still considered to start downloading.
+	denied bool
+}
+
+type shard struct {
+	sync.Mutex
+	sessions map[sessionKey]session
+}
+
+type hook struct {
+	minRatio        float64
+	graceBytes      uint64
+	sessionLifetime int64
+	store           Store
+	shards          [shardCount]shard
+
+	closing chan struct{}
+	wg      sync.WaitGroup
+}
+
+// NewHook returns an instance of the ratio middleware.
+func NewHook(provided Config) (middleware.Hook, error) {
+	cfg := provided.Validate()
+
+	var store Store
+	switch cfg.Store {
+	case StoreMemory:
+		store = newMemoryStore()
+	case StoreRedis:
+		store = newRedisStore(cfg.Redis)
+	default:
+		return nil, fmt.Errorf("unknown traffic store %q", cfg.Store)
+	}
+
+	return NewHookWithStore(cfg, store), nil
+}
+
+// NewHookWithStore returns an instance of the ratio middleware that persists
+// the traffic in the given store. The Store and Redis fields of the config are
+// ignored.
+func NewHookWithStore(provided Config, store Store) middleware.Hook {
+	cfg := provided.Validate()
+	h := &hook{
+		minRatio:        cfg.MinRatio,
+		graceBytes:      cfg.GraceBytes,
+		sessionLifetime: int64(cfg.SessionLifetime),
+		store:           store,
+		closing:         make(chan struct{}),
+	}
+	for i := range h.shards {
+		h.shards[i].sessions = make(map[sessionKey]session)
+	}
+
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		t := time.NewTicker(cfg.GarbageCollectionInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-h.closing:
+				return
+			case <-t.C:
+				h.collectGarbage(timecache.NowUnixNano())
+			}
+		}
+	}()
+
+	return h
+}
+
+// collectGarbage removes sessions that expired.
+func (h *hook) collectGarbage(now int64) {
+	for i := range h.shards {
+		s := &h.shards[i]
+		s.Lock()
+		for k, sess := range s.sessions {
+			if now-sess.lastSeen > h.sessionLifetime {
+				delete(s.sessions, k)
+			}
+		}
+		s.Unlock()
+	}
+}
+
+// Stop stops the garbage collection and closes the Store, if necessary.
+func (h *hook) Stop() stop.Result {
+	select {
+	case <-h.closing:
+		return stop.AlreadyStopped
+	default:
+	}
+	c := make(stop.Channel)
+	go func() {
+		close(h.closing)
+		h.wg.Wait()
+		if s, ok := h.store.(stop.Stopper); ok {
+			c.Done(s.Stop().Wait()...)
+			return
+		}
+		c.Done()
+	}()
+	return c.Result()
+}
+
+// delta returns the difference between the reported traffic and the traffic
+// of the previous announce of a session.
+// Clients that restarted report smaller values, which are counted in full.
+func delta(previous, reported Traffic) Traffic {
+	d := reported
+	if reported.Uploaded >= previous.Uploaded {
+		d.Uploaded -= previous.Uploaded
+	}
+	if reported.Downloaded >= previous.Downloaded {
+		d.Downloaded -= previous.Downloaded
+	}
+	return d
+}
+
+// allowed returns whether the user may start downloading.
+// If the traffic of the user cannot be determined, downloading is allowed.
+func (h *hook) allowed(ctx context.Context, userID string) bool {
+	if h.minRatio == 0 {
+		return true
+	}
+
+	t, err := h.store.Traffic(ctx, userID)
+	if err != nil {
+		log.Error("failed to look up traffic", log.Fields{"userID": userID}, log.Err(err))
+		return true
+	}
+
+	ratio := t.Ratio()
+	return t.Downloaded <= h.graceBytes || ratio < 0 || ratio >= h.minRatio
+}
+
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	user, ok := ctx.Value(passkey.UserKey).(passkey.User)
+	if !ok {
+		log.Debug("ratio: no user in announce context, skipping")
+		return ctx, nil
+	}
+
+	k := sessionKey{infoHash: req.InfoHash, peerID: req.Peer.ID}
+	s := &h.shards[k.infoHash[0]]
+	reported := Traffic{Uploaded: req.Uploaded, Downloaded: req.Downloaded}
+
+	s.Lock()
+	previous, known := s.sessions[k]
+	if req.Event == bittorrent.Stopped {
+		delete(s.sessions, k)
+	} else {
+		s.sessions[k] = session{traffic: reported, lastSeen: timecache.NowUnixNano(), denied: previous.denied}
+	}
+	s.Unlock()
+
+	if d := delta(previous.traffic, reported); d.Uploaded > 0 || d.Downloaded > 0 {
+		if err := h.store.AddTraffic(ctx, user.ID, d); err != nil {
+			log.Error("failed to account traffic", log.Fields{"userID": user.ID}, log.Err(err))
+		}
+	}
+
+	starting := !known || previous.denied || req.Event == bittorrent.Started
+	if req.Left == 0 || req.Event == bittorrent.Stopped || !starting {
+		return ctx, nil
+	}
+
+	allowed := h.allowed(ctx, user.ID)
+	s.Lock()
+	if sess, ok := s.sessions[k]; ok {
+		sess.denied = !allowed
+		s.sessions[k] = sess
+	}
+	s.Unlock()
+
+	if !allowed {
+		return ctx, ErrRatioTooLow
+	}
+	return ctx, nil
+}
+
+func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrapes are not limited.
+	return ctx, nil
+}
@@ -0,0 +1,71 @@
+package ratio
+
+import (
+	"context"
+	"testing"
+
+	"github.com/alicebob/miniredis"
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware/passkey"
+)
+
+func TestDelta(t *testing.T) {
+	require.Equal(t, Traffic{5, 10}, delta(Traffic{10, 10}, Traffic{15, 20}))
+	// Restarted clients report their traffic since the restart.
+	require.Equal(t, Traffic{3, 10}, delta(Traffic{10, 10}, Traffic{3, 20}))
+}
+
+func TestStores(t *testing.T) {
+	rs, err := miniredis.Run()
+	require.Nil(t, err)
+	defer rs.Close()
+
+	stores := map[string]Config{
+		"memory": {},
+		"redis":  {Store: StoreRedis, Redis: RedisConfig{URL: "redis://" + rs.Addr()}},
+	}
+
+	for name, cfg := range stores {
+		t.Run(name, func(t *testing.T) {
+			cfg.MinRatio = 0.5
+			cfg.GraceBytes = 100
+			mh, err := NewHook(cfg)
+			require.Nil(t, err)
+			h := mh.(*hook)
+			defer func() { require.Nil(t, h.Stop().Wait()) }()
+
+			ctx := context.WithValue(context.Background(), passkey.UserKey, passkey.User{ID: "42"})
+			announce := func(ih byte, event bittorrent.Event, left, uploaded, downloaded uint64) error {
+				req := &bittorrent.AnnounceRequest{
+					InfoHash:   bittorrent.InfoHash{ih},
+					Event:      event,
+					Left:       left,
+					Uploaded:   uploaded,
+					Downloaded: downloaded,
+				}
+				_, err := h.HandleAnnounce(ctx, req, &bittorrent.AnnounceResponse{})
+				return err
+			}
+
+			// Downloads within the grace amount are allowed.
+			require.Nil(t, announce(1, bittorrent.Started, 1000, 0, 0))
+			require.Nil(t, announce(1, bittorrent.None, 800, 10, 200))
+			require.Nil(t, announce(1, bittorrent.None, 600, 20, 400))
+
+			traffic, err := h.store.Traffic(ctx, "42")
+			require.Nil(t, err)
+			require.Equal(t, Traffic{Uploaded: 20, Downloaded: 400}, traffic)
+
+			// New downloads are denied, seeding is allowed.
+			require.Equal(t, ErrRatioTooLow, announce(2, bittorrent.Started, 1000, 0, 0))
+			require.Equal(t, ErrRatioTooLow, announce(2, bittorrent.None, 1000, 0, 0))
+			require.Nil(t, announce(3, bittorrent.Started, 0, 0, 0))
+
+			// Uploading restores the ratio.
+			require.Nil(t, announce(3, bittorrent.None, 0, 300, 0))
+			require.Nil(t, announce(2, bittorrent.None, 1000, 0, 0))
+		})
+	}
+}
@@ -0,0 +1,194 @@
+package ratio
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/pkg/stop"
+)
+
+// Traffic is the amount of data a user uploaded and downloaded in bytes.
+type Traffic struct {
+	Uploaded   uint64
+	Downloaded uint64
+}
+
+// Ratio returns the ratio of uploaded to downloaded data.
+// It is -1 if nothing was downloaded, which stands for an infinite ratio.
+func (t Traffic) Ratio() float64 {
+	if t.Downloaded == 0 {
+		return -1
+	}
+	return float64(t.Uploaded) / float64(t.Downloaded)
+}
+
+// Store persists the traffic of users.
+//
+// Implementations must be safe for concurrent use and may implement
+// stop.Stopper if they need to be closed.
+type Store interface {
+	// AddTraffic adds to the traffic of a user.
+	AddTraffic(ctx context.Context, userID string, delta Traffic) error
+
+	// Traffic returns the traffic of a user.
+	Traffic(ctx context.Context, userID string) (Traffic, error)
+}
+
+// memoryStore is a Store that keeps the traffic in memory.
+// The traffic is lost on restarts, so it's mostly useful for testing.
+type memoryStore struct {
+	mu      sync.Mutex
+	traffic map[string]Traffic
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{traffic: make(map[string]Traffic)}
+}
+
+func (s *memoryStore) AddTraffic(_ context.Context, userID string, delta Traffic) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := s.traffic[userID]
+	t.Uploaded += delta.Uploaded
+	t.Downloaded += delta.Downloaded
+	s.traffic[userID] = t
+	return nil
+}
+
+func (s *memoryStore) Traffic(_ context.Context, userID string) (Traffic, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.traffic[userID], nil
+}
+
+// RedisConfig represents the configuration of a Store backed by Redis.
+//
+// The traffic of every user is stored as a hash under KeyPrefix followed by
+// the user ID, with the fields "uploaded" and "downloaded".
+type RedisConfig struct {
+	URL            string        `yaml:"url"`
+	KeyPrefix      string        `yaml:"key_prefix"`
+	ReadTimeout    time.Duration `yaml:"read_timeout"`
+	WriteTimeout   time.Duration `yaml:"write_timeout"`
+	ConnectTimeout time.Duration `yaml:"connect_timeout"`
+}
+
+// Default Redis config constants.
+const (
+	defaultRedisURL       = "redis://127.0.0.1:6379/0"
+	defaultRedisKeyPrefix = "chihaya_traffic_"
+	defaultRedisTimeout   = 5 * time.Second
+)
+
+func (cfg RedisConfig) validate() RedisConfig {
+	validcfg := cfg
+
+	if cfg.URL == "" {
+		validcfg.URL = defaultRedisURL
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".Redis.URL",
+			"provided": cfg.URL,
+			"default":  validcfg.URL,
+		})
+	}
+
+	if cfg.KeyPrefix == "" {
+		validcfg.KeyPrefix = defaultRedisKeyPrefix
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".Redis.KeyPrefix",
+			"provided": cfg.KeyPrefix,
+			"default":  validcfg.KeyPrefix,
+		})
+	}
+
+	for _, d := range []struct {
+		name     string
+		provided time.Duration
+		valid    *time.Duration
+	}{
+		{"ReadTimeout", cfg.ReadTimeout, &validcfg.ReadTimeout},
+		{"WriteTimeout", cfg.WriteTimeout, &validcfg.WriteTimeout},
+		{"ConnectTimeout", cfg.ConnectTimeout, &validcfg.ConnectTimeout},
+	} {
+		if d.provided <= 0 {
+			*d.valid = defaultRedisTimeout
+			log.Warn("falling back to default configuration", log.Fields{
+				"name":     Name + ".Redis." + d.name,
+				"provided": d.provided,
+				"default":  *d.valid,
+			})
+		}
+	}
+
+	return validcfg
+}
+
+// redisStore is a Store backed by Redis.
+type redisStore struct {
+	prefix string
+	pool   *redis.Pool
+}
+
+func newRedisStore(cfg RedisConfig) *redisStore {
+	return &redisStore{
+		prefix: cfg.KeyPrefix,
+		pool: &redis.Pool{
+			MaxIdle:     3,
+			IdleTimeout: 240 * time.Second,
+			Dial: func() (redis.Conn, error) {
+				return redis.DialURL(cfg.URL,
+					redis.DialReadTimeout(cfg.ReadTimeout),
+					redis.DialWriteTimeout(cfg.WriteTimeout),
+					redis.DialConnectTimeout(cfg.ConnectTimeout),
+				)
+			},
+		},
+	}
+}
+
+func (s *redisStore) AddTraffic(ctx context.Context, userID string, delta Traffic) error {
+	conn, err := s.pool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	key := s.prefix + userID
+	_ = conn.Send("MULTI")
+	_ = conn.Send("HINCRBY", key, "uploaded", delta.Uploaded)
+	_ = conn.Send("HINCRBY", key, "downloaded", delta.Downloaded)
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+func (s *redisStore) Traffic(ctx context.Context, userID string) (Traffic, error) {
+	conn, err := s.pool.GetContext(ctx)
+	if err != nil {
+		return Traffic{}, err
+	}
+	defer conn.Close()
+
+	values, err := redis.Values(conn.Do("HMGET", s.prefix+userID, "uploaded", "downloaded"))
+	if err != nil {
+		return Traffic{}, err
+	}
+
+	var t Traffic
+	if _, err := redis.Scan(values, &t.Uploaded, &t.Downloaded); err != nil {
+		return Traffic{}, err
+	}
+	return t, nil
+}
+
+// Stop closes the connections to Redis.
+func (s *redisStore) Stop() stop.Result {
+	c := make(stop.Channel)
+	go func() {
+		c.Done(s.pool.Close())
+	}()
+	return c.Result()
+}
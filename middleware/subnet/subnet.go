@@ -0,0 +1,165 @@
+// Package subnet implements a Hook that prefers peers in the same subnet as
+// the announcing peer when choosing the peers of an announce response.
+//
+// This works with any PeerStore, because the peers are reordered after they
+// have been fetched from storage.
+package subnet
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/pkg/log"
+)
+
+// Name is the name by which this middleware is registered with Chihaya.
+const Name = "subnet preference"
+
+func init() {
+	middleware.RegisterDriver(Name, driver{})
+}
+
+var _ middleware.Driver = driver{}
+
+type driver struct{}
+
+func (d driver) NewHook(optionBytes []byte) (middleware.Hook, error) {
+	var cfg Config
+	err := yaml.Unmarshal(optionBytes, &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid options for middleware %s: %w", Name, err)
+	}
+
+	return NewHook(cfg), nil
+}
+
+// Config represents all the values required by this middleware to prefer
+// peers in the same subnet.
+type Config struct {
+	// PreferredIPv4SubnetMaskBitsSet and PreferredIPv6SubnetMaskBitsSet are
+	// the prefix lengths of the subnets whose peers are preferred.
+	PreferredIPv4SubnetMaskBitsSet int `yaml:"preferred_ipv4_subnet_mask_bits_set"`
+	PreferredIPv6SubnetMaskBitsSet int `yaml:"preferred_ipv6_subnet_mask_bits_set"`
+
+	// CandidatesFactor is the multiple of the requested number of peers that
+	// is fetched from storage to choose peers in the same subnet from.
+	CandidatesFactor int `yaml:"candidates_factor"`
+}
+
+// LogFields implements log.Fielder for a Config.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"preferredIPv4SubnetMaskBitsSet": cfg.PreferredIPv4SubnetMaskBitsSet,
+		"preferredIPv6SubnetMaskBitsSet": cfg.PreferredIPv6SubnetMaskBitsSet,
+		"candidatesFactor":               cfg.CandidatesFactor,
+	}
+}
+
+// Default config constants.
+const (
+	defaultIPv4SubnetMaskBitsSet = 24
+	defaultIPv6SubnetMaskBitsSet = 64
+	defaultCandidatesFactor      = 4
+)
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+//
+// This function warns to the logger when a value is changed.
+func (cfg Config) Validate() Config {
+	validcfg := cfg
+
+	if cfg.PreferredIPv4SubnetMaskBitsSet <= 0 || cfg.PreferredIPv4SubnetMaskBitsSet > 32 {
+		validcfg.PreferredIPv4SubnetMaskBitsSet = defaultIPv4SubnetMaskBitsSet
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".PreferredIPv4SubnetMaskBitsSet",
+			"provided": cfg.PreferredIPv4SubnetMaskBitsSet,
+			"default":  validcfg.PreferredIPv4SubnetMaskBitsSet,
+		})
+	}
+
+	if cfg.PreferredIPv6SubnetMaskBitsSet <= 0 || cfg.PreferredIPv6SubnetMaskBitsSet > 128 {
+		validcfg.PreferredIPv6SubnetMaskBitsSet = defaultIPv6SubnetMaskBitsSet
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".PreferredIPv6SubnetMaskBitsSet",
+			"provided": cfg.PreferredIPv6SubnetMaskBitsSet,
+			"default":  validcfg.PreferredIPv6SubnetMaskBitsSet,
+		})
+	}
+
+	if cfg.CandidatesFactor <= 0 {
+		validcfg.CandidatesFactor = defaultCandidatesFactor
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".CandidatesFactor",
+			"provided": cfg.CandidatesFactor,
+			"default":  validcfg.CandidatesFactor,
+		})
+	}
+
+	return validcfg
+}
+
+type hook struct {
+	ipv4Mask         net.IPMask
+	ipv6Mask         net.IPMask
+	candidatesFactor int
+}
+
+var _ middleware.PeerSelector = &hook{}
+
+// NewHook returns an instance of the subnet preference middleware.
+func NewHook(provided Config) middleware.Hook {
+	cfg := provided.Validate()
+	return &hook{
+		ipv4Mask:         net.CIDRMask(cfg.PreferredIPv4SubnetMaskBitsSet, 32),
+		ipv6Mask:         net.CIDRMask(cfg.PreferredIPv6SubnetMaskBitsSet, 128),
+		candidatesFactor: cfg.CandidatesFactor,
+	}
+}
+
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	// Peers are selected in SelectPeers.
+	return ctx, nil
+}
+
+func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrapes don't contain peers.
+	return ctx, nil
+}
+
+// Candidates implements middleware.PeerSelector.
+func (h *hook) Candidates(numWant int) int {
+	return numWant * h.candidatesFactor
+}
+
+// SelectPeers implements middleware.PeerSelector by moving peers in the same
+// subnet as the announcing peer to the front, keeping the relative order of
+// all peers otherwise.
+func (h *hook) SelectPeers(req *bittorrent.AnnounceRequest, peers []bittorrent.Peer) []bittorrent.Peer {
+	mask := h.ipv4Mask
+	if req.IP.AddressFamily == bittorrent.IPv6 {
+		mask = h.ipv6Mask
+	}
+	subnet := req.IP.Mask(mask)
+	if subnet == nil {
+		return peers
+	}
+
+	// Peers in other subnets are collected separately and appended afterwards.
+	var others []bittorrent.Peer
+	n := 0
+	for _, p := range peers {
+		if p.IP.Mask(mask).Equal(subnet) {
+			peers[n] = p
+			n++
+		} else {
+			others = append(others, p)
+		}
+	}
+	return append(peers[:n], others...)
+}
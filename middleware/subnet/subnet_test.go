@@ -0,0 +1,62 @@
+package subnet
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+func peer(ip string) bittorrent.Peer {
+	p := bittorrent.Peer{IP: bittorrent.IP{IP: net.ParseIP(ip), AddressFamily: bittorrent.IPv6}}
+	if ip4 := p.IP.IP.To4(); ip4 != nil {
+		p.IP = bittorrent.IP{IP: ip4, AddressFamily: bittorrent.IPv4}
+	}
+	return p
+}
+
+func TestSelectPeers(t *testing.T) {
+	var table = []struct {
+		cfg      Config
+		origin   string
+		peers    []string
+		expected []string
+	}{
+		{
+			Config{},
+			"10.0.0.1",
+			[]string{"10.0.1.1", "10.0.0.2", "10.1.0.1", "10.0.0.3"},
+			[]string{"10.0.0.2", "10.0.0.3", "10.0.1.1", "10.1.0.1"},
+		},
+		{
+			Config{PreferredIPv4SubnetMaskBitsSet: 16},
+			"10.0.0.1",
+			[]string{"10.1.0.1", "10.0.1.1", "10.0.0.2"},
+			[]string{"10.0.1.1", "10.0.0.2", "10.1.0.1"},
+		},
+		{
+			Config{},
+			"fc00::1",
+			[]string{"fc01::1", "fc00::ffff:2", "fc00:0:0:1::1"},
+			[]string{"fc00::ffff:2", "fc01::1", "fc00:0:0:1::1"},
+		},
+	}
+
+	for _, tt := range table {
+		h := NewHook(tt.cfg).(*hook)
+
+		var peers []bittorrent.Peer
+		for _, ip := range tt.peers {
+			peers = append(peers, peer(ip))
+		}
+		req := &bittorrent.AnnounceRequest{Peer: peer(tt.origin)}
+
+		var selected []string
+		for _, p := range h.SelectPeers(req, peers) {
+			selected = append(selected, p.IP.String())
+		}
+		require.Equal(t, tt.expected, selected, "origin %s", tt.origin)
+	}
+}
@@ -0,0 +1,156 @@
+// Package swarminterval provides a middleware that scales the announce
+// interval according to the size and health of the swarm, so peers of large,
+// well-seeded swarms announce less often.
+package swarminterval
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+)
+
+// Name is the name by which this middleware is registered with Chihaya.
+const Name = "swarm interval"
+
+func init() {
+	middleware.RegisterDriver(Name, driver{})
+}
+
+var _ middleware.Driver = driver{}
+
+type driver struct{}
+
+func (d driver) NewHook(optionBytes []byte) (middleware.Hook, error) {
+	var cfg Config
+	err := yaml.Unmarshal(optionBytes, &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid options for middleware %s: %w", Name, err)
+	}
+
+	return NewHook(cfg)
+}
+
+// ErrInvalidFactor is returned for a config with a tier with a factor that is
+// not positive.
+var ErrInvalidFactor = errors.New("invalid factor")
+
+// ErrInvalidMaxInterval is returned for a config with a negative MaxInterval.
+var ErrInvalidMaxInterval = errors.New("invalid max_interval")
+
+// Tier is a class of swarms whose intervals are scaled by the same factor.
+type Tier struct {
+	// MinPeers is the number of seeders and leechers a swarm must have at
+	// least to be in this tier.
+	MinPeers uint32 `yaml:"min_peers"`
+
+	// MinSeeders is the number of seeders a swarm must have at least to be
+	// in this tier.
+	MinSeeders uint32 `yaml:"min_seeders"`
+
+	// Factor is the factor the interval is multiplied with.
+	Factor float64 `yaml:"factor"`
+}
+
+// Config represents the configuration for the swarminterval middleware.
+type Config struct {
+	// Tiers are the classes of swarms. The interval of a swarm is scaled by
+	// the factor of the tier with the largest MinPeers that it is in.
+	// Intervals of swarms that are in no tier are not changed.
+	Tiers []Tier `yaml:"tiers"`
+
+	// MaxInterval is the interval that scaled intervals are capped at.
+	// A value of zero disables the cap.
+	MaxInterval time.Duration `yaml:"max_interval"`
+
+	// ScaleMinInterval specifies whether min_interval should be scaled as
+	// well.
+	ScaleMinInterval bool `yaml:"scale_min_interval"`
+}
+
+func checkConfig(cfg Config) error {
+	for _, t := range cfg.Tiers {
+		if t.Factor <= 0 {
+			return ErrInvalidFactor
+		}
+	}
+
+	if cfg.MaxInterval < 0 {
+		return ErrInvalidMaxInterval
+	}
+
+	return nil
+}
+
+type hook struct {
+	cfg Config
+}
+
+var _ middleware.AnnounceResponseAdjuster = &hook{}
+
+// NewHook creates a middleware to scale the announce interval from the given
+// config.
+func NewHook(cfg Config) (middleware.Hook, error) {
+	if err := checkConfig(cfg); err != nil {
+		return nil, err
+	}
+
+	cfg.Tiers = append([]Tier(nil), cfg.Tiers...)
+	sort.SliceStable(cfg.Tiers, func(i, j int) bool {
+		return cfg.Tiers[i].MinPeers < cfg.Tiers[j].MinPeers
+	})
+
+	return &hook{cfg: cfg}, nil
+}
+
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	// The swarm is not known yet, see AdjustAnnounceResponse.
+	return ctx, nil
+}
+
+func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrapes are not altered.
+	return ctx, nil
+}
+
+// tier returns the tier of a swarm, or nil if it is in none.
+func (h *hook) tier(seeders, leechers uint32) *Tier {
+	peers := seeders + leechers
+	for i := len(h.cfg.Tiers) - 1; i >= 0; i-- {
+		if t := &h.cfg.Tiers[i]; peers >= t.MinPeers && seeders >= t.MinSeeders {
+			return t
+		}
+	}
+	return nil
+}
+
+// AdjustAnnounceResponse scales the intervals of the response according to
+// the counts of the swarm.
+func (h *hook) AdjustAnnounceResponse(req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) {
+	t := h.tier(resp.Complete, resp.Incomplete)
+	if t == nil {
+		return
+	}
+
+	if h.cfg.ScaleMinInterval {
+		resp.MinInterval = h.scale(resp.MinInterval, t.Factor)
+	}
+	resp.Interval = h.scale(resp.Interval, t.Factor)
+	if resp.Interval < resp.MinInterval {
+		resp.Interval = resp.MinInterval
+	}
+}
+
+func (h *hook) scale(d time.Duration, factor float64) time.Duration {
+	d = time.Duration(float64(d) * factor).Round(time.Second)
+	if h.cfg.MaxInterval > 0 && d > h.cfg.MaxInterval {
+		d = h.cfg.MaxInterval
+	}
+	return d
+}
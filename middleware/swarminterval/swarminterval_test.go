@@ -0,0 +1,70 @@
+package swarminterval
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+var configTests = []struct {
+	cfg      Config
+	expected error
+}{
+	{Config{}, nil},
+	{Config{Tiers: []Tier{{MinPeers: 10, Factor: 2}}, MaxInterval: time.Hour}, nil},
+	{Config{Tiers: []Tier{{MinPeers: 10}}}, ErrInvalidFactor},
+	{Config{Tiers: []Tier{{MinPeers: 10, Factor: -1}}}, ErrInvalidFactor},
+	{Config{MaxInterval: -time.Second}, ErrInvalidMaxInterval},
+}
+
+func TestCheckConfig(t *testing.T) {
+	for _, tt := range configTests {
+		t.Run(fmt.Sprintf("%#v", tt), func(t *testing.T) {
+			require.Equal(t, tt.expected, checkConfig(tt.cfg))
+		})
+	}
+}
+
+func TestAdjustAnnounceResponse(t *testing.T) {
+	mh, err := NewHook(Config{
+		Tiers: []Tier{
+			{MinPeers: 10000, MinSeeders: 100, Factor: 4},
+			{MinPeers: 0, Factor: 0.5},
+			{MinPeers: 1000, MinSeeders: 10, Factor: 2},
+		},
+		MaxInterval: 90 * time.Minute,
+	})
+	require.Nil(t, err)
+	h := mh.(*hook)
+
+	var tests = []struct {
+		complete, incomplete uint32
+		interval             time.Duration
+	}{
+		{1, 5, 15 * time.Minute},
+		{5, 5000, 15 * time.Minute},
+		{10, 5000, time.Hour},
+		{10, 50000, time.Hour},
+		{500, 50000, 90 * time.Minute},
+	}
+	for _, tt := range tests {
+		resp := &bittorrent.AnnounceResponse{
+			Complete:    tt.complete,
+			Incomplete:  tt.incomplete,
+			Interval:    30 * time.Minute,
+			MinInterval: 10 * time.Minute,
+		}
+		h.AdjustAnnounceResponse(&bittorrent.AnnounceRequest{}, resp)
+		require.Equal(t, tt.interval, resp.Interval, "%d seeders, %d leechers", tt.complete, tt.incomplete)
+		require.Equal(t, 10*time.Minute, resp.MinInterval)
+	}
+
+	// The interval is never below the min interval.
+	resp := &bittorrent.AnnounceResponse{Interval: 15 * time.Minute, MinInterval: 10 * time.Minute}
+	h.AdjustAnnounceResponse(&bittorrent.AnnounceRequest{}, resp)
+	require.Equal(t, 10*time.Minute, resp.Interval)
+}
@@ -1,16 +1,24 @@
 // Package torrentapproval implements a Hook that fails an Announce based on a
 // whitelist or blacklist of torrent hash.
+//
+// The list can either be configured statically or be fetched from an HTTP(S)
+// URL or a file, in which case it is refreshed periodically.
 package torrentapproval
 
 import (
 	"context"
 	"encoding/hex"
 	"fmt"
+	"sync"
+	"time"
 
 	yaml "gopkg.in/yaml.v2"
 
 	"github.com/chihaya/chihaya/bittorrent"
 	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/middleware/pkg/listsource"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/pkg/stop"
 )
 
 // Name is the name by which this middleware is registered with Chihaya.
@@ -35,60 +43,216 @@ func (d driver) NewHook(optionBytes []byte) (middleware.Hook, error) {
 }
 
 // ErrTorrentUnapproved is the error returned when a torrent hash is invalid.
-var ErrTorrentUnapproved = bittorrent.ClientError("unapproved torrent")
+var ErrTorrentUnapproved = bittorrent.RegisterClientError("unapproved_torrent", "unapproved torrent")
 
 // Config represents all the values required by this middleware to validate
 // torrents based on their hash value.
 type Config struct {
 	Whitelist []string `yaml:"whitelist"`
 	Blacklist []string `yaml:"blacklist"`
+
+	// ListURL is an HTTP(S) URL or the path of a file from which the list
+	// of hashes is loaded, as an alternative to Whitelist and Blacklist.
+	// The list contains one hexadecimal hash per line. Comments starting with
+	// '#' or ';' are ignored.
+	ListURL string `yaml:"list_url"`
+
+	// ListMode is either "whitelist" or "blacklist" and determines how the
+	// hashes loaded from ListURL are used.
+	ListMode string `yaml:"list_mode"`
+
+	// ListUpdateInterval is the interval at which the list is reloaded from
+	// ListURL.
+	ListUpdateInterval time.Duration `yaml:"list_update_interval"`
+}
+
+// LogFields implements log.Fielder for a Config.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"whitelist":          len(cfg.Whitelist),
+		"blacklist":          len(cfg.Blacklist),
+		"listURL":            cfg.ListURL,
+		"listMode":           cfg.ListMode,
+		"listUpdateInterval": cfg.ListUpdateInterval,
+	}
+}
+
+const (
+	listModeWhitelist = "whitelist"
+	listModeBlacklist = "blacklist"
+
+	defaultListUpdateInterval = 5 * time.Minute
+)
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+//
+// This function warns to the logger when a value is changed.
+func (cfg Config) Validate() Config {
+	validcfg := cfg
+
+	if cfg.ListURL != "" && cfg.ListUpdateInterval <= 0 {
+		validcfg.ListUpdateInterval = defaultListUpdateInterval
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".ListUpdateInterval",
+			"provided": cfg.ListUpdateInterval,
+			"default":  validcfg.ListUpdateInterval,
+		})
+	}
+
+	return validcfg
 }
 
 type hook struct {
+	// whitelist is whether only approved hashes are allowed.
+	whitelist bool
+
+	mu         sync.RWMutex
 	approved   map[bittorrent.InfoHash]struct{}
 	unapproved map[bittorrent.InfoHash]struct{}
+
+	source  *listsource.Source
+	closing chan struct{}
+	wg      sync.WaitGroup
 }
 
 // NewHook returns an instance of the torrent approval middleware.
-func NewHook(cfg Config) (middleware.Hook, error) {
+func NewHook(provided Config) (middleware.Hook, error) {
+	cfg := provided.Validate()
 	h := &hook{
 		approved:   make(map[bittorrent.InfoHash]struct{}),
 		unapproved: make(map[bittorrent.InfoHash]struct{}),
+		closing:    make(chan struct{}),
 	}
 
 	if len(cfg.Whitelist) > 0 && len(cfg.Blacklist) > 0 {
 		return nil, fmt.Errorf("using both whitelist and blacklist is invalid")
 	}
 
-	for _, hashString := range cfg.Whitelist {
-		hashinfo, err := hex.DecodeString(hashString)
-		if err != nil {
-			return nil, fmt.Errorf("whitelist : invalid hash %s", hashString)
+	if cfg.ListURL != "" {
+		if len(cfg.Whitelist) > 0 || len(cfg.Blacklist) > 0 {
+			return nil, fmt.Errorf("using both list_url and a static whitelist or blacklist is invalid")
 		}
-		if len(hashinfo) != 20 {
-			return nil, fmt.Errorf("whitelist : hash %s is not 20 byes", hashString)
+		if cfg.ListMode != listModeWhitelist && cfg.ListMode != listModeBlacklist {
+			return nil, fmt.Errorf("invalid list_mode %q: must be %q or %q", cfg.ListMode, listModeWhitelist, listModeBlacklist)
 		}
-		h.approved[bittorrent.InfoHashFromBytes(hashinfo)] = struct{}{}
+
+		h.whitelist = cfg.ListMode == listModeWhitelist
+		h.source = listsource.New(cfg.ListURL)
+		if err := h.refresh(); err != nil {
+			return nil, fmt.Errorf("failed to load initial list: %w", err)
+		}
+
+		h.wg.Add(1)
+		go h.runRefresh(cfg.ListUpdateInterval)
+		return h, nil
+	}
+
+	var err error
+	if h.approved, err = parseHashes("whitelist", cfg.Whitelist); err != nil {
+		return nil, err
+	}
+	if h.unapproved, err = parseHashes("blacklist", cfg.Blacklist); err != nil {
+		return nil, err
 	}
+	h.whitelist = len(h.approved) > 0
 
-	for _, hashString := range cfg.Blacklist {
+	return h, nil
+}
+
+// parseHashes decodes a list of hexadecimal hashes.
+func parseHashes(name string, hashStrings []string) (map[bittorrent.InfoHash]struct{}, error) {
+	hashes := make(map[bittorrent.InfoHash]struct{}, len(hashStrings))
+	for _, hashString := range hashStrings {
 		hashinfo, err := hex.DecodeString(hashString)
 		if err != nil {
-			return nil, fmt.Errorf("blacklist : invalid hash %s", hashString)
+			return nil, fmt.Errorf("%s : invalid hash %s", name, hashString)
 		}
-		if len(hashinfo) != 20 {
-			return nil, fmt.Errorf("blacklist : hash %s is not 20 byes", hashString)
+		ih, ok := bittorrent.ParseInfoHash(hashinfo)
+		if !ok {
+			return nil, fmt.Errorf("%s : hash %s is not 20 or 32 bytes", name, hashString)
 		}
-		h.unapproved[bittorrent.InfoHashFromBytes(hashinfo)] = struct{}{}
+		hashes[ih] = struct{}{}
 	}
+	return hashes, nil
+}
 
-	return h, nil
+// refresh reloads the list from its source, if it has changed.
+func (h *hook) refresh() error {
+	hashStrings, changed, err := h.source.Fetch()
+	if err != nil {
+		return err
+	}
+	if !changed {
+		log.Debug("torrent approval list unchanged", log.Fields{"url": h.source.URL()})
+		return nil
+	}
+
+	name := listModeBlacklist
+	if h.whitelist {
+		name = listModeWhitelist
+	}
+	hashes, err := parseHashes(name, hashStrings)
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	if h.whitelist {
+		h.approved = hashes
+	} else {
+		h.unapproved = hashes
+	}
+	h.mu.Unlock()
+
+	log.Debug("loaded torrent approval list", log.Fields{
+		"url":   h.source.URL(),
+		"count": len(hashes),
+	})
+	return nil
+}
+
+// runRefresh periodically reloads the list until the hook is stopped.
+// If the list cannot be loaded, the previous list is kept.
+func (h *hook) runRefresh(interval time.Duration) {
+	defer h.wg.Done()
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-h.closing:
+			return
+		case <-t.C:
+			if err := h.refresh(); err != nil {
+				log.Error("failed to refresh torrent approval list", log.Fields{"url": h.source.URL()}, log.Err(err))
+			}
+		}
+	}
+}
+
+// Stop stops refreshing the list.
+func (h *hook) Stop() stop.Result {
+	select {
+	case <-h.closing:
+		return stop.AlreadyStopped
+	default:
+	}
+	c := make(stop.Channel)
+	go func() {
+		close(h.closing)
+		h.wg.Wait()
+		c.Done()
+	}()
+	return c.Result()
 }
 
 func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
 	infohash := req.InfoHash
 
-	if len(h.approved) > 0 {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if h.whitelist {
 		if _, found := h.approved[infohash]; !found {
 			return ctx, ErrTorrentUnapproved
 		}
@@ -4,7 +4,13 @@ import (
 	"context"
 	"encoding/hex"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 
@@ -77,3 +83,96 @@ func TestHandleAnnounce(t *testing.T) {
 		})
 	}
 }
+
+func announce(t *testing.T, h *hook, ih string) error {
+	hashbytes, err := hex.DecodeString(ih)
+	require.Nil(t, err)
+
+	req := &bittorrent.AnnounceRequest{}
+	req.InfoHash = bittorrent.InfoHashFromBytes(hashbytes)
+	_, err = h.HandleAnnounce(context.Background(), req, &bittorrent.AnnounceResponse{})
+	return err
+}
+
+func TestListURL(t *testing.T) {
+	const (
+		ih1 = "3532cf2d327fad8448c075b4cb42c8136964a435"
+		ih2 = "4532cf2d327fad8448c075b4cb42c8136964a435"
+	)
+
+	var list atomic.Value
+	list.Store("# approved torrents\n\n" + ih1 + "\n")
+	var fetches, notModified int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		body := list.Load().(string)
+		etag := fmt.Sprintf("%q", fmt.Sprint(len(body)))
+		if r.Header.Get("If-None-Match") == etag {
+			atomic.AddInt32(&notModified, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		fmt.Fprint(w, body)
+	}))
+	defer srv.Close()
+
+	mh, err := NewHook(Config{
+		ListURL:            srv.URL,
+		ListMode:           "whitelist",
+		ListUpdateInterval: time.Hour,
+	})
+	require.Nil(t, err)
+	h := mh.(*hook)
+	defer func() { require.Nil(t, h.Stop().Wait()) }()
+
+	require.Nil(t, announce(t, h, ih1))
+	require.Equal(t, ErrTorrentUnapproved, announce(t, h, ih2))
+
+	// An unchanged list is not downloaded again.
+	require.Nil(t, h.refresh())
+	require.Equal(t, int32(2), atomic.LoadInt32(&fetches))
+	require.Equal(t, int32(1), atomic.LoadInt32(&notModified))
+
+	list.Store(ih1 + "\n" + ih2 + "\n")
+	require.Nil(t, h.refresh())
+	require.Nil(t, announce(t, h, ih2))
+
+	// The previous list is kept if the list is invalid.
+	list.Store("invalid\n")
+	require.NotNil(t, h.refresh())
+	require.Nil(t, announce(t, h, ih2))
+}
+
+func TestListFile(t *testing.T) {
+	const ih = "3532cf2d327fad8448c075b4cb42c8136964a435"
+	path := filepath.Join(t.TempDir(), "blacklist")
+	require.Nil(t, os.WriteFile(path, []byte(ih+"\n"), 0o600))
+
+	mh, err := NewHook(Config{
+		ListURL:  path,
+		ListMode: "blacklist",
+	})
+	require.Nil(t, err)
+	h := mh.(*hook)
+	defer func() { require.Nil(t, h.Stop().Wait()) }()
+
+	require.Equal(t, ErrTorrentUnapproved, announce(t, h, ih))
+
+	require.Nil(t, os.WriteFile(path, nil, 0o600))
+	require.Nil(t, os.Chtimes(path, time.Now(), time.Now().Add(time.Minute)))
+	require.Nil(t, h.refresh())
+	require.Nil(t, announce(t, h, ih))
+}
+
+func TestListConfig(t *testing.T) {
+	_, err := NewHook(Config{ListURL: "list", ListMode: "graylist"})
+	require.NotNil(t, err)
+
+	_, err = NewHook(Config{
+		ListURL:   "list",
+		ListMode:  "whitelist",
+		Whitelist: []string{"3532cf2d327fad8448c075b4cb42c8136964a435"},
+	})
+	require.NotNil(t, err)
+}
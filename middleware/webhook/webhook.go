@@ -0,0 +1,438 @@
+// Package webhook implements a Hook that posts announce and scrape events as
+// JSON to webhook URLs.
+//
+// Events are delivered asynchronously in batches. Failed deliveries are
+// retried with exponential backoff and every request can be signed with an
+// HMAC, so that receivers can verify its origin.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/pkg/stop"
+)
+
+// Name is the name by which this middleware is registered with Chihaya.
+const Name = "webhook"
+
+func init() {
+	middleware.RegisterDriver(Name, driver{})
+	prometheus.MustRegister(promDroppedEvents, promDeliveries)
+}
+
+var (
+	promDroppedEvents = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "chihaya_webhook_dropped_events_total",
+		Help: "The number of events dropped because the queue was full or delivery failed",
+	})
+
+	promDeliveries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "chihaya_webhook_deliveries_total",
+			Help: "The number of batches delivered to webhooks, by result",
+		},
+		[]string{"result"},
+	)
+)
+
+var _ middleware.Driver = driver{}
+
+type driver struct{}
+
+func (d driver) NewHook(optionBytes []byte) (middleware.Hook, error) {
+	var cfg Config
+	err := yaml.Unmarshal(optionBytes, &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid options for middleware %s: %w", Name, err)
+	}
+
+	return NewHook(cfg)
+}
+
+// SignatureHeader is the header containing the hex-encoded HMAC-SHA256 of the
+// request body, prefixed with "sha256=".
+const SignatureHeader = "X-Chihaya-Signature"
+
+// Event types.
+const (
+	EventStarted   = "started"
+	EventCompleted = "completed"
+	EventStopped   = "stopped"
+	EventScrape    = "scrape"
+)
+
+// Config represents all the values required by this middleware to deliver
+// events.
+type Config struct {
+	// URLs are the webhooks every batch of events is posted to.
+	URLs []string `yaml:"urls"`
+
+	// Secret is the key used to sign requests. Requests are not signed if
+	// it is empty.
+	Secret string `yaml:"secret"`
+
+	// Events are the types of events to deliver: "started", "completed",
+	// "stopped" and "scrape". All are delivered if it is empty.
+	Events []string `yaml:"events"`
+
+	BatchSize     int           `yaml:"batch_size"`
+	FlushInterval time.Duration `yaml:"flush_interval"`
+	QueueSize     int           `yaml:"queue_size"`
+	MaxRetries    int           `yaml:"max_retries"`
+	RetryBackoff  time.Duration `yaml:"retry_backoff"`
+	Timeout       time.Duration `yaml:"timeout"`
+}
+
+// LogFields implements log.Fielder for a Config.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"urls":          cfg.URLs,
+		"signed":        cfg.Secret != "",
+		"events":        cfg.Events,
+		"batchSize":     cfg.BatchSize,
+		"flushInterval": cfg.FlushInterval,
+		"queueSize":     cfg.QueueSize,
+		"maxRetries":    cfg.MaxRetries,
+		"retryBackoff":  cfg.RetryBackoff,
+		"timeout":       cfg.Timeout,
+	}
+}
+
+// Default config constants.
+const (
+	defaultBatchSize     = 100
+	defaultFlushInterval = time.Second
+	defaultQueueSize     = 10000
+	defaultMaxRetries    = 3
+	defaultRetryBackoff  = time.Second
+	defaultTimeout       = 10 * time.Second
+)
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+//
+// This function warns to the logger when a value is changed.
+func (cfg Config) Validate() Config {
+	validcfg := cfg
+
+	if cfg.BatchSize <= 0 {
+		validcfg.BatchSize = defaultBatchSize
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".BatchSize",
+			"provided": cfg.BatchSize,
+			"default":  validcfg.BatchSize,
+		})
+	}
+
+	if cfg.FlushInterval <= 0 {
+		validcfg.FlushInterval = defaultFlushInterval
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".FlushInterval",
+			"provided": cfg.FlushInterval,
+			"default":  validcfg.FlushInterval,
+		})
+	}
+
+	if cfg.QueueSize <= 0 {
+		validcfg.QueueSize = defaultQueueSize
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".QueueSize",
+			"provided": cfg.QueueSize,
+			"default":  validcfg.QueueSize,
+		})
+	}
+
+	if cfg.MaxRetries <= 0 {
+		validcfg.MaxRetries = defaultMaxRetries
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".MaxRetries",
+			"provided": cfg.MaxRetries,
+			"default":  validcfg.MaxRetries,
+		})
+	}
+
+	if cfg.RetryBackoff <= 0 {
+		validcfg.RetryBackoff = defaultRetryBackoff
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".RetryBackoff",
+			"provided": cfg.RetryBackoff,
+			"default":  validcfg.RetryBackoff,
+		})
+	}
+
+	if cfg.Timeout <= 0 {
+		validcfg.Timeout = defaultTimeout
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".Timeout",
+			"provided": cfg.Timeout,
+			"default":  validcfg.Timeout,
+		})
+	}
+
+	return validcfg
+}
+
+// An Event is the JSON representation of an announce or scrape.
+type Event struct {
+	Type       string    `json:"type"`
+	Time       time.Time `json:"time"`
+	InfoHash   string    `json:"info_hash,omitempty"`
+	InfoHashes []string  `json:"info_hashes,omitempty"`
+	PeerID     string    `json:"peer_id,omitempty"`
+	IP         string    `json:"ip,omitempty"`
+	Port       uint16    `json:"port,omitempty"`
+	Left       uint64    `json:"left"`
+	Uploaded   uint64    `json:"uploaded"`
+	Downloaded uint64    `json:"downloaded"`
+}
+
+type hook struct {
+	cfg    Config
+	events map[string]bool
+	client *http.Client
+	queue  chan Event
+
+	closing chan struct{}
+	wg      sync.WaitGroup
+}
+
+// NewHook returns an instance of the webhook middleware.
+func NewHook(provided Config) (middleware.Hook, error) {
+	cfg := provided.Validate()
+	if len(cfg.URLs) == 0 {
+		return nil, fmt.Errorf("no webhook URLs configured")
+	}
+
+	h := &hook{
+		cfg:     cfg,
+		events:  make(map[string]bool),
+		client:  &http.Client{Timeout: cfg.Timeout},
+		queue:   make(chan Event, cfg.QueueSize),
+		closing: make(chan struct{}),
+	}
+
+	events := cfg.Events
+	if len(events) == 0 {
+		events = []string{EventStarted, EventCompleted, EventStopped, EventScrape}
+	}
+	for _, e := range events {
+		switch e {
+		case EventStarted, EventCompleted, EventStopped, EventScrape:
+			h.events[e] = true
+		default:
+			return nil, fmt.Errorf("unknown event %q", e)
+		}
+	}
+
+	h.wg.Add(1)
+	go h.run()
+
+	return h, nil
+}
+
+// enqueue queues an event for delivery or drops it if the queue is full.
+func (h *hook) enqueue(e Event) {
+	select {
+	case h.queue <- e:
+	default:
+		promDroppedEvents.Inc()
+	}
+}
+
+// run collects events into batches and delivers them until the hook is
+// stopped, then delivers the remaining events.
+func (h *hook) run() {
+	defer h.wg.Done()
+	t := time.NewTicker(h.cfg.FlushInterval)
+	defer t.Stop()
+
+	batch := make([]Event, 0, h.cfg.BatchSize)
+	flush := func() {
+		if len(batch) > 0 {
+			h.deliver(batch)
+			batch = batch[:0]
+		}
+	}
+
+	for {
+		select {
+		case e := <-h.queue:
+			batch = append(batch, e)
+			if len(batch) >= h.cfg.BatchSize {
+				flush()
+			}
+		case <-t.C:
+			flush()
+		case <-h.closing:
+			for {
+				select {
+				case e := <-h.queue:
+					batch = append(batch, e)
+					if len(batch) >= h.cfg.BatchSize {
+						flush()
+					}
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// deliver posts a batch to all URLs.
+func (h *hook) deliver(batch []Event) {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		log.Error("failed to encode webhook events", log.Err(err))
+		return
+	}
+
+	var signature string
+	if h.cfg.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(h.cfg.Secret))
+		mac.Write(body)
+		signature = "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	}
+
+	for _, url := range h.cfg.URLs {
+		if err := h.post(url, body, signature); err != nil {
+			log.Error("failed to deliver webhook events", log.Fields{
+				"url":    url,
+				"events": len(batch),
+			}, log.Err(err))
+			promDeliveries.WithLabelValues("failure").Inc()
+			promDroppedEvents.Add(float64(len(batch)))
+			continue
+		}
+		promDeliveries.WithLabelValues("success").Inc()
+	}
+}
+
+// post sends a request, retrying with exponential backoff.
+// Retries are cut short if the hook is stopped.
+func (h *hook) post(url string, body []byte, signature string) (err error) {
+	backoff := h.cfg.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		if err = h.postOnce(url, body, signature); err == nil || attempt >= h.cfg.MaxRetries {
+			return err
+		}
+
+		select {
+		case <-h.closing:
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (h *hook) postOnce(url string, body []byte, signature string) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if signature != "" {
+		req.Header.Set(SignatureHeader, signature)
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Stop delivers all queued events and stops the hook.
+func (h *hook) Stop() stop.Result {
+	select {
+	case <-h.closing:
+		return stop.AlreadyStopped
+	default:
+	}
+	c := make(stop.Channel)
+	go func() {
+		close(h.closing)
+		h.wg.Wait()
+		c.Done()
+	}()
+	return c.Result()
+}
+
+// NewAnnounceEvent returns the Event for an announce. It returns false for
+// announces without an event.
+//
+// Everything is copied, so the request may be reused afterwards.
+func NewAnnounceEvent(req *bittorrent.AnnounceRequest) (Event, bool) {
+	var event string
+	switch req.Event {
+	case bittorrent.Started:
+		event = EventStarted
+	case bittorrent.Completed:
+		event = EventCompleted
+	case bittorrent.Stopped:
+		event = EventStopped
+	default:
+		return Event{}, false
+	}
+
+	return Event{
+		Type:       event,
+		Time:       time.Now().UTC(),
+		InfoHash:   req.InfoHash.String(),
+		PeerID:     req.Peer.ID.String(),
+		IP:         req.Peer.IP.String(),
+		Port:       req.Peer.Port,
+		Left:       req.Left,
+		Uploaded:   req.Uploaded,
+		Downloaded: req.Downloaded,
+	}, true
+}
+
+// NewScrapeEvent returns the Event for a scrape.
+func NewScrapeEvent(req *bittorrent.ScrapeRequest) Event {
+	infoHashes := make([]string, 0, len(req.InfoHashes))
+	for _, ih := range req.InfoHashes {
+		infoHashes = append(infoHashes, ih.String())
+	}
+	return Event{
+		Type:       EventScrape,
+		Time:       time.Now().UTC(),
+		InfoHashes: infoHashes,
+	}
+}
+
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	if e, ok := NewAnnounceEvent(req); ok && h.events[e.Type] {
+		h.enqueue(e)
+	}
+	return ctx, nil
+}
+
+func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	if h.events[EventScrape] {
+		h.enqueue(NewScrapeEvent(req))
+	}
+	return ctx, nil
+}
@@ -0,0 +1,103 @@
+package webhook
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+func TestDelivery(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		batches  [][]Event
+		failures = 1
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.Nil(t, err)
+
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write(body)
+		require.Equal(t, "sha256="+hex.EncodeToString(mac.Sum(nil)), r.Header.Get(SignatureHeader))
+
+		mu.Lock()
+		defer mu.Unlock()
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var batch []Event
+		require.Nil(t, json.Unmarshal(body, &batch))
+		batches = append(batches, batch)
+	}))
+	defer srv.Close()
+
+	mh, err := NewHook(Config{
+		URLs:          []string{srv.URL},
+		Secret:        "secret",
+		Events:        []string{EventStarted, EventScrape},
+		BatchSize:     2,
+		FlushInterval: time.Hour,
+		RetryBackoff:  time.Millisecond,
+	})
+	require.Nil(t, err)
+
+	ctx := context.Background()
+	req := &bittorrent.AnnounceRequest{
+		Event:    bittorrent.Started,
+		InfoHash: bittorrent.InfoHash{1},
+		Peer: bittorrent.Peer{
+			IP:   bittorrent.IP{IP: net.IPv4(10, 0, 0, 1), AddressFamily: bittorrent.IPv4},
+			Port: 6881,
+		},
+	}
+	_, err = mh.HandleAnnounce(ctx, req, &bittorrent.AnnounceResponse{})
+	require.Nil(t, err)
+
+	// Stopped events are not configured.
+	req.Event = bittorrent.Stopped
+	_, err = mh.HandleAnnounce(ctx, req, &bittorrent.AnnounceResponse{})
+	require.Nil(t, err)
+
+	_, err = mh.HandleScrape(ctx, &bittorrent.ScrapeRequest{InfoHashes: []bittorrent.InfoHash{{2}}}, &bittorrent.ScrapeResponse{})
+	require.Nil(t, err)
+
+	// The full batch is delivered after a retry.
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(batches) == 1
+	}, 5*time.Second, time.Millisecond)
+
+	req.Event = bittorrent.Started
+	_, err = mh.HandleAnnounce(ctx, req, &bittorrent.AnnounceResponse{})
+	require.Nil(t, err)
+
+	// Stopping flushes the incomplete batch.
+	require.Nil(t, mh.(*hook).Stop().Wait())
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, batches, 2)
+	require.Len(t, batches[0], 2)
+	require.Equal(t, EventStarted, batches[0][0].Type)
+	require.Equal(t, bittorrent.InfoHash{1}.String(), batches[0][0].InfoHash)
+	require.Equal(t, "10.0.0.1", batches[0][0].IP)
+	require.Equal(t, EventScrape, batches[0][1].Type)
+	require.Equal(t, []string{bittorrent.InfoHash{2}.String()}, batches[0][1].InfoHashes)
+	require.Len(t, batches[1], 1)
+}
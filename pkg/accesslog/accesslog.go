@@ -0,0 +1,407 @@
+// Package accesslog implements an optional log of the announces and scrapes
+// served by the frontends, written as JSON lines to a sink separate from the
+// application log.
+//
+// The access log is disabled unless a Logger is running. Frontends call Sample
+// when a request starts, which returns nil if the access log is disabled or
+// the request is not sampled; all methods of Entry are safe to call on nil.
+package accesslog
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/pkg/stop"
+)
+
+func init() {
+	prometheus.MustRegister(promDroppedEntries)
+	current.Store((*Logger)(nil))
+}
+
+var promDroppedEntries = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "chihaya_access_log_dropped_entries_total",
+	Help: "The number of access log entries dropped because the queue was full",
+})
+
+// Fields of an access log entry.
+const (
+	FieldTime     = "time"
+	FieldFrontend = "frontend"
+	FieldAction   = "action"
+	FieldIP       = "ip"
+	FieldPort     = "port"
+	FieldPeerID   = "peer_id"
+	FieldInfoHash = "infohash"
+	FieldEvent    = "event"
+	FieldError    = "error"
+	FieldSize     = "size"
+	FieldLatency  = "latency"
+)
+
+// allFields are the fields logged by default, in the order they are
+// documented.
+var allFields = []string{
+	FieldTime,
+	FieldFrontend,
+	FieldAction,
+	FieldIP,
+	FieldPort,
+	FieldPeerID,
+	FieldInfoHash,
+	FieldEvent,
+	FieldError,
+	FieldSize,
+	FieldLatency,
+}
+
+// Config represents the configuration of a Logger.
+type Config struct {
+	// Path is the file the log is appended to, or "stdout" or "stderr". The
+	// access log is disabled without a path.
+	Path string `yaml:"path"`
+
+	// Fields are the fields of the entries. All fields are logged if none
+	// are configured.
+	Fields []string `yaml:"fields"`
+
+	// SampleRate is the fraction of requests that are logged.
+	SampleRate float64 `yaml:"sample_rate"`
+
+	// QueueSize is the number of entries that are queued for writing.
+	// Further entries are dropped.
+	QueueSize int `yaml:"queue_size"`
+}
+
+// Enabled reports whether the access log is configured.
+func (cfg Config) Enabled() bool {
+	return cfg.Path != ""
+}
+
+// LogFields renders the current config as a set of Logrus fields.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"path":       cfg.Path,
+		"fields":     cfg.Fields,
+		"sampleRate": cfg.SampleRate,
+		"queueSize":  cfg.QueueSize,
+	}
+}
+
+// Default config constants.
+const (
+	defaultSampleRate = 1.0
+	defaultQueueSize  = 1024
+)
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+//
+// This function warns to the logger when a value is changed.
+func (cfg Config) Validate() Config {
+	validcfg := cfg
+
+	validcfg.Fields = nil
+	for _, f := range cfg.Fields {
+		if !isField(f) {
+			log.Warn("ignoring unknown access log field", log.Fields{"field": f})
+			continue
+		}
+		validcfg.Fields = append(validcfg.Fields, f)
+	}
+	if len(validcfg.Fields) == 0 {
+		validcfg.Fields = allFields
+		if len(cfg.Fields) > 0 {
+			log.Warn("falling back to default configuration", log.Fields{
+				"name":     "access_log.Fields",
+				"provided": cfg.Fields,
+				"default":  validcfg.Fields,
+			})
+		}
+	}
+
+	if cfg.SampleRate <= 0 || cfg.SampleRate > 1 {
+		validcfg.SampleRate = defaultSampleRate
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     "access_log.SampleRate",
+			"provided": cfg.SampleRate,
+			"default":  validcfg.SampleRate,
+		})
+	}
+
+	if cfg.QueueSize <= 0 {
+		validcfg.QueueSize = defaultQueueSize
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     "access_log.QueueSize",
+			"provided": cfg.QueueSize,
+			"default":  validcfg.QueueSize,
+		})
+	}
+
+	return validcfg
+}
+
+func isField(name string) bool {
+	for _, f := range allFields {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
+// current holds the running *Logger, or a nil *Logger.
+var current atomic.Value
+
+func logger() *Logger {
+	return current.Load().(*Logger)
+}
+
+// Entry describes a request served by a frontend.
+type Entry struct {
+	l *Logger
+
+	Start    time.Time
+	Frontend string
+
+	Action     string
+	IP         net.IP
+	Port       uint16
+	PeerID     bittorrent.PeerID
+	InfoHashes []bittorrent.InfoHash
+	Event      string
+	Err        error
+
+	// Size is the number of bytes of the response.
+	Size int
+}
+
+// Sample starts an Entry for a request served by a frontend, or returns nil
+// if the access log is disabled or the request is not sampled.
+func Sample(frontend string) *Entry {
+	l := logger()
+	if l == nil || (l.cfg.SampleRate < 1 && rand.Float64() >= l.cfg.SampleRate) {
+		return nil
+	}
+	return &Entry{l: l, Start: time.Now(), Frontend: frontend}
+}
+
+// SetAnnounce records the details of an announce. They are copied, as
+// announce requests are released to a pool after they are handled.
+func (e *Entry) SetAnnounce(req *bittorrent.AnnounceRequest) {
+	if e == nil {
+		return
+	}
+	e.IP = append(net.IP(nil), req.IP.IP...)
+	e.Port = req.Port
+	e.PeerID = req.ID
+	e.InfoHashes = []bittorrent.InfoHash{req.InfoHash}
+	e.Event = req.Event.String()
+}
+
+// SetScrape records the details of a scrape from the given IP.
+func (e *Entry) SetScrape(req *bittorrent.ScrapeRequest, ip net.IP) {
+	if e == nil {
+		return
+	}
+	e.IP = ip
+	e.InfoHashes = req.InfoHashes
+}
+
+// AddSize adds to the size of the response.
+func (e *Entry) AddSize(n int) {
+	if e == nil {
+		return
+	}
+	e.Size += n
+}
+
+// Log queues the entry for writing, with the action of the request and the
+// error it failed with. Only announces and scrapes are logged; for requests
+// that failed to parse, the entry lacks their details.
+//
+// The entry must not be used after Log.
+func (e *Entry) Log(action string, err error) {
+	if e == nil || (action != "announce" && action != "scrape") {
+		return
+	}
+	e.Action = action
+	e.Err = err
+	e.l.enqueue(e, time.Since(e.Start))
+}
+
+// Logger writes the entries of the access log to its sink.
+type Logger struct {
+	cfg    Config
+	w      io.Writer
+	closer io.Closer
+
+	queue   chan queuedEntry
+	closing chan struct{}
+	wg      sync.WaitGroup
+}
+
+type queuedEntry struct {
+	*Entry
+	latency time.Duration
+}
+
+// NewLogger opens the sink of the config and makes the Logger the one all
+// sampled requests are logged to, until it is stopped.
+func NewLogger(provided Config) (*Logger, error) {
+	cfg := provided.Validate()
+	l := &Logger{
+		cfg:     cfg,
+		queue:   make(chan queuedEntry, cfg.QueueSize),
+		closing: make(chan struct{}),
+	}
+
+	switch cfg.Path {
+	case "stdout":
+		l.w = os.Stdout
+	case "stderr":
+		l.w = os.Stderr
+	default:
+		f, err := os.OpenFile(cfg.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+		if err != nil {
+			return nil, err
+		}
+		l.w, l.closer = f, f
+	}
+
+	l.wg.Add(1)
+	go l.run()
+
+	current.Store(l)
+	return l, nil
+}
+
+func (l *Logger) enqueue(e *Entry, latency time.Duration) {
+	select {
+	case l.queue <- queuedEntry{e, latency}:
+	default:
+		promDroppedEntries.Inc()
+	}
+}
+
+func (l *Logger) run() {
+	defer l.wg.Done()
+	w := bufio.NewWriter(l.w)
+	for {
+		select {
+		case <-l.closing:
+			// Write the entries that were queued before the Logger was
+			// stopped.
+			for {
+				select {
+				case e := <-l.queue:
+					l.write(w, e)
+				default:
+					if err := w.Flush(); err != nil {
+						log.Error("failed to write access log", log.Err(err))
+					}
+					return
+				}
+			}
+		case e := <-l.queue:
+			l.write(w, e)
+			if len(l.queue) == 0 {
+				if err := w.Flush(); err != nil {
+					log.Error("failed to write access log", log.Err(err))
+				}
+			}
+		}
+	}
+}
+
+// write writes an entry as a JSON line.
+func (l *Logger) write(w *bufio.Writer, e queuedEntry) {
+	line := make(map[string]interface{}, len(l.cfg.Fields))
+	for _, f := range l.cfg.Fields {
+		switch f {
+		case FieldTime:
+			line[f] = e.Start.UTC().Format(time.RFC3339Nano)
+		case FieldFrontend:
+			line[f] = e.Frontend
+		case FieldAction:
+			line[f] = e.Action
+		case FieldIP:
+			if e.IP != nil {
+				line[f] = e.IP.String()
+			}
+		case FieldPort:
+			if e.Port != 0 {
+				line[f] = e.Port
+			}
+		case FieldPeerID:
+			if e.PeerID != (bittorrent.PeerID{}) {
+				line[f] = e.PeerID.String()
+			}
+		case FieldInfoHash:
+			switch {
+			case e.Action == "announce" && len(e.InfoHashes) == 1:
+				line[f] = e.InfoHashes[0].String()
+			case len(e.InfoHashes) > 0:
+				infoHashes := make([]string, len(e.InfoHashes))
+				for i, ih := range e.InfoHashes {
+					infoHashes[i] = ih.String()
+				}
+				line[f] = infoHashes
+			}
+		case FieldEvent:
+			if e.Event != "" {
+				line[f] = e.Event
+			}
+		case FieldError:
+			if e.Err != nil {
+				line[f] = e.Err.Error()
+			}
+		case FieldSize:
+			line[f] = e.Size
+		case FieldLatency:
+			line[f] = e.latency.Seconds()
+		}
+	}
+
+	b, err := json.Marshal(line)
+	if err != nil {
+		log.Error("failed to encode access log entry", log.Err(err))
+		return
+	}
+	_, _ = w.Write(append(b, '\n'))
+}
+
+// Stop stops logging requests, writes the queued entries and closes the sink.
+func (l *Logger) Stop() stop.Result {
+	select {
+	case <-l.closing:
+		return stop.AlreadyStopped
+	default:
+	}
+	c := make(stop.Channel)
+	go func() {
+		// Only unset the Logger if it was not replaced already.
+		if logger() == l {
+			current.Store((*Logger)(nil))
+		}
+		close(l.closing)
+		l.wg.Wait()
+		if l.closer != nil {
+			c.Done(l.closer.Close())
+			return
+		}
+		c.Done()
+	}()
+	return c.Result()
+}
@@ -0,0 +1,110 @@
+package accesslog
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+// readLines reads the entries written to the log at path.
+func readLines(t *testing.T, path string) []map[string]interface{} {
+	f, err := os.Open(path)
+	require.Nil(t, err)
+	defer f.Close()
+
+	var lines []map[string]interface{}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var line map[string]interface{}
+		require.Nil(t, json.Unmarshal(s.Bytes(), &line))
+		lines = append(lines, line)
+	}
+	require.Nil(t, s.Err())
+	return lines
+}
+
+func TestLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	l, err := NewLogger(Config{Path: path})
+	require.Nil(t, err)
+
+	ih := bittorrent.InfoHashFromString("aaaaaaaaaaaaaaaaaaaa")
+	announce := &bittorrent.AnnounceRequest{
+		Event:    bittorrent.Started,
+		InfoHash: ih,
+		Peer: bittorrent.Peer{
+			ID:   bittorrent.PeerIDFromString("bbbbbbbbbbbbbbbbbbbb"),
+			IP:   bittorrent.IP{IP: net.IPv4(10, 0, 0, 1).To4(), AddressFamily: bittorrent.IPv4},
+			Port: 6881,
+		},
+	}
+	e := Sample("http")
+	e.SetAnnounce(announce)
+	e.AddSize(40)
+	e.AddSize(2)
+	e.Log("announce", nil)
+
+	e = Sample("udp")
+	e.SetScrape(&bittorrent.ScrapeRequest{InfoHashes: []bittorrent.InfoHash{ih, ih}}, net.IPv6loopback)
+	e.Log("scrape", errors.New("failure"))
+
+	// Requests other than announces and scrapes are not logged.
+	Sample("udp").Log("connect", nil)
+
+	require.Nil(t, <-l.Stop())
+	require.Nil(t, Sample("http"))
+
+	lines := readLines(t, path)
+	require.Len(t, lines, 2)
+
+	require.Equal(t, "http", lines[0]["frontend"])
+	require.Equal(t, "announce", lines[0]["action"])
+	require.Equal(t, "10.0.0.1", lines[0]["ip"])
+	require.Equal(t, float64(6881), lines[0]["port"])
+	require.Equal(t, announce.ID.String(), lines[0]["peer_id"])
+	require.Equal(t, ih.String(), lines[0]["infohash"])
+	require.Equal(t, "started", lines[0]["event"])
+	require.Equal(t, float64(42), lines[0]["size"])
+	require.NotContains(t, lines[0], "error")
+	require.Contains(t, lines[0], "time")
+	require.Contains(t, lines[0], "latency")
+
+	require.Equal(t, "scrape", lines[1]["action"])
+	require.Equal(t, "::1", lines[1]["ip"])
+	require.Equal(t, []interface{}{ih.String(), ih.String()}, lines[1]["infohash"])
+	require.Equal(t, "failure", lines[1]["error"])
+	require.NotContains(t, lines[1], "event")
+}
+
+func TestFieldsAndSampling(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	l, err := NewLogger(Config{Path: path, Fields: []string{"ip", "unknown", "action"}, SampleRate: 0.5})
+	require.Nil(t, err)
+
+	var sampled int
+	for i := 0; i < 1000; i++ {
+		e := Sample("http")
+		if e == nil {
+			continue
+		}
+		sampled++
+		e.SetScrape(&bittorrent.ScrapeRequest{}, net.IPv4(10, 0, 0, 1))
+		e.Log("scrape", nil)
+	}
+	require.InDelta(t, 500, sampled, 100)
+	require.Nil(t, <-l.Stop())
+
+	lines := readLines(t, path)
+	require.Len(t, lines, sampled)
+	for _, line := range lines {
+		require.Equal(t, map[string]interface{}{"ip": "10.0.0.1", "action": "scrape"}, line)
+	}
+}
@@ -0,0 +1,582 @@
+// Package admin implements an HTTP API for inspecting and changing the swarms
+// of a PeerStore and the lists of middleware, protected by an API key.
+//
+// The API is served on its own listener, or mounted on the metrics server.
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/pkg/drain"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/pkg/stop"
+	"github.com/chihaya/chihaya/storage"
+)
+
+// Prefix is the path all routes of the API are mounted at.
+const Prefix = "/admin/"
+
+// Default and maximum number of peers returned by a request.
+const (
+	defaultLimit = 100
+	maxLimit     = 10000
+)
+
+// Config represents the configuration of the admin API.
+type Config struct {
+	// Addr is the address of the listener of the API. If empty, the API is
+	// mounted on the metrics server.
+	Addr string `yaml:"addr"`
+
+	// APIKey must be presented as a bearer token by all requests. The API
+	// is disabled without a key.
+	APIKey string `yaml:"api_key"`
+}
+
+// LogFields renders the current config as a set of Logrus fields.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"addr":    cfg.Addr,
+		"enabled": cfg.Enabled(),
+	}
+}
+
+// Enabled reports whether an API key is configured.
+func (cfg Config) Enabled() bool {
+	return cfg.APIKey != ""
+}
+
+// Handler serves the admin API for a PeerStore.
+type Handler struct {
+	ps     storage.PeerStore
+	apiKey []byte
+}
+
+// NewHandler creates a Handler serving the API for the PeerStore, which
+// requires the API key.
+func NewHandler(ps storage.PeerStore, apiKey string) *Handler {
+	return &Handler{ps: ps, apiKey: []byte(apiKey)}
+}
+
+// ServeHTTP implements the http.Handler interface.
+//
+// The routes are
+//
+//	GET    /admin/swarms?family=IPv4&cursor=&limit=
+//	DELETE /admin/swarms
+//	GET    /admin/swarms/<infohash>?limit=
+//	DELETE /admin/swarms/<infohash>
+//	DELETE /admin/swarms/<infohash>/peers?id=<peer ID>&ip=<ip>&port=<port>
+//	POST   /admin/gc
+//	GET    /admin/drain
+//	POST   /admin/drain?instance=<name>
+//	GET    /admin/lists
+//	GET    /admin/lists/<name>
+//	POST   /admin/lists/<name>?entry=<entry>
+//	DELETE /admin/lists/<name>?entry=<entry>
+//
+// Infohashes and peer IDs are hex encoded.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="chihaya"`)
+		writeError(w, http.StatusUnauthorized, "invalid API key")
+		return
+	}
+
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, Prefix), "/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "swarms" && r.Method == http.MethodGet:
+		h.listSwarms(w, r)
+	case len(parts) == 1 && parts[0] == "swarms" && r.Method == http.MethodDelete:
+		h.clear(w)
+	case len(parts) == 2 && parts[0] == "swarms" && r.Method == http.MethodGet:
+		h.getSwarm(w, r, parts[1])
+	case len(parts) == 2 && parts[0] == "swarms" && r.Method == http.MethodDelete:
+		h.deleteSwarm(w, r, parts[1])
+	case len(parts) == 3 && parts[0] == "swarms" && parts[2] == "peers" && r.Method == http.MethodDelete:
+		h.deletePeer(w, r, parts[1])
+	case len(parts) == 1 && parts[0] == "gc" && r.Method == http.MethodPost:
+		h.collectGarbage(w)
+	case len(parts) == 1 && parts[0] == "drain" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, newDrainResponse())
+	case len(parts) == 1 && parts[0] == "drain" && r.Method == http.MethodPost:
+		h.startDraining(w, r)
+	case len(parts) == 1 && parts[0] == "lists" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, listsResponse{Lists: middleware.ListNames()})
+	case len(parts) == 2 && parts[0] == "lists":
+		h.handleList(w, r, parts[1])
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func (h *Handler) authorized(r *http.Request) bool {
+	const scheme = "Bearer "
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, scheme) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(auth[len(scheme):]), h.apiKey) == 1
+}
+
+type swarmSummary struct {
+	InfoHash string `json:"infohash"`
+	Seeders  int    `json:"seeders"`
+	Leechers int    `json:"leechers"`
+}
+
+type listResponse struct {
+	Swarms []swarmSummary `json:"swarms"`
+	Next   string         `json:"next,omitempty"`
+}
+
+func (h *Handler) listSwarms(w http.ResponseWriter, r *http.Request) {
+	e, ok := h.ps.(storage.Exporter)
+	if !ok {
+		writeError(w, http.StatusNotImplemented, "storage cannot list swarms")
+		return
+	}
+
+	q := r.URL.Query()
+	af := bittorrent.IPv4
+	switch q.Get("family") {
+	case "", "IPv4":
+	case "IPv6":
+		af = bittorrent.IPv6
+	default:
+		writeError(w, http.StatusBadRequest, "invalid family")
+		return
+	}
+	limit, err := parseLimit(q.Get("limit"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	peers, next, err := e.ExportPeers(af, q.Get("cursor"), limit)
+	if errors.Is(err, storage.ErrInvalidCursor) {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	resp := listResponse{Swarms: []swarmSummary{}, Next: next}
+	for i, sp := range peers {
+		if i == 0 || peers[i-1].InfoHash != sp.InfoHash {
+			resp.Swarms = append(resp.Swarms, swarmSummary{InfoHash: sp.InfoHash.String()})
+		}
+		if sp.Seeder {
+			resp.Swarms[len(resp.Swarms)-1].Seeders++
+		} else {
+			resp.Swarms[len(resp.Swarms)-1].Leechers++
+		}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (h *Handler) clear(w http.ResponseWriter) {
+	c, ok := h.ps.(storage.ClearablePeerStore)
+	if !ok {
+		writeError(w, http.StatusNotImplemented, "storage cannot be cleared")
+		return
+	}
+
+	if err := c.Clear(); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	log.Info("admin: cleared storage")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type peer struct {
+	ID   string `json:"id"`
+	IP   string `json:"ip"`
+	Port uint16 `json:"port"`
+}
+
+type swarmResponse struct {
+	InfoHash   string `json:"infohash"`
+	Complete   uint32 `json:"complete"`
+	Incomplete uint32 `json:"incomplete"`
+	Downloaded uint32 `json:"downloaded"`
+	Seeders    []peer `json:"seeders"`
+	Leechers   []peer `json:"leechers"`
+}
+
+// swarmPeers returns up to limit seeders and leechers of each address family
+// of the swarm.
+func (h *Handler) swarmPeers(ih bittorrent.InfoHash, limit int) (seeders, leechers []bittorrent.Peer, err error) {
+	pm, ok := h.ps.(storage.PeerMixer)
+	if !ok {
+		return nil, nil, errors.New("storage cannot return the peers of a swarm")
+	}
+
+	for _, af := range []bittorrent.AddressFamily{bittorrent.IPv4, bittorrent.IPv6} {
+		// The announcer is excluded from the peers, so an unspecified
+		// address announces.
+		announcer := bittorrent.Peer{IP: bittorrent.IP{IP: net.IPv4zero.To4(), AddressFamily: af}}
+		if af == bittorrent.IPv6 {
+			announcer.IP.IP = net.IPv6zero
+		}
+
+		s, err := pm.AnnounceMixedPeers(ih, limit, 0, announcer)
+		if errors.Is(err, storage.ErrResourceDoesNotExist) {
+			continue
+		} else if err != nil {
+			return nil, nil, err
+		}
+		l, err := pm.AnnounceMixedPeers(ih, 0, limit, announcer)
+		if err != nil && !errors.Is(err, storage.ErrResourceDoesNotExist) {
+			return nil, nil, err
+		}
+		seeders = append(seeders, s...)
+		leechers = append(leechers, l...)
+	}
+	return seeders, leechers, nil
+}
+
+func (h *Handler) getSwarm(w http.ResponseWriter, r *http.Request, ihString string) {
+	ih, err := parseInfoHash(ihString)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	limit, err := parseLimit(r.URL.Query().Get("limit"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	seeders, leechers, err := h.swarmPeers(ih, limit)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	resp := swarmResponse{InfoHash: ih.String(), Seeders: []peer{}, Leechers: []peer{}}
+	for _, af := range []bittorrent.AddressFamily{bittorrent.IPv4, bittorrent.IPv6} {
+		scrape := h.ps.ScrapeSwarm(ih, af)
+		resp.Complete += scrape.Complete
+		resp.Incomplete += scrape.Incomplete
+		resp.Downloaded += scrape.Snatches
+	}
+	if resp.Complete == 0 && resp.Incomplete == 0 {
+		writeError(w, http.StatusNotFound, "swarm not found")
+		return
+	}
+	for _, p := range seeders {
+		resp.Seeders = append(resp.Seeders, newPeer(p))
+	}
+	for _, p := range leechers {
+		resp.Leechers = append(resp.Leechers, newPeer(p))
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+type deleteResponse struct {
+	Deleted int `json:"deleted"`
+}
+
+func (h *Handler) deleteSwarm(w http.ResponseWriter, r *http.Request, ihString string) {
+	ih, err := parseInfoHash(ihString)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Swarms larger than maxLimit are deleted in several rounds, until a
+	// round finds no peers to delete.
+	var deleted int
+	for {
+		seeders, leechers, err := h.swarmPeers(ih, maxLimit)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		round := 0
+		for _, p := range seeders {
+			if err := h.ps.DeleteSeeder(ih, p); err == nil {
+				round++
+			} else if !errors.Is(err, storage.ErrResourceDoesNotExist) {
+				writeError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+		}
+		for _, p := range leechers {
+			if err := h.ps.DeleteLeecher(ih, p); err == nil {
+				round++
+			} else if !errors.Is(err, storage.ErrResourceDoesNotExist) {
+				writeError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+		}
+		if round == 0 {
+			break
+		}
+		deleted += round
+	}
+
+	if deleted == 0 {
+		writeError(w, http.StatusNotFound, "swarm not found")
+		return
+	}
+	log.Info("admin: deleted swarm", log.Fields{"InfoHash": ih.String(), "deleted": deleted})
+	writeJSON(w, http.StatusOK, deleteResponse{Deleted: deleted})
+}
+
+func (h *Handler) deletePeer(w http.ResponseWriter, r *http.Request, ihString string) {
+	ih, err := parseInfoHash(ihString)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	p, err := parsePeer(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var deleted int
+	for _, del := range []func(bittorrent.InfoHash, bittorrent.Peer) error{h.ps.DeleteSeeder, h.ps.DeleteLeecher} {
+		if err := del(ih, p); err == nil {
+			deleted++
+		} else if !errors.Is(err, storage.ErrResourceDoesNotExist) {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	if deleted == 0 {
+		writeError(w, http.StatusNotFound, "peer not found")
+		return
+	}
+	log.Info("admin: deleted peer", log.Fields{"InfoHash": ih.String(), "Peer": p})
+	writeJSON(w, http.StatusOK, deleteResponse{Deleted: deleted})
+}
+
+func (h *Handler) collectGarbage(w http.ResponseWriter) {
+	gc, ok := h.ps.(storage.GarbageCollector)
+	if !ok {
+		writeError(w, http.StatusNotImplemented, "storage cannot collect garbage on demand")
+		return
+	}
+
+	if err := gc.CollectGarbage(); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	log.Info("admin: collected garbage")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type drainResponse struct {
+	// Draining reports whether the process is draining.
+	Draining  bool            `json:"draining"`
+	Instances []instanceDrain `json:"instances"`
+}
+
+type instanceDrain struct {
+	// Name is empty for the top-level tracker.
+	Name     string `json:"name,omitempty"`
+	Draining bool   `json:"draining"`
+}
+
+// newDrainResponse reports whether the process and each of its trackers are
+// draining.
+func newDrainResponse() drainResponse {
+	resp := drainResponse{Draining: drain.Draining(), Instances: []instanceDrain{}}
+	for _, s := range drain.States() {
+		resp.Instances = append(resp.Instances, instanceDrain{Name: s.Name(), Draining: s.Draining()})
+	}
+	return resp
+}
+
+// startDraining starts draining an instance, if one is named, or otherwise
+// the process, after which Chihaya shuts down.
+func (h *Handler) startDraining(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("instance")
+	if name == "" {
+		if drain.Start() {
+			log.Info("admin: started draining")
+		}
+		writeJSON(w, http.StatusAccepted, newDrainResponse())
+		return
+	}
+
+	for _, s := range drain.States() {
+		if s.Name() == name {
+			if s.Start() {
+				log.Info("admin: started draining instance", log.Fields{"instance": name})
+			}
+			writeJSON(w, http.StatusAccepted, newDrainResponse())
+			return
+		}
+	}
+	writeError(w, http.StatusNotFound, "instance not found")
+}
+
+type listsResponse struct {
+	Lists []string `json:"lists"`
+}
+
+type entriesResponse struct {
+	Name    string   `json:"name"`
+	Entries []string `json:"entries"`
+}
+
+func (h *Handler) handleList(w http.ResponseWriter, r *http.Request, name string) {
+	l, ok := middleware.ListByName(name)
+	if !ok {
+		writeError(w, http.StatusNotFound, "list not found")
+		return
+	}
+
+	entry := r.URL.Query().Get("entry")
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, entriesResponse{Name: name, Entries: l.Entries()})
+		return
+	case http.MethodPost, http.MethodDelete:
+		if entry == "" {
+			writeError(w, http.StatusBadRequest, "missing entry")
+			return
+		}
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		if err := l.Add(entry); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		log.Info("admin: added list entry", log.Fields{"list": name, "entry": entry})
+	} else {
+		if !l.Remove(entry) {
+			writeError(w, http.StatusNotFound, "entry not found")
+			return
+		}
+		log.Info("admin: removed list entry", log.Fields{"list": name, "entry": entry})
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func newPeer(p bittorrent.Peer) peer {
+	return peer{ID: p.ID.String(), IP: p.IP.String(), Port: p.Port}
+}
+
+func parseInfoHash(s string) (bittorrent.InfoHash, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return bittorrent.InfoHash{}, errors.New("invalid infohash")
+	}
+	ih, ok := bittorrent.ParseInfoHash(b)
+	if !ok {
+		return bittorrent.InfoHash{}, errors.New("invalid infohash")
+	}
+	return ih, nil
+}
+
+func parsePeer(q url.Values) (bittorrent.Peer, error) {
+	id, err := hex.DecodeString(q.Get("id"))
+	if err != nil || len(id) != len(bittorrent.PeerID{}) {
+		return bittorrent.Peer{}, errors.New("invalid peer ID")
+	}
+	ip := net.ParseIP(q.Get("ip"))
+	if ip == nil {
+		return bittorrent.Peer{}, errors.New("invalid IP")
+	}
+	port, err := strconv.ParseUint(q.Get("port"), 10, 16)
+	if err != nil {
+		return bittorrent.Peer{}, errors.New("invalid port")
+	}
+
+	p := bittorrent.Peer{ID: bittorrent.PeerIDFromBytes(id), Port: uint16(port)}
+	if ip4 := ip.To4(); ip4 != nil {
+		p.IP = bittorrent.IP{IP: ip4, AddressFamily: bittorrent.IPv4}
+	} else {
+		p.IP = bittorrent.IP{IP: ip, AddressFamily: bittorrent.IPv6}
+	}
+	return p, nil
+}
+
+func parseLimit(s string) (int, error) {
+	if s == "" {
+		return defaultLimit, nil
+	}
+	limit, err := strconv.Atoi(s)
+	if err != nil || limit <= 0 || limit > maxLimit {
+		return 0, errors.New("invalid limit")
+	}
+	return limit, nil
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, errorResponse{Error: msg})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Debug("admin: failed to write response", log.Err(err))
+	}
+}
+
+// Server serves the admin API on its own listener.
+type Server struct {
+	srv *http.Server
+}
+
+// NewServer creates a Server that asynchronously serves the API for the
+// PeerStore on the configured address.
+func NewServer(cfg Config, ps storage.PeerStore) *Server {
+	mux := http.NewServeMux()
+	mux.Handle(Prefix, NewHandler(ps, cfg.APIKey))
+
+	s := &Server{
+		srv: &http.Server{
+			Addr:              cfg.Addr,
+			Handler:           mux,
+			ReadHeaderTimeout: time.Second * 60,
+		},
+	}
+
+	go func() {
+		if err := s.srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal("failed while serving admin API", log.Err(err))
+		}
+	}()
+
+	return s
+}
+
+// Stop shuts down the server.
+func (s *Server) Stop() stop.Result {
+	c := make(stop.Channel)
+	go func() {
+		c.Done(s.srv.Shutdown(context.Background()))
+	}()
+
+	return c.Result()
+}
@@ -0,0 +1,181 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/pkg/drain"
+	"github.com/chihaya/chihaya/storage"
+	"github.com/chihaya/chihaya/storage/memory"
+)
+
+const apiKey = "secret"
+
+func newTestHandler(t *testing.T) (*Handler, storage.PeerStore) {
+	ps, err := memory.New(memory.Config{
+		ShardCount:                  4,
+		GarbageCollectionInterval:   10 * time.Minute,
+		PrometheusReportingInterval: 10 * time.Minute,
+		PeerLifetime:                30 * time.Minute,
+	})
+	require.Nil(t, err)
+	t.Cleanup(func() { require.Nil(t, <-ps.Stop()) })
+	return NewHandler(ps, apiKey), ps
+}
+
+func do(h http.Handler, method, target, key string, v interface{}) int {
+	r := httptest.NewRequest(method, target, nil)
+	if key != "" {
+		r.Header.Set("Authorization", "Bearer "+key)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if v != nil {
+		_ = json.NewDecoder(w.Body).Decode(v)
+	}
+	return w.Code
+}
+
+func TestAuthorization(t *testing.T) {
+	h, _ := newTestHandler(t)
+
+	require.Equal(t, http.StatusUnauthorized, do(h, http.MethodGet, "/admin/swarms", "", nil))
+	require.Equal(t, http.StatusUnauthorized, do(h, http.MethodGet, "/admin/swarms", "wrong", nil))
+	require.Equal(t, http.StatusOK, do(h, http.MethodGet, "/admin/swarms", apiKey, nil))
+	require.Equal(t, http.StatusNotFound, do(h, http.MethodGet, "/admin/unknown", apiKey, nil))
+}
+
+func TestClear(t *testing.T) {
+	h, ps := newTestHandler(t)
+
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	require.Nil(t, ps.PutSeeder(ih, bittorrent.Peer{ID: bittorrent.PeerIDFromString("99999999999999999991"), IP: bittorrent.IP{IP: net.ParseIP("1.1.1.1").To4(), AddressFamily: bittorrent.IPv4}, Port: 1}))
+	require.Equal(t, http.StatusNoContent, do(h, http.MethodDelete, "/admin/swarms", apiKey, nil))
+	require.Equal(t, bittorrent.Scrape{InfoHash: ih}, ps.ScrapeSwarm(ih, bittorrent.IPv4))
+
+	// Storages that cannot be cleared don't implement Clear.
+	h = NewHandler(struct{ storage.PeerStore }{ps}, apiKey)
+	require.Equal(t, http.StatusNotImplemented, do(h, http.MethodDelete, "/admin/swarms", apiKey, nil))
+}
+
+func TestSwarms(t *testing.T) {
+	h, ps := newTestHandler(t)
+
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	seeder := bittorrent.Peer{ID: bittorrent.PeerIDFromString("99999999999999999991"), IP: bittorrent.IP{IP: net.ParseIP("1.1.1.1").To4(), AddressFamily: bittorrent.IPv4}, Port: 1}
+	leecher := bittorrent.Peer{ID: bittorrent.PeerIDFromString("99999999999999999992"), IP: bittorrent.IP{IP: net.ParseIP("fc00::1"), AddressFamily: bittorrent.IPv6}, Port: 2}
+	require.Nil(t, ps.PutSeeder(ih, seeder))
+	require.Nil(t, ps.PutLeecher(ih, leecher))
+
+	var list listResponse
+	require.Equal(t, http.StatusOK, do(h, http.MethodGet, "/admin/swarms?family=IPv4", apiKey, &list))
+	require.Equal(t, listResponse{Swarms: []swarmSummary{{InfoHash: ih.String(), Seeders: 1}}}, list)
+	require.Equal(t, http.StatusBadRequest, do(h, http.MethodGet, "/admin/swarms?cursor=invalid", apiKey, nil))
+
+	var swarm swarmResponse
+	require.Equal(t, http.StatusOK, do(h, http.MethodGet, "/admin/swarms/"+ih.String(), apiKey, &swarm))
+	require.Equal(t, swarmResponse{
+		InfoHash:   ih.String(),
+		Complete:   1,
+		Incomplete: 1,
+		Seeders:    []peer{{ID: seeder.ID.String(), IP: "1.1.1.1", Port: 1}},
+		Leechers:   []peer{{ID: leecher.ID.String(), IP: "fc00::1", Port: 2}},
+	}, swarm)
+
+	var deleted deleteResponse
+	target := "/admin/swarms/" + ih.String() + "/peers?id=" + leecher.ID.String() + "&ip=fc00::1&port=2"
+	require.Equal(t, http.StatusOK, do(h, http.MethodDelete, target, apiKey, &deleted))
+	require.Equal(t, 1, deleted.Deleted)
+	require.Equal(t, http.StatusNotFound, do(h, http.MethodDelete, target, apiKey, nil))
+
+	require.Equal(t, http.StatusOK, do(h, http.MethodDelete, "/admin/swarms/"+ih.String(), apiKey, &deleted))
+	require.Equal(t, 1, deleted.Deleted)
+	require.Equal(t, http.StatusNotFound, do(h, http.MethodGet, "/admin/swarms/"+ih.String(), apiKey, nil))
+	require.Equal(t, http.StatusBadRequest, do(h, http.MethodGet, "/admin/swarms/nothex", apiKey, nil))
+}
+
+// testList is a middleware.List of entries without validation, except that
+// "invalid" is invalid.
+type testList struct{ entries map[string]bool }
+
+func (l *testList) Add(entry string) error {
+	if entry == "invalid" {
+		return errors.New("invalid entry")
+	}
+	l.entries[entry] = true
+	return nil
+}
+
+func (l *testList) Remove(entry string) bool {
+	ok := l.entries[entry]
+	delete(l.entries, entry)
+	return ok
+}
+
+func (l *testList) Entries() []string {
+	entries := []string{}
+	for entry := range l.entries {
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func init() {
+	middleware.RegisterList("test", &testList{entries: make(map[string]bool)})
+}
+
+func TestLists(t *testing.T) {
+	h, _ := newTestHandler(t)
+
+	var lists listsResponse
+	require.Equal(t, http.StatusOK, do(h, http.MethodGet, "/admin/lists", apiKey, &lists))
+	require.Contains(t, lists.Lists, "test")
+
+	require.Equal(t, http.StatusNoContent, do(h, http.MethodPost, "/admin/lists/test?entry=10.0.0.0%2F8", apiKey, nil))
+	require.Equal(t, http.StatusBadRequest, do(h, http.MethodPost, "/admin/lists/test?entry=invalid", apiKey, nil))
+	require.Equal(t, http.StatusBadRequest, do(h, http.MethodPost, "/admin/lists/test", apiKey, nil))
+	require.Equal(t, http.StatusNotFound, do(h, http.MethodPost, "/admin/lists/unknown?entry=a", apiKey, nil))
+
+	var entries entriesResponse
+	require.Equal(t, http.StatusOK, do(h, http.MethodGet, "/admin/lists/test", apiKey, &entries))
+	require.Equal(t, entriesResponse{Name: "test", Entries: []string{"10.0.0.0/8"}}, entries)
+
+	require.Equal(t, http.StatusNoContent, do(h, http.MethodDelete, "/admin/lists/test?entry=10.0.0.0%2F8", apiKey, nil))
+	require.Equal(t, http.StatusNotFound, do(h, http.MethodDelete, "/admin/lists/test?entry=10.0.0.0%2F8", apiKey, nil))
+}
+
+func TestCollectGarbage(t *testing.T) {
+	h, _ := newTestHandler(t)
+	require.Equal(t, http.StatusNoContent, do(h, http.MethodPost, "/admin/gc", apiKey, nil))
+	require.Equal(t, http.StatusNotFound, do(h, http.MethodGet, "/admin/gc", apiKey, nil))
+}
+
+func TestDrain(t *testing.T) {
+	h, _ := newTestHandler(t)
+	tracker, instance := drain.NewState(""), drain.NewState("a")
+	defer tracker.Close()
+	defer instance.Close()
+
+	var resp drainResponse
+	require.Equal(t, http.StatusOK, do(h, http.MethodGet, "/admin/drain", apiKey, &resp))
+	require.Equal(t, drainResponse{Instances: []instanceDrain{{}, {Name: "a"}}}, resp)
+
+	// Instances drain on their own.
+	require.Equal(t, http.StatusNotFound, do(h, http.MethodPost, "/admin/drain?instance=b", apiKey, nil))
+	require.Equal(t, http.StatusAccepted, do(h, http.MethodPost, "/admin/drain?instance=a", apiKey, &resp))
+	require.Equal(t, drainResponse{Instances: []instanceDrain{{}, {Name: "a", Draining: true}}}, resp)
+	require.False(t, drain.Draining())
+
+	require.Equal(t, http.StatusAccepted, do(h, http.MethodPost, "/admin/drain", apiKey, &resp))
+	require.Equal(t, drainResponse{Draining: true, Instances: []instanceDrain{{Draining: true}, {Name: "a", Draining: true}}}, resp)
+	require.True(t, drain.Draining())
+}
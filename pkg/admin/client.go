@@ -0,0 +1,111 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client is a client of the admin API.
+type Client struct {
+	baseURL string
+	apiKey  string
+	client  *http.Client
+}
+
+// NewClient creates a Client of the API served at the base URL, e.g.
+// "http://127.0.0.1:6880" if the API is mounted on the metrics server.
+func NewClient(baseURL, apiKey string) *Client {
+	return &Client{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		apiKey:  apiKey,
+		client:  &http.Client{Timeout: time.Minute},
+	}
+}
+
+// Do sends a request to a route of the API, e.g. "swarms/<infohash>", and
+// returns the JSON body of the response, which is empty for responses without
+// content. Errors responded by the API are returned as errors.
+func (c *Client) Do(ctx context.Context, method, route string, query url.Values) (json.RawMessage, error) {
+	u := c.baseURL + Prefix + route
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.apiKey)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		var errResp errorResponse
+		if json.Unmarshal(body, &errResp) == nil && errResp.Error != "" {
+			return nil, errors.New(errResp.Error)
+		}
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return body, nil
+}
+
+// Swarm returns the counts and up to limit seeders and leechers of each
+// address family of a swarm.
+func (c *Client) Swarm(ctx context.Context, infoHash string, limit int) (json.RawMessage, error) {
+	return c.Do(ctx, http.MethodGet, "swarms/"+url.PathEscape(infoHash), url.Values{"limit": {strconv.Itoa(limit)}})
+}
+
+// CollectGarbage makes the storage collect garbage immediately.
+func (c *Client) CollectGarbage(ctx context.Context) error {
+	_, err := c.Do(ctx, http.MethodPost, "gc", nil)
+	return err
+}
+
+// Drain makes the tracker drain and shut down after the drain period.
+func (c *Client) Drain(ctx context.Context) error {
+	_, err := c.Do(ctx, http.MethodPost, "drain", nil)
+	return err
+}
+
+// DrainInstance makes an instance of the tracker drain, without shutting the
+// tracker down.
+func (c *Client) DrainInstance(ctx context.Context, name string) error {
+	_, err := c.Do(ctx, http.MethodPost, "drain", url.Values{"instance": {name}})
+	return err
+}
+
+// ListEntries returns the entries of a middleware list, or the names of all
+// lists if name is empty.
+func (c *Client) ListEntries(ctx context.Context, name string) (json.RawMessage, error) {
+	if name == "" {
+		return c.Do(ctx, http.MethodGet, "lists", nil)
+	}
+	return c.Do(ctx, http.MethodGet, "lists/"+url.PathEscape(name), nil)
+}
+
+// AddListEntry adds an entry to a middleware list.
+func (c *Client) AddListEntry(ctx context.Context, name, entry string) error {
+	_, err := c.Do(ctx, http.MethodPost, "lists/"+url.PathEscape(name), url.Values{"entry": {entry}})
+	return err
+}
+
+// RemoveListEntry removes an entry from a middleware list.
+func (c *Client) RemoveListEntry(ctx context.Context, name, entry string) error {
+	_, err := c.Do(ctx, http.MethodDelete, "lists/"+url.PathEscape(name), url.Values{"entry": {entry}})
+	return err
+}
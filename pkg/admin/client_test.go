@@ -0,0 +1,38 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+func TestClient(t *testing.T) {
+	h, ps := newTestHandler(t)
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	ctx := context.Background()
+
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	require.Nil(t, ps.PutSeeder(ih, bittorrent.Peer{ID: bittorrent.PeerIDFromString("99999999999999999991"), IP: bittorrent.IP{IP: []byte{1, 1, 1, 1}, AddressFamily: bittorrent.IPv4}, Port: 1}))
+
+	c := NewClient(srv.URL+"/", apiKey)
+	body, err := c.Swarm(ctx, ih.String(), 10)
+	require.Nil(t, err)
+	var swarm swarmResponse
+	require.Nil(t, json.Unmarshal(body, &swarm))
+	require.Equal(t, uint32(1), swarm.Complete)
+
+	require.Nil(t, c.CollectGarbage(ctx))
+	require.Nil(t, c.AddListEntry(ctx, "test", "client"))
+	require.Nil(t, c.RemoveListEntry(ctx, "test", "client"))
+
+	// Errors of the API are returned with their message.
+	require.EqualError(t, c.RemoveListEntry(ctx, "test", "client"), "entry not found")
+	_, err = NewClient(srv.URL, "wrong").ListEntries(ctx, "")
+	require.EqualError(t, err, "invalid API key")
+}
@@ -0,0 +1,231 @@
+// Package drain implements the drain mode of Chihaya, in which the tracker
+// keeps answering announces, but with an elevated interval, and stops creating
+// swarms, before it shuts down after the drain period. Taking an instance out
+// of a load balancer this way moves its clients to other instances gradually
+// instead of cutting them off.
+//
+// Every tracker of the process has a State of its own, which survives reloads.
+// A tracker can be drained on its own, while draining the process drains all
+// trackers and shuts the process down after the drain period. Neither can be
+// left once it started.
+package drain
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/chihaya/chihaya/pkg/log"
+)
+
+func init() {
+	prometheus.MustRegister(promDraining)
+	current.Store(Config{Period: defaultPeriod, AnnounceInterval: defaultAnnounceInterval})
+}
+
+var promDraining = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "chihaya_draining",
+	Help: "Whether the tracker is draining before it shuts down",
+})
+
+// Default config constants.
+const (
+	defaultPeriod           = 5 * time.Minute
+	defaultAnnounceInterval = time.Hour
+)
+
+// Config represents the configuration of the drain mode.
+type Config struct {
+	// Period is the time between the start of draining and the shutdown.
+	Period time.Duration `yaml:"period"`
+
+	// AnnounceInterval is the minimum interval of announce responses while
+	// draining. It should exceed Period, so that clients announce to other
+	// instances next.
+	AnnounceInterval time.Duration `yaml:"announce_interval"`
+}
+
+// LogFields renders the current config as a set of Logrus fields.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"period":           cfg.Period,
+		"announceInterval": cfg.AnnounceInterval,
+	}
+}
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+//
+// This function warns to the logger when a value is changed.
+func (cfg Config) Validate() Config {
+	validcfg := cfg
+
+	if cfg.Period <= 0 {
+		validcfg.Period = defaultPeriod
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     "drain.Period",
+			"provided": cfg.Period,
+			"default":  validcfg.Period,
+		})
+	}
+
+	if cfg.AnnounceInterval <= 0 {
+		validcfg.AnnounceInterval = defaultAnnounceInterval
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     "drain.AnnounceInterval",
+			"provided": cfg.AnnounceInterval,
+			"default":  validcfg.AnnounceInterval,
+		})
+	}
+
+	return validcfg
+}
+
+var (
+	// current holds the validated Config.
+	current atomic.Value
+
+	// statesMu guards states and draining.
+	statesMu sync.Mutex
+	// states are the registered States, in the order of their creation.
+	states []*State
+	// draining is set once the process started draining. It is written
+	// while holding statesMu and read atomically.
+	draining int32
+
+	startOnce sync.Once
+	started   = make(chan struct{})
+)
+
+// Configure sets the configuration used by Start. It does not change the
+// configuration of a drain that already started.
+func Configure(cfg Config) {
+	current.Store(cfg.Validate())
+}
+
+// CurrentConfig returns the validated configuration set by Configure.
+func CurrentConfig() Config {
+	return current.Load().(Config)
+}
+
+// Start starts draining the process with the current configuration and
+// reports whether draining was started by this call.
+//
+// This starts draining every registered State, as well as those created
+// afterwards.
+func Start() bool {
+	first := false
+	startOnce.Do(func() {
+		cfg := CurrentConfig()
+		log.Info("starting to drain", cfg)
+		promDraining.Set(1)
+
+		statesMu.Lock()
+		atomic.StoreInt32(&draining, 1)
+		for _, s := range states {
+			s.start(cfg)
+		}
+		statesMu.Unlock()
+
+		close(started)
+		first = true
+	})
+	return first
+}
+
+// Draining reports whether the process is draining.
+func Draining() bool {
+	return atomic.LoadInt32(&draining) != 0
+}
+
+// Started returns a channel that is closed when the process starts draining.
+func Started() <-chan struct{} {
+	return started
+}
+
+// State is the drain state of a tracker. A tracker drains when it is
+// drained on its own by its Start method, or when the process drains.
+//
+// A nil State never drains.
+type State struct {
+	name string
+
+	// announceInterval is the announce interval in nanoseconds while
+	// draining, or zero. It is accessed atomically.
+	announceInterval int64
+
+	startOnce sync.Once
+}
+
+// NewState creates and registers the State of the tracker with the given
+// name, which drains right away if the process is draining.
+//
+// The State must be closed once the tracker is stopped.
+func NewState(name string) *State {
+	s := &State{name: name}
+
+	statesMu.Lock()
+	defer statesMu.Unlock()
+	states = append(states, s)
+	if Draining() {
+		s.start(CurrentConfig())
+	}
+	return s
+}
+
+// States returns the registered States, in the order of their creation.
+func States() []*State {
+	statesMu.Lock()
+	defer statesMu.Unlock()
+	return append([]*State(nil), states...)
+}
+
+// Close unregisters the State.
+func (s *State) Close() {
+	statesMu.Lock()
+	defer statesMu.Unlock()
+	for i, registered := range states {
+		if registered == s {
+			states = append(states[:i], states[i+1:]...)
+			return
+		}
+	}
+}
+
+// Name returns the name of the tracker of the State.
+func (s *State) Name() string {
+	return s.name
+}
+
+// Start starts draining the tracker with the current configuration, without
+// draining the process, and reports whether draining was started by this
+// call.
+func (s *State) Start() bool {
+	return s.start(CurrentConfig())
+}
+
+func (s *State) start(cfg Config) bool {
+	first := false
+	s.startOnce.Do(func() {
+		log.Info("starting to drain tracker", log.Fields{"instance": s.name, "announceInterval": cfg.AnnounceInterval})
+		atomic.StoreInt64(&s.announceInterval, int64(cfg.AnnounceInterval))
+		first = true
+	})
+	return first
+}
+
+// Draining reports whether the tracker is draining.
+func (s *State) Draining() bool {
+	return s.AnnounceInterval() > 0
+}
+
+// AnnounceInterval returns the minimum interval of announce responses while
+// the tracker is draining, or zero if it is not draining.
+func (s *State) AnnounceInterval() time.Duration {
+	if s == nil {
+		return 0
+	}
+	return time.Duration(atomic.LoadInt64(&s.announceInterval))
+}
@@ -0,0 +1,51 @@
+package drain
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDrain(t *testing.T) {
+	var unset *State
+	require.False(t, unset.Draining())
+
+	a, b := NewState("a"), NewState("b")
+	defer a.Close()
+	defer b.Close()
+	require.Equal(t, []*State{a, b}, States())
+
+	// A tracker drains on its own.
+	require.True(t, a.Start())
+	require.False(t, a.Start())
+	require.True(t, a.Draining())
+	require.Equal(t, defaultAnnounceInterval, a.AnnounceInterval())
+	require.False(t, b.Draining())
+	require.False(t, Draining())
+	select {
+	case <-Started():
+		t.Fatal("started before Start")
+	default:
+	}
+
+	// Draining the process drains all trackers, including those created
+	// afterwards, with the configuration at the time draining started.
+	Configure(Config{Period: time.Minute})
+	require.Equal(t, Config{Period: time.Minute, AnnounceInterval: defaultAnnounceInterval}, CurrentConfig())
+
+	require.True(t, Start())
+	require.True(t, Draining())
+	require.True(t, b.Draining())
+	<-Started()
+
+	c := NewState("c")
+	require.True(t, c.Draining())
+	c.Close()
+	require.Equal(t, []*State{a, b}, States())
+
+	// Draining cannot be restarted with another configuration.
+	Configure(Config{Period: time.Minute, AnnounceInterval: 2 * time.Hour})
+	require.False(t, Start())
+	require.Equal(t, defaultAnnounceInterval, b.AnnounceInterval())
+}
@@ -0,0 +1,365 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Level is the severity of a log entry.
+type Level int
+
+// The levels of log entries, in increasing severity.
+const (
+	DebugLevel Level = iota
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+	FatalLevel
+)
+
+// String returns the name of the level.
+func (lvl Level) String() string {
+	switch lvl {
+	case DebugLevel:
+		return "debug"
+	case InfoLevel:
+		return "info"
+	case WarnLevel:
+		return "warning"
+	case ErrorLevel:
+		return "error"
+	case FatalLevel:
+		return "fatal"
+	default:
+		return "unknown"
+	}
+}
+
+// Backend writes log entries.
+//
+// Entries are filtered and sampled before they are passed to a Backend, so a
+// Backend writes every entry it receives.
+type Backend interface {
+	// Log writes an entry. It must be safe for concurrent use.
+	Log(level Level, msg string, fields Fields)
+
+	// Sync flushes buffered entries.
+	Sync()
+}
+
+// BackendConfig is the configuration passed to a Backend when it is created.
+type BackendConfig struct {
+	// Out is where the entries are written to.
+	Out io.Writer
+
+	// JSON selects JSON lines instead of human-readable text.
+	JSON bool
+}
+
+// NewBackendFunc creates a Backend.
+type NewBackendFunc func(BackendConfig) (Backend, error)
+
+var (
+	backendsM sync.RWMutex
+	backends  = map[string]NewBackendFunc{"logrus": newLogrusBackend}
+)
+
+// RegisterBackend makes a Backend available by the provided name.
+//
+// If called twice with the same name, the name is blank, or if the provided
+// function is nil, this function panics.
+func RegisterBackend(name string, f NewBackendFunc) {
+	if name == "" {
+		panic("log: could not register a Backend with an empty name")
+	}
+	if f == nil {
+		panic("log: could not register a nil Backend")
+	}
+
+	backendsM.Lock()
+	defer backendsM.Unlock()
+
+	if _, dup := backends[name]; dup {
+		panic("log: RegisterBackend called twice for " + name)
+	}
+
+	backends[name] = f
+}
+
+// Default config constants.
+const (
+	defaultBackend          = "logrus"
+	defaultSamplingInterval = time.Second
+)
+
+// Config represents the configuration of the logger.
+type Config struct {
+	// Backend is the name of a registered Backend: logrus, zap or zerolog.
+	Backend string `yaml:"backend"`
+
+	// Format is either "text" or "json". If it is empty, the format chosen
+	// on the command line is kept.
+	Format string `yaml:"format"`
+
+	// Outputs are the sinks the entries are written to, each being "stderr",
+	// "stdout" or the path of a file to append to. All entries are written
+	// to stderr if none are configured.
+	Outputs []string `yaml:"outputs"`
+
+	// DebugSampling limits the debug lines written per message.
+	DebugSampling SamplingConfig `yaml:"debug_sampling"`
+}
+
+// SamplingConfig represents the sampling of log entries. Entries with the
+// same message are counted per interval: the first ones are written, and of
+// the following ones every thereafter-th.
+type SamplingConfig struct {
+	Interval   time.Duration `yaml:"interval"`
+	First      int           `yaml:"first"`
+	Thereafter int           `yaml:"thereafter"`
+}
+
+// Enabled reports whether entries are sampled.
+func (cfg SamplingConfig) Enabled() bool {
+	return cfg.First > 0 || cfg.Thereafter > 0
+}
+
+// LogFields renders the current config as a set of Logrus fields.
+func (cfg Config) LogFields() Fields {
+	return Fields{
+		"backend":                 cfg.Backend,
+		"format":                  cfg.Format,
+		"outputs":                 cfg.Outputs,
+		"debugSamplingInterval":   cfg.DebugSampling.Interval,
+		"debugSamplingFirst":      cfg.DebugSampling.First,
+		"debugSamplingThereafter": cfg.DebugSampling.Thereafter,
+	}
+}
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+//
+// This function warns to the logger when a value is changed.
+func (cfg Config) Validate() Config {
+	validcfg := cfg
+
+	if cfg.Backend == "" {
+		validcfg.Backend = defaultBackend
+	}
+
+	if cfg.Format != "" && cfg.Format != "text" && cfg.Format != "json" {
+		validcfg.Format = ""
+		Warn("falling back to default configuration", Fields{
+			"name":     "log.Format",
+			"provided": cfg.Format,
+			"default":  validcfg.Format,
+		})
+	}
+
+	if cfg.DebugSampling.Enabled() && cfg.DebugSampling.Interval <= 0 {
+		validcfg.DebugSampling.Interval = defaultSamplingInterval
+		Warn("falling back to default configuration", Fields{
+			"name":     "log.DebugSampling.Interval",
+			"provided": cfg.DebugSampling.Interval,
+			"default":  validcfg.DebugSampling.Interval,
+		})
+	}
+
+	return validcfg
+}
+
+// Check reports errors of the config that Configure would fail on, without
+// opening the outputs.
+func (cfg Config) Check() error {
+	cfg = cfg.Validate()
+
+	backendsM.RLock()
+	_, ok := backends[cfg.Backend]
+	backendsM.RUnlock()
+	if !ok {
+		return fmt.Errorf("unknown log backend %q", cfg.Backend)
+	}
+
+	for _, output := range cfg.Outputs {
+		if output == "" {
+			return errors.New("empty log output")
+		}
+	}
+	return nil
+}
+
+// Configure replaces the logger by one with the backend, format, outputs and
+// sampling of the config.
+//
+// The outputs of the previous logger are closed. The level is controlled by
+// SetDebug independently.
+func Configure(cfg Config) error {
+	cfg = cfg.Validate()
+
+	backendsM.RLock()
+	newBackend, ok := backends[cfg.Backend]
+	backendsM.RUnlock()
+	if !ok {
+		return fmt.Errorf("unknown log backend %q", cfg.Backend)
+	}
+
+	configureMu.Lock()
+	defer configureMu.Unlock()
+
+	out, closers, err := openOutputs(cfg.Outputs)
+	if err != nil {
+		return err
+	}
+
+	bcfg := BackendConfig{Out: out, JSON: cfg.Format == "json"}
+	if cfg.Format == "" {
+		_, bcfg.JSON = l.Formatter.(*logrus.JSONFormatter)
+	}
+	b, err := newBackend(bcfg)
+	if err != nil {
+		closeOutputs(closers)
+		return err
+	}
+
+	lg := &logger{backend: b, outputs: closers}
+	if cfg.DebugSampling.Enabled() {
+		lg.sampler = newSampler(cfg.DebugSampling)
+	}
+
+	previous := current.Load().(*logger)
+	current.Store(lg)
+	previous.backend.Sync()
+	closeOutputs(previous.outputs)
+	return nil
+}
+
+// openOutputs opens the outputs and returns a writer writing to all of them
+// and the files to close once they are no longer used.
+func openOutputs(outputs []string) (io.Writer, []io.Closer, error) {
+	if len(outputs) == 0 {
+		return os.Stderr, nil, nil
+	}
+
+	var writers []io.Writer
+	var closers []io.Closer
+	for _, output := range outputs {
+		switch output {
+		case "":
+			closeOutputs(closers)
+			return nil, nil, errors.New("empty log output")
+		case "stderr":
+			writers = append(writers, os.Stderr)
+		case "stdout":
+			writers = append(writers, os.Stdout)
+		default:
+			f, err := os.OpenFile(output, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+			if err != nil {
+				closeOutputs(closers)
+				return nil, nil, err
+			}
+			writers = append(writers, f)
+			closers = append(closers, f)
+		}
+	}
+
+	if len(writers) == 1 {
+		return writers[0], closers, nil
+	}
+	return multiWriter(writers), closers, nil
+}
+
+// multiWriter writes to all of its writers. Unlike io.MultiWriter, it keeps
+// writing to the others if one fails, so that a full disk does not silence
+// stderr.
+type multiWriter []io.Writer
+
+func (mw multiWriter) Write(p []byte) (int, error) {
+	var firstErr error
+	for _, w := range mw {
+		if _, err := w.Write(p); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return len(p), firstErr
+}
+
+func closeOutputs(closers []io.Closer) {
+	for _, c := range closers {
+		c.Close()
+	}
+}
+
+// sampler decides which entries are written by counting the entries with the
+// same message per interval.
+type sampler struct {
+	cfg SamplingConfig
+
+	mu     sync.Mutex
+	start  time.Time
+	counts map[string]int
+}
+
+func newSampler(cfg SamplingConfig) *sampler {
+	return &sampler{cfg: cfg, start: time.Now(), counts: make(map[string]int)}
+}
+
+// sample reports whether an entry with the message is written.
+func (s *sampler) sample(msg string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now := time.Now(); now.Sub(s.start) >= s.cfg.Interval {
+		s.start = now
+		s.counts = make(map[string]int)
+	}
+
+	n := s.counts[msg] + 1
+	s.counts[msg] = n
+	if n <= s.cfg.First {
+		return true
+	}
+	return s.cfg.Thereafter > 0 && (n-s.cfg.First)%s.cfg.Thereafter == 0
+}
+
+// logrusBackend is a Backend writing to a logrus.Logger.
+type logrusBackend struct {
+	l *logrus.Logger
+}
+
+func newLogrusBackend(cfg BackendConfig) (Backend, error) {
+	lg := logrus.New()
+	lg.Out = cfg.Out
+	lg.Level = logrus.DebugLevel
+	if cfg.JSON {
+		lg.Formatter = &logrus.JSONFormatter{}
+	} else if _, json := l.Formatter.(*logrus.JSONFormatter); !json {
+		// Keep text options chosen on the command line, such as disabled
+		// colors.
+		lg.Formatter = l.Formatter
+	}
+	return logrusBackend{lg}, nil
+}
+
+var logrusLevels = map[Level]logrus.Level{
+	DebugLevel: logrus.DebugLevel,
+	InfoLevel:  logrus.InfoLevel,
+	WarnLevel:  logrus.WarnLevel,
+	ErrorLevel: logrus.ErrorLevel,
+	FatalLevel: logrus.FatalLevel,
+}
+
+func (b logrusBackend) Log(level Level, msg string, fields Fields) {
+	if len(fields) != 0 {
+		b.l.WithFields(logrus.Fields(fields)).Log(logrusLevels[level], msg)
+	} else {
+		b.l.Log(logrusLevels[level], msg)
+	}
+}
+
+func (b logrusBackend) Sync() {}
@@ -1,10 +1,13 @@
-// Package log adds a thin wrapper around logrus to improve non-debug logging
-// performance.
+// Package log adds a thin wrapper around a logging backend, logrus by
+// default, to improve non-debug logging performance.
 package log
 
 import (
 	"fmt"
 	"io"
+	"os"
+	"sync"
+	"sync/atomic"
 
 	"github.com/sirupsen/logrus"
 )
@@ -12,20 +15,41 @@ import (
 var (
 	l     = logrus.New()
 	debug = false
+
+	// current holds the *logger that entries are written to.
+	current atomic.Value
+
+	// configureMu serializes changes of the logger.
+	configureMu sync.Mutex
 )
 
+func init() {
+	current.Store(&logger{backend: logrusBackend{l}})
+}
+
+// logger is a backend with the outputs it writes to and the sampler of its
+// debug lines.
+type logger struct {
+	backend Backend
+	sampler *sampler
+	outputs []io.Closer
+}
+
 // SetDebug controls debug logging.
 func SetDebug(to bool) {
 	debug = to
 	l.Level = logrus.DebugLevel
 }
 
-// SetFormatter sets the formatter.
+// SetFormatter sets the formatter of the default logrus backend, which is
+// used until Configure is called. Configure keeps a JSON formatter and the
+// options of a text formatter unless the config sets the format.
 func SetFormatter(to logrus.Formatter) {
 	l.Formatter = to
 }
 
-// SetOutput sets the output.
+// SetOutput sets the output of the default logrus backend, which is used until
+// Configure is called.
 func SetOutput(to io.Writer) {
 	l.Out = to
 }
@@ -64,10 +88,8 @@ func Err(e error) Fielder {
 // mergeFielders merges the Fields of multiple Fielders.
 // Fields from the first Fielder will be used unchanged, Fields from subsequent
 // Fielders will be prefixed with "%d.", starting from 1.
-//
-// must be called with len(fielders) > 0
-func mergeFielders(fielders ...Fielder) logrus.Fields {
-	if fielders[0] == nil {
+func mergeFielders(fielders ...Fielder) Fields {
+	if len(fielders) == 0 || fielders[0] == nil {
 		return nil
 	}
 
@@ -83,52 +105,44 @@ func mergeFielders(fielders ...Fielder) logrus.Fields {
 		}
 	}
 
-	return logrus.Fields(fields)
+	return fields
+}
+
+// write passes an entry to the current backend.
+func write(level Level, v interface{}, fielders []Fielder) {
+	lg := current.Load().(*logger)
+	msg := fmt.Sprint(v)
+	if level == DebugLevel && lg.sampler != nil && !lg.sampler.sample(msg) {
+		return
+	}
+	lg.backend.Log(level, msg, mergeFielders(fielders...))
 }
 
 // Debug logs at the debug level if debug logging is enabled.
 func Debug(v interface{}, fielders ...Fielder) {
 	if debug {
-		if len(fielders) != 0 {
-			l.WithFields(mergeFielders(fielders...)).Debug(v)
-		} else {
-			l.Debug(v)
-		}
+		write(DebugLevel, v, fielders)
 	}
 }
 
 // Info logs at the info level.
 func Info(v interface{}, fielders ...Fielder) {
-	if len(fielders) != 0 {
-		l.WithFields(mergeFielders(fielders...)).Info(v)
-	} else {
-		l.Info(v)
-	}
+	write(InfoLevel, v, fielders)
 }
 
 // Warn logs at the warning level.
 func Warn(v interface{}, fielders ...Fielder) {
-	if len(fielders) != 0 {
-		l.WithFields(mergeFielders(fielders...)).Warn(v)
-	} else {
-		l.Warn(v)
-	}
+	write(WarnLevel, v, fielders)
 }
 
 // Error logs at the error level.
 func Error(v interface{}, fielders ...Fielder) {
-	if len(fielders) != 0 {
-		l.WithFields(mergeFielders(fielders...)).Error(v)
-	} else {
-		l.Error(v)
-	}
+	write(ErrorLevel, v, fielders)
 }
 
 // Fatal logs at the fatal level and exits with a status code != 0.
 func Fatal(v interface{}, fielders ...Fielder) {
-	if len(fielders) != 0 {
-		l.WithFields(mergeFielders(fielders...)).Fatal(v)
-	} else {
-		l.Fatal(v)
-	}
+	write(FatalLevel, v, fielders)
+	current.Load().(*logger).backend.Sync()
+	os.Exit(1)
 }
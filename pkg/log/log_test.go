@@ -0,0 +1,59 @@
+package log
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSampler(t *testing.T) {
+	s := newSampler(SamplingConfig{Interval: time.Hour, First: 2, Thereafter: 3})
+
+	var sampled []int
+	for i := 1; i <= 10; i++ {
+		if s.sample("a") {
+			sampled = append(sampled, i)
+		}
+	}
+	require.Equal(t, []int{1, 2, 5, 8}, sampled)
+
+	// Messages are counted separately.
+	require.True(t, s.sample("b"))
+}
+
+func TestConfigure(t *testing.T) {
+	dir := t.TempDir()
+	paths := []string{filepath.Join(dir, "a.log"), filepath.Join(dir, "b.log")}
+	defer func() {
+		require.Nil(t, Configure(Config{}))
+		SetDebug(false)
+	}()
+
+	require.Nil(t, Configure(Config{
+		Format:        "json",
+		Outputs:       paths,
+		DebugSampling: SamplingConfig{First: 1},
+	}))
+	SetDebug(true)
+	Info("hello", Fields{"key": "value"})
+	Debug("sampled")
+	Debug("sampled")
+
+	for _, path := range paths {
+		b, err := os.ReadFile(path)
+		require.Nil(t, err)
+		lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+		require.Len(t, lines, 2, path)
+		require.Contains(t, lines[0], `"key":"value"`)
+		require.Contains(t, lines[0], `"msg":"hello"`)
+		require.Contains(t, lines[1], `"msg":"sampled"`)
+	}
+
+	require.NotNil(t, Configure(Config{Backend: "unknown"}))
+	require.NotNil(t, Config{Backend: "unknown"}.Check())
+	require.NotNil(t, Config{Outputs: []string{""}}.Check())
+}
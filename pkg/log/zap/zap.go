@@ -0,0 +1,61 @@
+// Package zap implements a logging backend writing with zap.
+package zap
+
+import (
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/chihaya/chihaya/pkg/log"
+)
+
+// Name is the name by which this backend is registered with Chihaya.
+const Name = "zap"
+
+func init() {
+	log.RegisterBackend(Name, New)
+}
+
+var levels = map[log.Level]zapcore.Level{
+	log.DebugLevel: zapcore.DebugLevel,
+	log.InfoLevel:  zapcore.InfoLevel,
+	log.WarnLevel:  zapcore.WarnLevel,
+	log.ErrorLevel: zapcore.ErrorLevel,
+	log.FatalLevel: zapcore.FatalLevel,
+}
+
+type backend struct {
+	core zapcore.Core
+}
+
+// New creates a backend writing to cfg.Out with a JSON or console encoder.
+func New(cfg log.BackendConfig) (log.Backend, error) {
+	encoderCfg := zap.NewProductionEncoderConfig()
+	encoderCfg.EncodeTime = zapcore.ISO8601TimeEncoder
+	encoderCfg.EncodeDuration = zapcore.StringDurationEncoder
+	encoder := zapcore.NewJSONEncoder(encoderCfg)
+	if !cfg.JSON {
+		encoder = zapcore.NewConsoleEncoder(encoderCfg)
+	}
+
+	// Levels are filtered by package log.
+	core := zapcore.NewCore(encoder, zapcore.Lock(zapcore.AddSync(cfg.Out)), zapcore.DebugLevel)
+	return &backend{core: core}, nil
+}
+
+func (b *backend) Log(level log.Level, msg string, fields log.Fields) {
+	zapFields := make([]zapcore.Field, 0, len(fields))
+	for k, v := range fields {
+		zapFields = append(zapFields, zap.Any(k, v))
+	}
+
+	// The entry is written to the core directly, since a zap.Logger exits
+	// the process on fatal entries itself. Failed writes cannot be logged.
+	entry := zapcore.Entry{Level: levels[level], Time: time.Now(), Message: msg}
+	_ = b.core.Write(entry, zapFields)
+}
+
+func (b *backend) Sync() {
+	_ = b.core.Sync()
+}
@@ -0,0 +1,27 @@
+package zap
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/pkg/log"
+)
+
+func TestBackend(t *testing.T) {
+	var buf bytes.Buffer
+	b, err := New(log.BackendConfig{Out: &buf, JSON: true})
+	require.Nil(t, err)
+
+	b.Log(log.WarnLevel, "hello", log.Fields{"key": "value"})
+	b.Log(log.FatalLevel, "not exiting", nil)
+	b.Sync()
+
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	require.Len(t, lines, 2)
+	require.Contains(t, string(lines[0]), `"key":"value"`)
+	require.Contains(t, string(lines[0]), `"level":"warn"`)
+	require.Contains(t, string(lines[0]), "hello")
+	require.Contains(t, string(lines[1]), `"level":"fatal"`)
+}
@@ -0,0 +1,47 @@
+// Package zerolog implements a logging backend writing with zerolog.
+package zerolog
+
+import (
+	"github.com/rs/zerolog"
+
+	"github.com/chihaya/chihaya/pkg/log"
+)
+
+// Name is the name by which this backend is registered with Chihaya.
+const Name = "zerolog"
+
+func init() {
+	log.RegisterBackend(Name, New)
+}
+
+var levels = map[log.Level]zerolog.Level{
+	log.DebugLevel: zerolog.DebugLevel,
+	log.InfoLevel:  zerolog.InfoLevel,
+	log.WarnLevel:  zerolog.WarnLevel,
+	log.ErrorLevel: zerolog.ErrorLevel,
+	log.FatalLevel: zerolog.FatalLevel,
+}
+
+type backend struct {
+	l zerolog.Logger
+}
+
+// New creates a backend writing JSON lines or, unless cfg.JSON is set,
+// human-readable text to cfg.Out.
+func New(cfg log.BackendConfig) (log.Backend, error) {
+	out := cfg.Out
+	if !cfg.JSON {
+		out = zerolog.ConsoleWriter{Out: cfg.Out, NoColor: true}
+	}
+
+	// Levels are filtered by package log.
+	l := zerolog.New(zerolog.SyncWriter(out)).Level(zerolog.DebugLevel).With().Timestamp().Logger()
+	return &backend{l: l}, nil
+}
+
+func (b *backend) Log(level log.Level, msg string, fields log.Fields) {
+	// WithLevel does not exit the process on fatal entries, unlike Fatal.
+	b.l.WithLevel(levels[level]).Fields(map[string]interface{}(fields)).Msg(msg)
+}
+
+func (b *backend) Sync() {}
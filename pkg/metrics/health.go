@@ -0,0 +1,86 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Check reports whether a component of Chihaya is healthy, returning an
+// error describing the problem otherwise.
+type Check func(ctx context.Context) error
+
+// checkTimeout is the time all checks of a request must complete in.
+const checkTimeout = 5 * time.Second
+
+type namedCheck struct {
+	name      string
+	check     Check
+	readiness bool
+}
+
+// healthChecks are the checks of the /healthz and /readyz endpoints.
+type healthChecks struct {
+	mu     sync.RWMutex
+	checks []namedCheck
+}
+
+// AddHealthCheck adds a check to the /healthz and /readyz endpoints, e.g.
+// whether the storage is responsive.
+func (s *Server) AddHealthCheck(name string, check Check) {
+	s.health.add(namedCheck{name: name, check: check})
+}
+
+// AddReadinessCheck adds a check to the /readyz endpoint only, e.g. whether
+// the frontends are listening. Failing readiness checks take the instance out
+// of load balancing without restarting it.
+func (s *Server) AddReadinessCheck(name string, check Check) {
+	s.health.add(namedCheck{name: name, check: check, readiness: true})
+}
+
+func (hc *healthChecks) add(c namedCheck) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	hc.checks = append(hc.checks, c)
+}
+
+// handler serves the results of the checks, including the readiness checks
+// if readiness is set. It responds with 503 Service Unavailable if any check
+// fails.
+func (hc *healthChecks) handler(readiness bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), checkTimeout)
+		defer cancel()
+
+		hc.mu.RLock()
+		checks := hc.checks
+		hc.mu.RUnlock()
+
+		var b strings.Builder
+		failed := false
+		for _, c := range checks {
+			if c.readiness && !readiness {
+				continue
+			}
+			if err := c.check(ctx); err != nil {
+				failed = true
+				fmt.Fprintf(&b, "failed %s: %s\n", c.name, err)
+				continue
+			}
+			fmt.Fprintf(&b, "ok %s\n", c.name)
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		if failed {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			b.WriteString("unhealthy\n")
+		} else {
+			b.WriteString("healthy\n")
+		}
+		_, _ = w.Write([]byte(b.String()))
+	})
+}
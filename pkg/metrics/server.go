@@ -1,12 +1,14 @@
 // Package metrics implements a standalone HTTP server for serving pprof
-// profiles and Prometheus metrics.
+// profiles, Prometheus metrics and health checks.
 package metrics
 
 import (
 	"context"
+	"crypto/subtle"
 	"errors"
 	"net/http"
 	"net/http/pprof"
+	"strings"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -15,10 +17,29 @@ import (
 	"github.com/chihaya/chihaya/pkg/stop"
 )
 
+// PprofConfig represents the configuration of the pprof profiles served by a
+// Server.
+type PprofConfig struct {
+	// Disabled disables serving profiles.
+	Disabled bool `yaml:"disabled"`
+
+	// APIKey must be presented as a bearer token by requests for profiles, if
+	// it is set.
+	APIKey string `yaml:"api_key"`
+}
+
 // Server represents a standalone HTTP server for serving a Prometheus metrics
 // endpoint.
 type Server struct {
-	srv *http.Server
+	srv    *http.Server
+	mux    *http.ServeMux
+	health *healthChecks
+}
+
+// Handle registers a handler for the pattern on the server, next to the
+// metrics and profiles, for example to serve the admin API.
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
 }
 
 // Stop shuts down the server.
@@ -33,15 +54,19 @@ func (s *Server) Stop() stop.Result {
 
 // NewServer creates a new instance of a Prometheus server that asynchronously
 // serves requests.
-func NewServer(addr string) *Server {
+//
+// The server serves the results of its health checks under /healthz and
+// /readyz and, unless disabled, pprof profiles under /debug/pprof/.
+func NewServer(addr string, pprofCfg PprofConfig) *Server {
 	mux := http.NewServeMux()
 
+	health := &healthChecks{}
 	mux.Handle("/metrics", promhttp.Handler())
-	mux.HandleFunc("/debug/pprof/", pprof.Index)
-	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
-	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
-	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
-	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/healthz", health.handler(false))
+	mux.Handle("/readyz", health.handler(true))
+	if !pprofCfg.Disabled {
+		mux.Handle("/debug/pprof/", pprofHandler(pprofCfg.APIKey))
+	}
 
 	s := &Server{
 		srv: &http.Server{
@@ -49,6 +74,8 @@ func NewServer(addr string) *Server {
 			Handler:           mux,
 			ReadHeaderTimeout: time.Second * 60,
 		},
+		mux:    mux,
+		health: health,
 	}
 
 	go func() {
@@ -59,3 +86,28 @@ func NewServer(addr string) *Server {
 
 	return s
 }
+
+// pprofHandler serves the pprof profiles, which require the API key if it is
+// not empty.
+func pprofHandler(apiKey string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	if apiKey == "" {
+		return mux
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		const scheme = "Bearer "
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, scheme) || subtle.ConstantTimeCompare([]byte(auth[len(scheme):]), []byte(apiKey)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="chihaya"`)
+			http.Error(w, "invalid API key", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,56 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPprofHandler(t *testing.T) {
+	get := func(h http.Handler, auth string) int {
+		r := httptest.NewRequest(http.MethodGet, "/debug/pprof/cmdline", nil)
+		if auth != "" {
+			r.Header.Set("Authorization", auth)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	require.Equal(t, http.StatusOK, get(pprofHandler(""), ""))
+
+	h := pprofHandler("secret")
+	require.Equal(t, http.StatusUnauthorized, get(h, ""))
+	require.Equal(t, http.StatusUnauthorized, get(h, "Bearer wrong"))
+	require.Equal(t, http.StatusUnauthorized, get(h, "secret"))
+	require.Equal(t, http.StatusOK, get(h, "Bearer secret"))
+}
+
+func TestHealthChecks(t *testing.T) {
+	hc := &healthChecks{}
+	get := func(readiness bool) (int, string) {
+		w := httptest.NewRecorder()
+		hc.handler(readiness).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+		return w.Code, w.Body.String()
+	}
+
+	var ready error = errors.New("not listening")
+	hc.add(namedCheck{name: "storage", check: func(context.Context) error { return nil }})
+	hc.add(namedCheck{name: "frontends", check: func(context.Context) error { return ready }, readiness: true})
+
+	code, body := get(false)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "ok storage\nhealthy\n", body)
+
+	code, body = get(true)
+	require.Equal(t, http.StatusServiceUnavailable, code)
+	require.Equal(t, "ok storage\nfailed frontends: not listening\nunhealthy\n", body)
+
+	ready = nil
+	code, _ = get(true)
+	require.Equal(t, http.StatusOK, code)
+}
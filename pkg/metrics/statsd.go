@@ -0,0 +1,335 @@
+package metrics
+
+import (
+	"errors"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/pkg/stop"
+)
+
+// Flavors of the StatsD protocol.
+const (
+	// FlavorStatsD encodes labels as parts of the metric names.
+	FlavorStatsD = "statsd"
+
+	// FlavorDogStatsD sends labels as DogStatsD tags.
+	FlavorDogStatsD = "dogstatsd"
+)
+
+// StatsDConfig represents the configuration of a StatsDExporter.
+type StatsDConfig struct {
+	// Addr is the UDP address of the StatsD server. Metrics are not pushed
+	// to StatsD without one.
+	Addr string `yaml:"addr"`
+
+	// Flavor is either "statsd" or "dogstatsd".
+	Flavor string `yaml:"flavor"`
+
+	// Prefix is prepended to the names of all metrics.
+	Prefix string `yaml:"prefix"`
+
+	// FlushInterval is the interval at which metrics are pushed.
+	FlushInterval time.Duration `yaml:"flush_interval"`
+
+	// MaxPacketSize is the maximum size of the UDP packets sent.
+	MaxPacketSize int `yaml:"max_packet_size"`
+}
+
+// Enabled reports whether a StatsD server is configured.
+func (cfg StatsDConfig) Enabled() bool {
+	return cfg.Addr != ""
+}
+
+// LogFields renders the current config as a set of Logrus fields.
+func (cfg StatsDConfig) LogFields() log.Fields {
+	return log.Fields{
+		"addr":          cfg.Addr,
+		"flavor":        cfg.Flavor,
+		"prefix":        cfg.Prefix,
+		"flushInterval": cfg.FlushInterval,
+		"maxPacketSize": cfg.MaxPacketSize,
+	}
+}
+
+// Default config constants.
+const (
+	defaultStatsDFlavor        = FlavorStatsD
+	defaultStatsDFlushInterval = 10 * time.Second
+
+	// defaultStatsDMaxPacketSize fits into the MTU of most networks.
+	defaultStatsDMaxPacketSize = 1432
+)
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+//
+// This function warns to the logger when a value is changed.
+func (cfg StatsDConfig) Validate() StatsDConfig {
+	validcfg := cfg
+
+	if cfg.Flavor != FlavorStatsD && cfg.Flavor != FlavorDogStatsD {
+		validcfg.Flavor = defaultStatsDFlavor
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     "statsd.Flavor",
+			"provided": cfg.Flavor,
+			"default":  validcfg.Flavor,
+		})
+	}
+
+	if cfg.FlushInterval <= 0 {
+		validcfg.FlushInterval = defaultStatsDFlushInterval
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     "statsd.FlushInterval",
+			"provided": cfg.FlushInterval,
+			"default":  validcfg.FlushInterval,
+		})
+	}
+
+	if cfg.MaxPacketSize <= 0 {
+		validcfg.MaxPacketSize = defaultStatsDMaxPacketSize
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     "statsd.MaxPacketSize",
+			"provided": cfg.MaxPacketSize,
+			"default":  validcfg.MaxPacketSize,
+		})
+	}
+
+	return validcfg
+}
+
+// StatsDExporter periodically pushes the metrics of a Prometheus registry to a
+// StatsD server, for environments that don't scrape Prometheus.
+//
+// Counters are sent as the increase since the last push, gauges as their
+// value. Histograms and summaries are sent as counters of their count and
+// sum; histograms of seconds are additionally sent as a timer of their mean
+// duration since the last push, in milliseconds.
+type StatsDExporter struct {
+	cfg      StatsDConfig
+	gatherer prometheus.Gatherer
+	conn     net.Conn
+
+	// last holds the last values of counters, and of the counts and sums of
+	// histograms and summaries, by their encoded names.
+	last map[string]float64
+
+	closing chan struct{}
+	wg      sync.WaitGroup
+}
+
+// NewStatsDExporter creates a StatsDExporter pushing the metrics of the
+// gatherer, e.g. prometheus.DefaultGatherer.
+func NewStatsDExporter(provided StatsDConfig, gatherer prometheus.Gatherer) (*StatsDExporter, error) {
+	cfg := provided.Validate()
+	if cfg.Addr == "" {
+		return nil, errors.New("no StatsD address configured")
+	}
+
+	conn, err := net.Dial("udp", cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &StatsDExporter{
+		cfg:      cfg,
+		gatherer: gatherer,
+		conn:     conn,
+		last:     make(map[string]float64),
+		closing:  make(chan struct{}),
+	}
+
+	e.wg.Add(1)
+	go func() {
+		defer e.wg.Done()
+		t := time.NewTicker(cfg.FlushInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-e.closing:
+				e.flush()
+				return
+			case <-t.C:
+				e.flush()
+			}
+		}
+	}()
+
+	return e, nil
+}
+
+// flush pushes the current metrics.
+func (e *StatsDExporter) flush() {
+	families, err := e.gatherer.Gather()
+	if err != nil {
+		// Gather returns what it could collect along with the error.
+		log.Error("failed to gather metrics for statsd", log.Err(err))
+	}
+
+	var lines []string
+	for _, mf := range families {
+		for _, m := range mf.GetMetric() {
+			lines = e.appendLines(lines, mf, m)
+		}
+	}
+	e.send(lines)
+}
+
+// appendLines appends the StatsD lines of a metric.
+func (e *StatsDExporter) appendLines(lines []string, mf *dto.MetricFamily, m *dto.Metric) []string {
+	name, tags := e.encodeName(mf.GetName(), m.GetLabel())
+
+	switch mf.GetType() {
+	case dto.MetricType_COUNTER:
+		if delta := e.delta(name, m.GetCounter().GetValue()); delta != 0 {
+			lines = append(lines, name+":"+formatFloat(delta)+"|c"+tags)
+		}
+	case dto.MetricType_GAUGE:
+		lines = appendGauge(lines, name, m.GetGauge().GetValue(), tags)
+	case dto.MetricType_UNTYPED:
+		lines = appendGauge(lines, name, m.GetUntyped().GetValue(), tags)
+	case dto.MetricType_HISTOGRAM:
+		h := m.GetHistogram()
+		lines = e.appendSummary(lines, mf.GetName(), name, float64(h.GetSampleCount()), h.GetSampleSum(), tags)
+	case dto.MetricType_SUMMARY:
+		s := m.GetSummary()
+		lines = e.appendSummary(lines, mf.GetName(), name, float64(s.GetSampleCount()), s.GetSampleSum(), tags)
+	}
+	return lines
+}
+
+func (e *StatsDExporter) appendSummary(lines []string, family, name string, count, sum float64, tags string) []string {
+	dcount := e.delta(name+".count", count)
+	dsum := e.delta(name+".sum", sum)
+	if dcount == 0 {
+		return lines
+	}
+
+	lines = append(lines,
+		name+".count:"+formatFloat(dcount)+"|c"+tags,
+		name+".sum:"+formatFloat(dsum)+"|c"+tags,
+	)
+	if strings.HasSuffix(family, "_seconds") {
+		lines = append(lines, name+".mean:"+formatFloat(dsum/dcount*1000)+"|ms"+tags)
+	}
+	return lines
+}
+
+// appendGauge appends a gauge. A leading sign changes gauges relatively in
+// StatsD, so negative values are sent after resetting the gauge to zero.
+func appendGauge(lines []string, name string, value float64, tags string) []string {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return lines
+	}
+	if value < 0 {
+		lines = append(lines, name+":0|g"+tags)
+	}
+	return append(lines, name+":"+formatFloat(value)+"|g"+tags)
+}
+
+// delta returns the increase of a cumulative value since the last push. A
+// decrease means that the value was reset, e.g. because a metric was
+// unregistered and registered again.
+func (e *StatsDExporter) delta(key string, value float64) float64 {
+	last, ok := e.last[key]
+	e.last[key] = value
+	switch {
+	case !ok:
+		return value
+	case value < last:
+		return value
+	default:
+		return value - last
+	}
+}
+
+// encodeName returns the name of a metric with the configured prefix, and
+// its labels as DogStatsD tags or as parts of the name.
+func (e *StatsDExporter) encodeName(family string, labels []*dto.LabelPair) (name, tags string) {
+	name = e.cfg.Prefix + family
+	if len(labels) == 0 {
+		return name, ""
+	}
+
+	sorted := append([]*dto.LabelPair(nil), labels...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].GetName() < sorted[j].GetName() })
+
+	if e.cfg.Flavor == FlavorDogStatsD {
+		parts := make([]string, len(sorted))
+		for i, l := range sorted {
+			parts[i] = sanitize(l.GetName()) + ":" + sanitize(l.GetValue())
+		}
+		return name, "|#" + strings.Join(parts, ",")
+	}
+
+	for _, l := range sorted {
+		name += "." + sanitize(l.GetValue())
+	}
+	return name, ""
+}
+
+// sanitize replaces the characters that have a meaning in the StatsD
+// protocol.
+func sanitize(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ':', '|', '@', '#', ',', '\n', ' ':
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// send sends the lines in as few packets as possible.
+func (e *StatsDExporter) send(lines []string) {
+	var packet []byte
+	write := func() {
+		if len(packet) == 0 {
+			return
+		}
+		if _, err := e.conn.Write(packet); err != nil {
+			log.Error("failed to send metrics to statsd", log.Fields{"addr": e.cfg.Addr}, log.Err(err))
+		}
+		packet = packet[:0]
+	}
+
+	for _, line := range lines {
+		if len(packet) > 0 && len(packet)+1+len(line) > e.cfg.MaxPacketSize {
+			write()
+		}
+		if len(packet) > 0 {
+			packet = append(packet, '\n')
+		}
+		packet = append(packet, line...)
+	}
+	write()
+}
+
+// Stop pushes the metrics one last time and stops the StatsDExporter.
+func (e *StatsDExporter) Stop() stop.Result {
+	select {
+	case <-e.closing:
+		return stop.AlreadyStopped
+	default:
+	}
+	c := make(stop.Channel)
+	go func() {
+		close(e.closing)
+		e.wg.Wait()
+		c.Done(e.conn.Close())
+	}()
+	return c.Result()
+}
@@ -0,0 +1,94 @@
+package metrics
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+)
+
+// statsdServer returns the address of a UDP listener and a function reading
+// the lines of the next packet sent to it.
+func statsdServer(t *testing.T) (string, func() []string) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	return conn.LocalAddr().String(), func() []string {
+		buf := make([]byte, 65536)
+		require.Nil(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+		n, _, err := conn.ReadFrom(buf)
+		require.Nil(t, err)
+		return strings.Split(string(buf[:n]), "\n")
+	}
+}
+
+func TestStatsDExporter(t *testing.T) {
+	for _, tt := range []struct {
+		flavor   string
+		expected []string
+	}{
+		{FlavorStatsD, []string{
+			"chihaya.duration_seconds.count:2|c",
+			"chihaya.duration_seconds.sum:2|c",
+			"chihaya.duration_seconds.mean:1000|ms",
+			"chihaya.offset:0|g",
+			"chihaya.offset:-2|g",
+			"chihaya.requests_total.announce:3|c",
+		}},
+		{FlavorDogStatsD, []string{
+			"chihaya.duration_seconds.count:2|c",
+			"chihaya.duration_seconds.sum:2|c",
+			"chihaya.duration_seconds.mean:1000|ms",
+			"chihaya.offset:0|g",
+			"chihaya.offset:-2|g",
+			"chihaya.requests_total:3|c|#action:announce",
+		}},
+	} {
+		t.Run(tt.flavor, func(t *testing.T) {
+			reg := prometheus.NewRegistry()
+			counter := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "requests_total"}, []string{"action"})
+			gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "offset"})
+			histogram := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "duration_seconds"})
+			reg.MustRegister(counter, gauge, histogram)
+
+			counter.WithLabelValues("announce").Add(3)
+			gauge.Set(-2)
+			histogram.Observe(0.5)
+			histogram.Observe(1.5)
+
+			addr, read := statsdServer(t)
+			e, err := NewStatsDExporter(StatsDConfig{
+				Addr:          addr,
+				Flavor:        tt.flavor,
+				Prefix:        "chihaya.",
+				FlushInterval: time.Hour,
+			}, reg)
+			require.Nil(t, err)
+
+			e.flush()
+			require.Equal(t, tt.expected, read())
+
+			// Counters are sent as deltas, and only if they changed.
+			counter.WithLabelValues("announce").Inc()
+			gauge.Set(5)
+			require.Nil(t, <-e.Stop())
+			require.Equal(t, []string{"chihaya.offset:5|g", strings.Replace(tt.expected[5], ":3|", ":1|", 1)}, read())
+		})
+	}
+}
+
+func TestStatsDPackets(t *testing.T) {
+	addr, read := statsdServer(t)
+	e, err := NewStatsDExporter(StatsDConfig{Addr: addr, MaxPacketSize: 10, FlushInterval: time.Hour}, prometheus.NewRegistry())
+	require.Nil(t, err)
+	defer func() { require.Nil(t, <-e.Stop()) }()
+
+	e.send([]string{"a:1|c", "b:1|c", "cdefghijklm:1|c"})
+	require.Equal(t, []string{"a:1|c"}, read())
+	require.Equal(t, []string{"b:1|c"}, read())
+	require.Equal(t, []string{"cdefghijklm:1|c"}, read())
+}
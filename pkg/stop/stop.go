@@ -2,7 +2,11 @@
 package stop
 
 import (
+	"context"
+	"fmt"
+	"sort"
 	"sync"
+	"time"
 )
 
 // Channel is used to return zero or more errors asynchronously. Call Done()
@@ -33,6 +37,20 @@ func (r Result) Wait() []error {
 	return <-r
 }
 
+// WaitContext blocks until Done() is called on the underlying Channel or the
+// context is done, whichever happens first, and returns any errors.
+//
+// If the context is done first, the context's error is returned and the
+// stop continues in the background.
+func (r Result) WaitContext(ctx context.Context) []error {
+	select {
+	case errs := <-r:
+		return errs
+	case <-ctx.Done():
+		return []error{ctx.Err()}
+	}
+}
+
 // AlreadyStopped is a closed error channel to be used by Funcs when
 // an element was already stopped.
 var AlreadyStopped Result
@@ -58,64 +76,149 @@ type Stopper interface {
 	Stop() Result
 }
 
+// ContextStopper is a Stopper whose shutdown can be bounded by a context.
+//
+// Once the context is done, the shutdown should give up work that can be
+// skipped, like flushing caches, and finish as soon as possible.
+type ContextStopper interface {
+	Stopper
+
+	// StopContext behaves like Stop, but passes the context to the
+	// shutdown.
+	StopContext(ctx context.Context) Result
+}
+
+// StopContext stops s with the context if it implements ContextStopper, or
+// without it otherwise.
+//
+// The Result is not bounded by the context, use WaitContext for that.
+func StopContext(ctx context.Context, s Stopper) Result {
+	if cs, ok := s.(ContextStopper); ok {
+		return cs.StopContext(ctx)
+	}
+	return s.Stop()
+}
+
 // Func is a function that can be used to provide a clean shutdown.
 type Func func() Result
 
+// ContextFunc is a function that can be used to provide a clean shutdown
+// bounded by a context.
+type ContextFunc func(ctx context.Context) Result
+
+// StopperFunc returns a ContextFunc that stops s using StopContext.
+func StopperFunc(s Stopper) ContextFunc {
+	return func(ctx context.Context) Result {
+		return StopContext(ctx, s)
+	}
+}
+
+// Member describes a member of a Group with its place in the shutdown.
+type Member struct {
+	// Name prefixes the errors returned by stopping the member, if set.
+	Name string
+
+	// Tier orders the shutdown of a Group: the members of a tier start
+	// stopping once all members of lower tiers stopped.
+	Tier int
+
+	// Timeout bounds stopping the member, if positive. A member that did not
+	// stop in time is reported as failed and continues to stop in the
+	// background.
+	Timeout time.Duration
+
+	// Stop stops the member with the context of its shutdown.
+	Stop ContextFunc
+}
+
+// err prefixes err with the name of the member.
+func (m Member) err(err error) error {
+	if m.Name == "" {
+		return err
+	}
+	return fmt.Errorf("%s: %w", m.Name, err)
+}
+
 // Group is a collection of Stoppers that can be stopped all at once.
 type Group struct {
-	stoppables []Func
+	members []Member
 	sync.Mutex
 }
 
 // NewGroup allocates a new Group.
 func NewGroup() *Group {
 	return &Group{
-		stoppables: make([]Func, 0),
+		members: make([]Member, 0),
 	}
 }
 
-// Add appends a Stopper to the Group.
+// Add appends a Stopper to the Group in tier 0.
+//
+// If the Stopper implements ContextStopper, the context passed to
+// StopContext is passed on to it.
 func (cg *Group) Add(toAdd Stopper) {
-	cg.Lock()
-	defer cg.Unlock()
-
-	cg.stoppables = append(cg.stoppables, toAdd.Stop)
+	cg.AddContextFunc(StopperFunc(toAdd))
 }
 
-// AddFunc appends a Func to the Group.
+// AddFunc appends a Func to the Group in tier 0.
 func (cg *Group) AddFunc(toAddFunc Func) {
+	cg.AddContextFunc(func(context.Context) Result {
+		return toAddFunc()
+	})
+}
+
+// AddContextFunc appends a ContextFunc to the Group in tier 0.
+func (cg *Group) AddContextFunc(toAddFunc ContextFunc) {
+	cg.AddMember(Member{Stop: toAddFunc})
+}
+
+// AddMember appends a Member to the Group.
+func (cg *Group) AddMember(m Member) {
 	cg.Lock()
 	defer cg.Unlock()
 
-	cg.stoppables = append(cg.stoppables, toAddFunc)
+	cg.members = append(cg.members, m)
 }
 
 // Stop stops all members of the Group.
 //
-// Stopping will be done in a concurrent fashion.
+// Stopping will be done in a concurrent fashion within each tier, and tier by
+// tier in ascending order.
 // The slice of errors returned contains all errors returned by stopping the
-// members.
+// members. A failing member does not keep the later tiers from stopping.
 func (cg *Group) Stop() Result {
-	cg.Lock()
-	defer cg.Unlock()
+	return cg.StopContext(context.Background())
+}
 
-	whenDone := make(Channel)
+// StopContext stops all members of the Group like Stop, but passes the
+// context on to them and bounds the shutdown by it.
+//
+// If the context is done before all members stopped, the Result contains
+// the errors of the members that stopped so far and the context's error.
+// The members that are stopping continue to stop in the background, and the
+// members of later tiers are not stopped.
+func (cg *Group) StopContext(ctx context.Context) Result {
+	cg.Lock()
+	members := make([]Member, len(cg.members))
+	copy(members, cg.members)
+	cg.Unlock()
 
-	waitChannels := make([]Result, 0, len(cg.stoppables))
-	for _, toStop := range cg.stoppables {
-		waitFor := toStop()
-		if waitFor == nil {
-			panic("received a nil chan from Stop")
-		}
-		waitChannels = append(waitChannels, waitFor)
-	}
+	sort.SliceStable(members, func(i, j int) bool { return members[i].Tier < members[j].Tier })
 
+	whenDone := make(Channel)
 	go func() {
 		var errors []error
-		for _, waitForMe := range waitChannels {
-			childErrors := waitForMe.Wait()
-			if len(childErrors) > 0 {
-				errors = append(errors, childErrors...)
+		for len(members) > 0 {
+			n := 1
+			for n < len(members) && members[n].Tier == members[0].Tier {
+				n++
+			}
+			errors = append(errors, stopTier(ctx, members[:n])...)
+			members = members[n:]
+
+			if err := ctx.Err(); err != nil {
+				errors = append(errors, err)
+				break
 			}
 		}
 		whenDone.Done(errors...)
@@ -123,3 +226,40 @@ func (cg *Group) Stop() Result {
 
 	return whenDone.Result()
 }
+
+// stopTier stops the members of a tier concurrently and returns their
+// errors.
+func stopTier(ctx context.Context, members []Member) []error {
+	contexts := make([]context.Context, len(members))
+	waitChannels := make([]Result, len(members))
+	for i, m := range members {
+		contexts[i] = ctx
+		if m.Timeout > 0 {
+			var cancel context.CancelFunc
+			contexts[i], cancel = context.WithTimeout(ctx, m.Timeout)
+			defer cancel()
+		}
+
+		waitChannels[i] = m.Stop(contexts[i])
+		if waitChannels[i] == nil {
+			panic("received a nil chan from Stop")
+		}
+	}
+
+	var errors []error
+	for i, waitForMe := range waitChannels {
+		select {
+		case childErrors := <-waitForMe:
+			for _, err := range childErrors {
+				errors = append(errors, members[i].err(err))
+			}
+		case <-contexts[i].Done():
+			// The context of the whole shutdown is reported once by the
+			// caller.
+			if ctx.Err() == nil {
+				errors = append(errors, members[i].err(contexts[i].Err()))
+			}
+		}
+	}
+	return errors
+}
@@ -0,0 +1,89 @@
+package stop
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type contextStopper struct {
+	ctx context.Context
+}
+
+func (s *contextStopper) Stop() Result {
+	return s.StopContext(context.Background())
+}
+
+func (s *contextStopper) StopContext(ctx context.Context) Result {
+	s.ctx = ctx
+	return AlreadyStopped
+}
+
+func TestGroupStopContext(t *testing.T) {
+	errStop := errors.New("failed to stop")
+	blocked := make(Channel)
+	defer blocked.Done()
+	cs := &contextStopper{}
+
+	g := NewGroup()
+	g.Add(cs)
+	g.AddFunc(func() Result {
+		c := make(Channel)
+		go c.Done(errStop)
+		return c.Result()
+	})
+	g.AddFunc(func() Result { return blocked.Result() })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	errs := g.StopContext(ctx).Wait()
+	require.Equal(t, []error{errStop, context.DeadlineExceeded}, errs)
+	require.Equal(t, ctx, cs.ctx)
+}
+
+func TestGroupTiers(t *testing.T) {
+	var mu sync.Mutex
+	var stopped []string
+	member := func(name string, tier int, err error) Member {
+		return Member{Name: name, Tier: tier, Stop: func(context.Context) Result {
+			c := make(Channel)
+			go func() {
+				time.Sleep(time.Millisecond)
+				mu.Lock()
+				stopped = append(stopped, name)
+				mu.Unlock()
+				c.Done(err)
+			}()
+			return c.Result()
+		}}
+	}
+	errStop := errors.New("failed to stop")
+	blocked := make(Channel)
+	defer blocked.Done()
+
+	g := NewGroup()
+	g.AddMember(member("storage", 2, nil))
+	g.AddMember(member("logic", 1, errStop))
+	g.AddMember(member("frontend", 0, nil))
+	g.AddMember(Member{Name: "exporter", Tier: 1, Timeout: time.Millisecond, Stop: func(context.Context) Result {
+		return blocked.Result()
+	}})
+
+	errs := g.Stop().Wait()
+	require.Equal(t, []string{"frontend", "logic", "storage"}, stopped)
+	require.Len(t, errs, 2)
+	require.EqualError(t, errs[0], "logic: failed to stop")
+	require.ErrorIs(t, errs[0], errStop)
+	require.EqualError(t, errs[1], "exporter: context deadline exceeded")
+}
+
+func TestResultWaitContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.Equal(t, []error{context.Canceled}, make(Result).WaitContext(ctx))
+	require.Empty(t, AlreadyStopped.WaitContext(context.Background()))
+}
@@ -0,0 +1,8 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package systemd
+
+// closeOnExec is not supported on this platform, where socket activation does
+// not exist.
+func closeOnExec(fd int) {}
@@ -0,0 +1,12 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package systemd
+
+import "syscall"
+
+// closeOnExec keeps an inherited file descriptor from leaking into child
+// processes.
+func closeOnExec(fd int) {
+	syscall.CloseOnExec(fd)
+}
@@ -0,0 +1,205 @@
+// Package systemd implements the parts of the systemd service protocol used by
+// Chihaya: state notifications for services of Type=notify and socket
+// activation, which lets systemd keep the sockets of the frontends open while
+// Chihaya restarts.
+//
+// Both are no-ops unless Chihaya is started by systemd with the respective
+// environment variables.
+package systemd
+
+import (
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// States that can be sent with Notify.
+const (
+	// Ready tells systemd that startup or a reload finished.
+	Ready = "READY=1"
+
+	// Reloading tells systemd that the configuration is being reloaded.
+	// Ready must be sent when the reload finished.
+	Reloading = "RELOADING=1"
+
+	// Stopping tells systemd that Chihaya is shutting down.
+	Stopping = "STOPPING=1"
+)
+
+// Notify sends a state to systemd.
+//
+// It reports whether the state was sent, which is not the case if Chihaya was
+// not started by systemd as a notify service.
+func Notify(state string) (bool, error) {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return false, nil
+	}
+
+	// Addresses starting with "@" are abstract sockets, which the net
+	// package handles.
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// listenFDsStart is the first file descriptor passed by socket activation.
+const listenFDsStart = 3
+
+var (
+	filesOnce sync.Once
+	files     []*os.File
+)
+
+// inheritedFiles returns the sockets passed by socket activation.
+//
+// The files are kept open for the lifetime of the process, so that frontends
+// restarted on reload can use the sockets again. The environment variables of
+// socket activation are removed, so that child processes do not mistake the
+// sockets for their own.
+func inheritedFiles() []*os.File {
+	filesOnce.Do(func() {
+		defer func() {
+			os.Unsetenv("LISTEN_PID")
+			os.Unsetenv("LISTEN_FDS")
+			os.Unsetenv("LISTEN_FDNAMES")
+		}()
+
+		pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+		if err != nil || pid != os.Getpid() {
+			return
+		}
+		n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+		if err != nil || n <= 0 {
+			return
+		}
+
+		names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+		for i := 0; i < n; i++ {
+			fd := listenFDsStart + i
+			closeOnExec(fd)
+
+			name := "LISTEN_FD_" + strconv.Itoa(fd)
+			if i < len(names) && names[i] != "" {
+				name = names[i]
+			}
+			files = append(files, os.NewFile(uintptr(fd), name))
+		}
+	})
+	return files
+}
+
+// Listener returns a listener for the stream socket passed by socket
+// activation that is bound to the TCP address, or nil if there is none.
+//
+// An unspecified IP in the address, e.g. ":6969", matches sockets bound to
+// the unspecified IP of either address family, preferring the family of the
+// address. Every call returns a new listener; closing it does not close the
+// socket passed by systemd.
+func Listener(addr string) (net.Listener, error) {
+	want, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	l := find(want.IP, want.Port, func(f *os.File) (io.Closer, net.IP, int) {
+		l, err := net.FileListener(f)
+		if err != nil {
+			// Not a stream socket.
+			return nil, nil, 0
+		}
+		if got, ok := l.Addr().(*net.TCPAddr); ok {
+			return l, got.IP, got.Port
+		}
+		return l, nil, 0
+	})
+	if l == nil {
+		return nil, nil
+	}
+	return l.(net.Listener), nil
+}
+
+// PacketConn returns a connection for the datagram socket passed by socket
+// activation that is bound to the UDP address, or nil if there is none.
+//
+// Addresses are matched like those of Listener. Every call returns a new
+// connection; closing it does not close the socket passed by systemd.
+func PacketConn(addr string) (*net.UDPConn, error) {
+	want, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn := find(want.IP, want.Port, func(f *os.File) (io.Closer, net.IP, int) {
+		pc, err := net.FilePacketConn(f)
+		if err != nil {
+			// Not a datagram socket.
+			return nil, nil, 0
+		}
+		if got, ok := pc.LocalAddr().(*net.UDPAddr); ok {
+			return pc, got.IP, got.Port
+		}
+		return pc, nil, 0
+	})
+	if conn == nil {
+		return nil, nil
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+// find opens the inherited sockets and returns the one that matches the IP
+// and port best, closing all others.
+//
+// open returns nil if the file is not a socket of the wanted type, or a zero
+// port if the socket is not bound to an address of the wanted type.
+func find(wantIP net.IP, wantPort int, open func(*os.File) (io.Closer, net.IP, int)) io.Closer {
+	var best io.Closer
+	bestScore := 0
+	for _, f := range inheritedFiles() {
+		c, ip, port := open(f)
+		if c == nil {
+			continue
+		}
+		if score := matchScore(wantIP, wantPort, ip, port); score > bestScore {
+			if best != nil {
+				best.Close()
+			}
+			best, bestScore = c, score
+			continue
+		}
+		c.Close()
+	}
+	return best
+}
+
+// matchScore rates how well a socket bound to gotIP and gotPort serves the
+// configured wantIP and wantPort: 0 if it does not, 1 if it is bound to the
+// unspecified IP of another address family and 2 if it matches exactly.
+func matchScore(wantIP net.IP, wantPort int, gotIP net.IP, gotPort int) int {
+	if gotPort == 0 || wantPort != gotPort {
+		return 0
+	}
+	if wantIP != nil && !wantIP.IsUnspecified() {
+		if wantIP.Equal(gotIP) {
+			return 2
+		}
+		return 0
+	}
+	if gotIP != nil && !gotIP.IsUnspecified() {
+		return 0
+	}
+	if wantIP == nil || gotIP == nil || (wantIP.To4() != nil) == (gotIP.To4() != nil) {
+		return 2
+	}
+	return 1
+}
@@ -0,0 +1,127 @@
+package systemd
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNotify(t *testing.T) {
+	defer os.Unsetenv("NOTIFY_SOCKET")
+
+	os.Unsetenv("NOTIFY_SOCKET")
+	sent, err := Notify(Ready)
+	require.Nil(t, err)
+	require.False(t, sent)
+
+	dir, err := os.MkdirTemp("", "systemd")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	addr := filepath.Join(dir, "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		t.Skip("unixgram sockets are not supported:", err)
+	}
+	defer conn.Close()
+
+	os.Setenv("NOTIFY_SOCKET", addr)
+	sent, err = Notify(Ready)
+	require.Nil(t, err)
+	require.True(t, sent)
+
+	buf := make([]byte, 64)
+	n, err := conn.Read(buf)
+	require.Nil(t, err)
+	require.Equal(t, Ready, string(buf[:n]))
+}
+
+func TestActivation(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("socket activation is not supported on windows")
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer l.Close()
+	lf, err := l.(*net.TCPListener).File()
+	require.Nil(t, err)
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer pc.Close()
+	pcf, err := pc.(*net.UDPConn).File()
+	require.Nil(t, err)
+
+	// Pretend the sockets were passed by systemd.
+	filesOnce.Do(func() {})
+	files = []*os.File{pcf, lf}
+	defer func() {
+		files = nil
+		lf.Close()
+		pcf.Close()
+	}()
+
+	got, err := Listener(l.Addr().String())
+	require.Nil(t, err)
+	require.NotNil(t, got)
+	require.Equal(t, l.Addr().String(), got.Addr().String())
+	require.Nil(t, got.Close())
+
+	// Closing a listener keeps the passed socket open.
+	got, err = Listener(l.Addr().String())
+	require.Nil(t, err)
+	require.NotNil(t, got)
+	require.Nil(t, got.Close())
+
+	conn, err := PacketConn(pc.LocalAddr().String())
+	require.Nil(t, err)
+	require.NotNil(t, conn)
+	require.Equal(t, pc.LocalAddr().String(), conn.LocalAddr().String())
+	require.Nil(t, conn.Close())
+
+	got, err = Listener(pc.LocalAddr().String())
+	require.Nil(t, err)
+	if got != nil {
+		// The UDP and TCP ports may coincide by chance.
+		require.Equal(t, l.Addr().String(), got.Addr().String())
+		got.Close()
+	}
+
+	got, err = Listener("127.0.0.2:1")
+	require.Nil(t, err)
+	require.Nil(t, got)
+}
+
+func TestMatchScore(t *testing.T) {
+	var table = []struct {
+		want     string
+		got      string
+		expected int
+	}{
+		{":6969", "0.0.0.0:6969", 2},
+		{":6969", "[::]:6969", 2},
+		{"0.0.0.0:6969", "0.0.0.0:6969", 2},
+		{"0.0.0.0:6969", "[::]:6969", 1},
+		{"[::]:6969", "0.0.0.0:6969", 1},
+		{":6969", "127.0.0.1:6969", 0},
+		{"127.0.0.1:6969", "127.0.0.1:6969", 2},
+		{"127.0.0.1:6969", "[::ffff:127.0.0.1]:6969", 2},
+		{"127.0.0.1:6969", "0.0.0.0:6969", 0},
+		{"127.0.0.1:6969", "127.0.0.1:6970", 0},
+	}
+
+	for _, tt := range table {
+		t.Run(tt.want+" "+tt.got, func(t *testing.T) {
+			want, err := net.ResolveTCPAddr("tcp", tt.want)
+			require.Nil(t, err)
+			got, err := net.ResolveTCPAddr("tcp", tt.got)
+			require.Nil(t, err)
+			require.Equal(t, tt.expected, matchScore(want.IP, want.Port, got.IP, got.Port))
+		})
+	}
+}
@@ -4,7 +4,11 @@
 // the Unix Epoch. The value is accessed using atomic primitives, without
 // locking.
 // The package runs a global singleton TimeCache that is is updated every
-// second.
+// second by default, see SetResolution.
+//
+// Besides the wall clock, a TimeCache caches a monotonic clock, which is not
+// affected by changes of the wall clock, for measuring the age of timestamps
+// kept in memory, such as the last announces of peers.
 package timecache
 
 import (
@@ -13,17 +17,24 @@ import (
 	"time"
 )
 
+// DefaultResolution is the interval the global TimeCache is updated at,
+// unless it is changed by SetResolution.
+const DefaultResolution = time.Second
+
 // t is the global TimeCache.
 var t *TimeCache
 
+// epoch is the start of the monotonic clock, which starts at the wall clock
+// time of epoch.
+var (
+	epoch         = time.Now()
+	epochUnixNano = epoch.UnixNano()
+)
+
 func init() {
-	t = &TimeCache{
-		clock:   time.Now().UnixNano(),
-		closed:  make(chan struct{}),
-		running: make(chan struct{}),
-	}
+	t = New()
 
-	go t.Run(1 * time.Second)
+	go t.Run(DefaultResolution)
 }
 
 // A TimeCache is a cache for the current system time.
@@ -33,21 +44,38 @@ type TimeCache struct {
 	// Must be accessed atomically.
 	clock int64
 
+	// monotonic saves the current time of the monotonic clock.
+	// Must be accessed atomically.
+	monotonic int64
+
 	closed  chan struct{}
 	running chan struct{}
 	m       sync.Mutex
+
+	// ticker is set by Run. interval is the interval set by SetInterval
+	// before Run was called.
+	ticker   *time.Ticker
+	interval time.Duration
 }
 
 // New returns a new TimeCache instance.
 // The TimeCache must be started to update the time.
 func New() *TimeCache {
+	now := time.Now()
 	return &TimeCache{
-		clock:   time.Now().UnixNano(),
-		closed:  make(chan struct{}),
-		running: make(chan struct{}),
+		clock:     now.UnixNano(),
+		monotonic: monotonicOf(now),
+		closed:    make(chan struct{}),
+		running:   make(chan struct{}),
 	}
 }
 
+// monotonicOf returns the time of the monotonic clock at t, which must carry
+// a monotonic clock reading.
+func monotonicOf(t time.Time) int64 {
+	return epochUnixNano + int64(t.Sub(epoch))
+}
+
 // Run runs the TimeCache, updating the cached clock value once every interval
 // and blocks until Stop is called.
 func (t *TimeCache) Run(interval time.Duration) {
@@ -58,21 +86,50 @@ func (t *TimeCache) Run(interval time.Duration) {
 	default:
 	}
 	close(t.running)
+	if t.interval > 0 {
+		interval = t.interval
+	}
+	tick := time.NewTicker(interval)
+	t.ticker = tick
 	t.m.Unlock()
 
-	tick := time.NewTicker(interval)
 	defer tick.Stop()
 	for {
 		select {
 		case <-t.closed:
 			tick.Stop()
 			return
-		case now := <-tick.C:
-			atomic.StoreInt64(&t.clock, now.UnixNano())
+		case <-tick.C:
+			// The time of the tick is delayed if the TimeCache could not
+			// keep up, so the current time is used instead.
+			t.update(time.Now())
 		}
 	}
 }
 
+func (t *TimeCache) update(now time.Time) {
+	atomic.StoreInt64(&t.clock, now.UnixNano())
+	atomic.StoreInt64(&t.monotonic, monotonicOf(now))
+}
+
+// SetInterval changes the interval at which the TimeCache is updated and
+// updates it immediately. If it is called before Run, the interval replaces
+// the one passed to Run.
+//
+// A shorter interval makes the cached time more precise at the cost of more
+// frequent updates.
+func (t *TimeCache) SetInterval(interval time.Duration) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	if t.ticker != nil {
+		t.ticker.Reset(interval)
+	} else {
+		t.interval = interval
+	}
+	t.update(time.Now())
+}
+
 // Stop stops the TimeCache.
 // The cached time remains valid but will not be updated anymore.
 // A TimeCache can not be restarted. Construct a new one instead.
@@ -111,6 +168,17 @@ func (t *TimeCache) NowUnix() int64 {
 	return sec
 }
 
+// MonotonicUnixNano returns the cached time of the monotonic clock in
+// nanoseconds.
+//
+// The monotonic clock starts at the wall clock time when the process started
+// and is not affected by later changes of the wall clock, so that durations
+// between its times are exact. Its times are only comparable within the
+// process, use FromMonotonic to convert them to wall clock times.
+func (t *TimeCache) MonotonicUnixNano() int64 {
+	return atomic.LoadInt64(&t.monotonic)
+}
+
 // Now calls Now on the global TimeCache instance.
 func Now() time.Time {
 	return t.Now()
@@ -125,3 +193,32 @@ func NowUnixNano() int64 {
 func NowUnix() int64 {
 	return t.NowUnix()
 }
+
+// MonotonicUnixNano calls MonotonicUnixNano on the global TimeCache instance.
+func MonotonicUnixNano() int64 {
+	return t.MonotonicUnixNano()
+}
+
+// SetResolution changes the interval at which the global TimeCache is
+// updated.
+func SetResolution(interval time.Duration) {
+	t.SetInterval(interval)
+}
+
+// ToMonotonic converts t to a time of the monotonic clock.
+//
+// If t carries a monotonic clock reading, like the times returned by
+// time.Now and derived from them, the conversion is exact regardless of
+// changes of the wall clock. Otherwise t is converted relative to the current
+// wall clock time.
+func ToMonotonic(t time.Time) int64 {
+	now := time.Now()
+	return monotonicOf(now) - int64(now.Sub(t))
+}
+
+// FromMonotonic converts a time of the monotonic clock to a wall clock time
+// relative to the current wall clock time.
+func FromMonotonic(monotonic int64) time.Time {
+	now := time.Now()
+	return now.Add(time.Duration(monotonic - monotonicOf(now)))
+}
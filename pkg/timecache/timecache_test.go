@@ -146,3 +146,34 @@ func BenchmarkTimeNow(b *testing.B) {
 		_ = now
 	})
 }
+
+func TestSetInterval(t *testing.T) {
+	c := New()
+	c.SetInterval(time.Millisecond)
+	go c.Run(time.Hour)
+	defer c.Stop()
+
+	before := c.NowUnixNano()
+	require.Eventually(t, func() bool { return c.NowUnixNano() > before }, time.Second, time.Millisecond)
+
+	// A tick received before the interval changed may still update the
+	// clock once.
+	c.SetInterval(time.Hour)
+	time.Sleep(10 * time.Millisecond)
+	before = c.NowUnixNano()
+	time.Sleep(10 * time.Millisecond)
+	require.Equal(t, before, c.NowUnixNano())
+}
+
+func TestMonotonic(t *testing.T) {
+	now := time.Now()
+	mono := ToMonotonic(now)
+	require.InDelta(t, now.UnixNano(), mono, float64(time.Second))
+	require.InDelta(t, MonotonicUnixNano(), mono, float64(2*DefaultResolution))
+
+	// Times without a monotonic clock reading are converted relative to the
+	// wall clock.
+	require.InDelta(t, mono, ToMonotonic(now.Round(0)), float64(time.Millisecond))
+	require.InDelta(t, now.UnixNano(), FromMonotonic(mono).UnixNano(), float64(time.Millisecond))
+	require.Equal(t, int64(time.Minute), ToMonotonic(now.Add(time.Minute))-mono)
+}
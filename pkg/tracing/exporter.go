@@ -0,0 +1,400 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/pkg/stop"
+)
+
+func init() {
+	prometheus.MustRegister(promExportedSpans, promDroppedSpans)
+}
+
+var (
+	promExportedSpans = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "chihaya_tracing_exported_spans_total",
+		Help: "The number of spans exported to the OpenTelemetry collector",
+	})
+
+	promDroppedSpans = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "chihaya_tracing_dropped_spans_total",
+		Help: "The number of spans dropped because the export queue was full or the export failed",
+	})
+)
+
+// Config represents the configuration of an Exporter.
+type Config struct {
+	// Endpoint is the OTLP/HTTP traces endpoint of the collector, e.g.
+	// "http://localhost:4318/v1/traces". Tracing is disabled without one.
+	Endpoint string `yaml:"endpoint"`
+
+	// Headers are added to every export request, e.g. for authentication.
+	Headers map[string]string `yaml:"headers"`
+
+	// ServiceName is the service.name of the exported spans.
+	ServiceName string `yaml:"service_name"`
+
+	// SampleRatio is the fraction of new traces that are recorded. Traces
+	// continued from clients follow the sampling decision of the client.
+	SampleRatio float64 `yaml:"sample_ratio"`
+
+	// BatchSize is the maximum number of spans exported at once. Up to eight
+	// batches are queued; further spans are dropped.
+	BatchSize int `yaml:"batch_size"`
+
+	// ExportInterval is the interval at which queued spans are exported.
+	ExportInterval time.Duration `yaml:"export_interval"`
+
+	// Timeout is the timeout of export requests.
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// Enabled reports whether tracing is configured.
+func (cfg Config) Enabled() bool {
+	return cfg.Endpoint != ""
+}
+
+// LogFields implements log.Fielder for a Config.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"endpoint":       cfg.Endpoint,
+		"serviceName":    cfg.ServiceName,
+		"sampleRatio":    cfg.SampleRatio,
+		"batchSize":      cfg.BatchSize,
+		"exportInterval": cfg.ExportInterval,
+		"timeout":        cfg.Timeout,
+	}
+}
+
+// Default config constants.
+const (
+	defaultServiceName    = "chihaya"
+	defaultSampleRatio    = 0.01
+	defaultBatchSize      = 512
+	defaultExportInterval = 5 * time.Second
+	defaultTimeout        = 10 * time.Second
+)
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+//
+// This function warns to the logger when a value is changed.
+func (cfg Config) Validate() Config {
+	validcfg := cfg
+
+	if cfg.ServiceName == "" {
+		validcfg.ServiceName = defaultServiceName
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     "tracing.ServiceName",
+			"provided": cfg.ServiceName,
+			"default":  validcfg.ServiceName,
+		})
+	}
+
+	if cfg.SampleRatio <= 0 || cfg.SampleRatio > 1 {
+		validcfg.SampleRatio = defaultSampleRatio
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     "tracing.SampleRatio",
+			"provided": cfg.SampleRatio,
+			"default":  validcfg.SampleRatio,
+		})
+	}
+
+	if cfg.BatchSize <= 0 {
+		validcfg.BatchSize = defaultBatchSize
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     "tracing.BatchSize",
+			"provided": cfg.BatchSize,
+			"default":  validcfg.BatchSize,
+		})
+	}
+
+	if cfg.ExportInterval <= 0 {
+		validcfg.ExportInterval = defaultExportInterval
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     "tracing.ExportInterval",
+			"provided": cfg.ExportInterval,
+			"default":  validcfg.ExportInterval,
+		})
+	}
+
+	if cfg.Timeout <= 0 {
+		validcfg.Timeout = defaultTimeout
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     "tracing.Timeout",
+			"provided": cfg.Timeout,
+			"default":  validcfg.Timeout,
+		})
+	}
+
+	return validcfg
+}
+
+// Exporter exports the spans recorded while it is running.
+type Exporter struct {
+	cfg    Config
+	client *http.Client
+
+	// sampleThreshold is compared to the last eight bytes of trace IDs to
+	// sample new traces.
+	sampleThreshold uint64
+
+	queue   chan *Span
+	closing chan struct{}
+	wg      sync.WaitGroup
+}
+
+// NewExporter starts exporting spans to the endpoint of the config and makes
+// the Exporter the one all spans are recorded for, until it is stopped.
+func NewExporter(provided Config) *Exporter {
+	cfg := provided.Validate()
+	e := &Exporter{
+		cfg:     cfg,
+		client:  &http.Client{Timeout: cfg.Timeout},
+		queue:   make(chan *Span, 8*cfg.BatchSize),
+		closing: make(chan struct{}),
+	}
+	if cfg.SampleRatio >= 1 {
+		e.sampleThreshold = math.MaxUint64
+	} else {
+		e.sampleThreshold = uint64(cfg.SampleRatio * math.MaxUint64)
+	}
+
+	e.wg.Add(1)
+	go e.run()
+
+	current.Store(e)
+	return e
+}
+
+// sample reports whether a new trace is recorded.
+func (e *Exporter) sample(traceID [16]byte) bool {
+	return e.sampleThreshold == math.MaxUint64 || binary.BigEndian.Uint64(traceID[8:]) < e.sampleThreshold
+}
+
+func (e *Exporter) enqueue(s *Span) {
+	select {
+	case e.queue <- s:
+	default:
+		promDroppedSpans.Inc()
+	}
+}
+
+func (e *Exporter) run() {
+	defer e.wg.Done()
+	t := time.NewTicker(e.cfg.ExportInterval)
+	defer t.Stop()
+
+	batch := make([]*Span, 0, e.cfg.BatchSize)
+	flush := func() {
+		if len(batch) > 0 {
+			e.export(batch)
+			batch = batch[:0]
+		}
+	}
+	for {
+		select {
+		case <-e.closing:
+			// Export the spans that were queued before the Exporter was
+			// stopped.
+			for {
+				select {
+				case s := <-e.queue:
+					if batch = append(batch, s); len(batch) == cap(batch) {
+						flush()
+					}
+				default:
+					flush()
+					return
+				}
+			}
+		case s := <-e.queue:
+			if batch = append(batch, s); len(batch) == cap(batch) {
+				flush()
+			}
+		case <-t.C:
+			flush()
+		}
+	}
+}
+
+// export sends spans to the collector.
+func (e *Exporter) export(spans []*Span) {
+	body, err := json.Marshal(e.request(spans))
+	if err != nil {
+		log.Error("failed to encode spans", log.Err(err))
+		promDroppedSpans.Add(float64(len(spans)))
+		return
+	}
+
+	req, err := http.NewRequest(http.MethodPost, e.cfg.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		log.Error("failed to export spans", log.Fields{"endpoint": e.cfg.Endpoint}, log.Err(err))
+		promDroppedSpans.Add(float64(len(spans)))
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := e.client.Do(req)
+	if err == nil {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			err = fmt.Errorf("unexpected status %s", resp.Status)
+		}
+	}
+	if err != nil {
+		log.Error("failed to export spans", log.Fields{"endpoint": e.cfg.Endpoint}, log.Err(err))
+		promDroppedSpans.Add(float64(len(spans)))
+		return
+	}
+	promExportedSpans.Add(float64(len(spans)))
+}
+
+// The types below are the parts of the JSON encoding of an OTLP
+// ExportTraceServiceRequest that are used by the Exporter.
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// Span kinds and status codes of OTLP.
+const (
+	otlpKindInternal = 1
+	otlpKindServer   = 2
+	otlpStatusError  = 2
+)
+
+func otlpAttributeOf(key string, value interface{}) otlpAttribute {
+	a := otlpAttribute{Key: key}
+	switch v := value.(type) {
+	case string:
+		a.Value.StringValue = &v
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		a.Value.IntValue = &s
+	case bool:
+		a.Value.BoolValue = &v
+	}
+	return a
+}
+
+func (e *Exporter) request(spans []*Span) otlpRequest {
+	encoded := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		span := otlpSpan{
+			TraceID:           hex.EncodeToString(s.traceID[:]),
+			SpanID:            hex.EncodeToString(s.spanID[:]),
+			Name:              s.name,
+			Kind:              otlpKindInternal,
+			StartTimeUnixNano: strconv.FormatInt(s.start, 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end, 10),
+		}
+		if s.parentID != ([8]byte{}) {
+			span.ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+		if s.server {
+			span.Kind = otlpKindServer
+		}
+		for _, a := range s.attrs {
+			span.Attributes = append(span.Attributes, otlpAttributeOf(a.key, a.value))
+		}
+		if s.err != "" {
+			span.Status = otlpStatus{Code: otlpStatusError, Message: s.err}
+		}
+		encoded = append(encoded, span)
+	}
+
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpAttribute{
+			otlpAttributeOf("service.name", e.cfg.ServiceName),
+		}},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "github.com/chihaya/chihaya"},
+			Spans: encoded,
+		}},
+	}}}
+}
+
+// Stop stops recording spans and exports the queued spans.
+func (e *Exporter) Stop() stop.Result {
+	select {
+	case <-e.closing:
+		return stop.AlreadyStopped
+	default:
+	}
+	c := make(stop.Channel)
+	go func() {
+		// Only unset the Exporter if it was not replaced already.
+		if exporter() == e {
+			current.Store((*Exporter)(nil))
+		}
+		close(e.closing)
+		e.wg.Wait()
+		c.Done()
+	}()
+	return c.Result()
+}
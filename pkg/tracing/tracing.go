@@ -0,0 +1,219 @@
+// Package tracing records spans of the requests handled by Chihaya and
+// exports them to an OpenTelemetry collector, so that operators can see where
+// the latency of requests is spent.
+//
+// Spans are exported via OTLP/HTTP in its JSON encoding, so no OpenTelemetry
+// SDK needs to be linked into chihaya. Traces are continued from the W3C
+// traceparent header of HTTP requests and sampled by their trace ID
+// otherwise.
+//
+// Tracing is disabled unless an Exporter is running. All functions and
+// methods of this package are safe to call with tracing disabled, and return
+// nil Spans, whose methods do nothing.
+package tracing
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"math"
+	"math/rand"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// current holds the running *Exporter, or a nil *Exporter.
+var current atomic.Value
+
+func init() {
+	current.Store((*Exporter)(nil))
+}
+
+func exporter() *Exporter {
+	return current.Load().(*Exporter)
+}
+
+// Enabled reports whether spans are recorded.
+func Enabled() bool {
+	return exporter() != nil
+}
+
+// spanContext identifies a span within a trace.
+type spanContext struct {
+	traceID [16]byte
+	spanID  [8]byte
+	sampled bool
+	remote  bool
+}
+
+type spanContextKey struct{}
+
+// fromContext returns the span context carried by ctx. A zero span context
+// is carried by contexts unwound to a context without one.
+func fromContext(ctx context.Context) (spanContext, bool) {
+	sc, ok := ctx.Value(spanContextKey{}).(spanContext)
+	return sc, ok && sc.traceID != [16]byte{}
+}
+
+// Unwind returns ctx carrying the span of parent instead of its own, so that
+// a context returned by code that ran in a span, e.g. a middleware hook, can
+// be used after the span has ended without making later spans its children.
+func Unwind(ctx, parent context.Context) context.Context {
+	sc, _ := fromContext(parent)
+	if current, _ := fromContext(ctx); current == sc {
+		return ctx
+	}
+	return context.WithValue(ctx, spanContextKey{}, sc)
+}
+
+// ContextWithRemoteParent returns a context carrying the span of a W3C
+// traceparent header, so that the spans started with it continue the trace
+// of the caller. The context is returned unchanged if the header is invalid
+// or tracing is disabled.
+func ContextWithRemoteParent(ctx context.Context, traceparent string) context.Context {
+	if traceparent == "" || !Enabled() {
+		return ctx
+	}
+	sc, err := parseTraceparent(traceparent)
+	if err != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, spanContextKey{}, sc)
+}
+
+// parseTraceparent parses a traceparent header of version 00, e.g.
+// "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01".
+func parseTraceparent(s string) (spanContext, error) {
+	parts := strings.Split(s, "-")
+	if len(parts) < 4 || parts[0] != "00" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return spanContext{}, errors.New("invalid traceparent")
+	}
+
+	sc := spanContext{remote: true}
+	var flags [1]byte
+	if _, err := hex.Decode(sc.traceID[:], []byte(parts[1])); err != nil {
+		return spanContext{}, err
+	}
+	if _, err := hex.Decode(sc.spanID[:], []byte(parts[2])); err != nil {
+		return spanContext{}, err
+	}
+	if _, err := hex.Decode(flags[:], []byte(parts[3])); err != nil {
+		return spanContext{}, err
+	}
+	if sc.traceID == ([16]byte{}) || sc.spanID == ([8]byte{}) {
+		return spanContext{}, errors.New("invalid traceparent")
+	}
+	sc.sampled = flags[0]&1 == 1
+	return sc, nil
+}
+
+// attribute is a key-value pair describing a span. The value is a string, an
+// int64 or a bool.
+type attribute struct {
+	key   string
+	value interface{}
+}
+
+// Span is a timed operation within a trace.
+//
+// A nil Span is valid and does nothing, which is what Start returns if
+// tracing is disabled or the trace is not sampled.
+type Span struct {
+	e        *Exporter
+	name     string
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	server   bool
+	start    int64
+	end      int64
+	attrs    []attribute
+	err      string
+}
+
+// Start starts a span as a child of the span of the context, or as the root
+// span of a new trace. The returned context carries the new span.
+//
+// Root spans and children of remote spans represent requests served by
+// Chihaya. New traces are sampled at the ratio configured for the Exporter;
+// children of spans follow the decision of their parent.
+func Start(ctx context.Context, name string) (context.Context, *Span) {
+	e := exporter()
+	if e == nil {
+		return ctx, nil
+	}
+
+	parent, hasParent := fromContext(ctx)
+	if hasParent && !parent.sampled {
+		return ctx, nil
+	}
+
+	s := &Span{e: e, name: name, start: time.Now().UnixNano()}
+	if hasParent {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+		s.server = parent.remote
+	} else {
+		binary.BigEndian.PutUint64(s.traceID[:8], rand.Uint64())
+		binary.BigEndian.PutUint64(s.traceID[8:], rand.Uint64())
+		s.server = true
+	}
+	binary.BigEndian.PutUint64(s.spanID[:], rand.Uint64()|1)
+
+	if !hasParent && !e.sample(s.traceID) {
+		// The children of the span must not start new traces.
+		return context.WithValue(ctx, spanContextKey{}, spanContext{traceID: s.traceID}), nil
+	}
+
+	return context.WithValue(ctx, spanContextKey{}, spanContext{
+		traceID: s.traceID,
+		spanID:  s.spanID,
+		sampled: true,
+	}), s
+}
+
+// SetAttribute sets an attribute of the span. Values other than strings,
+// integers and bools are ignored.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	switch v := value.(type) {
+	case string, bool:
+	case int:
+		value = int64(v)
+	case int64:
+	case uint16:
+		value = int64(v)
+	case uint32:
+		value = int64(v)
+	case uint64:
+		if v > math.MaxInt64 {
+			v = math.MaxInt64
+		}
+		value = int64(v)
+	default:
+		return
+	}
+	s.attrs = append(s.attrs, attribute{key: key, value: value})
+}
+
+// SetError marks the span as failed if err is not nil.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.err = err.Error()
+}
+
+// End ends the span and queues it for export.
+// The span must not be used afterwards.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.end = time.Now().UnixNano()
+	s.e.enqueue(s)
+}
@@ -0,0 +1,157 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// collector records the spans exported to it.
+type collector struct {
+	*httptest.Server
+
+	mu    sync.Mutex
+	spans []otlpSpan
+}
+
+func newCollector(t *testing.T) *collector {
+	c := &collector{}
+	c.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		require.Equal(t, "secret", r.Header.Get("Authorization"))
+
+		var req otlpRequest
+		require.Nil(t, json.NewDecoder(r.Body).Decode(&req))
+		require.Equal(t, "chihaya", *req.ResourceSpans[0].Resource.Attributes[0].Value.StringValue)
+
+		c.mu.Lock()
+		c.spans = append(c.spans, req.ResourceSpans[0].ScopeSpans[0].Spans...)
+		c.mu.Unlock()
+	}))
+	t.Cleanup(c.Close)
+	return c
+}
+
+func (c *collector) exporter(ratio float64) *Exporter {
+	return NewExporter(Config{
+		Endpoint:    c.URL,
+		Headers:     map[string]string{"Authorization": "secret"},
+		SampleRatio: ratio,
+	})
+}
+
+func TestDisabled(t *testing.T) {
+	require.False(t, Enabled())
+
+	ctx, span := Start(context.Background(), "disabled")
+	require.Nil(t, span)
+	require.Equal(t, context.Background(), ctx)
+
+	// Nil spans can be used like any other.
+	span.SetAttribute("key", "value")
+	span.SetError(errors.New("failure"))
+	span.End()
+}
+
+func TestExport(t *testing.T) {
+	c := newCollector(t)
+	e := c.exporter(1)
+	require.True(t, Enabled())
+
+	ctx, root := Start(context.Background(), "root")
+	root.SetAttribute("port", uint16(6881))
+	_, child := Start(ctx, "child")
+	child.SetError(errors.New("failure"))
+	child.End()
+	root.End()
+
+	require.Nil(t, <-e.Stop())
+	require.False(t, Enabled())
+
+	require.Len(t, c.spans, 2)
+	require.Equal(t, "child", c.spans[0].Name)
+	require.Equal(t, otlpKindInternal, c.spans[0].Kind)
+	require.Equal(t, otlpStatus{Code: otlpStatusError, Message: "failure"}, c.spans[0].Status)
+
+	require.Equal(t, "root", c.spans[1].Name)
+	require.Equal(t, otlpKindServer, c.spans[1].Kind)
+	require.Equal(t, "", c.spans[1].ParentSpanID)
+	require.Equal(t, "6881", *c.spans[1].Attributes[0].Value.IntValue)
+
+	require.Equal(t, c.spans[1].TraceID, c.spans[0].TraceID)
+	require.Equal(t, c.spans[1].SpanID, c.spans[0].ParentSpanID)
+}
+
+func TestRemoteParent(t *testing.T) {
+	c := newCollector(t)
+	e := c.exporter(1)
+
+	const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	_, span := Start(ContextWithRemoteParent(context.Background(), traceparent), "continued")
+	require.NotNil(t, span)
+	span.End()
+
+	// Traces the client doesn't record are not recorded either, regardless
+	// of the sample ratio.
+	ctx, span := Start(ContextWithRemoteParent(context.Background(), traceparent[:len(traceparent)-1]+"0"), "unsampled")
+	require.Nil(t, span)
+	_, span = Start(ctx, "child")
+	require.Nil(t, span)
+
+	for _, invalid := range []string{"", "00-4bf92f3577b34da6a3ce929d0e0e4736", "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"} {
+		require.Equal(t, context.Background(), ContextWithRemoteParent(context.Background(), invalid))
+	}
+
+	require.Nil(t, <-e.Stop())
+
+	require.Len(t, c.spans, 1)
+	require.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", c.spans[0].TraceID)
+	require.Equal(t, "00f067aa0ba902b7", c.spans[0].ParentSpanID)
+	require.Equal(t, otlpKindServer, c.spans[0].Kind)
+}
+
+func TestUnwind(t *testing.T) {
+	c := newCollector(t)
+	e := c.exporter(1)
+	defer func() { require.Nil(t, <-e.Stop()) }()
+
+	type key struct{}
+	parent, root := Start(context.Background(), "root")
+	ctx, hook := Start(parent, "hook")
+	ctx = context.WithValue(ctx, key{}, true)
+	hook.End()
+
+	ctx = Unwind(ctx, parent)
+	require.Equal(t, true, ctx.Value(key{}))
+	_, next := Start(ctx, "next")
+	require.Equal(t, root.spanID, next.parentID)
+
+	// Unwinding to a context without a span makes the next span a root.
+	_, next = Start(Unwind(ctx, context.Background()), "next")
+	require.Equal(t, [8]byte{}, next.parentID)
+	require.NotEqual(t, root.traceID, next.traceID)
+}
+
+func TestSampling(t *testing.T) {
+	e := NewExporter(Config{Endpoint: "http://localhost", SampleRatio: 0.5})
+	defer func() { require.Nil(t, <-e.Stop()) }()
+
+	var sampled int
+	for i := 0; i < 1000; i++ {
+		ctx, span := Start(context.Background(), "root")
+		if span != nil {
+			sampled++
+			continue
+		}
+		// The children of unsampled spans are not sampled either.
+		_, span = Start(ctx, "child")
+		require.Nil(t, span)
+	}
+	require.InDelta(t, 500, sampled, 100)
+}
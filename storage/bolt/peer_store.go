@@ -0,0 +1,561 @@
+// Package bolt implements the storage interface for a Chihaya BitTorrent
+// tracker keeping peer data in memory and persisting it to a local bbolt
+// database, so that peers survive restarts without an external database.
+package bolt
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/pkg/stop"
+	"github.com/chihaya/chihaya/pkg/timecache"
+	"github.com/chihaya/chihaya/storage"
+	"github.com/chihaya/chihaya/storage/memory"
+)
+
+// Name is the name by which this peer store is registered with Chihaya.
+const Name = "bolt"
+
+// Default config constants.
+const (
+	defaultPath                        = "chihaya.db"
+	defaultFlushInterval               = time.Second
+	defaultShardCount                  = 1024
+	defaultPrometheusReportingInterval = time.Second * 1
+	defaultGarbageCollectionInterval   = time.Minute * 3
+	defaultPeerLifetime                = time.Minute * 30
+)
+
+func init() {
+	// Register the storage driver.
+	storage.RegisterDriver(Name, driver{})
+}
+
+type driver struct{}
+
+func (d driver) NewPeerStore(icfg interface{}) (storage.PeerStore, error) {
+	// Marshal the config back into bytes.
+	bytes, err := yaml.Marshal(icfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// Unmarshal the bytes into the proper config type.
+	var cfg Config
+	err = yaml.Unmarshal(bytes, &cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return New(cfg)
+}
+
+// Config holds the configuration of a bolt PeerStore.
+//
+// The swarms are kept in memory like by the memory PeerStore, which is
+// configured by the fields shared with its Config. Changes are written to the
+// database at Path every FlushInterval.
+type Config struct {
+	Path                        string        `yaml:"path"`
+	FlushInterval               time.Duration `yaml:"flush_interval"`
+	GarbageCollectionInterval   time.Duration `yaml:"gc_interval"`
+	PrometheusReportingInterval time.Duration `yaml:"prometheus_reporting_interval"`
+	PeerLifetime                time.Duration `yaml:"peer_lifetime"`
+	ShardCount                  int           `yaml:"shard_count"`
+}
+
+// LogFields renders the current config as a set of Logrus fields.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"name":               Name,
+		"path":               cfg.Path,
+		"flushInterval":      cfg.FlushInterval,
+		"gcInterval":         cfg.GarbageCollectionInterval,
+		"promReportInterval": cfg.PrometheusReportingInterval,
+		"peerLifetime":       cfg.PeerLifetime,
+		"shardCount":         cfg.ShardCount,
+	}
+}
+
+// memoryConfig returns the config of the in-memory index.
+func (cfg Config) memoryConfig() memory.Config {
+	return memory.Config{
+		GarbageCollectionInterval:   cfg.GarbageCollectionInterval,
+		PrometheusReportingInterval: cfg.PrometheusReportingInterval,
+		PeerLifetime:                cfg.PeerLifetime,
+		ShardCount:                  cfg.ShardCount,
+	}
+}
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+//
+// This function warns to the logger when a value is changed.
+func (cfg Config) Validate() Config {
+	validcfg := cfg
+
+	if cfg.Path == "" {
+		validcfg.Path = defaultPath
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".Path",
+			"provided": cfg.Path,
+			"default":  validcfg.Path,
+		})
+	}
+
+	if cfg.FlushInterval <= 0 {
+		validcfg.FlushInterval = defaultFlushInterval
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".FlushInterval",
+			"provided": cfg.FlushInterval,
+			"default":  validcfg.FlushInterval,
+		})
+	}
+
+	if cfg.ShardCount <= 0 || cfg.ShardCount > (math.MaxInt/2) {
+		validcfg.ShardCount = defaultShardCount
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".ShardCount",
+			"provided": cfg.ShardCount,
+			"default":  validcfg.ShardCount,
+		})
+	}
+
+	if cfg.GarbageCollectionInterval <= 0 {
+		validcfg.GarbageCollectionInterval = defaultGarbageCollectionInterval
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".GarbageCollectionInterval",
+			"provided": cfg.GarbageCollectionInterval,
+			"default":  validcfg.GarbageCollectionInterval,
+		})
+	}
+
+	if cfg.PrometheusReportingInterval <= 0 {
+		validcfg.PrometheusReportingInterval = defaultPrometheusReportingInterval
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".PrometheusReportingInterval",
+			"provided": cfg.PrometheusReportingInterval,
+			"default":  validcfg.PrometheusReportingInterval,
+		})
+	}
+
+	if cfg.PeerLifetime <= 0 {
+		validcfg.PeerLifetime = defaultPeerLifetime
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".PeerLifetime",
+			"provided": cfg.PeerLifetime,
+			"default":  validcfg.PeerLifetime,
+		})
+	}
+
+	return validcfg
+}
+
+// peersBucket is the bucket all peers are stored in.
+//
+// The key of a peer consists of the address family (1 byte), the infohash
+// (20 bytes), the kind (1 byte, seederKind or leecherKind) and the peer
+// encoded by bittorrent.EncodePeer.
+// The value is the time of the last announce in nanoseconds since the epoch
+// (8 bytes).
+var peersBucket = []byte("peers")
+
+// Kinds of peers.
+const (
+	seederKind  = 's'
+	leecherKind = 'l'
+)
+
+func peerKey(ih bittorrent.InfoHash, kind byte, p bittorrent.Peer) string {
+	b := make([]byte, 1+20+1, 1+20+1+20+2+len(p.IP.IP))
+	b[0] = byte(p.IP.AddressFamily)
+	copy(b[1:21], ih[:])
+	b[21] = kind
+	return string(append(b, bittorrent.EncodePeer(p)...))
+}
+
+func decodePeerKey(k []byte) (ih bittorrent.InfoHash, kind byte, p bittorrent.Peer, err error) {
+	if len(k) < 22 {
+		return ih, 0, p, fmt.Errorf("invalid peer key of length %d", len(k))
+	}
+	if p, err = bittorrent.EncodedPeer(k[22:]).Decode(); err != nil {
+		return ih, 0, p, fmt.Errorf("invalid peer key: %w", err)
+	}
+
+	copy(ih[:], k[1:21])
+	return ih, k[21], p, nil
+}
+
+// memoryIndex is the in-memory PeerStore that serves all reads.
+type memoryIndex interface {
+	storage.ClearablePeerStore
+	storage.FullScraper
+	storage.PeerMixer
+	storage.Exporter
+}
+
+type peerStore struct {
+	memoryIndex
+
+	cfg Config
+	db  *bolt.DB
+
+	// flushMu serializes writing pending changes with clearing the
+	// database, so that cleared peers are not written back.
+	flushMu sync.Mutex
+
+	// pending maps the keys of changed peers to their new mtime, or to
+	// deleted for peers that were removed.
+	pendingMu sync.Mutex
+	pending   map[string]int64
+
+	closed chan struct{}
+	wg     sync.WaitGroup
+}
+
+// deleted marks pending deletions.
+const deleted = -1
+
+var (
+	_ storage.PeerStore          = &peerStore{}
+	_ storage.FullScraper        = &peerStore{}
+	_ storage.PeerMixer          = &peerStore{}
+	_ storage.Exporter           = &peerStore{}
+	_ storage.Pinger             = &peerStore{}
+	_ storage.ClearablePeerStore = &peerStore{}
+)
+
+// New creates a new PeerStore backed by memory and a bbolt database.
+// The peers stored in the database are restored, if they didn't expire.
+func New(provided Config) (storage.PeerStore, error) {
+	cfg := provided.Validate()
+
+	db, err := bolt.Open(cfg.Path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", cfg.Path, err)
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(peersBucket)
+		return err
+	}); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	mem, err := memory.New(cfg.memoryConfig())
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	ps := &peerStore{
+		memoryIndex: mem.(memoryIndex),
+		cfg:         cfg,
+		db:          db,
+		pending:     make(map[string]int64),
+		closed:      make(chan struct{}),
+	}
+
+	if err := ps.restore(time.Now().Add(-cfg.PeerLifetime)); err != nil {
+		db.Close()
+		mem.Stop().Wait()
+		return nil, fmt.Errorf("failed to restore peers from %s: %w", cfg.Path, err)
+	}
+
+	// Start a goroutine for writing changes and collecting garbage.
+	ps.wg.Add(1)
+	go func() {
+		defer ps.wg.Done()
+		flush := time.NewTicker(cfg.FlushInterval)
+		defer flush.Stop()
+		gc := time.NewTicker(cfg.GarbageCollectionInterval)
+		defer gc.Stop()
+		for {
+			select {
+			case <-ps.closed:
+				return
+			case <-flush.C:
+				if err := ps.flush(); err != nil {
+					log.Error("storage: failed to write peers", log.Fields{"path": cfg.Path}, log.Err(err))
+				}
+			case <-gc.C:
+				before := time.Now().Add(-cfg.PeerLifetime)
+				if err := ps.collectGarbage(before); err != nil {
+					log.Error("storage: failed to purge peers", log.Fields{"path": cfg.Path}, log.Err(err))
+				}
+			}
+		}
+	}()
+
+	return ps, nil
+}
+
+// restore adds the peers of the database that were updated after cutoff to
+// the in-memory index.
+// Restored peers get the time of the restore as their last announce.
+func (ps *peerStore) restore(cutoff time.Time) error {
+	start := time.Now()
+	cutoffUnix := cutoff.UnixNano()
+
+	var numPeers int
+	err := ps.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(peersBucket).ForEach(func(k, v []byte) error {
+			if len(v) != 8 || int64(binary.BigEndian.Uint64(v)) <= cutoffUnix {
+				return nil
+			}
+			ih, kind, p, err := decodePeerKey(k)
+			if err != nil {
+				return err
+			}
+
+			numPeers++
+			if kind == seederKind {
+				return ps.memoryIndex.PutSeeder(ih, p)
+			}
+			return ps.memoryIndex.PutLeecher(ih, p)
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Info("storage: restored peers", log.Fields{
+		"path":      ps.cfg.Path,
+		"peers":     numPeers,
+		"timeTaken": time.Since(start),
+	})
+	return nil
+}
+
+// record marks changes of peers to be written with the next flush.
+func (ps *peerStore) record(mtime int64, keys ...string) {
+	ps.pendingMu.Lock()
+	for _, k := range keys {
+		ps.pending[k] = mtime
+	}
+	ps.pendingMu.Unlock()
+}
+
+// maxBatchSize is the maximum number of keys changed in one transaction.
+// bbolt keeps the changed nodes of a transaction in memory and inserting into
+// large nodes gets slow, so large changes are split into several transactions.
+const maxBatchSize = 10000
+
+// flush writes all pending changes to the database.
+func (ps *peerStore) flush() error {
+	ps.flushMu.Lock()
+	defer ps.flushMu.Unlock()
+
+	ps.pendingMu.Lock()
+	pending := ps.pending
+	ps.pending = make(map[string]int64, len(pending))
+	ps.pendingMu.Unlock()
+
+	// bbolt writes keys much faster in order.
+	keys := make([]string, 0, len(pending))
+	for k := range pending {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for len(keys) > 0 {
+		batch := keys
+		if len(batch) > maxBatchSize {
+			batch = batch[:maxBatchSize]
+		}
+		keys = keys[len(batch):]
+
+		err := ps.db.Update(func(tx *bolt.Tx) error {
+			b := tx.Bucket(peersBucket)
+			var v [8]byte
+			for _, k := range batch {
+				if mtime := pending[k]; mtime != deleted {
+					binary.BigEndian.PutUint64(v[:], uint64(mtime))
+					if err := b.Put([]byte(k), v[:]); err != nil {
+						return err
+					}
+				} else if err := b.Delete([]byte(k)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Clear implements storage.ClearablePeerStore by deleting the peers in memory,
+// the pending changes and all peers of the database.
+func (ps *peerStore) Clear() error {
+	if err := ps.memoryIndex.Clear(); err != nil {
+		return err
+	}
+
+	ps.flushMu.Lock()
+	defer ps.flushMu.Unlock()
+
+	ps.pendingMu.Lock()
+	ps.pending = make(map[string]int64)
+	ps.pendingMu.Unlock()
+
+	err := ps.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(peersBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucket(peersBucket)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Info("storage: cleared database", log.Fields{"path": ps.cfg.Path})
+	return nil
+}
+
+// CollectGarbage implements storage.GarbageCollector.
+func (ps *peerStore) CollectGarbage() error {
+	return ps.collectGarbage(time.Now().Add(-ps.cfg.PeerLifetime))
+}
+
+// collectGarbage deletes all peers from the database which are older than the
+// cutoff time. The in-memory index collects its garbage itself.
+func (ps *peerStore) collectGarbage(cutoff time.Time) error {
+	cutoffUnix := cutoff.UnixNano()
+	start := time.Now()
+
+	// Deleting while iterating with a cursor skips keys, so the expired keys
+	// are collected first.
+	var expired [][]byte
+	err := ps.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(peersBucket).ForEach(func(k, v []byte) error {
+			if len(v) != 8 || int64(binary.BigEndian.Uint64(v)) <= cutoffUnix {
+				expired = append(expired, append([]byte(nil), k...))
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < len(expired); i += maxBatchSize {
+		batch := expired[i:]
+		if len(batch) > maxBatchSize {
+			batch = batch[:maxBatchSize]
+		}
+
+		// Peers that announced since they were collected are kept.
+		err := ps.db.Update(func(tx *bolt.Tx) error {
+			b := tx.Bucket(peersBucket)
+			for _, k := range batch {
+				if v := b.Get(k); v != nil && len(v) == 8 && int64(binary.BigEndian.Uint64(v)) > cutoffUnix {
+					continue
+				}
+				if err := b.Delete(k); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	log.Debug("storage: purged peers from database", log.Fields{
+		"peers":     len(expired),
+		"timeTaken": time.Since(start),
+	})
+	return nil
+}
+
+func (ps *peerStore) PutSeeder(ih bittorrent.InfoHash, p bittorrent.Peer) error {
+	if err := ps.memoryIndex.PutSeeder(ih, p); err != nil {
+		return err
+	}
+	ps.record(timecache.NowUnixNano(), peerKey(ih, seederKind, p))
+	return nil
+}
+
+func (ps *peerStore) DeleteSeeder(ih bittorrent.InfoHash, p bittorrent.Peer) error {
+	if err := ps.memoryIndex.DeleteSeeder(ih, p); err != nil {
+		return err
+	}
+	ps.record(deleted, peerKey(ih, seederKind, p))
+	return nil
+}
+
+func (ps *peerStore) PutLeecher(ih bittorrent.InfoHash, p bittorrent.Peer) error {
+	if err := ps.memoryIndex.PutLeecher(ih, p); err != nil {
+		return err
+	}
+	ps.record(timecache.NowUnixNano(), peerKey(ih, leecherKind, p))
+	return nil
+}
+
+func (ps *peerStore) DeleteLeecher(ih bittorrent.InfoHash, p bittorrent.Peer) error {
+	if err := ps.memoryIndex.DeleteLeecher(ih, p); err != nil {
+		return err
+	}
+	ps.record(deleted, peerKey(ih, leecherKind, p))
+	return nil
+}
+
+func (ps *peerStore) GraduateLeecher(ih bittorrent.InfoHash, p bittorrent.Peer) error {
+	if err := ps.memoryIndex.GraduateLeecher(ih, p); err != nil {
+		return err
+	}
+	ps.record(deleted, peerKey(ih, leecherKind, p))
+	ps.record(timecache.NowUnixNano(), peerKey(ih, seederKind, p))
+	return nil
+}
+
+// Ping implements storage.Pinger by checking that the database can be read
+// and the peers in memory respond.
+func (ps *peerStore) Ping(ctx context.Context) error {
+	if err := ps.db.View(func(*bolt.Tx) error { return nil }); err != nil {
+		return err
+	}
+	return storage.Ping(ctx, ps.memoryIndex)
+}
+
+// Stop writes the pending changes, closes the database and stops the
+// in-memory index.
+func (ps *peerStore) Stop() stop.Result {
+	c := make(stop.Channel)
+	go func() {
+		close(ps.closed)
+		ps.wg.Wait()
+
+		var errs []error
+		if err := ps.flush(); err != nil {
+			errs = append(errs, err)
+		}
+		if err := ps.db.Close(); err != nil {
+			errs = append(errs, err)
+		}
+		errs = append(errs, ps.memoryIndex.Stop().Wait()...)
+
+		c.Done(errs...)
+	}()
+
+	return c.Result()
+}
+
+func (ps *peerStore) LogFields() log.Fields {
+	return ps.cfg.LogFields()
+}
@@ -0,0 +1,147 @@
+package bolt
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	s "github.com/chihaya/chihaya/storage"
+)
+
+// testDir holds the databases created by the tests.
+var (
+	testDir     string
+	testCounter uint64
+)
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "chihaya-bolt")
+	if err != nil {
+		panic(err)
+	}
+	testDir = dir
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func testConfig() Config {
+	return Config{
+		Path:                        filepath.Join(testDir, fmt.Sprintf("%d.db", atomic.AddUint64(&testCounter, 1))),
+		FlushInterval:               time.Second,
+		ShardCount:                  1024,
+		GarbageCollectionInterval:   10 * time.Minute,
+		PrometheusReportingInterval: 10 * time.Minute,
+		PeerLifetime:                30 * time.Minute,
+	}
+}
+
+func createNew() s.PeerStore {
+	ps, err := New(testConfig())
+	if err != nil {
+		panic(err)
+	}
+	return ps
+}
+
+func TestPeerStore(t *testing.T)   { s.TestPeerStore(t, createNew()) }
+func TestFullScraper(t *testing.T) { s.TestFullScraper(t, createNew()) }
+func TestPeerMixer(t *testing.T)   { s.TestPeerMixer(t, createNew()) }
+func TestExporter(t *testing.T)    { s.TestExporter(t, createNew()) }
+
+func TestClearablePeerStore(t *testing.T) { s.TestClearablePeerStore(t, createNew()) }
+
+func TestClearDatabase(t *testing.T) {
+	cfg := testConfig()
+	ih := bittorrent.InfoHash{1}
+	flushed := bittorrent.Peer{ID: bittorrent.PeerID{1}, IP: bittorrent.IP{IP: net.IPv4(10, 0, 0, 1).To4(), AddressFamily: bittorrent.IPv4}, Port: 1}
+	pending := bittorrent.Peer{ID: bittorrent.PeerID{2}, IP: bittorrent.IP{IP: net.IPv4(10, 0, 0, 2).To4(), AddressFamily: bittorrent.IPv4}, Port: 2}
+
+	ps, err := New(cfg)
+	require.Nil(t, err)
+	require.Nil(t, ps.PutSeeder(ih, flushed))
+	require.Nil(t, ps.(*peerStore).flush())
+	require.Nil(t, ps.PutLeecher(ih, pending))
+	require.Nil(t, ps.(s.ClearablePeerStore).Clear())
+	require.Empty(t, ps.Stop().Wait())
+
+	// Neither written nor pending peers are restored.
+	ps, err = New(cfg)
+	require.Nil(t, err)
+	require.Equal(t, bittorrent.Scrape{InfoHash: ih}, ps.ScrapeSwarm(ih, bittorrent.IPv4))
+	require.Empty(t, ps.Stop().Wait())
+}
+
+func TestRestore(t *testing.T) {
+	cfg := testConfig()
+	ih := bittorrent.InfoHash{1}
+	v4 := bittorrent.Peer{ID: bittorrent.PeerID{1}, IP: bittorrent.IP{IP: net.IPv4(10, 0, 0, 1).To4(), AddressFamily: bittorrent.IPv4}, Port: 1}
+	v6 := bittorrent.Peer{ID: bittorrent.PeerID{2}, IP: bittorrent.IP{IP: net.ParseIP("fc00::1"), AddressFamily: bittorrent.IPv6}, Port: 2}
+	gone := bittorrent.Peer{ID: bittorrent.PeerID{3}, IP: bittorrent.IP{IP: net.IPv4(10, 0, 0, 3).To4(), AddressFamily: bittorrent.IPv4}, Port: 3}
+
+	ps, err := New(cfg)
+	require.Nil(t, err)
+	require.Nil(t, ps.PutLeecher(ih, v4))
+	require.Nil(t, ps.GraduateLeecher(ih, v4))
+	require.Nil(t, ps.PutLeecher(ih, v6))
+	require.Nil(t, ps.PutLeecher(ih, gone))
+	require.Nil(t, ps.DeleteLeecher(ih, gone))
+	// Stopping writes the pending changes.
+	require.Empty(t, ps.Stop().Wait())
+
+	ps, err = New(cfg)
+	require.Nil(t, err)
+	require.Equal(t, bittorrent.Scrape{InfoHash: ih, Complete: 1}, ps.ScrapeSwarm(ih, bittorrent.IPv4))
+	require.Equal(t, bittorrent.Scrape{InfoHash: ih, Incomplete: 1}, ps.ScrapeSwarm(ih, bittorrent.IPv6))
+
+	peers, err := ps.AnnouncePeers(ih, false, 10, gone)
+	require.Nil(t, err)
+	require.Len(t, peers, 1)
+	require.True(t, peers[0].Equal(v4))
+
+	// Expired peers are purged from the database.
+	require.Nil(t, ps.(*peerStore).collectGarbage(time.Now().Add(time.Minute)))
+	require.Empty(t, ps.Stop().Wait())
+
+	ps, err = New(cfg)
+	require.Nil(t, err)
+	require.Equal(t, bittorrent.Scrape{InfoHash: ih}, ps.ScrapeSwarm(ih, bittorrent.IPv4))
+	require.Empty(t, ps.Stop().Wait())
+}
+
+func BenchmarkNop(b *testing.B)                        { s.Nop(b, createNew()) }
+func BenchmarkPut(b *testing.B)                        { s.Put(b, createNew()) }
+func BenchmarkPut1k(b *testing.B)                      { s.Put1k(b, createNew()) }
+func BenchmarkPut1kInfohash(b *testing.B)              { s.Put1kInfohash(b, createNew()) }
+func BenchmarkPut1kInfohash1k(b *testing.B)            { s.Put1kInfohash1k(b, createNew()) }
+func BenchmarkPutDelete(b *testing.B)                  { s.PutDelete(b, createNew()) }
+func BenchmarkPutDelete1k(b *testing.B)                { s.PutDelete1k(b, createNew()) }
+func BenchmarkPutDelete1kInfohash(b *testing.B)        { s.PutDelete1kInfohash(b, createNew()) }
+func BenchmarkPutDelete1kInfohash1k(b *testing.B)      { s.PutDelete1kInfohash1k(b, createNew()) }
+func BenchmarkDeleteNonexist(b *testing.B)             { s.DeleteNonexist(b, createNew()) }
+func BenchmarkDeleteNonexist1k(b *testing.B)           { s.DeleteNonexist1k(b, createNew()) }
+func BenchmarkDeleteNonexist1kInfohash(b *testing.B)   { s.DeleteNonexist1kInfohash(b, createNew()) }
+func BenchmarkDeleteNonexist1kInfohash1k(b *testing.B) { s.DeleteNonexist1kInfohash1k(b, createNew()) }
+func BenchmarkPutGradDelete(b *testing.B)              { s.PutGradDelete(b, createNew()) }
+func BenchmarkPutGradDelete1k(b *testing.B)            { s.PutGradDelete1k(b, createNew()) }
+func BenchmarkPutGradDelete1kInfohash(b *testing.B)    { s.PutGradDelete1kInfohash(b, createNew()) }
+func BenchmarkPutGradDelete1kInfohash1k(b *testing.B)  { s.PutGradDelete1kInfohash1k(b, createNew()) }
+func BenchmarkGradNonexist(b *testing.B)               { s.GradNonexist(b, createNew()) }
+func BenchmarkGradNonexist1k(b *testing.B)             { s.GradNonexist1k(b, createNew()) }
+func BenchmarkGradNonexist1kInfohash(b *testing.B)     { s.GradNonexist1kInfohash(b, createNew()) }
+func BenchmarkGradNonexist1kInfohash1k(b *testing.B)   { s.GradNonexist1kInfohash1k(b, createNew()) }
+func BenchmarkAnnounceLeecher(b *testing.B)            { s.AnnounceLeecher(b, createNew()) }
+func BenchmarkAnnounceLeecher1kInfohash(b *testing.B)  { s.AnnounceLeecher1kInfohash(b, createNew()) }
+func BenchmarkAnnounceSeeder(b *testing.B)             { s.AnnounceSeeder(b, createNew()) }
+func BenchmarkAnnounceSeeder1kInfohash(b *testing.B)   { s.AnnounceSeeder1kInfohash(b, createNew()) }
+func BenchmarkScrapeSwarm(b *testing.B)                { s.ScrapeSwarm(b, createNew()) }
+func BenchmarkScrapeSwarm1kInfohash(b *testing.B)      { s.ScrapeSwarm1kInfohash(b, createNew()) }
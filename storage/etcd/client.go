@@ -0,0 +1,316 @@
+package etcd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// client is a minimal client of the JSON gateway of the etcd v3 API.
+//
+// The gateway is served by every etcd member next to the gRPC API, so this
+// avoids depending on the gRPC client of etcd.
+type client struct {
+	endpoints []string
+	username  string
+	password  string
+	http      *http.Client
+
+	mu sync.Mutex
+	// next is the index of the endpoint that is tried first.
+	next  int
+	token string
+}
+
+func newClient(cfg Config) *client {
+	endpoints := make([]string, len(cfg.Endpoints))
+	for i, e := range cfg.Endpoints {
+		endpoints[i] = strings.TrimSuffix(e, "/")
+	}
+	return &client{
+		endpoints: endpoints,
+		username:  cfg.Username,
+		password:  cfg.Password,
+		http:      &http.Client{Timeout: cfg.RequestTimeout},
+	}
+}
+
+// gatewayError is an error returned by the gateway.
+type gatewayError struct {
+	Message string `json:"message"`
+	Code    int    `json:"code"`
+}
+
+func (e gatewayError) Error() string { return "etcd: " + e.Message }
+
+// errInvalidToken is the message of the error returned for expired tokens.
+const errInvalidToken = "etcdserver: invalid auth token"
+
+// call posts req as JSON to the path of the gateway and decodes the response
+// into resp.
+//
+// Endpoints are tried in turn until one of them responds.
+func (c *client) call(path string, req, resp interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	first := c.next
+	c.mu.Unlock()
+
+	var lastErr error
+	for i := range c.endpoints {
+		idx := (first + i) % len(c.endpoints)
+		err := c.post(c.endpoints[idx], path, body, resp)
+
+		var gwErr gatewayError
+		switch {
+		case err == nil:
+			if idx != first {
+				c.mu.Lock()
+				c.next = idx
+				c.mu.Unlock()
+			}
+			return nil
+		case errors.As(err, &gwErr) && gwErr.Message == errInvalidToken:
+			// The token expired, authenticate again.
+			c.mu.Lock()
+			c.token = ""
+			c.mu.Unlock()
+			return c.post(c.endpoints[idx], path, body, resp)
+		case errors.As(err, &gwErr):
+			// The member responded, trying others won't help.
+			return err
+		}
+		lastErr = err
+	}
+	return lastErr
+}
+
+func (c *client) post(endpoint, path string, body []byte, resp interface{}) error {
+	httpReq, err := http.NewRequest(http.MethodPost, endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	if c.username != "" {
+		token, err := c.authenticate(endpoint)
+		if err != nil {
+			return err
+		}
+		httpReq.Header.Set("Authorization", token)
+	}
+
+	httpResp, err := c.http.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusOK {
+		var gwErr gatewayError
+		if err := json.NewDecoder(httpResp.Body).Decode(&gwErr); err != nil || gwErr.Message == "" {
+			return fmt.Errorf("etcd: unexpected status %s", httpResp.Status)
+		}
+		return gwErr
+	}
+
+	err = json.NewDecoder(httpResp.Body).Decode(resp)
+	// Drain the body so that the connection can be reused.
+	_, _ = io.Copy(ioutil.Discard, httpResp.Body)
+	return err
+}
+
+// authenticate returns the current auth token, requesting a new one if
+// necessary.
+func (c *client) authenticate(endpoint string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token != "" {
+		return c.token, nil
+	}
+
+	body, err := json.Marshal(authRequest{Name: c.username, Password: c.password})
+	if err != nil {
+		return "", err
+	}
+	httpResp, err := c.http.Post(endpoint+"/v3/auth/authenticate", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("etcd: failed to authenticate: %s", httpResp.Status)
+	}
+	var resp authResponse
+	if err := json.NewDecoder(httpResp.Body).Decode(&resp); err != nil {
+		return "", err
+	}
+	c.token = resp.Token
+	return c.token, nil
+}
+
+// The messages of the gateway. Byte slices are encoded in base64 and 64-bit
+// integers as strings, like the gateway does.
+
+type authRequest struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+}
+
+type authResponse struct {
+	Token string `json:"token"`
+}
+
+type rangeRequest struct {
+	Key       []byte `json:"key"`
+	RangeEnd  []byte `json:"range_end,omitempty"`
+	Limit     int64  `json:"limit,omitempty,string"`
+	KeysOnly  bool   `json:"keys_only,omitempty"`
+	CountOnly bool   `json:"count_only,omitempty"`
+}
+
+type keyValue struct {
+	Key         []byte `json:"key"`
+	Value       []byte `json:"value,omitempty"`
+	Lease       int64  `json:"lease,omitempty,string"`
+	ModRevision int64  `json:"mod_revision,omitempty,string"`
+}
+
+type rangeResponse struct {
+	Kvs   []keyValue `json:"kvs"`
+	More  bool       `json:"more"`
+	Count int64      `json:"count,omitempty,string"`
+}
+
+type putRequest struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value,omitempty"`
+	Lease int64  `json:"lease,omitempty,string"`
+}
+
+type putResponse struct{}
+
+type deleteRangeRequest struct {
+	Key      []byte `json:"key"`
+	RangeEnd []byte `json:"range_end,omitempty"`
+}
+
+type deleteRangeResponse struct {
+	Deleted int64 `json:"deleted,omitempty,string"`
+}
+
+type requestOp struct {
+	RequestPut         *putRequest         `json:"request_put,omitempty"`
+	RequestDeleteRange *deleteRangeRequest `json:"request_delete_range,omitempty"`
+}
+
+type responseOp struct {
+	ResponsePut         *putResponse         `json:"response_put,omitempty"`
+	ResponseDeleteRange *deleteRangeResponse `json:"response_delete_range,omitempty"`
+}
+
+// compare is a condition of a transaction. Only the comparison of the
+// revision a key was last modified at is used; keys that do not exist have
+// the revision 0.
+type compare struct {
+	Key         []byte `json:"key"`
+	Target      string `json:"target"`
+	Result      string `json:"result"`
+	ModRevision int64  `json:"mod_revision,omitempty,string"`
+}
+
+type txnRequest struct {
+	Compare []compare   `json:"compare,omitempty"`
+	Success []requestOp `json:"success"`
+}
+
+type txnResponse struct {
+	Succeeded bool         `json:"succeeded"`
+	Responses []responseOp `json:"responses"`
+}
+
+type leaseGrantRequest struct {
+	TTL int64 `json:"TTL,string"`
+}
+
+type leaseGrantResponse struct {
+	ID  int64 `json:"ID,string"`
+	TTL int64 `json:"TTL,string"`
+}
+
+// prefixEnd returns the end of the range of all keys with the given prefix.
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	// The prefix consists of 0xff bytes only, the range extends to the end
+	// of the key space.
+	return []byte{0}
+}
+
+func (c *client) rangeKeys(req rangeRequest) (rangeResponse, error) {
+	var resp rangeResponse
+	err := c.call("/v3/kv/range", req, &resp)
+	return resp, err
+}
+
+func (c *client) put(key, value []byte, lease int64) error {
+	return c.call("/v3/kv/put", putRequest{Key: key, Value: value, Lease: lease}, &putResponse{})
+}
+
+func (c *client) deleteKey(key []byte) (deleted int64, err error) {
+	var resp deleteRangeResponse
+	err = c.call("/v3/kv/deleterange", deleteRangeRequest{Key: key}, &resp)
+	return resp.Deleted, err
+}
+
+// deletePrefix deletes all keys with the prefix.
+func (c *client) deletePrefix(prefix []byte) error {
+	return c.call("/v3/kv/deleterange", deleteRangeRequest{Key: prefix, RangeEnd: prefixEnd(prefix)}, &deleteRangeResponse{})
+}
+
+func (c *client) txn(ops ...requestOp) (txnResponse, error) {
+	var resp txnResponse
+	err := c.call("/v3/kv/txn", txnRequest{Success: ops}, &resp)
+	return resp, err
+}
+
+// txnIfUnmodified executes the ops in a transaction if the key was last
+// modified at the revision. Succeeded is false in the response if it was
+// modified since.
+func (c *client) txnIfUnmodified(key []byte, modRevision int64, ops ...requestOp) (txnResponse, error) {
+	var resp txnResponse
+	err := c.call("/v3/kv/txn", txnRequest{
+		Compare: []compare{{Key: key, Target: "MOD", Result: "EQUAL", ModRevision: modRevision}},
+		Success: ops,
+	}, &resp)
+	return resp, err
+}
+
+// status requests the status of a member, which checks that the cluster is
+// reachable.
+func (c *client) status() error {
+	return c.call("/v3/maintenance/status", struct{}{}, &struct{}{})
+}
+
+func (c *client) grantLease(ttl time.Duration) (int64, error) {
+	var resp leaseGrantResponse
+	err := c.call("/v3/lease/grant", leaseGrantRequest{TTL: int64((ttl + time.Second - 1) / time.Second)}, &resp)
+	return resp.ID, err
+}
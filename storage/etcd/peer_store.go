@@ -0,0 +1,811 @@
+// Package etcd implements the storage interface for a Chihaya BitTorrent
+// tracker keeping peer data in etcd, so that multiple trackers can share
+// their swarms.
+//
+// Every peer is stored as a key of the form
+//
+//	<key_prefix>IPv{4,6}/<hex infohash>/{S,L}/<serialized peer>
+//
+// with an empty value. Peers are attached to a lease that is shared by all
+// peers written within a rotation interval, so that etcd expires them
+// without garbage collection by the trackers.
+//
+// The snatches of a swarm are counted in the decimal value of the key
+//
+//	<key_prefix>IPv{4,6}/<hex infohash>/D
+//
+// which is attached to no lease and outlives the peers of the swarm.
+package etcd
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/pkg/stop"
+	"github.com/chihaya/chihaya/storage"
+)
+
+// Name is the name by which this peer store is registered with Chihaya.
+const Name = "etcd"
+
+// Default config constants.
+const (
+	defaultEndpoint                    = "http://127.0.0.1:2379"
+	defaultKeyPrefix                   = "chihaya/"
+	defaultRequestTimeout              = time.Second * 5
+	defaultLeaseRotationInterval       = time.Minute
+	defaultPrometheusReportingInterval = time.Minute
+	defaultPeerLifetime                = time.Minute * 30
+)
+
+// scrapePageSize is the number of keys requested at once by ScrapeAll.
+const scrapePageSize = 10000
+
+// snatchAttempts is the number of times GraduateLeecher tries to increment
+// the snatch counter of a swarm that is graduated concurrently.
+const snatchAttempts = 8
+
+func init() {
+	// Register the storage driver.
+	storage.RegisterDriver(Name, driver{})
+}
+
+type driver struct{}
+
+func (d driver) NewPeerStore(icfg interface{}) (storage.PeerStore, error) {
+	// Marshal the config back into bytes.
+	bytes, err := yaml.Marshal(icfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// Unmarshal the bytes into the proper config type.
+	var cfg Config
+	err = yaml.Unmarshal(bytes, &cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return New(cfg)
+}
+
+// Config holds the configuration of an etcd PeerStore.
+//
+// Peers expire between PeerLifetime and PeerLifetime plus
+// LeaseRotationInterval after their last announce.
+type Config struct {
+	Endpoints                   []string      `yaml:"endpoints"`
+	Username                    string        `yaml:"username"`
+	Password                    string        `yaml:"password"`
+	KeyPrefix                   string        `yaml:"key_prefix"`
+	RequestTimeout              time.Duration `yaml:"request_timeout"`
+	LeaseRotationInterval       time.Duration `yaml:"lease_rotation_interval"`
+	PrometheusReportingInterval time.Duration `yaml:"prometheus_reporting_interval"`
+	PeerLifetime                time.Duration `yaml:"peer_lifetime"`
+}
+
+// LogFields renders the current config as a set of Logrus fields.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"name":                  Name,
+		"endpoints":             cfg.Endpoints,
+		"username":              cfg.Username,
+		"keyPrefix":             cfg.KeyPrefix,
+		"requestTimeout":        cfg.RequestTimeout,
+		"leaseRotationInterval": cfg.LeaseRotationInterval,
+		"promReportInterval":    cfg.PrometheusReportingInterval,
+		"peerLifetime":          cfg.PeerLifetime,
+	}
+}
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+//
+// This function warns to the logger when a value is changed.
+func (cfg Config) Validate() Config {
+	validcfg := cfg
+
+	if len(cfg.Endpoints) == 0 {
+		validcfg.Endpoints = []string{defaultEndpoint}
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".Endpoints",
+			"provided": cfg.Endpoints,
+			"default":  validcfg.Endpoints,
+		})
+	}
+
+	if cfg.KeyPrefix == "" {
+		validcfg.KeyPrefix = defaultKeyPrefix
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".KeyPrefix",
+			"provided": cfg.KeyPrefix,
+			"default":  validcfg.KeyPrefix,
+		})
+	}
+
+	if cfg.RequestTimeout <= 0 {
+		validcfg.RequestTimeout = defaultRequestTimeout
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".RequestTimeout",
+			"provided": cfg.RequestTimeout,
+			"default":  validcfg.RequestTimeout,
+		})
+	}
+
+	if cfg.LeaseRotationInterval < time.Second {
+		validcfg.LeaseRotationInterval = defaultLeaseRotationInterval
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".LeaseRotationInterval",
+			"provided": cfg.LeaseRotationInterval,
+			"default":  validcfg.LeaseRotationInterval,
+		})
+	}
+
+	if cfg.PrometheusReportingInterval <= 0 {
+		validcfg.PrometheusReportingInterval = defaultPrometheusReportingInterval
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".PrometheusReportingInterval",
+			"provided": cfg.PrometheusReportingInterval,
+			"default":  validcfg.PrometheusReportingInterval,
+		})
+	}
+
+	if cfg.PeerLifetime < time.Second {
+		validcfg.PeerLifetime = defaultPeerLifetime
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".PeerLifetime",
+			"provided": cfg.PeerLifetime,
+			"default":  validcfg.PeerLifetime,
+		})
+	}
+
+	return validcfg
+}
+
+// New creates a new PeerStore backed by etcd.
+//
+// A lease is granted right away, so that unreachable clusters are reported
+// on startup.
+func New(provided Config) (storage.PeerStore, error) {
+	cfg := provided.Validate()
+
+	ps := &peerStore{
+		cfg:    cfg,
+		c:      newClient(cfg),
+		closed: make(chan struct{}),
+	}
+	if _, err := ps.currentLease(); err != nil {
+		return nil, err
+	}
+
+	// Start a goroutine for reporting statistics to Prometheus.
+	ps.wg.Add(1)
+	go func() {
+		defer ps.wg.Done()
+		t := time.NewTicker(cfg.PrometheusReportingInterval)
+		for {
+			select {
+			case <-ps.closed:
+				t.Stop()
+				return
+			case <-t.C:
+				before := time.Now()
+				ps.populateProm()
+				log.Debug("storage: populateProm() finished", log.Fields{"timeTaken": time.Since(before)})
+			}
+		}
+	}()
+
+	return ps, nil
+}
+
+// Kinds of peers, as used in keys.
+const (
+	seederKind  = 'S'
+	leecherKind = 'L'
+
+	// snatchKind is the kind of the snatch counter of a swarm.
+	snatchKind = 'D'
+)
+
+func serializePeer(p bittorrent.Peer) []byte {
+	return []byte(bittorrent.EncodePeer(p))
+}
+
+func decodePeer(b []byte, af bittorrent.AddressFamily) (bittorrent.Peer, bool) {
+	p, err := bittorrent.EncodedPeer(b).Decode()
+	if err != nil || p.IP.AddressFamily != af {
+		return bittorrent.Peer{}, false
+	}
+	return p, true
+}
+
+type peerStore struct {
+	cfg Config
+	c   *client
+
+	// lease is attached to all peers written until rotateAt.
+	leaseMu  sync.Mutex
+	lease    int64
+	rotateAt time.Time
+
+	closed chan struct{}
+	wg     sync.WaitGroup
+}
+
+var (
+	_ storage.PeerStore          = &peerStore{}
+	_ storage.FullScraper        = &peerStore{}
+	_ storage.PeerMixer          = &peerStore{}
+	_ storage.Exporter           = &peerStore{}
+	_ storage.Pinger             = &peerStore{}
+	_ storage.ClearablePeerStore = &peerStore{}
+)
+
+func (ps *peerStore) familyPrefix(af bittorrent.AddressFamily) []byte {
+	return []byte(ps.cfg.KeyPrefix + af.String() + "/")
+}
+
+func (ps *peerStore) swarmPrefix(ih bittorrent.InfoHash, af bittorrent.AddressFamily) []byte {
+	return append(ps.familyPrefix(af), ih.String()+"/"...)
+}
+
+func (ps *peerStore) kindPrefix(ih bittorrent.InfoHash, af bittorrent.AddressFamily, kind byte) []byte {
+	return append(ps.swarmPrefix(ih, af), kind, '/')
+}
+
+func (ps *peerStore) snatchKey(ih bittorrent.InfoHash, af bittorrent.AddressFamily) []byte {
+	return append(ps.swarmPrefix(ih, af), snatchKind)
+}
+
+func (ps *peerStore) peerKey(ih bittorrent.InfoHash, kind byte, p bittorrent.Peer) []byte {
+	return append(ps.kindPrefix(ih, p.IP.AddressFamily, kind), serializePeer(p)...)
+}
+
+// currentLease returns the lease to attach peers to, granting a new one if
+// the current one is due for rotation.
+//
+// Leases are granted for PeerLifetime plus the rotation interval, so that
+// every peer lives at least PeerLifetime.
+func (ps *peerStore) currentLease() (int64, error) {
+	ps.leaseMu.Lock()
+	defer ps.leaseMu.Unlock()
+
+	now := time.Now()
+	if ps.lease != 0 && now.Before(ps.rotateAt) {
+		return ps.lease, nil
+	}
+
+	id, err := ps.c.grantLease(ps.cfg.PeerLifetime + ps.cfg.LeaseRotationInterval)
+	if err != nil {
+		return 0, err
+	}
+	log.Debug("storage: granted etcd lease", log.Fields{"lease": id})
+
+	ps.lease = id
+	ps.rotateAt = now.Add(ps.cfg.LeaseRotationInterval)
+	return id, nil
+}
+
+func (ps *peerStore) checkClosed() {
+	select {
+	case <-ps.closed:
+		panic("attempted to interact with stopped etcd store")
+	default:
+	}
+}
+
+// count returns the number of keys with the given prefix.
+func (ps *peerStore) count(prefix []byte) (int64, error) {
+	resp, err := ps.c.rangeKeys(rangeRequest{
+		Key:       prefix,
+		RangeEnd:  prefixEnd(prefix),
+		CountOnly: true,
+	})
+	return resp.Count, err
+}
+
+// randomPeers returns up to n peers with the given key prefix, excluding the
+// peer serialized as excluded.
+//
+// Keys are read from a random position of the range and wrap around to its
+// start, so that different announces see different parts of large swarms.
+func (ps *peerStore) randomPeers(prefix []byte, af bittorrent.AddressFamily, n int, excluded []byte) ([]bittorrent.Peer, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+
+	var id bittorrent.PeerID
+	rand.Read(id[:])
+	start := append(append([]byte(nil), prefix...), id[:]...)
+
+	peers := make([]bittorrent.Peer, 0, n)
+	for _, r := range [][2][]byte{
+		{start, prefixEnd(prefix)},
+		{prefix, start},
+	} {
+		if len(peers) == n {
+			break
+		}
+		resp, err := ps.c.rangeKeys(rangeRequest{
+			Key:      r[0],
+			RangeEnd: r[1],
+			// Request one more key in case the excluded peer is among
+			// them.
+			Limit:    int64(n - len(peers) + 1),
+			KeysOnly: true,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, kv := range resp.Kvs {
+			if len(peers) == n {
+				break
+			}
+			pk := kv.Key[len(prefix):]
+			if bytes.Equal(pk, excluded) {
+				continue
+			}
+			if p, ok := decodePeer(pk, af); ok {
+				peers = append(peers, p)
+			}
+		}
+	}
+
+	return peers, nil
+}
+
+// populateProm aggregates metrics over all address families and then posts
+// them to prometheus.
+//
+// This scans all keys, which is why the reporting interval defaults to a
+// minute.
+func (ps *peerStore) populateProm() {
+	var numInfohashes, numSeeders, numLeechers uint64
+
+	for _, af := range []bittorrent.AddressFamily{bittorrent.IPv4, bittorrent.IPv6} {
+		scrapes, err := ps.ScrapeAll(af)
+		if err != nil {
+			log.Error("storage: failed to count peers", log.Fields{
+				"addressFamily": af,
+				"error":         err,
+			})
+			return
+		}
+
+		numInfohashes += uint64(len(scrapes))
+		for _, s := range scrapes {
+			numSeeders += uint64(s.Complete)
+			numLeechers += uint64(s.Incomplete)
+		}
+	}
+
+	storage.PromInfohashesCount.Set(float64(numInfohashes))
+	storage.PromSeedersCount.Set(float64(numSeeders))
+	storage.PromLeechersCount.Set(float64(numLeechers))
+}
+
+func (ps *peerStore) putPeer(ih bittorrent.InfoHash, kind byte, p bittorrent.Peer) error {
+	lease, err := ps.currentLease()
+	if err != nil {
+		return err
+	}
+	return ps.c.put(ps.peerKey(ih, kind, p), nil, lease)
+}
+
+func (ps *peerStore) deletePeer(ih bittorrent.InfoHash, kind byte, p bittorrent.Peer) error {
+	deleted, err := ps.c.deleteKey(ps.peerKey(ih, kind, p))
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return storage.ErrResourceDoesNotExist
+	}
+	return nil
+}
+
+func (ps *peerStore) PutSeeder(ih bittorrent.InfoHash, p bittorrent.Peer) error {
+	log.Debug("storage: PutSeeder", log.Fields{
+		"InfoHash": ih.String(),
+		"Peer":     p,
+	})
+	ps.checkClosed()
+
+	return ps.putPeer(ih, seederKind, p)
+}
+
+func (ps *peerStore) DeleteSeeder(ih bittorrent.InfoHash, p bittorrent.Peer) error {
+	log.Debug("storage: DeleteSeeder", log.Fields{
+		"InfoHash": ih.String(),
+		"Peer":     p,
+	})
+	ps.checkClosed()
+
+	return ps.deletePeer(ih, seederKind, p)
+}
+
+func (ps *peerStore) PutLeecher(ih bittorrent.InfoHash, p bittorrent.Peer) error {
+	log.Debug("storage: PutLeecher", log.Fields{
+		"InfoHash": ih.String(),
+		"Peer":     p,
+	})
+	ps.checkClosed()
+
+	return ps.putPeer(ih, leecherKind, p)
+}
+
+func (ps *peerStore) DeleteLeecher(ih bittorrent.InfoHash, p bittorrent.Peer) error {
+	log.Debug("storage: DeleteLeecher", log.Fields{
+		"InfoHash": ih.String(),
+		"Peer":     p,
+	})
+	ps.checkClosed()
+
+	return ps.deletePeer(ih, leecherKind, p)
+}
+
+// snatches reads the snatch counter of a swarm and the revision it was last
+// modified at, which is 0 if the swarm was never snatched.
+func (ps *peerStore) snatches(ih bittorrent.InfoHash, af bittorrent.AddressFamily) (n uint32, modRevision int64, err error) {
+	resp, err := ps.c.rangeKeys(rangeRequest{Key: ps.snatchKey(ih, af)})
+	if err != nil || len(resp.Kvs) == 0 {
+		return 0, 0, err
+	}
+	kv := resp.Kvs[0]
+	v, err := strconv.ParseUint(string(kv.Value), 10, 32)
+	if err != nil {
+		return 0, 0, err
+	}
+	return uint32(v), kv.ModRevision, nil
+}
+
+// GraduateLeecher deletes the leecher, puts the seeder and increments the
+// snatch counter in one transaction.
+//
+// The transaction only succeeds if the counter was not changed since it was
+// read, and is retried otherwise. If it keeps failing, the peer is graduated
+// without counting the snatch.
+func (ps *peerStore) GraduateLeecher(ih bittorrent.InfoHash, p bittorrent.Peer) error {
+	log.Debug("storage: GraduateLeecher", log.Fields{
+		"InfoHash": ih.String(),
+		"Peer":     p,
+	})
+	ps.checkClosed()
+
+	lease, err := ps.currentLease()
+	if err != nil {
+		return err
+	}
+	ops := []requestOp{
+		{RequestDeleteRange: &deleteRangeRequest{Key: ps.peerKey(ih, leecherKind, p)}},
+		{RequestPut: &putRequest{Key: ps.peerKey(ih, seederKind, p), Lease: lease}},
+	}
+
+	key := ps.snatchKey(ih, p.IP.AddressFamily)
+	for i := 0; i < snatchAttempts; i++ {
+		n, modRevision, err := ps.snatches(ih, p.IP.AddressFamily)
+		if err != nil {
+			return err
+		}
+		resp, err := ps.c.txnIfUnmodified(key, modRevision, append(ops,
+			requestOp{RequestPut: &putRequest{Key: key, Value: []byte(strconv.FormatUint(uint64(n)+1, 10))}},
+		)...)
+		if err != nil || resp.Succeeded {
+			return err
+		}
+	}
+
+	log.Warn("storage: etcd snatch counter contended, not counting snatch", log.Fields{
+		"InfoHash": ih.String(),
+	})
+	_, err = ps.c.txn(ops...)
+	return err
+}
+
+func (ps *peerStore) AnnouncePeers(ih bittorrent.InfoHash, seeder bool, numWant int, announcer bittorrent.Peer) (peers []bittorrent.Peer, err error) {
+	log.Debug("storage: AnnouncePeers", log.Fields{
+		"InfoHash": ih.String(),
+		"seeder":   seeder,
+		"numWant":  numWant,
+		"Peer":     announcer,
+	})
+	ps.checkClosed()
+
+	af := announcer.IP.AddressFamily
+	announcerPK := serializePeer(announcer)
+
+	if seeder {
+		// Return leechers only.
+		peers, err = ps.randomPeers(ps.kindPrefix(ih, af, leecherKind), af, numWant, nil)
+	} else {
+		// Return as many seeders as possible, then leechers.
+		peers, err = ps.randomPeers(ps.kindPrefix(ih, af, seederKind), af, numWant, nil)
+		if err != nil {
+			return nil, err
+		}
+		var leechers []bittorrent.Peer
+		leechers, err = ps.randomPeers(ps.kindPrefix(ih, af, leecherKind), af, numWant-len(peers), announcerPK)
+		peers = append(peers, leechers...)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(peers) == 0 {
+		// Only an empty response requires telling whether the swarm
+		// exists.
+		n, err := ps.count(ps.swarmPrefix(ih, af))
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			return nil, storage.ErrResourceDoesNotExist
+		}
+	}
+
+	return peers, nil
+}
+
+func (ps *peerStore) AnnounceMixedPeers(ih bittorrent.InfoHash, numSeeders, numLeechers int, announcer bittorrent.Peer) (peers []bittorrent.Peer, err error) {
+	log.Debug("storage: AnnounceMixedPeers", log.Fields{
+		"InfoHash":    ih.String(),
+		"numSeeders":  numSeeders,
+		"numLeechers": numLeechers,
+		"Peer":        announcer,
+	})
+	ps.checkClosed()
+
+	af := announcer.IP.AddressFamily
+	announcerPK := serializePeer(announcer)
+
+	peers, err = ps.randomPeers(ps.kindPrefix(ih, af, seederKind), af, numSeeders, announcerPK)
+	if err != nil {
+		return nil, err
+	}
+	leechers, err := ps.randomPeers(ps.kindPrefix(ih, af, leecherKind), af, numLeechers, announcerPK)
+	if err != nil {
+		return nil, err
+	}
+	peers = append(peers, leechers...)
+
+	if len(peers) == 0 {
+		n, err := ps.count(ps.swarmPrefix(ih, af))
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			return nil, storage.ErrResourceDoesNotExist
+		}
+	}
+
+	return peers, nil
+}
+
+func (ps *peerStore) ScrapeSwarm(ih bittorrent.InfoHash, af bittorrent.AddressFamily) (resp bittorrent.Scrape) {
+	ps.checkClosed()
+
+	resp.InfoHash = ih
+
+	seeders, err := ps.count(ps.kindPrefix(ih, af, seederKind))
+	if err != nil {
+		log.Error("storage: etcd count failure", log.Fields{
+			"InfoHash": ih.String(),
+			"error":    err,
+		})
+		return
+	}
+	leechers, err := ps.count(ps.kindPrefix(ih, af, leecherKind))
+	if err != nil {
+		log.Error("storage: etcd count failure", log.Fields{
+			"InfoHash": ih.String(),
+			"error":    err,
+		})
+		return
+	}
+
+	snatches, _, err := ps.snatches(ih, af)
+	if err != nil {
+		log.Error("storage: etcd snatch counter failure", log.Fields{
+			"InfoHash": ih.String(),
+			"error":    err,
+		})
+		return
+	}
+
+	resp.Complete = uint32(seeders)
+	resp.Incomplete = uint32(leechers)
+	resp.Snatches = snatches
+	return
+}
+
+// ScrapeAll pages through the keys of all peers of the address family.
+//
+// Swarms without peers are not scraped, even if their snatch counter
+// remains.
+func (ps *peerStore) ScrapeAll(af bittorrent.AddressFamily) ([]bittorrent.Scrape, error) {
+	ps.checkClosed()
+
+	prefix := ps.familyPrefix(af)
+	end := prefixEnd(prefix)
+
+	var scrapes []bittorrent.Scrape
+	indices := make(map[bittorrent.InfoHash]int)
+	snatches := make(map[bittorrent.InfoHash]uint32)
+	for key := prefix; ; {
+		// The values of peers are empty, only snatch counters have values.
+		resp, err := ps.c.rangeKeys(rangeRequest{
+			Key:      key,
+			RangeEnd: end,
+			Limit:    scrapePageSize,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, kv := range resp.Kvs {
+			// The key continues with the hex infohash, a slash, and
+			// either the kind and another slash, or the snatch kind.
+			rest := kv.Key[len(prefix):]
+			if len(rest) < 2*len(bittorrent.InfoHash{})+2 {
+				continue
+			}
+			var ih bittorrent.InfoHash
+			if _, err := hex.Decode(ih[:], rest[:2*len(ih)]); err != nil {
+				continue
+			}
+			if len(rest) == 2*len(ih)+2 {
+				if rest[2*len(ih)+1] == snatchKind {
+					n, err := strconv.ParseUint(string(kv.Value), 10, 32)
+					if err == nil {
+						snatches[ih] = uint32(n)
+					}
+				}
+				continue
+			}
+
+			i, ok := indices[ih]
+			if !ok {
+				i = len(scrapes)
+				indices[ih] = i
+				scrapes = append(scrapes, bittorrent.Scrape{InfoHash: ih})
+			}
+			switch rest[2*len(ih)+1] {
+			case seederKind:
+				scrapes[i].Complete++
+			case leecherKind:
+				scrapes[i].Incomplete++
+			}
+		}
+
+		if !resp.More || len(resp.Kvs) == 0 {
+			break
+		}
+		key = append(resp.Kvs[len(resp.Kvs)-1].Key, 0)
+	}
+
+	for i := range scrapes {
+		scrapes[i].Snatches = snatches[scrapes[i].InfoHash]
+	}
+
+	return scrapes, nil
+}
+
+// ExportPeers pages through the keys of all peers of the address family,
+// which are sorted by infohash.
+//
+// The cursor is the last infohash returned.
+func (ps *peerStore) ExportPeers(af bittorrent.AddressFamily, cursor string, limit int) ([]storage.SwarmPeer, string, error) {
+	ps.checkClosed()
+
+	prefix := ps.familyPrefix(af)
+	end := prefixEnd(prefix)
+
+	key := prefix
+	if cursor != "" {
+		var ih bittorrent.InfoHash
+		if len(cursor) != 2*len(ih) {
+			return nil, "", storage.ErrInvalidCursor
+		}
+		if _, err := hex.Decode(ih[:], []byte(cursor)); err != nil {
+			return nil, "", storage.ErrInvalidCursor
+		}
+		key = prefixEnd(ps.swarmPrefix(ih, af))
+	}
+
+	var peers []storage.SwarmPeer
+	for {
+		resp, err := ps.c.rangeKeys(rangeRequest{
+			Key:      key,
+			RangeEnd: end,
+			Limit:    scrapePageSize,
+			KeysOnly: true,
+		})
+		if err != nil {
+			return nil, "", err
+		}
+
+		for _, kv := range resp.Kvs {
+			// The key continues with the hex infohash, a slash, the
+			// kind, another slash and the serialized peer.
+			rest := kv.Key[len(prefix):]
+			if len(rest) < 2*len(bittorrent.InfoHash{})+3 {
+				continue
+			}
+			var ih bittorrent.InfoHash
+			if _, err := hex.Decode(ih[:], rest[:2*len(ih)]); err != nil {
+				continue
+			}
+			kind := rest[2*len(ih)+1]
+			if kind != seederKind && kind != leecherKind {
+				continue
+			}
+			p, ok := decodePeer(rest[2*len(ih)+3:], af)
+			if !ok {
+				continue
+			}
+
+			// The page ends before the first peer of another swarm.
+			if len(peers) >= limit && peers[len(peers)-1].InfoHash != ih {
+				return peers, peers[len(peers)-1].InfoHash.String(), nil
+			}
+			peers = append(peers, storage.SwarmPeer{InfoHash: ih, Peer: p, Seeder: kind == seederKind})
+		}
+
+		if !resp.More || len(resp.Kvs) == 0 {
+			return peers, "", nil
+		}
+		key = append(resp.Kvs[len(resp.Kvs)-1].Key, 0)
+	}
+}
+
+// Clear implements storage.ClearablePeerStore by deleting the swarms of both
+// address families under the key prefix, including their snatches. Other keys
+// are kept.
+func (ps *peerStore) Clear() error {
+	ps.checkClosed()
+
+	for _, af := range []bittorrent.AddressFamily{bittorrent.IPv4, bittorrent.IPv6} {
+		if err := ps.c.deletePrefix(ps.familyPrefix(af)); err != nil {
+			return err
+		}
+	}
+
+	log.Info("storage: cleared etcd", log.Fields{"prefix": ps.cfg.KeyPrefix})
+	return nil
+}
+
+// Ping implements storage.Pinger by requesting the status of an etcd member.
+func (ps *peerStore) Ping(_ context.Context) error {
+	return ps.c.status()
+}
+
+// Stop stops reporting to Prometheus.
+//
+// The lease is not revoked, the peers remain available to other trackers
+// until they expire.
+func (ps *peerStore) Stop() stop.Result {
+	c := make(stop.Channel)
+	go func() {
+		close(ps.closed)
+		ps.wg.Wait()
+		ps.c.http.CloseIdleConnections()
+
+		c.Done()
+	}()
+
+	return c.Result()
+}
+
+func (ps *peerStore) LogFields() log.Fields {
+	return ps.cfg.LogFields()
+}
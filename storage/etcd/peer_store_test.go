@@ -0,0 +1,285 @@
+package etcd
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	s "github.com/chihaya/chihaya/storage"
+)
+
+// fakeEtcd implements the parts of the JSON gateway used by the PeerStore
+// in memory.
+type fakeEtcd struct {
+	mu        sync.Mutex
+	kvs       map[string]keyValue
+	revision  int64
+	leaseTTLs map[int64]int64
+}
+
+func newFakeEtcd() *fakeEtcd {
+	return &fakeEtcd{
+		kvs:       make(map[string]keyValue),
+		leaseTTLs: make(map[int64]int64),
+	}
+}
+
+// expire deletes all keys attached to the lease, as etcd does once it
+// expires.
+func (f *fakeEtcd) expire(lease int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for k, kv := range f.kvs {
+		if kv.Lease == lease {
+			delete(f.kvs, k)
+		}
+	}
+	delete(f.leaseTTLs, lease)
+}
+
+// keys returns the sorted keys in the range.
+func (f *fakeEtcd) keys(key, end []byte) []string {
+	var keys []string
+	for k := range f.kvs {
+		if len(end) == 0 && k == string(key) ||
+			len(end) > 0 && k >= string(key) && (string(end) == "\x00" || k < string(end)) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (f *fakeEtcd) put(req putRequest) {
+	f.revision++
+	f.kvs[string(req.Key)] = keyValue{Key: req.Key, Value: req.Value, Lease: req.Lease, ModRevision: f.revision}
+}
+
+func (f *fakeEtcd) deleteRange(req deleteRangeRequest) deleteRangeResponse {
+	keys := f.keys(req.Key, req.RangeEnd)
+	for _, k := range keys {
+		delete(f.kvs, k)
+	}
+	return deleteRangeResponse{Deleted: int64(len(keys))}
+}
+
+func (f *fakeEtcd) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var resp interface{}
+	switch r.URL.Path {
+	case "/v3/lease/grant":
+		var req leaseGrantRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		id := int64(len(f.leaseTTLs) + 1)
+		for f.leaseTTLs[id] != 0 {
+			id++
+		}
+		f.leaseTTLs[id] = req.TTL
+		resp = leaseGrantResponse{ID: id, TTL: req.TTL}
+	case "/v3/kv/put":
+		var req putRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.put(req)
+		resp = putResponse{}
+	case "/v3/kv/deleterange":
+		var req deleteRangeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp = f.deleteRange(req)
+	case "/v3/kv/range":
+		var req rangeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		keys := f.keys(req.Key, req.RangeEnd)
+		rr := rangeResponse{Count: int64(len(keys))}
+		if !req.CountOnly {
+			if req.Limit > 0 && int64(len(keys)) > req.Limit {
+				keys = keys[:req.Limit]
+				rr.More = true
+			}
+			for _, k := range keys {
+				kv := f.kvs[k]
+				if req.KeysOnly {
+					kv.Value = nil
+				}
+				rr.Kvs = append(rr.Kvs, kv)
+			}
+		}
+		resp = rr
+	case "/v3/kv/txn":
+		var req txnRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var tr txnResponse
+		for _, c := range req.Compare {
+			if c.Target != "MOD" || c.Result != "EQUAL" {
+				http.Error(w, "unsupported comparison", http.StatusBadRequest)
+				return
+			}
+			if f.kvs[string(c.Key)].ModRevision != c.ModRevision {
+				resp = tr
+				break
+			}
+		}
+		if resp != nil {
+			break
+		}
+		for _, op := range req.Success {
+			switch {
+			case op.RequestPut != nil:
+				f.put(*op.RequestPut)
+				tr.Responses = append(tr.Responses, responseOp{ResponsePut: &putResponse{}})
+			case op.RequestDeleteRange != nil:
+				dr := f.deleteRange(*op.RequestDeleteRange)
+				tr.Responses = append(tr.Responses, responseOp{ResponseDeleteRange: &dr})
+			}
+		}
+		tr.Succeeded = true
+		resp = tr
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(gatewayError{Message: "Not Found", Code: 5})
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+func testConfig(endpoint string) Config {
+	return Config{
+		Endpoints:                   []string{endpoint},
+		KeyPrefix:                   "chihaya/",
+		RequestTimeout:              10 * time.Second,
+		LeaseRotationInterval:       time.Minute,
+		PrometheusReportingInterval: 10 * time.Minute,
+		PeerLifetime:                30 * time.Minute,
+	}
+}
+
+func createNew() s.PeerStore {
+	srv := httptest.NewServer(newFakeEtcd())
+	ps, err := New(testConfig(srv.URL))
+	if err != nil {
+		panic(err)
+	}
+	return ps
+}
+
+func TestPeerStore(t *testing.T)   { s.TestPeerStore(t, createNew()) }
+func TestFullScraper(t *testing.T) { s.TestFullScraper(t, createNew()) }
+func TestPeerMixer(t *testing.T)   { s.TestPeerMixer(t, createNew()) }
+func TestExporter(t *testing.T)    { s.TestExporter(t, createNew()) }
+
+func TestClearablePeerStore(t *testing.T) { s.TestClearablePeerStore(t, createNew()) }
+
+func TestClearKeepsOtherKeys(t *testing.T) {
+	f := newFakeEtcd()
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+
+	ps, err := New(testConfig(srv.URL))
+	require.Nil(t, err)
+	defer func() { require.Nil(t, <-ps.Stop()) }()
+
+	other := testConfig(srv.URL)
+	other.KeyPrefix = "other/"
+	ops, err := New(other)
+	require.Nil(t, err)
+	defer func() { require.Nil(t, <-ops.Stop()) }()
+
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	p := bittorrent.Peer{ID: bittorrent.PeerIDFromString("00000000000000000001"), Port: 1, IP: bittorrent.IP{IP: net.ParseIP("1.1.1.1").To4(), AddressFamily: bittorrent.IPv4}}
+	require.Nil(t, ps.PutLeecher(ih, p))
+	require.Nil(t, ps.GraduateLeecher(ih, p))
+	require.Nil(t, ops.PutSeeder(ih, p))
+
+	require.Nil(t, ps.(s.ClearablePeerStore).Clear())
+	require.Equal(t, bittorrent.Scrape{InfoHash: ih}, ps.ScrapeSwarm(ih, bittorrent.IPv4))
+	require.Equal(t, bittorrent.Scrape{InfoHash: ih, Complete: 1}, ops.ScrapeSwarm(ih, bittorrent.IPv4))
+}
+
+func TestLeaseExpiry(t *testing.T) {
+	f := newFakeEtcd()
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+
+	// The first endpoint is unreachable.
+	cfg := testConfig("http://127.0.0.1:1")
+	cfg.Endpoints = append(cfg.Endpoints, srv.URL)
+	ps, err := New(cfg)
+	require.Nil(t, err)
+	defer func() { require.Nil(t, <-ps.Stop()) }()
+	require.Equal(t, map[int64]int64{1: int64((31 * time.Minute).Seconds())}, f.leaseTTLs)
+
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	p1 := bittorrent.Peer{ID: bittorrent.PeerIDFromString("00000000000000000001"), Port: 1, IP: bittorrent.IP{IP: net.ParseIP("1.1.1.1").To4(), AddressFamily: bittorrent.IPv4}}
+	p2 := bittorrent.Peer{ID: bittorrent.PeerIDFromString("00000000000000000002"), Port: 2, IP: bittorrent.IP{IP: net.ParseIP("1.1.1.2").To4(), AddressFamily: bittorrent.IPv4}}
+
+	require.Nil(t, ps.PutSeeder(ih, p1))
+
+	// Peers written after the rotation are attached to a new lease.
+	ps.(*peerStore).leaseMu.Lock()
+	ps.(*peerStore).rotateAt = time.Now()
+	ps.(*peerStore).leaseMu.Unlock()
+	require.Nil(t, ps.PutLeecher(ih, p2))
+	require.Len(t, f.leaseTTLs, 2)
+
+	require.Equal(t, bittorrent.Scrape{InfoHash: ih, Complete: 1, Incomplete: 1}, ps.ScrapeSwarm(ih, bittorrent.IPv4))
+
+	f.expire(1)
+	require.Equal(t, bittorrent.Scrape{InfoHash: ih, Incomplete: 1}, ps.ScrapeSwarm(ih, bittorrent.IPv4))
+
+	f.expire(2)
+	_, err = ps.AnnouncePeers(ih, false, 50, p1)
+	require.Equal(t, s.ErrResourceDoesNotExist, err)
+}
+
+func BenchmarkNop(b *testing.B)                        { s.Nop(b, createNew()) }
+func BenchmarkPut(b *testing.B)                        { s.Put(b, createNew()) }
+func BenchmarkPut1k(b *testing.B)                      { s.Put1k(b, createNew()) }
+func BenchmarkPut1kInfohash(b *testing.B)              { s.Put1kInfohash(b, createNew()) }
+func BenchmarkPut1kInfohash1k(b *testing.B)            { s.Put1kInfohash1k(b, createNew()) }
+func BenchmarkPutDelete(b *testing.B)                  { s.PutDelete(b, createNew()) }
+func BenchmarkPutDelete1k(b *testing.B)                { s.PutDelete1k(b, createNew()) }
+func BenchmarkPutDelete1kInfohash(b *testing.B)        { s.PutDelete1kInfohash(b, createNew()) }
+func BenchmarkPutDelete1kInfohash1k(b *testing.B)      { s.PutDelete1kInfohash1k(b, createNew()) }
+func BenchmarkDeleteNonexist(b *testing.B)             { s.DeleteNonexist(b, createNew()) }
+func BenchmarkDeleteNonexist1k(b *testing.B)           { s.DeleteNonexist1k(b, createNew()) }
+func BenchmarkDeleteNonexist1kInfohash(b *testing.B)   { s.DeleteNonexist1kInfohash(b, createNew()) }
+func BenchmarkDeleteNonexist1kInfohash1k(b *testing.B) { s.DeleteNonexist1kInfohash1k(b, createNew()) }
+func BenchmarkPutGradDelete(b *testing.B)              { s.PutGradDelete(b, createNew()) }
+func BenchmarkPutGradDelete1k(b *testing.B)            { s.PutGradDelete1k(b, createNew()) }
+func BenchmarkPutGradDelete1kInfohash(b *testing.B)    { s.PutGradDelete1kInfohash(b, createNew()) }
+func BenchmarkPutGradDelete1kInfohash1k(b *testing.B)  { s.PutGradDelete1kInfohash1k(b, createNew()) }
+func BenchmarkGradNonexist(b *testing.B)               { s.GradNonexist(b, createNew()) }
+func BenchmarkGradNonexist1k(b *testing.B)             { s.GradNonexist1k(b, createNew()) }
+func BenchmarkGradNonexist1kInfohash(b *testing.B)     { s.GradNonexist1kInfohash(b, createNew()) }
+func BenchmarkGradNonexist1kInfohash1k(b *testing.B)   { s.GradNonexist1kInfohash1k(b, createNew()) }
+func BenchmarkAnnounceLeecher(b *testing.B)            { s.AnnounceLeecher(b, createNew()) }
+func BenchmarkAnnounceLeecher1kInfohash(b *testing.B)  { s.AnnounceLeecher1kInfohash(b, createNew()) }
+func BenchmarkAnnounceSeeder(b *testing.B)             { s.AnnounceSeeder(b, createNew()) }
+func BenchmarkAnnounceSeeder1kInfohash(b *testing.B)   { s.AnnounceSeeder1kInfohash(b, createNew()) }
+func BenchmarkScrapeSwarm(b *testing.B)                { s.ScrapeSwarm(b, createNew()) }
+func BenchmarkScrapeSwarm1kInfohash(b *testing.B)      { s.ScrapeSwarm1kInfohash(b, createNew()) }
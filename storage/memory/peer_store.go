@@ -3,11 +3,19 @@
 package memory
 
 import (
+	"bytes"
+	"context"
 	"encoding/binary"
+	"encoding/hex"
+	"errors"
 	"math"
-	"net"
+	"os"
 	"runtime"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	yaml "gopkg.in/yaml.v2"
@@ -28,8 +36,23 @@ const (
 	defaultPrometheusReportingInterval = time.Second * 1
 	defaultGarbageCollectionInterval   = time.Minute * 3
 	defaultPeerLifetime                = time.Minute * 30
+	defaultSnapshotInterval            = time.Minute * 5
+	defaultEvictionPolicy              = EvictLRU
 )
 
+// Eviction policies of MaxSwarms.
+const (
+	// EvictLRU evicts the swarm that was announced to least recently.
+	EvictLRU = "lru"
+	// EvictLFU evicts the swarm that was announced to least often.
+	EvictLFU = "lfu"
+)
+
+// evictionSamples is the number of swarms of a shard, or peers of a swarm,
+// compared to choose the one to evict, so that evicting doesn't scan the whole
+// shard or swarm.
+const evictionSamples = 8
+
 func init() {
 	// Register the storage driver.
 	storage.RegisterDriver(Name, driver{})
@@ -60,6 +83,41 @@ type Config struct {
 	PrometheusReportingInterval time.Duration `yaml:"prometheus_reporting_interval"`
 	PeerLifetime                time.Duration `yaml:"peer_lifetime"`
 	ShardCount                  int           `yaml:"shard_count"`
+
+	// MaxPeersPerSwarm, if set, is the maximum number of peers kept in a
+	// swarm. Adding a peer to a full swarm evicts the stalest of a few of its
+	// peers.
+	MaxPeersPerSwarm int `yaml:"max_peers_per_swarm"`
+
+	// GarbageCollectionBudget, if set, bounds the time a periodic garbage
+	// collection may take. A collection running out of time stops after the
+	// current shard, and the next one resumes with the following shard.
+	// Collections triggered via the admin API always visit all shards.
+	GarbageCollectionBudget time.Duration `yaml:"gc_budget"`
+	// GarbageCollectionShards, if set, is the maximum number of shards a
+	// periodic garbage collection visits, resuming where the previous one stopped.
+	GarbageCollectionShards int `yaml:"gc_shards"`
+
+	// SnapshotPath, if set, is the file the swarms are periodically written
+	// to, and restored from when the PeerStore is created, so that restarts
+	// don't lose all peers.
+	SnapshotPath     string        `yaml:"snapshot_path"`
+	SnapshotInterval time.Duration `yaml:"snapshot_interval"`
+
+	// ShardMetrics enables metrics of every shard, labeled by its index.
+	ShardMetrics bool `yaml:"shard_metrics"`
+
+	// DisableMetrics disables posting the numbers of swarms and peers to
+	// Prometheus, so that a PeerStore used besides another one does not
+	// overwrite its numbers.
+	DisableMetrics bool `yaml:"disable_metrics"`
+
+	// MaxSwarms, if set, is the maximum number of swarms kept per address
+	// family, so that announces of random infohashes cannot exhaust the
+	// memory. Adding a swarm to a full PeerStore evicts a swarm chosen by
+	// the EvictionPolicy.
+	MaxSwarms      int    `yaml:"max_swarms"`
+	EvictionPolicy string `yaml:"eviction_policy"`
 }
 
 // LogFields renders the current config as a set of Logrus fields.
@@ -70,6 +128,15 @@ func (cfg Config) LogFields() log.Fields {
 		"promReportInterval": cfg.PrometheusReportingInterval,
 		"peerLifetime":       cfg.PeerLifetime,
 		"shardCount":         cfg.ShardCount,
+		"maxPeersPerSwarm":   cfg.MaxPeersPerSwarm,
+		"gcBudget":           cfg.GarbageCollectionBudget,
+		"gcShards":           cfg.GarbageCollectionShards,
+		"snapshotPath":       cfg.SnapshotPath,
+		"snapshotInterval":   cfg.SnapshotInterval,
+		"shardMetrics":       cfg.ShardMetrics,
+		"disableMetrics":     cfg.DisableMetrics,
+		"maxSwarms":          cfg.MaxSwarms,
+		"evictionPolicy":     cfg.EvictionPolicy,
 	}
 }
 
@@ -98,7 +165,7 @@ func (cfg Config) Validate() Config {
 		})
 	}
 
-	if cfg.PrometheusReportingInterval <= 0 {
+	if cfg.PrometheusReportingInterval <= 0 && !cfg.DisableMetrics {
 		validcfg.PrometheusReportingInterval = defaultPrometheusReportingInterval
 		log.Warn("falling back to default configuration", log.Fields{
 			"name":     Name + ".PrometheusReportingInterval",
@@ -116,6 +183,60 @@ func (cfg Config) Validate() Config {
 		})
 	}
 
+	if cfg.MaxPeersPerSwarm < 0 {
+		validcfg.MaxPeersPerSwarm = 0
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".MaxPeersPerSwarm",
+			"provided": cfg.MaxPeersPerSwarm,
+			"default":  validcfg.MaxPeersPerSwarm,
+		})
+	}
+
+	if cfg.GarbageCollectionBudget < 0 {
+		validcfg.GarbageCollectionBudget = 0
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".GarbageCollectionBudget",
+			"provided": cfg.GarbageCollectionBudget,
+			"default":  validcfg.GarbageCollectionBudget,
+		})
+	}
+
+	if cfg.GarbageCollectionShards < 0 {
+		validcfg.GarbageCollectionShards = 0
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".GarbageCollectionShards",
+			"provided": cfg.GarbageCollectionShards,
+			"default":  validcfg.GarbageCollectionShards,
+		})
+	}
+
+	if cfg.MaxSwarms < 0 {
+		validcfg.MaxSwarms = 0
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".MaxSwarms",
+			"provided": cfg.MaxSwarms,
+			"default":  validcfg.MaxSwarms,
+		})
+	}
+
+	if cfg.MaxSwarms > 0 && cfg.EvictionPolicy != EvictLRU && cfg.EvictionPolicy != EvictLFU {
+		validcfg.EvictionPolicy = defaultEvictionPolicy
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".EvictionPolicy",
+			"provided": cfg.EvictionPolicy,
+			"default":  validcfg.EvictionPolicy,
+		})
+	}
+
+	if cfg.SnapshotPath != "" && cfg.SnapshotInterval <= 0 {
+		validcfg.SnapshotInterval = defaultSnapshotInterval
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".SnapshotInterval",
+			"provided": cfg.SnapshotInterval,
+			"default":  validcfg.SnapshotInterval,
+		})
+	}
+
 	return validcfg
 }
 
@@ -131,6 +252,44 @@ func New(provided Config) (storage.PeerStore, error) {
 	for i := 0; i < cfg.ShardCount*2; i++ {
 		ps.shards[i] = &peerShard{swarms: make(map[bittorrent.InfoHash]swarm)}
 	}
+	if cfg.MaxSwarms > 0 {
+		// The limit is split evenly between the shards of an address
+		// family, rounding up.
+		ps.maxShardSwarms = (cfg.MaxSwarms + cfg.ShardCount - 1) / cfg.ShardCount
+	}
+	if cfg.ShardMetrics {
+		ps.shardMetrics = make([]*shardMetrics, len(ps.shards))
+		for i := range ps.shardMetrics {
+			ps.shardMetrics[i] = newShardMetrics(i)
+		}
+	}
+
+	if cfg.SnapshotPath != "" {
+		err := ps.restoreSnapshot(cfg.SnapshotPath, time.Now().Add(-cfg.PeerLifetime))
+		if errors.Is(err, os.ErrNotExist) {
+			log.Info("storage: no snapshot to restore", log.Fields{"path": cfg.SnapshotPath})
+		} else if err != nil {
+			log.Error("storage: failed to restore snapshot", log.Fields{"path": cfg.SnapshotPath}, log.Err(err))
+		}
+
+		// Start a goroutine for writing snapshots.
+		ps.wg.Add(1)
+		go func() {
+			defer ps.wg.Done()
+			t := time.NewTicker(cfg.SnapshotInterval)
+			defer t.Stop()
+			for {
+				select {
+				case <-ps.closed:
+					return
+				case <-t.C:
+					if err := ps.writeSnapshot(context.Background(), cfg.SnapshotPath); err != nil {
+						log.Error("storage: failed to write snapshot", log.Fields{"path": cfg.SnapshotPath}, log.Err(err))
+					}
+				}
+			}
+		}()
+	}
 
 	// Start a goroutine for garbage collection.
 	ps.wg.Add(1)
@@ -143,95 +302,217 @@ func New(provided Config) (storage.PeerStore, error) {
 			case <-time.After(cfg.GarbageCollectionInterval):
 				before := time.Now().Add(-cfg.PeerLifetime)
 				log.Debug("storage: purging peers with no announces since", log.Fields{"before": before})
-				_ = ps.collectGarbage(before)
+				_ = ps.collectGarbage(before, false)
 			}
 		}
 	}()
 
 	// Start a goroutine for reporting statistics to Prometheus.
-	ps.wg.Add(1)
-	go func() {
-		defer ps.wg.Done()
-		t := time.NewTicker(cfg.PrometheusReportingInterval)
-		for {
-			select {
-			case <-ps.closed:
-				t.Stop()
-				return
-			case <-t.C:
-				before := time.Now()
-				ps.populateProm()
-				log.Debug("storage: populateProm() finished", log.Fields{"timeTaken": time.Since(before)})
+	if !cfg.DisableMetrics {
+		ps.wg.Add(1)
+		go func() {
+			defer ps.wg.Done()
+			t := time.NewTicker(cfg.PrometheusReportingInterval)
+			for {
+				select {
+				case <-ps.closed:
+					t.Stop()
+					return
+				case <-t.C:
+					before := time.Now()
+					ps.populateProm()
+					log.Debug("storage: populateProm() finished", log.Fields{"timeTaken": time.Since(before)})
+				}
 			}
-		}
-	}()
+		}()
+	}
 
 	return ps, nil
 }
 
+// serializedPeer is a Peer encoded by bittorrent.EncodePeer.
 type serializedPeer string
 
 func newPeerKey(p bittorrent.Peer) serializedPeer {
-	b := make([]byte, 20+2+len(p.IP.IP))
-	copy(b[:20], p.ID[:])
-	binary.BigEndian.PutUint16(b[20:22], p.Port)
-	copy(b[22:], p.IP.IP)
-
-	return serializedPeer(b)
+	return serializedPeer(bittorrent.EncodePeer(p))
 }
 
 func decodePeerKey(pk serializedPeer) bittorrent.Peer {
-	peer := bittorrent.Peer{
-		ID:   bittorrent.PeerIDFromString(string(pk[:20])),
-		Port: binary.BigEndian.Uint16([]byte(pk[20:22])),
-		IP:   bittorrent.IP{IP: net.IP(pk[22:])},
-	}
-
-	if ip := peer.IP.To4(); ip != nil {
-		peer.IP.IP = ip
-		peer.IP.AddressFamily = bittorrent.IPv4
-	} else if len(peer.IP.IP) == net.IPv6len { // implies toReturn.IP.To4() == nil
-		peer.IP.AddressFamily = bittorrent.IPv6
-	} else {
-		panic("IP is neither v4 nor v6")
+	peer, err := bittorrent.EncodedPeer(pk).Decode()
+	if err != nil {
+		panic(err)
 	}
-
 	return peer
 }
 
 type peerShard struct {
+	// lockWaitNanos is the time waited to lock the shard for writing, if
+	// shard metrics are enabled. It is accessed atomically and comes first
+	// to be aligned on 32-bit platforms.
+	lockWaitNanos int64
+
 	swarms      map[bittorrent.InfoHash]swarm
 	numSeeders  uint64
 	numLeechers uint64
 	sync.RWMutex
+
+	// views holds a *swarmView of swarms whose peers didn't change since it
+	// was taken, so that announces don't contend with writers for the lock.
+	// Writers delete the view of a swarm whose peers they change while
+	// holding the lock, and garbage collections those of swarms that were
+	// not announced to since the previous collection of the shard, so that
+	// only the swarms in use are copied.
+	views sync.Map
+}
+
+// view returns the view of the swarm of the infohash, taking it if there is
+// none.
+func (shard *peerShard) view(ih bittorrent.InfoHash) (*swarmView, bool) {
+	if v, ok := shard.views.Load(ih); ok {
+		v := v.(*swarmView)
+		// Loading before storing keeps hot views from being written
+		// by every announce.
+		if atomic.LoadUint32(&v.used) == 0 {
+			atomic.StoreUint32(&v.used, 1)
+		}
+		return v, true
+	}
+
+	shard.RLock()
+	defer shard.RUnlock()
+
+	sw, ok := shard.swarms[ih]
+	if !ok {
+		return nil, false
+	}
+	v := &swarmView{
+		used:     1,
+		seeders:  make([]serializedPeer, 0, len(sw.seeders)),
+		leechers: make([]serializedPeer, 0, len(sw.leechers)),
+	}
+	for pk := range sw.seeders {
+		v.seeders = append(v.seeders, pk)
+	}
+	for pk := range sw.leechers {
+		v.leechers = append(v.leechers, pk)
+	}
+	// Writers can't change the swarm before the lock is released, so the
+	// view is current when it is stored.
+	shard.views.Store(ih, v)
+	return v, true
+}
+
+// invalidate deletes the view of the swarm of the infohash.
+//
+// The shard must be locked for writing.
+func (shard *peerShard) invalidate(ih bittorrent.InfoHash) {
+	shard.views.Delete(ih)
+}
+
+// expireView deletes the view of the swarm of the infohash if it was not used
+// since the previous call, and otherwise marks it as unused.
+//
+// The shard must be locked for writing.
+func (shard *peerShard) expireView(ih bittorrent.InfoHash) {
+	v, ok := shard.views.Load(ih)
+	if !ok {
+		return
+	}
+	if atomic.SwapUint32(&v.(*swarmView).used, 0) == 0 {
+		shard.views.Delete(ih)
+	}
 }
 
 type swarm struct {
 	// map serialized peer to mtime
 	seeders  map[serializedPeer]int64
 	leechers map[serializedPeer]int64
+	// snatches is the number of completed downloads. It is lost once the
+	// swarm is empty and collected.
+	snatches uint32
+	// announces is the number of peers put into the swarm and lastAnnounce
+	// the time of the last one. They choose the swarm to evict if MaxSwarms
+	// is set.
+	announces    uint32
+	lastAnnounce int64
+}
+
+// swarmView is an immutable copy of the peers of a swarm.
+type swarmView struct {
+	// used is set when the view is read. It is accessed atomically.
+	used uint32
+
+	seeders  []serializedPeer
+	leechers []serializedPeer
+}
+
+// appendPeers appends up to num peers of pks, except skip, to peers,
+// starting at a random position. It returns the extended peers and the number
+// of peers that were not found.
+func appendPeers(peers []bittorrent.Peer, pks []serializedPeer, num int, skip serializedPeer) ([]bittorrent.Peer, int) {
+	if num <= 0 || len(pks) == 0 {
+		return peers, num
+	}
+
+	// The clock is random enough to vary the peers between announces and
+	// doesn't take a lock, unlike the global source of math/rand.
+	start := int(uint64(time.Now().UnixNano()) % uint64(len(pks)))
+	for i := 0; i < len(pks) && num > 0; i++ {
+		pk := pks[(start+i)%len(pks)]
+		if pk == skip {
+			continue
+		}
+		peers = append(peers, decodePeerKey(pk))
+		num--
+	}
+	return peers, num
 }
 
 type peerStore struct {
 	cfg    Config
 	shards []*peerShard
 
+	// gcMu serializes garbage collections, which are run periodically and
+	// on demand by CollectGarbage, and guards gcNext.
+	gcMu sync.Mutex
+	// gcNext is the index of the shard the next periodic garbage collection
+	// starts with.
+	gcNext int
+
+	// shardMetrics holds the metrics of every shard if ShardMetrics is set.
+	// They are only used by populateProm.
+	shardMetrics []*shardMetrics
+
+	// maxShardSwarms is the maximum number of swarms of a shard, or 0 if
+	// the number is not limited.
+	maxShardSwarms int
+
 	closed chan struct{}
 	wg     sync.WaitGroup
 }
 
-var _ storage.PeerStore = &peerStore{}
+var (
+	_ storage.PeerStore          = &peerStore{}
+	_ storage.FullScraper        = &peerStore{}
+	_ storage.PeerMixer          = &peerStore{}
+	_ storage.Batcher            = &peerStore{}
+	_ storage.Exporter           = &peerStore{}
+	_ storage.ClearablePeerStore = &peerStore{}
+)
 
 // populateProm aggregates metrics over all shards and then posts them to
-// prometheus.
+// prometheus, along with the metrics of every shard if they are enabled.
 func (ps *peerStore) populateProm() {
 	var numInfohashes, numSeeders, numLeechers uint64
 
-	for _, s := range ps.shards {
+	for i, s := range ps.shards {
 		s.RLock()
 		numInfohashes += uint64(len(s.swarms))
 		numSeeders += s.numSeeders
 		numLeechers += s.numLeechers
+		if ps.shardMetrics != nil {
+			ps.shardMetrics[i].report(len(s.swarms), s.numSeeders, s.numLeechers, atomic.LoadInt64(&s.lockWaitNanos))
+		}
 		s.RUnlock()
 	}
 
@@ -245,8 +526,20 @@ func recordGCDuration(duration time.Duration) {
 	storage.PromGCDurationMilliseconds.Observe(float64(duration.Nanoseconds()) / float64(time.Millisecond))
 }
 
+// getClock returns the time of the monotonic clock, so that the lifetime of
+// peers is not affected by changes of the wall clock.
 func (ps *peerStore) getClock() int64 {
-	return timecache.NowUnixNano()
+	return timecache.MonotonicUnixNano()
+}
+
+// familyShards returns the shards of the swarms of an address family.
+func (ps *peerStore) familyShards(af bittorrent.AddressFamily) []*peerShard {
+	// The first half of the shards holds IPv4 swarms, the second half IPv6
+	// swarms.
+	if af == bittorrent.IPv6 {
+		return ps.shards[len(ps.shards)/2:]
+	}
+	return ps.shards[:len(ps.shards)/2]
 }
 
 func (ps *peerStore) shardIndex(infoHash bittorrent.InfoHash, af bittorrent.AddressFamily) uint32 {
@@ -267,27 +560,59 @@ func (ps *peerStore) PutSeeder(ih bittorrent.InfoHash, p bittorrent.Peer) error
 	default:
 	}
 
-	pk := newPeerKey(p)
-
 	shard := ps.shards[ps.shardIndex(ih, p.IP.AddressFamily)]
-	shard.Lock()
+	ps.lock(shard)
+	ps.putPeer(shard, ih, newPeerKey(p), true, ps.getClock())
+	shard.Unlock()
+	return nil
+}
 
-	if _, ok := shard.swarms[ih]; !ok {
-		shard.swarms[ih] = swarm{
-			seeders:  make(map[serializedPeer]int64),
-			leechers: make(map[serializedPeer]int64),
-		}
+// putPeer adds or updates a seeder or leecher of the swarm of the infohash.
+//
+// The shard must be locked for writing.
+func (ps *peerStore) putPeer(shard *peerShard, ih bittorrent.InfoHash, pk serializedPeer, seeder bool, mtime int64) {
+	sw := ps.announceSwarm(shard, ih, mtime)
+
+	peers, count := sw.leechers, &shard.numLeechers
+	if seeder {
+		peers, count = sw.seeders, &shard.numSeeders
 	}
 
-	// If this peer isn't already a seeder, update the stats for the swarm.
-	if _, ok := shard.swarms[ih].seeders[pk]; !ok {
-		shard.numSeeders++
+	// If this peer is new, update the stats for the swarm.
+	if _, ok := peers[pk]; !ok {
+		ps.makeRoom(shard, sw)
+		shard.invalidate(ih)
+		*count++
 	}
 
 	// Update the peer in the swarm.
-	shard.swarms[ih].seeders[pk] = ps.getClock()
+	peers[pk] = mtime
+}
+
+// PutPeers adds or updates the peers, locking every shard once.
+func (ps *peerStore) PutPeers(peers []storage.SwarmPeer) error {
+	select {
+	case <-ps.closed:
+		panic("attempted to interact with stopped memory store")
+	default:
+	}
+
+	byShard := make(map[uint32][]storage.SwarmPeer)
+	for _, sp := range peers {
+		i := ps.shardIndex(sp.InfoHash, sp.Peer.IP.AddressFamily)
+		byShard[i] = append(byShard[i], sp)
+	}
+
+	mtime := ps.getClock()
+	for i, sps := range byShard {
+		shard := ps.shards[i]
+		ps.lock(shard)
+		for _, sp := range sps {
+			ps.putPeer(shard, sp.InfoHash, newPeerKey(sp.Peer), sp.Seeder, mtime)
+		}
+		shard.Unlock()
+	}
 
-	shard.Unlock()
 	return nil
 }
 
@@ -301,7 +626,7 @@ func (ps *peerStore) DeleteSeeder(ih bittorrent.InfoHash, p bittorrent.Peer) err
 	pk := newPeerKey(p)
 
 	shard := ps.shards[ps.shardIndex(ih, p.IP.AddressFamily)]
-	shard.Lock()
+	ps.lock(shard)
 
 	if _, ok := shard.swarms[ih]; !ok {
 		shard.Unlock()
@@ -315,6 +640,7 @@ func (ps *peerStore) DeleteSeeder(ih bittorrent.InfoHash, p bittorrent.Peer) err
 
 	shard.numSeeders--
 	delete(shard.swarms[ih].seeders, pk)
+	shard.invalidate(ih)
 
 	if len(shard.swarms[ih].seeders)|len(shard.swarms[ih].leechers) == 0 {
 		delete(shard.swarms, ih)
@@ -331,26 +657,9 @@ func (ps *peerStore) PutLeecher(ih bittorrent.InfoHash, p bittorrent.Peer) error
 	default:
 	}
 
-	pk := newPeerKey(p)
-
 	shard := ps.shards[ps.shardIndex(ih, p.IP.AddressFamily)]
-	shard.Lock()
-
-	if _, ok := shard.swarms[ih]; !ok {
-		shard.swarms[ih] = swarm{
-			seeders:  make(map[serializedPeer]int64),
-			leechers: make(map[serializedPeer]int64),
-		}
-	}
-
-	// If this peer isn't already a leecher, update the stats for the swarm.
-	if _, ok := shard.swarms[ih].leechers[pk]; !ok {
-		shard.numLeechers++
-	}
-
-	// Update the peer in the swarm.
-	shard.swarms[ih].leechers[pk] = ps.getClock()
-
+	ps.lock(shard)
+	ps.putPeer(shard, ih, newPeerKey(p), false, ps.getClock())
 	shard.Unlock()
 	return nil
 }
@@ -365,7 +674,7 @@ func (ps *peerStore) DeleteLeecher(ih bittorrent.InfoHash, p bittorrent.Peer) er
 	pk := newPeerKey(p)
 
 	shard := ps.shards[ps.shardIndex(ih, p.IP.AddressFamily)]
-	shard.Lock()
+	ps.lock(shard)
 
 	if _, ok := shard.swarms[ih]; !ok {
 		shard.Unlock()
@@ -379,6 +688,7 @@ func (ps *peerStore) DeleteLeecher(ih bittorrent.InfoHash, p bittorrent.Peer) er
 
 	shard.numLeechers--
 	delete(shard.swarms[ih].leechers, pk)
+	shard.invalidate(ih)
 
 	if len(shard.swarms[ih].seeders)|len(shard.swarms[ih].leechers) == 0 {
 		delete(shard.swarms, ih)
@@ -398,23 +708,26 @@ func (ps *peerStore) GraduateLeecher(ih bittorrent.InfoHash, p bittorrent.Peer)
 	pk := newPeerKey(p)
 
 	shard := ps.shards[ps.shardIndex(ih, p.IP.AddressFamily)]
-	shard.Lock()
+	ps.lock(shard)
 
-	if _, ok := shard.swarms[ih]; !ok {
-		shard.swarms[ih] = swarm{
-			seeders:  make(map[serializedPeer]int64),
-			leechers: make(map[serializedPeer]int64),
-		}
-	}
+	// Count the completed download.
+	sw := ps.announceSwarm(shard, ih, ps.getClock())
+	sw.snatches++
+	shard.swarms[ih] = sw
 
 	// If this peer is a leecher, update the stats for the swarm and remove them.
-	if _, ok := shard.swarms[ih].leechers[pk]; ok {
+	_, wasLeecher := shard.swarms[ih].leechers[pk]
+	if wasLeecher {
 		shard.numLeechers--
 		delete(shard.swarms[ih].leechers, pk)
 	}
 
 	// If this peer isn't already a seeder, update the stats for the swarm.
 	if _, ok := shard.swarms[ih].seeders[pk]; !ok {
+		if !wasLeecher {
+			ps.makeRoom(shard, shard.swarms[ih])
+		}
+		shard.invalidate(ih)
 		shard.numSeeders++
 	}
 
@@ -425,6 +738,106 @@ func (ps *peerStore) GraduateLeecher(ih bittorrent.InfoHash, p bittorrent.Peer)
 	return nil
 }
 
+// announceSwarm counts an announce of the swarm of the infohash and returns
+// it. If the swarm does not exist, it is created, evicting other swarms of the
+// shard if it is full.
+//
+// The shard must be locked for writing.
+func (ps *peerStore) announceSwarm(shard *peerShard, ih bittorrent.InfoHash, mtime int64) swarm {
+	sw, ok := shard.swarms[ih]
+	if !ok {
+		for ps.maxShardSwarms > 0 && len(shard.swarms) >= ps.maxShardSwarms {
+			ps.evictSwarm(shard)
+		}
+		sw = swarm{
+			seeders:  make(map[serializedPeer]int64),
+			leechers: make(map[serializedPeer]int64),
+		}
+	}
+
+	sw.announces++
+	sw.lastAnnounce = mtime
+	shard.swarms[ih] = sw
+	return sw
+}
+
+// evictSwarm deletes the swarm of the shard that was announced to least
+// recently or least often, depending on the EvictionPolicy, among a sample
+// of its swarms.
+//
+// The shard must be locked for writing.
+func (ps *peerStore) evictSwarm(shard *peerShard) {
+	var victim bittorrent.InfoHash
+	var victimSwarm swarm
+	var sampled int
+	for ih, sw := range shard.swarms {
+		if sampled == 0 || ps.evictsBefore(sw, victimSwarm) {
+			victim, victimSwarm = ih, sw
+		}
+		sampled++
+		if sampled == evictionSamples {
+			break
+		}
+	}
+	if sampled == 0 {
+		return
+	}
+
+	shard.numSeeders -= uint64(len(victimSwarm.seeders))
+	shard.numLeechers -= uint64(len(victimSwarm.leechers))
+	delete(shard.swarms, victim)
+	shard.invalidate(victim)
+	storage.PromSwarmsEvicted.Inc()
+}
+
+// evictsBefore returns whether swarm a is evicted before swarm b.
+func (ps *peerStore) evictsBefore(a, b swarm) bool {
+	if ps.cfg.EvictionPolicy == EvictLFU && a.announces != b.announces {
+		return a.announces < b.announces
+	}
+	return a.lastAnnounce < b.lastAnnounce
+}
+
+// makeRoom evicts the peer of the swarm that announced least recently among a
+// sample of its peers, if the swarm holds MaxPeersPerSwarm peers or more, so
+// that another peer can be added. Seeders and leechers are sampled in
+// proportion to their numbers.
+//
+// The shard of the swarm must be locked.
+func (ps *peerStore) makeRoom(shard *peerShard, sw swarm) {
+	numPeers := len(sw.seeders) + len(sw.leechers)
+	if ps.cfg.MaxPeersPerSwarm <= 0 || numPeers < ps.cfg.MaxPeersPerSwarm {
+		return
+	}
+
+	var stalest serializedPeer
+	var stalestMtime int64
+	stalestIsSeeder, found := false, false
+	sample := func(peers map[serializedPeer]int64, seeders bool, samples int) {
+		for pk, mtime := range peers {
+			if samples <= 0 {
+				return
+			}
+			if !found || mtime < stalestMtime {
+				stalest, stalestMtime, stalestIsSeeder, found = pk, mtime, seeders, true
+			}
+			samples--
+		}
+	}
+	seederSamples := (evictionSamples*len(sw.seeders) + numPeers - 1) / numPeers
+	sample(sw.seeders, true, seederSamples)
+	sample(sw.leechers, false, evictionSamples-seederSamples)
+
+	if stalestIsSeeder {
+		shard.numSeeders--
+		delete(sw.seeders, stalest)
+	} else {
+		shard.numLeechers--
+		delete(sw.leechers, stalest)
+	}
+	storage.PromPeersEvicted.Inc()
+}
+
 func (ps *peerStore) AnnouncePeers(ih bittorrent.InfoHash, seeder bool, numWant int, announcer bittorrent.Peer) (peers []bittorrent.Peer, err error) {
 	select {
 	case <-ps.closed:
@@ -433,56 +846,44 @@ func (ps *peerStore) AnnouncePeers(ih bittorrent.InfoHash, seeder bool, numWant
 	}
 
 	shard := ps.shards[ps.shardIndex(ih, announcer.IP.AddressFamily)]
-	shard.RLock()
-
-	if _, ok := shard.swarms[ih]; !ok {
-		shard.RUnlock()
+	view, ok := shard.view(ih)
+	if !ok {
 		return nil, storage.ErrResourceDoesNotExist
 	}
 
+	peers = bittorrent.NewPeers(numWant)
 	if seeder {
 		// Append leechers as possible.
-		leechers := shard.swarms[ih].leechers
-		for pk := range leechers {
-			if numWant == 0 {
-				break
-			}
-
-			peers = append(peers, decodePeerKey(pk))
-			numWant--
-		}
+		peers, _ = appendPeers(peers, view.leechers, numWant, "")
 	} else {
 		// Append as many seeders as possible.
-		seeders := shard.swarms[ih].seeders
-		for pk := range seeders {
-			if numWant == 0 {
-				break
-			}
-
-			peers = append(peers, decodePeerKey(pk))
-			numWant--
-		}
+		peers, numWant = appendPeers(peers, view.seeders, numWant, "")
 
 		// Append leechers until we reach numWant.
-		if numWant > 0 {
-			leechers := shard.swarms[ih].leechers
-			announcerPK := newPeerKey(announcer)
-			for pk := range leechers {
-				if pk == announcerPK {
-					continue
-				}
+		peers, _ = appendPeers(peers, view.leechers, numWant, newPeerKey(announcer))
+	}
 
-				if numWant == 0 {
-					break
-				}
+	return
+}
 
-				peers = append(peers, decodePeerKey(pk))
-				numWant--
-			}
-		}
+func (ps *peerStore) AnnounceMixedPeers(ih bittorrent.InfoHash, numSeeders, numLeechers int, announcer bittorrent.Peer) (peers []bittorrent.Peer, err error) {
+	select {
+	case <-ps.closed:
+		panic("attempted to interact with stopped memory store")
+	default:
 	}
 
-	shard.RUnlock()
+	shard := ps.shards[ps.shardIndex(ih, announcer.IP.AddressFamily)]
+	view, ok := shard.view(ih)
+	if !ok {
+		return nil, storage.ErrResourceDoesNotExist
+	}
+
+	announcerPK := newPeerKey(announcer)
+	peers = bittorrent.NewPeers(numSeeders + numLeechers)
+	peers, _ = appendPeers(peers, view.seeders, numSeeders, announcerPK)
+	peers, _ = appendPeers(peers, view.leechers, numLeechers, announcerPK)
+
 	return
 }
 
@@ -505,80 +906,283 @@ func (ps *peerStore) ScrapeSwarm(ih bittorrent.InfoHash, addressFamily bittorren
 
 	resp.Incomplete = uint32(len(swarm.leechers))
 	resp.Complete = uint32(len(swarm.seeders))
+	resp.Snatches = swarm.snatches
 	shard.RUnlock()
 
 	return
 }
 
-// collectGarbage deletes all Peers from the PeerStore which are older than the
-// cutoff time.
-//
-// This function must be able to execute while other methods on this interface
-// are being executed in parallel.
-func (ps *peerStore) collectGarbage(cutoff time.Time) error {
+// ScrapeMany scrapes the swarms one by one, as the memory store has no round
+// trips to save.
+func (ps *peerStore) ScrapeMany(infoHashes []bittorrent.InfoHash, addressFamily bittorrent.AddressFamily) []bittorrent.Scrape {
+	scrapes := make([]bittorrent.Scrape, 0, len(infoHashes))
+	for _, ih := range infoHashes {
+		scrapes = append(scrapes, ps.ScrapeSwarm(ih, addressFamily))
+	}
+	return scrapes
+}
+
+func (ps *peerStore) ScrapeAll(addressFamily bittorrent.AddressFamily) ([]bittorrent.Scrape, error) {
 	select {
 	case <-ps.closed:
-		return nil
+		panic("attempted to interact with stopped memory store")
 	default:
 	}
 
-	cutoffUnix := cutoff.UnixNano()
-	start := time.Now()
-
-	for _, shard := range ps.shards {
+	var scrapes []bittorrent.Scrape
+	for _, shard := range ps.familyShards(addressFamily) {
 		shard.RLock()
-		var infohashes []bittorrent.InfoHash
-		for ih := range shard.swarms {
-			infohashes = append(infohashes, ih)
+		for ih, swarm := range shard.swarms {
+			if len(swarm.seeders) == 0 && len(swarm.leechers) == 0 {
+				continue
+			}
+			scrapes = append(scrapes, bittorrent.Scrape{
+				InfoHash:   ih,
+				Complete:   uint32(len(swarm.seeders)),
+				Incomplete: uint32(len(swarm.leechers)),
+				Snatches:   swarm.snatches,
+			})
 		}
 		shard.RUnlock()
-		runtime.Gosched()
+	}
+
+	return scrapes, nil
+}
+
+// ExportPeers pages through the shards of the address family. Within a
+// shard, the swarms are sorted by infohash.
+//
+// The cursor consists of the index of a shard and the last infohash returned
+// from it.
+func (ps *peerStore) ExportPeers(addressFamily bittorrent.AddressFamily, cursor string, limit int) ([]storage.SwarmPeer, string, error) {
+	select {
+	case <-ps.closed:
+		panic("attempted to interact with stopped memory store")
+	default:
+	}
+
+	shards := ps.familyShards(addressFamily)
+
+	var start int
+	var after []byte
+	if cursor != "" {
+		parts := strings.SplitN(cursor, "/", 2)
+		if len(parts) != 2 {
+			return nil, "", storage.ErrInvalidCursor
+		}
+		var err error
+		start, err = strconv.Atoi(parts[0])
+		if err != nil || start < 0 || start >= len(shards) {
+			return nil, "", storage.ErrInvalidCursor
+		}
+		after, err = hex.DecodeString(parts[1])
+		if err != nil || len(after) != len(bittorrent.InfoHash{}) {
+			return nil, "", storage.ErrInvalidCursor
+		}
+	}
 
-		for _, ih := range infohashes {
-			shard.Lock()
+	var peers []storage.SwarmPeer
+	for i := start; i < len(shards); i++ {
+		shard := shards[i]
+		shard.RLock()
 
-			if _, stillExists := shard.swarms[ih]; !stillExists {
-				shard.Unlock()
-				runtime.Gosched()
+		ihs := make([]bittorrent.InfoHash, 0, len(shard.swarms))
+		for ih := range shard.swarms {
+			if i == start && after != nil && bytes.Compare(ih[:], after) <= 0 {
 				continue
 			}
+			ihs = append(ihs, ih)
+		}
+		sort.Slice(ihs, func(a, b int) bool { return bytes.Compare(ihs[a][:], ihs[b][:]) < 0 })
 
-			for pk, mtime := range shard.swarms[ih].leechers {
-				if mtime <= cutoffUnix {
-					shard.numLeechers--
-					delete(shard.swarms[ih].leechers, pk)
-				}
+		for _, ih := range ihs {
+			sw := shard.swarms[ih]
+			for pk := range sw.seeders {
+				peers = append(peers, storage.SwarmPeer{InfoHash: ih, Peer: decodePeerKey(pk), Seeder: true})
 			}
-
-			for pk, mtime := range shard.swarms[ih].seeders {
-				if mtime <= cutoffUnix {
-					shard.numSeeders--
-					delete(shard.swarms[ih].seeders, pk)
-				}
+			for pk := range sw.leechers {
+				peers = append(peers, storage.SwarmPeer{InfoHash: ih, Peer: decodePeerKey(pk)})
 			}
-
-			if len(shard.swarms[ih].seeders)|len(shard.swarms[ih].leechers) == 0 {
-				delete(shard.swarms, ih)
+			if len(peers) >= limit {
+				shard.RUnlock()
+				return peers, strconv.Itoa(i) + "/" + ih.String(), nil
 			}
+		}
 
-			shard.Unlock()
+		shard.RUnlock()
+	}
+
+	return peers, "", nil
+}
+
+// Clear implements storage.ClearablePeerStore.
+func (ps *peerStore) Clear() error {
+	select {
+	case <-ps.closed:
+		panic("attempted to interact with stopped memory store")
+	default:
+	}
+
+	for _, shard := range ps.shards {
+		ps.lock(shard)
+		for ih := range shard.swarms {
+			shard.invalidate(ih)
+		}
+		shard.swarms = make(map[bittorrent.InfoHash]swarm)
+		shard.numSeeders = 0
+		shard.numLeechers = 0
+		shard.Unlock()
+	}
+
+	log.Info("storage: cleared memory")
+	return nil
+}
+
+// CollectGarbage implements storage.GarbageCollector by visiting all shards,
+// regardless of the GarbageCollectionBudget and GarbageCollectionShards.
+func (ps *peerStore) CollectGarbage() error {
+	return ps.collectGarbage(time.Now().Add(-ps.cfg.PeerLifetime), true)
+}
+
+// collectGarbage deletes all Peers from the PeerStore which are older than the
+// cutoff time.
+//
+// Unless all is set, only some shards are visited if the
+// GarbageCollectionBudget or GarbageCollectionShards are set. The next such
+// call continues with the shard following the last one visited, so that all
+// shards are visited over several calls.
+//
+// This function must be able to execute while other methods on this interface
+// are being executed in parallel. Concurrent calls are serialized.
+func (ps *peerStore) collectGarbage(cutoff time.Time, all bool) error {
+	select {
+	case <-ps.closed:
+		return nil
+	default:
+	}
+
+	ps.gcMu.Lock()
+	defer ps.gcMu.Unlock()
+
+	cutoffUnix := timecache.ToMonotonic(cutoff)
+	start := time.Now()
+
+	if all {
+		for _, shard := range ps.shards {
+			ps.collectShardGarbage(shard, cutoffUnix)
 			runtime.Gosched()
 		}
 
+		log.Debug("storage: collected garbage", log.Fields{
+			"shards":    len(ps.shards),
+			"timeTaken": time.Since(start),
+		})
+		recordGCDuration(time.Since(start))
+		return nil
+	}
+
+	maxShards := len(ps.shards)
+	if ps.cfg.GarbageCollectionShards > 0 && ps.cfg.GarbageCollectionShards < maxShards {
+		maxShards = ps.cfg.GarbageCollectionShards
+	}
+
+	var visited int
+	for visited < maxShards {
+		if ps.cfg.GarbageCollectionBudget > 0 && visited > 0 && time.Since(start) >= ps.cfg.GarbageCollectionBudget {
+			break
+		}
+
+		ps.collectShardGarbage(ps.shards[ps.gcNext], cutoffUnix)
+		ps.gcNext = (ps.gcNext + 1) % len(ps.shards)
+		visited++
 		runtime.Gosched()
 	}
 
+	log.Debug("storage: collected garbage", log.Fields{
+		"shards":    visited,
+		"nextShard": ps.gcNext,
+		"timeTaken": time.Since(start),
+	})
 	recordGCDuration(time.Since(start))
 
 	return nil
 }
 
+// collectShardGarbage deletes all Peers of the shard which were last modified
+// at or before cutoffUnix, and the views of swarms that were not used since
+// the previous collection.
+//
+// The shard is locked for one swarm at a time.
+func (ps *peerStore) collectShardGarbage(shard *peerShard, cutoffUnix int64) {
+	shard.RLock()
+	var infohashes []bittorrent.InfoHash
+	for ih := range shard.swarms {
+		infohashes = append(infohashes, ih)
+	}
+	shard.RUnlock()
+	runtime.Gosched()
+
+	for _, ih := range infohashes {
+		ps.lock(shard)
+
+		if _, stillExists := shard.swarms[ih]; !stillExists {
+			shard.Unlock()
+			runtime.Gosched()
+			continue
+		}
+
+		var removed bool
+		for pk, mtime := range shard.swarms[ih].leechers {
+			if mtime <= cutoffUnix {
+				shard.numLeechers--
+				delete(shard.swarms[ih].leechers, pk)
+				removed = true
+			}
+		}
+
+		for pk, mtime := range shard.swarms[ih].seeders {
+			if mtime <= cutoffUnix {
+				shard.numSeeders--
+				delete(shard.swarms[ih].seeders, pk)
+				removed = true
+			}
+		}
+
+		if removed {
+			shard.invalidate(ih)
+		} else {
+			shard.expireView(ih)
+		}
+		if len(shard.swarms[ih].seeders)|len(shard.swarms[ih].leechers) == 0 {
+			delete(shard.swarms, ih)
+		}
+
+		shard.Unlock()
+		runtime.Gosched()
+	}
+}
+
 func (ps *peerStore) Stop() stop.Result {
+	return ps.StopContext(context.Background())
+}
+
+// StopContext implements stop.ContextStopper. If the context is done before
+// the final snapshot was written, the previous snapshot is kept.
+func (ps *peerStore) StopContext(ctx context.Context) stop.Result {
 	c := make(stop.Channel)
 	go func() {
 		close(ps.closed)
 		ps.wg.Wait()
 
+		var err error
+		if ps.cfg.SnapshotPath != "" {
+			err = ps.writeSnapshot(ctx, ps.cfg.SnapshotPath)
+		}
+
+		for _, m := range ps.shardMetrics {
+			m.delete()
+		}
+
 		// Explicitly deallocate our storage.
 		shards := make([]*peerShard, len(ps.shards))
 		for i := 0; i < len(ps.shards); i++ {
@@ -586,7 +1190,7 @@ func (ps *peerStore) Stop() stop.Result {
 		}
 		ps.shards = shards
 
-		c.Done()
+		c.Done(err)
 	}()
 
 	return c.Result()
@@ -1,9 +1,17 @@
 package memory
 
 import (
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
 	s "github.com/chihaya/chihaya/storage"
 )
 
@@ -20,7 +28,325 @@ func createNew() s.PeerStore {
 	return ps
 }
 
-func TestPeerStore(t *testing.T) { s.TestPeerStore(t, createNew()) }
+func TestPeerStore(t *testing.T)   { s.TestPeerStore(t, createNew()) }
+func TestFullScraper(t *testing.T) { s.TestFullScraper(t, createNew()) }
+func TestPeerMixer(t *testing.T)   { s.TestPeerMixer(t, createNew()) }
+func TestBatcher(t *testing.T)     { s.TestBatcher(t, createNew()) }
+func TestExporter(t *testing.T)    { s.TestExporter(t, createNew()) }
+
+func TestClearablePeerStore(t *testing.T) { s.TestClearablePeerStore(t, createNew()) }
+
+func TestIncrementalGarbageCollection(t *testing.T) {
+	ps, err := New(Config{
+		ShardCount:                  4,
+		GarbageCollectionInterval:   10 * time.Minute,
+		GarbageCollectionShards:     3,
+		PrometheusReportingInterval: 10 * time.Minute,
+		PeerLifetime:                30 * time.Minute,
+	})
+	require.Nil(t, err)
+	defer func() { require.Nil(t, <-ps.Stop()) }()
+	mps := ps.(*peerStore)
+
+	p := bittorrent.Peer{ID: bittorrent.PeerID{1}, Port: 1, IP: bittorrent.IP{IP: net.IPv4(10, 0, 0, 1).To4(), AddressFamily: bittorrent.IPv4}}
+	for i := byte(0); i < 64; i++ {
+		require.Nil(t, ps.PutSeeder(bittorrent.InfoHash{i}, p))
+	}
+	numSwarms := func() (n int) {
+		for _, shard := range mps.shards {
+			n += len(shard.swarms)
+		}
+		return n
+	}
+	require.Equal(t, 64, numSwarms())
+
+	// The four IPv4 shards come first. Every collection visits three
+	// shards, starting where the previous one stopped.
+	cutoff := time.Now().Add(time.Minute)
+	require.Nil(t, mps.collectGarbage(cutoff, false))
+	require.Equal(t, 3, mps.gcNext)
+	require.Equal(t, len(mps.shards[3].swarms), numSwarms())
+
+	require.Nil(t, mps.collectGarbage(cutoff, false))
+	require.Equal(t, 6, mps.gcNext)
+	require.Zero(t, numSwarms())
+
+	require.Nil(t, mps.collectGarbage(cutoff, false))
+	require.Equal(t, 1, mps.gcNext)
+}
+
+func TestConcurrentGarbageCollection(t *testing.T) {
+	ps, err := New(Config{
+		ShardCount:                  4,
+		GarbageCollectionInterval:   10 * time.Minute,
+		GarbageCollectionShards:     1,
+		PrometheusReportingInterval: 10 * time.Minute,
+		PeerLifetime:                30 * time.Minute,
+	})
+	require.Nil(t, err)
+	defer func() { require.Nil(t, <-ps.Stop()) }()
+	mps := ps.(*peerStore)
+
+	p := bittorrent.Peer{ID: bittorrent.PeerID{1}, Port: 1, IP: bittorrent.IP{IP: net.IPv4(10, 0, 0, 1).To4(), AddressFamily: bittorrent.IPv4}}
+	for i := byte(0); i < 64; i++ {
+		require.Nil(t, ps.PutSeeder(bittorrent.InfoHash{i}, p))
+	}
+
+	// Periodic collections run while collections are triggered.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 16; j++ {
+				_ = mps.collectGarbage(time.Now().Add(-time.Minute), false)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 16; j++ {
+				_ = mps.CollectGarbage()
+			}
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, 64%len(mps.shards), mps.gcNext)
+
+	// A triggered collection visits all shards despite
+	// GarbageCollectionShards.
+	mps.cfg.PeerLifetime = -time.Minute
+	require.Nil(t, mps.CollectGarbage())
+	for _, shard := range mps.shards {
+		require.Empty(t, shard.swarms)
+	}
+}
+
+func TestAnnounceViews(t *testing.T) {
+	ps := createNew()
+	defer func() { require.Nil(t, <-ps.Stop()) }()
+
+	ih := bittorrent.InfoHash{1}
+	p1 := bittorrent.Peer{ID: bittorrent.PeerID{1}, Port: 1, IP: bittorrent.IP{IP: net.IPv4(10, 0, 0, 1).To4(), AddressFamily: bittorrent.IPv4}}
+	p2 := bittorrent.Peer{ID: bittorrent.PeerID{2}, Port: 1, IP: bittorrent.IP{IP: net.IPv4(10, 0, 0, 2).To4(), AddressFamily: bittorrent.IPv4}}
+
+	require.Nil(t, ps.PutSeeder(ih, p1))
+	peers, err := ps.AnnouncePeers(ih, false, 50, p2)
+	require.Nil(t, err)
+	require.Len(t, peers, 1)
+
+	// Refreshing a peer keeps the view, adding one replaces it.
+	require.Nil(t, ps.PutSeeder(ih, p1))
+	require.Nil(t, ps.PutLeecher(ih, p2))
+	peers, err = ps.AnnouncePeers(ih, true, 50, p1)
+	require.Nil(t, err)
+	require.Equal(t, []bittorrent.Peer{p2}, peers)
+
+	// Collecting the swarm removes its view.
+	require.Nil(t, ps.(*peerStore).collectGarbage(time.Now().Add(time.Minute), false))
+	_, err = ps.AnnouncePeers(ih, false, 50, p2)
+	require.Equal(t, s.ErrResourceDoesNotExist, err)
+}
+
+func TestViewsExpire(t *testing.T) {
+	ps := createNew()
+	defer func() { require.Nil(t, <-ps.Stop()) }()
+	mps := ps.(*peerStore)
+
+	p := bittorrent.Peer{ID: bittorrent.PeerID{1}, Port: 1, IP: bittorrent.IP{IP: net.IPv4(10, 0, 0, 1).To4(), AddressFamily: bittorrent.IPv4}}
+	announce := func(ih bittorrent.InfoHash) {
+		_, err := ps.AnnouncePeers(ih, false, 50, p)
+		require.Nil(t, err)
+	}
+	numViews := func() (n int) {
+		for _, shard := range mps.shards {
+			shard.views.Range(func(_, _ interface{}) bool {
+				n++
+				return true
+			})
+		}
+		return n
+	}
+
+	for i := 0; i < 1000; i++ {
+		ih := bittorrent.InfoHash{byte(i), byte(i >> 8)}
+		require.Nil(t, ps.PutSeeder(ih, p))
+		announce(ih)
+	}
+	require.Equal(t, 1000, numViews())
+
+	// Views used since the previous collection are kept, the others are
+	// deleted, while their swarms are kept.
+	cutoff := time.Now().Add(-time.Minute)
+	require.Nil(t, mps.collectGarbage(cutoff, true))
+	require.Equal(t, 1000, numViews())
+	announce(bittorrent.InfoHash{1})
+	require.Nil(t, mps.collectGarbage(cutoff, true))
+	require.Equal(t, 1, numViews())
+	require.Nil(t, mps.collectGarbage(cutoff, true))
+	require.Zero(t, numViews())
+	require.Equal(t, uint32(1), ps.ScrapeSwarm(bittorrent.InfoHash{1}, bittorrent.IPv4).Complete)
+}
+
+func TestShardMetrics(t *testing.T) {
+	ps, err := New(Config{
+		ShardCount:                  1,
+		GarbageCollectionInterval:   10 * time.Minute,
+		PrometheusReportingInterval: 10 * time.Minute,
+		PeerLifetime:                30 * time.Minute,
+		ShardMetrics:                true,
+	})
+	require.Nil(t, err)
+	mps := ps.(*peerStore)
+
+	ih := bittorrent.InfoHash{1}
+	for i := byte(0); i < 3; i++ {
+		p := bittorrent.Peer{ID: bittorrent.PeerID{i}, Port: 1, IP: bittorrent.IP{IP: net.IPv4(10, 0, 0, i).To4(), AddressFamily: bittorrent.IPv4}}
+		require.Nil(t, ps.PutSeeder(ih, p))
+	}
+	require.Nil(t, ps.PutLeecher(ih, bittorrent.Peer{ID: bittorrent.PeerID{9}, Port: 1, IP: bittorrent.IP{IP: net.ParseIP("fc00::1"), AddressFamily: bittorrent.IPv6}}))
+	mps.populateProm()
+
+	// The first shard holds IPv4 swarms, the second IPv6 swarms.
+	require.Equal(t, 1.0, testutil.ToFloat64(promShardInfohashesCount.WithLabelValues("0")))
+	require.Equal(t, 3.0, testutil.ToFloat64(promShardSeedersCount.WithLabelValues("0")))
+	require.Equal(t, 0.0, testutil.ToFloat64(promShardLeechersCount.WithLabelValues("0")))
+	require.Equal(t, 1.0, testutil.ToFloat64(promShardLeechersCount.WithLabelValues("1")))
+	require.Greater(t, testutil.ToFloat64(promShardLockWaitSeconds.WithLabelValues("0")), 0.0)
+
+	// The metrics are removed when the PeerStore stops.
+	require.Nil(t, <-ps.Stop())
+	require.Equal(t, 0, testutil.CollectAndCount(promShardSeedersCount))
+}
+
+func TestMaxPeersPerSwarm(t *testing.T) {
+	ps, err := New(Config{
+		ShardCount:                  1,
+		GarbageCollectionInterval:   10 * time.Minute,
+		PrometheusReportingInterval: 10 * time.Minute,
+		PeerLifetime:                30 * time.Minute,
+		MaxPeersPerSwarm:            3,
+	})
+	require.Nil(t, err)
+	defer func() { require.Nil(t, <-ps.Stop()) }()
+	mps := ps.(*peerStore)
+
+	ih := bittorrent.InfoHash{1}
+	peer := func(i byte) bittorrent.Peer {
+		return bittorrent.Peer{ID: bittorrent.PeerID{i}, Port: 1, IP: bittorrent.IP{IP: net.IPv4(10, 0, 0, i).To4(), AddressFamily: bittorrent.IPv4}}
+	}
+	setMtime := func(p bittorrent.Peer, mtime int64) {
+		sw := mps.shards[mps.shardIndex(ih, bittorrent.IPv4)].swarms[ih]
+		if _, ok := sw.seeders[newPeerKey(p)]; ok {
+			sw.seeders[newPeerKey(p)] = mtime
+		} else {
+			sw.leechers[newPeerKey(p)] = mtime
+		}
+	}
+
+	require.Nil(t, ps.PutSeeder(ih, peer(1)))
+	require.Nil(t, ps.PutLeecher(ih, peer(2)))
+	require.Nil(t, ps.PutLeecher(ih, peer(3)))
+	setMtime(peer(1), 3)
+	setMtime(peer(2), 1)
+	setMtime(peer(3), 2)
+
+	// Updating a peer or graduating it doesn't evict anyone.
+	require.Nil(t, ps.PutSeeder(ih, peer(1)))
+	require.Nil(t, ps.GraduateLeecher(ih, peer(3)))
+	setMtime(peer(1), 3)
+	setMtime(peer(3), 2)
+	require.Equal(t, bittorrent.Scrape{InfoHash: ih, Complete: 2, Incomplete: 1, Snatches: 1}, ps.ScrapeSwarm(ih, bittorrent.IPv4))
+
+	// A new peer replaces the stalest one.
+	require.Nil(t, ps.PutSeeder(ih, peer(4)))
+	require.Equal(t, bittorrent.Scrape{InfoHash: ih, Complete: 3, Snatches: 1}, ps.ScrapeSwarm(ih, bittorrent.IPv4))
+	require.Equal(t, s.ErrResourceDoesNotExist, ps.DeleteLeecher(ih, peer(2)))
+
+	require.Nil(t, ps.PutLeecher(ih, peer(5)))
+	require.Equal(t, bittorrent.Scrape{InfoHash: ih, Complete: 2, Incomplete: 1, Snatches: 1}, ps.ScrapeSwarm(ih, bittorrent.IPv4))
+	require.Equal(t, s.ErrResourceDoesNotExist, ps.DeleteSeeder(ih, peer(3)))
+}
+
+// BenchmarkPutFullSwarm measures adding peers to a full swarm, each of which
+// evicts a peer.
+func BenchmarkPutFullSwarm(b *testing.B) {
+	ps, err := New(Config{
+		ShardCount:                  1,
+		GarbageCollectionInterval:   10 * time.Minute,
+		PrometheusReportingInterval: 10 * time.Minute,
+		PeerLifetime:                30 * time.Minute,
+		MaxPeersPerSwarm:            100000,
+	})
+	require.Nil(b, err)
+	defer func() { require.Nil(b, <-ps.Stop()) }()
+
+	ih := bittorrent.InfoHash{1}
+	peer := func(i int) bittorrent.Peer {
+		return bittorrent.Peer{ID: bittorrent.PeerID{byte(i), byte(i >> 8), byte(i >> 16), byte(i >> 24)}, Port: 1, IP: bittorrent.IP{IP: net.IPv4(10, 0, 0, 1).To4(), AddressFamily: bittorrent.IPv4}}
+	}
+	for i := 0; i < 100000; i++ {
+		require.Nil(b, ps.PutLeecher(ih, peer(i)))
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = ps.PutLeecher(ih, peer(100000+i))
+	}
+	b.StopTimer()
+	require.Equal(b, uint32(100000), ps.ScrapeSwarm(ih, bittorrent.IPv4).Incomplete)
+}
+
+func TestMaxSwarms(t *testing.T) {
+	for _, policy := range []string{EvictLRU, EvictLFU} {
+		t.Run(policy, func(t *testing.T) {
+			ps, err := New(Config{
+				ShardCount:                  1,
+				GarbageCollectionInterval:   10 * time.Minute,
+				PrometheusReportingInterval: 10 * time.Minute,
+				PeerLifetime:                30 * time.Minute,
+				MaxSwarms:                   2,
+				EvictionPolicy:              policy,
+			})
+			require.Nil(t, err)
+			defer func() { require.Nil(t, <-ps.Stop()) }()
+			mps := ps.(*peerStore)
+
+			peer := bittorrent.Peer{ID: bittorrent.PeerID{1}, Port: 1, IP: bittorrent.IP{IP: net.IPv4(10, 0, 0, 1).To4(), AddressFamily: bittorrent.IPv4}}
+			setLastAnnounce := func(ih bittorrent.InfoHash, mtime int64) {
+				shard := mps.shards[mps.shardIndex(ih, bittorrent.IPv4)]
+				sw := shard.swarms[ih]
+				sw.lastAnnounce = mtime
+				shard.swarms[ih] = sw
+			}
+
+			// The first swarm is announced to more often, the second more
+			// recently.
+			require.Nil(t, ps.PutSeeder(bittorrent.InfoHash{1}, peer))
+			require.Nil(t, ps.PutSeeder(bittorrent.InfoHash{1}, peer))
+			require.Nil(t, ps.PutLeecher(bittorrent.InfoHash{2}, peer))
+			setLastAnnounce(bittorrent.InfoHash{1}, 1)
+			setLastAnnounce(bittorrent.InfoHash{2}, 2)
+
+			// Swarms of other address families are limited separately.
+			v6Peer := bittorrent.Peer{ID: bittorrent.PeerID{1}, Port: 1, IP: bittorrent.IP{IP: net.ParseIP("fc00::1"), AddressFamily: bittorrent.IPv6}}
+			require.Nil(t, ps.PutSeeder(bittorrent.InfoHash{3}, v6Peer))
+
+			evicted, kept := bittorrent.InfoHash{1}, bittorrent.InfoHash{2}
+			if policy == EvictLFU {
+				evicted, kept = kept, evicted
+			}
+			require.Nil(t, ps.GraduateLeecher(bittorrent.InfoHash{4}, peer))
+			require.Equal(t, bittorrent.Scrape{InfoHash: evicted}, ps.ScrapeSwarm(evicted, bittorrent.IPv4))
+			require.Equal(t, uint32(1), ps.ScrapeSwarm(kept, bittorrent.IPv4).Complete+ps.ScrapeSwarm(kept, bittorrent.IPv4).Incomplete)
+			require.Equal(t, bittorrent.Scrape{InfoHash: bittorrent.InfoHash{4}, Complete: 1, Snatches: 1}, ps.ScrapeSwarm(bittorrent.InfoHash{4}, bittorrent.IPv4))
+			require.Equal(t, uint32(1), ps.ScrapeSwarm(bittorrent.InfoHash{3}, bittorrent.IPv6).Complete)
+
+			shard := mps.shards[0]
+			require.Len(t, shard.swarms, 2)
+			require.Equal(t, uint64(2), shard.numSeeders+shard.numLeechers)
+		})
+	}
+}
 
 func BenchmarkNop(b *testing.B)                        { s.Nop(b, createNew()) }
 func BenchmarkPut(b *testing.B)                        { s.Put(b, createNew()) }
@@ -49,3 +375,54 @@ func BenchmarkAnnounceSeeder(b *testing.B)             { s.AnnounceSeeder(b, cre
 func BenchmarkAnnounceSeeder1kInfohash(b *testing.B)   { s.AnnounceSeeder1kInfohash(b, createNew()) }
 func BenchmarkScrapeSwarm(b *testing.B)                { s.ScrapeSwarm(b, createNew()) }
 func BenchmarkScrapeSwarm1kInfohash(b *testing.B)      { s.ScrapeSwarm1kInfohash(b, createNew()) }
+
+// BenchmarkAnnounceMixedLoad announces to a swarm from parallel goroutines,
+// while every other operation refreshes a seeder and every hundredth
+// operation adds or removes a leecher, and reports the 99th percentile
+// latency of the announces.
+func BenchmarkAnnounceMixedLoad(b *testing.B) {
+	ps := createNew()
+	defer func() { <-ps.Stop() }()
+
+	ih := bittorrent.InfoHash{1}
+	peer := func(i int) bittorrent.Peer {
+		return bittorrent.Peer{ID: bittorrent.PeerID{byte(i), byte(i >> 8)}, Port: 1, IP: bittorrent.IP{IP: net.IPv4(10, 0, byte(i>>8), byte(i)).To4(), AddressFamily: bittorrent.IPv4}}
+	}
+	for i := 0; i < 1000; i++ {
+		_ = ps.PutSeeder(ih, peer(i))
+	}
+
+	var mu sync.Mutex
+	var latencies []time.Duration
+	var next int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		var local []time.Duration
+		for pb.Next() {
+			n := int(atomic.AddInt64(&next, 1))
+			switch {
+			case n%100 == 0:
+				if p := peer(1000 + n/100%1000); n/100%2 == 0 {
+					_ = ps.PutLeecher(ih, p)
+				} else {
+					_ = ps.DeleteLeecher(ih, p)
+				}
+			case n%2 == 0:
+				_ = ps.PutSeeder(ih, peer(n%1000))
+			default:
+				start := time.Now()
+				_, _ = ps.AnnouncePeers(ih, false, 50, peer(2000))
+				local = append(local, time.Since(start))
+			}
+		}
+		mu.Lock()
+		latencies = append(latencies, local...)
+		mu.Unlock()
+	})
+	b.StopTimer()
+
+	if len(latencies) > 0 {
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		b.ReportMetric(float64(latencies[len(latencies)*99/100].Nanoseconds()), "p99-ns/announce")
+	}
+}
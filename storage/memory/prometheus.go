@@ -0,0 +1,95 @@
+package memory
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func init() {
+	prometheus.MustRegister(
+		promShardInfohashesCount,
+		promShardSeedersCount,
+		promShardLeechersCount,
+		promShardLockWaitSeconds,
+	)
+}
+
+var (
+	promShardInfohashesCount = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "chihaya_storage_shard_infohashes_count",
+		Help: "The number of infohashes tracked by a shard of the memory storage",
+	}, []string{"shard"})
+
+	promShardSeedersCount = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "chihaya_storage_shard_seeders_count",
+		Help: "The number of seeders tracked by a shard of the memory storage",
+	}, []string{"shard"})
+
+	promShardLeechersCount = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "chihaya_storage_shard_leechers_count",
+		Help: "The number of leechers tracked by a shard of the memory storage",
+	}, []string{"shard"})
+
+	promShardLockWaitSeconds = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "chihaya_storage_shard_lock_wait_seconds_total",
+		Help: "The time spent waiting to lock a shard of the memory storage for writing",
+	}, []string{"shard"})
+)
+
+// shardMetrics holds the metrics of a shard, so that the label values are
+// only resolved once.
+type shardMetrics struct {
+	label      string
+	infohashes prometheus.Gauge
+	seeders    prometheus.Gauge
+	leechers   prometheus.Gauge
+	lockWait   prometheus.Counter
+
+	// reportedLockWait is the lock wait of the shard already added to
+	// lockWait.
+	reportedLockWait int64
+}
+
+func newShardMetrics(shard int) *shardMetrics {
+	label := strconv.Itoa(shard)
+	return &shardMetrics{
+		label:      label,
+		infohashes: promShardInfohashesCount.WithLabelValues(label),
+		seeders:    promShardSeedersCount.WithLabelValues(label),
+		leechers:   promShardLeechersCount.WithLabelValues(label),
+		lockWait:   promShardLockWaitSeconds.WithLabelValues(label),
+	}
+}
+
+// report posts the counts and lock wait of a shard to prometheus.
+func (m *shardMetrics) report(numInfohashes int, numSeeders, numLeechers uint64, lockWaitNanos int64) {
+	m.infohashes.Set(float64(numInfohashes))
+	m.seeders.Set(float64(numSeeders))
+	m.leechers.Set(float64(numLeechers))
+	m.lockWait.Add(time.Duration(lockWaitNanos - m.reportedLockWait).Seconds())
+	m.reportedLockWait = lockWaitNanos
+}
+
+// delete removes the metrics of the shard from prometheus.
+func (m *shardMetrics) delete() {
+	promShardInfohashesCount.DeleteLabelValues(m.label)
+	promShardSeedersCount.DeleteLabelValues(m.label)
+	promShardLeechersCount.DeleteLabelValues(m.label)
+	promShardLockWaitSeconds.DeleteLabelValues(m.label)
+}
+
+// lock locks the shard for writing. If shard metrics are enabled, the time
+// waited for the lock is added to the lock wait of the shard.
+func (ps *peerStore) lock(shard *peerShard) {
+	if !ps.cfg.ShardMetrics {
+		shard.Lock()
+		return
+	}
+
+	start := time.Now()
+	shard.Lock()
+	atomic.AddInt64(&shard.lockWaitNanos, int64(time.Since(start)))
+}
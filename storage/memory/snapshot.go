@@ -0,0 +1,268 @@
+package memory
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/pkg/timecache"
+)
+
+// snapshotMagic starts every snapshot file and identifies its format version.
+var snapshotMagic = []byte("CHYSNAP2")
+
+// snapshotMagicV1 identifies snapshots written before snatches were counted.
+// They are restored without snatches.
+var snapshotMagicV1 = []byte("CHYSNAP1")
+
+// A snapshot consists of snapshotMagic followed by one record per swarm:
+//
+//	address family (1 byte)
+//	infohash (20 bytes)
+//	number of seeders (uvarint)
+//	number of leechers (uvarint)
+//	number of snatches (uvarint, missing in version 1)
+//	seeders, then leechers, each as:
+//	    length of the serialized peer (uvarint)
+//	    serialized peer
+//	    mtime in nanoseconds since the epoch (varint)
+
+// writeSnapshot atomically replaces the snapshot at path with the current
+// swarms.
+//
+// Every shard is serialized under its read lock, so the snapshot is
+// consistent per swarm, but not across swarms.
+//
+// If the context is done before all shards were written, the previous
+// snapshot is kept and the context's error is returned.
+func (ps *peerStore) writeSnapshot(ctx context.Context, path string) error {
+	start := time.Now()
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	// Removing fails harmlessly once the file was renamed.
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	if _, err := w.Write(snapshotMagic); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	// Peers are updated at times of the monotonic clock, which snapshots
+	// store as wall clock times.
+	now := time.Now()
+	offset := now.UnixNano() - timecache.ToMonotonic(now)
+
+	var buf bytes.Buffer
+	var numSwarms int
+	for i, shard := range ps.shards {
+		if err := ctx.Err(); err != nil {
+			tmp.Close()
+			return err
+		}
+
+		af := bittorrent.IPv4
+		if i >= len(ps.shards)/2 {
+			af = bittorrent.IPv6
+		}
+
+		buf.Reset()
+		shard.RLock()
+		for ih, swarm := range shard.swarms {
+			encodeSwarm(&buf, af, ih, swarm, offset)
+			numSwarms++
+		}
+		shard.RUnlock()
+
+		if _, err := w.Write(buf.Bytes()); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	log.Debug("storage: wrote snapshot", log.Fields{
+		"path":      path,
+		"swarms":    numSwarms,
+		"timeTaken": time.Since(start),
+	})
+	return nil
+}
+
+// encodeSwarm appends the record of a swarm to buf, adding offset to the
+// mtimes of its peers.
+func encodeSwarm(buf *bytes.Buffer, af bittorrent.AddressFamily, ih bittorrent.InfoHash, s swarm, offset int64) {
+	var scratch [binary.MaxVarintLen64]byte
+
+	buf.WriteByte(byte(af))
+	buf.Write(ih[:])
+	buf.Write(scratch[:binary.PutUvarint(scratch[:], uint64(len(s.seeders)))])
+	buf.Write(scratch[:binary.PutUvarint(scratch[:], uint64(len(s.leechers)))])
+	buf.Write(scratch[:binary.PutUvarint(scratch[:], uint64(s.snatches))])
+	for _, peers := range []map[serializedPeer]int64{s.seeders, s.leechers} {
+		for pk, mtime := range peers {
+			buf.Write(scratch[:binary.PutUvarint(scratch[:], uint64(len(pk)))])
+			buf.WriteString(string(pk))
+			buf.Write(scratch[:binary.PutVarint(scratch[:], mtime+offset)])
+		}
+	}
+}
+
+// errInvalidSnapshot is returned when a snapshot cannot be decoded.
+var errInvalidSnapshot = errors.New("invalid snapshot")
+
+// restoreSnapshot adds the peers of the snapshot at path that were updated
+// after cutoff to the PeerStore.
+//
+// If the snapshot is truncated or corrupt, the swarms read up to that point
+// are kept.
+func (ps *peerStore) restoreSnapshot(path string, cutoff time.Time) error {
+	start := time.Now()
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	magic := make([]byte, len(snapshotMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return errInvalidSnapshot
+	}
+	hasSnatches := bytes.Equal(magic, snapshotMagic)
+	if !hasSnatches && !bytes.Equal(magic, snapshotMagicV1) {
+		return errInvalidSnapshot
+	}
+
+	cutoffUnix := cutoff.UnixNano()
+	now := time.Now()
+	offset := now.UnixNano() - timecache.ToMonotonic(now)
+	var numPeers int
+	for {
+		af, err := r.ReadByte()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return err
+		}
+		if bittorrent.AddressFamily(af) != bittorrent.IPv4 && bittorrent.AddressFamily(af) != bittorrent.IPv6 {
+			return errInvalidSnapshot
+		}
+
+		n, err := ps.restoreSwarm(r, bittorrent.AddressFamily(af), hasSnatches, cutoffUnix, offset)
+		if err != nil {
+			return fmt.Errorf("%w: %s", errInvalidSnapshot, err)
+		}
+		numPeers += n
+	}
+
+	log.Info("storage: restored snapshot", log.Fields{
+		"path":      path,
+		"peers":     numPeers,
+		"timeTaken": time.Since(start),
+	})
+	return nil
+}
+
+// restoreSwarm reads one swarm of a snapshot and returns the number of
+// restored peers. Peers updated at or before the wall clock time cutoff are
+// skipped, and offset is subtracted from the mtimes of the others.
+func (ps *peerStore) restoreSwarm(r *bufio.Reader, af bittorrent.AddressFamily, hasSnatches bool, cutoff, offset int64) (int, error) {
+	var ih bittorrent.InfoHash
+	if _, err := io.ReadFull(r, ih[:]); err != nil {
+		return 0, err
+	}
+	numSeeders, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, err
+	}
+	numLeechers, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, err
+	}
+	var snatches uint64
+	if hasSnatches {
+		if snatches, err = binary.ReadUvarint(r); err != nil {
+			return 0, err
+		}
+	}
+
+	s := swarm{
+		seeders:  make(map[serializedPeer]int64),
+		leechers: make(map[serializedPeer]int64),
+		snatches: uint32(snatches),
+	}
+	for i := uint64(0); i < numSeeders+numLeechers; i++ {
+		length, err := binary.ReadUvarint(r)
+		if err != nil {
+			return 0, err
+		}
+		if length != 20+2+net.IPv4len && length != 20+2+net.IPv6len {
+			return 0, fmt.Errorf("peer of length %d", length)
+		}
+		pk := make([]byte, length)
+		if _, err := io.ReadFull(r, pk); err != nil {
+			return 0, err
+		}
+		mtime, err := binary.ReadVarint(r)
+		if err != nil {
+			return 0, err
+		}
+
+		if mtime <= cutoff {
+			continue
+		}
+		mtime -= offset
+		if mtime > s.lastAnnounce {
+			s.lastAnnounce = mtime
+		}
+		if i < numSeeders {
+			s.seeders[serializedPeer(pk)] = mtime
+		} else {
+			s.leechers[serializedPeer(pk)] = mtime
+		}
+	}
+
+	if len(s.seeders)|len(s.leechers) == 0 {
+		return 0, nil
+	}
+
+	// Snapshots are restored before the PeerStore is used, so the swarm
+	// does not exist yet.
+	shard := ps.shards[ps.shardIndex(ih, af)]
+	ps.lock(shard)
+	shard.swarms[ih] = s
+	shard.numSeeders += uint64(len(s.seeders))
+	shard.numLeechers += uint64(len(s.leechers))
+	shard.Unlock()
+
+	return len(s.seeders) + len(s.leechers), nil
+}
@@ -0,0 +1,115 @@
+package memory
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/pkg/stop"
+)
+
+func TestSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "swarms.snapshot")
+	cfg := Config{
+		ShardCount:                  16,
+		GarbageCollectionInterval:   10 * time.Minute,
+		PrometheusReportingInterval: 10 * time.Minute,
+		PeerLifetime:                30 * time.Minute,
+		SnapshotPath:                path,
+		SnapshotInterval:            10 * time.Minute,
+	}
+
+	ih := bittorrent.InfoHash{1}
+	v4 := bittorrent.Peer{ID: bittorrent.PeerID{1}, IP: bittorrent.IP{IP: net.IPv4(10, 0, 0, 1).To4(), AddressFamily: bittorrent.IPv4}, Port: 1}
+	v6 := bittorrent.Peer{ID: bittorrent.PeerID{2}, IP: bittorrent.IP{IP: net.ParseIP("fc00::1"), AddressFamily: bittorrent.IPv6}, Port: 2}
+
+	ps, err := New(cfg)
+	require.Nil(t, err)
+	require.Nil(t, ps.GraduateLeecher(ih, v4))
+	require.Nil(t, ps.PutLeecher(ih, v6))
+	require.Nil(t, ps.PutLeecher(bittorrent.InfoHash{2}, v4))
+	// Stopping writes a final snapshot.
+	require.Empty(t, ps.Stop().Wait())
+
+	ps, err = New(cfg)
+	require.Nil(t, err)
+	require.Equal(t, bittorrent.Scrape{InfoHash: ih, Complete: 1, Snatches: 1}, ps.ScrapeSwarm(ih, bittorrent.IPv4))
+	require.Equal(t, bittorrent.Scrape{InfoHash: ih, Incomplete: 1}, ps.ScrapeSwarm(ih, bittorrent.IPv6))
+	require.Equal(t, bittorrent.Scrape{InfoHash: bittorrent.InfoHash{2}, Incomplete: 1}, ps.ScrapeSwarm(bittorrent.InfoHash{2}, bittorrent.IPv4))
+
+	peers, err := ps.AnnouncePeers(ih, false, 10, bittorrent.Peer{IP: bittorrent.IP{IP: net.IPv4(10, 0, 0, 2).To4(), AddressFamily: bittorrent.IPv4}})
+	require.Nil(t, err)
+	require.Len(t, peers, 1)
+	require.True(t, peers[0].Equal(v4))
+	require.Empty(t, ps.Stop().Wait())
+
+	// Peers that expired since the snapshot are not restored.
+	cfg.PeerLifetime = time.Nanosecond
+	ps, err = New(cfg)
+	require.Nil(t, err)
+	require.Equal(t, uint32(0), ps.ScrapeSwarm(ih, bittorrent.IPv4).Complete)
+	require.Empty(t, ps.Stop().Wait())
+}
+
+func TestSnapshotCanceled(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "swarms.snapshot")
+	cfg := Config{SnapshotPath: path}
+	peer := bittorrent.Peer{ID: bittorrent.PeerID{1}, IP: bittorrent.IP{IP: net.IPv4(10, 0, 0, 1).To4(), AddressFamily: bittorrent.IPv4}, Port: 1}
+
+	ps, err := New(cfg)
+	require.Nil(t, err)
+	require.Nil(t, ps.PutSeeder(bittorrent.InfoHash{1}, peer))
+	require.Empty(t, ps.Stop().Wait())
+
+	// Stopping after the deadline keeps the previous snapshot.
+	ps, err = New(cfg)
+	require.Nil(t, err)
+	require.Nil(t, ps.PutSeeder(bittorrent.InfoHash{2}, peer))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.Equal(t, []error{context.Canceled}, stop.StopContext(ctx, ps).Wait())
+
+	ps, err = New(cfg)
+	require.Nil(t, err)
+	require.Equal(t, uint32(1), ps.ScrapeSwarm(bittorrent.InfoHash{1}, bittorrent.IPv4).Complete)
+	require.Equal(t, uint32(0), ps.ScrapeSwarm(bittorrent.InfoHash{2}, bittorrent.IPv4).Complete)
+	require.Empty(t, ps.Stop().Wait())
+}
+
+func TestSnapshotInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "swarms.snapshot")
+	require.Nil(t, os.WriteFile(path, []byte("garbage"), 0o600))
+
+	ps, err := New(Config{SnapshotPath: path})
+	require.Nil(t, err)
+	require.Equal(t, bittorrent.Scrape{InfoHash: bittorrent.InfoHash{1}}, ps.ScrapeSwarm(bittorrent.InfoHash{1}, bittorrent.IPv4))
+	require.Empty(t, ps.Stop().Wait())
+}
+
+func TestSnapshotV1(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "swarms.snapshot")
+	v4 := bittorrent.Peer{ID: bittorrent.PeerID{1}, IP: bittorrent.IP{IP: net.IPv4(10, 0, 0, 1).To4(), AddressFamily: bittorrent.IPv4}, Port: 1}
+	pk := newPeerKey(v4)
+
+	// A version 1 snapshot has no snatches.
+	snapshot := append([]byte(nil), snapshotMagicV1...)
+	snapshot = append(snapshot, byte(bittorrent.IPv4))
+	snapshot = append(snapshot, bittorrent.InfoHash{1}.RawString()...)
+	snapshot = append(snapshot, 1, 0, byte(len(pk)))
+	snapshot = append(snapshot, pk...)
+	var mtime [binary.MaxVarintLen64]byte
+	snapshot = append(snapshot, mtime[:binary.PutVarint(mtime[:], time.Now().UnixNano())]...)
+	require.Nil(t, os.WriteFile(path, snapshot, 0o600))
+
+	ps, err := New(Config{SnapshotPath: path})
+	require.Nil(t, err)
+	require.Equal(t, bittorrent.Scrape{InfoHash: bittorrent.InfoHash{1}, Complete: 1}, ps.ScrapeSwarm(bittorrent.InfoHash{1}, bittorrent.IPv4))
+	require.Empty(t, ps.Stop().Wait())
+}
@@ -9,6 +9,8 @@ func init() {
 		PromInfohashesCount,
 		PromSeedersCount,
 		PromLeechersCount,
+		PromPeersEvicted,
+		PromSwarmsEvicted,
 	)
 }
 
@@ -41,4 +43,18 @@ var (
 		Name: "chihaya_storage_leechers_count",
 		Help: "The number of leechers tracked",
 	})
+
+	// PromPeersEvicted is a counter of the peers a storage evicted to keep a
+	// swarm within its size limit.
+	PromPeersEvicted = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "chihaya_storage_peers_evicted_total",
+		Help: "The number of peers evicted from full swarms",
+	})
+
+	// PromSwarmsEvicted is a counter of the swarms a storage evicted to keep
+	// the number of swarms within its limit.
+	PromSwarmsEvicted = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "chihaya_storage_swarms_evicted_total",
+		Help: "The number of swarms evicted from a full storage",
+	})
 )
@@ -0,0 +1,442 @@
+package redis
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	redigolib "github.com/gomodule/redigo/redis"
+
+	"github.com/chihaya/chihaya/pkg/log"
+)
+
+// numSlots is the number of hash slots of a redis cluster.
+const numSlots = 16384
+
+// maxRedirects is the number of MOVED or ASK redirections that are followed
+// for a single command.
+const maxRedirects = 3
+
+// cluster keeps track of the nodes of a redis cluster that serve the hash
+// slots, and a pool of connections to each of them.
+type cluster struct {
+	rc    redisConnector
+	seeds []string
+
+	mu    sync.RWMutex
+	slots [numSlots]string
+	pools map[string]*redigolib.Pool
+
+	refreshing int32
+}
+
+func newCluster(rc redisConnector, seeds []string) *cluster {
+	return &cluster{
+		rc:    rc,
+		seeds: seeds,
+		pools: make(map[string]*redigolib.Pool),
+	}
+}
+
+// pool returns the pool of connections to the node at addr.
+func (c *cluster) pool(addr string) *redigolib.Pool {
+	c.mu.RLock()
+	p, ok := c.pools[addr]
+	c.mu.RUnlock()
+	if ok {
+		return p
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if p, ok := c.pools[addr]; ok {
+		return p
+	}
+	rc := c.rc
+	u := *rc.URL
+	u.Host = addr
+	rc.URL = &u
+	p = rc.NewPool()
+	c.pools[addr] = p
+	return p
+}
+
+// refresh updates the slots from the first node that answers CLUSTER SLOTS.
+// The known nodes are asked before the seeds.
+func (c *cluster) refresh() error {
+	c.mu.RLock()
+	addrs := make([]string, 0, len(c.pools)+len(c.seeds))
+	for addr := range c.pools {
+		addrs = append(addrs, addr)
+	}
+	c.mu.RUnlock()
+	addrs = append(addrs, c.seeds...)
+
+	err := errors.New("redis: no cluster nodes")
+	for _, addr := range addrs {
+		var slots [numSlots]string
+		if slots, err = c.fetchSlots(addr); err == nil {
+			c.mu.Lock()
+			c.slots = slots
+			c.mu.Unlock()
+			return nil
+		}
+	}
+	return err
+}
+
+func (c *cluster) fetchSlots(addr string) (slots [numSlots]string, err error) {
+	conn := c.pool(addr).Get()
+	defer conn.Close()
+
+	ranges, err := redigolib.Values(conn.Do("CLUSTER", "SLOTS"))
+	if err != nil {
+		return slots, err
+	}
+	for _, r := range ranges {
+		// Every range consists of the first and last slot, followed by the
+		// master and its replicas, each as IP, port and node ID.
+		fields, err := redigolib.Values(r, nil)
+		if err != nil || len(fields) < 3 {
+			return slots, fmt.Errorf("redis: invalid CLUSTER SLOTS reply: %v", r)
+		}
+		first, err1 := redigolib.Int(fields[0], nil)
+		last, err2 := redigolib.Int(fields[1], nil)
+		master, err3 := redigolib.Values(fields[2], nil)
+		if err1 != nil || err2 != nil || err3 != nil || len(master) < 2 ||
+			first < 0 || last >= numSlots || first > last {
+			return slots, fmt.Errorf("redis: invalid CLUSTER SLOTS reply: %v", r)
+		}
+		ip, err1 := redigolib.String(master[0], nil)
+		port, err2 := redigolib.Int(master[1], nil)
+		if err1 != nil || err2 != nil {
+			return slots, fmt.Errorf("redis: invalid CLUSTER SLOTS reply: %v", r)
+		}
+		if ip == "" {
+			// The node answering doesn't know its own IP.
+			ip, _, _ = net.SplitHostPort(addr)
+		}
+
+		for slot := first; slot <= last; slot++ {
+			slots[slot] = net.JoinHostPort(ip, strconv.Itoa(port))
+		}
+	}
+	return slots, nil
+}
+
+// addr returns the address of the node serving the slot.
+func (c *cluster) addr(slot int) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if addr := c.slots[slot]; addr != "" {
+		return addr
+	}
+	return c.seeds[0]
+}
+
+// move records that the slot moved to the node at addr.
+func (c *cluster) move(slot int, addr string) {
+	c.mu.Lock()
+	c.slots[slot] = addr
+	c.mu.Unlock()
+}
+
+// refreshAsync refreshes the slots in the background, unless a refresh is
+// already running.
+func (c *cluster) refreshAsync() {
+	if !atomic.CompareAndSwapInt32(&c.refreshing, 0, 1) {
+		return
+	}
+	go func() {
+		defer atomic.StoreInt32(&c.refreshing, 0)
+		if err := c.refresh(); err != nil {
+			log.Error("storage: failed to refresh redis cluster slots", log.Fields{"error": err})
+		}
+	}()
+}
+
+// conn returns a connection that routes commands to the nodes of the
+// cluster.
+func (c *cluster) conn() redigolib.Conn {
+	return &clusterConn{c: c, conns: make(map[string]redigolib.Conn)}
+}
+
+// crc16 implements the CRC16-CCITT (XModem) checksum used for hash slots.
+func crc16(b []byte) uint16 {
+	var crc uint16
+	for _, c := range b {
+		crc ^= uint16(c) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// slot returns the hash slot of a key.
+//
+// If the key contains a non-empty hash tag enclosed in braces, only the tag
+// is hashed, so that keys sharing a tag share a slot.
+func slot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16([]byte(key)) % numSlots)
+}
+
+// commandKey returns the first key of a command, if it has one.
+func commandKey(cmd string, args []interface{}) (string, bool) {
+	switch cmd {
+	case "", "MULTI", "EXEC", "DISCARD", "UNWATCH", "PING", "ECHO", "INFO", "SCRIPT", "CLUSTER", "ASKING":
+		return "", false
+	case "EVAL", "EVALSHA":
+		// The keys follow the script and the number of keys.
+		if len(args) < 3 {
+			return "", false
+		}
+		if n, err := strconv.Atoi(keyString(args[1])); err != nil || n == 0 {
+			return "", false
+		}
+		return keyString(args[2]), true
+	}
+	if len(args) == 0 {
+		return "", false
+	}
+	return keyString(args[0]), true
+}
+
+func keyString(arg interface{}) string {
+	switch k := arg.(type) {
+	case string:
+		return k
+	case []byte:
+		return string(k)
+	default:
+		return fmt.Sprint(k)
+	}
+}
+
+// redirect parses MOVED and ASK errors.
+func redirect(err error) (ask bool, slot int, addr string, ok bool) {
+	var rerr redigolib.Error
+	if !errors.As(err, &rerr) {
+		return false, 0, "", false
+	}
+	fields := strings.Fields(string(rerr))
+	if len(fields) != 3 || (fields[0] != "MOVED" && fields[0] != "ASK") {
+		return false, 0, "", false
+	}
+	slot, convErr := strconv.Atoi(fields[1])
+	if convErr != nil || slot < 0 || slot >= numSlots {
+		return false, 0, "", false
+	}
+	return fields[0] == "ASK", slot, fields[2], true
+}
+
+// clusterConn is a connection to a redis cluster.
+//
+// Commands are sent to the node serving the slot of their first key, on a
+// connection to every node used. Between WATCH or MULTI and the end of the
+// transaction, all commands are sent to the node of the first key of the
+// transaction, so all keys of a transaction must share a hash slot.
+//
+// Commands sent with Do follow MOVED and ASK redirections, unless they are
+// part of a transaction or pipeline.
+type clusterConn struct {
+	c     *cluster
+	conns map[string]redigolib.Conn
+
+	// bound is the address of the node of the current transaction.
+	bound string
+	// multi is set if MULTI was issued, but not sent yet, because the
+	// transaction has no key yet.
+	multi bool
+	// inMulti is set if MULTI was sent to the bound node.
+	inMulti bool
+	// pending holds the node addresses of the commands that were sent, but
+	// whose replies were not received yet.
+	pending []string
+}
+
+func (cc *clusterConn) nodeConn(addr string) redigolib.Conn {
+	conn, ok := cc.conns[addr]
+	if !ok {
+		conn = cc.c.pool(addr).Get()
+		cc.conns[addr] = conn
+	}
+	return conn
+}
+
+// route returns the address of the node to send the command to and updates
+// the state of the transaction.
+//
+// It returns an empty address for a MULTI whose node is not known yet.
+func (cc *clusterConn) route(cmd string, args []interface{}) (string, error) {
+	if cc.bound == "" && cmd == "MULTI" {
+		cc.multi = true
+		return "", nil
+	}
+
+	addr := cc.bound
+	if addr == "" {
+		key, ok := commandKey(cmd, args)
+		if !ok {
+			if cc.multi {
+				return "", errors.New("redis: transaction without keys in cluster")
+			}
+			return cc.c.addr(0), nil
+		}
+		addr = cc.c.addr(slot(key))
+		if cc.multi || cmd == "WATCH" {
+			cc.bound = addr
+		}
+	}
+
+	if cc.multi {
+		// Send the deferred MULTI first.
+		if err := cc.nodeConn(addr).Send("MULTI"); err != nil {
+			return "", err
+		}
+		cc.pending = append(cc.pending, addr)
+		cc.multi = false
+		cc.inMulti = true
+	}
+
+	switch cmd {
+	case "EXEC", "DISCARD":
+		cc.bound, cc.inMulti = "", false
+	case "UNWATCH":
+		// UNWATCH only ends transactions that were not started with MULTI.
+		if !cc.inMulti {
+			cc.bound = ""
+		}
+	}
+	return addr, nil
+}
+
+func (cc *clusterConn) Send(cmd string, args ...interface{}) error {
+	cmd = strings.ToUpper(cmd)
+	addr, err := cc.route(cmd, args)
+	if err != nil || addr == "" {
+		return err
+	}
+	if err := cc.nodeConn(addr).Send(cmd, args...); err != nil {
+		return err
+	}
+	cc.pending = append(cc.pending, addr)
+	return nil
+}
+
+func (cc *clusterConn) Flush() error {
+	for _, conn := range cc.conns {
+		if err := conn.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (cc *clusterConn) Receive() (interface{}, error) {
+	if len(cc.pending) == 0 {
+		return nil, errors.New("redis: no pending replies")
+	}
+	addr := cc.pending[0]
+	cc.pending = cc.pending[1:]
+	return cc.nodeConn(addr).Receive()
+}
+
+func (cc *clusterConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	cmd = strings.ToUpper(cmd)
+	if cmd == "" {
+		// Flush and receive all pending replies.
+		if err := cc.Flush(); err != nil {
+			return nil, err
+		}
+		var reply interface{}
+		var err error
+		for len(cc.pending) > 0 {
+			r, e := cc.Receive()
+			if e != nil && err == nil {
+				err = e
+			}
+			reply = r
+		}
+		return reply, err
+	}
+
+	standalone := cc.bound == "" && !cc.multi && len(cc.pending) == 0 && cmd != "WATCH"
+	addr, err := cc.route(cmd, args)
+	if err != nil {
+		return nil, err
+	}
+	if addr == "" {
+		// The reply to MULTI is always OK.
+		return "OK", nil
+	}
+
+	if !standalone {
+		// The connection receives the pending replies of its node.
+		reply, err := cc.nodeConn(addr).Do(cmd, args...)
+		pending := cc.pending[:0]
+		for _, a := range cc.pending {
+			if a != addr {
+				pending = append(pending, a)
+			}
+		}
+		cc.pending = pending
+		return reply, err
+	}
+
+	var asking bool
+	for i := 0; ; i++ {
+		conn := cc.nodeConn(addr)
+		if asking {
+			if err := conn.Send("ASKING"); err != nil {
+				return nil, err
+			}
+		}
+		reply, err := conn.Do(cmd, args...)
+
+		ask, slot, newAddr, ok := redirect(err)
+		if !ok || i == maxRedirects {
+			return reply, err
+		}
+		if !ask {
+			cc.c.move(slot, newAddr)
+			cc.c.refreshAsync()
+		}
+		asking = ask
+		addr = newAddr
+	}
+}
+
+func (cc *clusterConn) Err() error {
+	for _, conn := range cc.conns {
+		if err := conn.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (cc *clusterConn) Close() error {
+	var err error
+	for addr, conn := range cc.conns {
+		if e := conn.Close(); e != nil && err == nil {
+			err = e
+		}
+		delete(cc.conns, addr)
+	}
+	cc.bound, cc.multi, cc.inMulti, cc.pending = "", false, false, nil
+	return err
+}
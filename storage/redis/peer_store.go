@@ -21,14 +21,27 @@
 //
 //   - IPv{4,6}_L_count
 //     To record the number of leechers.
+//
+// The snatches of a swarm are counted in IPv{4,6}_D_infohash, which is
+// deleted with the seeders of the swarm.
+//
+// In cluster mode, every address family is split into groups named
+// IPv{4,6}{shard}, which take the place of the address family in all keys.
+// The hash tag of the shard places all keys of a group in the same hash slot,
+// so the transactions of a swarm stay on one node.
+//
+// All keys start with the configured key prefix, which is empty by default.
 package redis
 
 import (
+	"context"
 	"encoding/binary"
+	"encoding/hex"
 	"errors"
-	"net"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gomodule/redigo/redis"
@@ -53,8 +66,13 @@ const (
 	defaultRedisReadTimeout            = time.Second * 15
 	defaultRedisWriteTimeout           = time.Second * 15
 	defaultRedisConnectTimeout         = time.Second * 15
+	defaultRedisClusterShardCount      = 256
 )
 
+// gcScanBatchSize is the number of fields garbage collection requests from
+// redis at a time.
+const gcScanBatchSize = 1000
+
 func init() {
 	// Register the storage driver.
 	storage.RegisterDriver(Name, driver{})
@@ -88,6 +106,14 @@ type Config struct {
 	RedisReadTimeout            time.Duration `yaml:"redis_read_timeout"`
 	RedisWriteTimeout           time.Duration `yaml:"redis_write_timeout"`
 	RedisConnectTimeout         time.Duration `yaml:"redis_connect_timeout"`
+	RedisTLSCAFile              string        `yaml:"redis_tls_ca_file"`
+	RedisTLSCertFile            string        `yaml:"redis_tls_cert_file"`
+	RedisTLSKeyFile             string        `yaml:"redis_tls_key_file"`
+	RedisTLSInsecureSkipVerify  bool          `yaml:"redis_tls_insecure_skip_verify"`
+	KeyPrefix                   string        `yaml:"key_prefix"`
+	ReconcileCounters           bool          `yaml:"reconcile_counters"`
+	RedisCluster                bool          `yaml:"redis_cluster"`
+	RedisClusterShardCount      int           `yaml:"redis_cluster_shard_count"`
 }
 
 // LogFields renders the current config as a set of Logrus fields.
@@ -101,6 +127,13 @@ func (cfg Config) LogFields() log.Fields {
 		"redisReadTimeout":    cfg.RedisReadTimeout,
 		"redisWriteTimeout":   cfg.RedisWriteTimeout,
 		"redisConnectTimeout": cfg.RedisConnectTimeout,
+		"redisTLSCAFile":      cfg.RedisTLSCAFile,
+		"redisTLSCertFile":    cfg.RedisTLSCertFile,
+		"redisTLSSkipVerify":  cfg.RedisTLSInsecureSkipVerify,
+		"keyPrefix":           cfg.KeyPrefix,
+		"reconcileCounters":   cfg.ReconcileCounters,
+		"redisCluster":        cfg.RedisCluster,
+		"redisClusterShards":  cfg.RedisClusterShardCount,
 	}
 }
 
@@ -147,6 +180,15 @@ func (cfg Config) Validate() Config {
 		})
 	}
 
+	if cfg.RedisCluster && cfg.RedisClusterShardCount <= 0 {
+		validcfg.RedisClusterShardCount = defaultRedisClusterShardCount
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".RedisClusterShardCount",
+			"provided": cfg.RedisClusterShardCount,
+			"default":  validcfg.RedisClusterShardCount,
+		})
+	}
+
 	if cfg.GarbageCollectionInterval <= 0 {
 		validcfg.GarbageCollectionInterval = defaultGarbageCollectionInterval
 		log.Warn("falling back to default configuration", log.Fields{
@@ -186,12 +228,40 @@ func New(provided Config) (storage.PeerStore, error) {
 		return nil, err
 	}
 
+	rb, err := newRedisBackend(&provided, u, "")
+	if err != nil {
+		return nil, err
+	}
+
+	return newPeerStore(cfg, rb), nil
+}
+
+// newPeerStore creates a PeerStore using the backend and starts its
+// goroutines.
+func newPeerStore(cfg Config, rb *redisBackend) *peerStore {
 	ps := &peerStore{
 		cfg:    cfg,
-		rb:     newRedisBackend(&provided, u, ""),
+		rb:     rb,
 		closed: make(chan struct{}),
 	}
 
+	// Scripts that failed to load are sent when they are called.
+	conn := rb.open()
+	if err := loadScripts(conn); err != nil {
+		log.Warn("storage: failed to load redis scripts", log.Fields{"error": err})
+	}
+	conn.Close()
+
+	if cfg.ReconcileCounters {
+		ps.wg.Add(1)
+		go func() {
+			defer ps.wg.Done()
+			if err := ps.reconcileCounters(); err != nil {
+				log.Error("storage: failed to reconcile counters", log.Fields{"error": err})
+			}
+		}()
+	}
+
 	// Start a goroutine for garbage collection.
 	ps.wg.Add(1)
 	go func() {
@@ -203,7 +273,7 @@ func New(provided Config) (storage.PeerStore, error) {
 			case <-time.After(cfg.GarbageCollectionInterval):
 				before := time.Now().Add(-cfg.PeerLifetime)
 				log.Debug("storage: purging peers with no announces since", log.Fields{"before": before})
-				if err = ps.collectGarbage(before); err != nil {
+				if err := ps.collectGarbage(before); err != nil {
 					log.Error("storage: collectGarbage error", log.Fields{"before": before, "error": err})
 				}
 			}
@@ -228,36 +298,21 @@ func New(provided Config) (storage.PeerStore, error) {
 		}
 	}()
 
-	return ps, nil
+	return ps
 }
 
+// serializedPeer is a Peer encoded by bittorrent.EncodePeer.
 type serializedPeer string
 
 func newPeerKey(p bittorrent.Peer) serializedPeer {
-	b := make([]byte, 20+2+len(p.IP.IP))
-	copy(b[:20], p.ID[:])
-	binary.BigEndian.PutUint16(b[20:22], p.Port)
-	copy(b[22:], p.IP.IP)
-
-	return serializedPeer(b)
+	return serializedPeer(bittorrent.EncodePeer(p))
 }
 
 func decodePeerKey(pk serializedPeer) bittorrent.Peer {
-	peer := bittorrent.Peer{
-		ID:   bittorrent.PeerIDFromString(string(pk[:20])),
-		Port: binary.BigEndian.Uint16([]byte(pk[20:22])),
-		IP:   bittorrent.IP{IP: net.IP(pk[22:])},
-	}
-
-	if ip := peer.IP.To4(); ip != nil {
-		peer.IP.IP = ip
-		peer.IP.AddressFamily = bittorrent.IPv4
-	} else if len(peer.IP.IP) == net.IPv6len { // implies toReturn.IP.To4() == nil
-		peer.IP.AddressFamily = bittorrent.IPv6
-	} else {
-		panic("IP is neither v4 nor v6")
+	peer, err := bittorrent.EncodedPeer(pk).Decode()
+	if err != nil {
+		panic(err)
 	}
-
 	return peer
 }
 
@@ -265,12 +320,44 @@ type peerStore struct {
 	cfg Config
 	rb  *redisBackend
 
+	// noHRandField is set to 1 once redis turned out not to support
+	// HRANDFIELD.
+	noHRandField int32
+
 	closed chan struct{}
 	wg     sync.WaitGroup
 }
 
+// groups returns the groups of all address families.
 func (ps *peerStore) groups() []string {
-	return []string{bittorrent.IPv4.String(), bittorrent.IPv6.String()}
+	return append(ps.familyGroups(bittorrent.IPv4), ps.familyGroups(bittorrent.IPv6)...)
+}
+
+// familyGroups returns the groups of an address family.
+//
+// Without a cluster, the address family is the only group. In a cluster, the
+// swarms are spread over RedisClusterShardCount groups, each of which
+// is tagged with its shard number so that its keys share a hash slot.
+//
+// The groups, and hence all keys, start with the KeyPrefix.
+func (ps *peerStore) familyGroups(af bittorrent.AddressFamily) []string {
+	if !ps.cfg.RedisCluster {
+		return []string{ps.cfg.KeyPrefix + af.String()}
+	}
+	groups := make([]string, ps.cfg.RedisClusterShardCount)
+	for i := range groups {
+		groups[i] = ps.cfg.KeyPrefix + af.String() + "{" + strconv.Itoa(i) + "}"
+	}
+	return groups
+}
+
+// group returns the group of the swarm of the infohash.
+func (ps *peerStore) group(af bittorrent.AddressFamily, ih bittorrent.InfoHash) string {
+	if !ps.cfg.RedisCluster {
+		return ps.cfg.KeyPrefix + af.String()
+	}
+	shard := binary.BigEndian.Uint32(ih[:4]) % uint32(ps.cfg.RedisClusterShardCount)
+	return ps.cfg.KeyPrefix + af.String() + "{" + strconv.Itoa(int(shard)) + "}"
 }
 
 func (ps *peerStore) leecherInfohashKey(af, ih string) string {
@@ -293,6 +380,45 @@ func (ps *peerStore) leecherCountKey(af string) string {
 	return af + "_L_count"
 }
 
+func (ps *peerStore) snatchCountKey(af, ih string) string {
+	return af + "_D_" + ih
+}
+
+// reconcileCounters recounts the seeders, leechers and infohashes of every
+// group and replaces the counters, which may have drifted from the swarms,
+// for example when connections failed while collecting garbage.
+//
+// Every group is recounted by a script, which blocks redis while it runs.
+func (ps *peerStore) reconcileCounters() error {
+	conn := ps.rb.open()
+	defer conn.Close()
+
+	start := time.Now()
+	for _, group := range ps.groups() {
+		select {
+		case <-ps.closed:
+			return nil
+		default:
+		}
+
+		counts, err := redis.Int64s(reconcileCountersScript.Do(conn,
+			group, ps.seederCountKey(group), ps.leecherCountKey(group), ps.infohashCountKey(group),
+			ps.seederInfohashKey(group, ""), ps.leecherInfohashKey(group, "")))
+		if err != nil {
+			return err
+		}
+		log.Debug("storage: reconciled counters", log.Fields{
+			"group":      group,
+			"seeders":    counts[0],
+			"leechers":   counts[1],
+			"infohashes": counts[2],
+		})
+	}
+
+	log.Info("storage: reconciled counters", log.Fields{"timeTaken": time.Since(start)})
+	return nil
+}
+
 // populateProm aggregates metrics over all groups and then posts them to
 // prometheus.
 func (ps *peerStore) populateProm() {
@@ -338,7 +464,7 @@ func (ps *peerStore) getClock() int64 {
 }
 
 func (ps *peerStore) PutSeeder(ih bittorrent.InfoHash, p bittorrent.Peer) error {
-	addressFamily := p.IP.AddressFamily.String()
+	group := ps.group(p.IP.AddressFamily, ih)
 	log.Debug("storage: PutSeeder", log.Fields{
 		"InfoHash": ih.String(),
 		"Peer":     p,
@@ -351,41 +477,60 @@ func (ps *peerStore) PutSeeder(ih bittorrent.InfoHash, p bittorrent.Peer) error
 	}
 
 	pk := newPeerKey(p)
-
-	encodedSeederInfoHash := ps.seederInfohashKey(addressFamily, ih.String())
+	encodedSeederInfoHash := ps.seederInfohashKey(group, ih.String())
 	ct := ps.getClock()
 
 	conn := ps.rb.open()
 	defer conn.Close()
 
-	_ = conn.Send("MULTI")
-	_ = conn.Send("HSET", encodedSeederInfoHash, pk, ct)
-	_ = conn.Send("HSET", addressFamily, encodedSeederInfoHash, ct)
-	reply, err := redis.Int64s(conn.Do("EXEC"))
-	if err != nil {
-		return err
+	_, err := putPeerScript.Do(conn,
+		encodedSeederInfoHash, group, ps.seederCountKey(group), ps.infohashCountKey(group),
+		pk, ct, "1")
+	return err
+}
+
+// PutPeers adds or updates the peers in a single pipeline.
+func (ps *peerStore) PutPeers(peers []storage.SwarmPeer) error {
+	select {
+	case <-ps.closed:
+		panic("attempted to interact with stopped redis store")
+	default:
 	}
 
-	// pk is a new field.
-	if reply[0] == 1 {
-		_, err = conn.Do("INCR", ps.seederCountKey(addressFamily))
-		if err != nil {
-			return err
+	ct := ps.getClock()
+
+	conn := ps.rb.open()
+	defer conn.Close()
+
+	for _, sp := range peers {
+		group := ps.group(sp.Peer.IP.AddressFamily, sp.InfoHash)
+		swarmKey, countKey, isSeeder := ps.leecherInfohashKey(group, sp.InfoHash.String()), ps.leecherCountKey(group), "0"
+		if sp.Seeder {
+			swarmKey, countKey, isSeeder = ps.seederInfohashKey(group, sp.InfoHash.String()), ps.seederCountKey(group), "1"
 		}
-	}
-	// encodedSeederInfoHash is a new field.
-	if reply[1] == 1 {
-		_, err = conn.Do("INCR", ps.infohashCountKey(addressFamily))
-		if err != nil {
+		// The script is sent with EVAL, as a failing EVALSHA can't be
+		// retried within the pipeline.
+		if err := putPeerScript.Send(conn,
+			swarmKey, group, countKey, ps.infohashCountKey(group),
+			newPeerKey(sp.Peer), ct, isSeeder); err != nil {
 			return err
 		}
 	}
+	if err := conn.Flush(); err != nil {
+		return err
+	}
 
-	return nil
+	var firstErr error
+	for range peers {
+		if _, err := conn.Receive(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
 }
 
 func (ps *peerStore) DeleteSeeder(ih bittorrent.InfoHash, p bittorrent.Peer) error {
-	addressFamily := p.IP.AddressFamily.String()
+	group := ps.group(p.IP.AddressFamily, ih)
 	log.Debug("storage: DeleteSeeder", log.Fields{
 		"InfoHash": ih.String(),
 		"Peer":     p,
@@ -402,24 +547,21 @@ func (ps *peerStore) DeleteSeeder(ih bittorrent.InfoHash, p bittorrent.Peer) err
 	conn := ps.rb.open()
 	defer conn.Close()
 
-	encodedSeederInfoHash := ps.seederInfohashKey(addressFamily, ih.String())
+	encodedSeederInfoHash := ps.seederInfohashKey(group, ih.String())
 
-	delNum, err := redis.Int64(conn.Do("HDEL", encodedSeederInfoHash, pk))
+	delNum, err := redis.Int64(deletePeerScript.Do(conn, encodedSeederInfoHash, ps.seederCountKey(group), pk))
 	if err != nil {
 		return err
 	}
 	if delNum == 0 {
 		return storage.ErrResourceDoesNotExist
 	}
-	if _, err := conn.Do("DECR", ps.seederCountKey(addressFamily)); err != nil {
-		return err
-	}
 
 	return nil
 }
 
 func (ps *peerStore) PutLeecher(ih bittorrent.InfoHash, p bittorrent.Peer) error {
-	addressFamily := p.IP.AddressFamily.String()
+	group := ps.group(p.IP.AddressFamily, ih)
 	log.Debug("storage: PutLeecher", log.Fields{
 		"InfoHash": ih.String(),
 		"Peer":     p,
@@ -432,32 +574,21 @@ func (ps *peerStore) PutLeecher(ih bittorrent.InfoHash, p bittorrent.Peer) error
 	}
 
 	// Update the peer in the swarm.
-	encodedLeecherInfoHash := ps.leecherInfohashKey(addressFamily, ih.String())
+	encodedLeecherInfoHash := ps.leecherInfohashKey(group, ih.String())
 	pk := newPeerKey(p)
 	ct := ps.getClock()
 
 	conn := ps.rb.open()
 	defer conn.Close()
 
-	_ = conn.Send("MULTI")
-	_ = conn.Send("HSET", encodedLeecherInfoHash, pk, ct)
-	_ = conn.Send("HSET", addressFamily, encodedLeecherInfoHash, ct)
-	reply, err := redis.Int64s(conn.Do("EXEC"))
-	if err != nil {
-		return err
-	}
-	// pk is a new field.
-	if reply[0] == 1 {
-		_, err = conn.Do("INCR", ps.leecherCountKey(addressFamily))
-		if err != nil {
-			return err
-		}
-	}
-	return nil
+	_, err := putPeerScript.Do(conn,
+		encodedLeecherInfoHash, group, ps.leecherCountKey(group), ps.infohashCountKey(group),
+		pk, ct, "0")
+	return err
 }
 
 func (ps *peerStore) DeleteLeecher(ih bittorrent.InfoHash, p bittorrent.Peer) error {
-	addressFamily := p.IP.AddressFamily.String()
+	group := ps.group(p.IP.AddressFamily, ih)
 	log.Debug("storage: DeleteLeecher", log.Fields{
 		"InfoHash": ih.String(),
 		"Peer":     p,
@@ -469,28 +600,26 @@ func (ps *peerStore) DeleteLeecher(ih bittorrent.InfoHash, p bittorrent.Peer) er
 	default:
 	}
 
+	pk := newPeerKey(p)
+
 	conn := ps.rb.open()
 	defer conn.Close()
 
-	pk := newPeerKey(p)
-	encodedLeecherInfoHash := ps.leecherInfohashKey(addressFamily, ih.String())
+	encodedLeecherInfoHash := ps.leecherInfohashKey(group, ih.String())
 
-	delNum, err := redis.Int64(conn.Do("HDEL", encodedLeecherInfoHash, pk))
+	delNum, err := redis.Int64(deletePeerScript.Do(conn, encodedLeecherInfoHash, ps.leecherCountKey(group), pk))
 	if err != nil {
 		return err
 	}
 	if delNum == 0 {
 		return storage.ErrResourceDoesNotExist
 	}
-	if _, err := conn.Do("DECR", ps.leecherCountKey(addressFamily)); err != nil {
-		return err
-	}
 
 	return nil
 }
 
 func (ps *peerStore) GraduateLeecher(ih bittorrent.InfoHash, p bittorrent.Peer) error {
-	addressFamily := p.IP.AddressFamily.String()
+	group := ps.group(p.IP.AddressFamily, ih)
 	log.Debug("storage: GraduateLeecher", log.Fields{
 		"InfoHash": ih.String(),
 		"Peer":     p,
@@ -503,46 +632,81 @@ func (ps *peerStore) GraduateLeecher(ih bittorrent.InfoHash, p bittorrent.Peer)
 	}
 
 	encodedInfoHash := ih.String()
-	encodedLeecherInfoHash := ps.leecherInfohashKey(addressFamily, encodedInfoHash)
-	encodedSeederInfoHash := ps.seederInfohashKey(addressFamily, encodedInfoHash)
+	encodedLeecherInfoHash := ps.leecherInfohashKey(group, encodedInfoHash)
+	encodedSeederInfoHash := ps.seederInfohashKey(group, encodedInfoHash)
 	pk := newPeerKey(p)
 	ct := ps.getClock()
 
 	conn := ps.rb.open()
 	defer conn.Close()
 
-	_ = conn.Send("MULTI")
-	_ = conn.Send("HDEL", encodedLeecherInfoHash, pk)
-	_ = conn.Send("HSET", encodedSeederInfoHash, pk, ct)
-	_ = conn.Send("HSET", addressFamily, encodedSeederInfoHash, ct)
-	reply, err := redis.Int64s(conn.Do("EXEC"))
-	if err != nil {
-		return err
-	}
-	if reply[0] == 1 {
-		_, err = conn.Do("DECR", ps.leecherCountKey(addressFamily))
-		if err != nil {
-			return err
+	_, err := graduatePeerScript.Do(conn,
+		encodedLeecherInfoHash, encodedSeederInfoHash, group,
+		ps.leecherCountKey(group), ps.seederCountKey(group), ps.infohashCountKey(group),
+		ps.snatchCountKey(group, encodedInfoHash),
+		pk, ct)
+	return err
+}
+
+// isUnknownCommand reports whether err is the error of redis for commands
+// it doesn't know.
+func isUnknownCommand(err error) bool {
+	var rerr redis.Error
+	return errors.As(err, &rerr) && strings.HasPrefix(string(rerr), "ERR unknown command")
+}
+
+// samplePeerKeys returns up to numSeeders random seeders and up to
+// numLeechers random leechers of a swarm in a single round trip.
+//
+// Random fields are sampled with HRANDFIELD. Servers older than redis 6.2
+// don't know it and return all peers instead, so callers must not rely on
+// the numbers.
+func (ps *peerStore) samplePeerKeys(conn redis.Conn, seederKey, leecherKey string, numSeeders, numLeechers int) (seeders, leechers [][]byte, err error) {
+	useHKEYS := atomic.LoadInt32(&ps.noHRandField) == 1
+	for _, sample := range []struct {
+		key string
+		num int
+	}{
+		{seederKey, numSeeders},
+		{leecherKey, numLeechers},
+	} {
+		if useHKEYS {
+			err = conn.Send("HKEYS", sample.key)
+		} else {
+			err = conn.Send("HRANDFIELD", sample.key, sample.num)
 		}
-	}
-	if reply[1] == 1 {
-		_, err = conn.Do("INCR", ps.seederCountKey(addressFamily))
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
 	}
-	if reply[2] == 1 {
-		_, err = conn.Do("INCR", ps.infohashCountKey(addressFamily))
-		if err != nil {
-			return err
-		}
+	if err := conn.Flush(); err != nil {
+		return nil, nil, err
 	}
 
-	return nil
+	// Both replies must be received before returning.
+	seeders, seedersErr := redis.ByteSlices(conn.Receive())
+	leechers, leechersErr := redis.ByteSlices(conn.Receive())
+	if !useHKEYS && isUnknownCommand(seedersErr) {
+		log.Info("storage: redis does not support HRANDFIELD, falling back to HKEYS")
+		atomic.StoreInt32(&ps.noHRandField, 1)
+		return ps.samplePeerKeys(conn, seederKey, leecherKey, numSeeders, numLeechers)
+	}
+	if seedersErr != nil {
+		return nil, nil, seedersErr
+	}
+	if leechersErr != nil {
+		return nil, nil, leechersErr
+	}
+	return seeders, leechers, nil
 }
 
+// AnnouncePeers samples the seeders and leechers of the swarm in one round
+// trip.
+//
+// One more peer than needed is sampled where the announcer may be among them,
+// and at least one peer of each kind, so that empty swarms can be told apart.
 func (ps *peerStore) AnnouncePeers(ih bittorrent.InfoHash, seeder bool, numWant int, announcer bittorrent.Peer) (peers []bittorrent.Peer, err error) {
-	addressFamily := announcer.IP.AddressFamily.String()
+	group := ps.group(announcer.IP.AddressFamily, ih)
 	log.Debug("storage: AnnouncePeers", log.Fields{
 		"InfoHash": ih.String(),
 		"seeder":   seeder,
@@ -557,28 +721,32 @@ func (ps *peerStore) AnnouncePeers(ih bittorrent.InfoHash, seeder bool, numWant
 	}
 
 	encodedInfoHash := ih.String()
-	encodedLeecherInfoHash := ps.leecherInfohashKey(addressFamily, encodedInfoHash)
-	encodedSeederInfoHash := ps.seederInfohashKey(addressFamily, encodedInfoHash)
+	encodedLeecherInfoHash := ps.leecherInfohashKey(group, encodedInfoHash)
+	encodedSeederInfoHash := ps.seederInfohashKey(group, encodedInfoHash)
 
 	conn := ps.rb.open()
 	defer conn.Close()
 
-	leechers, err := conn.Do("HKEYS", encodedLeecherInfoHash)
-	if err != nil {
-		return nil, err
+	numSeeders, numLeechers := numWant, numWant+1
+	if seeder {
+		numSeeders, numLeechers = 1, numWant
 	}
-	conLeechers := leechers.([]interface{})
-
-	seeders, err := conn.Do("HKEYS", encodedSeederInfoHash)
+	if numLeechers == 0 {
+		numLeechers = 1
+	}
+	if numSeeders == 0 {
+		numSeeders = 1
+	}
+	conSeeders, conLeechers, err := ps.samplePeerKeys(conn, encodedSeederInfoHash, encodedLeecherInfoHash, numSeeders, numLeechers)
 	if err != nil {
 		return nil, err
 	}
-	conSeeders := seeders.([]interface{})
 
 	if len(conLeechers) == 0 && len(conSeeders) == 0 {
 		return nil, storage.ErrResourceDoesNotExist
 	}
 
+	peers = bittorrent.NewPeers(numWant)
 	if seeder {
 		// Append leechers as possible.
 		for _, pk := range conLeechers {
@@ -586,7 +754,7 @@ func (ps *peerStore) AnnouncePeers(ih bittorrent.InfoHash, seeder bool, numWant
 				break
 			}
 
-			peers = append(peers, decodePeerKey(serializedPeer(pk.([]byte))))
+			peers = append(peers, decodePeerKey(serializedPeer(pk)))
 			numWant--
 		}
 	} else {
@@ -596,7 +764,7 @@ func (ps *peerStore) AnnouncePeers(ih bittorrent.InfoHash, seeder bool, numWant
 				break
 			}
 
-			peers = append(peers, decodePeerKey(serializedPeer(pk.([]byte))))
+			peers = append(peers, decodePeerKey(serializedPeer(pk)))
 			numWant--
 		}
 
@@ -604,7 +772,7 @@ func (ps *peerStore) AnnouncePeers(ih bittorrent.InfoHash, seeder bool, numWant
 		if numWant > 0 {
 			announcerPK := newPeerKey(announcer)
 			for _, pk := range conLeechers {
-				if pk == announcerPK {
+				if serializedPeer(pk) == announcerPK {
 					continue
 				}
 
@@ -612,7 +780,7 @@ func (ps *peerStore) AnnouncePeers(ih bittorrent.InfoHash, seeder bool, numWant
 					break
 				}
 
-				peers = append(peers, decodePeerKey(serializedPeer(pk.([]byte))))
+				peers = append(peers, decodePeerKey(serializedPeer(pk)))
 				numWant--
 			}
 		}
@@ -621,6 +789,63 @@ func (ps *peerStore) AnnouncePeers(ih bittorrent.InfoHash, seeder bool, numWant
 	return
 }
 
+func (ps *peerStore) AnnounceMixedPeers(ih bittorrent.InfoHash, numSeeders, numLeechers int, announcer bittorrent.Peer) (peers []bittorrent.Peer, err error) {
+	group := ps.group(announcer.IP.AddressFamily, ih)
+	log.Debug("storage: AnnounceMixedPeers", log.Fields{
+		"InfoHash":    ih.String(),
+		"numSeeders":  numSeeders,
+		"numLeechers": numLeechers,
+		"Peer":        announcer,
+	})
+
+	select {
+	case <-ps.closed:
+		panic("attempted to interact with stopped redis store")
+	default:
+	}
+
+	encodedInfoHash := ih.String()
+	encodedLeecherInfoHash := ps.leecherInfohashKey(group, encodedInfoHash)
+	encodedSeederInfoHash := ps.seederInfohashKey(group, encodedInfoHash)
+
+	conn := ps.rb.open()
+	defer conn.Close()
+
+	// The announcer may be among either.
+	seeders, leechers, err := ps.samplePeerKeys(conn, encodedSeederInfoHash, encodedLeecherInfoHash, numSeeders+1, numLeechers+1)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(seeders) == 0 && len(leechers) == 0 {
+		return nil, storage.ErrResourceDoesNotExist
+	}
+
+	announcerPK := newPeerKey(announcer)
+	peers = bittorrent.NewPeers(numSeeders + numLeechers)
+	for _, kind := range []struct {
+		peers [][]byte
+		num   int
+	}{
+		{seeders, numSeeders},
+		{leechers, numLeechers},
+	} {
+		for _, pk := range kind.peers {
+			if kind.num == 0 {
+				break
+			}
+			if serializedPeer(pk) == announcerPK {
+				continue
+			}
+
+			peers = append(peers, decodePeerKey(serializedPeer(pk)))
+			kind.num--
+		}
+	}
+
+	return
+}
+
 func (ps *peerStore) ScrapeSwarm(ih bittorrent.InfoHash, af bittorrent.AddressFamily) (resp bittorrent.Scrape) {
 	select {
 	case <-ps.closed:
@@ -629,10 +854,10 @@ func (ps *peerStore) ScrapeSwarm(ih bittorrent.InfoHash, af bittorrent.AddressFa
 	}
 
 	resp.InfoHash = ih
-	addressFamily := af.String()
+	group := ps.group(af, ih)
 	encodedInfoHash := ih.String()
-	encodedLeecherInfoHash := ps.leecherInfohashKey(addressFamily, encodedInfoHash)
-	encodedSeederInfoHash := ps.seederInfohashKey(addressFamily, encodedInfoHash)
+	encodedLeecherInfoHash := ps.leecherInfohashKey(group, encodedInfoHash)
+	encodedSeederInfoHash := ps.seederInfohashKey(group, encodedInfoHash)
 
 	conn := ps.rb.open()
 	defer conn.Close()
@@ -655,12 +880,297 @@ func (ps *peerStore) ScrapeSwarm(ih bittorrent.InfoHash, af bittorrent.AddressFa
 		return
 	}
 
+	snatches, err := redis.Int64(conn.Do("GET", ps.snatchCountKey(group, encodedInfoHash)))
+	if err != nil && !errors.Is(err, redis.ErrNil) {
+		log.Error("storage: Redis GET failure", log.Fields{
+			"key":   ps.snatchCountKey(group, encodedInfoHash),
+			"error": err,
+		})
+		return
+	}
+
 	resp.Incomplete = uint32(leechersLen)
 	resp.Complete = uint32(seedersLen)
+	resp.Snatches = uint32(snatches)
 
 	return
 }
 
+// ScrapeMany scrapes the swarms in a single pipeline.
+func (ps *peerStore) ScrapeMany(infoHashes []bittorrent.InfoHash, af bittorrent.AddressFamily) []bittorrent.Scrape {
+	select {
+	case <-ps.closed:
+		panic("attempted to interact with stopped redis store")
+	default:
+	}
+
+	scrapes := make([]bittorrent.Scrape, len(infoHashes))
+	if len(infoHashes) == 0 {
+		return scrapes
+	}
+
+	conn := ps.rb.open()
+	defer conn.Close()
+
+	for i, ih := range infoHashes {
+		scrapes[i].InfoHash = ih
+		group := ps.group(af, ih)
+		_ = conn.Send("HLEN", ps.leecherInfohashKey(group, ih.String()))
+		_ = conn.Send("HLEN", ps.seederInfohashKey(group, ih.String()))
+		_ = conn.Send("GET", ps.snatchCountKey(group, ih.String()))
+	}
+	if err := conn.Flush(); err != nil {
+		log.Error("storage: Redis pipeline failure", log.Fields{"error": err})
+		return scrapes
+	}
+
+	for i := range scrapes {
+		leechersLen, err := redis.Int64(conn.Receive())
+		if err != nil {
+			log.Error("storage: Redis HLEN failure", log.Fields{
+				"InfoHash": scrapes[i].InfoHash.String(),
+				"error":    err,
+			})
+		}
+		seedersLen, err := redis.Int64(conn.Receive())
+		if err != nil {
+			log.Error("storage: Redis HLEN failure", log.Fields{
+				"InfoHash": scrapes[i].InfoHash.String(),
+				"error":    err,
+			})
+		}
+		snatches, err := redis.Int64(conn.Receive())
+		if err != nil && !errors.Is(err, redis.ErrNil) {
+			log.Error("storage: Redis GET failure", log.Fields{
+				"InfoHash": scrapes[i].InfoHash.String(),
+				"error":    err,
+			})
+		}
+		scrapes[i].Incomplete = uint32(leechersLen)
+		scrapes[i].Complete = uint32(seedersLen)
+		scrapes[i].Snatches = uint32(snatches)
+	}
+
+	return scrapes
+}
+
+// ScrapeAll lists the infohash keys of the group hashes of the address
+// family and pipelines the lengths of all of them.
+func (ps *peerStore) ScrapeAll(af bittorrent.AddressFamily) ([]bittorrent.Scrape, error) {
+	select {
+	case <-ps.closed:
+		panic("attempted to interact with stopped redis store")
+	default:
+	}
+
+	conn := ps.rb.open()
+	defer conn.Close()
+
+	var scrapes []bittorrent.Scrape
+	indices := make(map[bittorrent.InfoHash]int)
+	for _, group := range ps.familyGroups(af) {
+		seederPrefix := ps.seederInfohashKey(group, "")
+		leecherPrefix := ps.leecherInfohashKey(group, "")
+
+		keys, err := redis.Strings(conn.Do("HKEYS", group))
+		if err != nil {
+			return nil, err
+		}
+		start := len(scrapes)
+
+		for _, key := range keys {
+			if err := conn.Send("HLEN", key); err != nil {
+				return nil, err
+			}
+		}
+		if err := conn.Flush(); err != nil {
+			return nil, err
+		}
+
+		for _, key := range keys {
+			n, err := redis.Int64(conn.Receive())
+			if err != nil {
+				return nil, err
+			}
+
+			isSeeder := strings.HasPrefix(key, seederPrefix)
+			if !isSeeder && !strings.HasPrefix(key, leecherPrefix) {
+				continue
+			}
+			ihBytes, err := hex.DecodeString(key[len(seederPrefix):])
+			if err != nil || len(ihBytes) != len(bittorrent.InfoHash{}) || n == 0 {
+				continue
+			}
+			ih := bittorrent.InfoHashFromBytes(ihBytes)
+
+			i, ok := indices[ih]
+			if !ok {
+				i = len(scrapes)
+				indices[ih] = i
+				scrapes = append(scrapes, bittorrent.Scrape{InfoHash: ih})
+			}
+			if isSeeder {
+				scrapes[i].Complete = uint32(n)
+			} else {
+				scrapes[i].Incomplete = uint32(n)
+			}
+		}
+
+		// The swarms of the group are complete, add their snatches.
+		for _, scrape := range scrapes[start:] {
+			if err := conn.Send("GET", ps.snatchCountKey(group, scrape.InfoHash.String())); err != nil {
+				return nil, err
+			}
+		}
+		if err := conn.Flush(); err != nil {
+			return nil, err
+		}
+		for i := range scrapes[start:] {
+			n, err := redis.Int64(conn.Receive())
+			if err != nil && !errors.Is(err, redis.ErrNil) {
+				return nil, err
+			}
+			scrapes[start+i].Snatches = uint32(n)
+		}
+	}
+
+	return scrapes, nil
+}
+
+// ExportPeers scans the group hashes of the address family with HSCAN.
+//
+// A swarm is exported when its seeder hash is scanned, or when its leecher
+// hash is scanned and it has no seeders, so that it isn't exported twice.
+// The cursor consists of the index of a group and the HSCAN cursor of its
+// group hash.
+func (ps *peerStore) ExportPeers(af bittorrent.AddressFamily, cursor string, limit int) ([]storage.SwarmPeer, string, error) {
+	select {
+	case <-ps.closed:
+		panic("attempted to interact with stopped redis store")
+	default:
+	}
+
+	groups := ps.familyGroups(af)
+	groupIdx, scanCursor := 0, "0"
+	if cursor != "" {
+		parts := strings.SplitN(cursor, "/", 2)
+		if len(parts) != 2 {
+			return nil, "", storage.ErrInvalidCursor
+		}
+		var err error
+		groupIdx, err = strconv.Atoi(parts[0])
+		if err != nil || groupIdx < 0 || groupIdx >= len(groups) {
+			return nil, "", storage.ErrInvalidCursor
+		}
+		if _, err := strconv.ParseUint(parts[1], 10, 64); err != nil {
+			return nil, "", storage.ErrInvalidCursor
+		}
+		scanCursor = parts[1]
+	}
+
+	conn := ps.rb.open()
+	defer conn.Close()
+
+	var peers []storage.SwarmPeer
+	for len(peers) < limit {
+		next, fields, err := hscan(conn, groups[groupIdx], scanCursor, limit)
+		if err != nil {
+			return nil, "", err
+		}
+		if peers, err = ps.exportSwarms(conn, groups[groupIdx], fields, peers); err != nil {
+			return nil, "", err
+		}
+
+		if next == "0" {
+			groupIdx++
+			if groupIdx == len(groups) {
+				return peers, "", nil
+			}
+		}
+		scanCursor = next
+	}
+
+	return peers, strconv.Itoa(groupIdx) + "/" + scanCursor, nil
+}
+
+// exportSwarms appends the peers of the swarms of the scanned fields of a
+// group hash to peers, reading all swarms in one round trip.
+func (ps *peerStore) exportSwarms(conn redis.Conn, group string, fields []string, peers []storage.SwarmPeer) ([]storage.SwarmPeer, error) {
+	seederPrefix := ps.seederInfohashKey(group, "")
+	leecherPrefix := ps.leecherInfohashKey(group, "")
+
+	var ihs []bittorrent.InfoHash
+	var isSeeder []bool
+	for i := 0; i < len(fields); i += 2 {
+		key := fields[i]
+		seeder := strings.HasPrefix(key, seederPrefix)
+		if !seeder && !strings.HasPrefix(key, leecherPrefix) {
+			continue
+		}
+		ihBytes, err := hex.DecodeString(key[len(seederPrefix):])
+		if err != nil || len(ihBytes) != len(bittorrent.InfoHash{}) {
+			continue
+		}
+		ih := bittorrent.InfoHashFromBytes(ihBytes)
+
+		// Leecher hashes only check whether the swarm has seeders.
+		if seeder {
+			_ = conn.Send("HKEYS", ps.seederInfohashKey(group, ih.String()))
+		} else {
+			_ = conn.Send("HEXISTS", group, ps.seederInfohashKey(group, ih.String()))
+		}
+		_ = conn.Send("HKEYS", ps.leecherInfohashKey(group, ih.String()))
+		ihs = append(ihs, ih)
+		isSeeder = append(isSeeder, seeder)
+	}
+	if len(ihs) == 0 {
+		return peers, nil
+	}
+	if err := conn.Flush(); err != nil {
+		return nil, err
+	}
+
+	for i, ih := range ihs {
+		var seeders []string
+		if isSeeder[i] {
+			var err error
+			if seeders, err = redis.Strings(conn.Receive()); err != nil {
+				return nil, err
+			}
+		} else {
+			hasSeeders, err := redis.Bool(conn.Receive())
+			if err != nil {
+				return nil, err
+			}
+			if hasSeeders {
+				// The swarm is exported with its seeder hash.
+				if _, err := conn.Receive(); err != nil {
+					return nil, err
+				}
+				continue
+			}
+		}
+		leechers, err := redis.Strings(conn.Receive())
+		if err != nil {
+			return nil, err
+		}
+
+		for _, pk := range seeders {
+			peers = append(peers, storage.SwarmPeer{InfoHash: ih, Peer: decodePeerKey(serializedPeer(pk)), Seeder: true})
+		}
+		for _, pk := range leechers {
+			peers = append(peers, storage.SwarmPeer{InfoHash: ih, Peer: decodePeerKey(serializedPeer(pk))})
+		}
+	}
+
+	return peers, nil
+}
+
+// CollectGarbage implements storage.GarbageCollector.
+func (ps *peerStore) CollectGarbage() error {
+	return ps.collectGarbage(time.Now().Add(-ps.cfg.PeerLifetime))
+}
+
 // collectGarbage deletes all Peers from the PeerStore which are older than the
 // cutoff time.
 //
@@ -720,104 +1230,214 @@ func (ps *peerStore) collectGarbage(cutoff time.Time) error {
 	start := time.Now()
 
 	for _, group := range ps.groups() {
-		// list all infohashes in the group
-		infohashesList, err := redis.Strings(conn.Do("HKEYS", group))
+		// iterate the infohashes in the group
+		err := scanHash(conn, group, func(ihStrs []string) error {
+			for i := 0; i < len(ihStrs); i += 2 {
+				if err := ps.collectSwarmGarbage(conn, group, ihStrs[i], cutoffUnix); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
 		if err != nil {
 			return err
 		}
+	}
 
-		for _, ihStr := range infohashesList {
-			isSeeder := len(ihStr) > 5 && ihStr[5:6] == "S"
-
-			// list all (peer, timeout) pairs for the ih
-			ihList, err := redis.Strings(conn.Do("HGETALL", ihStr))
-			if err != nil {
-				return err
-			}
+	duration := float64(time.Since(start).Nanoseconds()) / float64(time.Millisecond)
+	log.Debug("storage: recordGCDuration", log.Fields{"timeTaken(ms)": duration})
+	storage.PromGCDurationMilliseconds.Observe(duration)
 
-			var pk serializedPeer
-			var removedPeerCount int64
-			for index, ihField := range ihList {
-				if index%2 == 1 { // value
-					mtime, err := strconv.ParseInt(ihField, 10, 64)
-					if err != nil {
-						return err
-					}
-					if mtime <= cutoffUnix {
-						log.Debug("storage: deleting peer", log.Fields{
-							"Peer": decodePeerKey(pk).String(),
-						})
-						ret, err := redis.Int64(conn.Do("HDEL", ihStr, pk))
-						if err != nil {
-							return err
-						}
-
-						removedPeerCount += ret
-					}
-				} else { // key
-					pk = serializedPeer([]byte(ihField))
-				}
-			}
-			// DECR seeder/leecher counter
-			decrCounter := ps.leecherCountKey(group)
-			if isSeeder {
-				decrCounter = ps.seederCountKey(group)
-			}
-			if removedPeerCount > 0 {
-				if _, err := conn.Do("DECRBY", decrCounter, removedPeerCount); err != nil {
-					return err
-				}
-			}
+	return nil
+}
 
-			// use WATCH to avoid race condition
-			// https://redis.io/topics/transactions
-			_, err = conn.Do("WATCH", ihStr)
+// collectSwarmGarbage deletes the peers of the swarm ihStr in the group that
+// are older than the cutoff, and deletes the swarm from the group if it is
+// empty.
+func (ps *peerStore) collectSwarmGarbage(conn redis.Conn, group, ihStr string, cutoffUnix int64) error {
+	isSeeder := strings.HasPrefix(ihStr, ps.seederInfohashKey(group, ""))
+
+	// iterate the (peer, mtime) pairs of the ih
+	var removedPeerCount int64
+	err := scanHash(conn, ihStr, func(ihList []string) error {
+		args := redis.Args{ihStr}
+		for i := 0; i < len(ihList); i += 2 {
+			mtime, err := strconv.ParseInt(ihList[i+1], 10, 64)
 			if err != nil {
 				return err
 			}
-			ihLen, err := redis.Int64(conn.Do("HLEN", ihStr))
-			if err != nil {
-				return err
+			if mtime <= cutoffUnix {
+				log.Debug("storage: deleting peer", log.Fields{
+					"Peer": decodePeerKey(serializedPeer(ihList[i])).String(),
+				})
+				args = append(args, ihList[i])
 			}
-			if ihLen == 0 {
-				// Empty hashes are not shown among existing keys,
-				// in other words, it's removed automatically after `HDEL` the last field.
-				//_, err := conn.Do("DEL", ihStr)
-
-				_ = conn.Send("MULTI")
-				_ = conn.Send("HDEL", group, ihStr)
-				if isSeeder {
-					_ = conn.Send("DECR", ps.infohashCountKey(group))
-				}
-				_, err = redis.Values(conn.Do("EXEC"))
-				if err != nil && !errors.Is(err, redis.ErrNil) {
-					log.Error("storage: Redis EXEC failure", log.Fields{
-						"group":    group,
-						"infohash": ihStr,
-						"error":    err,
-					})
-				}
-			} else {
-				if _, err = conn.Do("UNWATCH"); err != nil && !errors.Is(err, redis.ErrNil) {
-					log.Error("storage: Redis UNWATCH failure", log.Fields{"error": err})
+		}
+		if len(args) == 1 {
+			return nil
+		}
+
+		ret, err := redis.Int64(conn.Do("HDEL", args...))
+		if err != nil {
+			return err
+		}
+		removedPeerCount += ret
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// DECR seeder/leecher counter
+	decrCounter := ps.leecherCountKey(group)
+	if isSeeder {
+		decrCounter = ps.seederCountKey(group)
+	}
+	if removedPeerCount > 0 {
+		if _, err := conn.Do("DECRBY", decrCounter, removedPeerCount); err != nil {
+			return err
+		}
+	}
+
+	// use WATCH to avoid race condition
+	// https://redis.io/topics/transactions
+	_, err = conn.Do("WATCH", ihStr)
+	if err != nil {
+		return err
+	}
+	ihLen, err := redis.Int64(conn.Do("HLEN", ihStr))
+	if err != nil {
+		return err
+	}
+	if ihLen == 0 {
+		// Empty hashes are not shown among existing keys,
+		// in other words, it's removed automatically after `HDEL` the last field.
+		//_, err := conn.Do("DEL", ihStr)
+
+		_ = conn.Send("MULTI")
+		_ = conn.Send("HDEL", group, ihStr)
+		if isSeeder {
+			_ = conn.Send("DECR", ps.infohashCountKey(group))
+			// The snatches are forgotten with the seeders.
+			_ = conn.Send("DEL", ps.snatchCountKey(group, strings.TrimPrefix(ihStr, ps.seederInfohashKey(group, ""))))
+		}
+		_, err = redis.Values(conn.Do("EXEC"))
+		if err != nil && !errors.Is(err, redis.ErrNil) {
+			log.Error("storage: Redis EXEC failure", log.Fields{
+				"group":    group,
+				"infohash": ihStr,
+				"error":    err,
+			})
+		}
+	} else {
+		if _, err = conn.Do("UNWATCH"); err != nil && !errors.Is(err, redis.ErrNil) {
+			log.Error("storage: Redis UNWATCH failure", log.Fields{"error": err})
+		}
+	}
+
+	return nil
+}
+
+// scanHash iterates the hash at key with HSCAN, calling fn with every batch
+// of alternating fields and values.
+//
+// Unlike HGETALL, this doesn't block redis or load the entire hash at once.
+// Fields may be passed to fn more than once and fields added or removed
+// during the iteration may be missed; fn may delete fields of the hash.
+func scanHash(conn redis.Conn, key string, fn func([]string) error) error {
+	cursor := "0"
+	for {
+		var batch []string
+		var err error
+		cursor, batch, err = hscan(conn, key, cursor, gcScanBatchSize)
+		if err != nil {
+			return err
+		}
+		if err := fn(batch); err != nil {
+			return err
+		}
+		if cursor == "0" {
+			return nil
+		}
+	}
+}
+
+// hscan requests a batch of about count fields and values of the hash,
+// starting at the cursor. It returns the cursor of the next batch, which is
+// "0" after the last one.
+func hscan(conn redis.Conn, key, cursor string, count int) (string, []string, error) {
+	reply, err := redis.Values(conn.Do("HSCAN", key, cursor, "COUNT", count))
+	if err != nil {
+		return "", nil, err
+	}
+	if len(reply) != 2 {
+		return "", nil, errors.New("storage: unexpected HSCAN reply")
+	}
+	if cursor, err = redis.String(reply[0], nil); err != nil {
+		return "", nil, err
+	}
+	batch, err := redis.Strings(reply[1], nil)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(batch)%2 != 0 {
+		return "", nil, errors.New("storage: unexpected HSCAN reply")
+	}
+	return cursor, batch, nil
+}
+
+// Clear deletes the swarms of every group, followed by its group hash and
+// counters.
+func (ps *peerStore) Clear() error {
+	select {
+	case <-ps.closed:
+		panic("attempted to interact with stopped redis store")
+	default:
+	}
+
+	conn := ps.rb.open()
+	defer conn.Close()
+
+	for _, group := range ps.groups() {
+		seederPrefix := ps.seederInfohashKey(group, "")
+		err := scanHash(conn, group, func(batch []string) error {
+			for i := 0; i < len(batch); i += 2 {
+				_ = conn.Send("DEL", batch[i])
+				if strings.HasPrefix(batch[i], seederPrefix) {
+					_ = conn.Send("DEL", ps.snatchCountKey(group, batch[i][len(seederPrefix):]))
 				}
 			}
+			_, err := conn.Do("")
+			return err
+		})
+		if err != nil {
+			return err
 		}
-	}
 
-	duration := float64(time.Since(start).Nanoseconds()) / float64(time.Millisecond)
-	log.Debug("storage: recordGCDuration", log.Fields{"timeTaken(ms)": duration})
-	storage.PromGCDurationMilliseconds.Observe(duration)
+		if _, err := conn.Do("DEL", group, ps.seederCountKey(group), ps.leecherCountKey(group), ps.infohashCountKey(group)); err != nil {
+			return err
+		}
+	}
 
+	log.Info("storage: cleared redis", log.Fields{"prefix": ps.cfg.KeyPrefix})
 	return nil
 }
 
+// Ping implements storage.Pinger by sending a PING to redis.
+func (ps *peerStore) Ping(_ context.Context) error {
+	conn := ps.rb.open()
+	defer conn.Close()
+
+	_, err := conn.Do("PING")
+	return err
+}
+
 func (ps *peerStore) Stop() stop.Result {
 	c := make(stop.Channel)
 	go func() {
 		close(ps.closed)
 		ps.wg.Wait()
-		log.Info("storage: exiting. chihaya does not clear data in redis when exiting. chihaya keys have prefix 'IPv{4,6}_'.")
+		log.Info("storage: exiting. chihaya does not clear data in redis when exiting. chihaya keys have prefix '" + ps.cfg.KeyPrefix + "IPv{4,6}'.")
 		c.Done()
 	}()
 
@@ -1,7 +1,10 @@
 package redis
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
+	"io/ioutil"
 	"net/url"
 	"strconv"
 	"strings"
@@ -19,16 +22,111 @@ type redisBackend struct {
 }
 
 // newRedisBackend creates a redisBackend instance.
-func newRedisBackend(cfg *Config, u *redisURL, socketPath string) *redisBackend {
+//
+// If the config enables the cluster mode, the hosts of the URL are the seed
+// nodes the slots of the cluster are requested from. For a sentinel URL, the
+// connections go to the master the sentinels report.
+func newRedisBackend(cfg *Config, u *redisURL, socketPath string) (*redisBackend, error) {
+	tlsConfig, err := newTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil && !u.TLS {
+		return nil, errors.New("redis TLS options require a rediss:// broker URL")
+	}
+	if u.TLS && tlsConfig == nil {
+		tlsConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+
 	rc := &redisConnector{
 		URL:            u,
 		SocketPath:     socketPath,
 		ReadTimeout:    cfg.RedisReadTimeout,
 		WriteTimeout:   cfg.RedisWriteTimeout,
 		ConnectTimeout: cfg.RedisConnectTimeout,
+		TLSConfig:      tlsConfig,
+	}
+	if u.SentinelMaster != "" {
+		if cfg.RedisCluster {
+			return nil, errors.New("redis cluster cannot be used with sentinel")
+		}
+		s := newSentinel(*rc, u.SentinelMaster, strings.Split(u.Host, ","))
+		if _, err := s.resolve(); err != nil {
+			return nil, err
+		}
+		pool := s.NewPool()
+		return &redisBackend{
+			pool:    pool,
+			redsync: redsync.New(redigo.NewPool(pool)),
+		}, nil
 	}
+	if cfg.RedisCluster {
+		if u.DB != 0 {
+			return nil, errors.New("redis cluster only supports database 0")
+		}
+		if strings.ContainsAny(cfg.KeyPrefix, "{}") {
+			// The hash tag of the prefix would place all keys in one slot.
+			return nil, errors.New("redis key prefix cannot contain braces in a cluster")
+		}
+		c := newCluster(*rc, strings.Split(u.Host, ","))
+		if err := c.refresh(); err != nil {
+			return nil, err
+		}
+		return newClusterBackend(c), nil
+	}
+
 	pool := rc.NewPool()
 	redsync := redsync.New(redigo.NewPool(pool))
+	return &redisBackend{
+		pool:    pool,
+		redsync: redsync,
+	}, nil
+}
+
+// newTLSConfig creates the TLS config of the connections from the TLS
+// options of the config. It returns nil if no option is set.
+func newTLSConfig(cfg *Config) (*tls.Config, error) {
+	if cfg.RedisTLSCAFile == "" && cfg.RedisTLSCertFile == "" && cfg.RedisTLSKeyFile == "" && !cfg.RedisTLSInsecureSkipVerify {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: cfg.RedisTLSInsecureSkipVerify,
+	}
+
+	if cfg.RedisTLSCAFile != "" {
+		pem, err := ioutil.ReadFile(cfg.RedisTLSCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in " + cfg.RedisTLSCAFile)
+		}
+	}
+
+	if cfg.RedisTLSCertFile != "" || cfg.RedisTLSKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.RedisTLSCertFile, cfg.RedisTLSKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// newClusterBackend creates a redisBackend instance for a redis cluster.
+func newClusterBackend(c *cluster) *redisBackend {
+	// The connections of the nodes are pooled per node, so cluster
+	// connections are not kept idle, which returns them to their pools.
+	pool := &redigolib.Pool{
+		Dial: func() (redigolib.Conn, error) {
+			return c.conn(), nil
+		},
+	}
+	redsync := redsync.New(redigo.NewPool(pool))
 	return &redisBackend{
 		pool:    pool,
 		redsync: redsync,
@@ -46,6 +144,7 @@ type redisConnector struct {
 	ReadTimeout    time.Duration
 	WriteTimeout   time.Duration
 	ConnectTimeout time.Duration
+	TLSConfig      *tls.Config
 }
 
 // NewPool returns a new pool of Redis connections
@@ -81,13 +180,11 @@ func (rc *redisConnector) NewPool() *redigolib.Pool {
 
 // Open a new Redis connection
 func (rc *redisConnector) open() (redigolib.Conn, error) {
-	opts := []redigolib.DialOption{
-		redigolib.DialDatabase(rc.URL.DB),
-		redigolib.DialReadTimeout(rc.ReadTimeout),
-		redigolib.DialWriteTimeout(rc.WriteTimeout),
-		redigolib.DialConnectTimeout(rc.ConnectTimeout),
-	}
+	opts := append(rc.transportOptions(), redigolib.DialDatabase(rc.URL.DB))
 
+	if rc.URL.Username != "" {
+		opts = append(opts, redigolib.DialUsername(rc.URL.Username))
+	}
 	if rc.URL.Password != "" {
 		opts = append(opts, redigolib.DialPassword(rc.URL.Password))
 	}
@@ -99,14 +196,45 @@ func (rc *redisConnector) open() (redigolib.Conn, error) {
 	return redigolib.Dial("tcp", rc.URL.Host, opts...)
 }
 
+// transportOptions returns the options for timeouts and TLS.
+func (rc *redisConnector) transportOptions() []redigolib.DialOption {
+	opts := []redigolib.DialOption{
+		redigolib.DialReadTimeout(rc.ReadTimeout),
+		redigolib.DialWriteTimeout(rc.WriteTimeout),
+		redigolib.DialConnectTimeout(rc.ConnectTimeout),
+	}
+	if rc.URL.TLS {
+		opts = append(opts,
+			redigolib.DialUseTLS(true),
+			redigolib.DialTLSConfig(rc.TLSConfig),
+		)
+	}
+	return opts
+}
+
 // A redisURL represents a parsed redisURL
 // The general form represented is:
 //
-//	redis://[password@]host][/][db]
+//	redis://[[username:]password@]host][/][db]
+//
+// The rediss scheme connects with TLS. A username selects the ACL user to
+// authenticate as.
+//
+// In cluster mode, the host may be a comma-separated list of seed nodes.
+//
+// A set of servers monitored by Sentinel is represented by the sentinel
+// addresses and the name of the master:
+//
+//	redis+sentinel://[[username:]password@]host[,host...]/master[/db]
+//
+// or rediss+sentinel for TLS.
 type redisURL struct {
-	Host     string
-	Password string
-	DB       int
+	Host           string
+	Username       string
+	Password       string
+	DB             int
+	TLS            bool
+	SentinelMaster string
 }
 
 // parseRedisURL parse rawurl into redisURL
@@ -116,21 +244,47 @@ func parseRedisURL(target string) (*redisURL, error) {
 	if err != nil {
 		return nil, err
 	}
-	if u.Scheme != "redis" {
+	scheme := u.Scheme
+	useTLS := strings.HasPrefix(scheme, "rediss")
+	if useTLS {
+		scheme = "redis" + strings.TrimPrefix(scheme, "rediss")
+	}
+	if scheme != "redis" && scheme != "redis+sentinel" {
 		return nil, errors.New("no redis scheme found")
 	}
 
 	db := 0 // default redis db
 	parts := strings.Split(u.Path, "/")
+	var master string
+	if scheme == "redis+sentinel" {
+		if len(parts) < 2 || parts[1] == "" {
+			return nil, errors.New("no sentinel master name found")
+		}
+		master = parts[1]
+		parts = parts[1:]
+	}
 	if len(parts) != 1 {
 		db, err = strconv.Atoi(parts[1])
 		if err != nil {
 			return nil, err
 		}
 	}
+	// Without a username, the user info is the password only.
+	var username, password string
+	if u.User != nil {
+		if p, ok := u.User.Password(); ok {
+			username, password = u.User.Username(), p
+		} else {
+			password = u.User.Username()
+		}
+	}
+
 	return &redisURL{
-		Host:     u.Host,
-		Password: u.User.String(),
-		DB:       db,
+		Host:           u.Host,
+		Username:       username,
+		Password:       password,
+		DB:             db,
+		TLS:            useTLS,
+		SentinelMaster: master,
 	}, nil
 }
@@ -0,0 +1,104 @@
+package redis
+
+import (
+	"github.com/gomodule/redigo/redis"
+)
+
+// The scripts change a swarm and the counters of its group atomically, so
+// that the counters cannot drift if a connection fails between commands.
+//
+// All keys of a script belong to the same group, so the scripts also work
+// in a redis cluster.
+
+// putPeerScript adds or updates a peer.
+//
+// KEYS: swarm hash, group hash, peer counter, infohash counter
+// ARGV: peer key, mtime, "1" if the infohash counter counts the swarm
+var putPeerScript = redis.NewScript(4, `
+if redis.call('HSET', KEYS[1], ARGV[1], ARGV[2]) == 1 then
+	redis.call('INCR', KEYS[3])
+end
+if redis.call('HSET', KEYS[2], KEYS[1], ARGV[2]) == 1 and ARGV[3] == '1' then
+	redis.call('INCR', KEYS[4])
+end
+return 1
+`)
+
+// deletePeerScript deletes a peer and returns the number of deleted peers.
+//
+// KEYS: swarm hash, peer counter
+// ARGV: peer key
+var deletePeerScript = redis.NewScript(2, `
+local n = redis.call('HDEL', KEYS[1], ARGV[1])
+if n == 1 then
+	redis.call('DECR', KEYS[2])
+end
+return n
+`)
+
+// graduatePeerScript moves a peer from the leechers to the seeders, adding it
+// if it was no leecher, and counts a snatch.
+//
+// KEYS: leecher hash, seeder hash, group hash, leecher counter,
+// seeder counter, infohash counter, snatch counter
+// ARGV: peer key, mtime
+var graduatePeerScript = redis.NewScript(7, `
+redis.call('INCR', KEYS[7])
+if redis.call('HDEL', KEYS[1], ARGV[1]) == 1 then
+	redis.call('DECR', KEYS[4])
+end
+if redis.call('HSET', KEYS[2], ARGV[1], ARGV[2]) == 1 then
+	redis.call('INCR', KEYS[5])
+end
+if redis.call('HSET', KEYS[3], KEYS[2], ARGV[2]) == 1 then
+	redis.call('INCR', KEYS[6])
+end
+return 1
+`)
+
+// reconcileCountersScript recounts the peers and infohashes of a group and
+// replaces its counters. It returns the number of seeders, leechers and
+// infohashes.
+//
+// The swarm hashes are read from the group hash, so they are not declared,
+// but they share the hash slot of the group.
+//
+// KEYS: group hash, seeder counter, leecher counter, infohash counter
+// ARGV: seeder hash prefix, leecher hash prefix
+var reconcileCountersScript = redis.NewScript(4, `
+local seeders, leechers, infohashes = 0, 0, 0
+for _, key in ipairs(redis.call('HKEYS', KEYS[1])) do
+	if string.sub(key, 1, #ARGV[1]) == ARGV[1] then
+		seeders = seeders + redis.call('HLEN', key)
+		infohashes = infohashes + 1
+	elseif string.sub(key, 1, #ARGV[2]) == ARGV[2] then
+		leechers = leechers + redis.call('HLEN', key)
+	end
+end
+redis.call('SET', KEYS[2], seeders)
+redis.call('SET', KEYS[3], leechers)
+redis.call('SET', KEYS[4], infohashes)
+return {seeders, leechers, infohashes}
+`)
+
+// scripts are loaded into redis when the PeerStore is created.
+var scripts = []*redis.Script{
+	putPeerScript,
+	deletePeerScript,
+	graduatePeerScript,
+	reconcileCountersScript,
+}
+
+// loadScripts loads the scripts into the script cache of redis, so that
+// they can be called by their hash.
+//
+// Scripts missing from the cache, for example after a restart of redis or
+// on other nodes of a cluster, are sent again when they are called.
+func loadScripts(conn redis.Conn) error {
+	for _, script := range scripts {
+		if err := script.Load(conn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
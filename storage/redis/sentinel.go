@@ -0,0 +1,202 @@
+package redis
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	redigolib "github.com/gomodule/redigo/redis"
+
+	"github.com/chihaya/chihaya/pkg/log"
+)
+
+// errMasterChanged marks connections to a former master.
+var errMasterChanged = errors.New("redis: master changed")
+
+// sentinel keeps track of the master of a set of redis servers monitored by
+// Sentinel.
+type sentinel struct {
+	rc         redisConnector
+	masterName string
+
+	mu sync.Mutex
+	// addrs holds the addresses of the sentinels, the one that answered last
+	// first.
+	addrs  []string
+	master string
+
+	refreshing int32
+}
+
+func newSentinel(rc redisConnector, masterName string, addrs []string) *sentinel {
+	return &sentinel{
+		rc:         rc,
+		masterName: masterName,
+		addrs:      addrs,
+	}
+}
+
+// resolve asks the sentinels for the address of the master and records it.
+func (s *sentinel) resolve() (string, error) {
+	s.mu.Lock()
+	addrs := append([]string(nil), s.addrs...)
+	s.mu.Unlock()
+
+	err := errors.New("redis: no sentinels")
+	for i, addr := range addrs {
+		var master string
+		if master, err = s.askSentinel(addr); err != nil {
+			continue
+		}
+
+		s.mu.Lock()
+		if i > 0 {
+			// Ask this sentinel first next time.
+			s.addrs[0], s.addrs[i] = s.addrs[i], s.addrs[0]
+		}
+		if s.master != master {
+			log.Info("storage: redis master changed", log.Fields{
+				"masterName": s.masterName,
+				"previous":   s.master,
+				"current":    master,
+			})
+			s.master = master
+		}
+		s.mu.Unlock()
+		return master, nil
+	}
+	return "", err
+}
+
+func (s *sentinel) askSentinel(addr string) (string, error) {
+	// The sentinels are not authenticated to.
+	conn, err := redigolib.Dial("tcp", addr, s.rc.transportOptions()...)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	reply, err := redigolib.Strings(conn.Do("SENTINEL", "get-master-addr-by-name", s.masterName))
+	if err != nil {
+		return "", err
+	}
+	if len(reply) != 2 {
+		return "", errors.New("redis: sentinel does not know master " + s.masterName)
+	}
+	return net.JoinHostPort(reply[0], reply[1]), nil
+}
+
+// current returns the last known address of the master.
+func (s *sentinel) current() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.master
+}
+
+// resolveAsync resolves the master in the background, unless that is
+// already happening.
+func (s *sentinel) resolveAsync() {
+	if !atomic.CompareAndSwapInt32(&s.refreshing, 0, 1) {
+		return
+	}
+	go func() {
+		defer atomic.StoreInt32(&s.refreshing, 0)
+		if _, err := s.resolve(); err != nil {
+			log.Error("storage: failed to resolve redis master", log.Fields{
+				"masterName": s.masterName,
+				"error":      err,
+			})
+		}
+	}()
+}
+
+// NewPool returns a pool of connections to the current master.
+//
+// Connections to a former master are closed once they are returned to the
+// pool or borrowed from it.
+func (s *sentinel) NewPool() *redigolib.Pool {
+	return &redigolib.Pool{
+		MaxIdle:     3,
+		IdleTimeout: 240 * time.Second,
+		Dial: func() (redigolib.Conn, error) {
+			addr, err := s.resolve()
+			if err != nil {
+				return nil, err
+			}
+
+			rc := s.rc
+			u := *rc.URL
+			u.Host = addr
+			rc.URL = &u
+			c, err := rc.open()
+			if err != nil {
+				return nil, err
+			}
+			return &sentinelConn{Conn: c, s: s, addr: addr}, nil
+		},
+		TestOnBorrow: func(c redigolib.Conn, t time.Time) error {
+			if err := c.Err(); err != nil {
+				return err
+			}
+			if time.Since(t) < 10*time.Second {
+				return nil
+			}
+			_, err := c.Do("PING")
+			return err
+		},
+	}
+}
+
+// sentinelConn is a connection to the master at addr.
+//
+// Errors hinting at a failover make the sentinels be asked for the master
+// again.
+type sentinelConn struct {
+	redigolib.Conn
+	s    *sentinel
+	addr string
+}
+
+// isFailoverError reports whether err is a connection error or a write
+// rejected by a replica.
+func isFailoverError(err error) bool {
+	if err == nil {
+		return false
+	}
+	var rerr redigolib.Error
+	if errors.As(err, &rerr) {
+		return strings.HasPrefix(string(rerr), "READONLY")
+	}
+	return true
+}
+
+func (c *sentinelConn) check(err error) {
+	if isFailoverError(err) {
+		c.s.resolveAsync()
+	}
+}
+
+func (c *sentinelConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	reply, err := c.Conn.Do(cmd, args...)
+	c.check(err)
+	return reply, err
+}
+
+func (c *sentinelConn) Receive() (interface{}, error) {
+	reply, err := c.Conn.Receive()
+	c.check(err)
+	return reply, err
+}
+
+func (c *sentinelConn) Err() error {
+	if err := c.Conn.Err(); err != nil {
+		return err
+	}
+	if c.s.current() != c.addr {
+		return errMasterChanged
+	}
+	return nil
+}
@@ -2,6 +2,7 @@
 package storage
 
 import (
+	"context"
 	"errors"
 	"sync"
 
@@ -23,12 +24,16 @@ type Driver interface {
 // ErrResourceDoesNotExist is the error returned by all delete methods and the
 // AnnouncePeers method of the PeerStore interface if the requested resource
 // does not exist.
-var ErrResourceDoesNotExist = bittorrent.ClientError("resource does not exist")
+var ErrResourceDoesNotExist = bittorrent.RegisterClientError("resource_not_found", "resource does not exist")
 
 // ErrDriverDoesNotExist is the error returned by NewPeerStore when a peer
 // store driver with that name does not exist.
 var ErrDriverDoesNotExist = errors.New("peer store driver with that name does not exist")
 
+// ErrInvalidCursor is the error returned by ExportPeers if the cursor was not
+// returned by the same PeerStore.
+var ErrInvalidCursor = errors.New("storage: invalid cursor")
+
 // PeerStore is an interface that abstracts the interactions of storing and
 // manipulating Peers such that it can be implemented for various data stores.
 //
@@ -72,7 +77,7 @@ type PeerStore interface {
 	DeleteLeecher(infoHash bittorrent.InfoHash, p bittorrent.Peer) error
 
 	// GraduateLeecher promotes a Leecher to a Seeder in the Swarm
-	// identified by the provided InfoHash.
+	// identified by the provided InfoHash and counts a snatch of the Swarm.
 	//
 	// If the given Peer is not present as a Leecher or the swarm does not exist
 	// already, the Peer is added as a Seeder and no error is returned.
@@ -99,8 +104,9 @@ type PeerStore interface {
 	// about a Swarm identified by the given InfoHash.
 	// The AddressFamily indicates whether or not the IPv6 swarm should be
 	// scraped.
-	// The Complete and Incomplete fields of the Scrape must be filled,
-	// filling the Snatches field is optional.
+	// The Complete, Incomplete and Snatches fields of the Scrape must be
+	// filled. Snatches are counted by GraduateLeecher and may be reset once
+	// the Swarm has no Peers left.
 	//
 	// If the Swarm does not exist, an empty Scrape and no error is returned.
 	ScrapeSwarm(infoHash bittorrent.InfoHash, addressFamily bittorrent.AddressFamily) bittorrent.Scrape
@@ -115,6 +121,213 @@ type PeerStore interface {
 	log.Fielder
 }
 
+// FullScraper is an optional interface of a PeerStore that is able to report
+// the counts of all of its Swarms, which is required to serve full scrapes.
+type FullScraper interface {
+	// ScrapeAll returns a Scrape for every non-empty Swarm of the given
+	// AddressFamily.
+	// The Complete and Incomplete fields of the Scrapes must be filled,
+	// filling the Snatches field is optional.
+	//
+	// This is expected to be expensive and should not be called for every
+	// request.
+	ScrapeAll(addressFamily bittorrent.AddressFamily) ([]bittorrent.Scrape, error)
+}
+
+// PeerMixer is an optional interface of a PeerStore that is able to return
+// the seeders and leechers of a Swarm in given numbers, which is required to
+// control the mix of seeders and leechers in announce responses.
+type PeerMixer interface {
+	// AnnounceMixedPeers returns up to numSeeders seeders followed by up to
+	// numLeechers leechers from the Swarm identified by the provided
+	// InfoHash, excluding the announcing Peer p.
+	// The returned Peers must be of the AddressFamily of p.
+	//
+	// Returns ErrResourceDoesNotExist if the provided InfoHash is not tracked.
+	AnnounceMixedPeers(infoHash bittorrent.InfoHash, numSeeders, numLeechers int, p bittorrent.Peer) (peers []bittorrent.Peer, err error)
+}
+
+// SwarmPeer is a Peer of the Swarm identified by InfoHash.
+type SwarmPeer struct {
+	InfoHash bittorrent.InfoHash
+	Peer     bittorrent.Peer
+	// Seeder is set if the Peer is a seeder, otherwise it is a leecher.
+	Seeder bool
+}
+
+// Batcher is an optional interface of a PeerStore that is able to store and
+// scrape many Swarms at once, which saves round trips to remote storages.
+//
+// Use PutPeers and ScrapeMany to fall back to single operations on
+// PeerStores that don't implement it.
+type Batcher interface {
+	// PutPeers adds or updates the Peers as seeders or leechers of their
+	// Swarms, like PutSeeder and PutLeecher do.
+	//
+	// The Peers are not necessarily added atomically; if an error is
+	// returned, some of them may have been added.
+	PutPeers(peers []SwarmPeer) error
+
+	// ScrapeMany returns a Scrape for every InfoHash, in the same order,
+	// like ScrapeSwarm does.
+	ScrapeMany(infoHashes []bittorrent.InfoHash, addressFamily bittorrent.AddressFamily) []bittorrent.Scrape
+}
+
+// PutPeers adds or updates the Peers using the Batcher implementation of the
+// PeerStore, or one by one if it has none.
+func PutPeers(ps PeerStore, peers []SwarmPeer) error {
+	if b, ok := ps.(Batcher); ok {
+		return b.PutPeers(peers)
+	}
+
+	for _, sp := range peers {
+		var err error
+		if sp.Seeder {
+			err = ps.PutSeeder(sp.InfoHash, sp.Peer)
+		} else {
+			err = ps.PutLeecher(sp.InfoHash, sp.Peer)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ScrapeMany scrapes the Swarms using the Batcher implementation of the
+// PeerStore, or one by one if it has none.
+func ScrapeMany(ps PeerStore, infoHashes []bittorrent.InfoHash, addressFamily bittorrent.AddressFamily) []bittorrent.Scrape {
+	if b, ok := ps.(Batcher); ok {
+		return b.ScrapeMany(infoHashes, addressFamily)
+	}
+
+	scrapes := make([]bittorrent.Scrape, 0, len(infoHashes))
+	for _, ih := range infoHashes {
+		scrapes = append(scrapes, ps.ScrapeSwarm(ih, addressFamily))
+	}
+	return scrapes
+}
+
+// GarbageCollector is an optional interface of a PeerStore that is able to
+// collect garbage on demand, in addition to its periodic garbage collection.
+type GarbageCollector interface {
+	// CollectGarbage deletes the Peers that have not announced within the
+	// peer lifetime of the PeerStore, like a periodic garbage collection.
+	CollectGarbage() error
+}
+
+// Pinger is an optional interface of a PeerStore that is able to cheaply check
+// whether it is responsive, for example by pinging a remote storage.
+//
+// Use Ping to check PeerStores that don't implement it.
+type Pinger interface {
+	// Ping returns an error if the PeerStore is unable to serve requests.
+	Ping(ctx context.Context) error
+}
+
+// Ping checks whether the PeerStore is responsive using its Pinger
+// implementation, or by scraping an empty Swarm if it has none.
+//
+// If the PeerStore doesn't respond before the context is done, the error of
+// the context is returned.
+func Ping(ctx context.Context, ps PeerStore) error {
+	done := make(chan error, 1)
+	go func() {
+		if p, ok := ps.(Pinger); ok {
+			done <- p.Ping(ctx)
+			return
+		}
+		_ = ps.ScrapeSwarm(bittorrent.InfoHash{}, bittorrent.IPv4)
+		done <- nil
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ClearablePeerStore is an optional interface of a PeerStore that is able to
+// delete all of its Swarms, so that shared storages can be reset, for example
+// before running the test and benchmark suites against them.
+//
+// Callers must check for it: PeerStores that cannot be cleared don't
+// implement it. Of the included PeerStores, memory, bolt, etcd and redis can
+// be cleared.
+type ClearablePeerStore interface {
+	PeerStore
+
+	// Clear deletes all Swarms and their Peers.
+	//
+	// Only the data of the PeerStore is deleted; data of other PeerStores or
+	// applications sharing the storage, for example under a different key
+	// prefix, is kept. Peers put while the PeerStore is cleared may remain.
+	Clear() error
+}
+
+// Exporter is an optional interface of a PeerStore that is able to page
+// through all of its Peers, so that Swarms can be inspected, analyzed or
+// migrated to another PeerStore.
+//
+// Use ForEachSwarm to iterate over the Swarms of an Exporter.
+type Exporter interface {
+	// ExportPeers returns the Peers of the AddressFamily following the
+	// cursor, and the cursor of the Peers after them. The empty cursor
+	// starts with the first Swarm, the returned cursor is empty after the
+	// last Swarm.
+	//
+	// The Peers of a Swarm are returned together and never split between
+	// pages. Swarms are added to a page until about limit
+	// Peers are returned, so that a page may exceed the limit, or be empty
+	// even though more Swarms follow.
+	//
+	// Swarms that change during the iteration may be skipped or returned
+	// twice.
+	//
+	// Returns ErrInvalidCursor if the cursor was not returned by the
+	// PeerStore.
+	ExportPeers(addressFamily bittorrent.AddressFamily, cursor string, limit int) (peers []SwarmPeer, next string, err error)
+}
+
+// exportPageSize is the limit of the pages requested by ForEachSwarm.
+const exportPageSize = 1000
+
+// ForEachSwarm calls fn with the seeders and leechers of every Swarm of the
+// AddressFamily, paging through them with ExportPeers.
+//
+// It stops at the first error returned by fn or the Exporter, and returns it.
+func ForEachSwarm(e Exporter, addressFamily bittorrent.AddressFamily, fn func(infoHash bittorrent.InfoHash, seeders, leechers []bittorrent.Peer) error) error {
+	var cursor string
+	for {
+		peers, next, err := e.ExportPeers(addressFamily, cursor, exportPageSize)
+		if err != nil {
+			return err
+		}
+
+		for i := 0; i < len(peers); {
+			ih := peers[i].InfoHash
+			var seeders, leechers []bittorrent.Peer
+			for ; i < len(peers) && peers[i].InfoHash == ih; i++ {
+				if peers[i].Seeder {
+					seeders = append(seeders, peers[i].Peer)
+				} else {
+					leechers = append(leechers, peers[i].Peer)
+				}
+			}
+			if err := fn(ih, seeders, leechers); err != nil {
+				return err
+			}
+		}
+
+		if next == "" {
+			return nil
+		}
+		cursor = next
+	}
+}
+
 // RegisterDriver makes a Driver available by the provided name.
 //
 // If called twice with the same name, the name is blank, or if the provided
@@ -142,11 +355,11 @@ func RegisterDriver(name string, d Driver) {
 //
 // If a driver does not exist, returns ErrDriverDoesNotExist.
 func NewPeerStore(name string, cfg interface{}) (ps PeerStore, err error) {
+	// The lock is released before the Driver is called, as drivers may
+	// create PeerStores of other drivers themselves.
 	driversM.RLock()
-	defer driversM.RUnlock()
-
-	var d Driver
 	d, ok := drivers[name]
+	driversM.RUnlock()
 	if !ok {
 		return nil, ErrDriverDoesNotExist
 	}
@@ -61,6 +61,11 @@ type (
 func runBenchmark(b *testing.B, ps PeerStore, parallel bool, sf setupFunc, ef executionFunc) {
 	bd := &benchData{generateInfohashes(), generatePeers()}
 	spacing := int32(1000 / runtime.NumCPU())
+	if c, ok := ps.(ClearablePeerStore); ok {
+		if err := c.Clear(); err != nil {
+			b.Fatal(err)
+		}
+	}
 	if sf != nil {
 		err := sf(ps, bd)
 		if err != nil {
@@ -97,6 +102,46 @@ func runBenchmark(b *testing.B, ps PeerStore, parallel bool, sf setupFunc, ef ex
 	}
 }
 
+// A Benchmark is a benchmark of the suite.
+type Benchmark struct {
+	Name string
+
+	// Run runs the benchmark against the PeerStore and stops it afterwards.
+	Run func(*testing.B, PeerStore)
+}
+
+// Benchmarks lists the benchmarks of the suite, so that they can be run with
+// testing.Benchmark outside of go test.
+var Benchmarks = []Benchmark{
+	{"Nop", Nop},
+	{"Put", Put},
+	{"Put1k", Put1k},
+	{"Put1kInfohash", Put1kInfohash},
+	{"Put1kInfohash1k", Put1kInfohash1k},
+	{"PutDelete", PutDelete},
+	{"PutDelete1k", PutDelete1k},
+	{"PutDelete1kInfohash", PutDelete1kInfohash},
+	{"PutDelete1kInfohash1k", PutDelete1kInfohash1k},
+	{"DeleteNonexist", DeleteNonexist},
+	{"DeleteNonexist1k", DeleteNonexist1k},
+	{"DeleteNonexist1kInfohash", DeleteNonexist1kInfohash},
+	{"DeleteNonexist1kInfohash1k", DeleteNonexist1kInfohash1k},
+	{"GradNonexist", GradNonexist},
+	{"GradNonexist1k", GradNonexist1k},
+	{"GradNonexist1kInfohash", GradNonexist1kInfohash},
+	{"GradNonexist1kInfohash1k", GradNonexist1kInfohash1k},
+	{"PutGradDelete", PutGradDelete},
+	{"PutGradDelete1k", PutGradDelete1k},
+	{"PutGradDelete1kInfohash", PutGradDelete1kInfohash},
+	{"PutGradDelete1kInfohash1k", PutGradDelete1kInfohash1k},
+	{"AnnounceLeecher", AnnounceLeecher},
+	{"AnnounceLeecher1kInfohash", AnnounceLeecher1kInfohash},
+	{"AnnounceSeeder", AnnounceSeeder},
+	{"AnnounceSeeder1kInfohash", AnnounceSeeder1kInfohash},
+	{"ScrapeSwarm", ScrapeSwarm},
+	{"ScrapeSwarm1kInfohash", ScrapeSwarm1kInfohash},
+}
+
 // Nop executes a no-op for each iteration.
 // It should produce the same results for each PeerStore.
 // This can be used to get an estimate of the impact of the benchmark harness
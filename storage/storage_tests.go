@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"errors"
 	"net"
 	"testing"
 
@@ -17,6 +18,8 @@ var PeerEqualityFunc = func(p1, p2 bittorrent.Peer) bool { return p1.Equal(p2) }
 
 // TestPeerStore tests a PeerStore implementation against the interface.
 func TestPeerStore(t *testing.T, p PeerStore) {
+	clearPeerStore(t, p)
+
 	testData := []struct {
 		ih   bittorrent.InfoHash
 		peer bittorrent.Peer
@@ -124,6 +127,12 @@ func TestPeerStore(t *testing.T, p PeerStore) {
 		require.Nil(t, err)
 		require.True(t, containsPeer(peers, c.peer))
 
+		// Graduating counts a snatch
+		scrape = p.ScrapeSwarm(c.ih, c.peer.IP.AddressFamily)
+		require.Equal(t, uint32(1), scrape.Incomplete)
+		require.Equal(t, uint32(1), scrape.Complete)
+		require.Equal(t, uint32(1), scrape.Snatches)
+
 		// Deleting the Peer as a Leecher should have no effect
 		err = p.DeleteLeecher(c.ih, c.peer)
 		require.Equal(t, ErrResourceDoesNotExist, err)
@@ -153,6 +162,215 @@ func TestPeerStore(t *testing.T, p PeerStore) {
 	require.Nil(t, <-e)
 }
 
+// TestFullScraper tests the FullScraper implementation of a PeerStore.
+func TestFullScraper(t *testing.T, p PeerStore) {
+	clearPeerStore(t, p)
+	fs, ok := p.(FullScraper)
+	require.True(t, ok, "PeerStore does not implement FullScraper")
+
+	ih1 := bittorrent.InfoHashFromString("00000000000000000001")
+	ih2 := bittorrent.InfoHashFromString("00000000000000000002")
+	v4Peer := bittorrent.Peer{ID: bittorrent.PeerIDFromString("99999999999999999994"), IP: bittorrent.IP{IP: net.ParseIP("99.99.99.99").To4(), AddressFamily: bittorrent.IPv4}, Port: 9994}
+	v6Peer := bittorrent.Peer{ID: bittorrent.PeerIDFromString("99999999999999999996"), IP: bittorrent.IP{IP: net.ParseIP("fc00::0001"), AddressFamily: bittorrent.IPv6}, Port: 9996}
+
+	require.Nil(t, p.GraduateLeecher(ih1, v4Peer))
+	require.Nil(t, p.PutLeecher(ih2, v4Peer))
+	require.Nil(t, p.PutLeecher(ih1, v6Peer))
+
+	scrapes, err := fs.ScrapeAll(bittorrent.IPv4)
+	require.Nil(t, err)
+	require.ElementsMatch(t, []bittorrent.Scrape{
+		{InfoHash: ih1, Complete: 1, Snatches: 1},
+		{InfoHash: ih2, Incomplete: 1},
+	}, scrapes)
+
+	scrapes, err = fs.ScrapeAll(bittorrent.IPv6)
+	require.Nil(t, err)
+	require.Equal(t, []bittorrent.Scrape{{InfoHash: ih1, Incomplete: 1}}, scrapes)
+
+	e := p.Stop()
+	require.Nil(t, <-e)
+}
+
+// TestBatcher tests the Batcher implementation of a PeerStore.
+func TestBatcher(t *testing.T, p PeerStore) {
+	clearPeerStore(t, p)
+	b, ok := p.(Batcher)
+	require.True(t, ok, "PeerStore does not implement Batcher")
+
+	ih1 := bittorrent.InfoHashFromString("00000000000000000001")
+	ih2 := bittorrent.InfoHashFromString("00000000000000000002")
+	ih3 := bittorrent.InfoHashFromString("00000000000000000003")
+	v4Peer1 := bittorrent.Peer{ID: bittorrent.PeerIDFromString("99999999999999999994"), IP: bittorrent.IP{IP: net.ParseIP("99.99.99.99").To4(), AddressFamily: bittorrent.IPv4}, Port: 9994}
+	v4Peer2 := bittorrent.Peer{ID: bittorrent.PeerIDFromString("99999999999999999995"), IP: bittorrent.IP{IP: net.ParseIP("99.99.99.98").To4(), AddressFamily: bittorrent.IPv4}, Port: 9995}
+	v6Peer := bittorrent.Peer{ID: bittorrent.PeerIDFromString("99999999999999999996"), IP: bittorrent.IP{IP: net.ParseIP("fc00::0001"), AddressFamily: bittorrent.IPv6}, Port: 9996}
+
+	require.Nil(t, b.PutPeers(nil))
+	require.Nil(t, b.PutPeers([]SwarmPeer{
+		{InfoHash: ih1, Peer: v4Peer1, Seeder: true},
+		{InfoHash: ih1, Peer: v4Peer2},
+		{InfoHash: ih2, Peer: v4Peer1},
+		{InfoHash: ih1, Peer: v6Peer, Seeder: true},
+		// Peers may be updated in the same batch.
+		{InfoHash: ih2, Peer: v4Peer1},
+	}))
+
+	require.Equal(t, []bittorrent.Scrape{
+		{InfoHash: ih2, Incomplete: 1},
+		{InfoHash: ih3},
+		{InfoHash: ih1, Complete: 1, Incomplete: 1},
+	}, b.ScrapeMany([]bittorrent.InfoHash{ih2, ih3, ih1}, bittorrent.IPv4))
+	require.Equal(t, []bittorrent.Scrape{
+		{InfoHash: ih1, Complete: 1},
+	}, b.ScrapeMany([]bittorrent.InfoHash{ih1}, bittorrent.IPv6))
+	require.Empty(t, b.ScrapeMany(nil, bittorrent.IPv4))
+
+	// The batched Peers can be deleted one by one.
+	require.Nil(t, p.DeleteLeecher(ih2, v4Peer1))
+	require.Nil(t, p.DeleteSeeder(ih1, v6Peer))
+
+	e := p.Stop()
+	require.Nil(t, <-e)
+}
+
+// TestExporter tests the Exporter implementation of a PeerStore.
+func TestExporter(t *testing.T, p PeerStore) {
+	clearPeerStore(t, p)
+	e, ok := p.(Exporter)
+	require.True(t, ok, "PeerStore does not implement Exporter")
+
+	_, _, err := e.ExportPeers(bittorrent.IPv4, "invalid", 10)
+	require.Equal(t, ErrInvalidCursor, err)
+
+	// Ten swarms of a seeder and two leechers each.
+	seeders := make(map[bittorrent.InfoHash]bittorrent.Peer)
+	leechers := make(map[bittorrent.InfoHash][]bittorrent.Peer)
+	for i := 0; i < 10; i++ {
+		ih := bittorrent.InfoHashFromString("0000000000000000000" + string(rune('a'+i)))
+		seeders[ih] = bittorrent.Peer{ID: bittorrent.PeerIDFromString("9999999999999999999" + string(rune('a'+i))), IP: bittorrent.IP{IP: net.IPv4(99, 99, 99, byte(i)).To4(), AddressFamily: bittorrent.IPv4}, Port: 9990}
+		require.Nil(t, p.PutSeeder(ih, seeders[ih]))
+		for j := 0; j < 2; j++ {
+			l := bittorrent.Peer{ID: bittorrent.PeerIDFromString("888888888888888888" + string(rune('a'+i)) + string(rune('a'+j))), IP: bittorrent.IP{IP: net.IPv4(88, 88, byte(i), byte(j)).To4(), AddressFamily: bittorrent.IPv4}, Port: 8880}
+			leechers[ih] = append(leechers[ih], l)
+			require.Nil(t, p.PutLeecher(ih, l))
+		}
+	}
+
+	// Small pages return every swarm once, without splitting it.
+	exported := make(map[bittorrent.InfoHash]int)
+	var cursor string
+	for {
+		peers, next, err := e.ExportPeers(bittorrent.IPv4, cursor, 4)
+		require.Nil(t, err)
+		for i, sp := range peers {
+			if i == 0 || peers[i-1].InfoHash != sp.InfoHash {
+				require.NotContains(t, exported, sp.InfoHash)
+			}
+			exported[sp.InfoHash]++
+			if sp.Seeder {
+				require.True(t, PeerEqualityFunc(seeders[sp.InfoHash], sp.Peer))
+			} else {
+				require.True(t, containsPeer(leechers[sp.InfoHash], sp.Peer))
+			}
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	require.Len(t, exported, 10)
+	for ih, n := range exported {
+		require.Equal(t, 3, n, ih.String())
+	}
+
+	visited := 0
+	require.Nil(t, ForEachSwarm(e, bittorrent.IPv4, func(ih bittorrent.InfoHash, s, l []bittorrent.Peer) error {
+		require.Len(t, s, 1)
+		require.Len(t, l, 2)
+		require.True(t, PeerEqualityFunc(seeders[ih], s[0]))
+		visited++
+		return nil
+	}))
+	require.Equal(t, 10, visited)
+
+	require.Nil(t, ForEachSwarm(e, bittorrent.IPv6, func(bittorrent.InfoHash, []bittorrent.Peer, []bittorrent.Peer) error {
+		return errors.New("unexpected IPv6 swarm")
+	}))
+
+	require.Nil(t, <-p.Stop())
+}
+
+// TestPeerMixer tests the PeerMixer implementation of a PeerStore.
+func TestPeerMixer(t *testing.T, p PeerStore) {
+	clearPeerStore(t, p)
+	pm, ok := p.(PeerMixer)
+	require.True(t, ok, "PeerStore does not implement PeerMixer")
+
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	var seeders, leechers []bittorrent.Peer
+	for i := 0; i < 3; i++ {
+		seeders = append(seeders, bittorrent.Peer{ID: bittorrent.PeerIDFromString("9999999999999999999" + string(rune('a'+i))), IP: bittorrent.IP{IP: net.IPv4(99, 99, 99, byte(i)).To4(), AddressFamily: bittorrent.IPv4}, Port: 9990})
+		leechers = append(leechers, bittorrent.Peer{ID: bittorrent.PeerIDFromString("8888888888888888888" + string(rune('a'+i))), IP: bittorrent.IP{IP: net.IPv4(88, 88, 88, byte(i)).To4(), AddressFamily: bittorrent.IPv4}, Port: 8880})
+		require.Nil(t, p.PutSeeder(ih, seeders[i]))
+		require.Nil(t, p.PutLeecher(ih, leechers[i]))
+	}
+
+	_, err := pm.AnnounceMixedPeers(bittorrent.InfoHashFromString("00000000000000000002"), 1, 1, leechers[0])
+	require.Equal(t, ErrResourceDoesNotExist, err)
+
+	// Seeders come first, the announcer is excluded.
+	peers, err := pm.AnnounceMixedPeers(ih, 1, 5, leechers[0])
+	require.Nil(t, err)
+	require.Len(t, peers, 3)
+	require.True(t, containsPeer(seeders, peers[0]))
+	require.True(t, containsPeer(leechers[1:], peers[1]))
+	require.True(t, containsPeer(leechers[1:], peers[2]))
+
+	peers, err = pm.AnnounceMixedPeers(ih, 2, 0, seeders[0])
+	require.Nil(t, err)
+	require.Len(t, peers, 2)
+	require.False(t, containsPeer(peers, seeders[0]))
+	require.True(t, containsPeer(seeders, peers[0]))
+	require.True(t, containsPeer(seeders, peers[1]))
+
+	e := p.Stop()
+	require.Nil(t, <-e)
+}
+
+// TestClearablePeerStore tests the Clear method of a PeerStore.
+func TestClearablePeerStore(t *testing.T, p PeerStore) {
+	c, ok := p.(ClearablePeerStore)
+	require.True(t, ok, "PeerStore does not implement ClearablePeerStore")
+
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	v4Peer := bittorrent.Peer{ID: bittorrent.PeerIDFromString("99999999999999999994"), IP: bittorrent.IP{IP: net.ParseIP("99.99.99.99").To4(), AddressFamily: bittorrent.IPv4}, Port: 9994}
+	v6Peer := bittorrent.Peer{ID: bittorrent.PeerIDFromString("99999999999999999996"), IP: bittorrent.IP{IP: net.ParseIP("fc00::0001"), AddressFamily: bittorrent.IPv6}, Port: 9996}
+
+	require.Nil(t, p.PutSeeder(ih, v4Peer))
+	require.Nil(t, p.GraduateLeecher(ih, v6Peer))
+	require.Nil(t, c.Clear())
+
+	for _, peer := range []bittorrent.Peer{v4Peer, v6Peer} {
+		_, err := p.AnnouncePeers(ih, false, 50, peer)
+		require.Equal(t, ErrResourceDoesNotExist, err)
+		require.Equal(t, bittorrent.Scrape{InfoHash: ih}, p.ScrapeSwarm(ih, peer.IP.AddressFamily))
+	}
+
+	// The PeerStore remains usable.
+	require.Nil(t, p.PutLeecher(ih, v4Peer))
+	require.Equal(t, uint32(1), p.ScrapeSwarm(ih, bittorrent.IPv4).Incomplete)
+
+	require.Nil(t, <-p.Stop())
+}
+
+// clearPeerStore clears PeerStores that implement ClearablePeerStore, so that
+// the suites can run against storages that were used before.
+func clearPeerStore(t *testing.T, p PeerStore) {
+	if c, ok := p.(ClearablePeerStore); ok {
+		require.Nil(t, c.Clear())
+	}
+}
+
 func containsPeer(peers []bittorrent.Peer, p bittorrent.Peer) bool {
 	for _, peer := range peers {
 		if PeerEqualityFunc(peer, p) {
@@ -0,0 +1,634 @@
+// Package tiered implements the storage interface for a Chihaya BitTorrent
+// tracker keeping busy swarms in a fast hot storage, such as memory, and all
+// other swarms in a cold storage, such as redis.
+//
+// Swarms start out in the cold storage. A swarm receiving enough announces
+// within the promotion window is moved to the hot storage, and moved back
+// once it received no announces for the demotion idle time.
+package tiered
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/pkg/stop"
+	"github.com/chihaya/chihaya/storage"
+)
+
+// Name is the name by which this peer store is registered with Chihaya.
+const Name = "tiered"
+
+// Default config constants.
+const (
+	defaultHotStorage         = "memory"
+	defaultPromotionAnnounces = 10
+	defaultPromotionWindow    = time.Minute
+	defaultDemotionIdle       = time.Minute * 10
+	defaultDemotionInterval   = time.Minute
+	shardCount                = 64
+)
+
+// ErrNoColdStorage is returned by New if no cold storage is configured.
+var ErrNoColdStorage = errors.New("tiered: no cold storage configured")
+
+func init() {
+	// Register the storage driver.
+	storage.RegisterDriver(Name, driver{})
+}
+
+type driver struct{}
+
+func (d driver) NewPeerStore(icfg interface{}) (storage.PeerStore, error) {
+	// Marshal the config back into bytes.
+	bytes, err := yaml.Marshal(icfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// Unmarshal the bytes into the proper config type.
+	var cfg Config
+	err = yaml.Unmarshal(bytes, &cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return New(cfg)
+}
+
+// TierConfig selects the storage driver of a tier and holds its config.
+type TierConfig struct {
+	Name   string      `yaml:"name"`
+	Config interface{} `yaml:"config"`
+}
+
+// Config holds the configuration of a tiered PeerStore.
+type Config struct {
+	Hot  TierConfig `yaml:"hot"`
+	Cold TierConfig `yaml:"cold"`
+
+	// PromotionAnnounces is the number of announces within the
+	// PromotionWindow that moves a swarm to the hot storage.
+	PromotionAnnounces int           `yaml:"promotion_announces"`
+	PromotionWindow    time.Duration `yaml:"promotion_window"`
+
+	// DemotionIdle is the time without announces after which a swarm is
+	// moved back to the cold storage. Swarms are checked every
+	// DemotionInterval.
+	DemotionIdle     time.Duration `yaml:"demotion_idle"`
+	DemotionInterval time.Duration `yaml:"demotion_interval"`
+}
+
+// LogFields renders the current config as a set of Logrus fields.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"name":               Name,
+		"hot":                cfg.Hot.Name,
+		"cold":               cfg.Cold.Name,
+		"promotionAnnounces": cfg.PromotionAnnounces,
+		"promotionWindow":    cfg.PromotionWindow,
+		"demotionIdle":       cfg.DemotionIdle,
+		"demotionInterval":   cfg.DemotionInterval,
+	}
+}
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+//
+// This function warns to the logger when a value is changed.
+func (cfg Config) Validate() Config {
+	validcfg := cfg
+
+	if cfg.Hot.Name == "" {
+		validcfg.Hot.Name = defaultHotStorage
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".Hot.Name",
+			"provided": cfg.Hot.Name,
+			"default":  validcfg.Hot.Name,
+		})
+	}
+
+	if cfg.PromotionAnnounces <= 0 {
+		validcfg.PromotionAnnounces = defaultPromotionAnnounces
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".PromotionAnnounces",
+			"provided": cfg.PromotionAnnounces,
+			"default":  validcfg.PromotionAnnounces,
+		})
+	}
+
+	if cfg.PromotionWindow <= 0 {
+		validcfg.PromotionWindow = defaultPromotionWindow
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".PromotionWindow",
+			"provided": cfg.PromotionWindow,
+			"default":  validcfg.PromotionWindow,
+		})
+	}
+
+	if cfg.DemotionIdle <= 0 {
+		validcfg.DemotionIdle = defaultDemotionIdle
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".DemotionIdle",
+			"provided": cfg.DemotionIdle,
+			"default":  validcfg.DemotionIdle,
+		})
+	}
+
+	if cfg.DemotionInterval <= 0 {
+		validcfg.DemotionInterval = defaultDemotionInterval
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".DemotionInterval",
+			"provided": cfg.DemotionInterval,
+			"default":  validcfg.DemotionInterval,
+		})
+	}
+
+	return validcfg
+}
+
+// tier is the PeerStore of a tier. Swarms are moved between tiers with the
+// PeerMixer implementation, which every tier must have.
+type tier interface {
+	storage.PeerStore
+	storage.PeerMixer
+}
+
+// New creates a new tiered PeerStore from the PeerStores of the configured
+// drivers.
+func New(provided Config) (storage.PeerStore, error) {
+	cfg := provided.Validate()
+	if cfg.Cold.Name == "" {
+		return nil, ErrNoColdStorage
+	}
+
+	hot, err := newTier(cfg.Hot)
+	if err != nil {
+		return nil, err
+	}
+	cold, err := newTier(cfg.Cold)
+	if err != nil {
+		<-hot.Stop()
+		return nil, err
+	}
+
+	ps := &peerStore{
+		cfg:    cfg,
+		hot:    hot,
+		cold:   cold,
+		closed: make(chan struct{}),
+	}
+	for i := range ps.shards {
+		ps.shards[i].swarms = make(map[bittorrent.InfoHash]*swarmState)
+	}
+
+	// Swarms restored by the hot storage, for example from a snapshot,
+	// stay hot until they are idle.
+	if e, ok := hot.(storage.Exporter); ok {
+		if err := ps.adoptHotSwarms(e); err != nil {
+			log.Error("storage: failed to list the swarms of the hot storage", log.Err(err))
+		}
+	}
+
+	// Start a goroutine for demoting idle swarms.
+	ps.wg.Add(1)
+	go func() {
+		defer ps.wg.Done()
+		t := time.NewTicker(cfg.DemotionInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ps.closed:
+				return
+			case <-t.C:
+				before := time.Now()
+				ps.demoteIdle(before.Add(-cfg.DemotionIdle), before.Add(-cfg.PromotionWindow))
+				log.Debug("storage: demoteIdle() finished", log.Fields{"timeTaken": time.Since(before)})
+			}
+		}
+	}()
+
+	return ps, nil
+}
+
+func newTier(cfg TierConfig) (tier, error) {
+	ps, err := storage.NewPeerStore(cfg.Name, cfg.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	t, ok := ps.(tier)
+	if !ok {
+		<-ps.Stop()
+		return nil, errors.New("tiered: storage " + cfg.Name + " does not implement PeerMixer")
+	}
+	return t, nil
+}
+
+// swarmState tracks the announces of a swarm and the tier it is stored in.
+//
+// Operations on a swarm hold its lock, so that it cannot move between
+// tiers in the meantime.
+type swarmState struct {
+	sync.Mutex
+	hot bool
+	// lastActive is the time of the last announce.
+	lastActive time.Time
+	// windowStart is the start of the current promotion window, announces
+	// counts the announces within it.
+	windowStart time.Time
+	announces   int
+	// removed is set once the state is deleted from its shard and must not
+	// be used anymore.
+	removed bool
+}
+
+type swarmShard struct {
+	swarms map[bittorrent.InfoHash]*swarmState
+	sync.Mutex
+}
+
+type peerStore struct {
+	cfg    Config
+	hot    tier
+	cold   tier
+	shards [shardCount]swarmShard
+
+	closed chan struct{}
+	wg     sync.WaitGroup
+}
+
+var (
+	_ storage.PeerStore   = &peerStore{}
+	_ storage.PeerMixer   = &peerStore{}
+	_ storage.FullScraper = &peerStore{}
+	_ storage.Exporter    = &peerStore{}
+	_ storage.Pinger      = &peerStore{}
+)
+
+func (ps *peerStore) shard(ih bittorrent.InfoHash) *swarmShard {
+	return &ps.shards[uint(ih[0])%shardCount]
+}
+
+// acquire returns the locked state of the swarm of the infohash. If the swarm
+// has no state, a new one is created if create is set, otherwise nil is
+// returned.
+func (ps *peerStore) acquire(ih bittorrent.InfoHash, create bool) *swarmState {
+	shard := ps.shard(ih)
+	for {
+		shard.Lock()
+		st, ok := shard.swarms[ih]
+		if !ok {
+			if !create {
+				shard.Unlock()
+				return nil
+			}
+			st = &swarmState{}
+			shard.swarms[ih] = st
+		}
+		shard.Unlock()
+
+		st.Lock()
+		if !st.removed {
+			return st
+		}
+		// The state was deleted while waiting for its lock.
+		st.Unlock()
+	}
+}
+
+// announce counts an announce of the swarm, promotes it if it became hot and
+// returns the tier it is stored in.
+//
+// The state of the swarm must be locked.
+func (ps *peerStore) announce(ih bittorrent.InfoHash, st *swarmState) tier {
+	now := time.Now()
+	st.lastActive = now
+	if st.hot {
+		return ps.hot
+	}
+
+	if now.Sub(st.windowStart) > ps.cfg.PromotionWindow {
+		st.windowStart = now
+		st.announces = 0
+	}
+	st.announces++
+	if st.announces < ps.cfg.PromotionAnnounces {
+		return ps.cold
+	}
+
+	if err := move(ih, ps.cold, ps.hot); err != nil {
+		log.Error("storage: failed to promote swarm", log.Fields{"infoHash": ih}, log.Err(err))
+		return ps.cold
+	}
+	st.hot = true
+	promPromotionsTotal.Inc()
+	return ps.hot
+}
+
+// write runs fn with the tier the swarm of the infohash is stored in,
+// counting an announce of the swarm.
+func (ps *peerStore) write(ih bittorrent.InfoHash, fn func(t tier) error) error {
+	st := ps.acquire(ih, true)
+	defer st.Unlock()
+	return fn(ps.announce(ih, st))
+}
+
+// read runs fn with the tier the swarm of the infohash is stored in.
+func (ps *peerStore) read(ih bittorrent.InfoHash, fn func(t tier)) {
+	st := ps.acquire(ih, false)
+	if st == nil {
+		fn(ps.cold)
+		return
+	}
+	defer st.Unlock()
+
+	if st.hot {
+		fn(ps.hot)
+	} else {
+		fn(ps.cold)
+	}
+}
+
+// adoptHotSwarms marks the swarms already stored in the hot storage as hot.
+func (ps *peerStore) adoptHotSwarms(e storage.Exporter) error {
+	now := time.Now()
+	for _, af := range []bittorrent.AddressFamily{bittorrent.IPv4, bittorrent.IPv6} {
+		err := storage.ForEachSwarm(e, af, func(ih bittorrent.InfoHash, _, _ []bittorrent.Peer) error {
+			st := ps.acquire(ih, true)
+			st.hot = true
+			st.lastActive = now
+			st.Unlock()
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// demoteIdle moves the hot swarms without announces since idleBefore to the
+// cold storage, and forgets the cold swarms without announces since
+// windowBefore.
+func (ps *peerStore) demoteIdle(idleBefore, windowBefore time.Time) {
+	var numHot int
+	for i := range ps.shards {
+		select {
+		case <-ps.closed:
+			return
+		default:
+		}
+
+		shard := &ps.shards[i]
+		shard.Lock()
+		states := make(map[bittorrent.InfoHash]*swarmState, len(shard.swarms))
+		for ih, st := range shard.swarms {
+			states[ih] = st
+		}
+		shard.Unlock()
+
+		for ih, st := range states {
+			st.Lock()
+			if st.hot && st.lastActive.Before(idleBefore) {
+				if err := move(ih, ps.hot, ps.cold); err != nil {
+					log.Error("storage: failed to demote swarm", log.Fields{"infoHash": ih}, log.Err(err))
+				} else {
+					st.hot = false
+					promDemotionsTotal.Inc()
+				}
+			}
+
+			if !st.hot && st.lastActive.Before(windowBefore) {
+				// Holding the lock of a state while locking its shard
+				// cannot deadlock, as acquire never holds both locks.
+				st.removed = true
+				shard.Lock()
+				delete(shard.swarms, ih)
+				shard.Unlock()
+			} else if st.hot {
+				numHot++
+			}
+			st.Unlock()
+		}
+	}
+
+	promHotSwarmsCount.Set(float64(numHot))
+}
+
+// move moves all peers of the swarm of the infohash from one tier to another.
+// The peers are only deleted from the source once the target stored them.
+//
+// Snatches and the time of the last announce of the peers are not moved.
+func move(ih bittorrent.InfoHash, from, to tier) error {
+	var peers []storage.SwarmPeer
+	for _, af := range []bittorrent.AddressFamily{bittorrent.IPv4, bittorrent.IPv6} {
+		scrape := from.ScrapeSwarm(ih, af)
+		if scrape.Complete == 0 && scrape.Incomplete == 0 {
+			continue
+		}
+
+		// The announcer is excluded from the peers, so an unspecified
+		// address is used, which no peer can have.
+		announcer := bittorrent.Peer{IP: bittorrent.IP{IP: net.IPv4zero.To4(), AddressFamily: af}}
+		if af == bittorrent.IPv6 {
+			announcer.IP.IP = net.IPv6zero
+		}
+
+		seeders, err := from.AnnounceMixedPeers(ih, int(scrape.Complete), 0, announcer)
+		if err != nil && !errors.Is(err, storage.ErrResourceDoesNotExist) {
+			return err
+		}
+		leechers, err := from.AnnounceMixedPeers(ih, 0, int(scrape.Incomplete), announcer)
+		if err != nil && !errors.Is(err, storage.ErrResourceDoesNotExist) {
+			return err
+		}
+
+		for _, p := range seeders {
+			peers = append(peers, storage.SwarmPeer{InfoHash: ih, Peer: p, Seeder: true})
+		}
+		for _, p := range leechers {
+			peers = append(peers, storage.SwarmPeer{InfoHash: ih, Peer: p})
+		}
+	}
+	if len(peers) == 0 {
+		return nil
+	}
+
+	if err := storage.PutPeers(to, peers); err != nil {
+		return err
+	}
+
+	for _, sp := range peers {
+		var err error
+		if sp.Seeder {
+			err = from.DeleteSeeder(ih, sp.Peer)
+		} else {
+			err = from.DeleteLeecher(ih, sp.Peer)
+		}
+		if err != nil && !errors.Is(err, storage.ErrResourceDoesNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ps *peerStore) PutSeeder(ih bittorrent.InfoHash, p bittorrent.Peer) error {
+	return ps.write(ih, func(t tier) error { return t.PutSeeder(ih, p) })
+}
+
+func (ps *peerStore) DeleteSeeder(ih bittorrent.InfoHash, p bittorrent.Peer) (err error) {
+	ps.read(ih, func(t tier) { err = t.DeleteSeeder(ih, p) })
+	return err
+}
+
+func (ps *peerStore) PutLeecher(ih bittorrent.InfoHash, p bittorrent.Peer) error {
+	return ps.write(ih, func(t tier) error { return t.PutLeecher(ih, p) })
+}
+
+func (ps *peerStore) DeleteLeecher(ih bittorrent.InfoHash, p bittorrent.Peer) (err error) {
+	ps.read(ih, func(t tier) { err = t.DeleteLeecher(ih, p) })
+	return err
+}
+
+func (ps *peerStore) GraduateLeecher(ih bittorrent.InfoHash, p bittorrent.Peer) error {
+	return ps.write(ih, func(t tier) error { return t.GraduateLeecher(ih, p) })
+}
+
+func (ps *peerStore) AnnouncePeers(ih bittorrent.InfoHash, seeder bool, numWant int, announcer bittorrent.Peer) (peers []bittorrent.Peer, err error) {
+	ps.read(ih, func(t tier) { peers, err = t.AnnouncePeers(ih, seeder, numWant, announcer) })
+	return peers, err
+}
+
+func (ps *peerStore) AnnounceMixedPeers(ih bittorrent.InfoHash, numSeeders, numLeechers int, announcer bittorrent.Peer) (peers []bittorrent.Peer, err error) {
+	ps.read(ih, func(t tier) { peers, err = t.AnnounceMixedPeers(ih, numSeeders, numLeechers, announcer) })
+	return peers, err
+}
+
+func (ps *peerStore) ScrapeSwarm(ih bittorrent.InfoHash, addressFamily bittorrent.AddressFamily) (scrape bittorrent.Scrape) {
+	ps.read(ih, func(t tier) { scrape = t.ScrapeSwarm(ih, addressFamily) })
+	return scrape
+}
+
+// ScrapeAll scrapes the swarms of both tiers. A swarm moving between tiers
+// in the meantime may be missing or returned twice.
+//
+// Both tiers must implement storage.FullScraper.
+func (ps *peerStore) ScrapeAll(addressFamily bittorrent.AddressFamily) ([]bittorrent.Scrape, error) {
+	var scrapes []bittorrent.Scrape
+	for _, t := range []tier{ps.hot, ps.cold} {
+		fs, ok := t.(storage.FullScraper)
+		if !ok {
+			return nil, errors.New("tiered: storage does not implement FullScraper")
+		}
+		s, err := fs.ScrapeAll(addressFamily)
+		if err != nil {
+			return nil, err
+		}
+		scrapes = append(scrapes, s...)
+	}
+	return scrapes, nil
+}
+
+// Cursor prefixes of the tiers in the cursors of ExportPeers.
+const (
+	hotCursor  = "hot/"
+	coldCursor = "cold/"
+)
+
+// ExportPeers pages through the swarms of the hot tier, followed by those of
+// the cold tier.
+//
+// Both tiers must implement storage.Exporter.
+func (ps *peerStore) ExportPeers(addressFamily bittorrent.AddressFamily, cursor string, limit int) ([]storage.SwarmPeer, string, error) {
+	t, prefix := tier(ps.hot), hotCursor
+	switch {
+	case cursor == "":
+	case strings.HasPrefix(cursor, hotCursor):
+		cursor = strings.TrimPrefix(cursor, hotCursor)
+	case strings.HasPrefix(cursor, coldCursor):
+		t, prefix = ps.cold, coldCursor
+		cursor = strings.TrimPrefix(cursor, coldCursor)
+	default:
+		return nil, "", storage.ErrInvalidCursor
+	}
+
+	e, ok := t.(storage.Exporter)
+	if !ok {
+		return nil, "", errors.New("tiered: storage does not implement Exporter")
+	}
+	peers, next, err := e.ExportPeers(addressFamily, cursor, limit)
+	if err != nil {
+		return nil, "", err
+	}
+
+	switch {
+	case next != "":
+		next = prefix + next
+	case prefix == hotCursor:
+		// Continue with the first swarm of the cold tier.
+		next = coldCursor
+	}
+	return peers, next, nil
+}
+
+// Ping implements storage.Pinger by checking both tiers.
+func (ps *peerStore) Ping(ctx context.Context) error {
+	if err := storage.Ping(ctx, ps.hot); err != nil {
+		return fmt.Errorf("hot tier: %w", err)
+	}
+	if err := storage.Ping(ctx, ps.cold); err != nil {
+		return fmt.Errorf("cold tier: %w", err)
+	}
+	return nil
+}
+
+// CollectGarbage implements storage.GarbageCollector by collecting the
+// garbage of the tiers that support it.
+func (ps *peerStore) CollectGarbage() error {
+	if gc, ok := ps.hot.(storage.GarbageCollector); ok {
+		if err := gc.CollectGarbage(); err != nil {
+			return fmt.Errorf("hot tier: %w", err)
+		}
+	}
+	if gc, ok := ps.cold.(storage.GarbageCollector); ok {
+		if err := gc.CollectGarbage(); err != nil {
+			return fmt.Errorf("cold tier: %w", err)
+		}
+	}
+	return nil
+}
+
+// Stop stops demoting swarms and both tiers. Hot swarms are not moved to the
+// cold storage, so they are lost unless the hot storage persists them.
+func (ps *peerStore) Stop() stop.Result {
+	return ps.StopContext(context.Background())
+}
+
+// StopContext implements stop.ContextStopper by passing the context on to
+// both tiers.
+func (ps *peerStore) StopContext(ctx context.Context) stop.Result {
+	c := make(stop.Channel)
+	go func() {
+		close(ps.closed)
+		ps.wg.Wait()
+
+		errs := <-stop.StopContext(ctx, ps.hot)
+		errs = append(errs, <-stop.StopContext(ctx, ps.cold)...)
+		c.Done(errs...)
+	}()
+
+	return c.Result()
+}
+
+func (ps *peerStore) LogFields() log.Fields {
+	return ps.cfg.LogFields()
+}
@@ -0,0 +1,97 @@
+package tiered
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	s "github.com/chihaya/chihaya/storage"
+	_ "github.com/chihaya/chihaya/storage/memory"
+)
+
+func memoryTier() TierConfig {
+	return TierConfig{Name: "memory", Config: map[string]interface{}{
+		"shard_count":                   4,
+		"gc_interval":                   10 * time.Minute,
+		"prometheus_reporting_interval": 10 * time.Minute,
+		"peer_lifetime":                 30 * time.Minute,
+	}}
+}
+
+func createNew() s.PeerStore {
+	ps, err := New(Config{
+		Hot:                memoryTier(),
+		Cold:               memoryTier(),
+		PromotionAnnounces: 3,
+		PromotionWindow:    time.Minute,
+		DemotionIdle:       10 * time.Minute,
+		DemotionInterval:   10 * time.Minute,
+	})
+	if err != nil {
+		panic(err)
+	}
+	return ps
+}
+
+func TestPeerStore(t *testing.T)   { s.TestPeerStore(t, createNew()) }
+func TestFullScraper(t *testing.T) { s.TestFullScraper(t, createNew()) }
+func TestPeerMixer(t *testing.T)   { s.TestPeerMixer(t, createNew()) }
+func TestExporter(t *testing.T)    { s.TestExporter(t, createNew()) }
+
+func TestNoColdStorage(t *testing.T) {
+	_, err := New(Config{Hot: memoryTier()})
+	require.Equal(t, ErrNoColdStorage, err)
+}
+
+func TestPromotionAndDemotion(t *testing.T) {
+	ps := createNew().(*peerStore)
+	defer func() { require.Nil(t, <-ps.Stop()) }()
+
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	seeder := bittorrent.Peer{ID: bittorrent.PeerIDFromString("99999999999999999991"), IP: bittorrent.IP{IP: net.ParseIP("1.1.1.1").To4(), AddressFamily: bittorrent.IPv4}, Port: 1}
+	leecher := bittorrent.Peer{ID: bittorrent.PeerIDFromString("99999999999999999992"), IP: bittorrent.IP{IP: net.ParseIP("fc00::1"), AddressFamily: bittorrent.IPv6}, Port: 2}
+	scrapes := func(t tier) (v4, v6 bittorrent.Scrape) {
+		return t.ScrapeSwarm(ih, bittorrent.IPv4), t.ScrapeSwarm(ih, bittorrent.IPv6)
+	}
+
+	// The swarm stays cold below the promotion threshold.
+	require.Nil(t, ps.PutSeeder(ih, seeder))
+	require.Nil(t, ps.PutLeecher(ih, leecher))
+	v4, v6 := scrapes(ps.cold)
+	require.Equal(t, uint32(1), v4.Complete)
+	require.Equal(t, uint32(1), v6.Incomplete)
+	v4, _ = scrapes(ps.hot)
+	require.Equal(t, uint32(0), v4.Complete)
+
+	// The third announce moves the swarm to the hot storage.
+	require.Nil(t, ps.PutSeeder(ih, seeder))
+	v4, v6 = scrapes(ps.hot)
+	require.Equal(t, uint32(1), v4.Complete)
+	require.Equal(t, uint32(1), v6.Incomplete)
+	v4, v6 = scrapes(ps.cold)
+	require.Equal(t, uint32(0), v4.Complete)
+	require.Equal(t, uint32(0), v6.Incomplete)
+	require.Equal(t, uint32(1), ps.ScrapeSwarm(ih, bittorrent.IPv6).Incomplete)
+
+	// Active swarms stay hot.
+	ps.demoteIdle(time.Now().Add(-time.Minute), time.Now().Add(-time.Minute))
+	v4, _ = scrapes(ps.hot)
+	require.Equal(t, uint32(1), v4.Complete)
+
+	// Idle swarms are moved back and forgotten.
+	ps.demoteIdle(time.Now().Add(time.Minute), time.Now().Add(time.Minute))
+	v4, v6 = scrapes(ps.cold)
+	require.Equal(t, uint32(1), v4.Complete)
+	require.Equal(t, uint32(1), v6.Incomplete)
+	v4, _ = scrapes(ps.hot)
+	require.Equal(t, uint32(0), v4.Complete)
+	require.Nil(t, ps.acquire(ih, false))
+
+	// The announce window starts over.
+	require.Nil(t, ps.PutSeeder(ih, seeder))
+	v4, _ = scrapes(ps.cold)
+	require.Equal(t, uint32(1), v4.Complete)
+}
@@ -0,0 +1,30 @@
+package tiered
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func init() {
+	prometheus.MustRegister(
+		promPromotionsTotal,
+		promDemotionsTotal,
+		promHotSwarmsCount,
+	)
+}
+
+var (
+	promPromotionsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "chihaya_storage_tiered_promotions_total",
+		Help: "The number of swarms moved to the hot storage",
+	})
+
+	promDemotionsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "chihaya_storage_tiered_demotions_total",
+		Help: "The number of swarms moved to the cold storage",
+	})
+
+	promHotSwarmsCount = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "chihaya_storage_tiered_hot_swarms_count",
+		Help: "The number of swarms in the hot storage",
+	})
+)